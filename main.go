@@ -1,25 +1,58 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/gob"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/fnv"
 	"io"
 	"log"
+	"math"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/http/httptrace"
 	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path"
+	"path/filepath"
+	"plugin"
 	"regexp"
+	"regexp/syntax"
+	"runtime"
+	"runtime/debug"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
 	"unicode/utf8"
 )
@@ -32,30 +65,235 @@ type BodyReplacement struct {
 	compiledRegex *regexp.Regexp // Скомпилированный regex (не сериализуется)
 }
 
+// QueryRewrite описывает изменение query параметра в запросе к серверу
+type QueryRewrite struct {
+	Param        string         `json:"param"`  // Имя параметра (для remove и replace поддерживается wildcard *)
+	Action       string         `json:"action"` // "set" (по умолчанию), "add", "remove" или "replace"
+	Value        string         `json:"value"`  // Значение для set/add или замена для replace ($1 - группа regex)
+	Find         string         `json:"find"`   // Regex значения: для replace - что заменить, для remove - какие значения удалить
+	compiledFind *regexp.Regexp // Скомпилированный Find (не сериализуется)
+}
+
+// Condition узел дерева условий правила: all/any/not объединяют вложенные условия,
+// остальные поля задают проверки одного узла (все должны выполняться)
+type Condition struct {
+	All []*Condition `json:"all,omitempty"` // Все вложенные условия
+	Any []*Condition `json:"any,omitempty"` // Хотя бы одно вложенное условие
+	Not *Condition   `json:"not,omitempty"` // Условие не выполнено
+	Ref string       `json:"ref,omitempty"` // Имя условия из conditions конфигурации
+
+	Method       string `json:"method,omitempty"`        // Метод, несколько через |: "POST|PUT"
+	URL          string `json:"url,omitempty"`           // Wildcard паттерн пути (* - любые символы)
+	URLRegex     string `json:"url_regex,omitempty"`     // Regex пути
+	Header       string `json:"header,omitempty"`        // Имя заголовка запроса
+	Query        string `json:"query,omitempty"`         // Имя query параметра
+	BodyJSON     string `json:"body_json,omitempty"`     // Путь в JSON теле запроса: "user.role", "items.0.id"
+	BodyContains string `json:"body_contains,omitempty"` // Подстрока тела запроса
+	BodyRegex    string `json:"body_regex,omitempty"`    // Regex тела запроса
+
+	// Проверки значения header/query/body_json (без них проверяется наличие)
+	Equals   *string `json:"equals,omitempty"`
+	Contains string  `json:"contains,omitempty"`
+	Regex    string  `json:"regex,omitempty"`
+	Exists   *bool   `json:"exists,omitempty"`
+
+	resolvedRef        *Condition     // Условие по ссылке ref (не сериализуется)
+	compiledURLRegex   *regexp.Regexp // Скомпилированные regex (не сериализуются)
+	compiledBodyRegex  *regexp.Regexp
+	compiledValueRegex *regexp.Regexp
+}
+
+// SSEEvent описывает синтетическое SSE событие для вставки в поток
+type SSEEvent struct {
+	Event       string `json:"event"`        // Тип события (пусто = message)
+	Data        string `json:"data"`         // Данные события (многострочные отправляются несколькими data:)
+	ID          string `json:"id"`           // Идентификатор события (id:)
+	AfterEvents int    `json:"after_events"` // После скольких событий сервера отправить (0 = в начале потока)
+}
+
+// ResponseFault описывает повреждение ответа для проверки обработки ошибок клиентом
+type ResponseFault struct {
+	TruncateAfter      int `json:"truncate_after"`       // Оборвать соединение после N байт тела (0 = не обрывать)
+	CorruptBytes       int `json:"corrupt_bytes"`        // Сколько случайных байт тела инвертировать
+	ContentLengthDelta int `json:"content_length_delta"` // Добавить к Content-Length (отрицательное значение - меньше реального)
+}
+
+// RateLimitSimulation описывает ответ 429 с Retry-After и проверку того, что клиент выждал паузу
+type RateLimitSimulation struct {
+	RetryAfter string `json:"retry_after"` // Пауза, которую должен выждать клиент (по умолчанию 1s)
+	HTTPDate   bool   `json:"http_date"`   // Retry-After в виде HTTP даты вместо секунд
+	ClientKey  string `json:"client_key"`  // Ключ клиента: "ip" (по умолчанию) или имя заголовка
+	StatusCode int    `json:"status_code"` // Статус ответа (по умолчанию 429)
+}
+
 // ResponseOverride конфигурация для подмены ответа
 type ResponseOverride struct {
-	Name             string            `json:"name"`              // Имя правила для логов
-	Method           string            `json:"method"`            // HTTP метод (* для любого)
-	URLPattern       string            `json:"url_pattern"`       // Паттерн URL (поддерживает regex)
-	IsRegex          bool              `json:"is_regex"`          // Использовать regex для паттерна
-	StatusCode       int               `json:"status_code"`       // HTTP статус код
-	Headers          map[string]string `json:"headers"`           // Заголовки ответа
-	BodyFile         string            `json:"body_file"`         // Путь к файлу с телом ответа
-	BodyText         string            `json:"body_text"`         // Текст ответа (альтернатива файлу)
-	BodyReplacements []BodyReplacement `json:"body_replacements"` // Замены в теле ответа
-	Enabled          bool              `json:"enabled"`           // Включено ли правило
-	TriggerAfter     int               `json:"trigger_after"`     // После скольких запросов срабатывать (0 = сразу)
-	MaxTriggers      int               `json:"max_triggers"`      // Максимальное количество срабатываний (-1 = бесконечно)
-	ResetAfter       int               `json:"reset_after"`       // Сброс счетчика через N запросов (0 = не сбрасывать)
-	compiledRegex    *regexp.Regexp    // Скомпилированный regex (не сериализуется)
-	requestCount     int               // Счетчик запросов (не сериализуется)
-	triggerCount     int               // Счетчик срабатываний (не сериализуется)
-	mutex            sync.Mutex        // Мьютекс для безопасности (не сериализуется)
+	Name                 string                       `json:"name"`                   // Имя правила для логов
+	Method               string                       `json:"method"`                 // HTTP метод (* для любого)
+	URLPattern           string                       `json:"url_pattern"`            // Паттерн URL (поддерживает regex)
+	IsRegex              bool                         `json:"is_regex"`               // Использовать regex для паттерна
+	MatchType            string                       `json:"match_type"`             // Сравнение url_pattern: "contains" (по умолчанию), "exact", "prefix", "glob", "regex"
+	CaseInsensitive      bool                         `json:"case_insensitive"`       // Сравнивать URL без учета регистра
+	MatchFullURL         bool                         `json:"match_full_url"`         // Сравнивать url_pattern с полным URL: схема, хост, путь и query
+	RequestContentTypes  []string                     `json:"request_content_types"`  // Content-Type запроса (пусто = любой, поддерживает "image/*")
+	ResponseContentTypes []string                     `json:"response_content_types"` // Content-Type ответа сервера (только для body_replacements)
+	Response             string                       `json:"response"`               // Имя шаблона ответа из responses конфигурации
+	StatusCode           int                          `json:"status_code"`            // HTTP статус код
+	Headers              map[string]string            `json:"headers"`                // Заголовки ответа
+	BodyFile             string                       `json:"body_file"`              // Путь к файлу с телом ответа, директории или glob ("responses/users/*.json")
+	BodyFileOrder        string                       `json:"body_file_order"`        // Выбор файла из директории/glob: "round_robin" (по умолчанию) или "random"
+	BodyText             string                       `json:"body_text"`              // Текст ответа (альтернатива файлу)
+	BodyTemplate         bool                         `json:"body_template"`          // Тело - Go шаблон с данными запроса и генератором {{fake.Name}}
+	BodyReplacements     []BodyReplacement            `json:"body_replacements"`      // Замены в теле ответа
+	Recompress           string                       `json:"recompress"`             // Кодирование измененного тела: "gzip", "br" (через плагин), "identity"; пусто - как у ответа сервера
+	RateLimit            *RateLimitSimulation         `json:"rate_limit"`             // Ответ 429 с Retry-After и проверкой соблюдения паузы клиентом
+	Fault                *ResponseFault               `json:"fault"`                  // Повреждение ответа (обрыв, битые байты, неверный Content-Length)
+	HTMLInject           string                       `json:"html_inject"`            // HTML фрагмент для вставки в text/html ответы (например, <script>)
+	HTMLInjectPosition   string                       `json:"html_inject_position"`   // Куда вставлять: "body_end" (перед </body>, по умолчанию) или "head" (в начало <head>)
+	Script               string                       `json:"script"`                 // Команда скрипта-обработчика, например "node transform.js"
+	ScriptTimeout        string                       `json:"script_timeout"`         // Таймаут скрипта (по умолчанию 10s)
+	TransformURL         string                       `json:"transform_url"`          // URL внешнего обработчика: POST с запросом и ответом, ответ обработчика отправляется клиенту
+	TransformTimeout     string                       `json:"transform_timeout"`      // Таймаут внешнего обработчика (по умолчанию 10s)
+	WebhookURL           string                       `json:"webhook_url"`            // URL для уведомления о срабатывании (дополнительно к RULE_WEBHOOK_URL)
+	RequestSchemaFile    string                       `json:"request_schema_file"`    // Путь к JSON Schema для проверки тела запроса
+	SchemaAction         string                       `json:"schema_action"`          // Действие при ошибке валидации: "reject" (по умолчанию) или "log"
+	SchemaErrorStatus    int                          `json:"schema_error_status"`    // HTTP статус отказа при ошибке валидации (по умолчанию 400)
+	Matcher              string                       `json:"matcher"`                // Имя зарегистрированного matcher - дополнительное условие срабатывания
+	When                 *Condition                   `json:"when"`                   // Дерево условий (all/any/not) по методу, URL, заголовкам, query и телу
+	ExcludeURLPatterns   []string                     `json:"exclude_url_patterns"`   // Wildcard паттерны URL-исключений, на которых правило не срабатывает
+	Transformers         []string                     `json:"transformers"`           // Имена зарегистрированных transformer для обработки ответа
+	SSEDropEvents        []string                     `json:"sse_drop_events"`        // Типы SSE событий (event:), которые не передаются клиенту
+	SSEInjectEvents      []SSEEvent                   `json:"sse_inject_events"`      // Синтетические SSE события
+	Enabled              bool                         `json:"enabled"`                // Включено ли правило
+	TriggerAfter         int                          `json:"trigger_after"`          // После скольких запросов срабатывать (0 = сразу)
+	MaxTriggers          int                          `json:"max_triggers"`           // Максимальное количество срабатываний (-1 = бесконечно)
+	ResetAfter           int                          `json:"reset_after"`            // Сброс счетчика через N запросов (0 = не сбрасывать)
+	Cooldown             string                       `json:"cooldown"`               // Пауза после срабатывания, например "30s" (пусто = без паузы)
+	MaxConcurrent        int                          `json:"max_concurrent"`         // Максимум одновременных срабатываний (0 = без ограничений)
+	QueryRewrites        []QueryRewrite               `json:"query_rewrites"`         // Изменения query параметров в запросе к серверу
+	ForwardMethod        string                       `json:"forward_method"`         // Метод запроса к серверу вместо исходного (туннелирование, например "POST")
+	ForwardMethodHeader  string                       `json:"forward_method_header"`  // Заголовок, в котором серверу передается исходный метод (X-HTTP-Method-Override)
+	Timeout              string                       `json:"timeout"`                // Таймаут запроса к серверу, например "5s" ("0" = без ограничений, пусто = по умолчанию)
+	Log                  *LogOverride                 `json:"log"`                    // Настройки логирования для запросов, на которых сработало правило
+	Tags                 []string                     `json:"tags"`                   // Теги, которые получают все запросы, подходящие под условия правила
+	compiledRegex        *regexp.Regexp               // Скомпилированный regex (не сериализуется)
+	cooldownDuration     time.Duration                // Распарсенный Cooldown (не сериализуется)
+	scriptTimeout        time.Duration                // Распарсенный ScriptTimeout (не сериализуется)
+	transformTimeout     time.Duration                // Распарсенный TransformTimeout (не сериализуется)
+	requestTimeout       time.Duration                // Распарсенный Timeout (не сериализуется)
+	requestSchema        interface{}                  // Загруженная JSON Schema (не сериализуется)
+	schemaViolations     int64                        // Счетчик запросов, не прошедших валидацию (атомарный, не сериализуется)
+	requestSeq           int64                        // Номер последнего запроса, прошедшего условия, включая отклоненные лимитами (атомарный, не сериализуется)
+	matchCount           int64                        // Всего запросов, прошедших условия, без сброса, включая отклоненные лимитами (атомарный, не сериализуется)
+	closeMisses          []RuleCloseMiss              // Запросы, почти совпавшие с правилом (не сериализуется)
+	triggers             atomic.Pointer[triggerState] // Срабатывания текущего цикла reset_after (не сериализуется)
+	activeTriggers       int64                        // Количество выполняющихся срабатываний (атомарный, не сериализуется)
+	bodyFileIndex        uint64                       // Счетчик round_robin выбора файла (атомарный, не сериализуется)
+	retryAfterDuration   time.Duration                // Распарсенный RateLimit.RetryAfter (не сериализуется)
+	backoffUntil         map[string]time.Time         // Клиенты в паузе Retry-After и ее окончание (не сериализуется)
+	rateLimited          int                          // Отправлено ответов 429 (не сериализуется)
+	backoffViolations    int                          // Повторы до окончания Retry-After (не сериализуется)
+	backoffRespected     int                          // Повторы после окончания Retry-After (не сериализуется)
+	mutex                sync.Mutex                   // Защищает closeMisses и состояние rate_limit; счетчики атомарные (не сериализуется)
+}
+
+// triggerState срабатывания правила в цикле reset_after. Заменяется целиком через CompareAndSwap:
+// лимит срабатываний и пауза проверяются и учитываются одной операцией
+type triggerState struct {
+	cycle int64 // Номер цикла reset_after (0 без reset_after)
+	count int64
+	last  time.Time
 }
 
 // Config конфигурация всех подмен
 type Config struct {
-	Overrides []ResponseOverride `json:"overrides"`
+	Conditions  map[string]*Condition       `json:"conditions,omitempty"`      // Именованные условия для ссылок {"ref": "имя"} в when
+	Responses   map[string]ResponseTemplate `json:"responses,omitempty"`       // Именованные шаблоны ответов для поля response правил
+	HostHeaders []HostHeaderPolicy          `json:"host_headers,omitempty"`    // Заголовки, которые всегда добавляются или удаляются для хостов
+	Signing     []RequestSigner             `json:"request_signing,omitempty"` // HMAC подпись запросов к серверам
+	Routes      []RouteSettings             `json:"routes,omitempty"`          // Логирование, кеш и upstream прокси для маршрутов
+	Budgets     []Budget                    `json:"budgets,omitempty"`         // Лимиты вызовов, объема и задержки сценария (/_proxy/budget)
+	Ordering    []OrderingRule              `json:"ordering,omitempty"`        // Порядок вызовов: first до then (/_proxy/ordering)
+	Checksums   []ExpectedChecksum          `json:"checksums,omitempty"`       // Ожидаемые хеши тел ответов по URL
+	Overrides   []ResponseOverride          `json:"overrides"`
+	raw         map[string]json.RawMessage  // Исходный JSON файла: правки через /_proxy/rules сохраняются без подстановки переменных
+	diagnostics []RuleDiagnostic            // Ошибки и замечания к паттернам правил, найденные при загрузке
+}
+
+// RuleDiagnostic ошибка или замечание к паттерну правила
+type RuleDiagnostic struct {
+	Rule    string `json:"rule"`
+	Field   string `json:"field"` // url_pattern, body_replacements[0].find, query_rewrites[1].find
+	Pattern string `json:"pattern"`
+	Level   string `json:"level"` // error - паттерн не работает, warning - подозрительный паттерн
+	Code    string `json:"code"`  // compile_error, mock_content_types, nested_quantifier, large_repeat, complex, broad_match
+	Message string `json:"message"`
+}
+
+// HostHeaderPolicy заголовки запросов к серверам, подходящим под паттерн хоста
+type HostHeaderPolicy struct {
+	Host   string            `json:"host"`   // Wildcard паттерн хоста: "*.internal.example.com", "api.example.com:8443"
+	Set    map[string]string `json:"set"`    // Заголовки, которые устанавливаются (значения могут ссылаться на переменные окружения ${NAME})
+	Remove []string          `json:"remove"` // Заголовки, которые удаляются
+}
+
+// RequestSigner HMAC подпись запросов к серверам, подходящим под паттерн хоста: прокси вычисляет
+// подпись канонической строки и добавляет заголовок, клиенту не нужно реализовывать схему
+type RequestSigner struct {
+	Host            string   `json:"host"`             // Wildcard паттерн хоста, как в host_headers
+	URL             string   `json:"url"`              // Wildcard паттерн пути (пусто - все запросы к хосту)
+	Header          string   `json:"header"`           // Заголовок подписи (по умолчанию X-Signature)
+	Algorithm       string   `json:"algorithm"`        // hmac-sha256 (по умолчанию), hmac-sha1, hmac-sha512
+	Key             string   `json:"key"`              // Секрет, может ссылаться на переменную окружения ${NAME}
+	KeyEncoding     string   `json:"key_encoding"`     // raw (по умолчанию), hex, base64
+	Canonical       []string `json:"canonical"`        // Части строки: method, path, query, host, body, body_sha256, timestamp, header:Имя
+	Separator       *string  `json:"separator"`        // Разделитель частей (по умолчанию перевод строки)
+	Encoding        string   `json:"encoding"`         // Кодирование подписи: hex (по умолчанию), base64
+	Prefix          string   `json:"prefix"`           // Префикс значения: "HMAC-SHA256 "
+	TimestampHeader string   `json:"timestamp_header"` // Заголовок с временем подписи в секундах Unix
+	key             []byte
+	hash            func() hash.Hash
+	signed          int64 // атомарный
+}
+
+// RouteSettings настройки маршрута; поля, которые не заданы, берутся из переменных окружения
+type RouteSettings struct {
+	Pattern       string       `json:"pattern"`        // Wildcard паттерн URL запроса: "/api/*", "*/stream*"
+	Log           *LogOverride `json:"log"`            // Как поле log правила
+	Streaming     *bool        `json:"streaming"`      // ENABLE_STREAMING для маршрута
+	Cache         *RouteCache  `json:"cache"`          // Кеширование маршрута
+	UpstreamProxy string       `json:"upstream_proxy"` // URL прокси или "direct" - без прокси
+	cacheTTL      time.Duration
+	proxyURL      *url.URL
+	requests      int64 // атомарный
+}
+
+// RouteCache кеширование маршрута: ttl включает кеш даже без CACHE_TTL
+type RouteCache struct {
+	Enabled    *bool    `json:"enabled"`
+	TTL        string   `json:"ttl"`
+	KeyHeaders []string `json:"key_headers"`
+}
+
+// RouteConfig настройки, действующие для запроса: глобальные с учетом секции routes
+type RouteConfig struct {
+	Log      *LogSettings
+	Cache    *CacheSettings
+	Proxy    *ProxySettings
+	Client   *http.Client   // Клиент с upstream прокси маршрута
+	settings *RouteSettings // nil - маршрут не найден, действуют глобальные настройки
+}
+
+type routeConfigKey struct{}
+
+// ResponseTemplate общий ответ нескольких правил; поля правила имеют приоритет над шаблоном
+type ResponseTemplate struct {
+	StatusCode    int               `json:"status_code"`
+	Headers       map[string]string `json:"headers"`
+	BodyFile      string            `json:"body_file"`
+	BodyFileOrder string            `json:"body_file_order"`
+	BodyText      string            `json:"body_text"`
+	BodyTemplate  bool              `json:"body_template"`
 }
 
 // LogSettings настройки логирования
@@ -64,11 +302,36 @@ type LogSettings struct {
 	ShowResponseBody    bool
 	ShowRequestHeaders  bool
 	ShowResponseHeaders bool
+	ShowTLSInfo         bool   // Логировать параметры TLS соединений с сервером
+	ShowTiming          bool   // Логировать фазы запроса к серверу (DNS, TCP, TLS, TTFB, передача)
 	BodyLogMode         string // "full", "truncate", "none", "json_full"
 	MaxLogLength        int
-	EnableStreaming     bool // Включить стриминговый режим (без буферизации)
+	EnableStreaming     bool           // Включить стриминговый режим (без буферизации)
+	Routes              []RouteLogMode // Режим логирования для маршрутов (LOG_ROUTES)
+	IncludePatterns     []string       // Логировать только эти URL (LOG_INCLUDE_PATTERNS)
+	ExcludePatterns     []string       // Не логировать эти URL совсем (LOG_EXCLUDE_PATTERNS)
+	SampleRate          int            // Заголовки и тела логируются для 1 из N запросов (LOG_SAMPLE_RATE)
+	Muted               bool           // Логи обработки запроса заглушены фильтром URL (только в контексте запроса)
+}
+
+// RouteLogMode режим логирования тел для маршрута: BODY_LOG_MODE или "quiet" (без заголовков и тел)
+type RouteLogMode struct {
+	Pattern string
+	Mode    string
 }
 
+// LogOverride переопределяет настройки логирования для правила (пустые поля - как глобально)
+type LogOverride struct {
+	RequestBody     *bool  `json:"request_body"`
+	ResponseBody    *bool  `json:"response_body"`
+	RequestHeaders  *bool  `json:"request_headers"`
+	ResponseHeaders *bool  `json:"response_headers"`
+	BodyLogMode     string `json:"body_log_mode"`
+	MaxLogLength    int    `json:"max_log_length"`
+}
+
+type logSettingsContextKey struct{}
+
 // ProxySettings настройки прокси
 type ProxySettings struct {
 	Enabled       bool
@@ -77,6 +340,15 @@ type ProxySettings struct {
 	Password      string
 	SkipTLSVerify bool
 	Timeout       time.Duration
+	RouteTimeouts []RouteTimeout // Таймауты по паттернам URL (ROUTE_TIMEOUTS)
+
+	ExpectContinueTimeout time.Duration // Ожидание 100 Continue от сервера перед отправкой тела
+}
+
+// RouteTimeout таймаут запроса к серверу для паттерна URL
+type RouteTimeout struct {
+	Pattern string
+	Timeout time.Duration // 0 = без ограничений
 }
 
 // CacheEntry запись в кеше
@@ -88,17 +360,37 @@ type CacheEntry struct {
 	ExpiresAt   time.Time
 	RequestURL  string
 	RequestHash string
+	Namespace   string // Пространство кеша (пусто в файлах старых версий = default)
 }
 
 // CacheSettings настройки кеширования
 type CacheSettings struct {
-	Enabled     bool
-	TTL         time.Duration
-	KeyHeaders  []string // Дополнительные заголовки для ключа кеша
-	URLPatterns []string // Паттерны URL для кеширования (с поддержкой wildcard *)
+	Enabled           bool
+	TTL               time.Duration
+	KeyHeaders        []string                // Дополнительные заголовки для ключа кеша
+	URLPatterns       []string                // Паттерны URL для кеширования (с поддержкой wildcard *)
+	ExcludePatterns   []string                // Паттерны URL, которые не кешируются и не читаются из кеша
+	NamespaceHeader   string                  // Заголовок запроса с пространством кеша (CACHE_NAMESPACE_HEADER)
+	NamespacePatterns []CacheNamespacePattern // Пространства по паттернам URL (CACHE_NAMESPACES)
+	Coalesce          bool                    // Одновременные промахи ждут ответа первого запроса (CACHE_COALESCE)
+	LockTimeout       time.Duration           // Максимальное ожидание чужого ответа (CACHE_LOCK_TIMEOUT)
+}
+
+// CacheNamespacePattern пространство кеша для паттерна URL
+type CacheNamespacePattern struct {
+	Pattern   string
+	Namespace string
 }
 
-var config Config
+var config atomic.Pointer[Config]        // Снимок конфигурации: при перезагрузке и правках заменяется целиком, не изменяется
+var configFile string                    // Файл правил основной конфигурации (OVERRIDE_CONFIG)
+var configPersist bool                   // Записывать правки правил через /_proxy/rules обратно в файл (CONFIG_PERSIST)
+var configStrict bool                    // Отклонять конфигурацию с ошибками и замечаниями к паттернам (CONFIG_STRICT)
+var adminToken string                    // Токен изменяющих запросов к служебным эндпоинтам (ADMIN_TOKEN); пусто - только с localhost
+var adminUnsafeRules bool                // Разрешить script и body_file в правилах, присланных через API (ADMIN_ALLOW_UNSAFE_RULES)
+var rejectedDiagnostics []RuleDiagnostic // Замечания последней отклоненной загрузки файла (под rejectedMutex)
+var rejectedMutex sync.Mutex
+var rulesEditMutex sync.Mutex
 var logSettings LogSettings
 var proxySettings ProxySettings
 var cacheSettings CacheSettings
@@ -110,9 +402,49 @@ var cacheModified int32     // Флаг изменения кеша (атома
 var cachePersistFile string // Путь к файлу кеша
 
 func main() {
+	// Источник случайных чисел нужен и для selftest (генератор данных в шаблонах)
+	setupRandomSeed()
+
+	// Версия сборки для отчетов об ошибках
+	if len(os.Args) > 1 && (os.Args[1] == "--version" || os.Args[1] == "-version" || os.Args[1] == "version") {
+		fmt.Println(versionString())
+		return
+	}
+
+	// Проверка правил подмены на примерах запросов (для CI)
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		os.Exit(runSelfTest(os.Args[2:]))
+	}
+
+	// Сравнение журналов запросов двух прогонов
+	if len(os.Args) > 1 && os.Args[1] == "compare" {
+		os.Exit(runJournalCompare(os.Args[2:]))
+	}
+
+	// Импорт сессий Fiddler и Charles в правила подмены
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		os.Exit(runSessionImport(os.Args[2:]))
+	}
+
+	// Прогон команды через прокси с проверкой бюджетов после ее завершения
+	if len(os.Args) > 1 && os.Args[1] == "run" {
+		runCommand = os.Args[2:]
+		if len(runCommand) > 0 && runCommand[0] == "--" {
+			runCommand = runCommand[1:]
+		}
+		if len(runCommand) == 0 {
+			fmt.Println("Использование: go run main.go run -- <команда> [аргументы]")
+			fmt.Println("  Команда получает адрес прокси в PROXY_URL; после ее завершения проверяются бюджеты (budgets)")
+			os.Exit(2)
+		}
+	}
+
 	// Получаем целевой хост из переменной окружения
 	targetHost := os.Getenv("PROXY_TARGET")
-	isProxyMode := targetHost == ""
+
+	// Серверы, смонтированные на префиксы пути (локальный API шлюз)
+	setupMounts()
+	isProxyMode := targetHost == "" && len(mounts) == 0
 
 	// Получаем порт для локального сервера
 	port := os.Getenv("PROXY_PORT")
@@ -126,62 +458,211 @@ func main() {
 	// Настраиваем кеширование
 	setupCacheSettings()
 
-	// Путь к файлу кеша
+	// Способ хранения и путь к файлу кеша
+	if value := strings.ToLower(os.Getenv("CACHE_BACKEND")); value != "" {
+		cacheBackendName = value
+	}
 	cachePersistFile = os.Getenv("CACHE_FILE")
 	if cachePersistFile == "" {
-		cachePersistFile = "cache.gob"
+		switch cacheBackendName {
+		case "snapshot":
+			cachePersistFile = "cache.gob"
+		case "log":
+			cachePersistFile = "cache.log"
+		default:
+			cachePersistFile = "cache.db"
+		}
 	}
 
-	// Восстанавливаем кеш из файла если включено кеширование
+	// Настраиваем прокси
+	setupProxySettings()
+
+	// Настраиваем параметры TLS для соединений с сервером
+	setupTLSSettings()
+
+	// Загружаем дескрипторы protobuf
+	setupProtobufSettings()
+
+	// Настраиваем обработку cookies
+	setupCookieSettings()
+
+	// Загружаем профили User-Agent
+	setupClientProfiles()
+
+	// Настраиваем очистку заголовков клиента
+	setupHeaderScrub()
+
+	// Регистр имен и повторяющиеся заголовки в запросах к серверу
+	setupHeaderCasing()
+
+	// Передача запросов на сервер байт в байт, минуя net/http
+	setupRawPassthrough()
+
+	// Keep-alive соединений с клиентом и сервером по маршрутам
+	setupKeepAlive()
+
+	// Замена метода по X-HTTP-Method-Override
+	setupMethodOverride()
+
+	// Сдвиг времени в заголовках ответов
+	setupClockSkew()
+
+	// Сжатие ответов клиентам
+	setupClientCompression()
+
+	// Загружаем OpenAPI спецификацию для проверки ответов
+	setupOpenAPISettings()
+
+	// Проверка контрольных сумм тел ответов сервера
+	setupChecksumVerification()
+
+	// Режим обслуживания (включается и через /_proxy/maintenance)
+	setupMaintenance()
+
+	// Счетчики запросов по эндпоинтам
+	setupEndpointStats()
+
+	// Обнаружение повторных одинаковых запросов
+	setupDuplicateDetection()
+
+	// Журнал запросов для проверок /_proxy/verify
+	setupRequestJournal()
+
+	// Политика для запросов, которых нет в правилах
+	setupUnmatchedPolicy()
+
+	// Точки останова для ручной проверки и изменения запросов
+	setupBreakpoints()
+
+	// Ворота, собирающие запросы для одновременной отправки (гонки на сервере)
+	setupRequestGates()
+
+	// Автоконфигурация прокси для браузеров и устройств (PAC)
+	setupPacSettings()
+
+	// Глобальный webhook для уведомлений о срабатывании правил
+	ruleWebhookURL = os.Getenv("RULE_WEBHOOK_URL")
+
+	// Настраиваем экспорт событий трафика в Kafka/NATS
+	setupStreamExport()
+
+	// Настраиваем архивирование тел в S3-совместимое хранилище
+	setupArchiveSettings()
+
+	// Запись трафика в PCAP файл для Wireshark
+	setupPcapExport()
+
+	// Кеш DNS и ручные адреса хостов для подключений к серверу
+	setupDNSCache()
+
+	// Семейство адресов (IPv4/IPv6) для подключений к серверу
+	setupDialSettings()
+
+	// Задержки и потери пакетов на соединениях с сервером
+	setupNetworkShaping()
+
+	// Исходящий адрес или интерфейс для подключений к серверу
+	setupOutboundSource()
+
+	// Создаем HTTP клиент с настройками прокси
+	setupHTTPClient()
+
+	// Загружаем плагины (до конфигурации, чтобы правила могли ссылаться на их matcher и transformer)
+	loadPlugins()
+
+	// Восстанавливаем кеш если включено кеширование (хранилище CACHE_BACKEND может быть из плагина)
 	if cacheSettings.Enabled {
-		loadCacheFromDisk()
+		restoreCache()
 		// Запускаем горутину для периодического сохранения
 		go cachePersistenceWorker()
 	}
 
-	// Настраиваем прокси
-	setupProxySettings()
+	// Обмен записями кеша с другими экземплярами прокси
+	setupCachePeers()
 
-	// Создаем HTTP клиент с настройками прокси
-	setupHTTPClient()
+	// Подключаем TLS отпечаток клиента из плагина
+	setupTLSFingerprint()
+
+	// Открываем базу трафика (драйвер SQLite может быть зарегистрирован плагином)
+	setupTrafficStore()
 
 	// Загружаем конфигурацию подмен
-	configFile := os.Getenv("OVERRIDE_CONFIG")
+	configFile = os.Getenv("OVERRIDE_CONFIG")
 	if configFile == "" {
 		configFile = "overrides.json"
 	}
+	configPersist = os.Getenv("CONFIG_PERSIST") == "true"
+	configStrict = os.Getenv("CONFIG_STRICT") == "true"
+	adminToken = os.Getenv("ADMIN_TOKEN")
+	adminUnsafeRules = os.Getenv("ADMIN_ALLOW_UNSAFE_RULES") == "true"
 	loadConfig(configFile)
 
+	// Загружаем арендаторов с собственными наборами правил
+	loadTenants()
+
 	// Создаем handler для обработки запросов
 	var handler http.Handler
 
 	if isProxyMode {
 		// Режим HTTP прокси - берём URL из запроса
 		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Обрабатываем статистику
-			if r.URL.Path == "/_proxy_stats" {
-				showStats(w, r)
+			// Обрабатываем статистику и служебные эндпоинты
+			if handleAdminRequest(w, r) {
 				return
 			}
 			handleProxyMode(w, r)
 		})
 	} else {
-		// Режим forward proxy - фиксированный целевой хост
-		targetURL, err := url.Parse(targetHost)
-		if err != nil {
-			log.Fatalf("Ошибка парсинга целевого URL: %v", err)
+		// Режим forward proxy - фиксированный целевой хост (или несколько через запятую)
+		var fallback http.Handler
+		if targetHost != "" {
+			setupUpstreams(targetHost)
+			fallback = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				proxyRequest(w, r, selectUpstream(w, r))
+			})
 		}
+		routes := mountHandler(fallback)
+
+		// Активные проверки здоровья upstream и смонтированных серверов
+		setupHealthChecks()
 
 		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Обрабатываем статистику
-			if r.URL.Path == "/_proxy_stats" {
-				showStats(w, r)
+			// Обрабатываем статистику и служебные эндпоинты
+			if handleAdminRequest(w, r) {
 				return
 			}
-			proxyRequest(w, r, targetURL)
+			routes.ServeHTTP(w, r)
 		})
 	}
 
+	// Оборачиваем handler зарегистрированными middleware
+	handler = applyMiddlewares(handler)
+
+	// Сжимаем или распаковываем ответы клиентам по маршрутам
+	handler = compressionHandler(handler)
+
+	// Сдвигаем время в заголовках ответов (расхождение часов клиента и сервера)
+	handler = clockSkewHandler(handler)
+
+	// Собираем сводки обменов для экспорта трафика
+	handler = trafficCaptureHandler(handler)
+
+	// Теги правил доступны сводкам обменов и статистике
+	handler = requestTagsHandler(handler)
+
+	// Проверяем порядок вызовов клиента (секция ordering)
+	handler = orderingHandler(handler)
+
+	// Считаем запросы, ошибки и задержку по эндпоинтам
+	handler = endpointStatsHandler(handler)
+
+	// Учитываем вызовы, объем и задержку в бюджетах сценария
+	handler = budgetHandler(handler)
+
+	// Закрываем соединения после ответа по маршрутам
+	handler = keepAliveHandler(handler)
+
+	log.Printf("📦 %s", versionString())
 	log.Printf("Прокси сервер запущен на http://127.0.0.1:%s", port)
 	if isProxyMode {
 		log.Printf("🌐 Режим: HTTP Proxy (целевой URL берётся из запроса)")
@@ -189,23 +670,106 @@ func main() {
 		log.Printf("💡 Пример: DialContext подключается к 127.0.0.1:%s", port)
 	} else {
 		log.Printf("🎯 Режим: Forward Proxy")
-		log.Printf("Проксирование запросов на: %s", targetHost)
-		targetURL, _ := url.Parse(targetHost)
-		if targetURL.Path != "" && targetURL.Path != "/" {
-			log.Printf("Базовый path: %s", targetURL.Path)
+		for _, mount := range mounts {
+			log.Printf("🚪 %s/* → %s%s", mount.Prefix, mount.Target.String(), mountStripDescription(mount))
+		}
+		for _, upstream := range upstreams {
+			log.Printf("Проксирование запросов на: %s", upstream.URL.String())
+			if upstream.URL.Path != "" && upstream.URL.Path != "/" {
+				log.Printf("Базовый path: %s", upstream.URL.Path)
+			}
+		}
+		if len(upstreams) > 1 {
+			log.Printf("⚖️  Балансировка: round-robin, привязка сессий: %s", affinityDescription())
 		}
 	}
 	log.Printf("Конфигурация подмен: %s", configFile)
-	log.Printf("Активных правил подмены: %d", countActiveOverrides())
+	if configPersist {
+		log.Printf("💾 Правки правил через /_proxy/rules сохраняются в %s (предыдущая версия - %s.bak)", configFile, configFile)
+	}
+	if configStrict {
+		log.Printf("🛡️  CONFIG_STRICT: конфигурация с ошибками и замечаниями к паттернам не применяется")
+	}
+	if adminToken != "" {
+		log.Printf("🔐 Изменяющие запросы к /_proxy требуют ADMIN_TOKEN")
+	} else {
+		log.Printf("🔐 Изменяющие запросы к /_proxy принимаются только с localhost (ADMIN_TOKEN не задан)")
+	}
+	if adminUnsafeRules {
+		log.Printf("⚠️  ADMIN_ALLOW_UNSAFE_RULES: правила через API могут задавать script и body_file")
+	}
+	log.Printf("Активных правил подмены: %d", countActiveOverrides(nil))
 	log.Printf("Статистика доступна на: http://127.0.0.1:%s/_proxy_stats", port)
+	log.Printf("Перезагрузка правил: kill -HUP %d, перезапуск бинарника: kill -USR2 %d или curl -X POST http://127.0.0.1:%s/_proxy_restart", os.Getpid(), os.Getpid(), port)
 	printLogSettings()
 	printCacheSettings()
+	printCachePeerSettings()
 	printProxySettings()
+	printHealthCheckSettings()
+	printTLSSettings()
+	printDNSSettings()
+	printDialSettings()
+	printNetworkShapingSettings()
+	printOutboundSourceSettings()
+	printProtobufSettings()
+	printCookieSettings()
+	printClientProfileSettings()
+	printHeaderScrubSettings()
+	printHeaderCasingSettings()
+	printRawPassthroughSettings()
+	printKeepAliveSettings()
+	printMethodOverrideSettings()
+	printClockSkewSettings()
+	printClientCompressionSettings()
+	printRandomSettings()
+	printOpenAPISettings()
+	printChecksumSettings()
+	printMaintenanceSettings()
+	printEndpointStatsSettings()
+	printDuplicateDetectionSettings()
+	printRequestJournalSettings()
+	printUnmatchedPolicySettings()
+	printPluginSettings()
+	printTenantSettings()
+	printStreamExportSettings()
+	printArchiveSettings()
+	printTrafficStoreSettings()
+	printPcapExportSettings()
+	printBreakpointSettings()
+	printRequestGateSettings()
+	printPacSettings()
+	if ruleWebhookURL != "" {
+		log.Printf("🔔 Уведомления о срабатывании правил: %s", ruleWebhookURL)
+		log.Printf("")
+	}
+
+	// Перезагружаем правила по SIGHUP, перезапускаем бинарник по SIGUSR2
+	go watchReloadSignal(configFile)
+	go watchRestartSignal()
+
+	// Запускаем сервер (на сокете, переданном предыдущим процессом, если это перезапуск)
+	listener, err := createListener(port)
+	if err != nil {
+		log.Fatalf("Ошибка запуска сервера: %v", err)
+	}
+	proxyServer = &http.Server{Handler: rawHeaderHandler(logFilterHandler(tenantHandler(handler, nil))), ConnState: trackClientConnState, ConnContext: rawHeaderConnContext}
+	proxyListener = listener
+
+	// Арендаторы с собственным портом
+	startTenantServers(handler)
 
-	// Запускаем сервер
-	if err := http.ListenAndServe("0.0.0.0:"+port, handler); err != nil {
+	// Сокет уже слушает - команда прогона может сразу отправлять запросы
+	if len(runCommand) > 0 {
+		go runAndVerify(port)
+	}
+
+	if err := proxyServer.Serve(wrapRawHeaderListener(wrapRawPassthroughListener(listener))); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Ошибка запуска сервера: %v", err)
 	}
+
+	// Serve завершается сразу после остановки приема соединений - дожидаемся текущих запросов
+	<-shutdownDone
+	log.Printf("👋 Процесс завершен, соединения обслуживает новый процесс")
 }
 
 func setupLogSettings() {
@@ -216,6 +780,8 @@ func setupLogSettings() {
 	// Настройки логирования headers
 	logSettings.ShowRequestHeaders = os.Getenv("LOG_REQUEST_HEADERS") != "false"
 	logSettings.ShowResponseHeaders = os.Getenv("LOG_RESPONSE_HEADERS") != "false"
+	logSettings.ShowTLSInfo = os.Getenv("LOG_TLS_INFO") != "false"
+	logSettings.ShowTiming = os.Getenv("LOG_UPSTREAM_TIMING") != "false"
 
 	// Режим логирования body
 	logSettings.BodyLogMode = strings.ToLower(os.Getenv("BODY_LOG_MODE"))
@@ -233,9 +799,277 @@ func setupLogSettings() {
 
 	// Настройка стримингового режима
 	logSettings.EnableStreaming = os.Getenv("ENABLE_STREAMING") == "true"
+
+	// Запросы, которым буферизация не нужна, передаются потоком и без ENABLE_STREAMING
+	autoPassthrough = os.Getenv("AUTO_PASSTHROUGH") != "false"
+
+	// Режимы логирования маршрутов: "/api/payments/*=full,/healthcheck=quiet"
+	if routes := os.Getenv("LOG_ROUTES"); routes != "" {
+		for _, item := range strings.Split(routes, ",") {
+			parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+			if len(parts) != 2 || parts[0] == "" || !isLogMode(strings.TrimSpace(parts[1])) {
+				log.Printf("⚠️  Неверный формат LOG_ROUTES: %s", item)
+				continue
+			}
+			logSettings.Routes = append(logSettings.Routes, RouteLogMode{Pattern: strings.TrimSpace(parts[0]), Mode: strings.ToLower(strings.TrimSpace(parts[1]))})
+		}
+	}
+
+	// Фильтрация логов по URL: шумные эндпоинты (health checks, polling) не логируются совсем
+	for _, pattern := range strings.Split(os.Getenv("LOG_INCLUDE_PATTERNS"), ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			logSettings.IncludePatterns = append(logSettings.IncludePatterns, pattern)
+		}
+	}
+	for _, pattern := range strings.Split(os.Getenv("LOG_EXCLUDE_PATTERNS"), ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			logSettings.ExcludePatterns = append(logSettings.ExcludePatterns, pattern)
+		}
+	}
+
+	// Выборочное логирование заголовков и тел при высокой нагрузке
+	logSettings.SampleRate = 1
+	if value := os.Getenv("LOG_SAMPLE_RATE"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			logSettings.SampleRate = parsed
+		} else {
+			log.Printf("⚠️  Неверный формат LOG_SAMPLE_RATE: %s, логируются все запросы", value)
+		}
+	}
+}
+
+func isLogMode(mode string) bool {
+	switch strings.ToLower(mode) {
+	case "full", "truncate", "none", "json_full", "quiet":
+		return true
+	}
+	return false
+}
+
+// resolveLogSettings применяет к настройкам маршрута режим LOG_ROUTES и настройки сработавшего правила.
+// Поле log маршрута из секции routes заменяет режим LOG_ROUTES
+func resolveLogSettings(route *RouteConfig, tenant *Tenant, fullURL string, override *ResponseOverride) *LogSettings {
+	settings := *route.Log
+	changed := false
+	// Явные настройки маршрута, арендатора или правила выборкой не отменяются
+	explicit := route.settings != nil && route.settings.Log != nil
+	if !explicit {
+		for _, logRoute := range logSettings.Routes {
+			if !matchURLPattern(fullURL, logRoute.Pattern) {
+				continue
+			}
+			applyLogMode(&settings, logRoute.Mode)
+			changed = true
+			explicit = true
+			break
+		}
+	}
+
+	// Профиль клиента (арендатор) задает уровень логирования своих запросов, правило - уточняет
+	if tenant != nil && tenant.Log != nil {
+		applyLogOverride(&settings, tenant.Log)
+		changed = true
+		explicit = true
+	}
+
+	if override != nil && override.Log != nil {
+		applyLogOverride(&settings, override.Log)
+		changed = true
+		explicit = true
+	}
+
+	// Запросы вне выборки логируются без заголовков и тел, но учитываются в статистике
+	if !explicit && logSettings.SampleRate > 1 && (atomic.AddUint64(&logSampleCounter, 1)-1)%uint64(logSettings.SampleRate) != 0 {
+		atomic.AddInt64(&logSampledOut, 1)
+		settings.ShowRequestHeaders = false
+		settings.ShowResponseHeaders = false
+		settings.ShowRequestBody = false
+		settings.ShowResponseBody = false
+		changed = true
+	}
+
+	if !changed {
+		return route.Log
+	}
+	return &settings
+}
+
+// applyLogOverride применяет поле log правила или маршрута
+func applyLogOverride(settings *LogSettings, rule *LogOverride) {
+	// Сначала режим ("quiet" скрывает все), затем явные флаги
+	if rule.BodyLogMode != "" {
+		applyLogMode(settings, strings.ToLower(rule.BodyLogMode))
+	}
+	if rule.RequestBody != nil {
+		settings.ShowRequestBody = *rule.RequestBody
+	}
+	if rule.ResponseBody != nil {
+		settings.ShowResponseBody = *rule.ResponseBody
+	}
+	if rule.RequestHeaders != nil {
+		settings.ShowRequestHeaders = *rule.RequestHeaders
+	}
+	if rule.ResponseHeaders != nil {
+		settings.ShowResponseHeaders = *rule.ResponseHeaders
+	}
+	if rule.MaxLogLength > 0 {
+		settings.MaxLogLength = rule.MaxLogLength
+	}
+}
+
+var logSampleCounter uint64 // Счетчик запросов для LOG_SAMPLE_RATE (атомарный)
+var logSampledOut int64     // Запросы, залогированные без заголовков и тел (атомарный)
+
+// applyLogMode устанавливает режим логирования тел; "quiet" скрывает заголовки и тела
+func applyLogMode(settings *LogSettings, mode string) {
+	if mode == "quiet" {
+		settings.ShowRequestHeaders = false
+		settings.ShowResponseHeaders = false
+		settings.ShowRequestBody = false
+		settings.ShowResponseBody = false
+		return
+	}
+	settings.BodyLogMode = mode
+}
+
+// requestLogSettings возвращает настройки логирования запроса (глобальные, если не переопределены)
+func requestLogSettings(r *http.Request) *LogSettings {
+	if r != nil {
+		if settings, ok := r.Context().Value(logSettingsContextKey{}).(*LogSettings); ok {
+			return settings
+		}
+	}
+	return &logSettings
+}
+
+// resolveRouteConfig находит маршрут секции routes (арендатора или основной конфигурации) для URL запроса
+func resolveRouteConfig(r *http.Request, fullURL string) *RouteConfig {
+	routes := currentRoutes(r)
+	for i := range routes {
+		route := &routes[i]
+		if route.Pattern == "" || !matchURLPattern(fullURL, route.Pattern) {
+			continue
+		}
+		atomic.AddInt64(&route.requests, 1)
+		return route.config()
+	}
+	return globalRouteConfig()
+}
+
+// globalRouteConfig настройки из переменных окружения
+func globalRouteConfig() *RouteConfig {
+	return &RouteConfig{Log: &logSettings, Cache: &cacheSettings, Proxy: &proxySettings, Client: httpClient}
+}
+
+// config копирует глобальные настройки и применяет к ним поля маршрута
+func (route *RouteSettings) config() *RouteConfig {
+	logs := logSettings
+	if route.Log != nil {
+		applyLogOverride(&logs, route.Log)
+	}
+	if route.Streaming != nil {
+		logs.EnableStreaming = *route.Streaming
+	}
+
+	cache := cacheSettings
+	if route.Cache != nil {
+		if route.cacheTTL > 0 {
+			cache.TTL = route.cacheTTL
+			cache.Enabled = true
+		}
+		if route.Cache.Enabled != nil {
+			// Без ttl маршрута и CACHE_TTL срок хранения неизвестен - кеш не включается
+			cache.Enabled = *route.Cache.Enabled && cache.TTL > 0
+		}
+		if len(route.Cache.KeyHeaders) > 0 {
+			cache.KeyHeaders = route.Cache.KeyHeaders
+		}
+	}
+
+	proxy := proxySettings
+	client := httpClient
+	if route.UpstreamProxy == "direct" {
+		proxy.Enabled = false
+		proxy.URL = ""
+		client = routeClient("direct", nil)
+	} else if route.proxyURL != nil {
+		proxy.Enabled = true
+		proxy.URL = route.proxyURL.Redacted()
+		client = routeClient(route.UpstreamProxy, route.proxyURL)
+	}
+	return &RouteConfig{Log: &logs, Cache: &cache, Proxy: &proxy, Client: client, settings: route}
+}
+
+var routeClients = make(map[string]*http.Client) // Клиенты по upstream прокси маршрутов
+var routeClientsMutex sync.Mutex
+
+// routeClient возвращает клиент с отдельным пулом соединений для upstream прокси маршрута (nil - напрямую)
+func routeClient(key string, proxyURL *url.URL) *http.Client {
+	routeClientsMutex.Lock()
+	defer routeClientsMutex.Unlock()
+	client, ok := routeClients[key]
+	if !ok {
+		transport := httpClient.Transport.(*http.Transport).Clone()
+		transport.Proxy = nil
+		if proxyURL != nil {
+			transport.Proxy = http.ProxyURL(proxyURL)
+		}
+		client = &http.Client{Transport: transport}
+		routeClients[key] = client
+	}
+	return client
+}
+
+// requestRouteConfig возвращает настройки маршрута запроса (глобальные, если маршрут не найден)
+func requestRouteConfig(r *http.Request) *RouteConfig {
+	if r != nil {
+		if route, ok := r.Context().Value(routeConfigKey{}).(*RouteConfig); ok {
+			return route
+		}
+	}
+	return globalRouteConfig()
+}
+
+func resetRouteCounters(routes []RouteSettings) {
+	for i := range routes {
+		atomic.StoreInt64(&routes[i].requests, 0)
+	}
+}
+
+func routeStats(r *http.Request) []map[string]interface{} {
+	routes := currentRoutes(r)
+	stats := make([]map[string]interface{}, 0, len(routes))
+	for i := range routes {
+		route := &routes[i]
+		config := route.config()
+		upstream := route.UpstreamProxy
+		if route.proxyURL != nil {
+			upstream = route.proxyURL.Redacted()
+		}
+		stats = append(stats, map[string]interface{}{
+			"pattern":        route.Pattern,
+			"streaming":      config.Log.EnableStreaming,
+			"cache":          config.Cache.Enabled,
+			"cache_ttl":      config.Cache.TTL.String(),
+			"upstream_proxy": upstream,
+			"requests":       atomic.LoadInt64(&route.requests),
+		})
+	}
+	return stats
 }
 
 func setupCacheSettings() {
+	// Объединение промахов действует и для кеша маршрутов (секция routes)
+	cacheSettings.Coalesce = os.Getenv("CACHE_COALESCE") == "true"
+	cacheSettings.LockTimeout = 10 * time.Second
+	if value := os.Getenv("CACHE_LOCK_TIMEOUT"); value != "" {
+		if timeout, err := time.ParseDuration(value); err == nil && timeout > 0 {
+			cacheSettings.LockTimeout = timeout
+		} else {
+			log.Printf("⚠️  Неверный формат CACHE_LOCK_TIMEOUT: %s, используется 10s", value)
+		}
+	}
+
 	cacheTTLStr := os.Getenv("CACHE_TTL")
 	if cacheTTLStr == "" {
 		cacheSettings.Enabled = false
@@ -269,6 +1103,29 @@ func setupCacheSettings() {
 			cacheSettings.URLPatterns[i] = strings.TrimSpace(cacheSettings.URLPatterns[i])
 		}
 	}
+
+	// Исключения внутри кешируемых URL
+	if excludePatterns := os.Getenv("CACHE_EXCLUDE_PATTERNS"); excludePatterns != "" {
+		for _, pattern := range strings.Split(excludePatterns, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				cacheSettings.ExcludePatterns = append(cacheSettings.ExcludePatterns, pattern)
+			}
+		}
+	}
+
+	// Пространства кеша: по заголовку запроса или паттернам URL
+	cacheSettings.NamespaceHeader = os.Getenv("CACHE_NAMESPACE_HEADER")
+	if namespaces := os.Getenv("CACHE_NAMESPACES"); namespaces != "" {
+		for _, item := range strings.Split(namespaces, ",") {
+			parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				log.Printf("⚠️  Неверный формат CACHE_NAMESPACES: %s", item)
+				continue
+			}
+			cacheSettings.NamespacePatterns = append(cacheSettings.NamespacePatterns,
+				CacheNamespacePattern{Pattern: strings.TrimSpace(parts[0]), Namespace: strings.TrimSpace(parts[1])})
+		}
+	}
 }
 
 func printCacheSettings() {
@@ -276,6 +1133,7 @@ func printCacheSettings() {
 	if cacheSettings.Enabled {
 		log.Printf("   Enabled: ✅")
 		log.Printf("   TTL: %v", cacheSettings.TTL)
+		log.Printf("   Backend: %s (%s)", cacheBackendName, cachePersistFile)
 		if len(cacheSettings.KeyHeaders) > 0 {
 			log.Printf("   Key Headers: %v", cacheSettings.KeyHeaders)
 		}
@@ -284,6 +1142,18 @@ func printCacheSettings() {
 		} else {
 			log.Printf("   URL Patterns: все URL (паттерны не заданы)")
 		}
+		if len(cacheSettings.ExcludePatterns) > 0 {
+			log.Printf("   Exclude Patterns: %v", cacheSettings.ExcludePatterns)
+		}
+		if cacheSettings.NamespaceHeader != "" {
+			log.Printf("   Namespace Header: %s", cacheSettings.NamespaceHeader)
+		}
+		for _, namespace := range cacheSettings.NamespacePatterns {
+			log.Printf("   Namespace %s: %s", namespace.Pattern, namespace.Namespace)
+		}
+		if cacheSettings.Coalesce {
+			log.Printf("   Coalesce: ✅ (ожидание не дольше %v)", cacheSettings.LockTimeout)
+		}
 	} else {
 		log.Printf("   Enabled: ❌")
 	}
@@ -293,11 +1163,31 @@ func printCacheSettings() {
 	log.Printf("   - CACHE_TTL=30m - кешировать запросы на 30 минут")
 	log.Printf("   - CACHE_KEY_HEADERS=X-Ya-Dest-Url,X-Custom - учитывать заголовки в ключе кеша")
 	log.Printf("   - CACHE_FILE=cache.gob - путь к файлу для сохранения кеша (gob+gzip)")
+	log.Printf("   - CACHE_BACKEND=log - дописывать только измененные записи в журнал (cache.log) вместо снимка всего кеша")
+	log.Printf("   - CACHE_BACKEND=bolt - встраиваемая база из плагина (ProxyCacheBackends, в сборку не входит), файл cache.db")
 	log.Printf("   - CACHE_URL_PATTERNS=http://storage.mds.yandex.net/*,*.yandex.net/* - паттерны URL для кеширования")
+	log.Printf("   - CACHE_EXCLUDE_PATTERNS=/api/*/live,*/stream* - не кешировать подходящие URL")
+	log.Printf("   - CACHE_NAMESPACE_HEADER=X-Test-Suite - пространство кеша из заголовка запроса")
+	log.Printf("   - CACHE_NAMESPACES=*/api/*=api,*/static/*=static - пространства кеша по паттернам URL")
+	log.Printf("   - CACHE_COALESCE=true - одновременные промахи по ключу ждут ответа первого запроса")
+	log.Printf("   - CACHE_LOCK_TIMEOUT=10s - максимальное ожидание чужого ответа")
 	log.Printf("")
 }
 
 func setupProxySettings() {
+	// Таймауты по маршрутам действуют и без upstream прокси
+	proxySettings.RouteTimeouts = parseRouteTimeouts(os.Getenv("ROUTE_TIMEOUTS"))
+
+	// Ожидание 100 Continue действует и без upstream прокси
+	proxySettings.ExpectContinueTimeout = time.Second
+	if value := os.Getenv("EXPECT_CONTINUE_TIMEOUT"); value != "" {
+		if timeout, err := time.ParseDuration(value); err == nil {
+			proxySettings.ExpectContinueTimeout = timeout
+		} else {
+			log.Printf("⚠️  Неверный формат EXPECT_CONTINUE_TIMEOUT: %s, используется 1s", value)
+		}
+	}
+
 	proxyURL := os.Getenv("UPSTREAM_PROXY")
 	if proxyURL == "" {
 		proxySettings.Enabled = false
@@ -328,9 +1218,20 @@ func setupHTTPClient() {
 	transport := &http.Transport{
 		TLSClientConfig: &tls.Config{
 			InsecureSkipVerify: proxySettings.SkipTLSVerify,
+			MinVersion:         tlsSettings.MinVersion,
+			MaxVersion:         tlsSettings.MaxVersion,
+			CipherSuites:       tlsSettings.CipherSuites,
+			ServerName:         tlsSettings.ServerName,
+			VerifyConnection:   verifyCertificatePins,
 		},
+		// Запросы с Expect: 100-continue ждут подтверждения сервера перед отправкой тела
+		ExpectContinueTimeout: proxySettings.ExpectContinueTimeout,
 	}
 
+	// Соединения с сервером учитываются для статистики (открытые, простаивающие, ошибки подключения)
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, FallbackDelay: dialSettings.FallbackDelay}
+	transport.DialContext = trackedDial(shapedDial(resolvingDial(dialer)))
+
 	if proxySettings.Enabled {
 		proxyURL, err := url.Parse(proxySettings.URL)
 		if err != nil {
@@ -346,36 +1247,179 @@ func setupHTTPClient() {
 		log.Printf("🔗 Настроен upstream прокси: %s", proxySettings.URL)
 	}
 
+	// Таймаут задается для каждого запроса через context (см. resolveRequestTimeout),
+	// чтобы маршруты и правила могли его переопределить
 	httpClient = &http.Client{
 		Transport: transport,
-		Timeout:   proxySettings.Timeout,
 	}
 }
 
-func printLogSettings() {
-	log.Printf("📋 Настройки логирования:")
-	log.Printf("   Request Body: %v", logSettings.ShowRequestBody)
-	log.Printf("   Response Body: %v", logSettings.ShowResponseBody)
-	log.Printf("   Request Headers: %v", logSettings.ShowRequestHeaders)
-	log.Printf("   Response Headers: %v", logSettings.ShowResponseHeaders)
-	log.Printf("   Body Log Mode: %s", logSettings.BodyLogMode)
-	if logSettings.BodyLogMode == "truncate" {
-		log.Printf("   Max Log Length: %d", logSettings.MaxLogLength)
+// parseRouteTimeouts разбирает список вида "/api/*=5s,/download/*=0"
+func parseRouteTimeouts(value string) []RouteTimeout {
+	var timeouts []RouteTimeout
+	if value == "" {
+		return timeouts
 	}
-	log.Printf("   Streaming Mode: %v", logSettings.EnableStreaming)
-	log.Printf("")
-	log.Printf("💡 Доступные режимы BODY_LOG_MODE:")
-	log.Printf("   - 'full' - показать все body полностью")
-	log.Printf("   - 'truncate' - обрезать длинные body")
-	log.Printf("   - 'json_full' - JSON полностью, остальное обрезать (по умолчанию)")
+
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			log.Printf("⚠️  Неверный формат таймаута маршрута: %s", item)
+			continue
+		}
+		timeout, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil {
+			log.Printf("⚠️  Неверный формат таймаута маршрута %s: %v", item, err)
+			continue
+		}
+		timeouts = append(timeouts, RouteTimeout{Pattern: strings.TrimSpace(parts[0]), Timeout: timeout})
+	}
+	return timeouts
+}
+
+var mutedRequests int64 // Всего заглушенных запросов (атомарный)
+
+// requestLogf логирует сообщение обработки запроса, если логи запроса не заглушены
+func requestLogf(r *http.Request, format string, args ...interface{}) {
+	if r != nil && logMuted(r.Context()) {
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// logMuted проверяет флаг заглушенного логирования в контексте запроса. Флаг передается
+// вместе с контекстом во вспомогательные горутины (запрос к серверу, стриминг, DNS)
+func logMuted(ctx context.Context) bool {
+	settings, ok := ctx.Value(logSettingsContextKey{}).(*LogSettings)
+	return ok && settings.Muted
+}
+
+// muteLogSettings отключает в настройках запроса все, что логируется по флагам (заголовки, тела,
+// TLS, фазы), и отмечает запрос заглушенным для остальных сообщений
+func muteLogSettings(settings *LogSettings) {
+	applyLogMode(settings, "quiet")
+	settings.ShowTLSInfo = false
+	settings.ShowTiming = false
+	settings.Muted = true
+}
+
+// isLogMuted проверяет URL по LOG_EXCLUDE_PATTERNS и LOG_INCLUDE_PATTERNS (исключение важнее)
+func isLogMuted(fullURL string) bool {
+	for _, pattern := range logSettings.ExcludePatterns {
+		if matchURLPattern(fullURL, pattern) {
+			return true
+		}
+	}
+	if len(logSettings.IncludePatterns) == 0 {
+		return false
+	}
+	for _, pattern := range logSettings.IncludePatterns {
+		if matchURLPattern(fullURL, pattern) {
+			return false
+		}
+	}
+	return true
+}
+
+// logFilterHandler заглушает все логи обработки запроса, если его URL отфильтрован
+func logFilterHandler(next http.Handler) http.Handler {
+	if len(logSettings.IncludePatterns) == 0 && len(logSettings.ExcludePatterns) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fullURL := r.URL.Path
+		if r.URL.RawQuery != "" {
+			fullURL += "?" + r.URL.RawQuery
+		}
+		if !isLogMuted(fullURL) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		atomic.AddInt64(&mutedRequests, 1)
+		settings := *requestLogSettings(r)
+		muteLogSettings(&settings)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), logSettingsContextKey{}, &settings)))
+	})
+}
+
+func logRouteStats() map[string]string {
+	stats := make(map[string]string, len(logSettings.Routes))
+	for _, route := range logSettings.Routes {
+		stats[route.Pattern] = route.Mode
+	}
+	return stats
+}
+
+func routeTimeoutStats() map[string]string {
+	stats := make(map[string]string, len(proxySettings.RouteTimeouts))
+	for _, route := range proxySettings.RouteTimeouts {
+		stats[route.Pattern] = route.Timeout.String()
+	}
+	return stats
+}
+
+// resolveRequestTimeout возвращает таймаут запроса к серверу:
+// timeout сработавшего правила, затем первый подходящий ROUTE_TIMEOUTS, затем UPSTREAM_PROXY_TIMEOUT
+func resolveRequestTimeout(fullURL string, triggered *ResponseOverride) time.Duration {
+	if triggered != nil && triggered.Timeout != "" {
+		return triggered.requestTimeout
+	}
+	for _, route := range proxySettings.RouteTimeouts {
+		if matchURLPattern(fullURL, route.Pattern) {
+			return route.Timeout
+		}
+	}
+	return proxySettings.Timeout
+}
+
+func printLogSettings() {
+	log.Printf("📋 Настройки логирования:")
+	log.Printf("   Request Body: %v", logSettings.ShowRequestBody)
+	log.Printf("   Response Body: %v", logSettings.ShowResponseBody)
+	log.Printf("   Request Headers: %v", logSettings.ShowRequestHeaders)
+	log.Printf("   Response Headers: %v", logSettings.ShowResponseHeaders)
+	log.Printf("   TLS Info: %v", logSettings.ShowTLSInfo)
+	log.Printf("   Upstream Timing: %v", logSettings.ShowTiming)
+	log.Printf("   Body Log Mode: %s", logSettings.BodyLogMode)
+	if logSettings.BodyLogMode == "truncate" {
+		log.Printf("   Max Log Length: %d", logSettings.MaxLogLength)
+	}
+	log.Printf("   Streaming Mode: %v", logSettings.EnableStreaming)
+	log.Printf("   Auto Passthrough: %v", autoPassthrough)
+	for _, route := range logSettings.Routes {
+		log.Printf("   Route %s: %s", route.Pattern, route.Mode)
+	}
+	if len(logSettings.IncludePatterns) > 0 {
+		log.Printf("   Include Patterns: %v", logSettings.IncludePatterns)
+	}
+	if len(logSettings.ExcludePatterns) > 0 {
+		log.Printf("   Exclude Patterns: %v", logSettings.ExcludePatterns)
+	}
+	if logSettings.SampleRate > 1 {
+		log.Printf("   Sample Rate: заголовки и тела для 1 из %d запросов", logSettings.SampleRate)
+	}
+	log.Printf("")
+	log.Printf("💡 Доступные режимы BODY_LOG_MODE:")
+	log.Printf("   - 'full' - показать все body полностью")
+	log.Printf("   - 'truncate' - обрезать длинные body")
+	log.Printf("   - 'json_full' - JSON полностью, остальное обрезать (по умолчанию)")
 	log.Printf("   - 'none' - не показывать body")
 	log.Printf("")
 	log.Printf("🎛️  Настройки заголовков:")
 	log.Printf("   - LOG_REQUEST_HEADERS=false - отключить заголовки запроса")
 	log.Printf("   - LOG_RESPONSE_HEADERS=false - отключить заголовки ответа")
+	log.Printf("   - LOG_TLS_INFO=false - отключить параметры TLS соединений с сервером")
+	log.Printf("   - LOG_UPSTREAM_TIMING=false - отключить фазы запроса к серверу (DNS, TCP, TLS, TTFB, передача)")
+	log.Printf("")
+	log.Printf("🔇 Фильтрация и выборка:")
+	log.Printf("   - LOG_EXCLUDE_PATTERNS=*/health*,*/poll* - не логировать эти запросы совсем")
+	log.Printf("   - LOG_INCLUDE_PATTERNS=/api/* - логировать только эти запросы")
+	log.Printf("   - LOG_SAMPLE_RATE=100 - заголовки и тела только для 1 из 100 запросов")
 	log.Printf("")
 	log.Printf("🚀 Стриминговый режим:")
 	log.Printf("   - ENABLE_STREAMING=true - включить стриминг (отключает логирование body)")
+	log.Printf("   - AUTO_PASSTHROUGH=false - буферизовать запросы, для которых не нужны ни тела, ни правила, ни кеш")
 	log.Printf("")
 }
 
@@ -394,6 +1438,14 @@ func printProxySettings() {
 	} else {
 		log.Printf("   Enabled: ❌")
 	}
+	log.Printf("   Expect Continue Timeout: %v", proxySettings.ExpectContinueTimeout)
+	for _, route := range proxySettings.RouteTimeouts {
+		if route.Timeout > 0 {
+			log.Printf("   Timeout %s: %v", route.Pattern, route.Timeout)
+		} else {
+			log.Printf("   Timeout %s: без ограничений", route.Pattern)
+		}
+	}
 	log.Printf("")
 	log.Printf("🔧 Переменные окружения для прокси:")
 	log.Printf("   - UPSTREAM_PROXY=http://proxy.example.com:8080")
@@ -401,1386 +1453,20447 @@ func printProxySettings() {
 	log.Printf("   - UPSTREAM_PROXY_PASSWORD=password")
 	log.Printf("   - UPSTREAM_PROXY_SKIP_TLS=true")
 	log.Printf("   - UPSTREAM_PROXY_TIMEOUT=30s")
+	log.Printf("   - ROUTE_TIMEOUTS=/api/*=5s,/download/*=0 - таймауты по паттернам URL (0 = без ограничений)")
+	log.Printf("   - EXPECT_CONTINUE_TIMEOUT=1s - ожидание 100 Continue от сервера (0 = отправлять тело сразу)")
 	log.Printf("")
 }
 
-func loadConfig(configFile string) {
+// loadConfig загружает правила подмены; при ошибке чтения или парсинга текущие правила сохраняются
+func loadConfig(configFile string) bool {
 	// Создаем пример конфигурации если файл не существует
 	if _, err := os.Stat(configFile); os.IsNotExist(err) {
 		createExampleConfig(configFile)
 	}
 
+	loaded, ok := parseConfigFile(configFile)
+	rejectedMutex.Lock()
+	rejectedDiagnostics = nil
+	if !ok {
+		rejectedDiagnostics = loaded.diagnostics
+		rejectedMutex.Unlock()
+		return false
+	}
+	config.Store(&loaded)
+	rejectedMutex.Unlock()
+
+	log.Printf("✅ Загружена конфигурация из %s", configFile)
+	return true
+}
+
+// parseConfigFile читает файл правил, компилирует паттерны и инициализирует счетчики
+func parseConfigFile(configFile string) (Config, bool) {
 	data, err := os.ReadFile(configFile)
 	if err != nil {
 		log.Printf("⚠️  Не удалось прочитать конфигурацию: %v", err)
-		return
+		return Config{}, false
 	}
+	return parseConfig(data)
+}
 
-	err = json.Unmarshal(data, &config)
+// parseConfig разбирает JSON конфигурации правил
+func parseConfig(data []byte) (Config, bool) {
+	// Разбираем в новую конфигурацию: при перезагрузке запросы в обработке
+	// продолжают работать с правилами предыдущей
+	var loaded Config
+	err := json.Unmarshal(data, &loaded)
+	if err == nil {
+		err = json.Unmarshal(data, &loaded.raw)
+	}
 	if err != nil {
 		log.Printf("⚠️  Ошибка парсинга конфигурации: %v", err)
-		return
+		return Config{}, false
 	}
 
-	// Компилируем regex паттерны и инициализируем счетчики
-	for i := range config.Overrides {
-		override := &config.Overrides[i]
-		if override.IsRegex {
-			compiled, err := regexp.Compile(override.URLPattern)
-			if err != nil {
-				log.Printf("⚠️  Ошибка компиляции regex '%s': %v", override.URLPattern, err)
-				override.Enabled = false
-			} else {
-				override.compiledRegex = compiled
-			}
+	// Подставляем переменные окружения в заголовки хостов, чтобы секреты не хранились в файле
+	for i := range loaded.HostHeaders {
+		policy := &loaded.HostHeaders[i]
+		if policy.Host == "" {
+			log.Printf("⚠️  host_headers: пропущена политика без host")
+			continue
 		}
-
-		// Компилируем regex для замен в body
-		for j := range override.BodyReplacements {
-			replacement := &override.BodyReplacements[j]
-			if replacement.IsRegex {
-				compiled, err := regexp.Compile(replacement.Find)
-				if err != nil {
-					log.Printf("⚠️  Ошибка компиляции regex замены '%s': %v", replacement.Find, err)
-				} else {
-					replacement.compiledRegex = compiled
+		for name, value := range policy.Set {
+			policy.Set[name] = os.Expand(value, func(key string) string {
+				value, ok := os.LookupEnv(key)
+				if !ok {
+					log.Printf("⚠️  host_headers '%s': переменная окружения %s не установлена", policy.Host, key)
 				}
-			}
+				return value
+			})
 		}
-
-		// Инициализируем счетчики
-		override.requestCount = 0
-		override.triggerCount = 0
 	}
 
-	log.Printf("✅ Загружена конфигурация из %s", configFile)
-}
-
-func createExampleConfig(configFile string) {
-	exampleConfig := Config{
-		Overrides: []ResponseOverride{
-			{
-				Name:         "Yandex bindings - срабатывает после 3 запросов",
-				Method:       "*",
-				URLPattern:   "/bindings",
-				IsRegex:      false,
-				StatusCode:   200,
-				TriggerAfter: 3,
-				MaxTriggers:  2,
-				ResetAfter:   10,
-				Headers: map[string]string{
-					"Content-Type": "application/json",
-					"X-Custom":     "overridden-after-3-requests",
-				},
-				BodyFile: "responses/bindings.json",
-				Enabled:  true,
-			},
-			{
-				Name:         "API users - мгновенная подмена",
-				Method:       "GET",
-				URLPattern:   `/api/users/\d+`,
-				IsRegex:      true,
-				StatusCode:   200,
-				TriggerAfter: 0,  // срабатывает сразу
-				MaxTriggers:  -1, // бесконечно
-				Headers: map[string]string{
-					"Content-Type": "application/json",
-				},
-				BodyText: `{"id": 123, "name": "Mock User", "email": "mock@example.com", "mocked": true}`,
-				Enabled:  false,
-			},
-			{
-				Name:         "Error simulation - после 5 запросов",
-				Method:       "POST",
-				URLPattern:   "/api/submit",
-				IsRegex:      false,
-				StatusCode:   500,
-				TriggerAfter: 5,
-				MaxTriggers:  1, // только один раз
-				Headers: map[string]string{
-					"Content-Type": "application/json",
-				},
-				BodyText: `{"error": "Simulated server error after 5 requests", "code": "MOCK_ERROR"}`,
-				Enabled:  false,
-			},
-		},
+	// Подписи запросов: секрет и алгоритм проверяются при загрузке, неверные подписчики отключаются
+	for i := range loaded.Signing {
+		if err := loaded.Signing[i].compile(); err != nil {
+			log.Printf("⚠️  request_signing '%s': %v - подпись отключена", loaded.Signing[i].Host, err)
+			loaded.Signing[i].Host = ""
+		}
 	}
 
-	data, _ := json.MarshalIndent(exampleConfig, "", "  ")
-	err := os.WriteFile(configFile, data, 0644)
-	if err != nil {
-		log.Printf("⚠️  Не удалось создать пример конфигурации: %v", err)
-	} else {
-		log.Printf("📝 Создан пример конфигурации: %s", configFile)
-
-		// Создаем директорию для файлов ответов
-		os.MkdirAll("responses", 0755)
-
-		// Создаем пример файла ответа
-		exampleResponse := map[string]interface{}{
-			"status": "success",
-			"data": map[string]interface{}{
-				"bindings": []map[string]interface{}{
-					{"id": 1, "name": "binding1", "type": "primary"},
-					{"id": 2, "name": "binding2", "type": "secondary"},
-					{"id": 3, "name": "binding3", "type": "primary"},
-				},
-				"total": 3,
-			},
-			"message":      "This is a mocked response from file (triggered after N requests)",
-			"triggered_at": "auto-generated",
+	// Маршруты: срок кеширования и upstream прокси проверяются при загрузке
+	for i := range loaded.Routes {
+		route := &loaded.Routes[i]
+		if route.Pattern == "" {
+			log.Printf("⚠️  routes: пропущен маршрут без pattern")
+			continue
+		}
+		if route.Cache != nil && route.Cache.TTL != "" {
+			ttl, err := time.ParseDuration(route.Cache.TTL)
+			if err != nil || ttl <= 0 {
+				log.Printf("⚠️  routes '%s': неверный формат cache.ttl '%s', используется CACHE_TTL", route.Pattern, route.Cache.TTL)
+			} else {
+				route.cacheTTL = ttl
+			}
+		}
+		if route.UpstreamProxy != "" && route.UpstreamProxy != "direct" {
+			proxyURL, err := url.Parse(route.UpstreamProxy)
+			if err != nil || proxyURL.Host == "" {
+				log.Printf("⚠️  routes '%s': неверный upstream_proxy '%s', используется UPSTREAM_PROXY", route.Pattern, route.UpstreamProxy)
+				route.UpstreamProxy = ""
+			} else {
+				route.proxyURL = proxyURL
+			}
 		}
-		responseData, _ := json.MarshalIndent(exampleResponse, "", "  ")
-		os.WriteFile("responses/bindings.json", responseData, 0644)
-		log.Printf("📝 Создан пример ответа: responses/bindings.json")
 	}
-}
 
-func countActiveOverrides() int {
-	count := 0
-	for i := range config.Overrides {
-		if config.Overrides[i].Enabled {
-			count++
+	// Бюджеты: задержка разбирается при загрузке, бюджет без лимитов ничего не проверяет
+	for i := range loaded.Budgets {
+		budget := &loaded.Budgets[i]
+		if budget.Name == "" {
+			budget.Name = strings.TrimSpace(budget.Method + " " + budget.URL)
+		}
+		if budget.MaxP95 != "" {
+			maxP95, err := time.ParseDuration(budget.MaxP95)
+			if err != nil || maxP95 <= 0 {
+				log.Printf("⚠️  budgets '%s': неверный формат max_p95 '%s', задержка не проверяется", budget.Name, budget.MaxP95)
+			} else {
+				budget.maxP95 = maxP95
+			}
+		}
+		if budget.MaxCalls == nil && budget.MaxBytes == nil && budget.maxP95 == 0 {
+			log.Printf("⚠️  budgets '%s': не задано ни одного лимита (max_calls, max_bytes, max_p95)", budget.Name)
 		}
 	}
-	return count
-}
 
-func findMatchingOverride(method, urlPath string) *ResponseOverride {
-	for i := range config.Overrides {
-		override := &config.Overrides[i]
-		if !override.Enabled {
-			continue
+	// Порядок вызовов: правило без first или then ничего не проверяет
+	for i := range loaded.Ordering {
+		rule := &loaded.Ordering[i]
+		if rule.Name == "" {
+			rule.Name = rule.First + " → " + rule.Then
 		}
-
-		// Проверяем метод
-		if override.Method != "*" && !strings.EqualFold(override.Method, method) {
-			continue
+		if rule.First == "" || rule.Then == "" {
+			log.Printf("⚠️  ordering '%s': нужны first и then, правило не проверяется", rule.Name)
+			rule.Then = ""
+		}
+		switch {
+		case rule.Scope == "", rule.Scope == "ip", rule.Scope == "global":
+		case strings.HasPrefix(rule.Scope, "header:") && len(rule.Scope) > len("header:"):
+		case strings.HasPrefix(rule.Scope, "cookie:") && len(rule.Scope) > len("cookie:"):
+		default:
+			log.Printf("⚠️  ordering '%s': неверный scope '%s', используется ip", rule.Name, rule.Scope)
+			rule.Scope = ""
 		}
+		if rule.Action != "" && rule.Action != "record" && rule.Action != "reject" {
+			log.Printf("⚠️  ordering '%s': неверный action '%s', используется record", rule.Name, rule.Action)
+			rule.Action = ""
+		}
+		if rule.Action == "" {
+			rule.Action = "record"
+		}
+		if rule.Status == 0 {
+			rule.Status = http.StatusPreconditionRequired
+		}
+	}
 
-		// Проверяем URL
-		var matches bool
-		if override.IsRegex {
-			matches = override.compiledRegex != nil && override.compiledRegex.MatchString(urlPath)
-		} else {
-			matches = strings.Contains(urlPath, override.URLPattern)
+	// Ошибки паттернов не только пишутся в лог, но и доступны через /_proxy/rules/diagnostics
+	diagnose := func(override *ResponseOverride, field, pattern, level, code, message string) {
+		loaded.diagnostics = append(loaded.diagnostics, RuleDiagnostic{
+			Rule: override.Name, Field: field, Pattern: pattern, Level: level, Code: code, Message: message,
+		})
+		if level == "warning" {
+			log.Printf("⚠️  Правило '%s': %s '%s': %s", override.Name, field, pattern, message)
 		}
+	}
 
-		if matches {
-			override.mutex.Lock()
-			override.requestCount++
+	// Компилируем regex паттерны и инициализируем счетчики
+	for i := range loaded.Overrides {
+		override := &loaded.Overrides[i]
 
-			// Проверяем, нужно ли сбросить счетчики
-			if override.ResetAfter > 0 && override.requestCount >= override.ResetAfter {
-				log.Printf("🔄 Сброс счетчиков для правила '%s' (достигнуто %d запросов)",
-					override.Name, override.ResetAfter)
-				override.requestCount = 0
-				override.triggerCount = 0
-				override.mutex.Unlock()
-				continue
+		// match_type имеет приоритет над is_regex
+		if override.MatchType == "" {
+			override.MatchType = "contains"
+			if override.IsRegex {
+				override.MatchType = "regex"
 			}
+		} else if override.IsRegex && override.MatchType != "regex" {
+			log.Printf("⚠️  Правило '%s': is_regex игнорируется, используется match_type '%s'", override.Name, override.MatchType)
+		}
+		override.IsRegex = override.MatchType == "regex"
 
-			// Проверяем, достигли ли порога срабатывания
-			shouldTrigger := override.requestCount > override.TriggerAfter
-
-			// Проверяем лимит срабатываний
-			if override.MaxTriggers > 0 && override.triggerCount >= override.MaxTriggers {
-				shouldTrigger = false
+		override.compiledRegex = nil
+		switch override.MatchType {
+		case "contains", "exact", "prefix":
+		case "regex", "glob":
+			pattern := override.URLPattern
+			if override.MatchType == "glob" {
+				// /api/*/users -> ^/api/.*/users$
+				pattern = "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
 			}
-
-			if shouldTrigger {
-				override.triggerCount++
-				log.Printf("📊 Правило '%s': запрос %d, срабатывание %d",
-					override.Name, override.requestCount, override.triggerCount)
-				override.mutex.Unlock()
-				return override
+			if override.CaseInsensitive {
+				pattern = "(?i)" + pattern
+			}
+			compiled, err := regexp.Compile(pattern)
+			if err != nil {
+				log.Printf("⚠️  Ошибка компиляции regex '%s': %v", override.URLPattern, err)
+				diagnose(override, "url_pattern", override.URLPattern, "error", "compile_error", err.Error()+", правило отключено")
+				override.Enabled = false
 			} else {
-				log.Printf("📊 Правило '%s': запрос %d (нужно %d для срабатывания)",
-					override.Name, override.requestCount, override.TriggerAfter+1)
-				override.mutex.Unlock()
+				override.compiledRegex = compiled
 			}
+		default:
+			log.Printf("⚠️  Правило '%s': неизвестный match_type '%s', правило отключено", override.Name, override.MatchType)
+			diagnose(override, "match_type", override.MatchType, "error", "unknown_match_type", "используйте contains, exact, prefix, glob или regex; правило отключено")
+			override.Enabled = false
 		}
-	}
-	return nil
-}
-
-// findMatchingOverrideForReplacements ищет правило только для применения замен (без учета триггеров)
-func findMatchingOverrideForReplacements(method, urlPath string) *ResponseOverride {
-	for i := range config.Overrides {
-		override := &config.Overrides[i]
-		if !override.Enabled {
-			continue
+		for _, finding := range lintURLPattern(override) {
+			diagnose(override, "url_pattern", override.URLPattern, finding.Level, finding.Code, finding.Message)
 		}
 
-		// Пропускаем если нет замен
-		if len(override.BodyReplacements) == 0 {
-			continue
+		// Парсим паузу между срабатываниями
+		if override.Cooldown != "" {
+			cooldown, err := time.ParseDuration(override.Cooldown)
+			if err != nil {
+				log.Printf("⚠️  Неверный формат cooldown '%s' в правиле '%s': %v", override.Cooldown, override.Name, err)
+				override.Enabled = false
+			} else {
+				override.cooldownDuration = cooldown
+			}
 		}
 
-		// Проверяем метод
-		if override.Method != "*" && !strings.EqualFold(override.Method, method) {
-			continue
+		// Кодирование измененного тела проверяется при загрузке, неизвестное игнорируется
+		switch override.Recompress = strings.ToLower(override.Recompress); override.Recompress {
+		case "", "identity", "gzip":
+		default:
+			if contentEncoders[override.Recompress] == nil {
+				log.Printf("⚠️  Нет кодировщика %s для recompress в правиле '%s' (подключается плагином), используется кодирование ответа сервера", override.Recompress, override.Name)
+				override.Recompress = ""
+			}
 		}
 
-		// Проверяем URL
-		var matches bool
-		if override.IsRegex {
-			matches = override.compiledRegex != nil && override.compiledRegex.MatchString(urlPath)
-		} else {
-			matches = strings.Contains(urlPath, override.URLPattern)
+		// Парсим таймаут скрипта
+		override.scriptTimeout = 10 * time.Second
+		if override.ScriptTimeout != "" {
+			timeout, err := time.ParseDuration(override.ScriptTimeout)
+			if err != nil {
+				log.Printf("⚠️  Неверный формат script_timeout '%s' в правиле '%s', используется 10s", override.ScriptTimeout, override.Name)
+			} else {
+				override.scriptTimeout = timeout
+			}
 		}
 
-		if matches {
-			return override
+		// Парсим таймаут внешнего обработчика
+		override.transformTimeout = 10 * time.Second
+		if override.TransformTimeout != "" {
+			timeout, err := time.ParseDuration(override.TransformTimeout)
+			if err != nil {
+				log.Printf("⚠️  Неверный формат transform_timeout '%s' в правиле '%s', используется 10s", override.TransformTimeout, override.Name)
+			} else {
+				override.transformTimeout = timeout
+			}
 		}
-	}
-	return nil
-}
-
-func showStats(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	stats := make([]map[string]interface{}, 0, len(config.Overrides))
 
-	for i := range config.Overrides {
-		override := &config.Overrides[i]
-		override.mutex.Lock()
-		stat := map[string]interface{}{
-			"name":          override.Name,
-			"enabled":       override.Enabled,
-			"url_pattern":   override.URLPattern,
-			"method":        override.Method,
-			"trigger_after": override.TriggerAfter,
-			"max_triggers":  override.MaxTriggers,
-			"reset_after":   override.ResetAfter,
-			"request_count": override.requestCount,
-			"trigger_count": override.triggerCount,
+		// Парсим таймаут запроса к серверу
+		override.requestTimeout = 0
+		if override.Timeout != "" {
+			timeout, err := time.ParseDuration(override.Timeout)
+			if err != nil {
+				log.Printf("⚠️  Неверный формат timeout '%s' в правиле '%s', используется таймаут по умолчанию", override.Timeout, override.Name)
+				override.Timeout = ""
+			} else {
+				override.requestTimeout = timeout
+			}
 		}
-		override.mutex.Unlock()
-		stats = append(stats, stat)
-	}
 
-	response := map[string]interface{}{
-		"overrides":    stats,
-		"total_rules":  len(config.Overrides),
-		"active_rules": countActiveOverrides(),
-		"log_settings": map[string]interface{}{
-			"show_request_body":     logSettings.ShowRequestBody,
-			"show_response_body":    logSettings.ShowResponseBody,
-			"show_request_headers":  logSettings.ShowRequestHeaders,
-			"show_response_headers": logSettings.ShowResponseHeaders,
-			"body_log_mode":         logSettings.BodyLogMode,
-			"max_log_length":        logSettings.MaxLogLength,
-		},
-		"proxy_settings": map[string]interface{}{
-			"enabled":         proxySettings.Enabled,
-			"url":             proxySettings.URL,
-			"has_auth":        proxySettings.Username != "",
-			"skip_tls_verify": proxySettings.SkipTLSVerify,
-			"timeout":         proxySettings.Timeout.String(),
-		},
-		"cache_settings": map[string]interface{}{
-			"enabled":      cacheSettings.Enabled,
-			"ttl":          cacheSettings.TTL.String(),
-			"cache_hits":   atomic.LoadInt64(&cacheHits),
-			"cache_misses": atomic.LoadInt64(&cacheMisses),
-			"cache_size":   getCacheSize(),
-		},
-	}
+		// Загружаем JSON Schema для проверки запросов
+		override.requestSchema = nil
+		if override.RequestSchemaFile != "" {
+			schema, err := loadJSONSchema(override.RequestSchemaFile)
+			if err != nil {
+				log.Printf("⚠️  Правило '%s': ошибка загрузки схемы %s: %v, правило отключено", override.Name, override.RequestSchemaFile, err)
+				override.Enabled = false
+			} else {
+				override.requestSchema = schema
+			}
+		}
 
-	json.NewEncoder(w).Encode(response)
-}
+		// Компилируем regex для замен в body
+		for j := range override.BodyReplacements {
+			replacement := &override.BodyReplacements[j]
+			if replacement.IsRegex {
+				field := fmt.Sprintf("body_replacements[%d].find", j)
+				compiled, err := regexp.Compile(replacement.Find)
+				if err != nil {
+					log.Printf("⚠️  Ошибка компиляции regex замены '%s': %v", replacement.Find, err)
+					diagnose(override, field, replacement.Find, "error", "compile_error", err.Error()+", замена не применяется")
+				} else {
+					replacement.compiledRegex = compiled
+					for _, finding := range lintRegex(replacement.Find) {
+						diagnose(override, field, replacement.Find, finding.Level, finding.Code, finding.Message)
+					}
+				}
+			}
+		}
 
-// handleProxyMode обрабатывает запросы в режиме HTTP прокси
-func handleProxyMode(w http.ResponseWriter, r *http.Request) {
-	// Пропускаем внутренние эндпоинты
-	if strings.HasPrefix(r.URL.Path, "/_proxy") {
-		return
-	}
+		// Парсим паузу Retry-After
+		override.backoffUntil = nil
+		if override.RateLimit != nil {
+			override.retryAfterDuration = time.Second
+			if override.RateLimit.RetryAfter != "" {
+				retryAfter, err := time.ParseDuration(override.RateLimit.RetryAfter)
+				if err != nil || retryAfter <= 0 {
+					log.Printf("⚠️  Неверный формат rate_limit.retry_after '%s' в правиле '%s', используется 1s", override.RateLimit.RetryAfter, override.Name)
+				} else {
+					override.retryAfterDuration = retryAfter
+				}
+			}
+			override.backoffUntil = make(map[string]time.Time)
+		}
 
-	// Обрабатываем CONNECT - отклоняем с объяснением
-	if r.Method == "CONNECT" {
-		http.Error(w, "CONNECT method not supported. Please use Custom Dialer without Proxy setting in Transport.", http.StatusMethodNotAllowed)
-		log.Printf("❌ CONNECT запрос отклонён: %s", r.Host)
-		log.Printf("💡 Используйте Custom Dialer с DialContext и DialTLSContext")
-		log.Printf("💡 Не устанавливайте transport.Proxy в клиенте")
-		return
-	}
+		// Проверяем изменения query параметров
+		for j := range override.QueryRewrites {
+			rewrite := &override.QueryRewrites[j]
+			if rewrite.Action == "" {
+				rewrite.Action = "set"
+			}
+			if rewrite.Param == "" || (rewrite.Action != "set" && rewrite.Action != "add" && rewrite.Action != "remove" && rewrite.Action != "replace") {
+				log.Printf("⚠️  Правило '%s': неверное изменение query (param '%s', action '%s'), правило отключено", override.Name, rewrite.Param, rewrite.Action)
+				override.Enabled = false
+				continue
+			}
+			if rewrite.Find == "" && rewrite.Action == "replace" {
+				rewrite.Find = "^.*$"
+			}
+			rewrite.compiledFind = nil
+			if rewrite.Find != "" {
+				field := fmt.Sprintf("query_rewrites[%d].find", j)
+				compiled, err := regexp.Compile(rewrite.Find)
+				if err != nil {
+					log.Printf("⚠️  Правило '%s': ошибка компиляции regex '%s' для query: %v, правило отключено", override.Name, rewrite.Find, err)
+					diagnose(override, field, rewrite.Find, "error", "compile_error", err.Error()+", правило отключено")
+					override.Enabled = false
+					continue
+				}
+				for _, finding := range lintRegex(rewrite.Find) {
+					diagnose(override, field, rewrite.Find, finding.Level, finding.Code, finding.Message)
+				}
+				rewrite.compiledFind = compiled
+			}
+		}
 
-	// Детальное логирование входящего запроса
-	log.Printf("📨 Входящий запрос: %s %s", r.Method, r.URL.String())
-	log.Printf("   Host: %s", r.Host)
-	log.Printf("   URL.Scheme: %s", r.URL.Scheme)
-	log.Printf("   URL.Host: %s", r.URL.Host)
-	log.Printf("   URL.Path: %s", r.URL.Path)
-	log.Printf("   URL.RawQuery: %s", r.URL.RawQuery)
+		// Проверяем режим логирования правила
+		if override.Log != nil && override.Log.BodyLogMode != "" && !isLogMode(override.Log.BodyLogMode) {
+			log.Printf("⚠️  Правило '%s': неизвестный body_log_mode '%s', используется глобальный", override.Name, override.Log.BodyLogMode)
+			override.Log.BodyLogMode = ""
+		}
 
-	// В режиме HTTP прокси URL должен быть полным
-	if r.URL.Scheme == "" || r.URL.Host == "" {
-		// Возможно URL в заголовке Host
-		if r.Host != "" && r.URL.Scheme == "" {
-			// Пытаемся восстановить scheme из RequestURI
-			if strings.HasPrefix(r.RequestURI, "https://") {
-				r.URL.Scheme = "https"
-			} else if strings.HasPrefix(r.RequestURI, "http://") {
-				r.URL.Scheme = "http"
+		// Подставляем шаблон ответа
+		if override.Response != "" {
+			template, ok := loaded.Responses[override.Response]
+			if !ok {
+				log.Printf("⚠️  Правило '%s': шаблон ответа '%s' не найден, правило отключено", override.Name, override.Response)
+				override.Enabled = false
 			} else {
-				r.URL.Scheme = "http" // по умолчанию
+				applyResponseTemplate(override, template)
 			}
-			r.URL.Host = r.Host
-			log.Printf("🔧 Восстановлен URL: %s://%s%s", r.URL.Scheme, r.URL.Host, r.URL.Path)
-		} else {
-			http.Error(w, "Bad Request: требуется полный URL (http://example.com/path)", http.StatusBadRequest)
-			log.Printf("❌ Неверный запрос: отсутствует scheme или host")
-			log.Printf("   RequestURI: %s", r.RequestURI)
-			log.Printf("   URL: %s", r.URL.String())
-			log.Printf("   Host header: %s", r.Host)
-			return
 		}
-	}
 
-	// Парсим целевой URL из запроса
-	targetURL, err := url.Parse(r.URL.Scheme + "://" + r.URL.Host)
-	if err != nil {
-		http.Error(w, "Bad Request: неверный URL", http.StatusBadRequest)
-		log.Printf("❌ Ошибка парсинга URL: %v", err)
-		return
-	}
+		// Полная подмена не запрашивает сервер, поэтому Content-Type его ответа проверить нельзя
+		if len(override.ResponseContentTypes) > 0 && (override.BodyFile != "" || override.BodyText != "") {
+			types := strings.Join(override.ResponseContentTypes, ", ")
+			log.Printf("⚠️  Правило '%s': response_content_types не применяется к полной подмене ответа, правило отключено", override.Name)
+			diagnose(override, "response_content_types", types, "error", "mock_content_types", "работает только с body_replacements и SSE; уберите поле или body_file/body_text; правило отключено")
+			override.Enabled = false
+		}
 
-	log.Printf("🌐 Proxy Mode: %s %s", r.Method, r.URL.String())
+		// Проверяем порядок выбора файлов ответа
+		if override.BodyFileOrder != "" && override.BodyFileOrder != "round_robin" && override.BodyFileOrder != "random" {
+			log.Printf("⚠️  Правило '%s': неизвестный body_file_order '%s', используется round_robin", override.Name, override.BodyFileOrder)
+			override.BodyFileOrder = ""
+		}
 
-	// Используем стандартную функцию проксирования
-	proxyRequest(w, r, targetURL)
-}
+		// Проверяем шаблон текста ответа (шаблоны файлов разбираются при каждом запросе)
+		if override.BodyTemplate && override.BodyText != "" {
+			if _, err := newBodyTemplate(override.Name, nil, nil).Parse(override.BodyText); err != nil {
+				log.Printf("⚠️  Правило '%s': ошибка в шаблоне body_text: %v, правило отключено", override.Name, err)
+				override.Enabled = false
+			}
+		}
 
-func proxyRequest(w http.ResponseWriter, r *http.Request, targetURL *url.URL) {
-	// Пропускаем внутренние эндпоинты
-	if strings.HasPrefix(r.URL.Path, "/_proxy") {
-		return
-	}
+		// Компилируем дерево условий; правило только с when подходит под любой метод
+		if override.When != nil {
+			if err := compileCondition(override.When, loaded.Conditions, nil); err != nil {
+				log.Printf("⚠️  Правило '%s': ошибка в when: %v, правило отключено", override.Name, err)
+				override.Enabled = false
+			}
+			if override.Method == "" {
+				override.Method = "*"
+			}
+		}
 
-	// Объединяем базовый path из targetURL с path из запроса
-	combinedPath := path.Join(targetURL.Path, r.URL.Path)
+		// Проверяем ссылки на расширения
+		if override.Matcher != "" && matchers[override.Matcher] == nil {
+			log.Printf("⚠️  Правило '%s': matcher '%s' не зарегистрирован, правило отключено", override.Name, override.Matcher)
+			override.Enabled = false
+		}
+		for _, name := range override.Transformers {
+			if transformers[name] == nil {
+				log.Printf("⚠️  Правило '%s': transformer '%s' не зарегистрирован", override.Name, name)
+			}
+		}
 
-	// path.Join убирает trailing slash, восстанавливаем если нужно
-	if strings.HasSuffix(r.URL.Path, "/") && !strings.HasSuffix(combinedPath, "/") {
-		combinedPath += "/"
+		// Инициализируем счетчики
+		override.requestSeq = 0
+		override.triggers.Store(nil)
+		override.activeTriggers = 0
+		override.schemaViolations = 0
 	}
 
-	// Создаем новый URL для проксирования
-	proxyURL := &url.URL{
-		Scheme:   targetURL.Scheme,
-		Host:     targetURL.Host,
-		Path:     combinedPath,
-		RawQuery: r.URL.RawQuery,
+	// В строгом режиме конфигурация с замечаниями не применяется
+	if configStrict && len(loaded.diagnostics) > 0 {
+		log.Printf("❌ CONFIG_STRICT: конфигурация отклонена, замечаний к паттернам: %d", len(loaded.diagnostics))
+		for _, diagnostic := range loaded.diagnostics {
+			log.Printf("   %s: правило '%s', %s '%s': %s", diagnostic.Level, diagnostic.Rule, diagnostic.Field, diagnostic.Pattern, diagnostic.Message)
+		}
+		return loaded, false
 	}
 
-	proxyInfo := proxyURL.String()
-	if proxySettings.Enabled {
-		proxyInfo += " (via " + proxySettings.URL + ")"
+	return loaded, true
+}
+
+// Пути, под которые подходит слишком широкий url_pattern
+var broadMatchProbes = []string{"/", "/zq9/xw8", "/index.html?utm=1", "/api/v1/users/42"}
+
+// lintURLPattern ищет в url_pattern правила паттерны, подходящие под любой URL, и проблемные regex
+func lintURLPattern(override *ResponseOverride) []RuleDiagnostic {
+	var findings []RuleDiagnostic
+	if override.MatchType == "regex" || override.MatchType == "glob" {
+		if override.compiledRegex == nil {
+			return nil
+		}
+		if override.MatchType == "regex" {
+			findings = lintRegex(override.URLPattern)
+		}
 	}
-	log.Printf("🔄 %s %s -> %s", r.Method, r.URL.String(), proxyInfo)
 
-	// Логируем заголовки входящего запроса
-	if logSettings.ShowRequestHeaders {
-		logHeaders("📤 Request Headers", r.Header)
+	// Широкий паттерн допустим, если правило сужено условиями when или matcher
+	if override.When != nil || override.Matcher != "" {
+		return findings
+	}
+	for _, probe := range broadMatchProbes {
+		if !override.matchesURL(probe) {
+			return findings
+		}
 	}
+	return append(findings, RuleDiagnostic{Level: "warning", Code: "broad_match", Message: "паттерн подходит под любой URL, добавьте when или уточните путь"})
+}
 
-	// Проверяем, есть ли подмена для этого запроса
-	// Передаем полный URL с query параметрами
-	fullURL := r.URL.Path
-	if r.URL.RawQuery != "" {
-		fullURL += "?" + r.URL.RawQuery
+// lintRegex находит конструкции, опасные для движков с возвратами (PCRE, JavaScript), и слишком сложные regex.
+// Движок Go выполняет regex за линейное время, но такие паттерны часто ошибочны и медленны на больших телах
+func lintRegex(pattern string) []RuleDiagnostic {
+	parsed, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil
 	}
-	if override := findMatchingOverride(r.Method, fullURL); override != nil {
-		// Если есть body_file или body_text - это полная подмена, не идём на сервер
-		if override.BodyFile != "" || override.BodyText != "" {
-			log.Printf("🎭 Применяем полную подмену: %s", override.Name)
-			handleOverride(w, r, override)
-			return
+
+	var findings []RuleDiagnostic
+	nested, largeRepeat := false, false
+	var walk func(re *syntax.Regexp, inRepeat bool)
+	walk = func(re *syntax.Regexp, inRepeat bool) {
+		unbounded := re.Op == syntax.OpStar || re.Op == syntax.OpPlus || (re.Op == syntax.OpRepeat && re.Max == -1)
+		if unbounded && inRepeat {
+			nested = true
 		}
-		// Если есть только body_replacements - продолжаем с проксированием
-		// (замены будут применены в bufferedProxyRequest)
-		if len(override.BodyReplacements) > 0 {
-			log.Printf("🔄 Правило '%s' будет применять замены к проксированному ответу", override.Name)
+		if re.Op == syntax.OpRepeat && (re.Max > 100 || re.Min > 100) {
+			largeRepeat = true
+		}
+		for _, sub := range re.Sub {
+			walk(sub, inRepeat || unbounded)
 		}
 	}
+	walk(parsed, false)
 
-	// Выбираем режим проксирования
-	// Приоритет: кеширование > стриминг (кеш требует буферизации)
-	if cacheSettings.Enabled && logSettings.EnableStreaming {
-		log.Printf("⚠️  Кеширование имеет приоритет над стримингом (используется буферизованный режим)")
+	if nested {
+		findings = append(findings, RuleDiagnostic{Level: "warning", Code: "nested_quantifier", Message: "вложенные квантификаторы вида (a+)+ - катастрофический перебор в движках с возвратами"})
+	}
+	if largeRepeat {
+		findings = append(findings, RuleDiagnostic{Level: "warning", Code: "large_repeat", Message: "повторение больше 100 раз разворачивается в большую программу"})
+	}
+	if program, err := syntax.Compile(parsed.Simplify()); err == nil && len(program.Inst) > 5000 {
+		findings = append(findings, RuleDiagnostic{Level: "warning", Code: "complex", Message: fmt.Sprintf("слишком сложный regex (%d инструкций)", len(program.Inst))})
 	}
+	return findings
+}
 
-	if logSettings.EnableStreaming && !cacheSettings.Enabled {
-		log.Printf("🚀 Стриминговый режим включен")
-		streamingProxyRequest(w, r, proxyURL, targetURL)
-	} else {
-		bufferedProxyRequest(w, r, proxyURL, targetURL)
+type configSnapshotKey struct{}
+
+// configSnapshot возвращает текущий снимок конфигурации (до первой загрузки - пустую)
+func configSnapshot(p *atomic.Pointer[Config]) *Config {
+	if snapshot := p.Load(); snapshot != nil {
+		return snapshot
 	}
+	return &Config{}
 }
 
-// bufferedProxyRequest - исходный режим с буферизацией для логирования
-func bufferedProxyRequest(w http.ResponseWriter, r *http.Request, proxyURL *url.URL, targetURL *url.URL) {
-	// Проверяем кеш если включен
-	if cacheSettings.Enabled {
-		cacheKey := generateCacheKey(r.Method, proxyURL.String(), r.Header)
-		if cached := getCachedResponse(cacheKey); cached != nil {
-			atomic.AddInt64(&cacheHits, 1)
-			log.Printf("💾 Ответ из кеша (срок действия до %s)", cached.ExpiresAt.Format("15:04:05"))
-			serveCachedResponse(w, cached)
+// currentConfig возвращает снимок конфигурации арендатора запроса или основной (r может быть nil).
+// Снимок, закрепленный за запросом (pinConfigSnapshot), действует до конца запроса
+func currentConfig(r *http.Request) *Config {
+	if r != nil {
+		if snapshot, ok := r.Context().Value(configSnapshotKey{}).(*Config); ok {
+			return snapshot
+		}
+	}
+	if tenant := tenantFromRequest(r); tenant != nil {
+		return configSnapshot(&tenant.config)
+	}
+	return configSnapshot(&config)
+}
+
+// pinConfigSnapshot закрепляет за запросом текущий снимок: все этапы видят одни и те же правила,
+// даже если конфигурация перезагружается во время обработки
+func pinConfigSnapshot(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), configSnapshotKey{}, currentConfig(r)))
+}
+
+// currentHostHeaders возвращает политики заголовков хостов арендатора запроса или основной конфигурации
+func currentHostHeaders(r *http.Request) []HostHeaderPolicy {
+	return currentConfig(r).HostHeaders
+}
+
+// currentRoutes возвращает маршруты арендатора запроса или основной конфигурации
+func currentRoutes(r *http.Request) []RouteSettings {
+	return currentConfig(r).Routes
+}
+
+// currentOverrides возвращает правила арендатора запроса или основной конфигурации (r может быть nil)
+func currentOverrides(r *http.Request) []ResponseOverride {
+	return currentConfig(r).Overrides
+}
+
+// handleRules просмотр и изменение правил во время работы (конфигурация арендатора запроса или основная):
+//
+//	GET    /_proxy/rules             - правила в том виде, в котором они записаны в файле
+//	POST   /_proxy/rules             - добавить правило (тело - правило в формате overrides.json)
+//	PUT    /_proxy/rules?name=...    - заменить правило
+//	DELETE /_proxy/rules?name=...    - удалить правило
+//
+// С CONFIG_PERSIST=true измененная конфигурация записывается в файл, предыдущая версия - в .bak
+func handleRules(w http.ResponseWriter, r *http.Request) {
+	rulesEditMutex.Lock()
+	defer rulesEditMutex.Unlock()
+
+	target, file := rulesTarget(r)
+	raw := configSnapshot(target).raw
+
+	var rules []json.RawMessage
+	if data, ok := raw["overrides"]; ok {
+		if err := json.Unmarshal(data, &rules); err != nil {
+			http.Error(w, fmt.Sprintf("Ошибка разбора правил: %v", err), http.StatusInternalServerError)
 			return
 		}
-		atomic.AddInt64(&cacheMisses, 1)
 	}
 
-	// Читаем тело запроса ПОЛНОСТЬЮ
-	var requestBody []byte
-	var bodyReader io.Reader
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"file":    file,
+			"persist": configPersist && file != "",
+			"rules":   rules,
+		})
+		return
+	}
 
-	if r.Body != nil {
-		var err error
-		requestBody, err = io.ReadAll(r.Body)
+	// Правки на основе пустой конфигурации затерли бы файл, который не удалось загрузить
+	if raw == nil && file != "" {
+		http.Error(w, fmt.Sprintf("Конфигурация %s не загружена (см. лог и /_proxy/rules/diagnostics), исправьте файл или используйте импорт", file), http.StatusConflict)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	index := -1
+	for i, rule := range rules {
+		if ruleName(rule) == name {
+			index = i
+			break
+		}
+	}
+
+	var rule json.RawMessage
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		body, err := io.ReadAll(r.Body)
 		if err != nil {
-			http.Error(w, "Ошибка чтения тела запроса", http.StatusBadRequest)
-			log.Printf("❌ Ошибка чтения тела запроса: %v", err)
+			http.Error(w, fmt.Sprintf("Ошибка чтения тела: %v", err), http.StatusBadRequest)
 			return
 		}
-		r.Body.Close()
+		var parsed ResponseOverride
+		if err := json.Unmarshal(body, &parsed); err != nil {
+			http.Error(w, fmt.Sprintf("Ошибка парсинга правила: %v", err), http.StatusBadRequest)
+			return
+		}
+		if parsed.Name == "" {
+			http.Error(w, "У правила должно быть имя (name)", http.StatusBadRequest)
+			return
+		}
+		if fields := unsafeRuleFields(&parsed); len(fields) > 0 && !adminUnsafeRules {
+			http.Error(w, fmt.Sprintf("Поля %s через API запрещены, задайте ADMIN_ALLOW_UNSAFE_RULES=true", strings.Join(fields, ", ")), http.StatusForbidden)
+			return
+		}
+		rule = json.RawMessage(body)
+		// Имя нового или переименованного правила не должно совпадать с существующим
+		if parsed.Name != name || r.Method == http.MethodPost {
+			for _, existing := range rules {
+				if ruleName(existing) == parsed.Name {
+					http.Error(w, fmt.Sprintf("Правило '%s' уже существует", parsed.Name), http.StatusConflict)
+					return
+				}
+			}
+		}
+	}
 
-		// Логируем тело входящего запроса
-		if len(requestBody) > 0 && logSettings.ShowRequestBody {
-			logBody("📤 Request Body", requestBody, r.Header.Get("Content-Type"), r.Header)
+	switch r.Method {
+	case http.MethodPost:
+		rules = append(rules, rule)
+	case http.MethodPut, http.MethodDelete:
+		if index < 0 {
+			http.Error(w, fmt.Sprintf("Правило '%s' не найдено", name), http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodPut {
+			rules[index] = rule
+		} else {
+			rules = append(rules[:index], rules[index+1:]...)
 		}
+	default:
+		http.Error(w, "Используйте GET, POST, PUT или DELETE", http.StatusMethodNotAllowed)
+		return
+	}
 
-		// Создаем новый Reader для прокси запроса
-		bodyReader = bytes.NewReader(requestBody)
+	// Собираем новую конфигурацию, остальные разделы файла не меняются
+	updated := make(map[string]json.RawMessage, len(raw)+1)
+	for key, value := range raw {
+		updated[key] = value
+	}
+	if rules == nil {
+		rules = []json.RawMessage{}
 	}
+	updated["overrides"], _ = json.Marshal(rules)
+	if name == "" {
+		name = ruleName(rule)
+	}
+	applyRulesConfig(w, r, target, file, updated, fmt.Sprintf("%s '%s'", r.Method, name))
+}
 
-	// Создаем новый HTTP запрос
-	proxyReq, err := http.NewRequest(r.Method, proxyURL.String(), bodyReader)
+// applyRulesConfig разбирает измененную конфигурацию, заменяет ею текущую и с CONFIG_PERSIST
+// записывает в файл; результат (или ошибка) отправляется клиенту
+func applyRulesConfig(w http.ResponseWriter, r *http.Request, target *atomic.Pointer[Config], file string, raw map[string]json.RawMessage, action string) {
+	data, err := json.MarshalIndent(raw, "", "  ")
 	if err != nil {
-		http.Error(w, "Ошибка создания запроса", http.StatusInternalServerError)
-		log.Printf("❌ Ошибка создания запроса: %v", err)
+		http.Error(w, fmt.Sprintf("Ошибка сериализации конфигурации: %v", err), http.StatusInternalServerError)
+		return
+	}
+	loaded, ok := parseConfig(data)
+	if !ok && len(loaded.diagnostics) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":       "CONFIG_STRICT: конфигурация с замечаниями к паттернам отклонена, правила не изменены",
+			"diagnostics": loaded.diagnostics,
+		})
+		return
+	}
+	if !ok {
+		http.Error(w, "Ошибка разбора конфигурации, правила не изменены", http.StatusBadRequest)
 		return
 	}
 
-	// Копируем заголовки из оригинального запроса
-	copyHeaders(proxyReq.Header, r.Header)
-
-	// Устанавливаем правильный Host заголовок
-	proxyReq.Host = targetURL.Host
+	target.Store(&loaded)
+	if target == &config {
+		rejectedMutex.Lock()
+		rejectedDiagnostics = nil
+		rejectedMutex.Unlock()
+	}
+	requestLogf(r, "✏️  Правила изменены через API: %s, правил: %d", action, len(loaded.Overrides))
+	if loaded.diagnostics == nil {
+		loaded.diagnostics = []RuleDiagnostic{}
+	}
 
-	// ВАЖНО: Убираем Transfer-Encoding и устанавливаем Content-Length
-	if len(requestBody) > 0 {
-		// Принудительно устанавливаем Content-Length
-		proxyReq.ContentLength = int64(len(requestBody))
-		proxyReq.Header.Set("Content-Length", strconv.Itoa(len(requestBody)))
+	persisted := false
+	if configPersist && file != "" {
+		if err := writeConfigFile(file, data); err != nil {
+			requestLogf(r, "⚠️  Не удалось сохранить правила в %s: %v", file, err)
+			http.Error(w, fmt.Sprintf("Правила изменены, но не сохранены в файл: %v", err), http.StatusInternalServerError)
+			return
+		}
+		persisted = true
+		requestLogf(r, "💾 Правила сохранены в %s", file)
+	}
 
-		// Убираем заголовки, связанные с chunked encoding
-		proxyReq.Header.Del("Transfer-Encoding")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"rules":       len(loaded.Overrides),
+		"active":      countActiveOverrides(r),
+		"persisted":   persisted,
+		"diagnostics": loaded.diagnostics,
+	})
+}
 
-		log.Printf("📏 Content-Length установлен: %d bytes", len(requestBody))
-	} else {
-		// Для запросов без тела также убираем Transfer-Encoding
-		proxyReq.Header.Del("Transfer-Encoding")
-		proxyReq.ContentLength = 0
+// handleRuleDiagnostics ошибки и замечания к паттернам текущих правил (GET /_proxy/rules/diagnostics)
+func handleRuleDiagnostics(w http.ResponseWriter, r *http.Request) {
+	target, file := rulesTarget(r)
+	diagnostics := configSnapshot(target).diagnostics
+	rejectedMutex.Lock()
+	rejected := rejectedDiagnostics
+	rejectedMutex.Unlock()
+	if target != &config {
+		rejected = nil
+	}
+	if diagnostics == nil {
+		diagnostics = []RuleDiagnostic{}
 	}
 
-	// Выполняем запрос через настроенный клиент (с прокси если настроен)
-	resp, err := httpClient.Do(proxyReq)
-	if err != nil {
-		http.Error(w, "Ошибка выполнения запроса", http.StatusBadGateway)
-		log.Printf("❌ Ошибка выполнения запроса: %v", err)
-		return
+	response := map[string]interface{}{
+		"file":        file,
+		"strict":      configStrict,
+		"diagnostics": diagnostics,
 	}
-	defer resp.Body.Close()
+	if rejected != nil {
+		response["rejected"] = rejected
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
 
-	// Читаем тело ответа для логирования
-	responseBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		http.Error(w, "Ошибка чтения ответа", http.StatusInternalServerError)
-		log.Printf("❌ Ошибка чтения тела ответа: %v", err)
+// handleOverridesExport отдает полный документ конфигурации (GET /_proxy/overrides/export)
+func handleOverridesExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Используйте GET", http.StatusMethodNotAllowed)
 		return
 	}
+	target, _ := rulesTarget(r)
+	raw := configSnapshot(target).raw
+	if raw == nil {
+		raw = map[string]json.RawMessage{"overrides": json.RawMessage("[]")}
+	}
 
-	// Логируем статус ответа
-	log.Printf("📥 Response Status: %d %s", resp.StatusCode, resp.Status)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="overrides.json"`)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(raw)
+}
 
-	// Логируем заголовки ответа
-	if logSettings.ShowResponseHeaders {
-		logHeaders("📥 Response Headers", resp.Header)
+// handleOverridesImport загружает документ конфигурации (POST /_proxy/overrides/import?mode=replace|merge):
+// replace заменяет конфигурацию целиком, merge добавляет правила и заменяет одноименные
+func handleOverridesImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Используйте POST", http.StatusMethodNotAllowed)
+		return
 	}
-
-	// Логируем тело ответа
-	if len(responseBody) > 0 && logSettings.ShowResponseBody {
-		logBody("📥 Response Body", responseBody, resp.Header.Get("Content-Type"), resp.Header)
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = "replace"
 	}
-
-	// Применяем замены из правил override если они есть (для всех запросов)
-	fullURL := r.URL.Path
-	if r.URL.RawQuery != "" {
-		fullURL += "?" + r.URL.RawQuery
+	if mode != "replace" && mode != "merge" {
+		http.Error(w, "Неизвестный режим: используйте replace или merge", http.StatusBadRequest)
+		return
 	}
-	if matchedOverride := findMatchingOverrideForReplacements(r.Method, fullURL); matchedOverride != nil {
-		if len(matchedOverride.BodyReplacements) > 0 && len(responseBody) > 0 {
-			log.Printf("🔄 Применяем замены из правила '%s' к проксированному ответу...", matchedOverride.Name)
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Ошибка чтения тела: %v", err), http.StatusBadRequest)
+		return
+	}
+	var imported map[string]json.RawMessage
+	if err := json.Unmarshal(body, &imported); err != nil {
+		http.Error(w, fmt.Sprintf("Ошибка парсинга конфигурации: %v", err), http.StatusBadRequest)
+		return
+	}
+	if !adminUnsafeRules {
+		fields, err := unsafeConfigFields(imported)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Ошибка парсинга конфигурации: %v", err), http.StatusBadRequest)
+			return
+		}
+		if len(fields) > 0 {
+			http.Error(w, fmt.Sprintf("Поля %s через API запрещены, задайте ADMIN_ALLOW_UNSAFE_RULES=true", strings.Join(fields, ", ")), http.StatusForbidden)
+			return
+		}
+	}
+
+	rulesEditMutex.Lock()
+	defer rulesEditMutex.Unlock()
+
+	target, file := rulesTarget(r)
+	updated := imported
+	if mode == "merge" {
+		raw := configSnapshot(target).raw
+		if raw == nil && file != "" {
+			http.Error(w, fmt.Sprintf("Конфигурация %s не загружена, объединять не с чем - используйте mode=replace", file), http.StatusConflict)
+			return
+		}
+		if updated, err = mergeRawConfig(raw, imported); err != nil {
+			http.Error(w, fmt.Sprintf("Ошибка объединения конфигурации: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if _, ok := updated["overrides"]; !ok {
+		updated["overrides"] = json.RawMessage("[]")
+	}
+	applyRulesConfig(w, r, target, file, updated, "импорт ("+mode+")")
+}
+
+// unsafeConfigFields поля script и body_file в правилах и шаблонах ответов импортируемого документа
+// (в виде "overrides[имя].script")
+func unsafeConfigFields(raw map[string]json.RawMessage) ([]string, error) {
+	var fields []string
+	if data, ok := raw["overrides"]; ok {
+		var rules []ResponseOverride
+		if err := json.Unmarshal(data, &rules); err != nil {
+			return nil, fmt.Errorf("overrides: %v", err)
+		}
+		for i := range rules {
+			for _, field := range unsafeRuleFields(&rules[i]) {
+				fields = append(fields, fmt.Sprintf("overrides[%s].%s", rules[i].Name, field))
+			}
+		}
+	}
+	if data, ok := raw["responses"]; ok {
+		var templates map[string]ResponseTemplate
+		if err := json.Unmarshal(data, &templates); err != nil {
+			return nil, fmt.Errorf("responses: %v", err)
+		}
+		for name, template := range templates {
+			if template.BodyFile != "" {
+				fields = append(fields, fmt.Sprintf("responses[%s].body_file", name))
+			}
+		}
+	}
+	sort.Strings(fields)
+	return fields, nil
+}
+
+// mergeRawConfig объединяет документы конфигурации: правила - по name, host_headers - по host, routes - по pattern,
+// conditions и responses - по ключам; при совпадении побеждает импортируемое значение
+func mergeRawConfig(current, imported map[string]json.RawMessage) (map[string]json.RawMessage, error) {
+	merged := make(map[string]json.RawMessage, len(current)+len(imported))
+	for key, value := range current {
+		merged[key] = value
+	}
+	for key, value := range imported {
+		existing, ok := merged[key]
+		if !ok {
+			merged[key] = value
+			continue
+		}
+		var err error
+		switch key {
+		case "overrides":
+			merged[key], err = mergeRawList(existing, value, "name")
+		case "host_headers", "request_signing":
+			merged[key], err = mergeRawList(existing, value, "host")
+		case "routes":
+			merged[key], err = mergeRawList(existing, value, "pattern")
+		case "conditions", "responses":
+			merged[key], err = mergeRawMap(existing, value)
+		default:
+			merged[key] = value
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return merged, nil
+}
+
+// mergeRawList заменяет элементы списка с тем же значением поля field и добавляет новые в конец
+func mergeRawList(current, imported json.RawMessage, field string) (json.RawMessage, error) {
+	var items, additions []json.RawMessage
+	if err := json.Unmarshal(current, &items); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(imported, &additions); err != nil {
+		return nil, err
+	}
+	key := func(item json.RawMessage) string {
+		var fields map[string]json.RawMessage
+		json.Unmarshal(item, &fields)
+		return string(fields[field])
+	}
+	for _, addition := range additions {
+		replaced := false
+		for i, item := range items {
+			if value := key(item); value != "" && value == key(addition) {
+				items[i] = addition
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			items = append(items, addition)
+		}
+	}
+	return json.Marshal(items)
+}
+
+// mergeRawMap добавляет ключи импортируемого объекта, заменяя совпадающие
+func mergeRawMap(current, imported json.RawMessage) (json.RawMessage, error) {
+	var values, additions map[string]json.RawMessage
+	if err := json.Unmarshal(current, &values); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(imported, &additions); err != nil {
+		return nil, err
+	}
+	if values == nil {
+		values = make(map[string]json.RawMessage, len(additions))
+	}
+	for key, value := range additions {
+		values[key] = value
+	}
+	return json.Marshal(values)
+}
+
+// rulesTarget конфигурация, которую меняет запрос, и ее файл (пусто, если у арендатора нет своего файла)
+func rulesTarget(r *http.Request) (*atomic.Pointer[Config], string) {
+	if tenant := tenantFromRequest(r); tenant != nil {
+		return &tenant.config, tenant.OverrideConfig
+	}
+	return &config, configFile
+}
+
+// ruleName имя правила из его JSON
+func ruleName(rule json.RawMessage) string {
+	var named struct {
+		Name string `json:"name"`
+	}
+	json.Unmarshal(rule, &named)
+	return named.Name
+}
+
+// writeConfigFile записывает конфигурацию через временный файл; прежняя версия сохраняется в file.bak
+func writeConfigFile(file string, data []byte) error {
+	if previous, err := os.ReadFile(file); err == nil {
+		if err := os.WriteFile(file+".bak", previous, 0644); err != nil {
+			return fmt.Errorf("резервная копия: %v", err)
+		}
+	}
+	temp := file + ".tmp"
+	if err := os.WriteFile(temp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, file)
+}
+
+func createExampleConfig(configFile string) {
+	exampleConfig := Config{
+		Overrides: []ResponseOverride{
+			{
+				Name:         "Yandex bindings - срабатывает после 3 запросов",
+				Method:       "*",
+				URLPattern:   "/bindings",
+				IsRegex:      false,
+				StatusCode:   200,
+				TriggerAfter: 3,
+				MaxTriggers:  2,
+				ResetAfter:   10,
+				Headers: map[string]string{
+					"Content-Type": "application/json",
+					"X-Custom":     "overridden-after-3-requests",
+				},
+				BodyFile: "responses/bindings.json",
+				Enabled:  true,
+			},
+			{
+				Name:         "API users - мгновенная подмена",
+				Method:       "GET",
+				URLPattern:   `/api/users/\d+`,
+				IsRegex:      true,
+				StatusCode:   200,
+				TriggerAfter: 0,  // срабатывает сразу
+				MaxTriggers:  -1, // бесконечно
+				Headers: map[string]string{
+					"Content-Type": "application/json",
+				},
+				BodyText: `{"id": 123, "name": "Mock User", "email": "mock@example.com", "mocked": true}`,
+				Enabled:  false,
+			},
+			{
+				Name:         "Error simulation - после 5 запросов",
+				Method:       "POST",
+				URLPattern:   "/api/submit",
+				IsRegex:      false,
+				StatusCode:   500,
+				TriggerAfter: 5,
+				MaxTriggers:  1, // только один раз
+				Headers: map[string]string{
+					"Content-Type": "application/json",
+				},
+				BodyText: `{"error": "Simulated server error after 5 requests", "code": "MOCK_ERROR"}`,
+				Enabled:  false,
+			},
+		},
+	}
+
+	data, _ := json.MarshalIndent(exampleConfig, "", "  ")
+	err := os.WriteFile(configFile, data, 0644)
+	if err != nil {
+		log.Printf("⚠️  Не удалось создать пример конфигурации: %v", err)
+	} else {
+		log.Printf("📝 Создан пример конфигурации: %s", configFile)
+
+		// Создаем директорию для файлов ответов
+		os.MkdirAll("responses", 0755)
+
+		// Создаем пример файла ответа
+		exampleResponse := map[string]interface{}{
+			"status": "success",
+			"data": map[string]interface{}{
+				"bindings": []map[string]interface{}{
+					{"id": 1, "name": "binding1", "type": "primary"},
+					{"id": 2, "name": "binding2", "type": "secondary"},
+					{"id": 3, "name": "binding3", "type": "primary"},
+				},
+				"total": 3,
+			},
+			"message":      "This is a mocked response from file (triggered after N requests)",
+			"triggered_at": "auto-generated",
+		}
+		responseData, _ := json.MarshalIndent(exampleResponse, "", "  ")
+		os.WriteFile("responses/bindings.json", responseData, 0644)
+		log.Printf("📝 Создан пример ответа: responses/bindings.json")
+	}
+}
+
+// countActiveOverrides считает включенные правила арендатора запроса или основной конфигурации (r может быть nil)
+func countActiveOverrides(r *http.Request) int {
+	count := 0
+	overrides := currentOverrides(r)
+	for i := range overrides {
+		if overrides[i].Enabled {
+			count++
+		}
+	}
+	return count
+}
+
+func findMatchingOverride(method, urlPath, contentType string, r *http.Request) *ResponseOverride {
+	overrides := currentOverrides(r)
+	var urlMisses []*ResponseOverride
+	conditionsMet := false
+	for i := range overrides {
+		override := &overrides[i]
+		if !override.Enabled {
+			continue
+		}
+
+		// Запросы, не прошедшие только одно условие, попадают в отчет о покрытии как близкие промахи
+		switch reason := overrideMismatch(override, method, urlPath, contentType, r); reason {
+		case "":
+			conditionsMet = true
+		case "*", "excluded":
+			continue
+		case "url":
+			urlMisses = append(urlMisses, override)
+			continue
+		default:
+			recordCloseMiss(override, method, urlPath, reason)
+			continue
+		}
+
+		// Счетчики учитывают каждый запрос, прошедший условия правила, до проверки лимитов: trigger_after
+		// и reset_after считают запросы, а не срабатывания, поэтому запросы, отклоненные max_concurrent,
+		// max_triggers или cooldown, тоже занимают номер. Срабатывания учитываются отдельно в claimTrigger.
+		// Каждый запрос получает свой номер: параллельные запросы не блокируют друг друга,
+		// а порог trigger_after и цикл reset_after определяются номером, а не общим состоянием
+		atomic.AddInt64(&override.matchCount, 1)
+		seq := atomic.AddInt64(&override.requestSeq, 1)
+		cycle, requestCount := override.requestPosition(seq)
+
+		// Запрос, завершающий цикл reset_after, сбрасывает счетчики и не срабатывает
+		if override.ResetAfter > 0 && requestCount == 0 {
+			requestLogf(r, "🔄 Сброс счетчиков для правила '%s' (достигнуто %d запросов)",
+				override.Name, override.ResetAfter)
+			continue
+		}
+
+		// Проверяем, достигли ли порога срабатывания
+		if requestCount <= int64(override.TriggerAfter) {
+			requestLogf(r, "📊 Правило '%s': запрос %d (нужно %d для срабатывания)",
+				override.Name, requestCount, override.TriggerAfter+1)
+			continue
+		}
+
+		// Лимит одновременных срабатываний: место занимается до проверки остальных лимитов
+		if active := atomic.AddInt64(&override.activeTriggers, 1); override.MaxConcurrent > 0 && active > int64(override.MaxConcurrent) {
+			atomic.AddInt64(&override.activeTriggers, -1)
+			requestLogf(r, "🚦 Правило '%s': достигнут лимит одновременных срабатываний (%d)",
+				override.Name, override.MaxConcurrent)
+			continue
+		}
+
+		triggerCount, denied := override.claimTrigger(cycle, time.Now())
+		if denied != "" {
+			atomic.AddInt64(&override.activeTriggers, -1)
+			switch denied {
+			case "max_triggers":
+				requestLogf(r, "📊 Правило '%s': запрос %d (достигнут лимит срабатываний %d)",
+					override.Name, requestCount, override.MaxTriggers)
+			case "cooldown":
+				requestLogf(r, "⏳ Правило '%s': пауза после срабатывания, осталось %v",
+					override.Name, override.cooldownRemaining().Round(time.Millisecond))
+			}
+			continue
+		}
+
+		requestLogf(r, "📊 Правило '%s': запрос %d, срабатывание %d",
+			override.Name, requestCount, triggerCount)
+		notifyRuleTriggered(override, r, int(requestCount), int(triggerCount))
+		return override
+	}
+
+	// Похожесть URL считается, только если запрос не подошел ни под одно правило
+	if !conditionsMet {
+		for _, override := range urlMisses {
+			if isCloseURL(urlPath, override) {
+				recordCloseMiss(override, method, urlPath, "url")
+			}
+		}
+	}
+	return nil
+}
+
+// requestPosition цикл reset_after и номер запроса в нем (0 - запрос, завершающий цикл)
+func (o *ResponseOverride) requestPosition(seq int64) (cycle, position int64) {
+	if o.ResetAfter <= 0 {
+		return 0, seq
+	}
+	return seq / int64(o.ResetAfter), seq % int64(o.ResetAfter)
+}
+
+// claimTrigger учитывает срабатывание, если позволяют max_triggers и cooldown. Возвращает номер
+// срабатывания в цикле или причину отказа: "max_triggers", "cooldown", "cycle" (цикл уже завершен)
+func (o *ResponseOverride) claimTrigger(cycle int64, now time.Time) (int64, string) {
+	for {
+		current := o.triggers.Load()
+		next := triggerState{cycle: cycle}
+		if current != nil {
+			if current.cycle > cycle {
+				return current.count, "cycle"
+			}
+			next.last = current.last
+			if current.cycle == cycle {
+				next.count = current.count
+			}
+		}
+		if o.MaxTriggers > 0 && next.count >= int64(o.MaxTriggers) {
+			return next.count, "max_triggers"
+		}
+		if o.cooldownDuration > 0 && !next.last.IsZero() && now.Sub(next.last) < o.cooldownDuration {
+			return next.count, "cooldown"
+		}
+		next.count++
+		next.last = now
+		if o.triggers.CompareAndSwap(current, &next) {
+			return next.count, ""
+		}
+	}
+}
+
+func (o *ResponseOverride) cooldownRemaining() time.Duration {
+	if state := o.triggers.Load(); state != nil {
+		return o.cooldownDuration - time.Since(state.last)
+	}
+	return 0
+}
+
+// requestCount номер последнего запроса в текущем цикле reset_after
+func (o *ResponseOverride) requestCount() int64 {
+	_, position := o.requestPosition(atomic.LoadInt64(&o.requestSeq))
+	return position
+}
+
+// triggerCount срабатывания в текущем цикле reset_after
+func (o *ResponseOverride) triggerCount() int64 {
+	state := o.triggers.Load()
+	if state == nil {
+		return 0
+	}
+	if cycle, _ := o.requestPosition(atomic.LoadInt64(&o.requestSeq)); state.cycle != cycle {
+		return 0
+	}
+	return state.count
+}
+
+// overrideMismatch проверяет условия правила без изменения счетчиков. Возвращает "" при совпадении,
+// единственное несовпавшее условие ("method", "content_type", "url", "matcher", "when"), "excluded" для
+// URL из exclude_url_patterns или "*", если не выполнено несколько условий
+func overrideMismatch(override *ResponseOverride, method, urlPath, contentType string, r *http.Request) string {
+	// Проверяем метод
+	methodMatches := override.Method == "*" || strings.EqualFold(override.Method, method)
+
+	// Проверяем Content-Type запроса
+	contentTypeMatches := matchContentType(contentType, override.RequestContentTypes)
+
+	// Проверяем URL (с match_full_url - вместе со схемой и хостом)
+	var matches bool
+	if override.MatchFullURL && r != nil {
+		matches = override.matchesURL(absoluteRequestURL(r, urlPath))
+	} else {
+		matches = override.matchesURL(urlPath)
+	}
+
+	switch {
+	case !methodMatches && contentTypeMatches && matches:
+		return "method"
+	case methodMatches && !contentTypeMatches && matches:
+		return "content_type"
+	case methodMatches && contentTypeMatches && !matches:
+		return "url"
+	case !methodMatches || !contentTypeMatches || !matches:
+		return "*"
+	}
+
+	// Исключения проверяются по пути и по пути с query
+	if isExcludedURL(urlPath, override.ExcludeURLPatterns) {
+		return "excluded"
+	}
+
+	// Проверяем пользовательский matcher
+	if override.Matcher != "" && !runMatcher(override.Matcher, r) {
+		return "matcher"
+	}
+
+	// Проверяем дерево условий
+	if override.When != nil && !override.When.matches(method, urlPath, r) {
+		return "when"
+	}
+	return ""
+}
+
+// matchesURL сравнивает URL запроса (путь с query) с url_pattern по match_type правила.
+// exact и glob сравниваются с путем без query, если в паттерне нет "?"
+func (o *ResponseOverride) matchesURL(urlPath string) bool {
+	requestPath := urlPath
+	if !strings.Contains(o.URLPattern, "?") {
+		if index := strings.Index(requestPath, "?"); index >= 0 {
+			requestPath = requestPath[:index]
+		}
+	}
+
+	switch o.MatchType {
+	case "regex":
+		return o.compiledRegex != nil && o.compiledRegex.MatchString(urlPath)
+	case "glob":
+		return o.compiledRegex != nil && o.compiledRegex.MatchString(requestPath)
+	}
+
+	pattern := o.URLPattern
+	if o.CaseInsensitive {
+		pattern, urlPath, requestPath = strings.ToLower(pattern), strings.ToLower(urlPath), strings.ToLower(requestPath)
+	}
+	switch o.MatchType {
+	case "exact":
+		return requestPath == pattern
+	case "prefix":
+		return strings.HasPrefix(urlPath, pattern)
+	default:
+		return strings.Contains(urlPath, pattern)
+	}
+}
+
+// absoluteRequestURL полный URL запроса: в режиме HTTP proxy схема и хост берутся из строки запроса,
+// в режиме forward proxy - из заголовка Host
+func absoluteRequestURL(r *http.Request, urlPath string) string {
+	scheme, host := r.URL.Scheme, r.URL.Host
+	if host == "" {
+		host = r.Host
+	}
+	if scheme == "" {
+		scheme = "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+	}
+	return scheme + "://" + host + urlPath
+}
+
+// isExcludedURL проверяет URL запроса по wildcard паттернам исключений
+func isExcludedURL(urlPath string, patterns []string) bool {
+	requestPath := urlPath
+	if index := strings.Index(requestPath, "?"); index >= 0 {
+		requestPath = requestPath[:index]
+	}
+	for _, pattern := range patterns {
+		if matchURLPattern(requestPath, pattern) || matchURLPattern(urlPath, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// conditionBodyLimit - сколько байт тела запроса читается для проверки условий
+const conditionBodyLimit = 1 << 20
+
+// applyResponseTemplate заполняет незаданные в правиле поля ответа из шаблона; заголовки объединяются
+func applyResponseTemplate(override *ResponseOverride, template ResponseTemplate) {
+	if override.StatusCode == 0 {
+		override.StatusCode = template.StatusCode
+	}
+	if override.BodyFile == "" && override.BodyText == "" {
+		override.BodyFile = template.BodyFile
+		override.BodyText = template.BodyText
+		if override.BodyFileOrder == "" {
+			override.BodyFileOrder = template.BodyFileOrder
+		}
+		override.BodyTemplate = override.BodyTemplate || template.BodyTemplate
+	}
+	if len(template.Headers) > 0 {
+		headers := make(map[string]string, len(template.Headers)+len(override.Headers))
+		for name, value := range template.Headers {
+			headers[name] = value
+		}
+		for name, value := range override.Headers {
+			headers[name] = value
+		}
+		override.Headers = headers
+	}
+}
+
+// compileCondition проверяет узел и компилирует его regex; resolving - цепочка разрешаемых ссылок ref
+func compileCondition(c *Condition, named map[string]*Condition, resolving []string) error {
+	if c.Ref != "" {
+		if containsName(resolving, c.Ref) {
+			return fmt.Errorf("циклическая ссылка на условие '%s'", c.Ref)
+		}
+		target := named[c.Ref]
+		if target == nil {
+			return fmt.Errorf("условие '%s' не найдено в conditions", c.Ref)
+		}
+		if err := compileCondition(target, named, append(resolving, c.Ref)); err != nil {
+			return err
+		}
+		c.resolvedRef = target
+	}
+
+	subjects := 0
+	for _, name := range []string{c.Header, c.Query, c.BodyJSON} {
+		if name != "" {
+			subjects++
+		}
+	}
+	if subjects > 1 {
+		return fmt.Errorf("header, query и body_json должны быть в разных узлах")
+	}
+	if subjects == 0 && (c.Equals != nil || c.Contains != "" || c.Regex != "" || c.Exists != nil) {
+		return fmt.Errorf("equals/contains/regex/exists требуют header, query или body_json")
+	}
+
+	var err error
+	if c.URLRegex != "" {
+		if c.compiledURLRegex, err = regexp.Compile(c.URLRegex); err != nil {
+			return fmt.Errorf("url_regex '%s': %v", c.URLRegex, err)
+		}
+	}
+	if c.BodyRegex != "" {
+		if c.compiledBodyRegex, err = regexp.Compile(c.BodyRegex); err != nil {
+			return fmt.Errorf("body_regex '%s': %v", c.BodyRegex, err)
+		}
+	}
+	if c.Regex != "" {
+		if c.compiledValueRegex, err = regexp.Compile(c.Regex); err != nil {
+			return fmt.Errorf("regex '%s': %v", c.Regex, err)
+		}
+	}
+
+	for _, child := range append(append([]*Condition(nil), c.All...), c.Any...) {
+		if child == nil {
+			return fmt.Errorf("пустое условие в all/any")
+		}
+		if err := compileCondition(child, named, resolving); err != nil {
+			return err
+		}
+	}
+	if c.Not != nil {
+		return compileCondition(c.Not, named, resolving)
+	}
+	return nil
+}
+
+// matches вычисляет узел дерева условий; url и url_regex проверяют путь без query
+func (c *Condition) matches(method, urlPath string, r *http.Request) bool {
+	if c.resolvedRef != nil && !c.resolvedRef.matches(method, urlPath, r) {
+		return false
+	}
+	for _, child := range c.All {
+		if !child.matches(method, urlPath, r) {
+			return false
+		}
+	}
+	if len(c.Any) > 0 {
+		found := false
+		for _, child := range c.Any {
+			if child.matches(method, urlPath, r) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if c.Not != nil && c.Not.matches(method, urlPath, r) {
+		return false
+	}
+
+	if c.Method != "" {
+		found := false
+		for _, candidate := range strings.Split(c.Method, "|") {
+			if strings.EqualFold(strings.TrimSpace(candidate), method) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	requestPath := urlPath
+	if index := strings.Index(requestPath, "?"); index >= 0 {
+		requestPath = requestPath[:index]
+	}
+	if c.URL != "" && !matchURLPattern(requestPath, c.URL) {
+		return false
+	}
+	if c.compiledURLRegex != nil && !c.compiledURLRegex.MatchString(requestPath) {
+		return false
+	}
+
+	if c.Header == "" && c.Query == "" && c.BodyJSON == "" && c.BodyContains == "" && c.compiledBodyRegex == nil {
+		return true
+	}
+	if r == nil {
+		return false
+	}
+
+	if c.Header != "" {
+		values, present := r.Header[http.CanonicalHeaderKey(c.Header)]
+		if !c.matchValue(strings.Join(values, ","), present) {
+			return false
+		}
+	}
+	if c.Query != "" {
+		values, present := r.URL.Query()[c.Query]
+		if !c.matchValue(strings.Join(values, ","), present) {
+			return false
+		}
+	}
+
+	if c.BodyJSON == "" && c.BodyContains == "" && c.compiledBodyRegex == nil {
+		return true
+	}
+	body := peekRequestBody(r)
+	if c.BodyContains != "" && !bytes.Contains(body, []byte(c.BodyContains)) {
+		return false
+	}
+	if c.compiledBodyRegex != nil && !c.compiledBodyRegex.Match(body) {
+		return false
+	}
+	if c.BodyJSON != "" {
+		value, present := lookupJSONPath(body, c.BodyJSON)
+		if !c.matchValue(value, present) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchValue применяет equals/contains/regex/exists к значению заголовка, параметра или поля JSON
+func (c *Condition) matchValue(value string, present bool) bool {
+	if c.Exists != nil {
+		if *c.Exists != present {
+			return false
+		}
+		if !present {
+			return true
+		}
+	}
+	if !present {
+		return false
+	}
+	if c.Equals != nil && value != *c.Equals {
+		return false
+	}
+	if c.Contains != "" && !strings.Contains(value, c.Contains) {
+		return false
+	}
+	if c.compiledValueRegex != nil && !c.compiledValueRegex.MatchString(value) {
+		return false
+	}
+	return true
+}
+
+// peekedBody тело запроса, начало которого уже прочитано для проверки условий
+type peekedBody struct {
+	io.Reader
+	io.Closer
+	data []byte // Прочитанное начало (распакованное, если тело в gzip)
+}
+
+// peekRequestBody читает начало тела запроса (не более conditionBodyLimit) и возвращает его,
+// не мешая дальнейшему проксированию; повторные вызовы не читают тело заново.
+// При Expect: 100-continue тело не читается: чтение отправило бы клиенту 100 Continue
+// до того, как сервер решит, принимать ли тело
+func peekRequestBody(r *http.Request) []byte {
+	if expectsContinue(r) {
+		if peeked, ok := r.Body.(*peekedBody); ok {
+			return peeked.data
+		}
+		return nil
+	}
+	return peekBody(r)
+}
+
+// peekBody читает начало тела без проверки Expect - для ответов, которые прокси формирует сам
+func peekBody(r *http.Request) []byte {
+	if peeked, ok := r.Body.(*peekedBody); ok {
+		return peeked.data
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, conditionBodyLimit))
+	if err != nil {
+		requestLogf(r, "⚠️  Ошибка чтения тела запроса для проверки условий: %v", err)
+	}
+	peeked := &peekedBody{Reader: io.MultiReader(bytes.NewReader(data), r.Body), Closer: r.Body, data: data}
+	if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		if decompressed, err := decompressGzip(data); err == nil {
+			peeked.data = decompressed
+		}
+	}
+	r.Body = peeked
+	return peeked.data
+}
+
+// lookupJSONPath находит значение по пути через точку (индексы массивов - числами);
+// строки возвращаются как есть, остальные значения - в виде JSON
+func lookupJSONPath(body []byte, path string) (string, bool) {
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return "", false
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch node := value.(type) {
+		case map[string]interface{}:
+			child, ok := node[key]
+			if !ok {
+				return "", false
+			}
+			value = child
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(node) {
+				return "", false
+			}
+			value = node[index]
+		default:
+			return "", false
+		}
+	}
+	if text, ok := value.(string); ok {
+		return text, true
+	}
+	data, _ := json.Marshal(value)
+	return string(data), true
+}
+
+// releaseOverride отмечает завершение срабатывания правила (для лимита max_concurrent)
+func releaseOverride(override *ResponseOverride) {
+	atomic.AddInt64(&override.activeTriggers, -1)
+}
+
+// findMatchingOverrideForReplacements ищет правило только для применения замен (без учета триггеров)
+func findMatchingOverrideForReplacements(method, urlPath, requestContentType, responseContentType string, r *http.Request) *ResponseOverride {
+	return findResponseOverride(method, urlPath, requestContentType, responseContentType, r, func(override *ResponseOverride) bool {
+		return len(override.BodyReplacements) > 0
+	})
+}
+
+// findMatchingOverrideForSSE ищет правило для обработки событий SSE потока (без учета триггеров)
+func findMatchingOverrideForSSE(method, urlPath, requestContentType, responseContentType string, r *http.Request) *ResponseOverride {
+	return findResponseOverride(method, urlPath, requestContentType, responseContentType, r, hasSSEProcessing)
+}
+
+// hasSSEProcessing проверяет, что правилу есть что делать с событиями SSE
+func hasSSEProcessing(override *ResponseOverride) bool {
+	return len(override.BodyReplacements) > 0 || len(override.SSEDropEvents) > 0 || len(override.SSEInjectEvents) > 0
+}
+
+// findResponseOverride ищет первое включенное правило, для которого applies возвращает true и выполнены
+// условия запроса и Content-Type ответа. Счетчики и триггеры не учитываются: правило применяется к ответу,
+// запрос уже учтен в findMatchingOverride
+func findResponseOverride(method, urlPath, requestContentType, responseContentType string, r *http.Request, applies func(*ResponseOverride) bool) *ResponseOverride {
+	overrides := currentOverrides(r)
+	for i := range overrides {
+		override := &overrides[i]
+		if !override.Enabled || !applies(override) {
+			continue
+		}
+
+		// Проверяем Content-Type ответа и остальные условия правила
+		if !matchContentType(responseContentType, override.ResponseContentTypes) {
+			continue
+		}
+		if overrideMismatch(override, method, urlPath, requestContentType, r) == "" {
+			return override
+		}
+	}
+	return nil
+}
+
+// matchContentType проверяет Content-Type по списку паттернов ("application/json", "image/*", "*/*")
+func matchContentType(contentType string, patterns []string) bool {
+	// Если паттерны не заданы - подходит любой
+	if len(patterns) == 0 {
+		return true
+	}
+
+	// Отбрасываем параметры (charset, boundary и т.д.)
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		switch {
+		case pattern == "*" || pattern == "*/*":
+			return true
+		case strings.HasSuffix(pattern, "/*"):
+			if strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		case mediaType == pattern:
+			return true
+		}
+	}
+	return false
+}
+
+// handleAdminRequest обрабатывает служебные эндпоинты прокси, для остальных запросов возвращает false
+func handleAdminRequest(w http.ResponseWriter, r *http.Request) bool {
+	// Изменяющие запросы (правила, перезапуск, прогоны, кеш) принимаются только от администратора
+	if isAdminMutation(r) && !authorizeAdmin(w, r) {
+		return true
+	}
+	switch r.URL.Path {
+	case "/_proxy_stats":
+		showStats(w, r)
+	case "/_proxy_stats/reset":
+		handleStatsReset(w, r)
+	case "/_proxy_restart":
+		handleRestart(w, r)
+	case "/_proxy_bench":
+		handleBenchmark(w, r)
+	case "/_proxy/coverage":
+		showCoverage(w, r)
+	case "/_proxy/verify":
+		handleVerify(w, r)
+	case "/_proxy/budget":
+		handleBudget(w, r)
+	case "/_proxy/ordering":
+		handleOrdering(w, r)
+	case "/_proxy/proxy.pac":
+		handleProxyPAC(w, r)
+	case "/_proxy/journal":
+		showJournal(w, r)
+	case "/_proxy/journal/compare":
+		handleJournalCompare(w, r)
+	case "/_proxy/cache/flush":
+		handleCacheFlush(w, r)
+	case "/_proxy/cache/peer":
+		handleCachePeer(w, r)
+	case "/_proxy/readyz":
+		handleReadyz(w, r)
+	case "/_proxy/maintenance":
+		handleMaintenance(w, r)
+	case "/_proxy/traffic/query":
+		handleTrafficQuery(w, r)
+	case "/_proxy/store":
+		handleMockStore(w, r)
+	case "/_proxy/dns":
+		handleDNSCache(w, r)
+	case "/_proxy/rules":
+		handleRules(w, r)
+	case "/_proxy/rules/diagnostics":
+		handleRuleDiagnostics(w, r)
+	case "/_proxy/overrides/export":
+		handleOverridesExport(w, r)
+	case "/_proxy/overrides/import":
+		handleOverridesImport(w, r)
+	default:
+		if r.URL.Path == "/_proxy/breakpoints" || strings.HasPrefix(r.URL.Path, "/_proxy/breakpoints/") {
+			handleBreakpoints(w, r)
+			return true
+		}
+		if r.URL.Path == "/_proxy/gates" || strings.HasPrefix(r.URL.Path, "/_proxy/gates/") {
+			handleRequestGates(w, r)
+			return true
+		}
+		if r.URL.Path == "/_proxy/cache" || strings.HasPrefix(r.URL.Path, "/_proxy/cache/") {
+			handleCacheEntries(w, r)
+			return true
+		}
+		// Путь готовности без префикса перекрывает путь сервера - только при включенных проверках
+		if len(healthTargets) > 0 && healthCheckSettings.ReadyzPath != "" && r.URL.Path == healthCheckSettings.ReadyzPath {
+			handleReadyz(w, r)
+			return true
+		}
+		return false
+	}
+	return true
+}
+
+// isAdminMutation запрос, меняющий состояние прокси через служебный эндпоинт. Обмен записями кеша
+// проверяется собственным CACHE_PEER_TOKEN
+func isAdminMutation(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	switch path := r.URL.Path; {
+	case path == "/_proxy/cache/peer":
+		return false
+	case path == "/_proxy_stats/reset", path == "/_proxy_restart", path == "/_proxy_bench":
+		return true
+	default:
+		return strings.HasPrefix(path, "/_proxy/")
+	}
+}
+
+// authorizeAdmin проверяет Authorization: Bearer <ADMIN_TOKEN>; без ADMIN_TOKEN допускаются только
+// запросы с loopback адреса. При отказе отвечает 401/403 и возвращает false
+func authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if adminToken != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok && hmac.Equal([]byte(token), []byte(adminToken)) {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="go-proxy-server"`)
+		http.Error(w, "Требуется Authorization: Bearer <ADMIN_TOKEN>", http.StatusUnauthorized)
+		requestLogf(r, "🔐 Отклонен запрос к %s без ADMIN_TOKEN от %s", r.URL.Path, r.RemoteAddr)
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if ip := net.ParseIP(host); err == nil && ip != nil && ip.IsLoopback() {
+		return true
+	}
+	http.Error(w, "Изменяющие запросы к служебным эндпоинтам принимаются только с localhost, задайте ADMIN_TOKEN для удаленного доступа", http.StatusForbidden)
+	requestLogf(r, "🔐 Отклонен запрос к %s с адреса %s", r.URL.Path, r.RemoteAddr)
+	return false
+}
+
+// unsafeRuleFields поля правила, которые запускают команды или читают файлы сервера; через API
+// принимаются только с ADMIN_ALLOW_UNSAFE_RULES=true
+func unsafeRuleFields(rule *ResponseOverride) []string {
+	var fields []string
+	if rule.Script != "" {
+		fields = append(fields, "script")
+	}
+	if rule.BodyFile != "" {
+		fields = append(fields, "body_file")
+	}
+	return fields
+}
+
+func showStats(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", "json", "text", "prometheus":
+	default:
+		http.Error(w, "Неизвестный формат: используйте json, text или prometheus", http.StatusBadRequest)
+		return
+	}
+
+	uptime := time.Since(startedAt).Round(time.Second)
+	overrides := currentOverrides(r)
+	stats := make([]map[string]interface{}, 0, len(overrides))
+
+	for i := range overrides {
+		override := &overrides[i]
+		override.mutex.Lock()
+		stat := map[string]interface{}{
+			"name":              override.Name,
+			"enabled":           override.Enabled,
+			"url_pattern":       override.URLPattern,
+			"method":            override.Method,
+			"trigger_after":     override.TriggerAfter,
+			"max_triggers":      override.MaxTriggers,
+			"reset_after":       override.ResetAfter,
+			"cooldown":          override.Cooldown,
+			"max_concurrent":    override.MaxConcurrent,
+			"request_count":     override.requestCount(),
+			"match_count":       atomic.LoadInt64(&override.matchCount),
+			"trigger_count":     override.triggerCount(),
+			"active_triggers":   atomic.LoadInt64(&override.activeTriggers),
+			"schema_violations": atomic.LoadInt64(&override.schemaViolations),
+		}
+		if override.RateLimit != nil {
+			stat["rate_limit"] = map[string]interface{}{
+				"rate_limited":       override.rateLimited,
+				"violations":         override.backoffViolations,
+				"respected":          override.backoffRespected,
+				"clients_in_backoff": len(override.backoffUntil),
+			}
+		}
+		override.mutex.Unlock()
+		stats = append(stats, stat)
+	}
+
+	response := map[string]interface{}{
+		"uptime":         uptime.String(),
+		"uptime_seconds": int64(uptime.Seconds()),
+		"started_at":     startedAt.Format(time.RFC3339),
+		"stats_reset_at": statsResetTime(),
+		"build":          buildInfo(),
+		"tenant":         tenantName(r),
+		"tenants":        tenantStats(),
+		"overrides":      stats,
+		"total_rules":    len(overrides),
+		"active_rules":   countActiveOverrides(r),
+		"log_settings": map[string]interface{}{
+			"show_request_body":     logSettings.ShowRequestBody,
+			"show_response_body":    logSettings.ShowResponseBody,
+			"show_request_headers":  logSettings.ShowRequestHeaders,
+			"show_response_headers": logSettings.ShowResponseHeaders,
+			"show_tls_info":         logSettings.ShowTLSInfo,
+			"show_timing":           logSettings.ShowTiming,
+			"body_log_mode":         logSettings.BodyLogMode,
+			"max_log_length":        logSettings.MaxLogLength,
+			"routes":                logRouteStats(),
+			"include_patterns":      logSettings.IncludePatterns,
+			"exclude_patterns":      logSettings.ExcludePatterns,
+			"muted_requests":        atomic.LoadInt64(&mutedRequests),
+			"sample_rate":           logSettings.SampleRate,
+			"sampled_out":           atomic.LoadInt64(&logSampledOut),
+		},
+		"proxy_settings": map[string]interface{}{
+			"enabled":                 proxySettings.Enabled,
+			"url":                     proxySettings.URL,
+			"has_auth":                proxySettings.Username != "",
+			"skip_tls_verify":         proxySettings.SkipTLSVerify,
+			"timeout":                 proxySettings.Timeout.String(),
+			"route_timeouts":          routeTimeoutStats(),
+			"expect_continue_timeout": proxySettings.ExpectContinueTimeout.String(),
+		},
+		"cache_settings": map[string]interface{}{
+			"enabled":      cacheSettings.Enabled,
+			"ttl":          cacheSettings.TTL.String(),
+			"cache_hits":   atomic.LoadInt64(&cacheHits),
+			"cache_misses": atomic.LoadInt64(&cacheMisses),
+			"not_modified": atomic.LoadInt64(&cacheNotModified),
+			"cache_size":   getCacheSize(),
+			"excluded":     cacheSettings.ExcludePatterns,
+			"namespaces":   cacheNamespaceStats(),
+			"store":        cacheStoreStats(),
+			"peers":        cachePeerStats(),
+			"coalescing":   cacheCoalescingStats(),
+			"ttl_changes":  atomic.LoadInt64(&cacheExpiryChanged),
+		},
+		"upstreams":       upstreamStats(),
+		"mounts":          mountStats(),
+		"health_checks":   healthCheckStats(),
+		"maintenance":     maintenanceStats(),
+		"client_profiles": clientProfileStats(),
+		"header_scrub":    headerScrubStats(),
+		"header_casing":   headerCasingStats(),
+		"raw_passthrough": rawPassthroughStats(),
+		"keepalive":       keepAliveStats(),
+		"body_headers":    bodyHeadersStats(),
+		"pipeline":        pipelineStats(),
+		"buffer_pool":     bufferPoolStats(),
+		"passthrough":     passthroughStats(),
+		"pac":             pacStats(),
+		"routes":          routeStats(r),
+		"budgets":         budgetStats(r),
+		"ordering":        orderingStats(r),
+		"method_override": methodOverrideStats(),
+		"clock_skew":      clockSkewStats(),
+		"compression":     clientCompressionStats(),
+		"connections":     connectionStats(),
+		"upstream_timing": upstreamTimingStats(),
+		"dns_cache":       dnsCacheStats(),
+		"dial":            dialStats(),
+		"network_shaping": networkShapingStats(),
+		"outbound_source": outboundSourceStats(),
+		"random_seed":     randomSeed,
+		"host_headers": map[string]interface{}{
+			"policies": len(currentHostHeaders(r)),
+			"applied":  atomic.LoadInt64(&hostHeadersApplied),
+		},
+		"request_signing": requestSigningStats(r),
+		"checksums":       checksumStats(r),
+		"tls_connections": tlsConnectionStats(),
+		"tls_settings": map[string]interface{}{
+			"min_version":   tlsVersionSettingName(tlsSettings.MinVersion),
+			"max_version":   tlsVersionSettingName(tlsSettings.MaxVersion),
+			"cipher_suites": tlsSettings.CipherNames,
+			"server_name":   tlsSettings.ServerName,
+			"pinned_hosts":  pinnedHosts(),
+			"fingerprint":   tlsSettings.Fingerprint,
+		},
+		"cookie_settings": map[string]interface{}{
+			"rewrite_domain": cookieSettings.RewriteDomain,
+			"rewrite_path":   cookieSettings.RewritePath,
+			"secure":         cookieSettings.Secure,
+			"same_site":      cookieSettings.SameSite,
+			"jar_enabled":    cookieSettings.JarEnabled,
+			"jar_key":        cookieSettings.JarKey,
+			"jar_clients":    countCookieJars(),
+			"jar_evicted":    atomic.LoadInt64(&cookieJarsEvicted),
+		},
+		"contract_validation": openAPIStats(),
+		"stream_export":       streamExportStats(),
+		"archive":             archiveStats(),
+		"traffic_store":       trafficStoreStats(),
+		"pcap":                pcapExportStats(),
+		"breakpoints":         breakpointStats(false),
+		"gates":               requestGateStats(false),
+		"tags":                tagStatsSnapshot(),
+		"endpoint_stats":      endpointStatsSnapshot(),
+		"duplicates":          duplicateStats(),
+		"unexpected_requests": unexpectedStats(),
+		"mock_store":          mockStoreStats(r),
+	}
+
+	switch format {
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeStatsText(w, response)
+	case "prometheus":
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeStatsPrometheus(w, response)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+var startedAt = time.Now()
+var statsResetAt time.Time // Время последнего сброса счетчиков (под statsResetMutex)
+var statsResetMutex sync.Mutex
+
+func statsResetTime() string {
+	statsResetMutex.Lock()
+	defer statsResetMutex.Unlock()
+	if statsResetAt.IsZero() {
+		return ""
+	}
+	return statsResetAt.Format(time.RFC3339)
+}
+
+// Версия сборки задается при компиляции:
+//
+//	go build -ldflags "-X main.version=v1.8.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Без ldflags commit и время берутся из метаданных VCS, которые Go добавляет при go build в репозитории
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// buildInfo версия сборки: значения ldflags, незаданные - из метаданных Go модуля
+func buildInfo() map[string]interface{} {
+	info := map[string]interface{}{
+		"version":    version,
+		"go_version": runtime.Version(),
+		"platform":   runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if commit != "" {
+		info["commit"] = commit
+	}
+	if buildDate != "" {
+		info["build_date"] = buildDate
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		if version == "dev" && build.Main.Version != "" && build.Main.Version != "(devel)" {
+			info["version"] = build.Main.Version
+		}
+		for _, setting := range build.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if commit == "" {
+					info["commit"] = setting.Value
+				}
+			case "vcs.time":
+				if buildDate == "" {
+					info["commit_time"] = setting.Value
+				}
+			case "vcs.modified":
+				info["modified"] = setting.Value == "true"
+			}
+		}
+	}
+	return info
+}
+
+// versionString однострочное описание сборки для --version и лога запуска
+func versionString() string {
+	info := buildInfo()
+	result := fmt.Sprintf("go-proxy-server %v", info["version"])
+	if value, ok := info["commit"].(string); ok {
+		if len(value) > 12 {
+			value = value[:12]
+		}
+		if modified, _ := info["modified"].(bool); modified {
+			value += "-dirty"
+		}
+		result += " (" + value + ")"
+	}
+	if value, ok := info["build_date"].(string); ok {
+		result += ", собрано " + value
+	} else if value, ok := info["commit_time"].(string); ok {
+		result += ", коммит от " + value
+	}
+	return result + ", " + info["go_version"].(string) + " " + info["platform"].(string)
+}
+
+// statsCounters - накопительные счетчики, которые обнуляет /_proxy_stats/reset.
+// Текущие значения (выполняющиеся запросы, открытые соединения, размер кеша) не сбрасываются
+var statsCounters = []*int64{
+	&cacheHits, &cacheMisses, &cacheNotModified, &mutedRequests, &logSampledOut,
+	&contractChecked, &contractViolations, &contractUndocumented,
+	&hostHeadersApplied, &checksumsVerified, &checksumMismatches, &requestsSigned, &requestSigningFailed,
+	&clockSkewCount, &compressedResponses, &decompressedResponses, &recompressedBodies, &recompressSkipped,
+	&cachePeerPushed, &cachePeerPushFailed, &cachePeerDropped, &cachePeerReceived, &cachePeerServed,
+	&cachePrimaryHits, &cachePrimaryMisses, &cachePrimaryErrors,
+	&cacheConcurrentMisses, &cacheCoalesced, &cacheLockTimeouts, &cacheExpiryChanged,
+	&methodOverrideCount, &forwardMethodCount, &headerScrubCount, &headerRecasedCount, &headerDuplicatesMerged,
+	&rawPassthroughConnections, &rawPassthroughBytesUp, &rawPassthroughBytesDown, &rawPassthroughErrors,
+	&shapedConnections, &shapedStalls, &shapedLosses, &shapedDelayMs,
+	&keepAliveClientClosed, &keepAliveUpstreamFresh, &bufferPoolGets, &bufferPoolAllocated, &bufferPoolDropped,
+	&passthroughRequests, &pacServed, &bodyLengthFixed, &bodyEncodingFixed, &bodyChunkedFixed,
+	&dnsCacheHits, &dnsCacheMisses, &dnsStaleHits, &dnsOverrideHits, &dnsEvicted, &cookieJarsEvicted, &ipv4Connections, &ipv6Connections,
+	&streamExportPublished, &streamExportDropped, &streamExportFailed,
+	&archiveStored, &archiveDropped, &archiveFailed, &archiveBytes, &archiveIndexObjects,
+	&trafficStoreWritten, &trafficStoreDropped, &trafficStoreFailed, &pcapWritten, &pcapDropped, &pcapFailed,
+	&breakpointReleased, &breakpointRejected, &breakpointTimedOut,
+	&duplicateRequests, &unexpectedRequests, &healthEjections, &healthReroutes,
+	&maintenanceRejected, &maintenanceCached, &gateReleased, &gateTimedOut,
+}
+
+// handleStatsReset обнуляет счетчики между этапами тестов (POST /_proxy_stats/reset)
+func handleStatsReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Используйте POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	for _, counter := range statsCounters {
+		atomic.StoreInt64(counter, 0)
+	}
+	resetPipelineStats()
+
+	// Счетчики правил основной конфигурации и арендаторов
+	current := configSnapshot(&config)
+	rules := resetOverrideCounters(current.Overrides)
+	resetRouteCounters(current.Routes)
+	resetBudgets(current.Budgets)
+	resetOrdering(current.Ordering)
+	for _, tenant := range tenants {
+		atomic.StoreInt64(&tenant.requests, 0)
+		snapshot := configSnapshot(&tenant.config)
+		rules += resetOverrideCounters(snapshot.Overrides)
+		resetRouteCounters(snapshot.Routes)
+		resetBudgets(snapshot.Budgets)
+		resetOrdering(snapshot.Ordering)
+	}
+
+	for _, upstream := range upstreams {
+		atomic.StoreInt64(&upstream.requests, 0)
+	}
+	for _, mount := range mounts {
+		atomic.StoreInt64(&mount.requests, 0)
+	}
+	for _, profile := range clientProfiles {
+		atomic.StoreInt64(&profile.uses, 0)
+	}
+	outboundConnections.Range(func(key, value interface{}) bool {
+		atomic.StoreInt64(value.(*int64), 0)
+		return true
+	})
+
+	tagStatsMutex.Lock()
+	tagStats = make(map[string]*TagStats)
+	tagStatsMutex.Unlock()
+
+	endpointStatsMutex.Lock()
+	endpointStats = make(map[string]*EndpointStats)
+	endpointOverflow = 0
+	endpointStatsMutex.Unlock()
+
+	duplicateMutex.Lock()
+	recentDuplicates = nil
+	duplicateMutex.Unlock()
+
+	orderingMutex.Lock()
+	recentOrderingViolations = nil
+	orderingMutex.Unlock()
+
+	cacheFetchMutex.Lock()
+	cacheContention = make(map[string]int64)
+	cacheFetchMutex.Unlock()
+
+	journalMutex.Lock()
+	requestJournal = nil
+	journalMutex.Unlock()
+
+	unexpectedMutex.Lock()
+	recentUnexpected = nil
+	unexpectedMutex.Unlock()
+
+	checksumMismatchMutex.Lock()
+	recentChecksumMismatches = nil
+	checksumMismatchMutex.Unlock()
+
+	upstreamTimingMutex.Lock()
+	upstreamTimings = make(map[string]*upstreamTimingHost)
+	upstreamTimingMutex.Unlock()
+
+	connectionsMutex.Lock()
+	clientConnections.Accepted = 0
+	clientConnections.Hijacked = 0
+	for _, stats := range upstreamConnections {
+		*stats = UpstreamConnectionStats{Open: stats.Open, Idle: stats.Idle}
+	}
+	connectionsMutex.Unlock()
+
+	statsResetMutex.Lock()
+	statsResetAt = time.Now()
+	statsResetMutex.Unlock()
+
+	requestLogf(r, "📊 Счетчики статистики сброшены (правил: %d)", rules)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"reset": true, "rules": rules})
+}
+
+// resetOverrideCounters обнуляет счетчики правил; правила с max_triggers и trigger_after начинают отсчет заново
+func resetOverrideCounters(overrides []ResponseOverride) int {
+	for i := range overrides {
+		override := &overrides[i]
+		atomic.StoreInt64(&override.requestSeq, 0)
+		atomic.StoreInt64(&override.matchCount, 0)
+		override.triggers.Store(nil)
+		atomic.StoreInt64(&override.schemaViolations, 0)
+		override.mutex.Lock()
+		override.rateLimited = 0
+		override.backoffViolations = 0
+		override.backoffRespected = 0
+		override.mutex.Unlock()
+	}
+	return len(overrides)
+}
+
+// flattenStats обходит статистику и вызывает emit для каждого значения-листа.
+// Ключи-идентификаторы становятся частью имени, остальные (хосты, статусы, паттерны) - метками
+func flattenStats(prefix string, labels []string, value interface{}, emit func(name string, labels []string, value interface{})) {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(typed))
+		for key := range typed {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if statsIdentifier.MatchString(key) {
+				flattenStats(joinStatsName(prefix, key), labels, typed[key], emit)
+			} else {
+				flattenStats(prefix, appendStatsLabel(labels, "key", key), typed[key], emit)
+			}
+		}
+	case []interface{}:
+		// Одинаковые имена (правила с одним name) получают номер элемента, иначе серии совпали бы
+		seen := make(map[string]bool, len(typed))
+		for index, item := range typed {
+			label := strconv.Itoa(index)
+			if object, ok := item.(map[string]interface{}); ok {
+				for _, field := range []string{"name", "prefix", "url", "pattern"} {
+					if name, ok := object[field].(string); ok && name != "" {
+						label = name
+						break
+					}
+				}
+			}
+			if seen[label] {
+				label = fmt.Sprintf("%s#%d", label, index)
+			}
+			seen[label] = true
+			flattenStats(prefix, appendStatsLabel(labels, "item", label), item, emit)
+		}
+	default:
+		emit(prefix, labels, value)
+	}
+}
+
+var statsIdentifier = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+func joinStatsName(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "_" + key
+}
+
+// appendStatsLabel добавляет метку; повторяющееся имя получает суффикс уровня вложенности
+func appendStatsLabel(labels []string, name, value string) []string {
+	result := append([]string(nil), labels...)
+	for _, label := range labels {
+		if strings.HasPrefix(label, name+"=") {
+			name = fmt.Sprintf("%s%d", name, len(labels))
+			break
+		}
+	}
+	return append(result, name+"="+value)
+}
+
+// normalizeStats приводит статистику к JSON типам (числа - float64, структуры - map)
+func normalizeStats(stats map[string]interface{}) map[string]interface{} {
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return stats
+	}
+	var normalized map[string]interface{}
+	if err := json.Unmarshal(data, &normalized); err != nil {
+		return stats
+	}
+	return normalized
+}
+
+// writeStatsText выводит статистику строками "путь метки значение"
+func writeStatsText(w io.Writer, stats map[string]interface{}) {
+	flattenStats("", nil, normalizeStats(stats), func(name string, labels []string, value interface{}) {
+		if len(labels) > 0 {
+			name += "{" + strings.Join(labels, ",") + "}"
+		}
+		switch typed := value.(type) {
+		case nil:
+			fmt.Fprintf(w, "%s -\n", name)
+		case string:
+			fmt.Fprintf(w, "%s %s\n", name, typed)
+		default:
+			fmt.Fprintf(w, "%s %v\n", name, typed)
+		}
+	})
+}
+
+// writeStatsPrometheus выводит числовые и логические значения в формате Prometheus (gauge)
+func writeStatsPrometheus(w io.Writer, stats map[string]interface{}) {
+	// Серии одного семейства должны идти подряд после его # TYPE: собираем их по семействам
+	var families []string
+	samples := make(map[string][]string)
+	flattenStats("", nil, normalizeStats(stats), func(name string, labels []string, value interface{}) {
+		var number float64
+		switch typedValue := value.(type) {
+		case float64:
+			number = typedValue
+		case bool:
+			if typedValue {
+				number = 1
+			}
+		default:
+			return
+		}
+		name = "go_proxy_" + name
+		if _, ok := samples[name]; !ok {
+			families = append(families, name)
+		}
+		series := name
+		if len(labels) > 0 {
+			quoted := make([]string, 0, len(labels))
+			for _, label := range labels {
+				parts := strings.SplitN(label, "=", 2)
+				quoted = append(quoted, parts[0]+`="`+prometheusLabelReplacer.Replace(parts[1])+`"`)
+			}
+			series += "{" + strings.Join(quoted, ",") + "}"
+		}
+		samples[name] = append(samples[name], series+" "+strconv.FormatFloat(number, 'g', -1, 64))
+	})
+
+	for _, name := range families {
+		fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+		for _, sample := range samples[name] {
+			fmt.Fprintln(w, sample)
+		}
+	}
+}
+
+// prometheusLabelReplacer экранирует значение метки по формату Prometheus: только \, " и перевод строки
+var prometheusLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// handleProxyMode обрабатывает запросы в режиме HTTP прокси
+func handleProxyMode(w http.ResponseWriter, r *http.Request) {
+	// Пропускаем внутренние эндпоинты
+	if strings.HasPrefix(r.URL.Path, "/_proxy") {
+		return
+	}
+
+	// Обрабатываем CONNECT - отклоняем с объяснением
+	if r.Method == "CONNECT" {
+		http.Error(w, "CONNECT method not supported. Please use Custom Dialer without Proxy setting in Transport.", http.StatusMethodNotAllowed)
+		requestLogf(r, "❌ CONNECT запрос отклонён: %s", r.Host)
+		requestLogf(r, "💡 Используйте Custom Dialer с DialContext и DialTLSContext")
+		requestLogf(r, "💡 Не устанавливайте transport.Proxy в клиенте")
+		return
+	}
+
+	// Детальное логирование входящего запроса
+	requestLogf(r, "📨 Входящий запрос: %s %s", r.Method, r.URL.String())
+	requestLogf(r, "   Host: %s", r.Host)
+	requestLogf(r, "   URL.Scheme: %s", r.URL.Scheme)
+	requestLogf(r, "   URL.Host: %s", r.URL.Host)
+	requestLogf(r, "   URL.Path: %s", r.URL.Path)
+	requestLogf(r, "   URL.RawQuery: %s", r.URL.RawQuery)
+
+	// В режиме HTTP прокси URL должен быть полным
+	if r.URL.Scheme == "" || r.URL.Host == "" {
+		// Возможно URL в заголовке Host
+		if r.Host != "" && r.URL.Scheme == "" {
+			// Пытаемся восстановить scheme из RequestURI
+			if strings.HasPrefix(r.RequestURI, "https://") {
+				r.URL.Scheme = "https"
+			} else if strings.HasPrefix(r.RequestURI, "http://") {
+				r.URL.Scheme = "http"
+			} else {
+				r.URL.Scheme = "http" // по умолчанию
+			}
+			r.URL.Host = r.Host
+			requestLogf(r, "🔧 Восстановлен URL: %s://%s%s", r.URL.Scheme, r.URL.Host, r.URL.Path)
+		} else {
+			http.Error(w, "Bad Request: требуется полный URL (http://example.com/path)", http.StatusBadRequest)
+			requestLogf(r, "❌ Неверный запрос: отсутствует scheme или host")
+			requestLogf(r, "   RequestURI: %s", r.RequestURI)
+			requestLogf(r, "   URL: %s", r.URL.String())
+			requestLogf(r, "   Host header: %s", r.Host)
+			return
+		}
+	}
+
+	// Парсим целевой URL из запроса
+	targetURL, err := url.Parse(r.URL.Scheme + "://" + r.URL.Host)
+	if err != nil {
+		http.Error(w, "Bad Request: неверный URL", http.StatusBadRequest)
+		requestLogf(r, "❌ Ошибка парсинга URL: %v", err)
+		return
+	}
+
+	requestLogf(r, "🌐 Proxy Mode: %s %s", r.Method, r.URL.String())
+
+	// Используем стандартную функцию проксирования
+	proxyRequest(w, r, targetURL)
+}
+
+func proxyRequest(w http.ResponseWriter, r *http.Request, targetURL *url.URL) {
+	// Пропускаем внутренние эндпоинты
+	if strings.HasPrefix(r.URL.Path, "/_proxy") {
+		return
+	}
+
+	x := &ProxyExchange{W: w, R: r, TargetURL: targetURL}
+	defer func() {
+		for i := len(x.cleanup) - 1; i >= 0; i-- {
+			x.cleanup[i]()
+		}
+	}()
+	runPipeline(x)
+}
+
+// ProxyExchange состояние запроса, которое этапы конвейера передают друг другу
+type ProxyExchange struct {
+	W         http.ResponseWriter
+	R         *http.Request // Этапы могут заменить запрос (например, r.WithContext)
+	TargetURL *url.URL
+	ProxyURL  *url.URL     // URL запроса к серверу
+	FullURL   string       // Путь с query для правил и паттернов
+	Route     *RouteConfig // Логирование, кеш и upstream прокси маршрута (секция routes)
+	Override  *ResponseOverride
+	Triggered *ResponseOverride // Сработавшее правило, которое применяется к ответу сервера
+	cleanup   []func()
+}
+
+// Defer выполняет fn после завершения всех этапов (в обратном порядке)
+func (x *ProxyExchange) Defer(fn func()) {
+	x.cleanup = append(x.cleanup, fn)
+}
+
+// PipelineStage этап обработки запроса. Run возвращает false, если ответ клиенту уже отправлен
+// и следующие этапы выполнять не нужно
+type PipelineStage struct {
+	Name        string
+	Description string
+	Run         func(x *ProxyExchange) bool
+	calls       int64 // атомарный
+	stopped     int64 // Сколько раз этап завершил обработку (атомарный)
+	nanos       int64 // Суммарное время этапа (атомарный)
+}
+
+// proxyPipeline этапы proxyRequest по порядку. Отдельных этапов аутентификации, обработки ответа
+// и логирования нет: прокси не проверяет клиентов, а замены, скрипты и логирование ответа выполняются
+// внутри upstream, потому что в стриминговом режиме ответ передается клиенту по мере чтения.
+// Этапы, зарегистрированные после upstream, выполняются, когда ответ уже отправлен
+var proxyPipeline = []*PipelineStage{
+	{Name: "prepare", Description: "URL сервера, X-HTTP-Method-Override", Run: stagePrepare},
+	{Name: "maintenance", Description: "режим обслуживания: заданный ответ или ответ из кеша", Run: stageMaintenance},
+	{Name: "intercept", Description: "точки останова", Run: stageIntercept},
+	{Name: "gate", Description: "ворота для одновременной отправки запросов", Run: stageGate},
+	{Name: "tag", Description: "теги подходящих правил", Run: stageTag},
+	{Name: "rate-limit", Description: "повторные запросы, нарушение Retry-After", Run: stageRateLimit},
+	{Name: "match", Description: "проверка тела по схеме, поиск правила, журнал, UNMATCHED_POLICY, настройки логирования", Run: stageMatch},
+	{Name: "respond", Description: "симуляция 429, полная подмена", Run: stageRespond},
+	{Name: "transform", Description: "изменение query и метода запроса к серверу", Run: stageTransform},
+	{Name: "route", Description: "таймаут и исходящий адрес", Run: stageRoute},
+	{Name: "cache", Description: "ответ из кеша", Run: stageCache},
+	{Name: "upstream", Description: "запрос к серверу, замены и скрипты ответа, логирование", Run: stageUpstream},
+}
+
+// RegisterPipelineStage добавляет этап после этапа after (пусто - перед upstream).
+// Вызывается из init() дополнительных файлов пакета
+func RegisterPipelineStage(name, after string, run func(x *ProxyExchange) bool) {
+	stage := &PipelineStage{Name: name, Description: "зарегистрирован дополнительно", Run: run}
+	position := len(proxyPipeline) - 1
+	for i, existing := range proxyPipeline {
+		if existing.Name == after {
+			position = i + 1
+		}
+	}
+	proxyPipeline = append(proxyPipeline, nil)
+	copy(proxyPipeline[position+1:], proxyPipeline[position:])
+	proxyPipeline[position] = stage
+}
+
+func runPipeline(x *ProxyExchange) {
+	for _, stage := range proxyPipeline {
+		started := time.Now()
+		proceed := stage.Run(x)
+		atomic.AddInt64(&stage.nanos, int64(time.Since(started)))
+		atomic.AddInt64(&stage.calls, 1)
+		if !proceed {
+			atomic.AddInt64(&stage.stopped, 1)
+			return
+		}
+	}
+}
+
+func pipelineStats() []map[string]interface{} {
+	stats := make([]map[string]interface{}, 0, len(proxyPipeline))
+	for _, stage := range proxyPipeline {
+		calls := atomic.LoadInt64(&stage.calls)
+		averageMs := 0.0
+		if calls > 0 {
+			averageMs = float64(atomic.LoadInt64(&stage.nanos)) / float64(calls) / 1e6
+		}
+		stats = append(stats, map[string]interface{}{
+			"name":        stage.Name,
+			"description": stage.Description,
+			"calls":       calls,
+			"stopped":     atomic.LoadInt64(&stage.stopped),
+			"avg_ms":      math.Round(averageMs*1000) / 1000,
+		})
+	}
+	return stats
+}
+
+func resetPipelineStats() {
+	for _, stage := range proxyPipeline {
+		atomic.StoreInt64(&stage.calls, 0)
+		atomic.StoreInt64(&stage.stopped, 0)
+		atomic.StoreInt64(&stage.nanos, 0)
+	}
+}
+
+// serverURL URL запроса к серверу: путь сервера и путь запроса (без префикса монтирования)
+func serverURL(r *http.Request, targetURL *url.URL) *url.URL {
+	combinedPath := path.Join(targetURL.Path, mountedPath(r))
+
+	// path.Join убирает trailing slash, восстанавливаем если нужно
+	if strings.HasSuffix(r.URL.Path, "/") && !strings.HasSuffix(combinedPath, "/") {
+		combinedPath += "/"
+	}
+
+	return &url.URL{
+		Scheme:   targetURL.Scheme,
+		Host:     targetURL.Host,
+		Path:     combinedPath,
+		RawQuery: r.URL.RawQuery,
+	}
+}
+
+func stagePrepare(x *ProxyExchange) bool {
+	x.R = pinConfigSnapshot(x.R)
+	x.ProxyURL = serverURL(x.R, x.TargetURL)
+
+	// Клиенты, которым доступны только GET и POST, передают нужный метод заголовком
+	x.R = applyMethodOverride(x.R)
+
+	// Полный URL с query параметрами для поиска правил и маршрутов
+	x.FullURL = x.R.URL.Path
+	if x.R.URL.RawQuery != "" {
+		x.FullURL += "?" + x.R.URL.RawQuery
+	}
+	applyRoute(x)
+
+	proxyInfo := x.ProxyURL.String()
+	if x.Route.Proxy.Enabled {
+		proxyInfo += " (via " + x.Route.Proxy.URL + ")"
+	}
+	requestLogf(x.R, "🔄 %s %s -> %s", x.R.Method, x.R.URL.String(), proxyInfo)
+	return true
+}
+
+// applyRoute находит настройки маршрута для FullURL; они действуют до конца запроса
+func applyRoute(x *ProxyExchange) {
+	x.Route = resolveRouteConfig(x.R, x.FullURL)
+	x.R = x.R.WithContext(context.WithValue(x.R.Context(), routeConfigKey{}, x.Route))
+}
+
+// stageIntercept: запрос ждет решения через /_proxy/breakpoints и может быть изменен
+func stageIntercept(x *ProxyExchange) bool {
+	if !breakpointMatches(x.R.Method, x.FullURL) {
+		return true
+	}
+	if !holdRequest(x.W, x.R, x.FullURL) {
+		return false
+	}
+	x.ProxyURL = serverURL(x.R, x.TargetURL)
+	x.FullURL = x.R.URL.Path
+	if x.R.URL.RawQuery != "" {
+		x.FullURL += "?" + x.R.URL.RawQuery
+	}
+	applyRoute(x)
+	return true
+}
+
+// stageTag помечает запрос тегами всех подходящих правил (независимо от срабатывания)
+func stageTag(x *ProxyExchange) bool {
+	if tags := collectRequestTags(x.R.Method, x.FullURL, x.R.Header.Get("Content-Type"), x.R); len(tags) > 0 {
+		setRequestTags(x.R, tags)
+		x.W.Header().Set("X-Proxy-Tags", strings.Join(tags, ","))
+		requestLogf(x.R, "🏷️  Теги: %s", strings.Join(tags, ", "))
+	}
+	return true
+}
+
+func stageRateLimit(x *ProxyExchange) bool {
+	// Одинаковый запрос в пределах окна - вероятная повторная отправка клиентом
+	checkDuplicateRequest(x.W, x.R, x.FullURL)
+
+	// Клиент, повторивший запрос до окончания Retry-After, снова получает 429
+	if checkBackoffViolation(x.W, x.R, x.FullURL) {
+		recordJournal(x.R, x.FullURL, nil)
+		return false
+	}
+	return true
+}
+
+func stageMatch(x *ProxyExchange) bool {
+	// Тело запроса проверяется по JSON Schema, как только выполнены условия правила - до trigger_after и лимитов
+	if schemaRule := findSchemaOverride(x.R.Method, x.FullURL, x.R.Header.Get("Content-Type"), x.R); schemaRule != nil && !validateRequestBody(x.W, x.R, schemaRule) {
+		recordJournal(x.R, x.FullURL, schemaRule)
+		return false
+	}
+
+	x.Override = findMatchingOverride(x.R.Method, x.FullURL, x.R.Header.Get("Content-Type"), x.R)
+	if x.Override != nil {
+		x.Defer(func() { releaseOverride(x.Override) })
+	}
+
+	// Запрос попадает в журнал для проверок через /_proxy/verify
+	recordJournal(x.R, x.FullURL, x.Override)
+
+	// В строгом режиме запрос, для которого нет ни правила, ни разрешения на проксирование, отклоняется
+	if x.Override == nil && rejectUnexpected(x.W, x.R, x.FullURL) {
+		return false
+	}
+
+	// Настройки логирования маршрута, арендатора и сработавшего правила действуют до конца запроса
+	settings := resolveLogSettings(x.Route, tenantFromRequest(x.R), x.FullURL, x.Override)
+	if requestLogSettings(x.R).Muted && !settings.Muted {
+		muted := *settings
+		muteLogSettings(&muted)
+		settings = &muted
+	}
+	x.R = x.R.WithContext(context.WithValue(x.R.Context(), logSettingsContextKey{}, settings))
+
+	// Логируем заголовки входящего запроса
+	if settings.ShowRequestHeaders {
+		logHeaders("📤 Request Headers", x.R.Header)
+	}
+	return true
+}
+
+func stageRespond(x *ProxyExchange) bool {
+	override := x.Override
+	if override == nil {
+		return true
+	}
+
+	// Симуляция ограничения частоты: ответ 429 и пауза для клиента
+	if override.RateLimit != nil {
+		handleRateLimit(x.W, x.R, override)
+		return false
+	}
+
+	// Если есть body_file или body_text - это полная подмена, не идём на сервер
+	if override.BodyFile != "" || override.BodyText != "" {
+		requestLogf(x.R, "🎭 Применяем полную подмену: %s", override.Name)
+		handleOverride(x.W, x.R, override)
+		return false
+	}
+	return true
+}
+
+// stageTransform: правило без полной подмены применяется к запросу и к ответу сервера
+func stageTransform(x *ProxyExchange) bool {
+	override := x.Override
+	if override == nil {
+		return true
+	}
+
+	// Если есть только body_replacements - продолжаем с проксированием
+	// (замены будут применены в bufferedProxyRequest)
+	if len(override.BodyReplacements) > 0 {
+		requestLogf(x.R, "🔄 Правило '%s' будет применять замены к проксированному ответу", override.Name)
+	}
+	if override.Fault != nil {
+		requestLogf(x.R, "💥 Правило '%s' будет повреждать проксированный ответ", override.Name)
+	}
+	if override.HTMLInject != "" {
+		requestLogf(x.R, "💉 Правило '%s' будет внедрять HTML в проксированный ответ", override.Name)
+	}
+	if override.Script != "" {
+		requestLogf(x.R, "📜 Правило '%s' будет обрабатывать проксированный ответ скриптом", override.Name)
+	}
+	if override.TransformURL != "" {
+		requestLogf(x.R, "🪝 Правило '%s' будет обрабатывать проксированный ответ через %s", override.Name, override.TransformURL)
+	}
+	if len(override.QueryRewrites) > 0 {
+		x.ProxyURL.RawQuery = rewriteQuery(x.ProxyURL.RawQuery, override.QueryRewrites)
+		requestLogf(x.R, "🔧 Правило '%s' изменило query: %s", override.Name, x.ProxyURL.RawQuery)
+	}
+	if override.ForwardMethod != "" {
+		requestLogf(x.R, "🔀 Правило '%s' отправит запрос серверу методом %s", override.Name, strings.ToUpper(override.ForwardMethod))
+		x.R = x.R.WithContext(context.WithValue(x.R.Context(), forwardMethodKey{}, override))
+	}
+	x.Triggered = override
+	return true
+}
+
+func stageRoute(x *ProxyExchange) bool {
+	// Таймаут запроса к серверу с учетом маршрута и правила
+	if timeout := resolveRequestTimeout(x.FullURL, x.Triggered); timeout > 0 {
+		requestLogf(x.R, "⏱️  Таймаут запроса к серверу: %v", timeout)
+		ctx, cancel := context.WithTimeout(x.R.Context(), timeout)
+		x.Defer(cancel)
+		x.R = x.R.WithContext(ctx)
+	}
+
+	// Исходящий адрес или интерфейс для подключения к серверу
+	if source := resolveOutboundSource(x.FullURL); source != "" {
+		requestLogf(x.R, "🛣️  Исходящий адрес: %s", source)
+		x.R = x.R.WithContext(context.WithValue(x.R.Context(), outboundSourceKey{}, source))
+	}
+	return true
+}
+
+// stageCache отвечает из кеша, если он включен (исключенные URL идут мимо кеша)
+func stageCache(x *ProxyExchange) bool {
+	cache := x.Route.Cache
+	if !cache.Enabled || cache.isExcluded(x.ProxyURL.String()) {
+		return true
+	}
+	cacheKey := namespacedCacheKey(cacheNamespace(x.R, x.ProxyURL.String()), generateCacheKey(x.R.Method, x.ProxyURL.String(), x.R.Header, cache.KeyHeaders))
+	cached := getCachedResponse(cacheKey)
+	if cached == nil {
+		// Промах: запись может быть у основного экземпляра (CACHE_PRIMARY)
+		cached = fetchFromPrimary(cacheKey)
+	}
+	if cached == nil {
+		atomic.AddInt64(&cacheMisses, 1)
+		if !cache.shouldCache(x.ProxyURL.String()) {
+			return true
+		}
+		return coalesceCacheMiss(x, cacheKey)
+	}
+	atomic.AddInt64(&cacheHits, 1)
+	requestLogf(x.R, "💾 Ответ из кеша (срок действия до %s)", cached.ExpiresAt.Format("15:04:05"))
+	serveCacheHit(x, cached)
+	return false
+}
+
+// serveCacheHit отдает запись кеша: 304, если версия клиента актуальна, иначе ответ целиком
+func serveCacheHit(x *ProxyExchange, cached *CacheEntry) {
+	if cached.StatusCode == http.StatusOK && notModified(x.R, cached.Headers) {
+		requestLogf(x.R, "💾 304 Not Modified из кеша: версия клиента актуальна")
+		writeNotModified(x.W, cached.Headers, cached)
+		return
+	}
+	var fault *ResponseFault
+	if x.Triggered != nil {
+		fault = x.Triggered.Fault
+	}
+	serveCachedResponse(x.W, x.R, cached, fault)
+}
+
+// stageUpstream выбирает режим проксирования и выполняет запрос к серверу
+func stageUpstream(x *ProxyExchange) bool {
+	needsBuffering := x.Triggered != nil && (x.Triggered.Fault != nil || x.Triggered.HTMLInject != "" || hasTransforms(x.Triggered))
+
+	streaming := x.Route.Log.EnableStreaming
+	cacheEnabled := x.Route.Cache.Enabled
+
+	// Приоритет: кеширование > стриминг (кеш требует буферизации)
+	if cacheEnabled && streaming {
+		requestLogf(x.R, "⚠️  Кеширование имеет приоритет над стримингом (используется буферизованный режим)")
+	}
+
+	if streaming && needsBuffering {
+		requestLogf(x.R, "⚠️  Fault injection, внедрение HTML и скрипты требуют буферизации (используется буферизованный режим)")
+	}
+
+	if streaming && !cacheEnabled && !needsBuffering {
+		requestLogf(x.R, "🚀 Стриминговый режим включен")
+		streamingProxyRequest(x.W, x.R, x.ProxyURL, x.TargetURL)
+	} else if !streaming && canPassThrough(x) {
+		atomic.AddInt64(&passthroughRequests, 1)
+		requestLogf(x.R, "🚀 Буферизация не нужна: ответ передается потоком")
+		streamingProxyRequest(x.W, x.R, x.ProxyURL, x.TargetURL)
+	} else {
+		bufferedProxyRequest(x.W, x.R, x.ProxyURL, x.TargetURL, x.Triggered)
+	}
+	return true
+}
+
+var autoPassthrough bool      // Потоковая передача запросов без правил, кеша и логирования тел (AUTO_PASSTHROUGH)
+var passthroughRequests int64 // атомарный
+
+// canPassThrough проверяет, что тела запроса и ответа никому не нужны целиком: нет сработавшего правила
+// и правил с заменами, ответ не кешируется, тела не логируются и не проверяются по контракту.
+// Такие запросы (загрузки файлов, бинарные ответы) передаются потоком без чтения в память
+func canPassThrough(x *ProxyExchange) bool {
+	if !autoPassthrough || x.Triggered != nil || openAPISettings.Enabled {
+		return false
+	}
+	if cache := x.Route.Cache; cache.Enabled && cache.shouldCache(x.ProxyURL.String()) {
+		return false
+	}
+	settings := requestLogSettings(x.R)
+	logsBodies := (settings.ShowRequestBody || settings.ShowResponseBody) && settings.BodyLogMode != "none"
+	if logsBodies && !isLogMuted(x.FullURL) {
+		return false
+	}
+	// Замены не все применимы к потоку, а Content-Type ответа еще неизвестен - подходит любое правило с заменами
+	overrides := currentOverrides(x.R)
+	for i := range overrides {
+		override := &overrides[i]
+		if override.Enabled && len(override.BodyReplacements) > 0 && overrideMismatch(override, x.R.Method, x.FullURL, x.R.Header.Get("Content-Type"), x.R) == "" {
+			return false
+		}
+	}
+	return true
+}
+
+func passthroughStats() map[string]interface{} {
+	return map[string]interface{}{
+		"enabled":  autoPassthrough,
+		"requests": atomic.LoadInt64(&passthroughRequests),
+	}
+}
+
+// bufferedProxyRequest - исходный режим с буферизацией для логирования
+// triggered - сработавшее правило без полной подмены (для fault injection и скриптов), может быть nil
+func bufferedProxyRequest(w http.ResponseWriter, r *http.Request, proxyURL *url.URL, targetURL *url.URL, triggered *ResponseOverride) {
+	// Ответ из кеша отправляет этап cache
+
+	// Читаем тело запроса ПОЛНОСТЬЮ
+	var requestBody []byte
+	var bodyReader io.Reader
+
+	// При Expect: 100-continue тело читается только после того, как сервер его примет,
+	// и сохраняется для логирования по мере отправки
+	var deferredBody *capturingReader
+
+	if expectsContinue(r) {
+		deferredBody = &capturingReader{reader: r.Body}
+		bodyReader = deferredBody
+	} else if r.Body != nil {
+		var err error
+		requestBody, err = readBody(r.Body, r.ContentLength)
+		if err != nil {
+			http.Error(w, "Ошибка чтения тела запроса", http.StatusBadRequest)
+			requestLogf(r, "❌ Ошибка чтения тела запроса: %v", err)
+			return
+		}
+		r.Body.Close()
+
+		// Логируем тело входящего запроса
+		logRequestBody(r, requestBody)
+
+		// Создаем новый Reader для прокси запроса
+		bodyReader = bytes.NewReader(requestBody)
+	}
+
+	// Создаем новый HTTP запрос
+	proxyReq, err := http.NewRequestWithContext(r.Context(), r.Method, proxyURL.String(), bodyReader)
+	if err != nil {
+		http.Error(w, "Ошибка создания запроса", http.StatusInternalServerError)
+		requestLogf(r, "❌ Ошибка создания запроса: %v", err)
+		return
+	}
+
+	// Копируем заголовки из оригинального запроса
+	copyHeaders(proxyReq.Header, r.Header)
+
+	// В кеш должен попасть полный ответ: условные заголовки клиента прокси проверяет сам
+	cache := requestRouteConfig(r).Cache
+	cacheable := cache.Enabled && cache.shouldCache(proxyURL.String())
+	if cacheable && isConditionalRequest(r) {
+		for _, name := range conditionalHeaders {
+			proxyReq.Header.Del(name)
+		}
+		requestLogf(r, "💾 Условный запрос отправлен серверу без If-None-Match/If-Modified-Since для кеширования")
+	}
+
+	// Устанавливаем правильный Host заголовок
+	proxyReq.Host = targetURL.Host
+
+	// Добавляем cookies из серверного cookie jar клиента
+	addJarCookies(r, proxyReq)
+
+	// Удаляем заголовки, раскрывающие клиента
+	applyHeaderScrub(r, proxyReq)
+
+	// Подменяем User-Agent и client hints по профилю клиента
+	applyClientProfile(r, proxyReq)
+
+	// Меняем метод запроса к серверу по правилу
+	applyForwardMethod(r, proxyReq)
+
+	// Добавляем и удаляем заголовки по политике хоста сервера
+	applyHostHeaders(r, proxyReq)
+
+	// Подписываем запрос к серверу (после всех изменений метода, пути и заголовков)
+	applyRequestSigning(r, proxyReq)
+
+	// Регистр имен и повторяющиеся заголовки для чувствительных к ним серверов
+	applyHeaderCasing(r, proxyReq)
+
+	// Новое соединение с сервером для маршрутов без keep-alive
+	applyUpstreamKeepAlive(r, proxyReq)
+
+	// ВАЖНО: Убираем Transfer-Encoding и устанавливаем Content-Length
+	if deferredBody != nil {
+		// Длина известна только из заголовка клиента (-1 = chunked)
+		proxyReq.ContentLength = r.ContentLength
+		requestLogf(r, "⏳ Expect: 100-continue - тело будет передано после подтверждения сервера")
+	} else if len(requestBody) > 0 {
+		// Принудительно устанавливаем Content-Length
+		proxyReq.ContentLength = int64(len(requestBody))
+		proxyReq.Header.Set("Content-Length", strconv.Itoa(len(requestBody)))
+
+		// Убираем заголовки, связанные с chunked encoding
+		proxyReq.Header.Del("Transfer-Encoding")
+
+		requestLogf(r, "📏 Content-Length установлен: %d bytes", len(requestBody))
+	} else {
+		// Для запросов без тела также убираем Transfer-Encoding
+		proxyReq.Header.Del("Transfer-Encoding")
+		proxyReq.ContentLength = 0
+	}
+
+	// Выполняем запрос через настроенный клиент (с прокси если настроен)
+	proxyReq, timing := traceUpstreamTiming(proxyReq)
+	resp, err := clientForRequest(proxyReq).Do(traceConnections(traceTLSHandshake(proxyReq)))
+	if err != nil {
+		timing.finish(r, err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			http.Error(w, "Превышен таймаут запроса к серверу", http.StatusGatewayTimeout)
+			requestLogf(r, "⏱️  Превышен таймаут запроса к серверу: %v", err)
+			return
+		}
+		http.Error(w, "Ошибка выполнения запроса", http.StatusBadGateway)
+		requestLogf(r, "❌ Ошибка выполнения запроса: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	// Логируем параметры TLS соединения
+	recordTLSInfo(proxyURL.Host, resp.TLS)
+
+	// Читаем тело ответа для логирования
+	responseBody, err := readBody(resp.Body, resp.ContentLength)
+	timing.finish(r, err)
+	if err != nil {
+		http.Error(w, "Ошибка чтения ответа", http.StatusInternalServerError)
+		requestLogf(r, "❌ Ошибка чтения тела ответа: %v", err)
+		return
+	}
+
+	// Тело запроса с Expect: 100-continue логируется после обмена с сервером
+	if deferredBody != nil {
+		requestBody = deferredBody.Bytes()
+		if len(requestBody) == 0 {
+			requestLogf(r, "⏳ Сервер ответил без 100 Continue, тело запроса не передано")
+		}
+		logRequestBody(r, requestBody)
+	}
+
+	// Логируем статус ответа
+	requestLogf(r, "📥 Response Status: %d %s", resp.StatusCode, resp.Status)
+
+	// Логируем заголовки ответа
+	settings := requestLogSettings(r)
+	if settings.ShowResponseHeaders {
+		logHeaders("📥 Response Headers", resp.Header)
+	}
+
+	// Логируем тело ответа
+	if len(responseBody) > 0 && settings.ShowResponseBody {
+		if !logProtobufBody(settings, "📥 Response Body", responseBody, resp.Header.Get("Content-Type"), resp.Header, r.URL.Path, true) {
+			logBody(settings, "📥 Response Body", responseBody, resp.Header.Get("Content-Type"), resp.Header)
+		}
+	}
+
+	// Проверяем ответ сервера по OpenAPI спецификации
+	validateResponseContract(r, resp.StatusCode, resp.Header, responseBody, true)
+
+	// Сверяем тело с Content-MD5/Digest и ожидаемыми хешами
+	if verifier := newChecksumVerifier(r, resp); verifier != nil {
+		verifier.Write(responseBody)
+		verifier.verify(responseBody)
+	}
+
+	// Сохраняем cookies в jar и переписываем атрибуты Set-Cookie
+	processResponseCookies(r, proxyURL, resp.Header)
+
+	// Применяем замены из правил override если они есть (для всех запросов)
+	fullURL := r.URL.Path
+	if r.URL.RawQuery != "" {
+		fullURL += "?" + r.URL.RawQuery
+	}
+	// SSE ответ обрабатывается по событиям, как в стриминговом режиме: фильтрация, замены в data, вставка событий
+	isSSE := isSSEContent(resp.Header.Get("Content-Type"))
+	if isSSE && len(responseBody) > 0 {
+		if override := findMatchingOverrideForSSE(r.Method, fullURL, r.Header.Get("Content-Type"), resp.Header.Get("Content-Type"), r); override != nil {
+			if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+				requestLogf(r, "⚠️  SSE ответ сжат (%s), правило '%s' к событиям не применяется", encoding, override.Name)
+			} else {
+				var events bytes.Buffer
+				streamSSEEvents(&events, bytes.NewReader(responseBody), discardFlusher{}, override)
+				requestLogf(r, "🌊 Правило '%s' применено к событиям SSE: %d -> %d bytes", override.Name, len(responseBody), events.Len())
+				responseBody = events.Bytes()
+			}
+		}
+	}
+	if matchedOverride := findMatchingOverrideForReplacements(r.Method, fullURL, r.Header.Get("Content-Type"), resp.Header.Get("Content-Type"), r); matchedOverride != nil && !isSSE {
+		if len(matchedOverride.BodyReplacements) > 0 && len(responseBody) > 0 {
+			requestLogf(r, "🔄 Применяем замены из правила '%s' к проксированному ответу...", matchedOverride.Name)
 
 			// Проверяем и распаковываем если данные сжаты
 			wasCompressed := false
 			contentEncoding := resp.Header.Get("Content-Encoding")
 			var decompressedBody []byte
 
-			if strings.ToLower(contentEncoding) == "gzip" {
-				if decompressed, err := decompressGzip(responseBody); err == nil {
-					log.Printf("🔓 Распакован gzip для замен: %d -> %d bytes", len(responseBody), len(decompressed))
-					decompressedBody = decompressed
-					wasCompressed = true
-				} else {
-					log.Printf("⚠️  Ошибка распаковки gzip: %v", err)
-					decompressedBody = responseBody
-				}
-			} else {
-				decompressedBody = responseBody
-			}
+			if strings.ToLower(contentEncoding) == "gzip" {
+				if decompressed, err := decompressGzip(responseBody); err == nil {
+					requestLogf(r, "🔓 Распакован gzip для замен: %d -> %d bytes", len(responseBody), len(decompressed))
+					decompressedBody = decompressed
+					wasCompressed = true
+				} else {
+					requestLogf(r, "⚠️  Ошибка распаковки gzip: %v", err)
+					decompressedBody = responseBody
+				}
+			} else {
+				decompressedBody = responseBody
+			}
+
+			// Применяем замены к распакованным данным
+			// Для protobuf замены применяются к JSON представлению
+			modifiedBody, ok := applyProtobufReplacements(decompressedBody, resp.Header.Get("Content-Type"), r.URL.Path, matchedOverride.BodyReplacements)
+			// Для MessagePack и CBOR - тоже к JSON представлению
+			if !ok {
+				modifiedBody, ok = applyBinaryJSONReplacements(decompressedBody, resp.Header.Get("Content-Type"), matchedOverride.BodyReplacements)
+			}
+			if !ok {
+				modifiedBody = applyBodyReplacements(decompressedBody, matchedOverride.BodyReplacements)
+			}
+
+			// Сжимаем измененное тело: кодирование правила или исходное (gzip, если было сжатие).
+			// Тело в кодировании, которое прокси не распаковывает, передается как есть
+			switch {
+			case wasCompressed:
+				responseBody = recompressBody(matchedOverride, resp.Header, modifiedBody, "gzip")
+			case contentEncoding == "" || strings.EqualFold(contentEncoding, "identity"):
+				responseBody = recompressBody(matchedOverride, resp.Header, modifiedBody, "")
+			default:
+				responseBody = modifiedBody
+			}
+		}
+	}
+
+	// Сохраняем в кеш если включен и URL соответствует паттернам.
+	// 304 и 206 - не полные ответы: отданные другому клиенту, они сломали бы его запрос
+	if cacheable && (resp.StatusCode == http.StatusNotModified || resp.StatusCode == http.StatusPartialContent) {
+		requestLogf(r, "⏭️  Ответ %d не кешируется", resp.StatusCode)
+	} else if cacheable {
+		namespace := cacheNamespace(r, proxyURL.String())
+		cacheKey := namespacedCacheKey(namespace, generateCacheKey(r.Method, proxyURL.String(), r.Header, cache.KeyHeaders))
+		cacheResponse(cacheKey, namespace, resp.StatusCode, resp.Header, responseBody, proxyURL.String(), cache.TTL)
+	} else if cache.Enabled && cache.isExcluded(proxyURL.String()) {
+		requestLogf(r, "⏭️  URL исключен из кеширования (CACHE_EXCLUDE_PATTERNS): %s", proxyURL.String())
+	} else if cache.Enabled && !cache.shouldCache(proxyURL.String()) {
+		requestLogf(r, "⏭️  URL не соответствует паттернам кеширования: %s", proxyURL.String())
+	}
+
+	// Версия клиента совпадает с полученной от сервера - отвечаем 304 вместо тела
+	if cacheable && triggered == nil && resp.StatusCode == http.StatusOK && notModified(r, resp.Header) {
+		requestLogf(r, "💾 304 Not Modified: версия клиента актуальна")
+		writeNotModified(w, resp.Header, nil)
+		return
+	}
+
+	// Копируем заголовки ответа
+	copyHeaders(w.Header(), resp.Header)
+
+	statusCode := resp.StatusCode
+	var fault *ResponseFault
+	if triggered != nil {
+		fault = triggered.Fault
+		// Внедряем HTML фрагмент в text/html ответ
+		if triggered.HTMLInject != "" {
+			responseBody = injectHTMLResponse(triggered, w.Header(), responseBody)
+		}
+		// Скрипт и внешний обработчик правила могут изменить статус, заголовки и тело
+		if hasTransforms(triggered) {
+			statusCode, responseBody = applyTransforms(triggered, r, requestBody, statusCode, w.Header(), responseBody)
+		}
+	}
+
+	// Устанавливаем статус код и отправляем тело ответа клиенту
+	err = writeResponse(w, r, statusCode, responseBody, fault)
+	if err != nil {
+		requestLogf(r, "❌ Ошибка отправки ответа клиенту: %v", err)
+	}
+
+	requestLogf(r, "✅ Запрос завершен\n")
+}
+
+// streamingProxyRequest - новый стриминговый режим без буферизации
+func streamingProxyRequest(w http.ResponseWriter, r *http.Request, proxyURL *url.URL, targetURL *url.URL) {
+	// Создаем новый HTTP запрос напрямую с Body из исходного запроса
+	proxyReq, err := http.NewRequestWithContext(r.Context(), r.Method, proxyURL.String(), r.Body)
+	if err != nil {
+		http.Error(w, "Ошибка создания запроса", http.StatusInternalServerError)
+		requestLogf(r, "❌ Ошибка создания запроса: %v", err)
+		return
+	}
+
+	// Копируем заголовки из оригинального запроса
+	copyHeaders(proxyReq.Header, r.Header)
+
+	// Устанавливаем правильный Host заголовок
+	proxyReq.Host = targetURL.Host
+
+	// Добавляем cookies из серверного cookie jar клиента
+	addJarCookies(r, proxyReq)
+
+	// Удаляем заголовки, раскрывающие клиента
+	applyHeaderScrub(r, proxyReq)
+
+	// Подменяем User-Agent и client hints по профилю клиента
+	applyClientProfile(r, proxyReq)
+
+	// Меняем метод запроса к серверу по правилу
+	applyForwardMethod(r, proxyReq)
+
+	// Добавляем и удаляем заголовки по политике хоста сервера
+	applyHostHeaders(r, proxyReq)
+
+	// Подписываем запрос к серверу (после всех изменений метода, пути и заголовков)
+	applyRequestSigning(r, proxyReq)
+
+	// Регистр имен и повторяющиеся заголовки для чувствительных к ним серверов
+	applyHeaderCasing(r, proxyReq)
+
+	// Новое соединение с сервером для маршрутов без keep-alive
+	applyUpstreamKeepAlive(r, proxyReq)
+
+	// В стриминговом режиме сохраняем исходный ContentLength
+	// Для SSE и chunked encoding это может быть -1
+	proxyReq.ContentLength = r.ContentLength
+
+	if r.ContentLength >= 0 {
+		requestLogf(r, "🚀 Стриминг: Content-Length=%d", r.ContentLength)
+	} else {
+		requestLogf(r, "🚀 Стриминг: chunked encoding или unknown length")
+	}
+
+	// Выполняем запрос через настроенный клиент; передача тела завершается вместе с функцией
+	proxyReq, timing := traceUpstreamTiming(proxyReq)
+	resp, err := clientForRequest(proxyReq).Do(traceConnections(traceTLSHandshake(proxyReq)))
+	if err != nil {
+		timing.finish(r, err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			http.Error(w, "Превышен таймаут запроса к серверу", http.StatusGatewayTimeout)
+			requestLogf(r, "⏱️  Превышен таймаут запроса к серверу: %v", err)
+			return
+		}
+		http.Error(w, "Ошибка выполнения запроса", http.StatusBadGateway)
+		requestLogf(r, "❌ Ошибка выполнения запроса: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	defer timing.finish(r, nil)
+
+	// Логируем параметры TLS соединения
+	recordTLSInfo(proxyURL.Host, resp.TLS)
+
+	// Логируем статус ответа
+	requestLogf(r, "📥 Response Status: %d %s", resp.StatusCode, resp.Status)
+
+	// Логируем заголовки ответа
+	if requestLogSettings(r).ShowResponseHeaders {
+		logHeaders("📥 Response Headers", resp.Header)
+	}
+
+	// В стриминговом режиме тело не буферизуется - проверяем только статус и Content-Type
+	validateResponseContract(r, resp.StatusCode, resp.Header, nil, false)
+
+	// Сохраняем cookies в jar и переписываем атрибуты Set-Cookie
+	processResponseCookies(r, proxyURL, resp.Header)
+
+	// Копируем заголовки ответа ПЕРЕД WriteHeader
+	copyHeaders(w.Header(), resp.Header)
+
+	// Проверяем, является ли это SSE потоком
+	contentType := resp.Header.Get("Content-Type")
+	isSSE := isSSEContent(contentType)
+
+	if isSSE {
+		requestLogf(r, "🌊 Обнаружен SSE поток (text/event-stream)")
+		// Для SSE принудительно устанавливаем важные заголовки
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		// Убираем Content-Length для SSE потоков
+		w.Header().Del("Content-Length")
+	}
+
+	fullURL := r.URL.Path
+	if r.URL.RawQuery != "" {
+		fullURL += "?" + r.URL.RawQuery
+	}
+
+	// Контрольные суммы считаются на лету по байтам, полученным от сервера (кроме SSE)
+	var body io.Reader = resp.Body
+	var verifier *checksumVerifier
+	if !isSSE {
+		if verifier = newChecksumVerifier(r, resp); verifier != nil {
+			body = io.TeeReader(resp.Body, verifier)
+		}
+	}
+
+	// Для обычного стриминга подготавливаем потоковые замены (без буферизации всего ответа)
+	var replacements []BodyReplacement
+	if !isSSE {
+		if override := findMatchingOverrideForReplacements(r.Method, fullURL, r.Header.Get("Content-Type"), contentType, r); override != nil {
+			replacements = streamableReplacements(override)
+			// Замены выполняются над распакованными байтами: сжатый ответ распаковывается декодером
+			// contentDecoders, ответ с неизвестным кодированием передается без замен
+			encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+			if len(replacements) > 0 && encoding != "" && encoding != "identity" {
+				if decoder, ok := contentDecoders[encoding]; !ok {
+					requestLogf(r, "⚠️  Content-Encoding '%s' не распаковывается на лету, потоковые замены не применяются", encoding)
+					replacements = nil
+				} else if reader, err := decoder(body); err != nil {
+					requestLogf(r, "⚠️  Ошибка распаковки %s: %v, замены не применяются", encoding, err)
+					replacements = nil
+				} else {
+					defer reader.Close()
+					requestLogf(r, "🔓 Ответ (%s) распаковывается на лету, отправляется без сжатия", encoding)
+					body = reader
+					w.Header().Del("Content-Encoding")
+				}
+			}
+			if len(replacements) > 0 {
+				requestLogf(r, "🔄 Правило '%s': потоковые замены (%d)", override.Name, len(replacements))
+				// Размер ответа изменится - отправляем chunked
+				w.Header().Del("Content-Length")
+			}
+		}
+	}
+
+	// Устанавливаем статус код
+	w.WriteHeader(resp.StatusCode)
+
+	// Получаем Flusher для немедленной отправки данных (важно для SSE)
+	flusher, canFlush := w.(http.Flusher)
+	if !canFlush {
+		requestLogf(r, "⚠️  ResponseWriter не поддерживает Flush")
+	}
+
+	// СТРИМИНГ: копируем с поддержкой Flush для SSE
+	if isSSE && canFlush {
+		if override := findMatchingOverrideForSSE(r.Method, fullURL, r.Header.Get("Content-Type"), contentType, r); override != nil {
+			// Обрабатываем поток по событиям
+			requestLogf(r, "🌊 Правило '%s' применяется к событиям SSE", override.Name)
+			bytesWritten := streamSSEEvents(w, resp.Body, flusher, override)
+			requestLogf(r, "🌊 SSE стриминг завершен: %d bytes передано", bytesWritten)
+		} else {
+			// Для SSE используем буферизованное копирование с Flush
+			bytesWritten := streamWithFlush(w, resp.Body, flusher)
+			requestLogf(r, "🌊 SSE стриминг завершен: %d bytes передано", bytesWritten)
+		}
+	} else if len(replacements) > 0 {
+		// Стриминг с заменами через скользящее окно; каждый обработанный кусок сразу отправляется
+		// клиенту, как в streamWithFlush, чтобы chunked ответы не копились в буфере
+		counter := &countingWriter{w: w}
+		replacer := newStreamReplacer(counter, replacements)
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := body.Read(buf)
+			if n > 0 {
+				if _, err := replacer.Write(buf[:n]); err != nil {
+					requestLogf(r, "❌ Ошибка стриминга ответа: %v", err)
+					return
+				}
+				if canFlush {
+					flusher.Flush()
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				requestLogf(r, "❌ Ошибка стриминга ответа: %v", err)
+				return
+			}
+		}
+		if err := replacer.Close(); err != nil {
+			requestLogf(r, "❌ Ошибка стриминга ответа: %v", err)
+			return
+		}
+		requestLogf(r, "🚀 Стриминг завершен: %d bytes передано", counter.n)
+		if verifier != nil {
+			verifier.verify(nil)
+		}
+	} else {
+		// Обычный стриминг
+		bytesWritten, err := io.Copy(w, body)
+		if err != nil {
+			requestLogf(r, "❌ Ошибка стриминга ответа: %v", err)
+			return
+		}
+		requestLogf(r, "🚀 Стриминг завершен: %d bytes передано", bytesWritten)
+		if verifier != nil {
+			verifier.verify(nil)
+		}
+	}
+
+	requestLogf(r, "✅ Запрос завершен\n")
+}
+
+// streamWithFlush - стриминг с принудительной отправкой для SSE
+func streamWithFlush(w io.Writer, src io.Reader, flusher http.Flusher) int64 {
+	buf := make([]byte, 4096) // Небольшой буфер для частой отправки
+	var written int64
+
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			w.Write(buf[:n])
+			written += int64(n)
+			// Немедленно отправляем данные клиенту (критично для SSE)
+			flusher.Flush()
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("⚠️  Ошибка чтения SSE потока: %v", err)
+			}
+			break
+		}
+	}
+
+	return written
+}
+
+// streamableReplacements отбирает замены, которые можно применять потоково (только текстовые)
+func streamableReplacements(override *ResponseOverride) []BodyReplacement {
+	var result []BodyReplacement
+	for _, replacement := range override.BodyReplacements {
+		if replacement.IsRegex {
+			log.Printf("⚠️  Regex замена '%s' не поддерживается в стриминговом режиме, пропускаем", replacement.Find)
+			continue
+		}
+		if replacement.Find == "" {
+			continue
+		}
+		result = append(result, replacement)
+	}
+	return result
+}
+
+// streamReplacer применяет одну текстовую замену к потоку.
+// В буфере остается не более len(find)-1 байт, которые могут оказаться началом совпадения
+type streamReplacer struct {
+	dst     io.WriteCloser
+	find    []byte
+	replace []byte
+	buf     []byte
+	count   int
+}
+
+// newStreamReplacer собирает цепочку замен: каждая применяется к результату предыдущей, как в applyBodyReplacements
+func newStreamReplacer(dst io.Writer, replacements []BodyReplacement) io.WriteCloser {
+	var writer io.WriteCloser = nopWriteCloser{dst}
+	for i := len(replacements) - 1; i >= 0; i-- {
+		writer = &streamReplacer{
+			dst:     writer,
+			find:    []byte(replacements[i].Find),
+			replace: []byte(replacements[i].Replace),
+		}
+	}
+	return writer
+}
+
+func (s *streamReplacer) Write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+
+	var out []byte
+	for {
+		idx := bytes.Index(s.buf, s.find)
+		if idx < 0 {
+			break
+		}
+		out = append(out, s.buf[:idx]...)
+		out = append(out, s.replace...)
+		s.buf = s.buf[idx+len(s.find):]
+		s.count++
+	}
+
+	// Хвост, который может быть началом совпадения, оставляем до следующей записи
+	if safe := len(s.buf) - (len(s.find) - 1); safe > 0 {
+		out = append(out, s.buf[:safe]...)
+		s.buf = append([]byte(nil), s.buf[safe:]...)
+	}
+
+	if len(out) > 0 {
+		if _, err := s.dst.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (s *streamReplacer) Close() error {
+	if len(s.buf) > 0 {
+		if _, err := s.dst.Write(s.buf); err != nil {
+			return err
+		}
+		s.buf = nil
+	}
+	log.Printf("🔄 Потоковая замена '%s' -> '%s': найдено совпадений: %d", s.find, s.replace, s.count)
+	return s.dst.Close()
+}
+
+// nopWriteCloser добавляет пустой Close к io.Writer
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// countingWriter считает количество записанных байт
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// isSSEContent проверяет, является ли ответ SSE потоком
+func isSSEContent(contentType string) bool {
+	return strings.Contains(strings.ToLower(contentType), "text/event-stream")
+}
+
+// discardFlusher заменяет http.Flusher при обработке уже прочитанного SSE ответа
+type discardFlusher struct{}
+
+func (discardFlusher) Flush() {}
+
+// streamSSEEvents - стриминг SSE с обработкой по событиям: фильтрация, замены в data и вставка событий
+func streamSSEEvents(w io.Writer, src io.Reader, flusher http.Flusher, override *ResponseOverride) int64 {
+	reader := bufio.NewReader(src)
+	var written int64
+	var block []string
+	received := 0
+
+	write := func(data string) {
+		n, _ := io.WriteString(w, data)
+		written += int64(n)
+		flusher.Flush()
+	}
+
+	injectEvents := func() {
+		for _, event := range override.SSEInjectEvents {
+			if event.AfterEvents == received {
+				log.Printf("💉 Вставлено SSE событие '%s' после %d событий", event.Event, received)
+				write(formatSSEEvent(event))
+			}
+		}
+	}
+
+	injectEvents()
+
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			line = strings.TrimRight(line, "\r\n")
+			if line == "" {
+				// Пустая строка завершает событие
+				if isSSECommentBlock(block) {
+					// Комментарии (keep-alive) не считаются событиями
+					write(strings.Join(block, "\n") + "\n\n")
+					block = nil
+				} else if len(block) > 0 {
+					received++
+					if event := transformSSEEvent(block, override); event != "" {
+						write(event)
+					}
+					block = nil
+					injectEvents()
+				} else {
+					write("\n")
+				}
+			} else {
+				block = append(block, line)
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("⚠️  Ошибка чтения SSE потока: %v", err)
+			}
+			break
+		}
+	}
+
+	// Незавершенное событие в конце потока передаем как есть
+	if len(block) > 0 {
+		write(strings.Join(block, "\n") + "\n")
+	}
+
+	return written
+}
+
+// transformSSEEvent применяет правило к одному SSE событию, возвращает пустую строку если событие отфильтровано
+func transformSSEEvent(lines []string, override *ResponseOverride) string {
+	eventType := "message"
+	var dataLines []string
+	for _, line := range lines {
+		field, value := parseSSELine(line)
+		switch field {
+		case "event":
+			eventType = value
+		case "data":
+			dataLines = append(dataLines, value)
+		}
+	}
+
+	for _, dropType := range override.SSEDropEvents {
+		if dropType == eventType {
+			log.Printf("🚫 SSE событие '%s' отфильтровано", eventType)
+			return ""
+		}
+	}
+
+	// Без замен или без data событие передается без изменений
+	if len(override.BodyReplacements) == 0 || len(dataLines) == 0 {
+		return strings.Join(lines, "\n") + "\n\n"
+	}
+
+	data := string(applyBodyReplacements([]byte(strings.Join(dataLines, "\n")), override.BodyReplacements))
+
+	// Пересобираем событие: строки data: заменяем на новые, остальные сохраняем
+	var result strings.Builder
+	dataWritten := false
+	for _, line := range lines {
+		if field, _ := parseSSELine(line); field == "data" {
+			if !dataWritten {
+				for _, dataLine := range strings.Split(data, "\n") {
+					result.WriteString("data: " + dataLine + "\n")
+				}
+				dataWritten = true
+			}
+			continue
+		}
+		result.WriteString(line + "\n")
+	}
+	result.WriteString("\n")
+	return result.String()
+}
+
+// isSSECommentBlock проверяет, что блок состоит только из комментариев
+func isSSECommentBlock(lines []string) bool {
+	for _, line := range lines {
+		if !strings.HasPrefix(line, ":") {
+			return false
+		}
+	}
+	return len(lines) > 0
+}
+
+// parseSSELine разбирает строку SSE на поле и значение ("data: x" -> "data", "x")
+func parseSSELine(line string) (string, string) {
+	if strings.HasPrefix(line, ":") {
+		return "", line // комментарий
+	}
+	field, value, found := strings.Cut(line, ":")
+	if !found {
+		return line, ""
+	}
+	return field, strings.TrimPrefix(value, " ")
+}
+
+// formatSSEEvent сериализует синтетическое SSE событие
+func formatSSEEvent(event SSEEvent) string {
+	var result strings.Builder
+	if event.ID != "" {
+		result.WriteString("id: " + event.ID + "\n")
+	}
+	if event.Event != "" {
+		result.WriteString("event: " + event.Event + "\n")
+	}
+	for _, dataLine := range strings.Split(event.Data, "\n") {
+		result.WriteString("data: " + dataLine + "\n")
+	}
+	result.WriteString("\n")
+	return result.String()
+}
+
+// applyBodyReplacements применяет замены к телу ответа
+func applyBodyReplacements(body []byte, replacements []BodyReplacement) []byte {
+	if len(replacements) == 0 {
+		return body
+	}
+
+	result := body
+	replacementsApplied := 0
+
+	for i, replacement := range replacements {
+		if replacement.IsRegex && replacement.compiledRegex != nil {
+			// Regex замена
+			beforeLen := len(result)
+			countBefore := bytes.Count(result, []byte(replacement.Find))
+			result = replacement.compiledRegex.ReplaceAll(result, []byte(replacement.Replace))
+			afterLen := len(result)
+
+			log.Printf("🔄 Замена #%d (regex): '%s' -> '%s'", i+1, replacement.Find, replacement.Replace)
+			log.Printf("   Найдено совпадений: %d, размер: %d -> %d bytes", countBefore, beforeLen, afterLen)
+
+			if beforeLen != afterLen {
+				replacementsApplied++
+			}
+		} else {
+			// Простая текстовая замена (глобальная)
+			searchBytes := []byte(replacement.Find)
+			replaceBytes := []byte(replacement.Replace)
+			beforeLen := len(result)
+			countBefore := bytes.Count(result, searchBytes)
+			result = bytes.ReplaceAll(result, searchBytes, replaceBytes)
+			afterLen := len(result)
+
+			log.Printf("🔄 Замена #%d (текст): '%s' -> '%s'", i+1, replacement.Find, replacement.Replace)
+			log.Printf("   Найдено совпадений: %d, размер: %d -> %d bytes", countBefore, beforeLen, afterLen)
+
+			if countBefore > 0 {
+				replacementsApplied++
+			}
+		}
+	}
+
+	if replacementsApplied > 0 {
+		log.Printf("✨ Всего применено замен: %d из %d", replacementsApplied, len(replacements))
+	} else {
+		log.Printf("⚠️  Ни одна замена не была применена (совпадений не найдено)")
+	}
+
+	return result
+}
+
+// selectBodyFile возвращает файл ответа; если body_file - директория или glob, файлы перечисляются
+// на каждый запрос (новые файлы подхватываются без перезагрузки) и выбираются по body_file_order
+func selectBodyFile(override *ResponseOverride) (string, error) {
+	var files []string
+	if strings.ContainsAny(override.BodyFile, "*?[") {
+		matches, err := filepath.Glob(override.BodyFile)
+		if err != nil {
+			return "", err
+		}
+		for _, match := range matches {
+			if info, err := os.Stat(match); err == nil && info.Mode().IsRegular() {
+				files = append(files, match)
+			}
+		}
+	} else {
+		info, err := os.Stat(override.BodyFile)
+		if err != nil || !info.IsDir() {
+			return override.BodyFile, nil
+		}
+		entries, err := os.ReadDir(override.BodyFile)
+		if err != nil {
+			return "", err
+		}
+		for _, entry := range entries {
+			if entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+				files = append(files, filepath.Join(override.BodyFile, entry.Name()))
+			}
+		}
+	}
+	if len(files) == 0 {
+		return "", fmt.Errorf("нет файлов ответа по пути %s", override.BodyFile)
+	}
+	sort.Strings(files)
+
+	if override.BodyFileOrder == "random" {
+		return files[randomIntn(len(files))], nil
+	}
+	index := atomic.AddUint64(&override.bodyFileIndex, 1) - 1
+	return files[index%uint64(len(files))], nil
+}
+
+// BodyTemplateData данные запроса, доступные в шаблоне ответа: {{.Query.Get "id"}}, {{.JSON.user.name}}
+type BodyTemplateData struct {
+	Method   string
+	Path     string
+	Segments []string // Части пути: /api/users/42 -> ["api", "users", "42"]
+	Query    url.Values
+	Headers  http.Header
+	Body     string
+	JSON     interface{} // Разобранное JSON тело запроса (nil, если тело не JSON)
+}
+
+// newBodyTemplate создает шаблон с функциями fake (генератор данных), json (экранирование значения),
+// store (хранилище объектов запроса r) и status (статус ответа); для проверки разбора r и status - nil
+func newBodyTemplate(name string, r *http.Request, status *int) *template.Template {
+	return template.New(name).Option("missingkey=zero").Funcs(template.FuncMap{
+		"fake": func() fakeData { return fakeData{} },
+		"json": func(value interface{}) (string, error) {
+			data, err := json.Marshal(value)
+			return string(data), err
+		},
+		"store": func() mockStoreAccessor {
+			return mockStoreAccessor{namespace: tenantCacheNamespace(r, "")}
+		},
+		"status": func(code int) string {
+			if status != nil {
+				*status = code
+			}
+			return ""
+		},
+	})
+}
+
+// renderBodyTemplate выполняет шаблон тела ответа для запроса; возвращает статус из {{status N}} (0 - не задан)
+func renderBodyTemplate(override *ResponseOverride, r *http.Request, body []byte) ([]byte, int, error) {
+	status := 0
+	tmpl, err := newBodyTemplate(override.Name, r, &status).Parse(string(body))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	data := BodyTemplateData{
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Segments: strings.FieldsFunc(r.URL.Path, func(c rune) bool { return c == '/' }),
+		Query:    r.URL.Query(),
+		Headers:  r.Header,
+	}
+	// Ответ формирует прокси, сервер тело не получит - ждать его решения не нужно
+	if requestBody := peekBody(r); len(requestBody) > 0 {
+		data.Body = string(requestBody)
+		var parsed interface{}
+		if json.Unmarshal(requestBody, &parsed) == nil {
+			data.JSON = parsed
+		}
+	}
+
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return nil, 0, err
+	}
+	return rendered.Bytes(), status, nil
+}
+
+// mockCollection коллекция объектов хранилища подмен в порядке добавления
+type mockCollection struct {
+	items  map[string]interface{}
+	order  []string
+	nextID int64
+}
+
+// mockStoreKey коллекция в пространстве арендатора
+type mockStoreKey struct {
+	namespace  string
+	collection string
+}
+
+// mockStore хранилище объектов подменных ответов на время работы прокси
+var mockStore = make(map[mockStoreKey]*mockCollection)
+var mockStoreMutex sync.Mutex
+
+// mockStoreAccessor методы хранилища для шаблонов: {{store.Save "users" .JSON}}
+type mockStoreAccessor struct {
+	namespace string
+}
+
+// collection возвращает коллекцию (nil, если ее нет и create = false); вызывается под mockStoreMutex
+func (s mockStoreAccessor) collection(name string, create bool) *mockCollection {
+	key := mockStoreKey{namespace: s.namespace, collection: name}
+	collection := mockStore[key]
+	if collection == nil && create {
+		collection = &mockCollection{items: make(map[string]interface{})}
+		mockStore[key] = collection
+	}
+	return collection
+}
+
+func (c *mockCollection) set(id string, value interface{}) {
+	if _, exists := c.items[id]; !exists {
+		c.order = append(c.order, id)
+	}
+	c.items[id] = value
+}
+
+// Save сохраняет объект; объекту без поля id назначается следующий номер коллекции
+func (s mockStoreAccessor) Save(name string, value interface{}) interface{} {
+	mockStoreMutex.Lock()
+	defer mockStoreMutex.Unlock()
+	collection := s.collection(name, true)
+	object, isObject := value.(map[string]interface{})
+	if isObject && object["id"] != nil {
+		collection.set(fmt.Sprint(object["id"]), value)
+		return value
+	}
+	collection.nextID++
+	for collection.items[strconv.FormatInt(collection.nextID, 10)] != nil {
+		collection.nextID++
+	}
+	if isObject {
+		object["id"] = collection.nextID
+	}
+	collection.set(strconv.FormatInt(collection.nextID, 10), value)
+	return value
+}
+
+// Put сохраняет объект под заданным id (для объекта поле id заменяется)
+func (s mockStoreAccessor) Put(name string, id interface{}, value interface{}) interface{} {
+	mockStoreMutex.Lock()
+	defer mockStoreMutex.Unlock()
+	if object, ok := value.(map[string]interface{}); ok {
+		object["id"] = id
+	}
+	s.collection(name, true).set(fmt.Sprint(id), value)
+	return value
+}
+
+// Merge дополняет сохраненный объект полями value (PATCH); возвращает nil, если объекта нет
+func (s mockStoreAccessor) Merge(name string, id interface{}, value interface{}) interface{} {
+	mockStoreMutex.Lock()
+	defer mockStoreMutex.Unlock()
+	collection := s.collection(name, false)
+	if collection == nil {
+		return nil
+	}
+	existing, ok := collection.items[fmt.Sprint(id)].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	merged := make(map[string]interface{}, len(existing))
+	for key, field := range existing {
+		merged[key] = field
+	}
+	if patch, ok := value.(map[string]interface{}); ok {
+		for key, field := range patch {
+			if key != "id" {
+				merged[key] = field
+			}
+		}
+	}
+	collection.set(fmt.Sprint(id), merged)
+	return merged
+}
+
+// Get возвращает объект или nil
+func (s mockStoreAccessor) Get(name string, id interface{}) interface{} {
+	mockStoreMutex.Lock()
+	defer mockStoreMutex.Unlock()
+	if collection := s.collection(name, false); collection != nil {
+		return collection.items[fmt.Sprint(id)]
+	}
+	return nil
+}
+
+func (s mockStoreAccessor) Has(name string, id interface{}) bool {
+	return s.Get(name, id) != nil
+}
+
+// List возвращает объекты коллекции в порядке добавления
+func (s mockStoreAccessor) List(name string) []interface{} {
+	mockStoreMutex.Lock()
+	defer mockStoreMutex.Unlock()
+	list := []interface{}{}
+	if collection := s.collection(name, false); collection != nil {
+		for _, id := range collection.order {
+			list = append(list, collection.items[id])
+		}
+	}
+	return list
+}
+
+func (s mockStoreAccessor) Count(name string) int {
+	mockStoreMutex.Lock()
+	defer mockStoreMutex.Unlock()
+	if collection := s.collection(name, false); collection != nil {
+		return len(collection.items)
+	}
+	return 0
+}
+
+// Delete удаляет объект; возвращает true, если он был
+func (s mockStoreAccessor) Delete(name string, id interface{}) bool {
+	mockStoreMutex.Lock()
+	defer mockStoreMutex.Unlock()
+	collection := s.collection(name, false)
+	key := fmt.Sprint(id)
+	if collection == nil || collection.items[key] == nil {
+		return false
+	}
+	delete(collection.items, key)
+	for i, orderID := range collection.order {
+		if orderID == key {
+			collection.order = append(collection.order[:i], collection.order[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// Collections имена коллекций пространства
+func (s mockStoreAccessor) Collections() []string {
+	mockStoreMutex.Lock()
+	defer mockStoreMutex.Unlock()
+	var names []string
+	for key := range mockStore {
+		if key.namespace == s.namespace {
+			names = append(names, key.collection)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// handleMockStore просмотр (GET), заполнение (PUT ?collection= с JSON массивом) и очистка (DELETE)
+// хранилища подмен; ?collection= ограничивает одной коллекцией
+func handleMockStore(w http.ResponseWriter, r *http.Request) {
+	store := mockStoreAccessor{namespace: tenantCacheNamespace(r, "")}
+	name := r.URL.Query().Get("collection")
+
+	switch r.Method {
+	case http.MethodGet:
+		result := make(map[string][]interface{})
+		for _, collection := range store.Collections() {
+			if name == "" || collection == name {
+				result[collection] = store.List(collection)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	case http.MethodPut:
+		if name == "" {
+			http.Error(w, "Укажите ?collection=", http.StatusBadRequest)
+			return
+		}
+		var items []interface{}
+		if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+			http.Error(w, fmt.Sprintf("Ожидается JSON массив объектов: %v", err), http.StatusBadRequest)
+			return
+		}
+		mockStoreMutex.Lock()
+		delete(mockStore, mockStoreKey{namespace: store.namespace, collection: name})
+		mockStoreMutex.Unlock()
+		for _, item := range items {
+			store.Save(name, item)
+		}
+		requestLogf(r, "🗃️  Коллекция хранилища подмен '%s' заполнена: %d объектов", name, len(items))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"collection": name, "count": len(items)})
+	case http.MethodDelete:
+		removed := 0
+		mockStoreMutex.Lock()
+		for key, collection := range mockStore {
+			if key.namespace == store.namespace && (name == "" || key.collection == name) {
+				removed += len(collection.items)
+				delete(mockStore, key)
+			}
+		}
+		mockStoreMutex.Unlock()
+		requestLogf(r, "🗑️  Хранилище подмен очищено: %d объектов", removed)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"removed": removed})
+	default:
+		http.Error(w, "Используйте GET, PUT или DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+// mockStoreStats число объектов в коллекциях для /_proxy_stats
+func mockStoreStats(r *http.Request) map[string]int {
+	store := mockStoreAccessor{namespace: tenantCacheNamespace(r, "")}
+	stats := make(map[string]int)
+	for _, name := range store.Collections() {
+		stats[name] = store.Count(name)
+	}
+	return stats
+}
+
+// fakeData генератор правдоподобных данных для шаблонов: {{fake.Name}}, {{fake.Int 1 100}}
+type fakeData struct{}
+
+var fakeFirstNames = []string{"James", "Mary", "John", "Patricia", "Robert", "Jennifer", "Michael", "Linda", "William", "Elizabeth", "David", "Barbara", "Richard", "Susan", "Joseph", "Jessica", "Thomas", "Sarah", "Daniel", "Karen", "Anna", "Ivan", "Olga", "Dmitry", "Elena"}
+var fakeLastNames = []string{"Smith", "Johnson", "Williams", "Brown", "Jones", "Garcia", "Miller", "Davis", "Rodriguez", "Martinez", "Wilson", "Anderson", "Taylor", "Thomas", "Moore", "Jackson", "Martin", "Lee", "Thompson", "White", "Ivanov", "Petrov", "Smirnov"}
+var fakeCompanySuffixes = []string{"Inc", "LLC", "Group", "Ltd", "Systems", "Labs", "Solutions", "Technologies"}
+var fakeCities = []string{"New York", "London", "Berlin", "Paris", "Tokyo", "Toronto", "Sydney", "Madrid", "Rome", "Amsterdam", "Moscow", "Prague", "Vienna", "Warsaw", "Lisbon"}
+var fakeStreets = []string{"Main St", "Oak Ave", "Maple Dr", "Cedar Ln", "Park Rd", "Pine St", "Elm St", "Lake View", "Hill Rd", "Sunset Blvd"}
+var fakeWords = []string{"alpha", "beta", "gamma", "delta", "lorem", "ipsum", "dolor", "sit", "amet", "consectetur", "adipiscing", "elit", "sed", "do", "eiusmod", "tempor", "incididunt", "labore", "magna", "aliqua"}
+var fakeDomains = []string{"example.com", "example.org", "example.net", "mail.test", "corp.test"}
+
+func fakePick(values []string) string {
+	return values[randomIntn(len(values))]
+}
+
+func (fakeData) FirstName() string { return fakePick(fakeFirstNames) }
+func (fakeData) LastName() string  { return fakePick(fakeLastNames) }
+func (fakeData) Name() string      { return fakePick(fakeFirstNames) + " " + fakePick(fakeLastNames) }
+func (fakeData) City() string      { return fakePick(fakeCities) }
+func (fakeData) Word() string      { return fakePick(fakeWords) }
+
+func (fakeData) Email() string {
+	return strings.ToLower(fakePick(fakeFirstNames)+"."+fakePick(fakeLastNames)) + strconv.Itoa(randomIntn(100)) + "@" + fakePick(fakeDomains)
+}
+
+func (fakeData) Company() string {
+	return fakePick(fakeLastNames) + " " + fakePick(fakeCompanySuffixes)
+}
+
+func (fakeData) Address() string {
+	return fmt.Sprintf("%d %s, %s", 1+randomIntn(999), fakePick(fakeStreets), fakePick(fakeCities))
+}
+
+func (fakeData) Phone() string {
+	return fmt.Sprintf("+1-%03d-%03d-%04d", 200+randomIntn(800), randomIntn(1000), randomIntn(10000))
+}
+
+// UUID случайный UUID версии 4
+func (fakeData) UUID() string {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], randomUint64())
+	binary.BigEndian.PutUint64(b[8:], randomUint64())
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func (fakeData) Sentence() string {
+	words := make([]string, 5+randomIntn(6))
+	for i := range words {
+		words[i] = fakePick(fakeWords)
+	}
+	sentence := strings.Join(words, " ")
+	return strings.ToUpper(sentence[:1]) + sentence[1:] + "."
+}
+
+// Int случайное целое в диапазоне [low, high]
+func (fakeData) Int(low, high int) int {
+	if high <= low {
+		return low
+	}
+	return low + randomIntn(high-low+1)
+}
+
+// Float случайное число в диапазоне [low, high) с двумя знаками после запятой
+func (fakeData) Float(low, high float64) float64 {
+	return math.Round((low+randomFloat64()*(high-low))*100) / 100
+}
+
+func (fakeData) Bool() bool { return randomIntn(2) == 1 }
+
+func (fakeData) IPv4() string {
+	return fmt.Sprintf("%d.%d.%d.%d", 1+randomIntn(223), randomIntn(256), randomIntn(256), 1+randomIntn(254))
+}
+
+// Date случайный момент за последний год в формате RFC 3339
+func (fakeData) Date() string {
+	return time.Now().Add(-time.Duration(randomInt63n(int64(365 * 24 * time.Hour)))).UTC().Format(time.RFC3339)
+}
+
+func handleOverride(w http.ResponseWriter, r *http.Request, override *ResponseOverride) {
+	// Устанавливаем заголовки
+	for key, value := range override.Headers {
+		w.Header().Set(key, value)
+	}
+
+	// Получаем тело ответа
+	var responseBody []byte
+	var err error
+
+	if override.BodyFile != "" {
+		// Читаем из файла (для директории или glob - выбранного для этого запроса)
+		var bodyFile string
+		bodyFile, err = selectBodyFile(override)
+		if err == nil {
+			responseBody, err = os.ReadFile(bodyFile)
+		}
+		if err != nil {
+			requestLogf(r, "❌ Ошибка чтения файла %s: %v", override.BodyFile, err)
+			http.Error(w, "Ошибка чтения файла подмены", http.StatusInternalServerError)
+			return
+		}
+		requestLogf(r, "📂 Загружен ответ из файла: %s (%d bytes)", bodyFile, len(responseBody))
+	} else if override.BodyText != "" {
+		// Используем текст
+		responseBody = []byte(override.BodyText)
+		requestLogf(r, "📝 Использован текст ответа (%d bytes)", len(responseBody))
+	}
+
+	// Заполняем шаблон данными запроса и сгенерированными значениями
+	templateStatus := 0
+	if override.BodyTemplate && len(responseBody) > 0 {
+		responseBody, templateStatus, err = renderBodyTemplate(override, r, responseBody)
+		if err != nil {
+			requestLogf(r, "❌ Ошибка шаблона ответа правила '%s': %v", override.Name, err)
+			http.Error(w, "Ошибка шаблона ответа", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Применяем замены в body если они есть
+	if len(override.BodyReplacements) > 0 && len(responseBody) > 0 {
+		requestLogf(r, "🔄 Применяем замены в body...")
+		responseBody = applyBodyReplacements(responseBody, override.BodyReplacements)
+	}
+
+	// Внедряем HTML фрагмент в text/html ответ
+	if override.HTMLInject != "" && len(responseBody) > 0 {
+		responseBody = injectHTMLResponse(override, w.Header(), responseBody)
+	}
+
+	// Скрипт и внешний обработчик правила могут изменить статус, заголовки и тело
+	statusCode := override.StatusCode
+	if templateStatus != 0 {
+		statusCode = templateStatus
+	}
+	if hasTransforms(override) {
+		var requestBody []byte
+		if r.Body != nil {
+			requestBody, _ = io.ReadAll(r.Body)
+		}
+		statusCode, responseBody = applyTransforms(override, r, requestBody, statusCode, w.Header(), responseBody)
+	}
+
+	// Отправляем статус код и тело
+	err = writeResponse(w, r, statusCode, responseBody, override.Fault)
+	if err != nil {
+		requestLogf(r, "❌ Ошибка отправки подменного ответа: %v", err)
+	}
+
+	// Логируем подменный ответ
+	requestLogf(r, "🎭 Отправлен подменный ответ:")
+	requestLogf(r, "   Status: %d", statusCode)
+
+	// Логируем заголовки подмены
+	settings := requestLogSettings(r)
+	if settings.ShowResponseHeaders && len(override.Headers) > 0 {
+		requestLogf(r, "   Override Headers:")
+		headers := make([]string, 0, len(override.Headers))
+		for key, _ := range override.Headers {
+			headers = append(headers, key)
+		}
+		sort.Strings(headers)
+		for _, key := range headers {
+			requestLogf(r, "     %s: %s", key, override.Headers[key])
+		}
+	}
+
+	if len(responseBody) > 0 && settings.ShowResponseBody {
+		contentType := override.Headers["Content-Type"]
+		logBody(settings, "   Body", responseBody, contentType, nil)
+	}
+
+	requestLogf(r, "✅ Подмена завершена\n")
+}
+
+// Исправления заголовков тела в writeResponse (атомарные)
+var bodyLengthFixed int64   // Content-Length не совпадал с телом
+var bodyEncodingFixed int64 // Content-Encoding у несжатого тела
+var bodyChunkedFixed int64  // Transfer-Encoding у буферизованного тела
+
+// writeResponse единая точка отправки буферизованного ответа: после всех изменений тела
+// (замены, распаковка, шаблоны, скрипты) заголовки тела приводятся в соответствие с ним
+func writeResponse(w http.ResponseWriter, r *http.Request, statusCode int, body []byte, fault *ResponseFault) error {
+	reconcileBodyHeaders(w.Header(), r.Method, statusCode, body)
+	return writeBodyWithFault(w, statusCode, body, fault)
+}
+
+// reconcileBodyHeaders согласует Content-Length, Transfer-Encoding и Content-Encoding с телом
+func reconcileBodyHeaders(header http.Header, method string, statusCode int, body []byte) {
+	// Тело уже целиком в памяти - chunked не нужен, net/http сам решит, как его передать
+	if header.Get("Transfer-Encoding") != "" {
+		header.Del("Transfer-Encoding")
+		atomic.AddInt64(&bodyChunkedFixed, 1)
+	}
+
+	// У 1xx, 204 и 304 тела нет
+	if statusCode == http.StatusNoContent || statusCode == http.StatusNotModified || (statusCode >= 100 && statusCode < 200) {
+		header.Del("Content-Length")
+		return
+	}
+
+	// Тело распаковали (замены, transformer) или не смогли сжать обратно
+	switch encoding := strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding"))); encoding {
+	case "":
+	case "identity":
+		header.Del("Content-Encoding")
+	default:
+		if len(body) > 0 && !isEncodedBody(body, encoding) {
+			header.Del("Content-Encoding")
+			atomic.AddInt64(&bodyEncodingFixed, 1)
+			log.Printf("🧮 Content-Encoding: %s убран - тело не сжато", encoding)
+		}
+	}
+
+	// Ответ на HEAD без тела: Content-Length описывает тело ответа на GET
+	if method == http.MethodHead && len(body) == 0 {
+		return
+	}
+	length := strconv.Itoa(len(body))
+	if declared := header.Get("Content-Length"); declared != length {
+		if declared != "" {
+			atomic.AddInt64(&bodyLengthFixed, 1)
+			log.Printf("🧮 Content-Length: %s -> %s", declared, length)
+		}
+		header.Set("Content-Length", length)
+	}
+}
+
+// isEncodedBody проверяет, что тело действительно сжато кодированием: gzip - по сигнатуре,
+// кодирования плагинов - пробной распаковкой начала тела. Без декодера тело считается сжатым
+func isEncodedBody(body []byte, encoding string) bool {
+	if encoding == "gzip" || encoding == "x-gzip" {
+		return isGzipData(body)
+	}
+	decoder := contentDecoders[encoding]
+	if decoder == nil {
+		return true
+	}
+	reader, err := decoder(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	defer reader.Close()
+	_, err = io.CopyN(io.Discard, reader, 512)
+	return err == nil || err == io.EOF
+}
+
+// isGzipData проверяет сигнатуру gzip
+func isGzipData(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+func bodyHeadersStats() map[string]interface{} {
+	return map[string]interface{}{
+		"content_length_fixed":    atomic.LoadInt64(&bodyLengthFixed),
+		"content_encoding_fixed":  atomic.LoadInt64(&bodyEncodingFixed),
+		"transfer_encoding_fixed": atomic.LoadInt64(&bodyChunkedFixed),
+	}
+}
+
+// writeBodyWithFault отправляет статус и тело, применяя повреждения из правила
+func writeBodyWithFault(w http.ResponseWriter, statusCode int, body []byte, fault *ResponseFault) error {
+	if fault == nil {
+		w.WriteHeader(statusCode)
+		if len(body) == 0 {
+			return nil
+		}
+		_, err := w.Write(body)
+		return err
+	}
+
+	// Портим копию, чтобы не задеть кеш и файлы подмен
+	body = append([]byte(nil), body...)
+	if fault.CorruptBytes > 0 && len(body) > 0 {
+		for i := 0; i < fault.CorruptBytes; i++ {
+			pos := randomIntn(len(body))
+			body[pos] ^= 0xff
+		}
+		log.Printf("💥 Инвертировано байт в теле: %d", fault.CorruptBytes)
+	}
+
+	if fault.ContentLengthDelta != 0 {
+		declared := len(body) + fault.ContentLengthDelta
+		if declared < 0 {
+			declared = 0
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(declared))
+		log.Printf("💥 Неверный Content-Length: %d (реально %d bytes)", declared, len(body))
+		if declared < len(body) {
+			if fault.TruncateAfter > 0 && fault.TruncateAfter < len(body) {
+				body = body[:fault.TruncateAfter]
+			}
+			err := writeMismatchedLength(w, statusCode, body, declared-len(body))
+			if err == nil {
+				return nil
+			}
+			// net/http не отправит больше заявленного - клиент получит только начало тела
+			log.Printf("⚠️  Соединение не перехвачено (%v): отправлено только %d bytes", err, declared)
+			body = body[:min(declared, len(body))]
+		}
+	}
+
+	if fault.TruncateAfter > 0 && fault.TruncateAfter < len(body) {
+		// Заявлено полное тело: сервер закроет соединение, не дождавшись остальных байт
+		if w.Header().Get("Content-Length") == "" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		w.WriteHeader(statusCode)
+		w.Write(body[:fault.TruncateAfter])
+		controller := http.NewResponseController(w)
+		controller.Flush()
+		// Закрываем соединение сами: обработчик завершается штатно, и обмен попадает в статистику,
+		// экспорт и журнал; сжатый ответ остается без окончания потока
+		if conn, _, err := controller.Hijack(); err == nil {
+			conn.Close()
+		}
+		log.Printf("💥 Соединение оборвано после %d из %d bytes", fault.TruncateAfter, len(body))
+		return nil
+	}
+
+	w.WriteHeader(statusCode)
+
+	_, err := w.Write(body)
+	return err
+}
+
+// rawResponsePreparer обертка ResponseWriter, которая меняет заголовки, тело или запоминает ответ.
+// Перед записью в перехваченное соединение она применяет те же изменения, что и при WriteHeader и Write
+type rawResponsePreparer interface {
+	prepareRaw(statusCode int, body []byte) []byte
+}
+
+// writeMismatchedLength пишет ответ в перехваченное соединение: net/http не отправляет больше
+// заявленного Content-Length, а клиент должен получить заголовок и все тело независимо.
+// Заявленная длина - длина тела после оберток (сжатие, сдвиг времени) плюс delta
+func writeMismatchedLength(w http.ResponseWriter, statusCode int, body []byte, delta int) error {
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Обертки применяются снаружи внутрь, как при обычной записи ответа
+	header := w.Header()
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	for writer := w; ; {
+		if preparer, ok := writer.(rawResponsePreparer); ok {
+			body = preparer.prepareRaw(statusCode, body)
+		}
+		unwrapper, ok := writer.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			break
+		}
+		writer = unwrapper.Unwrap()
+	}
+	header.Set("Content-Length", strconv.Itoa(max(len(body)+delta, 0)))
+
+	header = header.Clone()
+	header.Set("Connection", "close")
+	if header.Get("Date") == "" {
+		header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	fmt.Fprintf(buf, "HTTP/1.1 %d %s\r\n", statusCode, http.StatusText(statusCode))
+	header.Write(buf)
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Flush()
+}
+
+// logHeaders логирует HTTP заголовки
+func logHeaders(prefix string, headers http.Header) {
+	if len(headers) == 0 {
+		log.Printf("%s: [None]", prefix)
+		return
+	}
+
+	// Сортируем заголовки для консистентного вывода
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	log.Printf("%s:", prefix)
+	for _, key := range keys {
+		values := headers[key]
+		if len(values) == 1 {
+			log.Printf("  %s: %s", key, values[0])
+		} else {
+			log.Printf("  %s: %v", key, values)
+		}
+	}
+}
+
+// logBody логирует тело запроса/ответа с учетом настроек
+func logBody(settings *LogSettings, prefix string, body []byte, contentType string, headers http.Header) {
+	if len(body) == 0 {
+		log.Printf("%s: [Empty]", prefix)
+		return
+	}
+
+	// multipart тела логируем по частям
+	if settings.BodyLogMode != "none" && logMultipartBody(settings, prefix, body, contentType) {
+		return
+	}
+
+	// Проверяем режим логирования
+	switch settings.BodyLogMode {
+	case "none":
+		log.Printf("%s: [Hidden by BODY_LOG_MODE=none]", prefix)
+		return
+	case "full":
+		logBodyFull(prefix, body, contentType, headers)
+		return
+	case "truncate":
+		logBodyTruncated(settings, prefix, body, contentType, headers)
+		return
+	case "json_full":
+		logBodyJSONSmart(settings, prefix, body, contentType, headers)
+		return
+	default:
+		log.Printf("%s: [Unknown BODY_LOG_MODE: %s]", prefix, settings.BodyLogMode)
+		return
+	}
+}
+
+// logBodyFull показывает body полностью
+func logBodyFull(prefix string, body []byte, contentType string, headers http.Header) {
+	if len(body) > 500*1024 { // 500KB лимит для безопасности
+		log.Printf("%s: [Very large content, %d bytes] - skipping log for safety", prefix, len(body))
+		return
+	}
+
+	decompressedBody := decompressIfNeeded(body, headers)
+
+	if utf8.Valid(decompressedBody) {
+		log.Printf("%s: %s", prefix, string(decompressedBody))
+	} else {
+		log.Printf("%s: [Non-UTF8 data, %d bytes]", prefix, len(decompressedBody))
+		logHexDump(prefix, body)
+	}
+}
+
+// logBodyTruncated показывает body с обрезанием
+func logBodyTruncated(settings *LogSettings, prefix string, body []byte, contentType string, headers http.Header) {
+	decompressedBody := decompressIfNeeded(body, headers)
+
+	if utf8.Valid(decompressedBody) {
+		text := string(decompressedBody)
+		log.Printf("%s: %s", prefix, truncateString(text, settings.MaxLogLength))
+	} else {
+		log.Printf("%s: [Non-UTF8 data, %d bytes]", prefix, len(decompressedBody))
+		logHexDump(prefix, body)
+	}
+}
+
+// logBodyJSONSmart показывает JSON полностью, остальное обрезает
+func logBodyJSONSmart(settings *LogSettings, prefix string, body []byte, contentType string, headers http.Header) {
+	decompressedBody := decompressIfNeeded(body, headers)
+
+	// MessagePack и CBOR декодируем в JSON
+	if isMsgpackContent(contentType) || isCBORContent(contentType) {
+		if decoded, format, err := decodeBinaryJSON(decompressedBody, contentType); err == nil {
+			if formatted, err := json.MarshalIndent(decoded, "", "  "); err == nil {
+				log.Printf("%s (%s → JSON):\n%s", prefix, format, string(formatted))
+				return
+			}
+		} else {
+			log.Printf("⚠️  Не удалось декодировать %s: %v", format, err)
+		}
+	}
+
+	// Проверяем, является ли контент JSON
+	if isJSONContent(contentType, decompressedBody) {
+		// Для JSON форматируем и выводим полностью
+		if formatted := formatJSON(decompressedBody); formatted != "" {
+			log.Printf("%s (JSON formatted):\n%s", prefix, formatted)
+		} else {
+			// Если не удалось отформатировать, выводим как есть
+			log.Printf("%s (JSON): %s", prefix, string(decompressedBody))
+		}
+		return
+	}
+
+	// Для не-JSON применяем truncation
+	if utf8.Valid(decompressedBody) {
+		text := string(decompressedBody)
+		log.Printf("%s: %s", prefix, truncateString(text, settings.MaxLogLength))
+	} else {
+		log.Printf("%s: [Non-UTF8 data, %d bytes]", prefix, len(decompressedBody))
+		logHexDump(prefix, body)
+	}
+}
+
+// logMultipartBody логирует multipart тело по частям, возвращает false если тело не multipart
+func logMultipartBody(settings *LogSettings, prefix string, body []byte, contentType string) bool {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return false
+	}
+
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	type partInfo struct {
+		name        string
+		filename    string
+		contentType string
+		data        []byte
+	}
+	var parts []partInfo
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("⚠️  Ошибка разбора multipart: %v", err)
+			return false
+		}
+		data, err := io.ReadAll(part)
+		part.Close()
+		if err != nil {
+			log.Printf("⚠️  Ошибка чтения части multipart: %v", err)
+			return false
+		}
+		parts = append(parts, partInfo{
+			name:        part.FormName(),
+			filename:    part.FileName(),
+			contentType: part.Header.Get("Content-Type"),
+			data:        data,
+		})
+	}
+
+	log.Printf("%s (%s, %d parts, %d bytes):", prefix, mediaType, len(parts), len(body))
+	for i, part := range parts {
+		description := fmt.Sprintf("  #%d name=%q", i+1, part.name)
+		if part.filename != "" {
+			description += fmt.Sprintf(" filename=%q", part.filename)
+		}
+		if part.contentType != "" {
+			description += " type=" + part.contentType
+		}
+		description += fmt.Sprintf(" size=%d", len(part.data))
+
+		// Текстовые части показываем, бинарные - только описание и hex сэмпл
+		isText := part.filename == "" || strings.HasPrefix(part.contentType, "text/") || isJSONContent(part.contentType, nil)
+		if isText && utf8.Valid(part.data) {
+			text := string(part.data)
+			if settings.BodyLogMode != "full" {
+				text = truncateString(text, settings.MaxLogLength)
+			}
+			log.Printf("%s: %s", description, text)
+		} else {
+			log.Printf("%s: [Binary data]", description)
+			if len(part.data) > 0 {
+				logHexDump(fmt.Sprintf("  #%d", i+1), part.data[:min(16, len(part.data))])
+			}
+		}
+	}
+	return true
+}
+
+// logHexDump показывает hex дамп для бинарных данных
+func logHexDump(prefix string, body []byte) {
+	sampleSize := min(64, len(body))
+	hexSample := hex.EncodeToString(body[:sampleSize])
+	log.Printf("%s (hex sample): %s", prefix, hexSample)
+	if len(body) > sampleSize {
+		log.Printf("%s (hex): ... +%d more bytes", prefix, len(body)-sampleSize)
+	}
+}
+
+// decompressIfNeeded распаковывает данные если они сжаты
+func decompressIfNeeded(body []byte, headers http.Header) []byte {
+	decoded, _ := decodeContent(body, headers)
+	return decoded
+}
+
+// decodeContent распаковывает тело по Content-Encoding (gzip и кодирования плагинов) и возвращает
+// снятое кодирование. Пустая строка - тело не распаковано: кодирования нет, декодера нет или тело повреждено
+func decodeContent(body []byte, headers http.Header) ([]byte, string) {
+	if headers == nil {
+		return body, ""
+	}
+	encoding := strings.ToLower(strings.TrimSpace(headers.Get("Content-Encoding")))
+	decoder := contentDecoders[encoding]
+	if decoder == nil {
+		return body, ""
+	}
+
+	reader, err := decoder(bytes.NewReader(body))
+	if err != nil {
+		return body, ""
+	}
+	defer reader.Close()
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		return body, ""
+	}
+	log.Printf("🔓 Decompressed %s: %d -> %d bytes", encoding, len(body), len(decoded))
+	return decoded, encoding
+}
+
+// isJSONContent проверяет, является ли контент JSON
+func isJSONContent(contentType string, body []byte) bool {
+	// Проверяем Content-Type
+	if strings.Contains(strings.ToLower(contentType), "application/json") {
+		return true
+	}
+
+	// Проверяем структуру данных
+	if len(body) == 0 {
+		return false
+	}
+
+	// Проверяем синтаксис без построения значений
+	return json.Valid(body)
+}
+
+// formatJSON форматирует JSON для красивого вывода (порядок ключей сохраняется)
+func formatJSON(body []byte) string {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := json.Indent(buf, body, "", "  "); err != nil {
+		return ""
+	}
+	return buf.String()
+}
+
+// Буферы и gzip кодеры переиспользуются между запросами: буферизованный режим читает,
+// распаковывает и сжимает тела на каждый запрос
+var bufferPool = sync.Pool{New: func() interface{} {
+	atomic.AddInt64(&bufferPoolAllocated, 1)
+	return new(bytes.Buffer)
+}}
+var gzipReaderPool sync.Pool // *gzip.Reader
+var gzipWriterPool = sync.Pool{New: func() interface{} {
+	return gzip.NewWriter(nil)
+}}
+
+const maxPooledBuffer = 4 << 20 // Буферы больше 4MB не возвращаются в пул, чтобы не удерживать память
+
+var bufferPoolGets int64      // атомарный
+var bufferPoolAllocated int64 // Новые буферы, когда в пуле не нашлось свободного (атомарный)
+var bufferPoolDropped int64   // Слишком большие буферы, не возвращенные в пул (атомарный)
+
+func getBuffer() *bytes.Buffer {
+	atomic.AddInt64(&bufferPoolGets, 1)
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		atomic.AddInt64(&bufferPoolDropped, 1)
+		return
+	}
+	bufferPool.Put(buf)
+}
+
+// readBody читает тело целиком через буфер из пула и возвращает копию точного размера:
+// вместо нескольких перевыделений io.ReadAll - одно. sizeHint - Content-Length (-1, если неизвестен)
+func readBody(reader io.Reader, sizeHint int64) ([]byte, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if sizeHint > 0 && sizeHint <= maxPooledBuffer {
+		buf.Grow(int(sizeHint) + bytes.MinRead)
+	}
+	if _, err := buf.ReadFrom(reader); err != nil {
+		return nil, err
+	}
+	return bytes.Clone(buf.Bytes()), nil
+}
+
+// getGzipReader возвращает распаковщик из пула, настроенный на reader
+func getGzipReader(reader io.Reader) (*gzip.Reader, error) {
+	if pooled, ok := gzipReaderPool.Get().(*gzip.Reader); ok {
+		if err := pooled.Reset(reader); err != nil {
+			gzipReaderPool.Put(pooled)
+			return nil, err
+		}
+		return pooled, nil
+	}
+	return gzip.NewReader(reader)
+}
+
+// pooledGzipReader возвращает распаковщик в пул при закрытии
+type pooledGzipReader struct {
+	*gzip.Reader
+}
+
+func (r pooledGzipReader) Close() error {
+	err := r.Reader.Close()
+	gzipReaderPool.Put(r.Reader)
+	return err
+}
+
+// pooledGzipWriter возвращает упаковщик в пул при закрытии
+type pooledGzipWriter struct {
+	*gzip.Writer
+}
+
+func (w pooledGzipWriter) Close() error {
+	err := w.Writer.Close()
+	w.Writer.Reset(nil)
+	gzipWriterPool.Put(w.Writer)
+	return err
+}
+
+func newPooledGzipWriter(writer io.Writer) io.WriteCloser {
+	gz := gzipWriterPool.Get().(*gzip.Writer)
+	gz.Reset(writer)
+	return pooledGzipWriter{gz}
+}
+
+func bufferPoolStats() map[string]interface{} {
+	return map[string]interface{}{
+		"gets":      atomic.LoadInt64(&bufferPoolGets),
+		"allocated": atomic.LoadInt64(&bufferPoolAllocated),
+		"dropped":   atomic.LoadInt64(&bufferPoolDropped),
+	}
+}
+
+// Остальные вспомогательные функции
+func decompressGzip(data []byte) ([]byte, error) {
+	reader, err := getGzipReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer pooledGzipReader{reader}.Close()
+
+	return readBody(reader, -1)
+}
+
+func compressGzip(data []byte) ([]byte, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	writer := newPooledGzipWriter(buf)
+
+	_, err := writer.Write(data)
+	if err != nil {
+		writer.Close()
+		return nil, err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.Clone(buf.Bytes()), nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func truncateString(s string, maxLen int) string {
+	if len(s) <= maxLen {
+		return s
+	}
+	return s[:maxLen] + "... [truncated]"
+}
+
+func copyHeaders(dst, src http.Header) {
+	for name, values := range src {
+		if shouldSkipHeader(name) {
+			continue
+		}
+		for _, value := range values {
+			dst.Add(name, value)
+		}
+	}
+}
+
+func shouldSkipHeader(name string) bool {
+	skipHeaders := []string{
+		"Connection",
+		"Proxy-Connection",
+		"Proxy-Authenticate",
+		"Proxy-Authorization",
+		"Te",
+		"Trailer",
+		"Upgrade",
+	}
+
+	// В стриминговом режиме НЕ пропускаем Transfer-Encoding
+	if !logSettings.EnableStreaming {
+		skipHeaders = append(skipHeaders, "Transfer-Encoding")
+	}
+
+	lowerName := strings.ToLower(name)
+	for _, skipHeader := range skipHeaders {
+		if lowerName == strings.ToLower(skipHeader) {
+			return true
+		}
+	}
+	return false
+}
+
+// generateCacheKey генерирует ключ кеша на основе метода, URL и заголовков (keyHeaders - CACHE_KEY_HEADERS маршрута)
+func generateCacheKey(method, url string, headers http.Header, keyHeaders []string) string {
+	h := sha256.New()
+	h.Write([]byte(method))
+	h.Write([]byte(url))
+
+	// Добавляем важные заголовки в ключ кеша
+	if auth := headers.Get("Authorization"); auth != "" {
+		h.Write([]byte("Authorization:"))
+		h.Write([]byte(auth))
+	}
+	if contentType := headers.Get("Content-Type"); contentType != "" {
+		h.Write([]byte("Content-Type:"))
+		h.Write([]byte(contentType))
+	}
+
+	// Добавляем дополнительные заголовки из настроек
+	for _, headerName := range keyHeaders {
+		if headerValue := headers.Get(headerName); headerValue != "" {
+			h.Write([]byte(headerName + ":"))
+			h.Write([]byte(headerValue))
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// getCachedResponse получает ответ из кеша
+func getCachedResponse(key string) *CacheEntry {
+	if val, ok := responseCache.Load(key); ok {
+		entry := val.(*CacheEntry)
+		if time.Now().Before(entry.ExpiresAt) {
+			return entry
+		}
+		// Удаляем устаревшую запись
+		responseCache.Delete(key)
+		markCacheDirty(key)
+	}
+	return nil
+}
+
+// cacheResponse сохраняет ответ в кеш
+func cacheResponse(key, namespace string, statusCode int, headers http.Header, body []byte, url string, ttl time.Duration) {
+	now := time.Now()
+	entry := &CacheEntry{
+		StatusCode:  statusCode,
+		Headers:     cloneHeaders(headers),
+		Body:        body,
+		CachedAt:    now,
+		ExpiresAt:   now.Add(ttl),
+		RequestURL:  url,
+		RequestHash: key,
+		Namespace:   namespace,
+	}
+	responseCache.Store(key, entry)
+	markCacheDirty(key) // Отмечаем, что кеш изменился
+	replicateCacheEntry(key, entry)
+	log.Printf("💾 Ответ сохранен в кеш (срок действия до %s)", entry.ExpiresAt.Format("15:04:05"))
+}
+
+// serveCachedResponse отправляет кешированный ответ клиенту
+func serveCachedResponse(w http.ResponseWriter, r *http.Request, entry *CacheEntry, fault *ResponseFault) {
+	requestLogf(r, "📥 Response Status: %d (cached)", entry.StatusCode)
+
+	// Логируем заголовки с отметкой кеша
+	settings := requestLogSettings(r)
+	if settings.ShowResponseHeaders {
+		logHeaders("📥 Response Headers (cached)", entry.Headers)
+	}
+
+	// Логируем тело с обрезанием
+	if len(entry.Body) > 0 && settings.ShowResponseBody {
+		// Принудительно обрезаем кешированные логи
+		contentType := entry.Headers.Get("Content-Type")
+		logCachedBody(settings, "📥 Response Body (cached)", entry.Body, contentType, entry.Headers)
+	}
+
+	// Копируем заголовки
+	copyHeaders(w.Header(), entry.Headers)
+
+	// Добавляем заголовок о кешировании
+	w.Header().Set("X-Cache", "HIT")
+	w.Header().Set("X-Cache-Expires", entry.ExpiresAt.Format(time.RFC3339))
+
+	// Отправляем статус код и тело
+	writeResponse(w, r, entry.StatusCode, entry.Body, fault)
+
+	requestLogf(r, "✅ Запрос завершен (из кеша)\n")
+}
+
+// conditionalHeaders - условные заголовки GET запроса, которые при кешировании проверяет прокси
+var conditionalHeaders = []string{"If-None-Match", "If-Modified-Since"}
+var cacheNotModified int64 // Ответы 304 от прокси (атомарный)
+
+func isConditionalRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	return r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != ""
+}
+
+// notModified проверяет условные заголовки клиента по валидаторам ответа (RFC 9110, 13.1):
+// If-None-Match важнее If-Modified-Since, ETag сравниваются слабо (W/ не учитывается)
+func notModified(r *http.Request, headers http.Header) bool {
+	if !isConditionalRequest(r) {
+		return false
+	}
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		etag := strings.TrimPrefix(strings.TrimSpace(headers.Get("ETag")), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(headers.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.After(since)
+}
+
+// writeNotModified отвечает 304 с валидаторами и заголовками кеширования ответа, без тела.
+// cached - запись кеша, из которой взят ответ (nil, если ответ только что получен от сервера)
+func writeNotModified(w http.ResponseWriter, headers http.Header, cached *CacheEntry) {
+	for _, name := range []string{"ETag", "Last-Modified", "Cache-Control", "Expires", "Vary", "Content-Location", "Date"} {
+		if values, ok := headers[name]; ok {
+			w.Header()[name] = append([]string(nil), values...)
+		}
+	}
+	if cached != nil {
+		w.Header().Set("X-Cache", "HIT")
+		w.Header().Set("X-Cache-Expires", cached.ExpiresAt.Format(time.RFC3339))
+	}
+	w.WriteHeader(http.StatusNotModified)
+	atomic.AddInt64(&cacheNotModified, 1)
+	log.Printf("✅ Запрос завершен (304)\n")
+}
+
+// logCachedBody логирует кешированное тело с обрезанием
+func logCachedBody(settings *LogSettings, prefix string, body []byte, contentType string, headers http.Header) {
+	if len(body) == 0 {
+		log.Printf("%s: [Empty]", prefix)
+		return
+	}
+
+	decompressedBody := decompressIfNeeded(body, headers)
+
+	// Всегда обрезаем для кешированных ответов
+	maxLen := settings.MaxLogLength
+	if maxLen == 0 {
+		maxLen = 2000
+	}
+
+	if utf8.Valid(decompressedBody) {
+		text := string(decompressedBody)
+		if len(text) > maxLen {
+			log.Printf("%s: %s... [truncated, total: %d bytes]", prefix, text[:maxLen], len(text))
+		} else {
+			log.Printf("%s: %s", prefix, text)
+		}
+	} else {
+		log.Printf("%s: [Non-UTF8 data, %d bytes]", prefix, len(decompressedBody))
+		logHexDump(prefix, body)
+	}
+}
+
+// cloneHeaders создает копию заголовков
+func cloneHeaders(headers http.Header) http.Header {
+	clone := make(http.Header)
+	for key, values := range headers {
+		clone[key] = append([]string(nil), values...)
+	}
+	return clone
+}
+
+// getCacheSize возвращает количество записей в кеше
+func getCacheSize() int {
+	size := 0
+	responseCache.Range(func(key, value interface{}) bool {
+		size++
+		return true
+	})
+	return size
+}
+
+// matchURLPattern проверяет соответствие URL паттерну с поддержкой wildcard (*)
+func matchURLPattern(urlStr string, pattern string) bool {
+	// Экранируем специальные символы regex кроме *
+	pattern = regexp.QuoteMeta(pattern)
+	// Заменяем \* (экранированную звездочку) на .*
+	pattern = strings.ReplaceAll(pattern, "\\*", ".*")
+	// Добавляем ^ и $ для полного совпадения
+	pattern = "^" + pattern + "$"
+
+	matched, err := regexp.MatchString(pattern, urlStr)
+	if err != nil {
+		log.Printf("⚠️  Ошибка проверки паттерна '%s': %v", pattern, err)
+		return false
+	}
+	return matched
+}
+
+// shouldCache проверяет, нужно ли кешировать данный URL
+func (settings *CacheSettings) shouldCache(urlStr string) bool {
+	if settings.isExcluded(urlStr) {
+		return false
+	}
+
+	// Если паттерны не заданы - кешируем все
+	if len(settings.URLPatterns) == 0 {
+		return true
+	}
+
+	// Проверяем соответствие хотя бы одному паттерну
+	for _, pattern := range settings.URLPatterns {
+		if matchURLPattern(urlStr, pattern) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isExcluded проверяет CACHE_EXCLUDE_PATTERNS по полному URL и по пути (с query и без)
+func (settings *CacheSettings) isExcluded(urlStr string) bool {
+	if len(settings.ExcludePatterns) == 0 {
+		return false
+	}
+	for _, pattern := range settings.ExcludePatterns {
+		if matchURLPattern(urlStr, pattern) {
+			return true
+		}
+	}
+	if parsed, err := url.Parse(urlStr); err == nil {
+		return isExcludedURL(parsed.RequestURI(), settings.ExcludePatterns)
+	}
+	return false
+}
+
+// cachePersistenceWorker периодически сохраняет кеш на диск при изменениях
+func cachePersistenceWorker() {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// Проверяем, был ли изменен кеш
+		if atomic.LoadInt32(&cacheModified) == 1 {
+			atomic.StoreInt32(&cacheModified, 0) // Сбрасываем флаг до записи: изменения во время записи попадут в следующую
+			if err := persistCache(); err != nil {
+				log.Printf("⚠️  Ошибка сохранения кеша: %v", err)
+			}
+		}
+	}
+}
+
+// CacheSnapshot структура для сериализации кеша
+type CacheSnapshot struct {
+	Entries   map[string]*CacheEntry
+	SavedAt   time.Time
+	CacheHits int64
+	CacheMiss int64
+}
+
+// saveCacheToDisk сохраняет кеш на диск в формате gob + gzip
+func saveCacheToDisk() error {
+	snapshot := CacheSnapshot{
+		Entries:   make(map[string]*CacheEntry),
+		SavedAt:   time.Now(),
+		CacheHits: atomic.LoadInt64(&cacheHits),
+		CacheMiss: atomic.LoadInt64(&cacheMisses),
+	}
+
+	// Собираем все записи из sync.Map
+	count := 0
+	responseCache.Range(func(key, value interface{}) bool {
+		keyStr := key.(string)
+		entry := value.(*CacheEntry)
+
+		// Сохраняем только актуальные записи
+		if time.Now().Before(entry.ExpiresAt) {
+			snapshot.Entries[keyStr] = entry
+			count++
+		}
+		return true
+	})
+
+	if count == 0 {
+		// Если нет актуальных записей, удаляем файл
+		if _, err := os.Stat(cachePersistFile); err == nil {
+			os.Remove(cachePersistFile)
+			log.Printf("🗑️  Файл кеша удален (нет актуальных записей)")
+		}
+		return nil
+	}
+
+	// Кодируем в gob
+	var gobBuf bytes.Buffer
+	encoder := gob.NewEncoder(&gobBuf)
+	if err := encoder.Encode(snapshot); err != nil {
+		return err
+	}
+
+	// Сжимаем с помощью gzip (используем существующую функцию)
+	gzipData, err := compressGzip(gobBuf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	// Сохраняем в файл
+	if err := os.WriteFile(cachePersistFile, gzipData, 0644); err != nil {
+		return err
+	}
+
+	log.Printf("💾 Кеш сохранен на диск: %d записей (gob: %d bytes, gzip: %d bytes)",
+		count, gobBuf.Len(), len(gzipData))
+	return nil
+}
+
+// loadCacheFromDisk загружает кеш из файла (gob + gzip)
+func loadCacheFromDisk() {
+	// Проверяем существование файла
+	if _, err := os.Stat(cachePersistFile); os.IsNotExist(err) {
+		log.Printf("📂 Файл кеша не найден: %s", cachePersistFile)
+		return
+	}
+
+	// Читаем файл
+	gzipData, err := os.ReadFile(cachePersistFile)
+	if err != nil {
+		log.Printf("⚠️  Ошибка чтения файла кеша: %v", err)
+		return
+	}
+
+	// Распаковываем gzip (используем существующую функцию)
+	gobData, err := decompressGzip(gzipData)
+	if err != nil {
+		log.Printf("⚠️  Ошибка распаковки gzip: %v", err)
+		return
+	}
+
+	// Декодируем gob
+	var snapshot CacheSnapshot
+	decoder := gob.NewDecoder(bytes.NewReader(gobData))
+	if err := decoder.Decode(&snapshot); err != nil {
+		log.Printf("⚠️  Ошибка декодирования gob: %v", err)
+		return
+	}
+
+	// Загружаем записи
+	loaded := 0
+	expired := 0
+	now := time.Now()
+
+	for key, entry := range snapshot.Entries {
+		// Проверяем актуальность записи
+		if now.Before(entry.ExpiresAt) {
+			// Записи старых версий без пространства переносятся в default
+			if entry.Namespace == "" {
+				entry.Namespace = "default"
+				key = namespacedCacheKey(entry.Namespace, key)
+			}
+			responseCache.Store(key, entry)
+			loaded++
+		} else {
+			expired++
+		}
+	}
+
+	// Восстанавливаем статистику
+	if loaded > 0 {
+		atomic.StoreInt64(&cacheHits, snapshot.CacheHits)
+		atomic.StoreInt64(&cacheMisses, snapshot.CacheMiss)
+	}
+
+	log.Printf("✅ Кеш восстановлен из файла: %s", cachePersistFile)
+	log.Printf("   Загружено записей: %d", loaded)
+	if expired > 0 {
+		log.Printf("   Пропущено устаревших: %d", expired)
+	}
+	log.Printf("   Сохранен: %s", snapshot.SavedAt.Format("2006-01-02 15:04:05"))
+	log.Printf("   Статистика: hits=%d, misses=%d", snapshot.CacheHits, snapshot.CacheMiss)
+	log.Printf("   Размер файла: gzip=%d bytes, распаковано gob=%d bytes", len(gzipData), len(gobData))
+}
+
+// ProtobufSettings настройки декодирования protobuf тел
+type ProtobufSettings struct {
+	Enabled         bool
+	DescriptorFiles []string              // Файлы FileDescriptorSet (protoc --descriptor_set_out --include_imports)
+	RequestTypes    []ProtobufTypeMapping // Типы сообщений запросов для application/x-protobuf
+	ResponseTypes   []ProtobufTypeMapping // Типы сообщений ответов для application/x-protobuf
+}
+
+// ProtobufTypeMapping сопоставление паттерна URL с типом сообщения
+type ProtobufTypeMapping struct {
+	Pattern     string // Паттерн пути с поддержкой wildcard *
+	MessageType string // Полное имя сообщения, например "shop.v1.Item"
+}
+
+// protoMessage описание сообщения из дескриптора
+type protoMessage struct {
+	name     string
+	fields   []*protoField
+	byNumber map[int]*protoField
+	byName   map[string]*protoField
+	mapEntry bool
+}
+
+// protoField описание поля сообщения из дескриптора
+type protoField struct {
+	name     string
+	number   int
+	label    int
+	typ      int
+	typeName string
+}
+
+// protoEnum описание enum из дескриптора
+type protoEnum struct {
+	byNumber map[int32]string
+	byName   map[string]int32
+}
+
+// protoWireField поле protobuf в wire формате
+type protoWireField struct {
+	number   int
+	wireType int
+	varint   uint64 // Значение для varint, fixed32 и fixed64
+	data     []byte // Значение для length-delimited
+}
+
+// Типы полей и метки из descriptor.proto
+const (
+	protoTypeDouble   = 1
+	protoTypeFloat    = 2
+	protoTypeInt64    = 3
+	protoTypeUint64   = 4
+	protoTypeInt32    = 5
+	protoTypeFixed64  = 6
+	protoTypeFixed32  = 7
+	protoTypeBool     = 8
+	protoTypeString   = 9
+	protoTypeMessage  = 11
+	protoTypeBytes    = 12
+	protoTypeUint32   = 13
+	protoTypeEnum     = 14
+	protoTypeSfixed32 = 15
+	protoTypeSfixed64 = 16
+	protoTypeSint32   = 17
+	protoTypeSint64   = 18
+
+	protoLabelRepeated = 3
+)
+
+var protobufSettings ProtobufSettings
+var protoMessages = make(map[string]*protoMessage) // полное имя -> сообщение
+var protoEnums = make(map[string]*protoEnum)       // полное имя -> enum
+var protoMethods = make(map[string][2]string)      // "/pkg.Service/Method" -> [input, output]
+
+func setupProtobufSettings() {
+	descriptors := os.Getenv("PROTOBUF_DESCRIPTORS")
+	if descriptors == "" {
+		protobufSettings.Enabled = false
+		return
+	}
+
+	for _, file := range strings.Split(descriptors, ",") {
+		if file = strings.TrimSpace(file); file != "" {
+			protobufSettings.DescriptorFiles = append(protobufSettings.DescriptorFiles, file)
+		}
+	}
+	protobufSettings.RequestTypes = parseProtobufTypeMappings(os.Getenv("PROTOBUF_REQUEST_TYPES"))
+	protobufSettings.ResponseTypes = parseProtobufTypeMappings(os.Getenv("PROTOBUF_RESPONSE_TYPES"))
+
+	for _, file := range protobufSettings.DescriptorFiles {
+		if err := loadProtobufDescriptorSet(file); err != nil {
+			log.Printf("⚠️  Ошибка загрузки дескрипторов protobuf %s: %v", file, err)
+		}
+	}
+	protobufSettings.Enabled = true
+}
+
+// parseProtobufTypeMappings разбирает список вида "/api/items*=shop.ItemList,/api/user=shop.User"
+func parseProtobufTypeMappings(value string) []ProtobufTypeMapping {
+	var mappings []ProtobufTypeMapping
+	if value == "" {
+		return mappings
+	}
+
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			log.Printf("⚠️  Неверный формат сопоставления типа protobuf: %s", item)
+			continue
+		}
+		mappings = append(mappings, ProtobufTypeMapping{
+			Pattern:     strings.TrimSpace(parts[0]),
+			MessageType: strings.TrimPrefix(strings.TrimSpace(parts[1]), "."),
+		})
+	}
+	return mappings
+}
+
+func printProtobufSettings() {
+	log.Printf("🧬 Декодирование protobuf:")
+	if protobufSettings.Enabled {
+		log.Printf("   Enabled: ✅")
+		log.Printf("   Descriptor Files: %v", protobufSettings.DescriptorFiles)
+		log.Printf("   Сообщений: %d, enum: %d, gRPC методов: %d", len(protoMessages), len(protoEnums), len(protoMethods))
+		for _, mapping := range protobufSettings.RequestTypes {
+			log.Printf("   Request %s -> %s", mapping.Pattern, mapping.MessageType)
+		}
+		for _, mapping := range protobufSettings.ResponseTypes {
+			log.Printf("   Response %s -> %s", mapping.Pattern, mapping.MessageType)
+		}
+	} else {
+		log.Printf("   Enabled: ❌")
+	}
+	log.Printf("")
+	log.Printf("🔧 Переменные окружения для protobuf:")
+	log.Printf("   - PROTOBUF_DESCRIPTORS=api.pb - файлы FileDescriptorSet через запятую")
+	log.Printf("   - PROTOBUF_REQUEST_TYPES=/api/items*=shop.ItemQuery - типы запросов для application/x-protobuf")
+	log.Printf("   - PROTOBUF_RESPONSE_TYPES=/api/items*=shop.ItemList - типы ответов для application/x-protobuf")
+	log.Printf("")
+}
+
+// loadProtobufDescriptorSet загружает сообщения, enum и сервисы из FileDescriptorSet
+func loadProtobufDescriptorSet(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	fields, err := protoParseFields(data)
+	if err != nil {
+		return err
+	}
+
+	files := 0
+	for _, f := range fields {
+		// FileDescriptorSet.file = 1
+		if f.number == 1 && f.wireType == 2 {
+			if err := parseProtoFileDescriptor(f.data); err != nil {
+				return err
+			}
+			files++
+		}
+	}
+
+	log.Printf("🧬 Загружены дескрипторы protobuf: %s (%d файлов)", file, files)
+	return nil
+}
+
+// parseProtoFileDescriptor разбирает FileDescriptorProto
+func parseProtoFileDescriptor(data []byte) error {
+	fields, err := protoParseFields(data)
+	if err != nil {
+		return err
+	}
+
+	// Сначала ищем package, он может идти после сообщений
+	pkg := ""
+	for _, f := range fields {
+		if f.number == 2 && f.wireType == 2 {
+			pkg = string(f.data)
+		}
+	}
+
+	for _, f := range fields {
+		if f.wireType != 2 {
+			continue
+		}
+		var err error
+		switch f.number {
+		case 4: // message_type
+			err = parseProtoMessageDescriptor(f.data, pkg)
+		case 5: // enum_type
+			err = parseProtoEnumDescriptor(f.data, pkg)
+		case 6: // service
+			err = parseProtoServiceDescriptor(f.data, pkg)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseProtoMessageDescriptor разбирает DescriptorProto вместе с вложенными типами
+func parseProtoMessageDescriptor(data []byte, scope string) error {
+	fields, err := protoParseFields(data)
+	if err != nil {
+		return err
+	}
+
+	msg := &protoMessage{
+		byNumber: make(map[int]*protoField),
+		byName:   make(map[string]*protoField),
+	}
+	for _, f := range fields {
+		if f.number == 1 && f.wireType == 2 {
+			msg.name = protoJoinName(scope, string(f.data))
+		}
+	}
+
+	for _, f := range fields {
+		if f.wireType != 2 {
+			continue
+		}
+		switch f.number {
+		case 2: // field
+			field, err := parseProtoFieldDescriptor(f.data)
+			if err != nil {
+				return err
+			}
+			msg.fields = append(msg.fields, field)
+			msg.byNumber[field.number] = field
+			msg.byName[field.name] = field
+		case 3: // nested_type
+			if err := parseProtoMessageDescriptor(f.data, msg.name); err != nil {
+				return err
+			}
+		case 4: // enum_type
+			if err := parseProtoEnumDescriptor(f.data, msg.name); err != nil {
+				return err
+			}
+		case 7: // options
+			options, err := protoParseFields(f.data)
+			if err != nil {
+				return err
+			}
+			for _, option := range options {
+				// MessageOptions.map_entry = 7
+				if option.number == 7 && option.wireType == 0 {
+					msg.mapEntry = option.varint != 0
+				}
+			}
+		}
+	}
+
+	protoMessages[msg.name] = msg
+	return nil
+}
+
+// parseProtoFieldDescriptor разбирает FieldDescriptorProto
+func parseProtoFieldDescriptor(data []byte) (*protoField, error) {
+	fields, err := protoParseFields(data)
+	if err != nil {
+		return nil, err
+	}
+
+	field := &protoField{}
+	for _, f := range fields {
+		switch {
+		case f.number == 1 && f.wireType == 2:
+			field.name = string(f.data)
+		case f.number == 3 && f.wireType == 0:
+			field.number = int(f.varint)
+		case f.number == 4 && f.wireType == 0:
+			field.label = int(f.varint)
+		case f.number == 5 && f.wireType == 0:
+			field.typ = int(f.varint)
+		case f.number == 6 && f.wireType == 2:
+			field.typeName = strings.TrimPrefix(string(f.data), ".")
+		}
+	}
+	return field, nil
+}
+
+// parseProtoEnumDescriptor разбирает EnumDescriptorProto
+func parseProtoEnumDescriptor(data []byte, scope string) error {
+	fields, err := protoParseFields(data)
+	if err != nil {
+		return err
+	}
+
+	enum := &protoEnum{
+		byNumber: make(map[int32]string),
+		byName:   make(map[string]int32),
+	}
+	name := ""
+	for _, f := range fields {
+		if f.wireType != 2 {
+			continue
+		}
+		switch f.number {
+		case 1:
+			name = protoJoinName(scope, string(f.data))
+		case 2: // value
+			values, err := protoParseFields(f.data)
+			if err != nil {
+				return err
+			}
+			valueName := ""
+			var valueNumber int32
+			for _, v := range values {
+				if v.number == 1 && v.wireType == 2 {
+					valueName = string(v.data)
+				} else if v.number == 2 && v.wireType == 0 {
+					valueNumber = int32(v.varint)
+				}
+			}
+			if _, exists := enum.byNumber[valueNumber]; !exists {
+				enum.byNumber[valueNumber] = valueName
+			}
+			enum.byName[valueName] = valueNumber
+		}
+	}
+
+	protoEnums[name] = enum
+	return nil
+}
+
+// parseProtoServiceDescriptor разбирает ServiceDescriptorProto для определения типов gRPC методов
+func parseProtoServiceDescriptor(data []byte, pkg string) error {
+	fields, err := protoParseFields(data)
+	if err != nil {
+		return err
+	}
+
+	service := ""
+	for _, f := range fields {
+		if f.number == 1 && f.wireType == 2 {
+			service = protoJoinName(pkg, string(f.data))
+		}
+	}
+
+	for _, f := range fields {
+		if f.number != 2 || f.wireType != 2 {
+			continue
+		}
+		methodFields, err := protoParseFields(f.data)
+		if err != nil {
+			return err
+		}
+		var method, input, output string
+		for _, m := range methodFields {
+			if m.wireType != 2 {
+				continue
+			}
+			switch m.number {
+			case 1:
+				method = string(m.data)
+			case 2:
+				input = strings.TrimPrefix(string(m.data), ".")
+			case 3:
+				output = strings.TrimPrefix(string(m.data), ".")
+			}
+		}
+		protoMethods["/"+service+"/"+method] = [2]string{input, output}
+	}
+	return nil
+}
+
+func protoJoinName(scope, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + "." + name
+}
+
+// protoReadVarint читает varint и возвращает значение и количество прочитанных байт
+func protoReadVarint(data []byte) (uint64, int, error) {
+	var value uint64
+	for i := 0; i < len(data) && i < 10; i++ {
+		value |= uint64(data[i]&0x7f) << (7 * uint(i))
+		if data[i] < 0x80 {
+			return value, i + 1, nil
+		}
+	}
+	return 0, 0, io.ErrUnexpectedEOF
+}
+
+// protoParseFields разбирает сообщение protobuf на поля в wire формате
+func protoParseFields(data []byte) ([]protoWireField, error) {
+	var fields []protoWireField
+
+	for len(data) > 0 {
+		key, n, err := protoReadVarint(data)
+		if err != nil {
+			return nil, err
+		}
+		data = data[n:]
+
+		field := protoWireField{number: int(key >> 3), wireType: int(key & 7)}
+		if field.number <= 0 {
+			return nil, errors.New("неверный номер поля protobuf")
+		}
+
+		switch field.wireType {
+		case 0:
+			field.varint, n, err = protoReadVarint(data)
+			if err != nil {
+				return nil, err
+			}
+			data = data[n:]
+		case 1:
+			if len(data) < 8 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			field.varint = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case 2:
+			length, n, err := protoReadVarint(data)
+			if err != nil {
+				return nil, err
+			}
+			data = data[n:]
+			if length > uint64(len(data)) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			field.data = data[:length]
+			data = data[length:]
+		case 5:
+			if len(data) < 4 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			field.varint = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		default:
+			return nil, fmt.Errorf("неподдерживаемый wire type %d", field.wireType)
+		}
+
+		fields = append(fields, field)
+	}
+
+	return fields, nil
+}
+
+// isProtobufContent проверяет, является ли контент protobuf или gRPC
+func isProtobufContent(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	switch mediaType {
+	case "application/x-protobuf", "application/protobuf", "application/x-google-protobuf", "application/vnd.google.protobuf":
+		return true
+	}
+	return isGRPCContent(contentType)
+}
+
+// isGRPCContent проверяет, является ли контент gRPC (бинарный protobuf с фреймами)
+func isGRPCContent(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	return mediaType == "application/grpc" || mediaType == "application/grpc+proto" ||
+		mediaType == "application/grpc-web" || mediaType == "application/grpc-web+proto"
+}
+
+// resolveProtobufType определяет тип сообщения по пути запроса
+func resolveProtobufType(urlPath, contentType string, isResponse bool) string {
+	if isGRPCContent(contentType) {
+		if types, ok := protoMethods[urlPath]; ok {
+			if isResponse {
+				return types[1]
+			}
+			return types[0]
+		}
+		return ""
+	}
+
+	mappings := protobufSettings.RequestTypes
+	if isResponse {
+		mappings = protobufSettings.ResponseTypes
+	}
+	for _, mapping := range mappings {
+		if matchURLPattern(urlPath, mapping.Pattern) {
+			return mapping.MessageType
+		}
+	}
+	return ""
+}
+
+// grpcFrame фрейм тела gRPC: флаги, данные в том виде, в котором они переданы, и распакованное сообщение
+type grpcFrame struct {
+	flags   byte
+	data    []byte
+	message []byte
+}
+
+// isTrailer фрейм трейлеров gRPC-Web (флаг 0x80) - содержит заголовки, а не protobuf
+func (f grpcFrame) isTrailer() bool {
+	return f.flags&0x80 != 0
+}
+
+// splitGRPCFrames разбирает тело gRPC на фреймы (1 байт флагов + 4 байта длины)
+func splitGRPCFrames(body []byte) ([]grpcFrame, error) {
+	var frames []grpcFrame
+	for len(body) > 0 {
+		if len(body) < 5 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		frame := grpcFrame{flags: body[0]}
+		length := binary.BigEndian.Uint32(body[1:5])
+		body = body[5:]
+		if uint64(length) > uint64(len(body)) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		frame.data = body[:length]
+		frame.message = frame.data
+		body = body[length:]
+
+		if !frame.isTrailer() && frame.flags&0x01 != 0 {
+			decompressed, err := decompressGzip(frame.data)
+			if err != nil {
+				return nil, fmt.Errorf("сжатое gRPC сообщение: %v", err)
+			}
+			frame.message = decompressed
+		}
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
+
+// joinGRPCFrames собирает тело gRPC из фреймов
+func joinGRPCFrames(frames []grpcFrame) []byte {
+	var buf bytes.Buffer
+	for _, frame := range frames {
+		header := make([]byte, 5)
+		header[0] = frame.flags
+		binary.BigEndian.PutUint32(header[1:], uint32(len(frame.data)))
+		buf.Write(header)
+		buf.Write(frame.data)
+	}
+	return buf.Bytes()
+}
+
+// decodeProtobufBody декодирует protobuf или gRPC тело в структуру для JSON
+func decodeProtobufBody(body []byte, contentType, messageType string) (interface{}, error) {
+	if !isGRPCContent(contentType) {
+		return decodeProtobufMessage(body, messageType)
+	}
+
+	frames, err := splitGRPCFrames(body)
+	if err != nil {
+		return nil, err
+	}
+	decoded := make([]interface{}, 0, len(frames))
+	for _, frame := range frames {
+		// Фреймы трейлеров gRPC-Web не содержат protobuf
+		if frame.isTrailer() {
+			continue
+		}
+		value, err := decodeProtobufMessage(frame.message, messageType)
+		if err != nil {
+			return nil, err
+		}
+		decoded = append(decoded, value)
+	}
+	if len(decoded) == 1 {
+		return decoded[0], nil
+	}
+	return decoded, nil
+}
+
+// decodeProtobufMessage декодирует сообщение по дескриптору или без схемы, если тип неизвестен
+func decodeProtobufMessage(data []byte, messageType string) (map[string]interface{}, error) {
+	if msg := protoMessages[messageType]; msg != nil {
+		return protoDecodeTyped(data, msg, 0, false)
+	}
+	return protoDecodeRaw(data, 0)
+}
+
+// protoUnknownKey ключ JSON представления с исходными байтами неизвестных полей (base64 wire формата):
+// protoEncodeTyped дописывает их в сообщение без изменений. Имена полей .proto не содержат "$"
+const protoUnknownKey = "$unknown"
+
+// protoDecodeTyped декодирует сообщение по дескриптору; depth ограничивает вложенность
+// (binaryMaxDepth), keepUnknown сохраняет байты неизвестных полей под protoUnknownKey
+func protoDecodeTyped(data []byte, msg *protoMessage, depth int, keepUnknown bool) (map[string]interface{}, error) {
+	if depth > binaryMaxDepth {
+		return nil, errors.New("слишком глубокая вложенность")
+	}
+	fields, err := protoParseFields(data)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]interface{})
+	var unknown []byte
+	for _, wf := range fields {
+		field := msg.byNumber[wf.number]
+		if field == nil {
+			// Неизвестное поле - показываем по номеру
+			result[strconv.Itoa(wf.number)] = protoRawValue(wf, depth+1)
+			if keepUnknown {
+				unknown = protoAppendWireField(unknown, wf)
+			}
+			continue
+		}
+
+		// map<K, V> кодируется как repeated сообщение с полями key = 1 и value = 2
+		if entryMsg := protoMessages[field.typeName]; field.typ == protoTypeMessage && entryMsg != nil && entryMsg.mapEntry {
+			entry, err := protoDecodeTyped(wf.data, entryMsg, depth+1, keepUnknown)
+			if err != nil {
+				return nil, err
+			}
+			m, _ := result[field.name].(map[string]interface{})
+			if m == nil {
+				m = make(map[string]interface{})
+				result[field.name] = m
+			}
+			key := ""
+			if k, ok := entry["key"]; ok {
+				key = fmt.Sprint(k)
+			}
+			m[key] = entry["value"]
+			continue
+		}
+
+		values, err := protoDecodeFieldValues(wf, field, depth, keepUnknown)
+		if err != nil {
+			return nil, fmt.Errorf("поле %s: %v", field.name, err)
+		}
+		if field.label == protoLabelRepeated {
+			existing, _ := result[field.name].([]interface{})
+			result[field.name] = append(existing, values...)
+		} else if len(values) > 0 {
+			result[field.name] = values[len(values)-1]
+		}
+	}
+	if len(unknown) > 0 {
+		result[protoUnknownKey] = base64.StdEncoding.EncodeToString(unknown)
+	}
+	return result, nil
+}
+
+// protoDecodeFieldValues декодирует значение поля (для packed полей - несколько значений)
+func protoDecodeFieldValues(wf protoWireField, field *protoField, depth int, keepUnknown bool) ([]interface{}, error) {
+	packable := field.typ != protoTypeString && field.typ != protoTypeBytes && field.typ != protoTypeMessage
+	if wf.wireType != 2 || !packable {
+		value, err := protoDecodeScalar(wf, field, depth, keepUnknown)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{value}, nil
+	}
+
+	// Packed repeated поле
+	var values []interface{}
+	data := wf.data
+	for len(data) > 0 {
+		element := protoWireField{number: wf.number}
+		switch field.typ {
+		case protoTypeDouble, protoTypeFixed64, protoTypeSfixed64:
+			if len(data) < 8 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			element.wireType = 1
+			element.varint = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case protoTypeFloat, protoTypeFixed32, protoTypeSfixed32:
+			if len(data) < 4 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			element.wireType = 5
+			element.varint = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		default:
+			v, n, err := protoReadVarint(data)
+			if err != nil {
+				return nil, err
+			}
+			element.varint = v
+			data = data[n:]
+		}
+		value, err := protoDecodeScalar(element, field, depth, keepUnknown)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// protoDecodeScalar декодирует одиночное значение поля по его типу
+func protoDecodeScalar(wf protoWireField, field *protoField, depth int, keepUnknown bool) (interface{}, error) {
+	v := wf.varint
+	switch field.typ {
+	case protoTypeDouble:
+		return jsonSafeFloat(math.Float64frombits(v)), nil
+	case protoTypeFloat:
+		return jsonSafeFloat(float64(math.Float32frombits(uint32(v)))), nil
+	case protoTypeInt64, protoTypeSfixed64:
+		return int64(v), nil
+	case protoTypeUint64, protoTypeFixed64:
+		return v, nil
+	case protoTypeInt32, protoTypeSfixed32:
+		return int32(v), nil
+	case protoTypeUint32, protoTypeFixed32:
+		return uint32(v), nil
+	case protoTypeBool:
+		return v != 0, nil
+	case protoTypeSint32:
+		return int32(uint32(v>>1) ^ -uint32(v&1)), nil
+	case protoTypeSint64:
+		return int64(v>>1) ^ -int64(v&1), nil
+	case protoTypeEnum:
+		if enum := protoEnums[field.typeName]; enum != nil {
+			if name, ok := enum.byNumber[int32(v)]; ok {
+				return name, nil
+			}
+		}
+		return int32(v), nil
+	case protoTypeString:
+		return string(wf.data), nil
+	case protoTypeBytes:
+		return base64.StdEncoding.EncodeToString(wf.data), nil
+	case protoTypeMessage:
+		if msg := protoMessages[field.typeName]; msg != nil {
+			return protoDecodeTyped(wf.data, msg, depth+1, keepUnknown)
+		}
+		return protoDecodeRaw(wf.data, depth+1)
+	}
+	return nil, fmt.Errorf("неподдерживаемый тип поля %d", field.typ)
+}
+
+// protoDecodeRaw декодирует сообщение без схемы (ключи - номера полей); depth ограничивает вложенность
+func protoDecodeRaw(data []byte, depth int) (map[string]interface{}, error) {
+	if depth > binaryMaxDepth {
+		return nil, errors.New("слишком глубокая вложенность")
+	}
+	fields, err := protoParseFields(data)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]interface{})
+	for _, wf := range fields {
+		key := strconv.Itoa(wf.number)
+		value := protoRawValue(wf, depth+1)
+		if existing, ok := result[key]; ok {
+			if list, isList := existing.([]interface{}); isList {
+				result[key] = append(list, value)
+			} else {
+				result[key] = []interface{}{existing, value}
+			}
+		} else {
+			result[key] = value
+		}
+	}
+	return result, nil
+}
+
+// protoRawValue угадывает представление значения без схемы; слишком глубоко вложенное
+// сообщение показывается в base64
+func protoRawValue(wf protoWireField, depth int) interface{} {
+	if wf.wireType != 2 {
+		return wf.varint
+	}
+	if utf8.Valid(wf.data) && isPrintableText(wf.data) {
+		return string(wf.data)
+	}
+	if nested, err := protoDecodeRaw(wf.data, depth); err == nil && len(nested) > 0 {
+		return nested
+	}
+	return base64.StdEncoding.EncodeToString(wf.data)
+}
+
+// isPrintableText проверяет, что в тексте нет управляющих символов (кроме пробельных)
+func isPrintableText(data []byte) bool {
+	for _, r := range string(data) {
+		if r < 0x20 && r != '\n' && r != '\r' && r != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// protoEncodeTyped кодирует JSON объект в сообщение по дескриптору. Неизвестные поля берутся
+// в исходном виде из protoUnknownKey; их представление по номерам не кодируется
+func protoEncodeTyped(value map[string]interface{}, msg *protoMessage) ([]byte, error) {
+	var buf []byte
+	for _, field := range msg.fields {
+		fieldValue, ok := value[field.name]
+		if !ok || fieldValue == nil {
+			continue
+		}
+
+		// map<K, V>
+		if entryMsg := protoMessages[field.typeName]; field.typ == protoTypeMessage && entryMsg != nil && entryMsg.mapEntry {
+			object, ok := fieldValue.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("поле %s: ожидался объект", field.name)
+			}
+			keys := make([]string, 0, len(object))
+			for key := range object {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				entry, err := protoEncodeTyped(map[string]interface{}{"key": key, "value": object[key]}, entryMsg)
+				if err != nil {
+					return nil, fmt.Errorf("поле %s: %v", field.name, err)
+				}
+				buf = protoAppendBytes(buf, field.number, entry)
+			}
+			continue
+		}
+
+		values := []interface{}{fieldValue}
+		if field.label == protoLabelRepeated {
+			list, ok := fieldValue.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("поле %s: ожидался массив", field.name)
+			}
+			values = list
+		}
+
+		for _, v := range values {
+			var err error
+			buf, err = protoAppendValue(buf, field, v)
+			if err != nil {
+				return nil, fmt.Errorf("поле %s: %v", field.name, err)
+			}
+		}
+	}
+	if unknown, ok := value[protoUnknownKey].(string); ok {
+		data, err := base64.StdEncoding.DecodeString(unknown)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", protoUnknownKey, err)
+		}
+		buf = append(buf, data...)
+	}
+	return buf, nil
+}
+
+// protoAppendWireField добавляет разобранное поле в исходном wire формате
+func protoAppendWireField(buf []byte, wf protoWireField) []byte {
+	switch wf.wireType {
+	case 0:
+		buf = protoAppendKey(buf, wf.number, 0)
+		return binary.AppendUvarint(buf, wf.varint)
+	case 1:
+		buf = protoAppendKey(buf, wf.number, 1)
+		return binary.LittleEndian.AppendUint64(buf, wf.varint)
+	case 5:
+		buf = protoAppendKey(buf, wf.number, 5)
+		return binary.LittleEndian.AppendUint32(buf, uint32(wf.varint))
+	}
+	return protoAppendBytes(buf, wf.number, wf.data)
+}
+
+// protoAppendValue добавляет значение поля в wire формате
+func protoAppendValue(buf []byte, field *protoField, value interface{}) ([]byte, error) {
+	switch field.typ {
+	case protoTypeDouble:
+		f, err := protoToFloat(value)
+		if err != nil {
+			return nil, err
+		}
+		buf = protoAppendKey(buf, field.number, 1)
+		return binary.LittleEndian.AppendUint64(buf, math.Float64bits(f)), nil
+	case protoTypeFloat:
+		f, err := protoToFloat(value)
+		if err != nil {
+			return nil, err
+		}
+		buf = protoAppendKey(buf, field.number, 5)
+		return binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(f))), nil
+	case protoTypeFixed64, protoTypeSfixed64:
+		n, err := protoToUint64(value, field.typ == protoTypeSfixed64)
+		if err != nil {
+			return nil, err
+		}
+		buf = protoAppendKey(buf, field.number, 1)
+		return binary.LittleEndian.AppendUint64(buf, n), nil
+	case protoTypeFixed32, protoTypeSfixed32:
+		n, err := protoToUint64(value, field.typ == protoTypeSfixed32)
+		if err != nil {
+			return nil, err
+		}
+		buf = protoAppendKey(buf, field.number, 5)
+		return binary.LittleEndian.AppendUint32(buf, uint32(n)), nil
+	case protoTypeInt64, protoTypeInt32:
+		n, err := protoToUint64(value, true)
+		if err != nil {
+			return nil, err
+		}
+		buf = protoAppendKey(buf, field.number, 0)
+		return binary.AppendUvarint(buf, n), nil
+	case protoTypeUint64, protoTypeUint32:
+		n, err := protoToUint64(value, false)
+		if err != nil {
+			return nil, err
+		}
+		buf = protoAppendKey(buf, field.number, 0)
+		return binary.AppendUvarint(buf, n), nil
+	case protoTypeSint32, protoTypeSint64:
+		n, err := protoToUint64(value, true)
+		if err != nil {
+			return nil, err
+		}
+		signed := int64(n)
+		buf = protoAppendKey(buf, field.number, 0)
+		return binary.AppendUvarint(buf, uint64(signed<<1)^uint64(signed>>63)), nil
+	case protoTypeBool:
+		b, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("ожидался bool, получено %v", value)
+		}
+		var n uint64
+		if b {
+			n = 1
+		}
+		buf = protoAppendKey(buf, field.number, 0)
+		return binary.AppendUvarint(buf, n), nil
+	case protoTypeEnum:
+		var n uint64
+		if name, ok := value.(string); ok {
+			enum := protoEnums[field.typeName]
+			number, found := int32(0), false
+			if enum != nil {
+				number, found = enum.byName[name]
+			}
+			if !found {
+				parsed, err := protoToUint64(name, true)
+				if err != nil {
+					return nil, fmt.Errorf("неизвестное значение enum %s", name)
+				}
+				number = int32(parsed)
+			}
+			n = uint64(int64(number))
+		} else {
+			parsed, err := protoToUint64(value, true)
+			if err != nil {
+				return nil, err
+			}
+			n = parsed
+		}
+		buf = protoAppendKey(buf, field.number, 0)
+		return binary.AppendUvarint(buf, n), nil
+	case protoTypeString:
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("ожидалась строка, получено %v", value)
+		}
+		return protoAppendBytes(buf, field.number, []byte(s)), nil
+	case protoTypeBytes:
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("ожидалась base64 строка, получено %v", value)
+		}
+		data, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return protoAppendBytes(buf, field.number, data), nil
+	case protoTypeMessage:
+		msg := protoMessages[field.typeName]
+		object, ok := value.(map[string]interface{})
+		if msg == nil || !ok {
+			return nil, fmt.Errorf("не удалось закодировать сообщение %s", field.typeName)
+		}
+		data, err := protoEncodeTyped(object, msg)
+		if err != nil {
+			return nil, err
+		}
+		return protoAppendBytes(buf, field.number, data), nil
+	}
+	return nil, fmt.Errorf("неподдерживаемый тип поля %d", field.typ)
+}
+
+func protoAppendKey(buf []byte, number, wireType int) []byte {
+	return binary.AppendUvarint(buf, uint64(number)<<3|uint64(wireType))
+}
+
+func protoAppendBytes(buf []byte, number int, data []byte) []byte {
+	buf = protoAppendKey(buf, number, 2)
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+// protoToUint64 приводит JSON число или строку к целому (знаковые значения в дополнительном коде)
+func protoToUint64(value interface{}, signed bool) (uint64, error) {
+	var s string
+	switch v := value.(type) {
+	case json.Number:
+		s = v.String()
+	case string:
+		s = v
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return 0, fmt.Errorf("ожидалось число, получено %v", value)
+	}
+
+	if signed {
+		n, err := strconv.ParseInt(s, 10, 64)
+		return uint64(n), err
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+// protoToFloat приводит JSON число или строку к float64
+func protoToFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case json.Number:
+		return v.Float64()
+	case string:
+		return strconv.ParseFloat(v, 64)
+	case float64:
+		return v, nil
+	}
+	return 0, fmt.Errorf("ожидалось число, получено %v", value)
+}
+
+// logProtobufBody логирует protobuf тело как JSON, возвращает false если тело не protobuf
+func logProtobufBody(settings *LogSettings, prefix string, body []byte, contentType string, headers http.Header, urlPath string, isResponse bool) bool {
+	if !protobufSettings.Enabled || !isProtobufContent(contentType) || settings.BodyLogMode == "none" || len(body) == 0 {
+		return false
+	}
+
+	messageType := resolveProtobufType(urlPath, contentType, isResponse)
+	decoded, err := decodeProtobufBody(decompressIfNeeded(body, headers), contentType, messageType)
+	if err != nil {
+		log.Printf("⚠️  Не удалось декодировать protobuf: %v", err)
+		return false
+	}
+
+	formatted, err := json.MarshalIndent(decoded, "", "  ")
+	if err != nil {
+		return false
+	}
+
+	if messageType == "" {
+		messageType = "без схемы"
+	}
+	text := string(formatted)
+	if settings.BodyLogMode == "truncate" {
+		text = truncateString(text, settings.MaxLogLength)
+	}
+	log.Printf("%s (protobuf %s):\n%s", prefix, messageType, text)
+	return true
+}
+
+// applyProtobufReplacements применяет замены к JSON представлению protobuf тела и кодирует результат обратно.
+// В gRPC каждое сообщение обрабатывается отдельно: трейлеры gRPC-Web и сообщения, которые не удалось
+// декодировать, передаются без изменений. Возвращает false, если тело не protobuf или его тип неизвестен
+func applyProtobufReplacements(body []byte, contentType, urlPath string, replacements []BodyReplacement) ([]byte, bool) {
+	if !protobufSettings.Enabled || !isProtobufContent(contentType) {
+		return nil, false
+	}
+
+	messageType := resolveProtobufType(urlPath, contentType, true)
+	if protoMessages[messageType] == nil {
+		log.Printf("⚠️  Тип protobuf ответа не определен, замены применяются к бинарным данным")
+		return nil, false
+	}
+	log.Printf("🧬 Замены применяются к JSON представлению %s", messageType)
+
+	if !isGRPCContent(contentType) {
+		encoded, changed, err := replaceProtobufMessage(body, messageType, replacements)
+		if err != nil {
+			log.Printf("⚠️  Замены в protobuf пропущены: %v", err)
+			return body, true
+		}
+		if changed {
+			log.Printf("🧬 Protobuf закодирован обратно: %d -> %d bytes", len(body), len(encoded))
+		}
+		return encoded, true
+	}
+
+	frames, err := splitGRPCFrames(body)
+	if err != nil {
+		log.Printf("⚠️  Замены в gRPC пропущены: %v", err)
+		return body, true
+	}
+	changed := false
+	for i, frame := range frames {
+		if frame.isTrailer() {
+			continue
+		}
+		encoded, frameChanged, err := replaceProtobufMessage(frame.message, messageType, replacements)
+		if err != nil {
+			log.Printf("⚠️  Замены в gRPC сообщении %d пропущены: %v", i+1, err)
+			continue
+		}
+		if frameChanged {
+			// Измененное сообщение передается без сжатия
+			frames[i] = grpcFrame{flags: frame.flags &^ 0x01, data: encoded, message: encoded}
+			changed = true
+		}
+	}
+	if !changed {
+		return body, true
+	}
+	encoded := joinGRPCFrames(frames)
+	log.Printf("🧬 Protobuf закодирован обратно: %d -> %d bytes", len(body), len(encoded))
+	return encoded, true
+}
+
+// replaceProtobufMessage применяет замены к одному сообщению. Если замены не изменили JSON представление,
+// возвращает исходные байты
+func replaceProtobufMessage(message []byte, messageType string, replacements []BodyReplacement) ([]byte, bool, error) {
+	decoded, err := protoDecodeTyped(message, protoMessages[messageType], 0, true)
+	if err != nil {
+		return message, false, fmt.Errorf("не удалось декодировать: %v", err)
+	}
+	jsonBody, err := json.Marshal(decoded)
+	if err != nil {
+		return message, false, err
+	}
+
+	modified := applyBodyReplacements(jsonBody, replacements)
+	if bytes.Equal(modified, jsonBody) {
+		return message, false, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(modified))
+	decoder.UseNumber()
+	var value map[string]interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return message, false, fmt.Errorf("после замен получен невалидный JSON объект: %v", err)
+	}
+
+	encoded, err := protoEncodeTyped(value, protoMessages[messageType])
+	if err != nil {
+		return message, false, fmt.Errorf("не удалось закодировать: %v", err)
+	}
+	return encoded, true, nil
+}
+
+// binaryDecoder читает MessagePack и CBOR данные
+type binaryDecoder struct {
+	data []byte
+	pos  int
+}
+
+// Максимальная глубина вложенности при декодировании MessagePack/CBOR
+const binaryMaxDepth = 256
+
+var errBinaryTruncated = errors.New("неожиданный конец данных")
+
+func (d *binaryDecoder) readByte() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, errBinaryTruncated
+	}
+	b := d.data[d.pos]
+	d.pos++
+	return b, nil
+}
+
+func (d *binaryDecoder) readBytes(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, errBinaryTruncated
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+func (d *binaryDecoder) readUint(size int) (uint64, error) {
+	b, err := d.readBytes(uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+// checkCount защищает от огромных длин массивов и map в поврежденных данных
+func (d *binaryDecoder) checkCount(n uint64) error {
+	if n > uint64(len(d.data)-d.pos) {
+		return errBinaryTruncated
+	}
+	return nil
+}
+
+// isMsgpackContent проверяет, является ли контент MessagePack
+func isMsgpackContent(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	return mediaType == "application/msgpack" || mediaType == "application/x-msgpack" || mediaType == "application/vnd.msgpack"
+}
+
+// isCBORContent проверяет, является ли контент CBOR
+func isCBORContent(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	return mediaType == "application/cbor"
+}
+
+// decodeBinaryJSON декодирует MessagePack или CBOR тело, возвращает название формата
+func decodeBinaryJSON(body []byte, contentType string) (interface{}, string, error) {
+	d := &binaryDecoder{data: body}
+	var value interface{}
+	var format string
+	var err error
+
+	switch {
+	case isMsgpackContent(contentType):
+		format = "MessagePack"
+		value, err = d.decodeMsgpack(0)
+	case isCBORContent(contentType):
+		format = "CBOR"
+		value, err = d.decodeCBOR(0)
+	default:
+		return nil, "", errors.New("неподдерживаемый формат")
+	}
+
+	if err != nil {
+		return nil, format, err
+	}
+	if d.pos != len(d.data) {
+		return nil, format, fmt.Errorf("лишние данные после значения: %d bytes", len(d.data)-d.pos)
+	}
+	return value, format, nil
+}
+
+// decodeMsgpack декодирует одно значение MessagePack
+func (d *binaryDecoder) decodeMsgpack(depth int) (interface{}, error) {
+	if depth > binaryMaxDepth {
+		return nil, errors.New("слишком глубокая вложенность")
+	}
+
+	b, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case b <= 0x7f: // positive fixint
+		return uint64(b), nil
+	case b >= 0xe0: // negative fixint
+		return int64(int8(b)), nil
+	case b >= 0x80 && b <= 0x8f: // fixmap
+		return d.decodeMsgpackMap(uint64(b&0x0f), depth)
+	case b >= 0x90 && b <= 0x9f: // fixarray
+		return d.decodeMsgpackArray(uint64(b&0x0f), depth)
+	case b >= 0xa0 && b <= 0xbf: // fixstr
+		s, err := d.readBytes(uint64(b & 0x1f))
+		return string(s), err
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6: // bin 8/16/32
+		n, err := d.readUint(1 << (b - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		data, err := d.readBytes(n)
+		return base64.StdEncoding.EncodeToString(data), err
+	case 0xc7, 0xc8, 0xc9: // ext 8/16/32
+		n, err := d.readUint(1 << (b - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMsgpackExt(n)
+	case 0xca:
+		v, err := d.readUint(4)
+		return jsonSafeFloat(float64(math.Float32frombits(uint32(v)))), err
+	case 0xcb:
+		v, err := d.readUint(8)
+		return jsonSafeFloat(math.Float64frombits(v)), err
+	case 0xcc, 0xcd, 0xce, 0xcf: // uint 8/16/32/64
+		return d.readUint(1 << (b - 0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3: // int 8/16/32/64
+		size := 1 << (b - 0xd0)
+		v, err := d.readUint(size)
+		if err != nil {
+			return nil, err
+		}
+		// Расширяем знак
+		shift := uint(64 - size*8)
+		return int64(v<<shift) >> shift, nil
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8: // fixext 1/2/4/8/16
+		return d.decodeMsgpackExt(1 << (b - 0xd4))
+	case 0xd9, 0xda, 0xdb: // str 8/16/32
+		n, err := d.readUint(1 << (b - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.readBytes(n)
+		return string(s), err
+	case 0xdc, 0xdd: // array 16/32
+		n, err := d.readUint(2 << (b - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMsgpackArray(n, depth)
+	case 0xde, 0xdf: // map 16/32
+		n, err := d.readUint(2 << (b - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMsgpackMap(n, depth)
+	}
+
+	return nil, fmt.Errorf("неизвестный байт формата MessagePack: 0x%02x", b)
+}
+
+func (d *binaryDecoder) decodeMsgpackArray(n uint64, depth int) (interface{}, error) {
+	if err := d.checkCount(n); err != nil {
+		return nil, err
+	}
+	array := make([]interface{}, 0, n)
+	for i := uint64(0); i < n; i++ {
+		value, err := d.decodeMsgpack(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		array = append(array, value)
+	}
+	return array, nil
+}
+
+func (d *binaryDecoder) decodeMsgpackMap(n uint64, depth int) (interface{}, error) {
+	if err := d.checkCount(n); err != nil {
+		return nil, err
+	}
+	object := make(map[string]interface{}, n)
+	for i := uint64(0); i < n; i++ {
+		key, err := d.decodeMsgpack(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.decodeMsgpack(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		object[binaryMapKey(key)] = value
+	}
+	return object, nil
+}
+
+// decodeMsgpackExt декодирует ext тип (timestamp -1 как строку RFC3339, остальные как base64)
+func (d *binaryDecoder) decodeMsgpackExt(n uint64) (interface{}, error) {
+	typ, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	data, err := d.readBytes(n)
+	if err != nil {
+		return nil, err
+	}
+
+	if int8(typ) == -1 {
+		var ts time.Time
+		switch len(data) {
+		case 4:
+			ts = time.Unix(int64(binary.BigEndian.Uint32(data)), 0)
+		case 8:
+			v := binary.BigEndian.Uint64(data)
+			ts = time.Unix(int64(v&0x3ffffffff), int64(v>>34))
+		case 12:
+			ts = time.Unix(int64(binary.BigEndian.Uint64(data[4:])), int64(binary.BigEndian.Uint32(data[:4])))
+		}
+		if !ts.IsZero() {
+			return ts.UTC().Format(time.RFC3339Nano), nil
+		}
+	}
+
+	return map[string]interface{}{
+		"ext_type": int8(typ),
+		"data":     base64.StdEncoding.EncodeToString(data),
+	}, nil
+}
+
+// binaryMapKey приводит ключ map к строке для JSON
+func binaryMapKey(key interface{}) string {
+	if s, ok := key.(string); ok {
+		return s
+	}
+	return fmt.Sprint(key)
+}
+
+// jsonSafeFloat заменяет NaN и Inf строками, так как JSON их не поддерживает
+func jsonSafeFloat(f float64) interface{} {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	return f
+}
+
+// encodeMsgpack кодирует JSON значение в MessagePack
+func encodeMsgpack(buf []byte, value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case nil:
+		return append(buf, 0xc0), nil
+	case bool:
+		if v {
+			return append(buf, 0xc3), nil
+		}
+		return append(buf, 0xc2), nil
+	case json.Number:
+		if n, err := strconv.ParseInt(v.String(), 10, 64); err == nil {
+			return encodeMsgpackInt(buf, n), nil
+		}
+		if n, err := strconv.ParseUint(v.String(), 10, 64); err == nil {
+			buf = append(buf, 0xcf)
+			return binary.BigEndian.AppendUint64(buf, n), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, 0xcb)
+		return binary.BigEndian.AppendUint64(buf, math.Float64bits(f)), nil
+	case string:
+		n := len(v)
+		switch {
+		case n < 32:
+			buf = append(buf, 0xa0|byte(n))
+		case n <= math.MaxUint8:
+			buf = append(buf, 0xd9, byte(n))
+		case n <= math.MaxUint16:
+			buf = append(buf, 0xda)
+			buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+		default:
+			buf = append(buf, 0xdb)
+			buf = binary.BigEndian.AppendUint32(buf, uint32(n))
+		}
+		return append(buf, v...), nil
+	case []interface{}:
+		buf = encodeMsgpackArrayHead(buf, len(v))
+		for _, item := range v {
+			var err error
+			if buf, err = encodeMsgpack(buf, item); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case map[string]interface{}:
+		buf = encodeMsgpackMapHead(buf, len(v))
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			var err error
+			if buf, err = encodeMsgpack(buf, key); err != nil {
+				return nil, err
+			}
+			if buf, err = encodeMsgpack(buf, v[key]); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+	return nil, fmt.Errorf("неподдерживаемый тип значения: %T", value)
+}
+
+// encodeMsgpackArrayHead кодирует заголовок массива MessagePack из n элементов
+func encodeMsgpackArrayHead(buf []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(buf, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xdc), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(buf, 0xdd), uint32(n))
+}
+
+// encodeMsgpackMapHead кодирует заголовок map MessagePack из n пар
+func encodeMsgpackMapHead(buf []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(buf, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xde), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(buf, 0xdf), uint32(n))
+}
+
+// encodeMsgpackBinHead кодирует заголовок bin MessagePack длиной n байт
+func encodeMsgpackBinHead(buf []byte, n int) []byte {
+	switch {
+	case n <= math.MaxUint8:
+		return append(buf, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xc5), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(buf, 0xc6), uint32(n))
+}
+
+// encodeMsgpackInt кодирует целое число в минимальном формате
+func encodeMsgpackInt(buf []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n <= 0x7f:
+		return append(buf, byte(n))
+	case n < 0 && n >= -32:
+		return append(buf, byte(n))
+	case n >= 0 && n <= math.MaxUint8:
+		return append(buf, 0xcc, byte(n))
+	case n >= 0 && n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xcd), uint16(n))
+	case n >= 0 && n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xce), uint32(n))
+	case n >= 0:
+		return binary.BigEndian.AppendUint64(append(buf, 0xcf), uint64(n))
+	case n >= math.MinInt8:
+		return append(buf, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xd1), uint16(n))
+	case n >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xd2), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, 0xd3), uint64(n))
+}
+
+// decodeCBOR декодирует одно значение CBOR
+func (d *binaryDecoder) decodeCBOR(depth int) (interface{}, error) {
+	if depth > binaryMaxDepth {
+		return nil, errors.New("слишком глубокая вложенность")
+	}
+
+	b, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	major := b >> 5
+	info := b & 0x1f
+
+	// Простые значения и числа с плавающей точкой
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22, 23: // null, undefined
+			return nil, nil
+		case 25:
+			v, err := d.readUint(2)
+			return jsonSafeFloat(cborHalfToFloat(uint16(v))), err
+		case 26:
+			v, err := d.readUint(4)
+			return jsonSafeFloat(float64(math.Float32frombits(uint32(v)))), err
+		case 27:
+			v, err := d.readUint(8)
+			return jsonSafeFloat(math.Float64frombits(v)), err
+		}
+		if info < 24 {
+			return uint64(info), nil
+		}
+		if info == 24 {
+			v, err := d.readByte()
+			return uint64(v), err
+		}
+		return nil, fmt.Errorf("неподдерживаемое простое значение CBOR: %d", info)
+	}
+
+	// Неопределенная длина для строк, массивов и map
+	if info == 31 {
+		return d.decodeCBORIndefinite(major, depth)
+	}
+
+	n, err := d.readCBORArgument(info)
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case 0:
+		return n, nil
+	case 1:
+		if n > math.MaxInt64 {
+			return nil, errors.New("отрицательное число CBOR вне диапазона int64")
+		}
+		return -1 - int64(n), nil
+	case 2:
+		data, err := d.readBytes(n)
+		return base64.StdEncoding.EncodeToString(data), err
+	case 3:
+		data, err := d.readBytes(n)
+		return string(data), err
+	case 4:
+		if err := d.checkCount(n); err != nil {
+			return nil, err
+		}
+		array := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			value, err := d.decodeCBOR(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		return array, nil
+	case 5:
+		if err := d.checkCount(n); err != nil {
+			return nil, err
+		}
+		object := make(map[string]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			key, err := d.decodeCBOR(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			value, err := d.decodeCBOR(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			object[binaryMapKey(key)] = value
+		}
+		return object, nil
+	case 6:
+		// Теги (даты, bignum и т.д.) не сохраняются - показываем вложенное значение
+		return d.decodeCBOR(depth + 1)
+	}
+
+	return nil, fmt.Errorf("неизвестный major type CBOR: %d", major)
+}
+
+// readCBORArgument читает аргумент (длину или значение) заголовка CBOR
+func (d *binaryDecoder) readCBORArgument(info byte) (uint64, error) {
+	switch {
+	case info < 24:
+		return uint64(info), nil
+	case info <= 27:
+		return d.readUint(1 << (info - 24))
+	}
+	return 0, fmt.Errorf("неверный аргумент CBOR: %d", info)
+}
+
+// decodeCBORIndefinite декодирует строки, массивы и map неопределенной длины (до break 0xff)
+func (d *binaryDecoder) decodeCBORIndefinite(major byte, depth int) (interface{}, error) {
+	isBreak := func() bool {
+		if d.pos < len(d.data) && d.data[d.pos] == 0xff {
+			d.pos++
+			return true
+		}
+		return false
+	}
+
+	switch major {
+	case 2, 3:
+		var buf []byte
+		for !isBreak() {
+			chunk, err := d.decodeCBOR(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			switch c := chunk.(type) {
+			case string:
+				if major == 2 {
+					decoded, _ := base64.StdEncoding.DecodeString(c)
+					buf = append(buf, decoded...)
+				} else {
+					buf = append(buf, c...)
+				}
+			default:
+				return nil, errors.New("неверный фрагмент строки CBOR")
+			}
+		}
+		if major == 2 {
+			return base64.StdEncoding.EncodeToString(buf), nil
+		}
+		return string(buf), nil
+	case 4:
+		array := make([]interface{}, 0)
+		for !isBreak() {
+			value, err := d.decodeCBOR(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		return array, nil
+	case 5:
+		object := make(map[string]interface{})
+		for !isBreak() {
+			key, err := d.decodeCBOR(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			value, err := d.decodeCBOR(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			object[binaryMapKey(key)] = value
+		}
+		return object, nil
+	}
+	return nil, fmt.Errorf("неопределенная длина не поддерживается для major type %d", major)
+}
+
+// cborHalfToFloat преобразует float16 в float64
+func cborHalfToFloat(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var value float64
+	switch exp {
+	case 0:
+		value = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			value = math.Inf(1)
+		} else {
+			value = math.NaN()
+		}
+	default:
+		value = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -value
+	}
+	return value
+}
+
+// encodeCBORHead кодирует заголовок CBOR с major type и аргументом
+func encodeCBORHead(buf []byte, major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return append(buf, major|byte(n))
+	case n <= math.MaxUint8:
+		return append(buf, major|24, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, major|26), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, major|27), n)
+}
+
+// encodeCBOR кодирует JSON значение в CBOR
+func encodeCBOR(buf []byte, value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case nil:
+		return append(buf, 0xf6), nil
+	case bool:
+		if v {
+			return append(buf, 0xf5), nil
+		}
+		return append(buf, 0xf4), nil
+	case json.Number:
+		if n, err := strconv.ParseInt(v.String(), 10, 64); err == nil {
+			if n >= 0 {
+				return encodeCBORHead(buf, 0, uint64(n)), nil
+			}
+			return encodeCBORHead(buf, 1, uint64(-1-n)), nil
+		}
+		if n, err := strconv.ParseUint(v.String(), 10, 64); err == nil {
+			return encodeCBORHead(buf, 0, n), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return binary.BigEndian.AppendUint64(append(buf, 0xfb), math.Float64bits(f)), nil
+	case string:
+		buf = encodeCBORHead(buf, 3, uint64(len(v)))
+		return append(buf, v...), nil
+	case []interface{}:
+		buf = encodeCBORHead(buf, 4, uint64(len(v)))
+		for _, item := range v {
+			var err error
+			if buf, err = encodeCBOR(buf, item); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case map[string]interface{}:
+		buf = encodeCBORHead(buf, 5, uint64(len(v)))
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			buf = encodeCBORHead(buf, 3, uint64(len(key)))
+			buf = append(buf, key...)
+			var err error
+			if buf, err = encodeCBOR(buf, v[key]); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+	return nil, fmt.Errorf("неподдерживаемый тип значения: %T", value)
+}
+
+// applyBinaryJSONReplacements применяет замены к JSON представлению MessagePack/CBOR тела и кодирует результат обратно.
+// Значения, которые замены не изменили, переносятся исходными байтами: float 1.0, float32, bin/ext и теги CBOR
+// сохраняют свой тип. Возвращает false, если тело не MessagePack/CBOR или не декодируется
+func applyBinaryJSONReplacements(body []byte, contentType string, replacements []BodyReplacement) ([]byte, bool) {
+	if !isMsgpackContent(contentType) && !isCBORContent(contentType) {
+		return nil, false
+	}
+
+	root, format, err := decodeBinaryNode(body, contentType)
+	if err != nil {
+		log.Printf("⚠️  Не удалось декодировать %s для замен: %v", format, err)
+		return nil, false
+	}
+	jsonBody, err := json.Marshal(root.view)
+	if err != nil {
+		return nil, false
+	}
+
+	log.Printf("📦 Замены применяются к JSON представлению %s", format)
+	modified := applyBodyReplacements(jsonBody, replacements)
+
+	decoder := json.NewDecoder(bytes.NewReader(modified))
+	decoder.UseNumber()
+	var modifiedValue interface{}
+	if err := decoder.Decode(&modifiedValue); err != nil {
+		log.Printf("⚠️  После замен получен невалидный JSON: %v", err)
+		return nil, false
+	}
+
+	encoded, err := encodeBinaryNode(nil, root, modifiedValue, isCBORContent(contentType))
+	if err != nil {
+		log.Printf("⚠️  Не удалось закодировать %s после замен: %v", format, err)
+		return nil, false
+	}
+	log.Printf("📦 %s закодирован обратно: %d -> %d bytes", format, len(body), len(encoded))
+	return encoded, true
+}
+
+// binaryNode значение MessagePack/CBOR вместе с исходной кодировкой: по нему тело кодируется
+// обратно без потери типов, которых нет в JSON
+type binaryNode struct {
+	raw    []byte        // Исходные байты значения (вместе с тегом CBOR)
+	view   interface{}   // JSON представление, как у decodeBinaryJSON
+	kind   string        // array, map, tag, bin, float32, float; пусто - остальные значения
+	prefix []byte        // Заголовок тега CBOR перед вложенным значением
+	items  []*binaryNode // Элементы массива, значения map или вложенное значение тега
+	keys   []*binaryNode // Ключи map в исходном порядке
+}
+
+// decodeBinaryNode декодирует MessagePack или CBOR тело в дерево binaryNode, возвращает название формата
+func decodeBinaryNode(body []byte, contentType string) (*binaryNode, string, error) {
+	d := &binaryDecoder{data: body}
+	var node *binaryNode
+	var format string
+	var err error
+
+	switch {
+	case isMsgpackContent(contentType):
+		format = "MessagePack"
+		node, err = d.decodeMsgpackNode(0)
+	case isCBORContent(contentType):
+		format = "CBOR"
+		node, err = d.decodeCBORNode(0)
+	default:
+		return nil, "", errors.New("неподдерживаемый формат")
+	}
+
+	if err != nil {
+		return nil, format, err
+	}
+	if d.pos != len(d.data) {
+		return nil, format, fmt.Errorf("лишние данные после значения: %d bytes", len(d.data)-d.pos)
+	}
+	return node, format, nil
+}
+
+func (d *binaryDecoder) decodeMsgpackNode(depth int) (*binaryNode, error) {
+	if depth > binaryMaxDepth {
+		return nil, errors.New("слишком глубокая вложенность")
+	}
+	if d.pos >= len(d.data) {
+		return nil, errBinaryTruncated
+	}
+	start := d.pos
+	b := d.data[d.pos]
+	node := &binaryNode{}
+
+	switch {
+	case b >= 0x90 && b <= 0x9f, b == 0xdc, b == 0xdd: // array
+		d.pos++
+		n := uint64(b & 0x0f)
+		if b >= 0xdc {
+			var err error
+			if n, err = d.readUint(2 << (b - 0xdc)); err != nil {
+				return nil, err
+			}
+		}
+		if err := d.checkCount(n); err != nil {
+			return nil, err
+		}
+		node.kind = "array"
+		for i := uint64(0); i < n; i++ {
+			item, err := d.decodeMsgpackNode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			node.items = append(node.items, item)
+		}
+	case b >= 0x80 && b <= 0x8f, b == 0xde, b == 0xdf: // map
+		d.pos++
+		n := uint64(b & 0x0f)
+		if b >= 0xde {
+			var err error
+			if n, err = d.readUint(2 << (b - 0xde)); err != nil {
+				return nil, err
+			}
+		}
+		if err := d.checkCount(n); err != nil {
+			return nil, err
+		}
+		node.kind = "map"
+		for i := uint64(0); i < n; i++ {
+			key, err := d.decodeMsgpackNode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			value, err := d.decodeMsgpackNode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			node.keys = append(node.keys, key)
+			node.items = append(node.items, value)
+		}
+	default:
+		value, err := d.decodeMsgpack(depth)
+		if err != nil {
+			return nil, err
+		}
+		node.view = value
+		switch {
+		case b >= 0xc4 && b <= 0xc6:
+			node.kind = "bin"
+		case b == 0xca:
+			node.kind = "float32"
+		case b == 0xcb:
+			node.kind = "float"
+		}
+	}
+	node.raw = d.data[start:d.pos]
+	node.buildView()
+	return node, nil
+}
+
+func (d *binaryDecoder) decodeCBORNode(depth int) (*binaryNode, error) {
+	if depth > binaryMaxDepth {
+		return nil, errors.New("слишком глубокая вложенность")
+	}
+	if d.pos >= len(d.data) {
+		return nil, errBinaryTruncated
+	}
+	start := d.pos
+	b := d.data[d.pos]
+	major, info := b>>5, b&0x1f
+	node := &binaryNode{}
+
+	isBreak := func() bool {
+		if d.pos < len(d.data) && d.data[d.pos] == 0xff {
+			d.pos++
+			return true
+		}
+		return false
+	}
+
+	switch {
+	case major == 4 || major == 5:
+		d.pos++
+		n := uint64(0)
+		if info != 31 {
+			var err error
+			if n, err = d.readCBORArgument(info); err != nil {
+				return nil, err
+			}
+			if err := d.checkCount(n); err != nil {
+				return nil, err
+			}
+		}
+		node.kind = "array"
+		if major == 5 {
+			node.kind = "map"
+		}
+		for i := uint64(0); ; i++ {
+			if (info == 31 && isBreak()) || (info != 31 && i == n) {
+				break
+			}
+			if major == 5 {
+				key, err := d.decodeCBORNode(depth + 1)
+				if err != nil {
+					return nil, err
+				}
+				node.keys = append(node.keys, key)
+			}
+			item, err := d.decodeCBORNode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			node.items = append(node.items, item)
+		}
+	case major == 6:
+		d.pos++
+		if _, err := d.readCBORArgument(info); err != nil {
+			return nil, err
+		}
+		node.prefix = d.data[start:d.pos]
+		child, err := d.decodeCBORNode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		node.kind = "tag"
+		node.items = []*binaryNode{child}
+	default:
+		value, err := d.decodeCBOR(depth)
+		if err != nil {
+			return nil, err
+		}
+		node.view = value
+		switch {
+		case major == 2:
+			node.kind = "bin"
+		case major == 7 && (info == 25 || info == 26):
+			node.kind = "float32"
+		case major == 7 && info == 27:
+			node.kind = "float"
+		}
+	}
+	node.raw = d.data[start:d.pos]
+	node.buildView()
+	return node, nil
+}
+
+// buildView собирает JSON представление контейнера из вложенных значений
+func (n *binaryNode) buildView() {
+	switch n.kind {
+	case "array":
+		array := make([]interface{}, 0, len(n.items))
+		for _, item := range n.items {
+			array = append(array, item.view)
+		}
+		n.view = array
+	case "map":
+		object := make(map[string]interface{}, len(n.items))
+		for i, item := range n.items {
+			object[binaryMapKey(n.keys[i].view)] = item.view
+		}
+		n.view = object
+	case "tag":
+		n.view = n.items[0].view
+	}
+}
+
+// sameJSONValue сравнивает значения по их JSON записи (json.Number и float64 1 совпадают)
+func sameJSONValue(a, b interface{}) bool {
+	left, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	right, err := json.Marshal(b)
+	return err == nil && bytes.Equal(left, right)
+}
+
+// encodeBinaryNode кодирует значение после замен. Неизмененные значения переносятся исходными байтами,
+// измененные по возможности кодируются исходным типом; новые - как JSON значения
+func encodeBinaryNode(buf []byte, node *binaryNode, value interface{}, isCBOR bool) ([]byte, error) {
+	encodeValue := func(buf []byte, value interface{}) ([]byte, error) {
+		if isCBOR {
+			return encodeCBOR(buf, value)
+		}
+		return encodeMsgpack(buf, value)
+	}
+	if node == nil {
+		return encodeValue(buf, value)
+	}
+	if sameJSONValue(node.view, value) {
+		return append(buf, node.raw...), nil
+	}
+
+	switch node.kind {
+	case "tag":
+		return encodeBinaryNode(append(buf, node.prefix...), node.items[0], value, isCBOR)
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			break
+		}
+		if isCBOR {
+			buf = encodeCBORHead(buf, 4, uint64(len(array)))
+		} else {
+			buf = encodeMsgpackArrayHead(buf, len(array))
+		}
+		for i, item := range array {
+			var child *binaryNode
+			if i < len(node.items) {
+				child = node.items[i]
+			}
+			var err error
+			if buf, err = encodeBinaryNode(buf, child, item, isCBOR); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case "map":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			break
+		}
+		if isCBOR {
+			buf = encodeCBORHead(buf, 5, uint64(len(object)))
+		} else {
+			buf = encodeMsgpackMapHead(buf, len(object))
+		}
+		// Сохранившиеся ключи - в исходном порядке и исходной кодировке, новые - по алфавиту
+		written := make(map[string]bool, len(object))
+		for i, key := range node.keys {
+			name := binaryMapKey(key.view)
+			item, ok := object[name]
+			if !ok || written[name] {
+				continue
+			}
+			written[name] = true
+			var err error
+			buf = append(buf, key.raw...)
+			if buf, err = encodeBinaryNode(buf, node.items[i], item, isCBOR); err != nil {
+				return nil, err
+			}
+		}
+		added := make([]string, 0)
+		for name := range object {
+			if !written[name] {
+				added = append(added, name)
+			}
+		}
+		sort.Strings(added)
+		for _, name := range added {
+			var err error
+			if buf, err = encodeValue(buf, name); err != nil {
+				return nil, err
+			}
+			if buf, err = encodeValue(buf, object[name]); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case "bin":
+		// bin и byte string представлены в JSON строкой base64
+		if text, ok := value.(string); ok {
+			if data, err := base64.StdEncoding.DecodeString(text); err == nil {
+				if isCBOR {
+					return append(encodeCBORHead(buf, 2, uint64(len(data))), data...), nil
+				}
+				return append(encodeMsgpackBinHead(buf, len(data)), data...), nil
+			}
+		}
+	case "float32", "float":
+		number, ok := value.(json.Number)
+		if !ok {
+			break
+		}
+		f, err := number.Float64()
+		if err != nil {
+			break
+		}
+		if node.kind == "float32" && float64(float32(f)) == f {
+			if isCBOR {
+				return binary.BigEndian.AppendUint32(append(buf, 0xfa), math.Float32bits(float32(f))), nil
+			}
+			return binary.BigEndian.AppendUint32(append(buf, 0xca), math.Float32bits(float32(f))), nil
+		}
+		if isCBOR {
+			return binary.BigEndian.AppendUint64(append(buf, 0xfb), math.Float64bits(f)), nil
+		}
+		return binary.BigEndian.AppendUint64(append(buf, 0xcb), math.Float64bits(f)), nil
+	}
+	return encodeValue(buf, value)
+}
+
+// TransformMessage данные запроса и ответа, передаваемые внешнему обработчику
+type TransformMessage struct {
+	Rule     string            `json:"rule"`
+	Request  TransformRequest  `json:"request"`
+	Response TransformResponse `json:"response"`
+}
+
+// TransformRequest запрос клиента для внешнего обработчика
+type TransformRequest struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Headers    http.Header `json:"headers"`
+	Body       string      `json:"body"`
+	BodyBase64 bool        `json:"body_base64"` // Тело не UTF-8 и закодировано в base64
+}
+
+// TransformResponse ответ для внешнего обработчика и результат его работы
+type TransformResponse struct {
+	StatusCode int         `json:"status_code"`
+	Headers    http.Header `json:"headers"`
+	Body       *string     `json:"body"`        // В результате обработчика: нет поля - тело не меняется
+	BodyBase64 bool        `json:"body_base64"` // Тело не UTF-8 и закодировано в base64
+}
+
+// encodeTransformBody представляет тело строкой (base64 для бинарных данных)
+func encodeTransformBody(body []byte) (string, bool) {
+	if utf8.Valid(body) {
+		return string(body), false
+	}
+	return base64.StdEncoding.EncodeToString(body), true
+}
+
+// decodeTransformBody восстанавливает тело из строки
+func decodeTransformBody(body string, isBase64 bool) ([]byte, error) {
+	if isBase64 {
+		return base64.StdEncoding.DecodeString(body)
+	}
+	return []byte(body), nil
+}
+
+// newTransformMessage собирает данные запроса и ответа для внешнего обработчика
+func newTransformMessage(override *ResponseOverride, r *http.Request, requestBody []byte, statusCode int, headers http.Header, body []byte) TransformMessage {
+	message := TransformMessage{
+		Rule: override.Name,
+		Request: TransformRequest{
+			Method:  r.Method,
+			URL:     r.URL.String(),
+			Headers: r.Header,
+		},
+		Response: TransformResponse{
+			StatusCode: statusCode,
+			Headers:    headers,
+		},
+	}
+	message.Request.Body, message.Request.BodyBase64 = encodeTransformBody(requestBody)
+
+	// Обработчику передаем распакованное тело
+	decompressed := decompressIfNeeded(body, headers)
+	responseBody, isBase64 := encodeTransformBody(decompressed)
+	message.Response.Body, message.Response.BodyBase64 = &responseBody, isBase64
+	return message
+}
+
+// applyTransformResult применяет ответ обработчика к заголовкам, возвращает новый статус и тело
+// Без поля body тело остается прежним (распакованным, как его видел обработчик)
+func applyTransformResult(result TransformResponse, statusCode int, headers http.Header, body []byte) (int, []byte, error) {
+	// Кодирование остается только у прежнего тела, которое не удалось распаковать
+	encoding := headers.Get("Content-Encoding")
+	var newBody []byte
+	if result.Body != nil {
+		decoded, err := decodeTransformBody(*result.Body, result.BodyBase64)
+		if err != nil {
+			return statusCode, body, err
+		}
+		newBody = decoded
+		encoding = ""
+	} else {
+		var removed string
+		if newBody, removed = decodeContent(body, headers); removed != "" {
+			encoding = ""
+		}
+	}
+
+	if result.StatusCode > 0 {
+		statusCode = result.StatusCode
+	}
+	if result.Headers != nil {
+		for key := range headers {
+			delete(headers, key)
+		}
+		for key, values := range result.Headers {
+			headers[http.CanonicalHeaderKey(key)] = values
+		}
+	}
+
+	// Тело возвращается распакованным
+	headers.Del("Content-Encoding")
+	if encoding != "" {
+		headers.Set("Content-Encoding", encoding)
+	}
+	headers.Del("Content-Length")
+	return statusCode, newBody, nil
+}
+
+// hasTransforms проверяет, есть ли у правила скрипт, внешний обработчик или transformer
+func hasTransforms(override *ResponseOverride) bool {
+	return override.Script != "" || override.TransformURL != "" || len(override.Transformers) > 0
+}
+
+// applyTransforms применяет скрипт, внешний обработчик и transformer правила (в этом порядке)
+func applyTransforms(override *ResponseOverride, r *http.Request, requestBody []byte, statusCode int, headers http.Header, body []byte) (int, []byte) {
+	if override.Script != "" {
+		statusCode, body = runTransformScript(override, r, requestBody, statusCode, headers, body)
+	}
+	if override.TransformURL != "" {
+		statusCode, body = runTransformWebhook(override, r, requestBody, statusCode, headers, body)
+	}
+	for _, name := range override.Transformers {
+		statusCode, body = runTransformer(name, r, statusCode, headers, body)
+	}
+	return statusCode, body
+}
+
+// runTransformWebhook отправляет запрос и ответ POST запросом на transform_url и использует ответ обработчика.
+// Ответ 204 или пустое тело - ответ не меняется, при ошибке возвращается исходный ответ
+func runTransformWebhook(override *ResponseOverride, r *http.Request, requestBody []byte, statusCode int, headers http.Header, body []byte) (int, []byte) {
+	input, err := json.Marshal(newTransformMessage(override, r, requestBody, statusCode, headers, body))
+	if err != nil {
+		requestLogf(r, "❌ Ошибка подготовки данных для обработчика: %v", err)
+		return statusCode, body
+	}
+
+	client := &http.Client{Timeout: override.transformTimeout}
+	started := time.Now()
+	resp, err := client.Post(override.TransformURL, "application/json", bytes.NewReader(input))
+	if err != nil {
+		requestLogf(r, "❌ Ошибка вызова обработчика %s: %v", override.TransformURL, err)
+		return statusCode, body
+	}
+	defer resp.Body.Close()
+
+	output, err := io.ReadAll(resp.Body)
+	if err != nil {
+		requestLogf(r, "❌ Ошибка чтения ответа обработчика %s: %v", override.TransformURL, err)
+		return statusCode, body
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		requestLogf(r, "❌ Обработчик %s вернул статус %d: %s", override.TransformURL, resp.StatusCode, truncateString(string(output), logSettings.MaxLogLength))
+		return statusCode, body
+	}
+	if resp.StatusCode == http.StatusNoContent || len(bytes.TrimSpace(output)) == 0 {
+		requestLogf(r, "🪝 Обработчик %s не изменил ответ (%v)", override.TransformURL, time.Since(started).Round(time.Millisecond))
+		return statusCode, body
+	}
+
+	var result TransformResponse
+	if err := json.Unmarshal(output, &result); err != nil {
+		requestLogf(r, "❌ Обработчик %s вернул невалидный JSON: %v", override.TransformURL, err)
+		return statusCode, body
+	}
+
+	newStatus, newBody, err := applyTransformResult(result, statusCode, headers, body)
+	if err != nil {
+		requestLogf(r, "❌ Обработчик %s вернул невалидное тело: %v", override.TransformURL, err)
+		return statusCode, body
+	}
+	requestLogf(r, "🪝 Обработчик %s: статус %d -> %d, тело %d -> %d bytes (%v)",
+		override.TransformURL, statusCode, newStatus, len(body), len(newBody), time.Since(started).Round(time.Millisecond))
+	return newStatus, newBody
+}
+
+// runTransformScript запускает скрипт правила: JSON с запросом и ответом в stdin, новый ответ в stdout.
+// При ошибке скрипта возвращается исходный ответ
+func runTransformScript(override *ResponseOverride, r *http.Request, requestBody []byte, statusCode int, headers http.Header, body []byte) (int, []byte) {
+	args := strings.Fields(override.Script)
+	if len(args) == 0 {
+		return statusCode, body
+	}
+
+	input, err := json.Marshal(newTransformMessage(override, r, requestBody, statusCode, headers, body))
+	if err != nil {
+		requestLogf(r, "❌ Ошибка подготовки данных для скрипта: %v", err)
+		return statusCode, body
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), override.scriptTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	started := time.Now()
+	if err := cmd.Run(); err != nil {
+		requestLogf(r, "❌ Ошибка скрипта '%s': %v", override.Script, err)
+		if stderr.Len() > 0 {
+			requestLogf(r, "   stderr: %s", truncateString(stderr.String(), logSettings.MaxLogLength))
+		}
+		return statusCode, body
+	}
+	if stderr.Len() > 0 {
+		requestLogf(r, "📜 stderr скрипта: %s", truncateString(stderr.String(), logSettings.MaxLogLength))
+	}
+
+	// Пустой вывод - ответ не меняется
+	if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+		requestLogf(r, "📜 Скрипт '%s' не изменил ответ (%v)", override.Script, time.Since(started).Round(time.Millisecond))
+		return statusCode, body
+	}
+
+	var result TransformResponse
+	if err := json.Unmarshal(stdout.Bytes(), &result); err != nil {
+		requestLogf(r, "❌ Скрипт '%s' вернул невалидный JSON: %v", override.Script, err)
+		return statusCode, body
+	}
+
+	newStatus, newBody, err := applyTransformResult(result, statusCode, headers, body)
+	if err != nil {
+		requestLogf(r, "❌ Скрипт '%s' вернул невалидное тело: %v", override.Script, err)
+		return statusCode, body
+	}
+	requestLogf(r, "📜 Скрипт '%s': статус %d -> %d, тело %d -> %d bytes (%v)",
+		override.Script, statusCode, newStatus, len(body), len(newBody), time.Since(started).Round(time.Millisecond))
+	return newStatus, newBody
+}
+
+// Точки расширения ниже объявлены в пакете main: импортировать их из другого модуля нельзя.
+// Расширение подключается файлом в пакете main (Register* из init()) или плагином через PROXY_PLUGINS (plugin.Open)
+
+// Middleware оборачивает обработку всех запросов (логирование, авторизация, маршрутизация и т.д.)
+type Middleware interface {
+	Name() string
+	Wrap(next http.Handler) http.Handler
+}
+
+// Matcher дополнительное условие срабатывания правила (поле matcher)
+type Matcher interface {
+	Name() string
+	Match(r *http.Request) bool
+}
+
+// Transformer обработчик ответа правила (поле transformers).
+// Получает распакованное тело, может изменить статус, заголовки и тело
+type Transformer interface {
+	Name() string
+	Transform(r *http.Request, statusCode int, headers http.Header, body []byte) (int, []byte, error)
+}
+
+// TLSHandshakeFunc выполняет TLS рукопожатие поверх установленного TCP соединения.
+// Используется для подмены ClientHello (отпечатка JA3) через UPSTREAM_TLS_FINGERPRINT
+type TLSHandshakeFunc func(conn net.Conn, config *tls.Config) (net.Conn, error)
+
+// MiddlewareFunc функция-адаптер для Middleware
+type MiddlewareFunc func(next http.Handler) http.Handler
+
+// MatcherFunc функция-адаптер для Matcher
+type MatcherFunc func(r *http.Request) bool
+
+// TransformerFunc функция-адаптер для Transformer
+type TransformerFunc func(r *http.Request, statusCode int, headers http.Header, body []byte) (int, []byte, error)
+
+type namedMiddleware struct {
+	name string
+	fn   MiddlewareFunc
+}
+
+func (m namedMiddleware) Name() string                        { return m.name }
+func (m namedMiddleware) Wrap(next http.Handler) http.Handler { return m.fn(next) }
+
+type namedMatcher struct {
+	name string
+	fn   MatcherFunc
+}
+
+func (m namedMatcher) Name() string               { return m.name }
+func (m namedMatcher) Match(r *http.Request) bool { return m.fn(r) }
+
+type namedTransformer struct {
+	name string
+	fn   TransformerFunc
+}
+
+func (t namedTransformer) Name() string { return t.name }
+func (t namedTransformer) Transform(r *http.Request, statusCode int, headers http.Header, body []byte) (int, []byte, error) {
+	return t.fn(r, statusCode, headers, body)
+}
+
+var middlewares []Middleware
+var matchers = make(map[string]Matcher)
+var transformers = make(map[string]Transformer)
+var tlsFingerprints = make(map[string]TLSHandshakeFunc)
+var loadedPlugins []string
+
+// RegisterMiddleware регистрирует middleware (вызывается из init() дополнительных файлов пакета)
+func RegisterMiddleware(m Middleware) {
+	middlewares = append(middlewares, m)
+}
+
+// RegisterMatcher регистрирует matcher под его именем
+func RegisterMatcher(m Matcher) {
+	matchers[m.Name()] = m
+}
+
+// RegisterTransformer регистрирует transformer под его именем
+func RegisterTransformer(t Transformer) {
+	transformers[t.Name()] = t
+}
+
+// RegisterContentEncoding регистрирует кодирование тела (например, br) для сжатия и распаковки ответов клиентам
+func RegisterContentEncoding(name string, encoder func(io.Writer) io.WriteCloser, decoder func(io.Reader) (io.ReadCloser, error)) {
+	name = strings.ToLower(name)
+	if encoder != nil {
+		contentEncoders[name] = encoder
+	}
+	if decoder != nil {
+		contentDecoders[name] = decoder
+	}
+}
+
+// RegisterTLSFingerprint регистрирует TLS рукопожатие с собственным ClientHello (например, на uTLS)
+func RegisterTLSFingerprint(name string, fn TLSHandshakeFunc) {
+	tlsFingerprints[name] = fn
+}
+
+// applyMiddlewares оборачивает handler; первый зарегистрированный middleware выполняется первым
+func applyMiddlewares(handler http.Handler) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i].Wrap(handler)
+	}
+	return handler
+}
+
+// runMatcher проверяет условие matcher, незарегистрированный matcher не срабатывает
+func runMatcher(name string, r *http.Request) bool {
+	matcher := matchers[name]
+	if matcher == nil || r == nil {
+		return false
+	}
+	holder, _ := r.Context().Value(requestTagsKey{}).(*requestTagHolder)
+	if holder == nil {
+		return matcher.Match(r)
+	}
+	holder.mutex.Lock()
+	defer holder.mutex.Unlock()
+	if matched, ok := holder.matchers[name]; ok {
+		return matched
+	}
+	matched := matcher.Match(r)
+	if holder.matchers == nil {
+		holder.matchers = make(map[string]bool)
+	}
+	holder.matchers[name] = matched
+	return matched
+}
+
+// runTransformer применяет transformer к ответу, при ошибке возвращается исходный ответ
+func runTransformer(name string, r *http.Request, statusCode int, headers http.Header, body []byte) (int, []byte) {
+	transformer := transformers[name]
+	if transformer == nil {
+		requestLogf(r, "⚠️  Transformer '%s' не зарегистрирован", name)
+		return statusCode, body
+	}
+
+	// Transformer получает распакованное тело
+	decompressed, removed := decodeContent(body, headers)
+	newStatus, newBody, err := transformer.Transform(r, statusCode, headers, decompressed)
+	if err != nil {
+		requestLogf(r, "❌ Ошибка transformer '%s': %v", name, err)
+		return statusCode, body
+	}
+	if removed != "" {
+		headers.Del("Content-Encoding")
+	}
+	headers.Del("Content-Length")
+	requestLogf(r, "🧩 Transformer '%s': статус %d -> %d, тело %d -> %d bytes", name, statusCode, newStatus, len(body), len(newBody))
+	return newStatus, newBody
+}
+
+// loadPlugins загружает Go плагины (go build -buildmode=plugin) из PROXY_PLUGINS.
+// Плагин может экспортировать (используются только типы стандартной библиотеки):
+//   - ProxyMiddleware func(http.Handler) http.Handler
+//   - ProxyMatchers map[string]func(*http.Request) bool
+//   - ProxyTransformers map[string]func(*http.Request, int, http.Header, []byte) (int, []byte, error)
+//   - ProxyEncoders map[string]func(io.Writer) io.WriteCloser
+//   - ProxyDecoders map[string]func(io.Reader) (io.ReadCloser, error)
+//   - ProxyCacheBackends map[string]func(path string) (interface{}, error) - значение с методами cacheBackend
+func loadPlugins() {
+	pluginsEnv := os.Getenv("PROXY_PLUGINS")
+	if pluginsEnv == "" {
+		return
+	}
+
+	for _, file := range strings.Split(pluginsEnv, ",") {
+		file = strings.TrimSpace(file)
+		if file == "" {
+			continue
+		}
+		p, err := plugin.Open(file)
+		if err != nil {
+			log.Printf("⚠️  Ошибка загрузки плагина %s: %v", file, err)
+			continue
+		}
+
+		if symbol, err := p.Lookup("ProxyMiddleware"); err == nil {
+			switch fn := symbol.(type) {
+			case func(http.Handler) http.Handler:
+				RegisterMiddleware(namedMiddleware{name: file, fn: fn})
+			case *func(http.Handler) http.Handler:
+				RegisterMiddleware(namedMiddleware{name: file, fn: *fn})
+			default:
+				log.Printf("⚠️  Плагин %s: ProxyMiddleware имеет неверный тип %T", file, symbol)
+			}
+		}
+
+		if symbol, err := p.Lookup("ProxyMatchers"); err == nil {
+			if fns, ok := symbol.(*map[string]func(*http.Request) bool); ok {
+				for name, fn := range *fns {
+					RegisterMatcher(namedMatcher{name: name, fn: fn})
+				}
+			} else {
+				log.Printf("⚠️  Плагин %s: ProxyMatchers имеет неверный тип %T", file, symbol)
+			}
+		}
+
+		if symbol, err := p.Lookup("ProxyTLSFingerprints"); err == nil {
+			if fns, ok := symbol.(*map[string]func(net.Conn, *tls.Config) (net.Conn, error)); ok {
+				for name, fn := range *fns {
+					RegisterTLSFingerprint(name, fn)
+				}
+			} else {
+				log.Printf("⚠️  Плагин %s: ProxyTLSFingerprints имеет неверный тип %T", file, symbol)
+			}
+		}
+
+		if symbol, err := p.Lookup("ProxyTransformers"); err == nil {
+			if fns, ok := symbol.(*map[string]func(*http.Request, int, http.Header, []byte) (int, []byte, error)); ok {
+				for name, fn := range *fns {
+					RegisterTransformer(namedTransformer{name: name, fn: fn})
+				}
+			} else {
+				log.Printf("⚠️  Плагин %s: ProxyTransformers имеет неверный тип %T", file, symbol)
+			}
+		}
+
+		if symbol, err := p.Lookup("ProxyEncoders"); err == nil {
+			if fns, ok := symbol.(*map[string]func(io.Writer) io.WriteCloser); ok {
+				for name, fn := range *fns {
+					RegisterContentEncoding(name, fn, nil)
+				}
+			} else {
+				log.Printf("⚠️  Плагин %s: ProxyEncoders имеет неверный тип %T", file, symbol)
+			}
+		}
+
+		if symbol, err := p.Lookup("ProxyDecoders"); err == nil {
+			if fns, ok := symbol.(*map[string]func(io.Reader) (io.ReadCloser, error)); ok {
+				for name, fn := range *fns {
+					RegisterContentEncoding(name, nil, fn)
+				}
+			} else {
+				log.Printf("⚠️  Плагин %s: ProxyDecoders имеет неверный тип %T", file, symbol)
+			}
+		}
+
+		if symbol, err := p.Lookup("ProxyCacheBackends"); err == nil {
+			if fns, ok := symbol.(*map[string]func(string) (interface{}, error)); ok {
+				for name, fn := range *fns {
+					RegisterCacheBackend(name, fn)
+				}
+			} else {
+				log.Printf("⚠️  Плагин %s: ProxyCacheBackends имеет неверный тип %T", file, symbol)
+			}
+		}
+
+		loadedPlugins = append(loadedPlugins, file)
+		log.Printf("🧩 Загружен плагин: %s", file)
+	}
+}
+
+func printPluginSettings() {
+	log.Printf("🧩 Расширения:")
+	log.Printf("   Plugins: %v", loadedPlugins)
+	names := make([]string, 0, len(middlewares))
+	for _, m := range middlewares {
+		names = append(names, m.Name())
+	}
+	log.Printf("   Middleware: %v", names)
+	names = names[:0]
+	for name := range matchers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	log.Printf("   Matchers: %v", names)
+	names = names[:0]
+	for name := range transformers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	log.Printf("   Transformers: %v", names)
+	names = names[:0]
+	for name := range tlsFingerprints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	log.Printf("   TLS Fingerprints: %v", names)
+	log.Printf("")
+	log.Printf("🔧 Переменные окружения для расширений:")
+	log.Printf("   - PROXY_PLUGINS=./plugins/auth.so,./plugins/mask.so - Go плагины через запятую")
+	log.Printf("")
+}
+
+// RuleTriggerEvent уведомление о срабатывании правила
+type RuleTriggerEvent struct {
+	Event        string    `json:"event"`
+	Rule         string    `json:"rule"`
+	Method       string    `json:"method"`
+	URL          string    `json:"url"`
+	Host         string    `json:"host"`
+	RemoteAddr   string    `json:"remote_addr"`
+	RequestCount int       `json:"request_count"`
+	TriggerCount int       `json:"trigger_count"`
+	TriggeredAt  time.Time `json:"triggered_at"`
+}
+
+var ruleWebhookURL string // Глобальный webhook (RULE_WEBHOOK_URL)
+var webhookClient = &http.Client{Timeout: 5 * time.Second}
+
+// notifyRuleTriggered асинхронно отправляет уведомление о срабатывании правила на webhook правила и глобальный webhook
+func notifyRuleTriggered(override *ResponseOverride, r *http.Request, requestCount, triggerCount int) {
+	var targets []string
+	if override.WebhookURL != "" {
+		targets = append(targets, override.WebhookURL)
+	}
+	if ruleWebhookURL != "" && ruleWebhookURL != override.WebhookURL {
+		targets = append(targets, ruleWebhookURL)
+	}
+	if len(targets) == 0 {
+		return
+	}
+
+	event := RuleTriggerEvent{
+		Event:        "rule_triggered",
+		Rule:         override.Name,
+		RequestCount: requestCount,
+		TriggerCount: triggerCount,
+		TriggeredAt:  time.Now(),
+	}
+	if r != nil {
+		event.Method = r.Method
+		event.URL = r.URL.String()
+		event.Host = r.Host
+		event.RemoteAddr = r.RemoteAddr
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		requestLogf(r, "⚠️  Ошибка подготовки уведомления: %v", err)
+		return
+	}
+
+	for _, target := range targets {
+		go func(target string) {
+			resp, err := webhookClient.Post(target, "application/json", bytes.NewReader(payload))
+			if err != nil {
+				requestLogf(r, "⚠️  Ошибка отправки уведомления на %s: %v", target, err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				requestLogf(r, "⚠️  Webhook %s вернул статус %d", target, resp.StatusCode)
+				return
+			}
+			requestLogf(r, "🔔 Уведомление о срабатывании '%s' отправлено на %s", event.Rule, target)
+		}(target)
+	}
+}
+
+// loadJSONSchema читает JSON Schema из файла
+func loadJSONSchema(file string) (interface{}, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var schema interface{}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, err
+	}
+	switch schema.(type) {
+	case map[string]interface{}, bool:
+		if err := compileSchemaPatterns(schema); err != nil {
+			return nil, err
+		}
+		return schema, nil
+	}
+	return nil, fmt.Errorf("схема должна быть объектом или boolean")
+}
+
+var schemaPatterns sync.Map // pattern и ключи patternProperties схем -> *regexp.Regexp
+
+// compileSchemaPatterns компилирует regex схемы при загрузке: ошибка в pattern отключает правило,
+// а проверка запроса не компилирует их заново
+func compileSchemaPatterns(schema interface{}) error {
+	switch v := schema.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			switch key {
+			case "enum", "const", "default", "examples":
+				// Значения, а не схемы
+				continue
+			case "pattern":
+				if pattern, ok := value.(string); ok {
+					if _, err := schemaRegexp(pattern); err != nil {
+						return fmt.Errorf("pattern %s: %v", pattern, err)
+					}
+					continue
+				}
+			case "patternProperties":
+				if properties, ok := value.(map[string]interface{}); ok {
+					for pattern := range properties {
+						if _, err := schemaRegexp(pattern); err != nil {
+							return fmt.Errorf("patternProperties %s: %v", pattern, err)
+						}
+					}
+				}
+			}
+			if err := compileSchemaPatterns(value); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if err := compileSchemaPatterns(item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// schemaRegexp возвращает скомпилированный regex схемы
+func schemaRegexp(pattern string) (*regexp.Regexp, error) {
+	if re, ok := schemaPatterns.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	schemaPatterns.Store(pattern, re)
+	return re, nil
+}
+
+// findSchemaOverride ищет первое включенное правило со схемой запроса, условия которого выполнены
+// (без учета триггеров и лимитов)
+func findSchemaOverride(method, urlPath, contentType string, r *http.Request) *ResponseOverride {
+	overrides := currentOverrides(r)
+	for i := range overrides {
+		override := &overrides[i]
+		if override.Enabled && override.requestSchema != nil && overrideMismatch(override, method, urlPath, contentType, r) == "" {
+			return override
+		}
+	}
+	return nil
+}
+
+// validateRequestBody проверяет тело запроса по схеме правила.
+// Возвращает false, если запрос отклонён и ответ клиенту уже отправлен
+func validateRequestBody(w http.ResponseWriter, r *http.Request, override *ResponseOverride) bool {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			requestLogf(r, "❌ Ошибка чтения тела запроса для валидации: %v", err)
+		}
+	}
+	// Восстанавливаем тело для дальнейшего проксирования
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var errs []string
+	var value interface{}
+	if err := json.Unmarshal(decompressIfNeeded(body, r.Header), &value); err != nil {
+		errs = []string{fmt.Sprintf("$: тело запроса не является валидным JSON: %v", err)}
+	} else {
+		errs = validateJSONSchema(value, override.requestSchema, override.requestSchema, "$")
+	}
+
+	if len(errs) == 0 {
+		requestLogf(r, "✅ Правило '%s': запрос соответствует схеме", override.Name)
+		return true
+	}
+
+	atomic.AddInt64(&override.schemaViolations, 1)
+
+	requestLogf(r, "🚫 Правило '%s': запрос не соответствует схеме %s (%d ошибок)", override.Name, override.RequestSchemaFile, len(errs))
+	for _, e := range errs {
+		requestLogf(r, "   - %s", e)
+	}
+
+	if override.SchemaAction == "log" {
+		return true
+	}
+
+	status := override.SchemaErrorStatus
+	if status == 0 {
+		status = http.StatusBadRequest
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":  "request validation failed",
+		"rule":   override.Name,
+		"errors": errs,
+	})
+	return false
+}
+
+// validateJSONSchema проверяет значение по JSON Schema (подмножество draft-07/2020-12:
+// type, enum, const, properties, required, additionalProperties, patternProperties, items,
+// min/max ограничения, pattern, format не проверяется, allOf/anyOf/oneOf/not, локальные $ref).
+// Возвращает список ошибок с путями вида $.items[0].name
+func validateJSONSchema(value interface{}, schema interface{}, root interface{}, path string) []string {
+	switch s := schema.(type) {
+	case bool:
+		if !s {
+			return []string{path + ": значение запрещено схемой"}
+		}
+		return nil
+	case map[string]interface{}:
+		return validateJSONSchemaObject(value, s, root, path)
+	}
+	return nil
+}
+
+func validateJSONSchemaObject(value interface{}, schema map[string]interface{}, root interface{}, path string) []string {
+	var errs []string
+
+	if ref, ok := schema["$ref"].(string); ok {
+		resolved, err := resolveJSONSchemaRef(root, ref)
+		if err != nil {
+			return []string{fmt.Sprintf("%s: %v", path, err)}
+		}
+		errs = append(errs, validateJSONSchema(value, resolved, root, path)...)
+	}
+
+	// OpenAPI: nullable: true разрешает null для любого типа
+	if value == nil && schema["nullable"] == true {
+		return errs
+	}
+
+	if t, ok := schema["type"]; ok {
+		var types []string
+		switch tv := t.(type) {
+		case string:
+			types = []string{tv}
+		case []interface{}:
+			for _, item := range tv {
+				if name, ok := item.(string); ok {
+					types = append(types, name)
+				}
+			}
+		}
+		matched := false
+		for _, name := range types {
+			if jsonSchemaTypeMatches(value, name) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return append(errs, fmt.Sprintf("%s: ожидается %s, получено %s", path, strings.Join(types, "|"), jsonValueType(value)))
+		}
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, item := range enum {
+			if jsonValuesEqual(value, item) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs = append(errs, fmt.Sprintf("%s: значение %s не входит в enum", path, truncateString(jsonString(value), 100)))
+		}
+	}
+	if c, ok := schema["const"]; ok && !jsonValuesEqual(value, c) {
+		errs = append(errs, fmt.Sprintf("%s: ожидается значение %s", path, truncateString(jsonString(c), 100)))
+	}
+
+	switch v := value.(type) {
+	case string:
+		length := utf8.RuneCountInString(v)
+		if n, ok := schema["minLength"].(float64); ok && float64(length) < n {
+			errs = append(errs, fmt.Sprintf("%s: длина строки %d меньше minLength %v", path, length, n))
+		}
+		if n, ok := schema["maxLength"].(float64); ok && float64(length) > n {
+			errs = append(errs, fmt.Sprintf("%s: длина строки %d больше maxLength %v", path, length, n))
+		}
+		if p, ok := schema["pattern"].(string); ok {
+			if re, err := schemaRegexp(p); err == nil && !re.MatchString(v) {
+				errs = append(errs, fmt.Sprintf("%s: строка не соответствует pattern %s", path, p))
+			}
+		}
+	case float64:
+		if n, ok := schema["minimum"].(float64); ok && v < n {
+			errs = append(errs, fmt.Sprintf("%s: %v меньше minimum %v", path, v, n))
+		}
+		if n, ok := schema["maximum"].(float64); ok && v > n {
+			errs = append(errs, fmt.Sprintf("%s: %v больше maximum %v", path, v, n))
+		}
+		if n, ok := schema["exclusiveMinimum"].(float64); ok && v <= n {
+			errs = append(errs, fmt.Sprintf("%s: %v должно быть больше %v", path, v, n))
+		}
+		if n, ok := schema["exclusiveMaximum"].(float64); ok && v >= n {
+			errs = append(errs, fmt.Sprintf("%s: %v должно быть меньше %v", path, v, n))
+		}
+		if n, ok := schema["multipleOf"].(float64); ok && n > 0 {
+			if q := v / n; q != math.Trunc(q) {
+				errs = append(errs, fmt.Sprintf("%s: %v не кратно %v", path, v, n))
+			}
+		}
+	case []interface{}:
+		if n, ok := schema["minItems"].(float64); ok && float64(len(v)) < n {
+			errs = append(errs, fmt.Sprintf("%s: элементов %d меньше minItems %v", path, len(v), n))
+		}
+		if n, ok := schema["maxItems"].(float64); ok && float64(len(v)) > n {
+			errs = append(errs, fmt.Sprintf("%s: элементов %d больше maxItems %v", path, len(v), n))
+		}
+		if schema["uniqueItems"] == true {
+			for i := range v {
+				for j := i + 1; j < len(v); j++ {
+					if jsonValuesEqual(v[i], v[j]) {
+						errs = append(errs, fmt.Sprintf("%s: элементы [%d] и [%d] совпадают (uniqueItems)", path, i, j))
+					}
+				}
+			}
+		}
+		// prefixItems (2020-12) и items-массив (draft-07) проверяют элементы по позиции
+		start := 0
+		tuple, isTuple := schema["prefixItems"].([]interface{})
+		if !isTuple {
+			tuple, isTuple = schema["items"].([]interface{})
+		}
+		if isTuple {
+			for i := 0; i < len(tuple) && i < len(v); i++ {
+				errs = append(errs, validateJSONSchema(v[i], tuple[i], root, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+			start = len(tuple)
+		}
+		if items, ok := schema["items"]; ok {
+			if _, isArray := items.([]interface{}); !isArray {
+				for i := start; i < len(v); i++ {
+					errs = append(errs, validateJSONSchema(v[i], items, root, fmt.Sprintf("%s[%d]", path, i))...)
+				}
+			}
+		}
+	case map[string]interface{}:
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, item := range required {
+				if name, ok := item.(string); ok {
+					if _, exists := v[name]; !exists {
+						errs = append(errs, fmt.Sprintf("%s: отсутствует обязательное поле '%s'", path, name))
+					}
+				}
+			}
+		}
+		if n, ok := schema["minProperties"].(float64); ok && float64(len(v)) < n {
+			errs = append(errs, fmt.Sprintf("%s: полей %d меньше minProperties %v", path, len(v), n))
+		}
+		if n, ok := schema["maxProperties"].(float64); ok && float64(len(v)) > n {
+			errs = append(errs, fmt.Sprintf("%s: полей %d больше maxProperties %v", path, len(v), n))
+		}
+
+		properties, _ := schema["properties"].(map[string]interface{})
+		patternProperties, _ := schema["patternProperties"].(map[string]interface{})
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fieldPath := path + "." + key
+			known := false
+			if propSchema, ok := properties[key]; ok {
+				known = true
+				errs = append(errs, validateJSONSchema(v[key], propSchema, root, fieldPath)...)
+			}
+			for pattern, propSchema := range patternProperties {
+				if re, err := schemaRegexp(pattern); err == nil && re.MatchString(key) {
+					known = true
+					errs = append(errs, validateJSONSchema(v[key], propSchema, root, fieldPath)...)
+				}
+			}
+			if known {
+				continue
+			}
+			if additional, ok := schema["additionalProperties"]; ok {
+				if additional == false {
+					errs = append(errs, fmt.Sprintf("%s: неизвестное поле '%s'", path, key))
+				} else {
+					errs = append(errs, validateJSONSchema(v[key], additional, root, fieldPath)...)
+				}
+			}
+		}
+	}
+
+	if allOf, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range allOf {
+			errs = append(errs, validateJSONSchema(value, sub, root, path)...)
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+		matched := false
+		for _, sub := range anyOf {
+			if len(validateJSONSchema(value, sub, root, path)) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			errs = append(errs, fmt.Sprintf("%s: значение не соответствует ни одной схеме anyOf", path))
+		}
+	}
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		count := 0
+		for _, sub := range oneOf {
+			if len(validateJSONSchema(value, sub, root, path)) == 0 {
+				count++
+			}
+		}
+		if count != 1 {
+			errs = append(errs, fmt.Sprintf("%s: значение соответствует %d схемам oneOf (нужно ровно 1)", path, count))
+		}
+	}
+	if not, ok := schema["not"]; ok {
+		if len(validateJSONSchema(value, not, root, path)) == 0 {
+			errs = append(errs, fmt.Sprintf("%s: значение не должно соответствовать схеме not", path))
+		}
+	}
+
+	return errs
+}
+
+// resolveJSONSchemaRef разрешает локальную ссылку вида "#/definitions/User" или "#/components/schemas/User"
+func resolveJSONSchemaRef(root interface{}, ref string) (interface{}, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("внешние $ref не поддерживаются: %s", ref)
+	}
+	current := root
+	pointer := strings.TrimPrefix(ref, "#")
+	if pointer == "" {
+		return current, nil
+	}
+	for _, part := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		if unescaped, err := url.PathUnescape(part); err == nil {
+			part = unescaped
+		}
+		obj, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("не найден $ref %s", ref)
+		}
+		if current, ok = obj[part]; !ok {
+			return nil, fmt.Errorf("не найден $ref %s", ref)
+		}
+	}
+	return current, nil
+}
+
+func jsonSchemaTypeMatches(value interface{}, name string) bool {
+	switch name {
+	case "integer":
+		f, ok := value.(float64)
+		return ok && f == math.Trunc(f)
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	}
+	return jsonValueType(value) == name
+}
+
+// jsonValueType возвращает тип значения в терминах JSON Schema
+func jsonValueType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+func jsonValuesEqual(a, b interface{}) bool {
+	return jsonString(a) == jsonString(b)
+}
+
+// jsonString сериализует значение в JSON (ключи объектов сортируются encoding/json)
+func jsonString(value interface{}) string {
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// OpenAPISettings настройки проверки ответов по OpenAPI спецификации
+type OpenAPISettings struct {
+	Enabled  bool
+	SpecFile string
+	BasePath string // Префикс пути, который отбрасывается перед поиском операции
+}
+
+// ContractViolation нарушение контракта OpenAPI
+type ContractViolation struct {
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Operation  string    `json:"operation"`
+	StatusCode int       `json:"status_code"`
+	Errors     []string  `json:"errors"`
+	At         time.Time `json:"at"`
+}
+
+type openAPIPath struct {
+	template string
+	regex    *regexp.Regexp
+	item     map[string]interface{}
+}
+
+const maxRecentViolations = 50
+
+var openAPISettings OpenAPISettings
+var openAPISpec map[string]interface{}
+var openAPIPaths []openAPIPath
+var contractChecked int64
+var contractViolations int64
+var contractUndocumented int64
+var recentViolations []ContractViolation
+var recentViolationsMutex sync.Mutex
+
+func setupOpenAPISettings() {
+	openAPISettings.SpecFile = os.Getenv("OPENAPI_SPEC")
+	if openAPISettings.SpecFile == "" {
+		openAPISettings.Enabled = false
+		return
+	}
+
+	if err := loadOpenAPISpec(openAPISettings.SpecFile); err != nil {
+		log.Printf("⚠️  Ошибка загрузки OpenAPI спецификации %s: %v, проверка отключена", openAPISettings.SpecFile, err)
+		openAPISettings.Enabled = false
+		return
+	}
+
+	// Базовый путь берется из переменной окружения или из первого servers[].url (swagger 2.0: basePath)
+	openAPISettings.BasePath = os.Getenv("OPENAPI_BASE_PATH")
+	if openAPISettings.BasePath == "" {
+		if servers, ok := openAPISpec["servers"].([]interface{}); ok && len(servers) > 0 {
+			if server, ok := servers[0].(map[string]interface{}); ok {
+				if serverURL, ok := server["url"].(string); ok {
+					if parsed, err := url.Parse(serverURL); err == nil {
+						openAPISettings.BasePath = parsed.Path
+					}
+				}
+			}
+		} else if basePath, ok := openAPISpec["basePath"].(string); ok {
+			openAPISettings.BasePath = basePath
+		}
+	}
+	openAPISettings.BasePath = strings.TrimSuffix(openAPISettings.BasePath, "/")
+	openAPISettings.Enabled = true
+}
+
+// loadOpenAPISpec загружает спецификацию (JSON) и подготавливает шаблоны путей
+func loadOpenAPISpec(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &openAPISpec); err != nil {
+		return fmt.Errorf("поддерживается только JSON формат: %v", err)
+	}
+
+	paths, ok := openAPISpec["paths"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("в спецификации нет раздела paths")
+	}
+
+	openAPIPaths = nil
+	for template, value := range paths {
+		item, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		// /users/{id} -> ^/users/[^/]+$
+		pattern := regexp.QuoteMeta(template)
+		pattern = regexp.MustCompile(`\\\{[^/]+?\\\}`).ReplaceAllString(pattern, `[^/]+`)
+		compiled, err := regexp.Compile("^" + pattern + "$")
+		if err != nil {
+			log.Printf("⚠️  OpenAPI: не удалось разобрать путь %s: %v", template, err)
+			continue
+		}
+		openAPIPaths = append(openAPIPaths, openAPIPath{template: template, regex: compiled, item: item})
+	}
+
+	// Пути без параметров проверяются первыми: /users/me важнее /users/{id}
+	sort.Slice(openAPIPaths, func(i, j int) bool {
+		pi := strings.Count(openAPIPaths[i].template, "{")
+		pj := strings.Count(openAPIPaths[j].template, "{")
+		if pi != pj {
+			return pi < pj
+		}
+		return openAPIPaths[i].template < openAPIPaths[j].template
+	})
+	return nil
+}
+
+func printOpenAPISettings() {
+	log.Printf("📐 Проверка ответов по OpenAPI:")
+	if openAPISettings.Enabled {
+		log.Printf("   Enabled: ✅")
+		log.Printf("   Spec: %s (%d путей)", openAPISettings.SpecFile, len(openAPIPaths))
+		if openAPISettings.BasePath != "" {
+			log.Printf("   Base Path: %s", openAPISettings.BasePath)
+		}
+	} else {
+		log.Printf("   Enabled: ❌")
+	}
+	log.Printf("")
+	log.Printf("🔧 Переменные окружения для OpenAPI:")
+	log.Printf("   - OPENAPI_SPEC=openapi.json - спецификация для проверки ответов (JSON)")
+	log.Printf("   - OPENAPI_BASE_PATH=/api/v1 - префикс пути (по умолчанию из servers[0].url)")
+	log.Printf("")
+}
+
+// findOpenAPIOperation находит операцию спецификации для метода и пути запроса
+func findOpenAPIOperation(method, urlPath string) (string, map[string]interface{}) {
+	if basePath := openAPISettings.BasePath; basePath != "" {
+		// Префикс совпадает целыми сегментами: /api не отбрасывается от /apiv2
+		if urlPath != basePath && !strings.HasPrefix(urlPath, basePath+"/") {
+			return "", nil
+		}
+		urlPath = strings.TrimPrefix(urlPath, openAPISettings.BasePath)
+		if urlPath == "" {
+			urlPath = "/"
+		}
+	}
+
+	for _, p := range openAPIPaths {
+		if !p.regex.MatchString(urlPath) {
+			continue
+		}
+		if operation, ok := p.item[strings.ToLower(method)].(map[string]interface{}); ok {
+			return strings.ToUpper(method) + " " + p.template, operation
+		}
+	}
+	return "", nil
+}
+
+// findOpenAPIResponse ищет описание ответа: точный код, затем маска вида 2XX, затем default
+func findOpenAPIResponse(operation map[string]interface{}, statusCode int) map[string]interface{} {
+	responses, ok := operation["responses"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	code := strconv.Itoa(statusCode)
+	for _, key := range []string{code, code[:1] + "XX", code[:1] + "xx", "default"} {
+		if value, ok := responses[key]; ok {
+			response, _ := value.(map[string]interface{})
+			if ref, ok := response["$ref"].(string); ok {
+				resolved, err := resolveJSONSchemaRef(openAPISpec, ref)
+				if err != nil {
+					return nil
+				}
+				response, _ = resolved.(map[string]interface{})
+			}
+			return response
+		}
+	}
+	return nil
+}
+
+// validateResponseContract проверяет ответ сервера по OpenAPI спецификации.
+// checkBody = false - тело не проверяется (стриминговый режим)
+func validateResponseContract(r *http.Request, statusCode int, headers http.Header, body []byte, checkBody bool) {
+	if !openAPISettings.Enabled {
+		return
+	}
+
+	operationName, operation := findOpenAPIOperation(r.Method, r.URL.Path)
+	if operation == nil {
+		atomic.AddInt64(&contractUndocumented, 1)
+		requestLogf(r, "📐 OpenAPI: операция %s %s не описана в спецификации", r.Method, r.URL.Path)
+		return
+	}
+	atomic.AddInt64(&contractChecked, 1)
+
+	var errs []string
+	response := findOpenAPIResponse(operation, statusCode)
+	if response == nil {
+		errs = append(errs, fmt.Sprintf("статус %d не описан в спецификации", statusCode))
+	} else if content, ok := response["content"].(map[string]interface{}); ok && len(content) > 0 {
+		// OpenAPI 3: схема задается для каждого media type
+		contentType, _, _ := mime.ParseMediaType(headers.Get("Content-Type"))
+		media, found := findOpenAPIMediaType(content, contentType)
+		if !found {
+			errs = append(errs, fmt.Sprintf("Content-Type '%s' не описан для статуса %d", contentType, statusCode))
+		} else if schema, ok := media["schema"]; ok && checkBody {
+			errs = append(errs, validateContractBody(body, headers, schema)...)
+		}
+	} else if schema, ok := response["schema"]; ok && checkBody {
+		// Swagger 2.0: схема задается прямо в ответе
+		errs = append(errs, validateContractBody(body, headers, schema)...)
+	}
+
+	if len(errs) == 0 {
+		requestLogf(r, "📐 OpenAPI: ответ %d соответствует %s", statusCode, operationName)
+		return
+	}
+
+	atomic.AddInt64(&contractViolations, 1)
+	requestLogf(r, "⚠️  OpenAPI: ответ %d нарушает контракт %s (%d ошибок)", statusCode, operationName, len(errs))
+	for _, e := range errs {
+		requestLogf(r, "   - %s", e)
+	}
+
+	recentViolationsMutex.Lock()
+	recentViolations = append(recentViolations, ContractViolation{
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Operation:  operationName,
+		StatusCode: statusCode,
+		Errors:     errs,
+		At:         time.Now(),
+	})
+	if len(recentViolations) > maxRecentViolations {
+		recentViolations = recentViolations[len(recentViolations)-maxRecentViolations:]
+	}
+	recentViolationsMutex.Unlock()
+}
+
+// findOpenAPIMediaType ищет описание media type: точное совпадение, затем "type/*" и "*/*"
+func findOpenAPIMediaType(content map[string]interface{}, contentType string) (map[string]interface{}, bool) {
+	candidates := []string{contentType}
+	if slash := strings.Index(contentType, "/"); slash > 0 {
+		candidates = append(candidates, contentType[:slash]+"/*")
+	}
+	candidates = append(candidates, "*/*")
+
+	for _, candidate := range candidates {
+		for key, value := range content {
+			if strings.EqualFold(key, candidate) {
+				media, _ := value.(map[string]interface{})
+				return media, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// validateContractBody проверяет JSON тело ответа по схеме из спецификации
+func validateContractBody(body []byte, headers http.Header, schema interface{}) []string {
+	if !isJSONContent(headers.Get("Content-Type"), body) {
+		return nil
+	}
+	var value interface{}
+	if err := json.Unmarshal(decompressIfNeeded(body, headers), &value); err != nil {
+		return []string{fmt.Sprintf("$: тело ответа не является валидным JSON: %v", err)}
+	}
+	return validateJSONSchema(value, schema, openAPISpec, "$")
+}
+
+// openAPIStats возвращает статистику проверки контрактов для /_proxy_stats
+func openAPIStats() map[string]interface{} {
+	recentViolationsMutex.Lock()
+	recent := make([]ContractViolation, len(recentViolations))
+	copy(recent, recentViolations)
+	recentViolationsMutex.Unlock()
+
+	return map[string]interface{}{
+		"enabled":           openAPISettings.Enabled,
+		"spec":              openAPISettings.SpecFile,
+		"checked":           atomic.LoadInt64(&contractChecked),
+		"violations":        atomic.LoadInt64(&contractViolations),
+		"undocumented":      atomic.LoadInt64(&contractUndocumented),
+		"recent_violations": recent,
+	}
+}
+
+// CookieSettings настройки переписывания Set-Cookie и серверного cookie jar
+type CookieSettings struct {
+	RewriteDomain string        // "" - не менять, "strip" - удалить Domain, иначе новый домен
+	RewritePath   string        // "" - не менять, иначе новый Path
+	Secure        string        // "" - не менять, "strip" - убрать Secure, "force" - добавить Secure
+	SameSite      string        // "" - не менять, иначе Lax, Strict или None
+	JarEnabled    bool          // Хранить cookies на стороне прокси
+	JarKey        string        // Ключ клиента для jar: "ip" или имя заголовка
+	JarMaxClients int           // Максимум jar одновременно (COOKIE_JAR_MAX_CLIENTS)
+	JarIdle       time.Duration // Jar без запросов удаляется, когда истекли все его cookies и прошло это время
+}
+
+// clientCookieJar jar клиента с отметками для очистки: последнее обращение и самый поздний
+// срок действия сохраненных cookies (cookies сессии живут, пока jar используется)
+type clientCookieJar struct {
+	*cookiejar.Jar
+	lastUsed atomic.Int64 // UnixNano
+	expires  atomic.Int64 // UnixNano
+}
+
+var cookieSettings CookieSettings
+var cookieJars sync.Map     // map[string]*clientCookieJar
+var cookieJarCount int64    // атомарный
+var cookieJarsEvicted int64 // атомарный
+
+func setupCookieSettings() {
+	cookieSettings.RewriteDomain = os.Getenv("COOKIE_REWRITE_DOMAIN")
+	cookieSettings.RewritePath = os.Getenv("COOKIE_REWRITE_PATH")
+
+	cookieSettings.Secure = strings.ToLower(os.Getenv("COOKIE_SECURE"))
+	if cookieSettings.Secure != "" && cookieSettings.Secure != "strip" && cookieSettings.Secure != "force" {
+		log.Printf("⚠️  Неверное значение COOKIE_SECURE: %s, атрибут Secure не меняется", cookieSettings.Secure)
+		cookieSettings.Secure = ""
+	}
+
+	cookieSettings.SameSite = os.Getenv("COOKIE_SAMESITE")
+	switch strings.ToLower(cookieSettings.SameSite) {
+	case "", "lax", "strict", "none":
+	default:
+		log.Printf("⚠️  Неверное значение COOKIE_SAMESITE: %s, атрибут SameSite не меняется", cookieSettings.SameSite)
+		cookieSettings.SameSite = ""
+	}
+
+	cookieSettings.JarEnabled = os.Getenv("COOKIE_JAR") == "true"
+	cookieSettings.JarKey = os.Getenv("COOKIE_JAR_KEY")
+	if cookieSettings.JarKey == "" {
+		cookieSettings.JarKey = "ip"
+	}
+	cookieSettings.JarMaxClients = 1000
+	if value := os.Getenv("COOKIE_JAR_MAX_CLIENTS"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			cookieSettings.JarMaxClients = parsed
+		} else {
+			log.Printf("⚠️  Неверное значение COOKIE_JAR_MAX_CLIENTS: %s", value)
+		}
+	}
+	cookieSettings.JarIdle = time.Hour
+	if value := os.Getenv("COOKIE_JAR_IDLE"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			cookieSettings.JarIdle = parsed
+		} else {
+			log.Printf("⚠️  Неверный формат COOKIE_JAR_IDLE: %s", value)
+		}
+	}
+	if cookieSettings.JarEnabled {
+		go cookieJarCleanupWorker()
+	}
+}
+
+func printCookieSettings() {
+	log.Printf("🍪 Настройки cookies:")
+	if cookieSettings.RewriteDomain != "" {
+		log.Printf("   Domain: %s", cookieSettings.RewriteDomain)
+	}
+	if cookieSettings.RewritePath != "" {
+		log.Printf("   Path: %s", cookieSettings.RewritePath)
+	}
+	if cookieSettings.Secure != "" {
+		log.Printf("   Secure: %s", cookieSettings.Secure)
+	}
+	if cookieSettings.SameSite != "" {
+		log.Printf("   SameSite: %s", cookieSettings.SameSite)
+	}
+	if cookieSettings.JarEnabled {
+		log.Printf("   Cookie Jar: ✅ (ключ клиента: %s, до %d клиентов, очистка после %v без запросов)", cookieSettings.JarKey, cookieSettings.JarMaxClients, cookieSettings.JarIdle)
+	} else {
+		log.Printf("   Cookie Jar: ❌")
+	}
+	log.Printf("")
+	log.Printf("🔧 Переменные окружения для cookies:")
+	log.Printf("   - COOKIE_REWRITE_DOMAIN=localhost - заменить Domain в Set-Cookie (strip - удалить)")
+	log.Printf("   - COOKIE_REWRITE_PATH=/ - заменить Path в Set-Cookie")
+	log.Printf("   - COOKIE_SECURE=strip - убрать Secure (force - добавить)")
+	log.Printf("   - COOKIE_SAMESITE=Lax - заменить SameSite")
+	log.Printf("   - COOKIE_JAR=true - хранить cookies на стороне прокси")
+	log.Printf("   - COOKIE_JAR_KEY=X-Client-Id - ключ клиента для jar (по умолчанию ip)")
+	log.Printf("   - COOKIE_JAR_MAX_CLIENTS=1000 - максимум jar; при переполнении удаляется самый давно использованный")
+	log.Printf("   - COOKIE_JAR_IDLE=1h - удалять jar без запросов, когда истекли все его cookies")
+	log.Printf("")
+}
+
+// cookieJarKey определяет клиента для серверного cookie jar
+func cookieJarKey(r *http.Request) string {
+	if strings.EqualFold(cookieSettings.JarKey, "ip") {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr
+		}
+		return host
+	}
+	return r.Header.Get(cookieSettings.JarKey)
+}
+
+// getCookieJar возвращает jar клиента, создавая его при необходимости
+func getCookieJar(r *http.Request) *clientCookieJar {
+	key := cookieJarKey(r)
+	if key == "" {
+		return nil
+	}
+	now := time.Now()
+	if value, ok := cookieJars.Load(key); ok {
+		jar := value.(*clientCookieJar)
+		jar.lastUsed.Store(now.UnixNano())
+		return jar
+	}
+	inner, err := cookiejar.New(nil)
+	if err != nil {
+		requestLogf(r, "⚠️  Ошибка создания cookie jar: %v", err)
+		return nil
+	}
+	jar := &clientCookieJar{Jar: inner}
+	jar.lastUsed.Store(now.UnixNano())
+	actual, loaded := cookieJars.LoadOrStore(key, jar)
+	if !loaded && atomic.AddInt64(&cookieJarCount, 1) > int64(cookieSettings.JarMaxClients) {
+		evictCookieJars(now)
+	}
+	return actual.(*clientCookieJar)
+}
+
+// setCookies сохраняет cookies и продлевает срок jar до самого позднего Expires/Max-Age
+func (j *clientCookieJar) setCookies(u *url.URL, cookies []*http.Cookie) {
+	j.SetCookies(u, cookies)
+	now := time.Now()
+	for _, cookie := range cookies {
+		var expires time.Time
+		switch {
+		case cookie.MaxAge > 0:
+			expires = now.Add(time.Duration(cookie.MaxAge) * time.Second)
+		case cookie.MaxAge == 0 && !cookie.Expires.IsZero():
+			expires = cookie.Expires
+		}
+		if current := j.expires.Load(); expires.UnixNano() > current {
+			j.expires.Store(expires.UnixNano())
+		}
+	}
+}
+
+func countCookieJars() int {
+	return int(atomic.LoadInt64(&cookieJarCount))
+}
+
+// cookieJarCleanupWorker раз в минуту удаляет jar, у которых истекли все cookies и которые не
+// использовались COOKIE_JAR_IDLE. Истекшие cookies используемых jar удаляет сам cookiejar при чтении
+func cookieJarCleanupWorker() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		evictCookieJars(now)
+	}
+}
+
+// evictCookieJars удаляет неиспользуемые jar без действующих cookies, а при превышении
+// COOKIE_JAR_MAX_CLIENTS - самые давно использованные
+func evictCookieJars(now time.Time) {
+	type candidate struct {
+		key      interface{}
+		lastUsed int64
+	}
+	var remaining []candidate
+	cookieJars.Range(func(key, value interface{}) bool {
+		jar := value.(*clientCookieJar)
+		lastUsed := jar.lastUsed.Load()
+		idle := now.Sub(time.Unix(0, lastUsed)) > cookieSettings.JarIdle
+		if idle && now.UnixNano() > jar.expires.Load() {
+			removeCookieJar(key, value)
+			return true
+		}
+		remaining = append(remaining, candidate{key: key, lastUsed: lastUsed})
+		return true
+	})
+	if excess := len(remaining) - cookieSettings.JarMaxClients; excess > 0 {
+		sort.Slice(remaining, func(i, j int) bool { return remaining[i].lastUsed < remaining[j].lastUsed })
+		for _, item := range remaining[:excess] {
+			if value, ok := cookieJars.Load(item.key); ok {
+				removeCookieJar(item.key, value)
+			}
+		}
+	}
+}
+
+func removeCookieJar(key, value interface{}) {
+	if cookieJars.CompareAndDelete(key, value) {
+		atomic.AddInt64(&cookieJarCount, -1)
+		atomic.AddInt64(&cookieJarsEvicted, 1)
+	}
+}
+
+// addJarCookies добавляет в запрос к серверу cookies из jar клиента (cookies клиента имеют приоритет)
+func addJarCookies(r *http.Request, proxyReq *http.Request) {
+	if !cookieSettings.JarEnabled {
+		return
+	}
+	jar := getCookieJar(r)
+	if jar == nil {
+		return
+	}
+
+	added := 0
+	for _, cookie := range jar.Cookies(proxyReq.URL) {
+		if _, err := proxyReq.Cookie(cookie.Name); err == nil {
+			continue
+		}
+		proxyReq.AddCookie(cookie)
+		added++
+	}
+	if added > 0 {
+		requestLogf(r, "🍪 Добавлено cookies из jar клиента %s: %d", cookieJarKey(r), added)
+	}
+}
+
+// processResponseCookies сохраняет Set-Cookie в jar клиента (и убирает их из ответа)
+// либо переписывает атрибуты Domain, Path, Secure и SameSite
+func processResponseCookies(r *http.Request, proxyURL *url.URL, headers http.Header) {
+	values := headers.Values("Set-Cookie")
+	if len(values) == 0 {
+		return
+	}
+
+	if cookieSettings.JarEnabled {
+		if jar := getCookieJar(r); jar != nil {
+			cookies := make([]*http.Cookie, 0, len(values))
+			for _, value := range values {
+				if cookie, err := http.ParseSetCookie(value); err == nil {
+					cookies = append(cookies, cookie)
+				}
+			}
+			jar.setCookies(proxyURL, cookies)
+			headers.Del("Set-Cookie")
+			requestLogf(r, "🍪 Сохранено cookies в jar клиента %s: %d", cookieJarKey(r), len(cookies))
+			return
+		}
+	}
+
+	if cookieSettings.RewriteDomain == "" && cookieSettings.RewritePath == "" &&
+		cookieSettings.Secure == "" && cookieSettings.SameSite == "" {
+		return
+	}
+
+	rewritten := make([]string, 0, len(values))
+	for _, value := range values {
+		rewritten = append(rewritten, rewriteSetCookie(value))
+	}
+	headers["Set-Cookie"] = rewritten
+	requestLogf(r, "🍪 Переписано Set-Cookie: %d", len(rewritten))
+}
+
+// rewriteSetCookie меняет атрибуты одного Set-Cookie, сохраняя остальные как есть
+func rewriteSetCookie(value string) string {
+	parts := strings.Split(value, ";")
+	result := []string{strings.TrimSpace(parts[0])}
+	hasSecure, hasSameSite, hasPath := false, false, false
+
+	for _, part := range parts[1:] {
+		attr := strings.TrimSpace(part)
+		if attr == "" {
+			continue
+		}
+		name := strings.ToLower(attr)
+		if eq := strings.Index(name, "="); eq >= 0 {
+			name = strings.TrimSpace(name[:eq])
+		}
+
+		switch name {
+		case "domain":
+			if cookieSettings.RewriteDomain == "strip" {
+				continue
+			}
+			if cookieSettings.RewriteDomain != "" {
+				attr = "Domain=" + cookieSettings.RewriteDomain
+			}
+		case "path":
+			hasPath = true
+			if cookieSettings.RewritePath != "" {
+				attr = "Path=" + cookieSettings.RewritePath
+			}
+		case "secure":
+			if cookieSettings.Secure == "strip" {
+				continue
+			}
+			hasSecure = true
+		case "samesite":
+			hasSameSite = true
+			if cookieSettings.SameSite != "" {
+				attr = "SameSite=" + cookieSettings.SameSite
+			}
+		}
+		result = append(result, attr)
+	}
+
+	if cookieSettings.Secure == "force" && !hasSecure {
+		result = append(result, "Secure")
+	}
+	if cookieSettings.SameSite != "" && !hasSameSite {
+		result = append(result, "SameSite="+cookieSettings.SameSite)
+	}
+	if cookieSettings.RewritePath != "" && !hasPath {
+		result = append(result, "Path="+cookieSettings.RewritePath)
+	}
+	return strings.Join(result, "; ")
+}
+
+// Upstream целевой сервер forward proxy
+type Upstream struct {
+	URL      *url.URL
+	requests int64         // Количество запросов (атомарный)
+	health   *HealthTarget // Проверки здоровья (nil - не проверяется)
+}
+
+// upstreamCookieName cookie прокси с номером upstream (UPSTREAM_AFFINITY=cookie)
+const upstreamCookieName = "_proxy_upstream"
+
+var upstreams []*Upstream
+var upstreamCounter uint64  // Счетчик для round-robin (атомарный)
+var upstreamAffinity string // "", "cookie", "cookie:NAME", "header:NAME", "ip"
+
+// setupUpstreams разбирает PROXY_TARGET (один или несколько URL через запятую) и UPSTREAM_AFFINITY
+func setupUpstreams(targetHost string) {
+	for _, item := range strings.Split(targetHost, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		targetURL, err := url.Parse(item)
+		if err != nil {
+			log.Fatalf("Ошибка парсинга целевого URL: %v", err)
+		}
+		upstreams = append(upstreams, &Upstream{URL: targetURL})
+	}
+	if len(upstreams) == 0 {
+		log.Fatalf("Ошибка парсинга целевого URL: пустой PROXY_TARGET")
+	}
+
+	upstreamAffinity = os.Getenv("UPSTREAM_AFFINITY")
+	switch {
+	case upstreamAffinity == "", upstreamAffinity == "cookie", upstreamAffinity == "ip":
+	case strings.HasPrefix(upstreamAffinity, "cookie:") && len(upstreamAffinity) > len("cookie:"):
+	case strings.HasPrefix(upstreamAffinity, "header:") && len(upstreamAffinity) > len("header:"):
+	default:
+		log.Printf("⚠️  Неверное значение UPSTREAM_AFFINITY: %s, привязка сессий отключена", upstreamAffinity)
+		upstreamAffinity = ""
+	}
+}
+
+func affinityDescription() string {
+	if upstreamAffinity == "" {
+		return "нет"
+	}
+	return upstreamAffinity
+}
+
+// selectUpstream выбирает upstream для запроса: по ключу сессии, если он есть, иначе round-robin
+func selectUpstream(w http.ResponseWriter, r *http.Request) *url.URL {
+	if len(upstreams) == 1 {
+		atomic.AddInt64(&upstreams[0].requests, 1)
+		return upstreams[0].URL
+	}
+
+	index := -1
+	switch {
+	case upstreamAffinity == "cookie":
+		// Номер upstream хранится в собственной cookie прокси
+		if cookie, err := r.Cookie(upstreamCookieName); err == nil {
+			if n, err := strconv.Atoi(cookie.Value); err == nil && n >= 0 && n < len(upstreams) {
+				index = n
+			}
+		}
+	case upstreamAffinity == "ip":
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		index = affinityIndex(host)
+	case strings.HasPrefix(upstreamAffinity, "cookie:"):
+		if cookie, err := r.Cookie(strings.TrimPrefix(upstreamAffinity, "cookie:")); err == nil {
+			index = affinityIndex(cookie.Value)
+		}
+	case strings.HasPrefix(upstreamAffinity, "header:"):
+		index = affinityIndex(r.Header.Get(strings.TrimPrefix(upstreamAffinity, "header:")))
+	}
+
+	reason := "привязка " + upstreamAffinity
+	if index < 0 {
+		index = int((atomic.AddUint64(&upstreamCounter, 1) - 1) % uint64(len(upstreams)))
+		reason = "round-robin"
+		if upstreamAffinity == "cookie" {
+			http.SetCookie(w, &http.Cookie{Name: upstreamCookieName, Value: strconv.Itoa(index), Path: "/", HttpOnly: true})
+		}
+	}
+
+	// Исключенный проверками здоровья upstream заменяется следующим здоровым; если здоровых нет,
+	// запрос идет на выбранный - лучше попытка, чем отказ без попытки
+	if !upstreams[index].health.isHealthy() {
+		if next := nextHealthyUpstream(index); next >= 0 {
+			requestLogf(r, "🩺 Upstream #%d исключен проверками здоровья, запрос на #%d", index, next)
+			index = next
+			reason = "замена исключенного"
+			atomic.AddInt64(&healthReroutes, 1)
+			if upstreamAffinity == "cookie" {
+				http.SetCookie(w, &http.Cookie{Name: upstreamCookieName, Value: strconv.Itoa(index), Path: "/", HttpOnly: true})
+			}
+		} else {
+			requestLogf(r, "⚠️  Все upstream исключены проверками здоровья, запрос на #%d", index)
+		}
+	}
+	requestLogf(r, "⚖️  Upstream #%d (%s): %s", index, reason, upstreams[index].URL.String())
+
+	atomic.AddInt64(&upstreams[index].requests, 1)
+	return upstreams[index].URL
+}
+
+// Mount сервер, смонтированный на префикс пути
+type Mount struct {
+	Prefix      string
+	Target      *url.URL
+	StripPrefix bool
+	requests    int64         // атомарный
+	health      *HealthTarget // Проверки здоровья (nil - не проверяется)
+}
+
+// mountKey - ключ контекста со смонтированным сервером запроса
+type mountKey struct{}
+
+var mounts []*Mount
+
+// setupMounts разбирает PROXY_MOUNTS="/svc-a=http://localhost:3001,/svc-b=http://localhost:3002".
+// Префикс с "!" в конце (/svc-a!=...) передается серверу без удаления
+func setupMounts() {
+	value := os.Getenv("PROXY_MOUNTS")
+	if value == "" {
+		return
+	}
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 {
+			log.Fatalf("❌ Неверный формат PROXY_MOUNTS: %s (ожидается /префикс=URL)", item)
+		}
+		prefix := strings.TrimSpace(parts[0])
+		strip := !strings.HasSuffix(prefix, "!")
+		prefix = "/" + strings.Trim(strings.TrimSuffix(prefix, "!"), "/")
+		if prefix == "/" || strings.HasPrefix(prefix, "/_proxy") {
+			log.Fatalf("❌ Неверный префикс в PROXY_MOUNTS: %s", parts[0])
+		}
+		target, err := url.Parse(strings.TrimSpace(parts[1]))
+		if err != nil || target.Scheme == "" || target.Host == "" {
+			log.Fatalf("❌ Неверный URL в PROXY_MOUNTS: %s", parts[1])
+		}
+		mounts = append(mounts, &Mount{Prefix: prefix, Target: target, StripPrefix: strip})
+	}
+}
+
+func mountStripDescription(mount *Mount) string {
+	if mount.StripPrefix {
+		return " (префикс удаляется)"
+	}
+	return ""
+}
+
+// mountHandler направляет запросы по префиксам PROXY_MOUNTS, остальные - в fallback (PROXY_TARGET).
+// Выбирается самый длинный префикс, совпадающий с путем целыми сегментами. ServeMux не подходит:
+// он перенаправляет неочищенные пути (301) и разбирает "{" в префиксе как шаблон
+func mountHandler(fallback http.Handler) http.Handler {
+	if len(mounts) == 0 {
+		return fallback
+	}
+	sorted := append([]*Mount(nil), mounts...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i].Prefix) > len(sorted[j].Prefix)
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, mount := range sorted {
+			if r.URL.Path != mount.Prefix && !strings.HasPrefix(r.URL.Path, mount.Prefix+"/") {
+				continue
+			}
+			atomic.AddInt64(&mount.requests, 1)
+			requestLogf(r, "🚪 %s → %s", mount.Prefix, mount.Target.String())
+			proxyRequest(w, r.WithContext(context.WithValue(r.Context(), mountKey{}, mount)), mount.Target)
+			return
+		}
+		if fallback != nil {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		requestLogf(r, "🚪 Нет сервера для %s", r.URL.Path)
+		http.Error(w, "Нет сервера для этого пути (см. PROXY_MOUNTS)", http.StatusNotFound)
+	})
+}
+
+// mountedPath возвращает путь запроса для сервера: без префикса монтирования, если его нужно удалять.
+// Правила, кеш и логи видят исходный путь клиента
+func mountedPath(r *http.Request) string {
+	mount, ok := r.Context().Value(mountKey{}).(*Mount)
+	if !ok || !mount.StripPrefix {
+		return r.URL.Path
+	}
+	return "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, mount.Prefix), "/")
+}
+
+func mountStats() []map[string]interface{} {
+	stats := make([]map[string]interface{}, 0, len(mounts))
+	for _, mount := range mounts {
+		stats = append(stats, map[string]interface{}{
+			"prefix":       mount.Prefix,
+			"target":       mount.Target.String(),
+			"strip_prefix": mount.StripPrefix,
+			"requests":     atomic.LoadInt64(&mount.requests),
+			"healthy":      mount.health.isHealthy(),
+		})
+	}
+	return stats
+}
+
+// affinityIndex возвращает номер upstream по хешу ключа сессии (-1 для пустого ключа)
+func affinityIndex(key string) int {
+	if key == "" {
+		return -1
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(len(upstreams)))
+}
+
+func upstreamStats() []map[string]interface{} {
+	stats := make([]map[string]interface{}, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		stats = append(stats, map[string]interface{}{
+			"url":      upstream.URL.String(),
+			"requests": atomic.LoadInt64(&upstream.requests),
+			"healthy":  upstream.health.isHealthy(),
+		})
+	}
+	return stats
+}
+
+// injectHTMLResponse вставляет HTML фрагмент правила в text/html ответ.
+// Сжатое gzip тело распаковывается и сжимается обратно, для однобайтовых кодировок
+// не-ASCII символы фрагмента заменяются на HTML сущности
+func injectHTMLResponse(override *ResponseOverride, headers http.Header, body []byte) []byte {
+	mediaType, params, _ := mime.ParseMediaType(headers.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		log.Printf("⏭️  Правило '%s': ответ не HTML (%s), внедрение пропущено", override.Name, mediaType)
+		return body
+	}
+
+	charset := strings.ToLower(params["charset"])
+	if strings.HasPrefix(charset, "utf-16") || strings.HasPrefix(charset, "utf-32") {
+		log.Printf("⚠️  Правило '%s': кодировка %s не поддерживается для внедрения HTML", override.Name, charset)
+		return body
+	}
+	snippet := override.HTMLInject
+	if charset != "" && charset != "utf-8" && charset != "utf8" {
+		snippet = escapeNonASCIIHTML(snippet)
+	}
+
+	encoding := strings.ToLower(headers.Get("Content-Encoding"))
+	switch encoding {
+	case "", "identity":
+		body = recompressBody(override, headers, injectHTML(body, snippet, override.HTMLInjectPosition), "")
+	case "gzip":
+		decompressed, err := decompressGzip(body)
+		if err != nil {
+			log.Printf("⚠️  Ошибка распаковки gzip для внедрения HTML: %v", err)
+			return body
+		}
+		body = recompressBody(override, headers, injectHTML(decompressed, snippet, override.HTMLInjectPosition), "gzip")
+	default:
+		log.Printf("⚠️  Правило '%s': Content-Encoding %s не поддерживается для внедрения HTML", override.Name, encoding)
+		return body
+	}
+
+	log.Printf("💉 Правило '%s': внедрен HTML фрагмент (%d bytes)", override.Name, len(snippet))
+	return body
+}
+
+// injectHTML вставляет фрагмент перед последним </body> (position "body_end")
+// или сразу после открывающего <head> (position "head"), без учета регистра тегов
+func injectHTML(body []byte, snippet, position string) []byte {
+	lower := bytes.ToLower(body)
+	index := -1
+
+	if position == "head" {
+		if start := htmlTagIndex(lower, "<head"); start >= 0 {
+			if end := bytes.IndexByte(lower[start:], '>'); end >= 0 {
+				index = start + end + 1
+			}
+		} else if start := htmlTagIndex(lower, "<html"); start >= 0 {
+			// Нет <head> - вставляем сразу после <html>
+			if end := bytes.IndexByte(lower[start:], '>'); end >= 0 {
+				index = start + end + 1
+			}
+		} else {
+			index = 0
+		}
+	} else {
+		index = bytes.LastIndex(lower, []byte("</body"))
+		if index < 0 {
+			index = bytes.LastIndex(lower, []byte("</html"))
+		}
+		if index < 0 {
+			index = len(body)
+		}
+	}
+
+	result := make([]byte, 0, len(body)+len(snippet))
+	result = append(result, body[:index]...)
+	result = append(result, snippet...)
+	result = append(result, body[index:]...)
+	return result
+}
+
+// htmlTagIndex ищет открывающий тег (например "<head"), не путая его с "<header"
+func htmlTagIndex(lower []byte, tag string) int {
+	offset := 0
+	for {
+		i := bytes.Index(lower[offset:], []byte(tag))
+		if i < 0 {
+			return -1
+		}
+		i += offset
+		next := i + len(tag)
+		if next >= len(lower) || lower[next] == '>' || lower[next] == ' ' || lower[next] == '\t' || lower[next] == '\n' || lower[next] == '\r' || lower[next] == '/' {
+			return i
+		}
+		offset = next
+	}
+}
+
+// escapeNonASCIIHTML заменяет не-ASCII символы на числовые HTML сущности
+func escapeNonASCIIHTML(s string) string {
+	var builder strings.Builder
+	for _, r := range s {
+		if r < utf8.RuneSelf {
+			builder.WriteRune(r)
+		} else {
+			fmt.Fprintf(&builder, "&#%d;", r)
+		}
+	}
+	return builder.String()
+}
+
+// ClientProfile профиль клиента: User-Agent и сопутствующие заголовки (client hints).
+// Пустое значение заголовка удаляет его из запроса
+type ClientProfile struct {
+	Name    string            `json:"name"`
+	Headers map[string]string `json:"headers"`
+	uses    int64             // Количество запросов с профилем (атомарный)
+}
+
+// clientProfileOverrideHeader заголовок запроса для явного выбора профиля (удаляется перед отправкой)
+const clientProfileOverrideHeader = "X-Proxy-Profile"
+
+// Заголовки client hints, которые отправляют только браузеры на Chromium
+var clientHintHeaders = []string{"Sec-CH-UA", "Sec-CH-UA-Mobile", "Sec-CH-UA-Platform"}
+
+// builtinClientProfiles встроенные профили популярных клиентов
+var builtinClientProfiles = []ClientProfile{
+	{Name: "chrome_windows", Headers: map[string]string{
+		"User-Agent":         "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+		"Sec-CH-UA":          `"Chromium";v="124", "Google Chrome";v="124", "Not-A.Brand";v="99"`,
+		"Sec-CH-UA-Mobile":   "?0",
+		"Sec-CH-UA-Platform": `"Windows"`,
+	}},
+	{Name: "chrome_android", Headers: map[string]string{
+		"User-Agent":         "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Mobile Safari/537.36",
+		"Sec-CH-UA":          `"Chromium";v="124", "Google Chrome";v="124", "Not-A.Brand";v="99"`,
+		"Sec-CH-UA-Mobile":   "?1",
+		"Sec-CH-UA-Platform": `"Android"`,
+	}},
+	{Name: "edge_windows", Headers: map[string]string{
+		"User-Agent":         "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36 Edg/124.0.0.0",
+		"Sec-CH-UA":          `"Chromium";v="124", "Microsoft Edge";v="124", "Not-A.Brand";v="99"`,
+		"Sec-CH-UA-Mobile":   "?0",
+		"Sec-CH-UA-Platform": `"Windows"`,
+	}},
+	{Name: "firefox_linux", Headers: map[string]string{
+		"User-Agent": "Mozilla/5.0 (X11; Linux x86_64; rv:125.0) Gecko/20100101 Firefox/125.0",
+	}},
+	{Name: "safari_macos", Headers: map[string]string{
+		"User-Agent": "Mozilla/5.0 (Macintosh; Intel Mac OS X 14_4_1) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4.1 Safari/605.1.15",
+	}},
+	{Name: "safari_ios", Headers: map[string]string{
+		"User-Agent": "Mozilla/5.0 (iPhone; CPU iPhone OS 17_4_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4.1 Mobile/15E148 Safari/604.1",
+	}},
+	{Name: "curl", Headers: map[string]string{
+		"User-Agent": "curl/8.7.1",
+	}},
+}
+
+var clientProfiles []*ClientProfile
+var clientProfileMode string    // "random", "round_robin", "sticky"
+var clientProfileCounter uint64 // Счетчик для round_robin (атомарный)
+
+func setupClientProfiles() {
+	selected := os.Getenv("UA_PROFILES")
+	file := os.Getenv("UA_PROFILES_FILE")
+	if selected == "" && file == "" {
+		return
+	}
+
+	available := make([]ClientProfile, len(builtinClientProfiles))
+	copy(available, builtinClientProfiles)
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			log.Printf("⚠️  Не удалось прочитать профили %s: %v", file, err)
+		} else {
+			var custom []ClientProfile
+			if err := json.Unmarshal(data, &custom); err != nil {
+				log.Printf("⚠️  Ошибка парсинга профилей %s: %v", file, err)
+			} else {
+				available = append(available, custom...)
+				// Если профили из файла заданы без UA_PROFILES - используем только их
+				if selected == "" {
+					available = custom
+					selected = "all"
+				}
+			}
+		}
+	}
+
+	for i := range available {
+		profile := &available[i]
+		if selected != "all" && !containsName(strings.Split(selected, ","), profile.Name) {
+			continue
+		}
+		clientProfiles = append(clientProfiles, profile)
+	}
+	if len(clientProfiles) == 0 {
+		log.Printf("⚠️  UA_PROFILES: не найдено ни одного профиля из '%s'", selected)
+	}
+
+	clientProfileMode = strings.ToLower(os.Getenv("UA_PROFILE_MODE"))
+	switch clientProfileMode {
+	case "random", "round_robin", "sticky":
+	case "":
+		clientProfileMode = "random"
+	default:
+		log.Printf("⚠️  Неверное значение UA_PROFILE_MODE: %s, используется random", clientProfileMode)
+		clientProfileMode = "random"
+	}
+}
+
+// containsName проверяет наличие имени в списке (без учета пробелов вокруг элементов)
+func containsName(names []string, name string) bool {
+	for _, item := range names {
+		if strings.TrimSpace(item) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func printClientProfileSettings() {
+	log.Printf("🎭 Профили User-Agent:")
+	if len(clientProfiles) > 0 {
+		names := make([]string, 0, len(clientProfiles))
+		for _, profile := range clientProfiles {
+			names = append(names, profile.Name)
+		}
+		log.Printf("   Enabled: ✅")
+		log.Printf("   Profiles: %v", names)
+		log.Printf("   Mode: %s", clientProfileMode)
+	} else {
+		log.Printf("   Enabled: ❌")
+	}
+	log.Printf("")
+	log.Printf("🔧 Переменные окружения для профилей:")
+	log.Printf("   - UA_PROFILES=chrome_windows,safari_ios - встроенные профили через запятую (all - все)")
+	log.Printf("   - UA_PROFILES_FILE=profiles.json - собственные профили")
+	log.Printf("   - UA_PROFILE_MODE=random - выбор профиля: random, round_robin, sticky (по IP клиента)")
+	log.Printf("")
+}
+
+// selectClientProfile выбирает профиль для запроса: явно через X-Proxy-Profile или по режиму
+func selectClientProfile(r *http.Request) *ClientProfile {
+	if name := r.Header.Get(clientProfileOverrideHeader); name != "" {
+		for _, profile := range clientProfiles {
+			if profile.Name == name {
+				return profile
+			}
+		}
+		requestLogf(r, "⚠️  Профиль '%s' из %s не найден", name, clientProfileOverrideHeader)
+	}
+
+	switch clientProfileMode {
+	case "round_robin":
+		return clientProfiles[(atomic.AddUint64(&clientProfileCounter, 1)-1)%uint64(len(clientProfiles))]
+	case "sticky":
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		hash := fnv.New32a()
+		hash.Write([]byte(host))
+		return clientProfiles[hash.Sum32()%uint32(len(clientProfiles))]
+	}
+	return clientProfiles[randomIntn(len(clientProfiles))]
+}
+
+// applyClientProfile подменяет User-Agent и client hints исходящего запроса
+func applyClientProfile(r *http.Request, proxyReq *http.Request) {
+	proxyReq.Header.Del(clientProfileOverrideHeader)
+	if len(clientProfiles) == 0 {
+		return
+	}
+
+	profile := selectClientProfile(r)
+	atomic.AddInt64(&profile.uses, 1)
+
+	// Профиль без client hints описывает браузер, который их не отправляет
+	hasClientHints := false
+	for name := range profile.Headers {
+		if strings.EqualFold(name, "Sec-CH-UA") {
+			hasClientHints = true
+		}
+	}
+	if !hasClientHints {
+		for _, name := range clientHintHeaders {
+			proxyReq.Header.Del(name)
+		}
+	}
+	for name, value := range profile.Headers {
+		if value == "" {
+			proxyReq.Header.Del(name)
+		} else {
+			proxyReq.Header.Set(name, value)
+		}
+	}
+	requestLogf(r, "🎭 Профиль клиента: %s", profile.Name)
+}
+
+func clientProfileStats() map[string]interface{} {
+	uses := make(map[string]int64, len(clientProfiles))
+	for _, profile := range clientProfiles {
+		uses[profile.Name] = atomic.LoadInt64(&profile.uses)
+	}
+	return map[string]interface{}{
+		"enabled": len(clientProfiles) > 0,
+		"mode":    clientProfileMode,
+		"uses":    uses,
+	}
+}
+
+// rateLimitClientKey определяет клиента для отслеживания паузы Retry-After
+func rateLimitClientKey(r *http.Request, limit *RateLimitSimulation) string {
+	if limit.ClientKey == "" || strings.EqualFold(limit.ClientKey, "ip") {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr
+		}
+		return host
+	}
+	return r.Header.Get(limit.ClientKey)
+}
+
+// handleRateLimit отправляет ответ 429 с Retry-After и запоминает, до какого момента клиент должен ждать
+func handleRateLimit(w http.ResponseWriter, r *http.Request, override *ResponseOverride) {
+	key := rateLimitClientKey(r, override.RateLimit)
+	until := time.Now().Add(override.retryAfterDuration)
+
+	override.mutex.Lock()
+	// Клиенты, которые так и не повторили запрос, не накапливаются бесконечно
+	if len(override.backoffUntil) >= 10000 {
+		for client, clientUntil := range override.backoffUntil {
+			if time.Since(clientUntil) > override.retryAfterDuration {
+				delete(override.backoffUntil, client)
+			}
+		}
+	}
+	override.backoffUntil[key] = until
+	override.rateLimited++
+	override.mutex.Unlock()
+
+	requestLogf(r, "🚦 Правило '%s': ответ %d клиенту %s, Retry-After %v", override.Name, rateLimitStatus(override), key, override.retryAfterDuration)
+	writeRateLimitResponse(w, override, until)
+}
+
+// checkBackoffViolation проверяет, не повторил ли клиент запрос к правилу с rate_limit раньше Retry-After.
+// Нарушение логируется и получает 429 с оставшейся паузой; повтор после паузы засчитывается как соблюдение
+func checkBackoffViolation(w http.ResponseWriter, r *http.Request, fullURL string) bool {
+	overrides := currentOverrides(r)
+	for i := range overrides {
+		override := &overrides[i]
+		if override.RateLimit == nil || !override.Enabled {
+			continue
+		}
+		key := rateLimitClientKey(r, override.RateLimit)
+
+		override.mutex.Lock()
+		until, waiting := override.backoffUntil[key]
+		override.mutex.Unlock()
+		if !waiting || overrideMismatch(override, r.Method, fullURL, r.Header.Get("Content-Type"), r) != "" {
+			continue
+		}
+
+		now := time.Now()
+		override.mutex.Lock()
+		if now.Before(until) {
+			override.backoffViolations++
+			override.mutex.Unlock()
+			early := override.retryAfterDuration - until.Sub(now)
+			requestLogf(r, "🚨 Правило '%s': клиент %s нарушил Retry-After - повтор через %v вместо %v", override.Name, key, early.Round(time.Millisecond), override.retryAfterDuration)
+			writeRateLimitResponse(w, override, until)
+			return true
+		}
+		delete(override.backoffUntil, key)
+		override.backoffRespected++
+		override.mutex.Unlock()
+		requestLogf(r, "✅ Правило '%s': клиент %s выждал Retry-After (%v)", override.Name, key, now.Sub(until.Add(-override.retryAfterDuration)).Round(time.Millisecond))
+	}
+	return false
+}
+
+func rateLimitStatus(override *ResponseOverride) int {
+	if override.RateLimit.StatusCode != 0 {
+		return override.RateLimit.StatusCode
+	}
+	return http.StatusTooManyRequests
+}
+
+// writeRateLimitResponse отправляет ответ ограничения частоты с паузой до until
+func writeRateLimitResponse(w http.ResponseWriter, override *ResponseOverride, until time.Time) {
+	for key, value := range override.Headers {
+		w.Header().Set(key, value)
+	}
+	// Retry-After в секундах округляется вверх, чтобы клиент не пришел раньше
+	seconds := int(math.Ceil(time.Until(until).Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	if override.RateLimit.HTTPDate {
+		w.Header().Set("Retry-After", until.UTC().Format(http.TimeFormat))
+	} else {
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+	w.Header().Set("X-RateLimit-Remaining", "0")
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(until.Unix(), 10))
+
+	body := []byte(override.BodyText)
+	if len(body) == 0 {
+		body, _ = json.Marshal(map[string]interface{}{"error": "rate limit exceeded", "retry_after": seconds})
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(rateLimitStatus(override))
+	w.Write(body)
+}
+
+// queryPair параметр query в исходном виде: неизмененные пары уходят серверу байт в байт
+type queryPair struct {
+	raw     string // Пара как в запросе клиента ("" - новая или измененная)
+	name    string
+	value   string
+	invalid bool // Не удалось раскодировать - правила к паре не применяются
+}
+
+func (p queryPair) encode() string {
+	if p.raw != "" {
+		return p.raw
+	}
+	return url.QueryEscape(p.name) + "=" + url.QueryEscape(p.value)
+}
+
+// rewriteQuery применяет изменения query параметров по порядку. Меняются только затронутые пары:
+// set меняет значение первой пары параметра и удаляет остальные, новые параметры дописываются в конец.
+// Если ничего не изменилось, query возвращается как есть
+func rewriteQuery(rawQuery string, rewrites []QueryRewrite) string {
+	var pairs []queryPair
+	for _, raw := range strings.Split(rawQuery, "&") {
+		if raw == "" {
+			continue
+		}
+		rawName, rawValue, _ := strings.Cut(raw, "=")
+		name, nameErr := url.QueryUnescape(rawName)
+		value, valueErr := url.QueryUnescape(rawValue)
+		if nameErr != nil || valueErr != nil {
+			log.Printf("⚠️  Query параметр не раскодирован и не изменяется: %s", raw)
+		}
+		pairs = append(pairs, queryPair{raw: raw, name: name, value: value, invalid: nameErr != nil || valueErr != nil})
+	}
+
+	changed := false
+	for _, rewrite := range rewrites {
+		switch rewrite.Action {
+		case "set":
+			found := false
+			kept := pairs[:0]
+			for _, pair := range pairs {
+				if pair.invalid || pair.name != rewrite.Param {
+					kept = append(kept, pair)
+					continue
+				}
+				if found {
+					changed = true
+					continue
+				}
+				found = true
+				if pair.value != rewrite.Value {
+					pair = queryPair{name: pair.name, value: rewrite.Value}
+					changed = true
+				}
+				kept = append(kept, pair)
+			}
+			pairs = kept
+			if !found {
+				pairs = append(pairs, queryPair{name: rewrite.Param, value: rewrite.Value})
+				changed = true
+			}
+		case "add":
+			pairs = append(pairs, queryPair{name: rewrite.Param, value: rewrite.Value})
+			changed = true
+		case "remove", "replace":
+			kept := pairs[:0]
+			for _, pair := range pairs {
+				if pair.invalid || !matchURLPattern(pair.name, rewrite.Param) ||
+					(rewrite.compiledFind != nil && !rewrite.compiledFind.MatchString(pair.value)) {
+					kept = append(kept, pair)
+					continue
+				}
+				if rewrite.Action == "remove" {
+					changed = true
+					continue
+				}
+				if value := rewrite.compiledFind.ReplaceAllString(pair.value, rewrite.Value); value != pair.value {
+					pair = queryPair{name: pair.name, value: value}
+					changed = true
+				}
+				kept = append(kept, pair)
+			}
+			pairs = kept
+		}
+	}
+	if !changed {
+		return rawQuery
+	}
+
+	encoded := make([]string, len(pairs))
+	for i, pair := range pairs {
+		encoded[i] = pair.encode()
+	}
+	return strings.Join(encoded, "&")
+}
+
+var hostHeadersApplied int64 // Запросы, к которым применена политика заголовков хоста (атомарный)
+
+// applyHostHeaders применяет все политики host_headers, подходящие под хост запроса к серверу
+// (с портом и без); значения заголовков в лог не выводятся
+func applyHostHeaders(r *http.Request, proxyReq *http.Request) {
+	policies := currentHostHeaders(r)
+	if len(policies) == 0 {
+		return
+	}
+	host := proxyReq.URL.Host
+	hostname := proxyReq.URL.Hostname()
+
+	var changes []string
+	for _, policy := range policies {
+		if policy.Host == "" || (!matchURLPattern(host, policy.Host) && !matchURLPattern(hostname, policy.Host)) {
+			continue
+		}
+		for _, name := range policy.Remove {
+			proxyReq.Header.Del(name)
+			changes = append(changes, "-"+name)
+		}
+		for name, value := range policy.Set {
+			proxyReq.Header.Set(name, value)
+			changes = append(changes, "+"+name)
+		}
+	}
+	if len(changes) > 0 {
+		atomic.AddInt64(&hostHeadersApplied, 1)
+		requestLogf(r, "🔑 Заголовки для %s: %s", host, strings.Join(changes, " "))
+	}
+}
+
+var requestsSigned int64       // Подписанные запросы к серверам (атомарный)
+var requestSigningFailed int64 // Запросы, которые не удалось подписать (атомарный)
+
+// compile проверяет алгоритм и декодирует секрет подписчика; ${NAME} в секрете заменяется переменной окружения
+func (s *RequestSigner) compile() error {
+	if s.Host == "" {
+		return fmt.Errorf("не задан host")
+	}
+	switch strings.ToLower(s.Algorithm) {
+	case "", "hmac-sha256", "sha256":
+		s.hash = sha256.New
+	case "hmac-sha1", "sha1":
+		s.hash = sha1.New
+	case "hmac-sha512", "sha512":
+		s.hash = sha512.New
+	default:
+		return fmt.Errorf("неизвестный алгоритм %s (hmac-sha256, hmac-sha1, hmac-sha512)", s.Algorithm)
+	}
+	secret := os.Expand(s.Key, func(key string) string {
+		value, ok := os.LookupEnv(key)
+		if !ok {
+			log.Printf("⚠️  request_signing '%s': переменная окружения %s не установлена", s.Host, key)
+		}
+		return value
+	})
+	var err error
+	switch s.KeyEncoding {
+	case "", "raw":
+		s.key = []byte(secret)
+	case "hex":
+		s.key, err = hex.DecodeString(secret)
+	case "base64":
+		s.key, err = base64.StdEncoding.DecodeString(secret)
+	default:
+		return fmt.Errorf("неизвестное key_encoding %s (raw, hex, base64)", s.KeyEncoding)
+	}
+	if err != nil {
+		return fmt.Errorf("секрет не декодируется как %s: %v", s.KeyEncoding, err)
+	}
+	if len(s.key) == 0 {
+		return fmt.Errorf("пустой секрет")
+	}
+	if s.Encoding != "" && s.Encoding != "hex" && s.Encoding != "base64" {
+		return fmt.Errorf("неизвестное encoding %s (hex, base64)", s.Encoding)
+	}
+	if len(s.Canonical) == 0 {
+		s.Canonical = []string{"method", "path", "query", "body"}
+	}
+	for _, part := range s.Canonical {
+		switch {
+		case part == "method", part == "path", part == "query", part == "host", part == "body", part == "body_sha256":
+		case part == "timestamp":
+			if s.TimestampHeader == "" {
+				s.TimestampHeader = "X-Timestamp"
+			}
+		case strings.HasPrefix(part, "header:"):
+		default:
+			return fmt.Errorf("неизвестная часть канонической строки %s", part)
+		}
+	}
+	if s.Header == "" {
+		s.Header = "X-Signature"
+	}
+	return nil
+}
+
+// matches проверяет, что подписчик подходит под хост (с портом и без) и путь запроса к серверу
+func (s *RequestSigner) matches(proxyReq *http.Request) bool {
+	if s.Host == "" || (!matchURLPattern(proxyReq.URL.Host, s.Host) && !matchURLPattern(proxyReq.URL.Hostname(), s.Host)) {
+		return false
+	}
+	return s.URL == "" || matchURLPattern(proxyReq.URL.Path, s.URL)
+}
+
+// sign вычисляет подпись канонической строки запроса
+func (s *RequestSigner) sign(proxyReq *http.Request, body []byte, timestamp string) string {
+	separator := "\n"
+	if s.Separator != nil {
+		separator = *s.Separator
+	}
+	parts := make([]string, 0, len(s.Canonical))
+	for _, part := range s.Canonical {
+		switch part {
+		case "method":
+			parts = append(parts, proxyReq.Method)
+		case "path":
+			parts = append(parts, proxyReq.URL.EscapedPath())
+		case "query":
+			parts = append(parts, proxyReq.URL.RawQuery)
+		case "host":
+			parts = append(parts, proxyReq.Host)
+		case "body":
+			parts = append(parts, string(body))
+		case "body_sha256":
+			sum := sha256.Sum256(body)
+			parts = append(parts, hex.EncodeToString(sum[:]))
+		case "timestamp":
+			parts = append(parts, timestamp)
+		default:
+			parts = append(parts, proxyReq.Header.Get(strings.TrimPrefix(part, "header:")))
+		}
+	}
+	mac := hmac.New(s.hash, s.key)
+	mac.Write([]byte(strings.Join(parts, separator)))
+	if s.Encoding == "base64" {
+		return s.Prefix + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+	return s.Prefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// usesBody сообщает, входит ли тело в каноническую строку
+func (s *RequestSigner) usesBody() bool {
+	for _, part := range s.Canonical {
+		if part == "body" || part == "body_sha256" {
+			return true
+		}
+	}
+	return false
+}
+
+// signingBody возвращает тело запроса к серверу для подписи. Тело из буфера берется через GetBody,
+// потоковое тело (стриминговый режим, Expect: 100-continue) читается целиком и подставляется заново
+func signingBody(proxyReq *http.Request) ([]byte, error) {
+	if proxyReq.Body == nil || proxyReq.Body == http.NoBody {
+		return nil, nil
+	}
+	if proxyReq.GetBody != nil {
+		body, err := proxyReq.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		defer body.Close()
+		return io.ReadAll(body)
+	}
+	data, err := readBody(proxyReq.Body, proxyReq.ContentLength)
+	proxyReq.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	proxyReq.Body = io.NopCloser(bytes.NewReader(data))
+	proxyReq.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	proxyReq.ContentLength = int64(len(data))
+	return data, nil
+}
+
+// applyRequestSigning добавляет подписи всех подходящих подписчиков; секрет и подпись в лог не выводятся
+func applyRequestSigning(r *http.Request, proxyReq *http.Request) {
+	signers := currentConfig(r).Signing
+	for i := range signers {
+		signer := &signers[i]
+		if !signer.matches(proxyReq) {
+			continue
+		}
+		var body []byte
+		if signer.usesBody() {
+			var err error
+			if body, err = signingBody(proxyReq); err != nil {
+				atomic.AddInt64(&requestSigningFailed, 1)
+				requestLogf(r, "❌ Подпись запроса к %s: ошибка чтения тела: %v", proxyReq.URL.Host, err)
+				continue
+			}
+		}
+		timestamp := ""
+		if signer.TimestampHeader != "" {
+			timestamp = strconv.FormatInt(time.Now().Unix(), 10)
+			proxyReq.Header.Set(signer.TimestampHeader, timestamp)
+		}
+		proxyReq.Header.Set(signer.Header, signer.sign(proxyReq, body, timestamp))
+		atomic.AddInt64(&signer.signed, 1)
+		atomic.AddInt64(&requestsSigned, 1)
+		requestLogf(r, "✍️  Запрос к %s подписан: %s (%s)", proxyReq.URL.Host, signer.Header, strings.Join(signer.Canonical, "+"))
+	}
+}
+
+func requestSigningStats(r *http.Request) map[string]interface{} {
+	signers := currentConfig(r).Signing
+	perSigner := make([]map[string]interface{}, 0, len(signers))
+	for i := range signers {
+		signer := &signers[i]
+		if signer.Host == "" {
+			continue
+		}
+		perSigner = append(perSigner, map[string]interface{}{
+			"host":      signer.Host,
+			"url":       signer.URL,
+			"header":    signer.Header,
+			"canonical": signer.Canonical,
+			"signed":    atomic.LoadInt64(&signer.signed),
+		})
+	}
+	return map[string]interface{}{
+		"signers": perSigner,
+		"signed":  atomic.LoadInt64(&requestsSigned),
+		"failed":  atomic.LoadInt64(&requestSigningFailed),
+	}
+}
+
+// randomSource - общий источник случайных чисел (выбор файла ответа, повреждение тела, профили клиента,
+// генератор данных). С RANDOM_SEED последовательность повторяется от запуска к запуску
+var randomSource *rand.Rand
+var randomMutex sync.Mutex // rand.Rand не потокобезопасен
+var randomSeed int64
+
+func setupRandomSeed() {
+	randomSeed = time.Now().UnixNano()
+	if value := os.Getenv("RANDOM_SEED"); value != "" {
+		if parsed, err := strconv.ParseInt(value, 10, 64); err == nil {
+			randomSeed = parsed
+		} else {
+			log.Printf("⚠️  Неверный формат RANDOM_SEED: %s, используется случайный", value)
+		}
+	}
+	randomSource = rand.New(rand.NewSource(randomSeed))
+}
+
+func printRandomSettings() {
+	log.Printf("🎲 Случайные значения:")
+	if os.Getenv("RANDOM_SEED") != "" {
+		log.Printf("   Seed: %d (детерминированный режим)", randomSeed)
+	} else {
+		log.Printf("   Seed: %d (для повторения запуска: RANDOM_SEED=%d)", randomSeed, randomSeed)
+	}
+	log.Printf("")
+}
+
+func randomIntn(n int) int {
+	randomMutex.Lock()
+	defer randomMutex.Unlock()
+	return randomSource.Intn(n)
+}
+
+func randomInt63n(n int64) int64 {
+	randomMutex.Lock()
+	defer randomMutex.Unlock()
+	return randomSource.Int63n(n)
+}
+
+func randomUint64() uint64 {
+	randomMutex.Lock()
+	defer randomMutex.Unlock()
+	return randomSource.Uint64()
+}
+
+func randomFloat64() float64 {
+	randomMutex.Lock()
+	defer randomMutex.Unlock()
+	return randomSource.Float64()
+}
+
+// ClockSkewRoute сдвиг времени для паттерна URL
+type ClockSkewRoute struct {
+	Pattern string
+	Offset  time.Duration
+}
+
+var clockSkewRoutes []ClockSkewRoute
+var clockSkewHeaders = []string{"Date", "Expires", "Last-Modified"}
+var clockSkewCount int64 // Ответы со сдвинутым временем (атомарный)
+
+func setupClockSkew() {
+	value := os.Getenv("CLOCK_SKEW")
+	if value == "" {
+		return
+	}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		// Значение без паттерна применяется ко всем запросам
+		pattern, offset := "*", item
+		if parts := strings.SplitN(item, "=", 2); len(parts) == 2 {
+			pattern, offset = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		}
+		duration, err := time.ParseDuration(offset)
+		if pattern == "" || err != nil {
+			log.Printf("⚠️  Неверный формат CLOCK_SKEW: %s", item)
+			continue
+		}
+		clockSkewRoutes = append(clockSkewRoutes, ClockSkewRoute{Pattern: pattern, Offset: duration})
+	}
+
+	if headers := os.Getenv("CLOCK_SKEW_HEADERS"); headers != "" {
+		clockSkewHeaders = nil
+		for _, name := range strings.Split(headers, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				clockSkewHeaders = append(clockSkewHeaders, name)
+			}
+		}
+	}
+}
+
+func printClockSkewSettings() {
+	log.Printf("🕰️  Сдвиг времени в заголовках ответов:")
+	if len(clockSkewRoutes) > 0 {
+		log.Printf("   Enabled: ✅")
+		for _, route := range clockSkewRoutes {
+			log.Printf("   %s: %v", route.Pattern, route.Offset)
+		}
+		log.Printf("   Headers: %v", clockSkewHeaders)
+	} else {
+		log.Printf("   Enabled: ❌")
+	}
+	log.Printf("")
+	log.Printf("🔧 Переменные окружения для сдвига времени:")
+	log.Printf("   - CLOCK_SKEW=-5m - часы сервера отстают на 5 минут во всех ответах")
+	log.Printf("   - CLOCK_SKEW=/auth/*=10m,/api/*=-30s - сдвиг по паттернам URL (первый подходящий)")
+	log.Printf("   - CLOCK_SKEW_HEADERS=Date,Expires,Last-Modified - заголовки со временем")
+	log.Printf("")
+}
+
+// resolveClockSkew возвращает сдвиг первого подходящего паттерна CLOCK_SKEW
+func resolveClockSkew(fullURL string) time.Duration {
+	for _, route := range clockSkewRoutes {
+		if matchURLPattern(fullURL, route.Pattern) {
+			return route.Offset
+		}
+	}
+	return 0
+}
+
+// clockSkewWriter сдвигает время в заголовках перед отправкой ответа
+type clockSkewWriter struct {
+	http.ResponseWriter
+	offset      time.Duration
+	wroteHeader bool
+}
+
+func (c *clockSkewWriter) WriteHeader(code int) {
+	if !c.wroteHeader {
+		c.wroteHeader = true
+		skewResponseHeaders(c.Header(), c.offset)
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *clockSkewWriter) Write(p []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+// prepareRaw сдвигает время в заголовках ответа, который пишется в перехваченное соединение
+func (c *clockSkewWriter) prepareRaw(statusCode int, body []byte) []byte {
+	if !c.wroteHeader {
+		c.wroteHeader = true
+		skewResponseHeaders(c.Header(), c.offset)
+	}
+	return body
+}
+
+// Unwrap нужен http.ResponseController: fault injection перехватывает соединение
+func (c *clockSkewWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// Flush сохраняет поддержку стриминга и SSE
+func (c *clockSkewWriter) Flush() {
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// skewResponseHeaders сдвигает HTTP даты заголовков; Date без значения (подменные ответы)
+// заполняется текущим временем со сдвигом, иначе сервер Go подставит настоящее
+func skewResponseHeaders(header http.Header, offset time.Duration) {
+	for _, name := range clockSkewHeaders {
+		value := header.Get(name)
+		if value == "" {
+			if strings.EqualFold(name, "Date") {
+				header.Set(name, time.Now().Add(offset).UTC().Format(http.TimeFormat))
+			}
+			continue
+		}
+		parsed, err := http.ParseTime(value)
+		if err != nil {
+			// Expires: 0 и другие некорректные даты означают "уже истек" и не меняются
+			continue
+		}
+		header.Set(name, parsed.Add(offset).UTC().Format(http.TimeFormat))
+	}
+	atomic.AddInt64(&clockSkewCount, 1)
+}
+
+// clockSkewHandler подключает сдвиг времени к ответам маршрутов из CLOCK_SKEW
+func clockSkewHandler(next http.Handler) http.Handler {
+	if len(clockSkewRoutes) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fullURL := r.URL.Path
+		if r.URL.RawQuery != "" {
+			fullURL += "?" + r.URL.RawQuery
+		}
+		offset := resolveClockSkew(fullURL)
+		if offset == 0 || strings.HasPrefix(r.URL.Path, "/_proxy") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&clockSkewWriter{ResponseWriter: w, offset: offset}, r)
+	})
+}
+
+func clockSkewStats() map[string]interface{} {
+	routes := make(map[string]string, len(clockSkewRoutes))
+	for _, route := range clockSkewRoutes {
+		routes[route.Pattern] = route.Offset.String()
+	}
+	return map[string]interface{}{
+		"enabled":   len(clockSkewRoutes) > 0,
+		"routes":    routes,
+		"headers":   clockSkewHeaders,
+		"responses": atomic.LoadInt64(&clockSkewCount),
+	}
+}
+
+// Режимы сжатия ответов клиентам
+const (
+	compressionAuto     = "auto"     // Сжимать несжатые ответы, если клиент принимает кодирование
+	compressionIdentity = "identity" // Всегда отдавать клиенту распакованное тело
+	compressionOff      = "off"      // Передавать ответ как есть
+)
+
+// compressionMinSize - ответы меньшего размера (по Content-Length) не сжимаются
+const compressionMinSize = 1024
+
+// CompressionRoute режим сжатия для запросов по паттерну
+type CompressionRoute struct {
+	Pattern string
+	Mode    string
+}
+
+var compressionRoutes []CompressionRoute
+var recompressLevel = gzip.DefaultCompression     // Уровень gzip для измененных тел (RECOMPRESS_LEVEL)
+var recompressMinSize int                         // Измененные тела меньше этого размера не сжимаются (RECOMPRESS_MIN_SIZE)
+var recompressedBodies int64                      // атомарный
+var recompressSkipped int64                       // Не сжатые из-за RECOMPRESS_MIN_SIZE (атомарный)
+var serveDecompressed bool                        // SERVE_DECOMPRESSED: всем клиентам отдавать распакованные тела
+var compressionEncodings = []string{"br", "gzip"} // Порядок предпочтения кодирований прокси
+var compressedResponses int64                     // атомарный
+var decompressedResponses int64                   // атомарный
+
+var contentEncoders = map[string]func(io.Writer) io.WriteCloser{
+	"gzip": newPooledGzipWriter,
+}
+var contentDecoders = map[string]func(io.Reader) (io.ReadCloser, error){
+	"gzip": func(r io.Reader) (io.ReadCloser, error) {
+		reader, err := getGzipReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return pooledGzipReader{reader}, nil
+	},
+}
+
+func isCompressionMode(value string) bool {
+	return value == compressionAuto || value == compressionIdentity || value == compressionOff
+}
+
+// setupClientCompression разбирает CLIENT_COMPRESSION: "auto" или "/api/*=auto,/legacy/*=identity"
+func setupClientCompression() {
+	value := os.Getenv("CLIENT_COMPRESSION")
+	if value != "" && !strings.Contains(value, "=") {
+		value = "*=" + value
+	}
+	for _, item := range strings.Split(value, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		mode := strings.ToLower(strings.TrimSpace(parts[len(parts)-1]))
+		if len(parts) != 2 || parts[0] == "" || !isCompressionMode(mode) {
+			log.Printf("⚠️  Неверный формат CLIENT_COMPRESSION: %s (режимы: auto, identity, off)", item)
+			continue
+		}
+		compressionRoutes = append(compressionRoutes, CompressionRoute{Pattern: strings.TrimSpace(parts[0]), Mode: mode})
+	}
+
+	// SERVE_DECOMPRESSED - короткая запись identity для всех запросов, важнее маршрутов CLIENT_COMPRESSION
+	serveDecompressed = os.Getenv("SERVE_DECOMPRESSED") == "true"
+	if serveDecompressed {
+		if len(compressionRoutes) > 0 {
+			log.Printf("⚠️  SERVE_DECOMPRESSED=true: маршруты CLIENT_COMPRESSION не применяются")
+		}
+		compressionRoutes = []CompressionRoute{{Pattern: "*", Mode: compressionIdentity}}
+	}
+
+	if value := os.Getenv("RECOMPRESS_LEVEL"); value != "" {
+		level, err := strconv.Atoi(value)
+		if err != nil || level < gzip.HuffmanOnly || level > gzip.BestCompression {
+			log.Printf("⚠️  Неверный RECOMPRESS_LEVEL: %s (от -2 до 9), используется уровень по умолчанию", value)
+		} else {
+			recompressLevel = level
+		}
+	}
+	if value := os.Getenv("RECOMPRESS_MIN_SIZE"); value != "" {
+		if size, err := strconv.Atoi(value); err == nil && size >= 0 {
+			recompressMinSize = size
+		} else {
+			log.Printf("⚠️  Неверный RECOMPRESS_MIN_SIZE: %s", value)
+		}
+	}
+
+	if value := os.Getenv("CLIENT_COMPRESSION_ENCODINGS"); value != "" {
+		compressionEncodings = nil
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				compressionEncodings = append(compressionEncodings, name)
+			}
+		}
+	}
+}
+
+func printClientCompressionSettings() {
+	log.Printf("🗜️  Сжатие ответов клиентам:")
+	if serveDecompressed {
+		log.Printf("   Serve Decompressed: ✅ (все ответы распаковываются)")
+	} else if len(compressionRoutes) > 0 {
+		for _, route := range compressionRoutes {
+			log.Printf("   %s: %s", route.Pattern, route.Mode)
+		}
+		log.Printf("   Encodings: %v (доступны: %v)", compressionEncodings, availableEncoders())
+	} else {
+		log.Printf("   Enabled: ❌")
+	}
+	log.Printf("   Recompress: level %d, min size %d bytes", recompressLevel, recompressMinSize)
+	log.Printf("")
+	log.Printf("🔧 Переменные окружения для сжатия:")
+	log.Printf("   - CLIENT_COMPRESSION=auto - сжимать несжатые ответы по Accept-Encoding клиента")
+	log.Printf("   - CLIENT_COMPRESSION=/api/*=auto,/legacy/*=identity - режим по паттернам URL (identity - всегда распаковывать)")
+	log.Printf("   - CLIENT_COMPRESSION_ENCODINGS=br,gzip - порядок предпочтения (br - через плагин)")
+	log.Printf("   - SERVE_DECOMPRESSED=true - всегда отдавать клиентам распакованные тела (для отладки клиентов с ошибками gzip)")
+	log.Printf("   - RECOMPRESS_LEVEL=9 - уровень gzip при сжатии измененных тел (1-9, 0 - без сжатия, -1 - по умолчанию, -2 - только Хаффман)")
+	log.Printf("   - RECOMPRESS_MIN_SIZE=1024 - измененные тела меньшего размера отправляются без сжатия")
+	log.Printf("")
+}
+
+func availableEncoders() []string {
+	var names []string
+	for _, name := range compressionEncodings {
+		if contentEncoders[name] != nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// resolveCompressionMode возвращает режим первого подходящего паттерна CLIENT_COMPRESSION
+func resolveCompressionMode(fullURL string) string {
+	for _, route := range compressionRoutes {
+		if matchURLPattern(fullURL, route.Pattern) {
+			return route.Mode
+		}
+	}
+	return compressionOff
+}
+
+// acceptedEncoding выбирает первое кодирование прокси, которое клиент принимает (q > 0)
+func acceptedEncoding(acceptEncoding string) string {
+	accepted := make(map[string]bool)
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		parts := strings.Split(item, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		q := 1.0
+		for _, param := range parts[1:] {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if name != "" {
+			accepted[name] = q > 0
+		}
+	}
+	for _, name := range availableEncoders() {
+		if ok, listed := accepted[name]; ok || (!listed && accepted["*"]) {
+			return name
+		}
+	}
+	return ""
+}
+
+// isCompressibleType - текстовые форматы, которые имеет смысл сжимать
+func isCompressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	}
+	switch {
+	case mediaType == "text/event-stream":
+		// SSE события должны доходить сразу, без буфера кодировщика
+		return false
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"),
+		mediaType == "application/json", mediaType == "application/javascript",
+		mediaType == "application/xml", mediaType == "image/svg+xml",
+		mediaType == "application/graphql-response+json", mediaType == "application/x-www-form-urlencoded":
+		return true
+	}
+	return false
+}
+
+// compressionWriter сжимает или распаковывает тело ответа по решению, принятому при WriteHeader
+type compressionWriter struct {
+	http.ResponseWriter
+	mode           string
+	acceptEncoding string
+	method         string
+	wroteHeader    bool
+
+	encoder io.WriteCloser // Сжатие: запись в кодировщик поверх ответа
+
+	// Распаковка: тело идет через pipe в горутину с декодером
+	pipe    *io.PipeWriter
+	done    chan struct{}
+	writeMu sync.Mutex // Горутина декодера и Flush пишут в один ResponseWriter
+}
+
+func (c *compressionWriter) WriteHeader(code int) {
+	if c.wroteHeader {
+		return
+	}
+	c.wroteHeader = true
+	switch action, encoding := c.negotiate(code); action {
+	case compressionDecode:
+		c.startDecoder(contentDecoders[encoding], encoding)
+	case compressionEncode:
+		c.encoder = contentEncoders[encoding](c.ResponseWriter)
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+// Действия compressionWriter с телом ответа
+const (
+	compressionPass   = iota // Тело передается как есть
+	compressionDecode        // Тело распаковывается декодером
+	compressionEncode        // Тело сжимается кодировщиком
+)
+
+// negotiate выбирает распаковку или сжатие ответа и приводит к ним заголовки
+func (c *compressionWriter) negotiate(code int) (int, string) {
+	header := c.Header()
+	encoding := strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding")))
+	bodyless := c.method == http.MethodHead || code < 200 || code == http.StatusNoContent ||
+		code == http.StatusNotModified || code == http.StatusPartialContent
+
+	switch {
+	case bodyless:
+	case c.mode == compressionIdentity && encoding != "" && encoding != "identity":
+		decoder := contentDecoders[encoding]
+		if decoder == nil {
+			log.Printf("⚠️  Нет декодера для Content-Encoding: %s, ответ передается сжатым", encoding)
+			break
+		}
+		header.Del("Content-Encoding")
+		header.Del("Content-Length")
+		adjustDecompressedHeaders(header)
+		atomic.AddInt64(&decompressedResponses, 1)
+		log.Printf("🔓 Ответ распаковывается для клиента (%s)", encoding)
+		return compressionDecode, encoding
+	case c.mode == compressionAuto && (encoding == "" || encoding == "identity") && isCompressibleType(header.Get("Content-Type")):
+		if length, err := strconv.Atoi(header.Get("Content-Length")); err == nil && length < compressionMinSize {
+			break
+		}
+		name := acceptedEncoding(c.acceptEncoding)
+		if name == "" {
+			break
+		}
+		header.Set("Content-Encoding", name)
+		header.Del("Content-Length")
+		header.Add("Vary", "Accept-Encoding")
+		atomic.AddInt64(&compressedResponses, 1)
+		return compressionEncode, name
+	}
+	return compressionPass, ""
+}
+
+// prepareRaw сжимает или распаковывает тело ответа, который пишется в перехваченное соединение
+func (c *compressionWriter) prepareRaw(statusCode int, body []byte) []byte {
+	if c.wroteHeader {
+		return body
+	}
+	c.wroteHeader = true
+	var out bytes.Buffer
+	switch action, encoding := c.negotiate(statusCode); action {
+	case compressionDecode:
+		reader, err := contentDecoders[encoding](bytes.NewReader(body))
+		if err == nil {
+			_, err = io.Copy(&out, reader)
+			reader.Close()
+		}
+		if err != nil {
+			log.Printf("❌ Ошибка распаковки %s для клиента: %v", encoding, err)
+			return body
+		}
+		return out.Bytes()
+	case compressionEncode:
+		encoder := contentEncoders[encoding](&out)
+		encoder.Write(body)
+		encoder.Close()
+		return out.Bytes()
+	}
+	return body
+}
+
+// recompressBody сжимает измененное тело для клиента кодированием правила (recompress) или исходным
+// (original, "" - тело было несжатым) и приводит к нему Content-Encoding. gzip использует RECOMPRESS_LEVEL,
+// тела меньше RECOMPRESS_MIN_SIZE отправляются без сжатия
+func recompressBody(override *ResponseOverride, header http.Header, body []byte, original string) []byte {
+	encoding := original
+	if override != nil && override.Recompress != "" {
+		encoding = override.Recompress
+	}
+	if encoding == "identity" {
+		encoding = ""
+	}
+	if encoding != "" && len(body) < recompressMinSize {
+		atomic.AddInt64(&recompressSkipped, 1)
+		log.Printf("🔓 Измененное тело %d bytes меньше RECOMPRESS_MIN_SIZE, отправляется без сжатия", len(body))
+		encoding = ""
+	}
+	if encoding == "" {
+		header.Del("Content-Encoding")
+		return body
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	var writer io.WriteCloser
+	var err error
+	if encoding == "gzip" {
+		writer, err = gzip.NewWriterLevel(buf, recompressLevel)
+	} else if encoder := contentEncoders[encoding]; encoder != nil {
+		writer = encoder(buf)
+	} else {
+		err = fmt.Errorf("нет кодировщика")
+	}
+	if err == nil {
+		if _, err = writer.Write(body); err == nil {
+			err = writer.Close()
+		} else {
+			writer.Close()
+		}
+	}
+	if err != nil {
+		log.Printf("⚠️  Ошибка сжатия %s: %v, отправляем без сжатия", encoding, err)
+		header.Del("Content-Encoding")
+		return body
+	}
+
+	compressed := make([]byte, buf.Len())
+	copy(compressed, buf.Bytes())
+	header.Set("Content-Encoding", encoding)
+	header.Del("Content-Length")
+	atomic.AddInt64(&recompressedBodies, 1)
+	log.Printf("🔒 Сжат в %s: %d -> %d bytes", encoding, len(body), len(compressed))
+	return compressed
+}
+
+// digestHeaders контрольные суммы тела, которые перестают совпадать после распаковки
+var digestHeaders = []string{"Content-MD5", "Digest", "Content-Digest", "Repr-Digest"}
+
+// adjustDecompressedHeaders приводит заголовки к распакованному телу: строгий ETag относится
+// к сжатому представлению и становится слабым, контрольные суммы сжатого тела удаляются
+func adjustDecompressedHeaders(header http.Header) {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+	for _, name := range digestHeaders {
+		header.Del(name)
+	}
+}
+
+// startDecoder запускает распаковку: декодер читает записанное тело из pipe
+func (c *compressionWriter) startDecoder(decoder func(io.Reader) (io.ReadCloser, error), encoding string) {
+	reader, writer := io.Pipe()
+	c.pipe = writer
+	c.done = make(chan struct{})
+	go func() {
+		defer close(c.done)
+		decoded, err := decoder(reader)
+		if err != nil {
+			log.Printf("❌ Ошибка распаковки %s для клиента: %v", encoding, err)
+			reader.CloseWithError(err)
+			return
+		}
+		defer decoded.Close()
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := decoded.Read(buf)
+			if n > 0 {
+				c.writeMu.Lock()
+				_, writeErr := c.ResponseWriter.Write(buf[:n])
+				c.writeMu.Unlock()
+				if writeErr != nil {
+					reader.CloseWithError(writeErr)
+					return
+				}
+			}
+			if err != nil {
+				if err != io.EOF {
+					log.Printf("❌ Ошибка распаковки %s для клиента: %v", encoding, err)
+				}
+				reader.CloseWithError(err)
+				return
+			}
+		}
+	}()
+}
+
+func (c *compressionWriter) Write(p []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case c.encoder != nil:
+		return c.encoder.Write(p)
+	case c.pipe != nil:
+		return c.pipe.Write(p)
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+// Unwrap открывает исходный ResponseWriter для http.ResponseController
+func (c *compressionWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// Flush отдает клиенту уже сжатые данные; при распаковке - то, что декодер успел записать
+func (c *compressionWriter) Flush() {
+	if flusher, ok := c.encoder.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		c.writeMu.Lock()
+		flusher.Flush()
+		c.writeMu.Unlock()
+	}
+}
+
+// finish дописывает окончание сжатого потока или дожидается распаковки
+func (c *compressionWriter) finish() {
+	if c.encoder != nil {
+		c.encoder.Close()
+	}
+	if c.pipe != nil {
+		c.pipe.Close()
+		<-c.done
+	}
+}
+
+// compressionHandler подключает сжатие и распаковку ответов маршрутов из CLIENT_COMPRESSION
+func compressionHandler(next http.Handler) http.Handler {
+	if len(compressionRoutes) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fullURL := r.URL.Path
+		if r.URL.RawQuery != "" {
+			fullURL += "?" + r.URL.RawQuery
+		}
+		mode := resolveCompressionMode(fullURL)
+		if mode == compressionOff {
+			next.ServeHTTP(w, r)
+			return
+		}
+		writer := &compressionWriter{ResponseWriter: w, mode: mode, acceptEncoding: r.Header.Get("Accept-Encoding"), method: r.Method}
+		defer writer.finish()
+		next.ServeHTTP(writer, r)
+	})
+}
+
+func clientCompressionStats() map[string]interface{} {
+	routes := make(map[string]string, len(compressionRoutes))
+	for _, route := range compressionRoutes {
+		routes[route.Pattern] = route.Mode
+	}
+	return map[string]interface{}{
+		"routes":             routes,
+		"serve_decompressed": serveDecompressed,
+		"encodings":          availableEncoders(),
+		"compressed":         atomic.LoadInt64(&compressedResponses),
+		"decompressed":       atomic.LoadInt64(&decompressedResponses),
+		"recompress": map[string]interface{}{
+			"level":        recompressLevel,
+			"min_size":     recompressMinSize,
+			"recompressed": atomic.LoadInt64(&recompressedBodies),
+			"skipped":      atomic.LoadInt64(&recompressSkipped),
+		},
+	}
+}
+
+// methodOverrideHeaders заголовки, которыми клиент передает нужный метод в POST запросе
+var methodOverrideHeaders = []string{"X-HTTP-Method-Override", "X-HTTP-Method", "X-Method-Override"}
+
+var methodOverrideEnabled bool
+var methodOverrideCount int64 // Запросы с замененным по заголовку методом (атомарный)
+var forwardMethodCount int64  // Запросы, отправленные серверу другим методом по правилу (атомарный)
+
+// forwardMethodKey - ключ контекста с правилом, меняющим метод запроса к серверу
+type forwardMethodKey struct{}
+
+func setupMethodOverride() {
+	methodOverrideEnabled = os.Getenv("METHOD_OVERRIDE") == "true"
+	if value := os.Getenv("METHOD_OVERRIDE_HEADERS"); value != "" {
+		methodOverrideHeaders = nil
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				methodOverrideHeaders = append(methodOverrideHeaders, name)
+			}
+		}
+	}
+}
+
+func printMethodOverrideSettings() {
+	log.Printf("🔀 Замена метода запроса:")
+	if methodOverrideEnabled {
+		log.Printf("   Enabled: ✅")
+		log.Printf("   Headers: %v", methodOverrideHeaders)
+	} else {
+		log.Printf("   Enabled: ❌")
+	}
+	log.Printf("")
+	log.Printf("🔧 Переменные окружения для замены метода:")
+	log.Printf("   - METHOD_OVERRIDE=true - POST с X-HTTP-Method-Override: DELETE обрабатывается как DELETE")
+	log.Printf("   - METHOD_OVERRIDE_HEADERS=X-HTTP-Method-Override,X-Method - заголовки с методом")
+	log.Printf("")
+}
+
+// applyMethodOverride возвращает копию POST запроса с методом из заголовка; заголовок серверу не передается
+func applyMethodOverride(r *http.Request) *http.Request {
+	if !methodOverrideEnabled || r.Method != http.MethodPost {
+		return r
+	}
+	for _, name := range methodOverrideHeaders {
+		method := strings.ToUpper(strings.TrimSpace(r.Header.Get(name)))
+		if method == "" {
+			continue
+		}
+		if strings.ContainsAny(method, " \t/") {
+			requestLogf(r, "⚠️  Неверный метод в %s: %s", name, method)
+			return r
+		}
+		overridden := r.WithContext(r.Context())
+		overridden.Method = method
+		overridden.Header = r.Header.Clone()
+		for _, header := range methodOverrideHeaders {
+			overridden.Header.Del(header)
+		}
+		atomic.AddInt64(&methodOverrideCount, 1)
+		requestLogf(r, "🔀 Метод POST заменен на %s по заголовку %s", method, name)
+		return overridden
+	}
+	return r
+}
+
+// applyForwardMethod отправляет запрос серверу методом из forward_method сработавшего правила;
+// исходный метод передается в forward_method_header
+func applyForwardMethod(r *http.Request, proxyReq *http.Request) {
+	override, ok := r.Context().Value(forwardMethodKey{}).(*ResponseOverride)
+	if !ok {
+		return
+	}
+	if override.ForwardMethodHeader != "" {
+		proxyReq.Header.Set(override.ForwardMethodHeader, r.Method)
+	}
+	proxyReq.Method = strings.ToUpper(override.ForwardMethod)
+	atomic.AddInt64(&forwardMethodCount, 1)
+}
+
+func methodOverrideStats() map[string]interface{} {
+	return map[string]interface{}{
+		"enabled":          methodOverrideEnabled,
+		"headers":          methodOverrideHeaders,
+		"overridden":       atomic.LoadInt64(&methodOverrideCount),
+		"forward_rewrites": atomic.LoadInt64(&forwardMethodCount),
+	}
+}
+
+// HeaderScrubRoute режим очистки заголовков для паттерна URL
+type HeaderScrubRoute struct {
+	Pattern string
+	Mode    string // "strip" - удалить заголовки, "spoof" - заменить нейтральными значениями
+}
+
+// fingerprintHeaders заголовки, раскрывающие адреса и окружение клиента
+var fingerprintHeaders = []string{
+	"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Forwarded-Port",
+	"X-Real-IP", "X-Client-IP", "True-Client-IP", "CF-Connecting-IP", "Forwarded", "Via",
+	"Referer", "Origin",
+}
+
+var headerScrubRoutes []HeaderScrubRoute
+var headerScrubExtra []string // Дополнительные заголовки для удаления (HEADER_SCRUB_HEADERS)
+var headerScrubIP string      // Адрес клиента для режима spoof
+var headerScrubCount int64    // Количество очищенных запросов (атомарный)
+
+func setupHeaderScrub() {
+	value := os.Getenv("HEADER_SCRUB")
+	if value == "" {
+		return
+	}
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		// Значение без паттерна применяется ко всем запросам
+		pattern, mode := "*", item
+		if parts := strings.SplitN(item, "=", 2); len(parts) == 2 {
+			pattern, mode = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		}
+		mode = strings.ToLower(mode)
+		if pattern == "" || (mode != "strip" && mode != "spoof" && mode != "off") {
+			log.Printf("⚠️  Неверный формат HEADER_SCRUB: %s", item)
+			continue
+		}
+		headerScrubRoutes = append(headerScrubRoutes, HeaderScrubRoute{Pattern: pattern, Mode: mode})
+	}
+
+	if extra := os.Getenv("HEADER_SCRUB_HEADERS"); extra != "" {
+		for _, name := range strings.Split(extra, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				headerScrubExtra = append(headerScrubExtra, name)
+			}
+		}
+	}
+
+	headerScrubIP = os.Getenv("HEADER_SCRUB_IP")
+	if headerScrubIP == "" {
+		headerScrubIP = "203.0.113.1" // TEST-NET-3, не маршрутизируется
+	}
+}
+
+func printHeaderScrubSettings() {
+	log.Printf("🕶️  Очистка заголовков клиента:")
+	if len(headerScrubRoutes) > 0 {
+		log.Printf("   Enabled: ✅")
+		for _, route := range headerScrubRoutes {
+			log.Printf("   %s: %s", route.Pattern, route.Mode)
+		}
+		if len(headerScrubExtra) > 0 {
+			log.Printf("   Extra Headers: %v", headerScrubExtra)
+		}
+		log.Printf("   Spoof IP: %s", headerScrubIP)
+	} else {
+		log.Printf("   Enabled: ❌")
+	}
+	log.Printf("")
+	log.Printf("🔧 Переменные окружения для очистки заголовков:")
+	log.Printf("   - HEADER_SCRUB=strip - удалять X-Forwarded-For, Via, Referer, client hints во всех запросах")
+	log.Printf("   - HEADER_SCRUB=/partner/*=spoof,/internal/*=off - режимы по паттернам URL (strip, spoof, off)")
+	log.Printf("   - HEADER_SCRUB_HEADERS=X-Request-Id,X-Debug - дополнительные заголовки для удаления")
+	log.Printf("   - HEADER_SCRUB_IP=203.0.113.1 - адрес клиента в режиме spoof")
+	log.Printf("")
+}
+
+// resolveHeaderScrubMode возвращает режим первого подходящего паттерна HEADER_SCRUB
+func resolveHeaderScrubMode(fullURL string) string {
+	for _, route := range headerScrubRoutes {
+		if matchURLPattern(fullURL, route.Pattern) {
+			return route.Mode
+		}
+	}
+	return "off"
+}
+
+// applyHeaderScrub удаляет или нормализует заголовки, раскрывающие клиента, в исходящем запросе
+func applyHeaderScrub(r *http.Request, proxyReq *http.Request) {
+	if len(headerScrubRoutes) == 0 {
+		return
+	}
+
+	fullURL := r.URL.Path
+	if r.URL.RawQuery != "" {
+		fullURL += "?" + r.URL.RawQuery
+	}
+	mode := resolveHeaderScrubMode(fullURL)
+	if mode == "off" {
+		return
+	}
+
+	referer := proxyReq.Header.Get("Referer")
+	for _, name := range fingerprintHeaders {
+		proxyReq.Header.Del(name)
+	}
+	for _, name := range headerScrubExtra {
+		proxyReq.Header.Del(name)
+	}
+	for name := range proxyReq.Header {
+		if strings.HasPrefix(strings.ToLower(name), "sec-ch-") {
+			proxyReq.Header.Del(name)
+		}
+	}
+
+	if mode == "spoof" {
+		proxyReq.Header.Set("X-Forwarded-For", headerScrubIP)
+		// Referer сокращается до адреса сервера, как при политике strict-origin
+		if referer != "" {
+			proxyReq.Header.Set("Referer", proxyReq.URL.Scheme+"://"+proxyReq.URL.Host+"/")
+		}
+	}
+
+	atomic.AddInt64(&headerScrubCount, 1)
+	requestLogf(r, "🕶️  Заголовки клиента очищены (%s)", mode)
+}
+
+func headerScrubStats() map[string]interface{} {
+	routes := make(map[string]string, len(headerScrubRoutes))
+	for _, route := range headerScrubRoutes {
+		routes[route.Pattern] = route.Mode
+	}
+	return map[string]interface{}{
+		"enabled":  len(headerScrubRoutes) > 0,
+		"routes":   routes,
+		"scrubbed": atomic.LoadInt64(&headerScrubCount),
+	}
+}
+
+// HeaderCaseRoute режим регистра имен заголовков для паттерна URL
+type HeaderCaseRoute struct {
+	Pattern string
+	Mode    string // "canonical" - как в Go (X-Api-Key), "preserve" - как прислал клиент, "lower" - строчными
+}
+
+// transportHeaders заголовки, которые http.Transport пишет сам по каноническому имени:
+// под другим именем они ушли бы на сервер дважды
+var transportHeaders = map[string]bool{
+	"Host": true, "User-Agent": true, "Content-Length": true, "Transfer-Encoding": true, "Trailer": true,
+}
+
+var headerCaseRoutes []HeaderCaseRoute
+var headerCaseNames = make(map[string]string) // Каноническое имя -> точное имя из HEADER_CASE_MAP
+var headerDuplicates = "preserve"             // preserve, first, last, join
+var headerRecasedCount int64                  // Запросов с переименованными заголовками (атомарный)
+var headerDuplicatesMerged int64              // Объединенных повторяющихся заголовков (атомарный)
+
+func setupHeaderCasing() {
+	if value := os.Getenv("HEADER_CASE"); value != "" {
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+			// Значение без паттерна применяется ко всем запросам
+			pattern, mode := "*", item
+			if parts := strings.SplitN(item, "=", 2); len(parts) == 2 {
+				pattern, mode = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+			}
+			mode = strings.ToLower(mode)
+			if pattern == "" || (mode != "canonical" && mode != "preserve" && mode != "lower") {
+				log.Printf("⚠️  Неверный формат HEADER_CASE: %s", item)
+				continue
+			}
+			headerCaseRoutes = append(headerCaseRoutes, HeaderCaseRoute{Pattern: pattern, Mode: mode})
+		}
+	}
+
+	if value := os.Getenv("HEADER_CASE_MAP"); value != "" {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				headerCaseNames[http.CanonicalHeaderKey(name)] = name
+			}
+		}
+	}
+
+	if value := strings.ToLower(os.Getenv("HEADER_DUPLICATES")); value != "" {
+		if value != "preserve" && value != "first" && value != "last" && value != "join" {
+			log.Printf("⚠️  Неверное значение HEADER_DUPLICATES: %s", value)
+		} else {
+			headerDuplicates = value
+		}
+	}
+}
+
+func printHeaderCasingSettings() {
+	log.Printf("🔠 Регистр и повторы заголовков:")
+	if len(headerCaseRoutes) > 0 || len(headerCaseNames) > 0 || headerDuplicates != "preserve" {
+		log.Printf("   Enabled: ✅")
+		for _, route := range headerCaseRoutes {
+			log.Printf("   %s: %s", route.Pattern, route.Mode)
+		}
+		if len(headerCaseNames) > 0 {
+			log.Printf("   Exact Names: %v", headerCaseNameList())
+		}
+		log.Printf("   Duplicates: %s", headerDuplicates)
+	} else {
+		log.Printf("   Enabled: ❌ (имена в каноническом виде Go, повторы передаются как есть)")
+	}
+	log.Printf("")
+	log.Printf("🔧 Переменные окружения для регистра заголовков:")
+	log.Printf("   - HEADER_CASE=preserve - передавать имена заголовков в регистре клиента")
+	log.Printf("   - HEADER_CASE=/legacy/*=preserve,/v2/*=lower - режимы по паттернам URL (canonical, preserve, lower)")
+	log.Printf("   - HEADER_CASE_MAP=SOAPAction,x-api-key - точное написание отдельных заголовков")
+	log.Printf("   - HEADER_DUPLICATES=join - повторяющиеся заголовки: preserve, first, last, join")
+	log.Printf("")
+}
+
+func headerCaseNameList() []string {
+	names := make([]string, 0, len(headerCaseNames))
+	for _, name := range headerCaseNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resolveHeaderCaseMode возвращает режим первого подходящего паттерна HEADER_CASE
+func resolveHeaderCaseMode(fullURL string) string {
+	for _, route := range headerCaseRoutes {
+		if matchURLPattern(fullURL, route.Pattern) {
+			return route.Mode
+		}
+	}
+	return "canonical"
+}
+
+// applyHeaderCasing объединяет повторяющиеся заголовки и переименовывает их в нужный регистр.
+// Вызывается последним перед отправкой: после него Header.Get не находит переименованные заголовки
+func applyHeaderCasing(r *http.Request, proxyReq *http.Request) {
+	if len(headerCaseRoutes) == 0 && len(headerCaseNames) == 0 && headerDuplicates == "preserve" {
+		return
+	}
+
+	if headerDuplicates != "preserve" {
+		for name, values := range proxyReq.Header {
+			// Set-Cookie нельзя объединять через запятую
+			if len(values) < 2 || name == "Set-Cookie" {
+				continue
+			}
+			switch headerDuplicates {
+			case "first":
+				proxyReq.Header[name] = values[:1]
+			case "last":
+				proxyReq.Header[name] = values[len(values)-1:]
+			case "join":
+				separator := ", "
+				if name == "Cookie" {
+					separator = "; "
+				}
+				proxyReq.Header[name] = []string{strings.Join(values, separator)}
+			}
+			atomic.AddInt64(&headerDuplicatesMerged, 1)
+			requestLogf(r, "🔠 Повторяющийся заголовок %s (%d значений): %s", name, len(values), headerDuplicates)
+		}
+	}
+
+	fullURL := r.URL.Path
+	if r.URL.RawQuery != "" {
+		fullURL += "?" + r.URL.RawQuery
+	}
+	mode := resolveHeaderCaseMode(fullURL)
+	var rawNames map[string]string
+	if mode == "preserve" {
+		rawNames, _ = r.Context().Value(rawHeaderNamesKey{}).(map[string]string)
+	}
+
+	var renamed []string
+	for name, values := range proxyReq.Header {
+		if transportHeaders[name] {
+			continue
+		}
+		target, ok := headerCaseNames[name]
+		if !ok {
+			switch mode {
+			case "preserve":
+				target, ok = rawNames[name]
+			case "lower":
+				target, ok = strings.ToLower(name), true
+			}
+		}
+		if !ok || target == name {
+			continue
+		}
+		delete(proxyReq.Header, name)
+		proxyReq.Header[target] = append(proxyReq.Header[target], values...)
+		renamed = append(renamed, target)
+	}
+	if len(renamed) > 0 {
+		sort.Strings(renamed)
+		atomic.AddInt64(&headerRecasedCount, 1)
+		requestLogf(r, "🔠 Имена заголовков (%s): %s", mode, strings.Join(renamed, ", "))
+	}
+}
+
+func headerCasingStats() map[string]interface{} {
+	routes := make(map[string]string, len(headerCaseRoutes))
+	for _, route := range headerCaseRoutes {
+		routes[route.Pattern] = route.Mode
+	}
+	return map[string]interface{}{
+		"routes":            routes,
+		"exact_names":       headerCaseNameList(),
+		"duplicates":        headerDuplicates,
+		"recased":           atomic.LoadInt64(&headerRecasedCount),
+		"duplicates_merged": atomic.LoadInt64(&headerDuplicatesMerged),
+	}
+}
+
+// rawHeaderWindow сколько последних прочитанных байт соединения хранится для поиска имен заголовков
+const rawHeaderWindow = 32 << 10
+
+// rawHeaderConn запоминает байты блока заголовков, прочитанные из соединения клиента:
+// net/http приводит имена заголовков к каноническому виду, а исходное написание остается только здесь.
+// После пустой строки запись останавливается - тело запроса не копируется; rawHeaderHandler
+// возобновляет ее, когда запрос обработан
+type rawHeaderConn struct {
+	net.Conn
+	mutex    sync.Mutex
+	recent   []byte
+	complete bool // Блок заголовков прочитан
+}
+
+func (c *rawHeaderConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.mutex.Lock()
+		if !c.complete {
+			// Конец блока может прийти на стыке двух чтений
+			from := max(len(c.recent)-3, 0)
+			c.recent = append(c.recent, p[:n]...)
+			c.complete = bytes.Contains(c.recent[from:], []byte("\r\n\r\n"))
+			if len(c.recent) > rawHeaderWindow {
+				c.recent = append(c.recent[:0], c.recent[len(c.recent)-rawHeaderWindow:]...)
+			}
+		}
+		c.mutex.Unlock()
+	}
+	return n, err
+}
+
+// rearm очищает записанное и ждет заголовков следующего запроса соединения
+func (c *rawHeaderConn) rearm() {
+	c.mutex.Lock()
+	c.recent = c.recent[:0]
+	c.complete = false
+	c.mutex.Unlock()
+}
+
+// rawHeaderNames исходные имена заголовков запроса по последней строке запроса в прочитанных байтах
+func (c *rawHeaderConn) rawHeaderNames(r *http.Request) map[string]string {
+	requestLine := []byte(r.Method + " " + r.RequestURI + " " + r.Proto + "\r\n")
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	start := bytes.LastIndex(c.recent, requestLine)
+	if start < 0 {
+		return nil
+	}
+	names := make(map[string]string)
+	for _, line := range bytes.Split(c.recent[start+len(requestLine):], []byte("\r\n")) {
+		colon := bytes.IndexByte(line, ':')
+		if len(line) == 0 || colon <= 0 {
+			break
+		}
+		name := string(line[:colon])
+		canonical := http.CanonicalHeaderKey(name)
+		// Имена, которых нет среди разобранных заголовков, - мусор из тела или другого запроса
+		if _, exists := names[canonical]; !exists && r.Header[canonical] != nil {
+			names[canonical] = name
+		}
+	}
+	return names
+}
+
+// rawHeaderListener оборачивает соединения клиентов для режима HEADER_CASE=preserve
+type rawHeaderListener struct {
+	net.Listener
+}
+
+func (l rawHeaderListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &rawHeaderConn{Conn: conn}, nil
+}
+
+func wrapRawHeaderListener(listener net.Listener) net.Listener {
+	for _, route := range headerCaseRoutes {
+		if route.Mode == "preserve" {
+			return rawHeaderListener{Listener: listener}
+		}
+	}
+	return listener
+}
+
+type rawHeaderConnKey struct{}
+type rawHeaderNamesKey struct{}
+
+// rawHeaderConnContext передает обернутое соединение обработчикам его запросов
+func rawHeaderConnContext(ctx context.Context, conn net.Conn) context.Context {
+	if raw, ok := conn.(*rawHeaderConn); ok {
+		return context.WithValue(ctx, rawHeaderConnKey{}, raw)
+	}
+	return ctx
+}
+
+// rawHeaderHandler сохраняет исходные имена заголовков в контексте запроса и после ответа
+// возобновляет запись для следующего запроса соединения
+func rawHeaderHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, ok := r.Context().Value(rawHeaderConnKey{}).(*rawHeaderConn)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if names := conn.rawHeaderNames(r); len(names) > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), rawHeaderNamesKey{}, names))
+		}
+		body := r.Body
+		next.ServeHTTP(w, r)
+
+		// Туннели и WebSocket передают по соединению не HTTP
+		if r.Method == http.MethodConnect || r.Header.Get("Upgrade") != "" {
+			return
+		}
+		// Остаток тела net/http дочитает после обработчика - дочитываем сами, чтобы он не попал
+		// в запись; при большем остатке net/http закрывает соединение
+		if body != nil {
+			io.Copy(io.Discard, io.LimitReader(body, 256<<10))
+		}
+		conn.rearm()
+	})
+}
+
+// KeepAliveRoute режим keep-alive для паттерна URL
+type KeepAliveRoute struct {
+	Pattern string
+	Mode    string // "on", "off" - закрывать оба соединения, "client" - только с клиентом, "upstream" - только с сервером
+}
+
+var keepAliveRoutes []KeepAliveRoute
+var keepAliveClientClosed int64  // Соединений с клиентом, закрытых после ответа (атомарный)
+var keepAliveUpstreamFresh int64 // Запросов к серверу без переиспользования соединения (атомарный)
+
+type keepAliveModeKey struct{}
+
+func setupKeepAlive() {
+	value := os.Getenv("KEEPALIVE")
+	if value == "" {
+		return
+	}
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		// Значение без паттерна применяется ко всем запросам
+		pattern, mode := "*", item
+		if parts := strings.SplitN(item, "=", 2); len(parts) == 2 {
+			pattern, mode = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		}
+		mode = strings.ToLower(mode)
+		if pattern == "" || (mode != "on" && mode != "off" && mode != "client" && mode != "upstream") {
+			log.Printf("⚠️  Неверный формат KEEPALIVE: %s", item)
+			continue
+		}
+		keepAliveRoutes = append(keepAliveRoutes, KeepAliveRoute{Pattern: pattern, Mode: mode})
+	}
+}
+
+func printKeepAliveSettings() {
+	log.Printf("🔁 Keep-alive соединений:")
+	if len(keepAliveRoutes) > 0 {
+		for _, route := range keepAliveRoutes {
+			log.Printf("   %s: %s", route.Pattern, route.Mode)
+		}
+	} else {
+		log.Printf("   Все маршруты: on (соединения переиспользуются)")
+	}
+	log.Printf("")
+	log.Printf("🔧 Переменные окружения для keep-alive:")
+	log.Printf("   - KEEPALIVE=off - новое соединение с клиентом и сервером для каждого запроса")
+	log.Printf("   - KEEPALIVE=/legacy/*=off,/upload/*=upstream,/api/*=client - режимы по паттернам URL (on, off, client, upstream)")
+	log.Printf("")
+}
+
+// resolveKeepAliveMode возвращает режим первого подходящего паттерна KEEPALIVE
+func resolveKeepAliveMode(fullURL string) string {
+	for _, route := range keepAliveRoutes {
+		if matchURLPattern(fullURL, route.Pattern) {
+			return route.Mode
+		}
+	}
+	return "on"
+}
+
+// keepAliveHandler отвечает с Connection: close на маршрутах без keep-alive к клиенту
+// и запоминает режим для запроса к серверу
+func keepAliveHandler(next http.Handler) http.Handler {
+	if len(keepAliveRoutes) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/_proxy") || r.Method == http.MethodConnect {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		fullURL := r.URL.Path
+		if r.URL.RawQuery != "" {
+			fullURL += "?" + r.URL.RawQuery
+		}
+		mode := resolveKeepAliveMode(fullURL)
+		if mode == "off" || mode == "client" {
+			// net/http закрывает соединение после ответа с этим заголовком
+			w.Header().Set("Connection", "close")
+			atomic.AddInt64(&keepAliveClientClosed, 1)
+			log.Printf("🔁 Соединение с клиентом будет закрыто после ответа (KEEPALIVE=%s)", mode)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), keepAliveModeKey{}, mode)))
+	})
+}
+
+// applyUpstreamKeepAlive отправляет запрос серверу с Connection: close. Новое соединение
+// обеспечивает клиент без пула (см. clientForRequest)
+func applyUpstreamKeepAlive(r *http.Request, proxyReq *http.Request) {
+	mode, _ := r.Context().Value(keepAliveModeKey{}).(string)
+	if mode != "off" && mode != "upstream" {
+		return
+	}
+	proxyReq.Close = true
+	atomic.AddInt64(&keepAliveUpstreamFresh, 1)
+	requestLogf(r, "🔁 Запрос к серверу по новому соединению (Connection: close)")
+}
+
+func keepAliveStats() map[string]interface{} {
+	routes := make(map[string]string, len(keepAliveRoutes))
+	for _, route := range keepAliveRoutes {
+		routes[route.Pattern] = route.Mode
+	}
+	return map[string]interface{}{
+		"routes":          routes,
+		"client_closed":   atomic.LoadInt64(&keepAliveClientClosed),
+		"upstream_closed": atomic.LoadInt64(&keepAliveUpstreamFresh),
+	}
+}
+
+var rawPassthroughPatterns []string // Паттерны URL, соединения с которыми передаются на сервер как есть
+var rawPassthroughLog bool          // Логировать передаваемые байты
+var rawPassthroughConnections int64 // Переданных соединений (атомарный)
+var rawPassthroughBytesUp int64     // Байт от клиента к серверу (атомарный)
+var rawPassthroughBytesDown int64   // Байт от сервера к клиенту (атомарный)
+var rawPassthroughErrors int64      // Ошибок подключения к серверу (атомарный)
+
+// rawHeadLimit максимальный размер строки запроса и заголовков, которые читаются для выбора режима
+const rawHeadLimit = 64 << 10
+
+// rawLogChunkLimit сколько байт каждого фрагмента выводится при RAW_PASSTHROUGH_LOG
+const rawLogChunkLimit = 2048
+
+func setupRawPassthrough() {
+	if value := os.Getenv("RAW_PASSTHROUGH"); value != "" {
+		for _, pattern := range strings.Split(value, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				rawPassthroughPatterns = append(rawPassthroughPatterns, pattern)
+			}
+		}
+	}
+	rawPassthroughLog = os.Getenv("RAW_PASSTHROUGH_LOG") == "true"
+}
+
+func printRawPassthroughSettings() {
+	log.Printf("🧱 Передача байт в байт (raw HTTP/1.1):")
+	if len(rawPassthroughPatterns) > 0 {
+		log.Printf("   Enabled: ✅")
+		log.Printf("   Patterns: %v", rawPassthroughPatterns)
+		log.Printf("   Log Bytes: %v", rawPassthroughLog)
+		if proxySettings.Enabled {
+			log.Printf("   ⚠️  UPSTREAM_PROXY не используется: соединение открывается напрямую")
+		}
+	} else {
+		log.Printf("   Enabled: ❌")
+	}
+	log.Printf("")
+	log.Printf("🔧 Переменные окружения для передачи байт в байт:")
+	log.Printf("   - RAW_PASSTHROUGH=/legacy/*,/chunked-bug - соединения с этими URL передаются на сервер без разбора net/http")
+	log.Printf("   - RAW_PASSTHROUGH_LOG=true - логировать передаваемые байты в обе стороны")
+	log.Printf("")
+}
+
+func rawPassthroughStats() map[string]interface{} {
+	return map[string]interface{}{
+		"patterns":    rawPassthroughPatterns,
+		"connections": atomic.LoadInt64(&rawPassthroughConnections),
+		"bytes_up":    atomic.LoadInt64(&rawPassthroughBytesUp),
+		"bytes_down":  atomic.LoadInt64(&rawPassthroughBytesDown),
+		"errors":      atomic.LoadInt64(&rawPassthroughErrors),
+	}
+}
+
+// rawPassthroughListener проверяет первый запрос каждого соединения до того, как его разберет net/http
+type rawPassthroughListener struct {
+	net.Listener
+}
+
+func (l rawPassthroughListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &rawPassthroughConn{Conn: conn}, nil
+}
+
+func wrapRawPassthroughListener(listener net.Listener) net.Listener {
+	if len(rawPassthroughPatterns) == 0 {
+		return listener
+	}
+	return rawPassthroughListener{Listener: listener}
+}
+
+// rawPassthroughConn при первом чтении читает заголовки запроса. Если URL подходит под RAW_PASSTHROUGH,
+// соединение целиком передается на сервер, а net/http получает EOF; иначе прочитанные байты отдаются net/http
+type rawPassthroughConn struct {
+	net.Conn
+	once    sync.Once
+	relayed bool
+	pending []byte
+	err     error // Ошибка чтения, которую нужно вернуть после pending
+}
+
+func (c *rawPassthroughConn) Read(p []byte) (int, error) {
+	c.once.Do(c.detect)
+	if c.relayed {
+		return 0, io.EOF
+	}
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *rawPassthroughConn) detect() {
+	buffer := make([]byte, 4096)
+	for !bytes.Contains(c.pending, []byte("\r\n\r\n")) && len(c.pending) < rawHeadLimit {
+		n, err := c.Conn.Read(buffer)
+		c.pending = append(c.pending, buffer[:n]...)
+		if err != nil {
+			c.err = err
+			return
+		}
+	}
+
+	lineEnd := bytes.Index(c.pending, []byte("\r\n"))
+	if lineEnd < 0 {
+		return
+	}
+	parts := strings.Fields(string(c.pending[:lineEnd]))
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "HTTP/1.") || parts[0] == http.MethodConnect {
+		return
+	}
+	upstream, matched := rawPassthroughUpstream(parts[1])
+	if !matched {
+		return
+	}
+
+	c.relayed = true
+	head := c.pending
+	c.pending = nil
+	relayRawConnection(c.Conn, head, parts[0]+" "+parts[1], upstream)
+}
+
+// rawPassthroughUpstream сервер для цели запроса (путь или абсолютный URL в режиме HTTP proxy),
+// если она подходит под RAW_PASSTHROUGH
+func rawPassthroughUpstream(target string) (*url.URL, bool) {
+	fullURL := target
+	var upstream *url.URL
+	if parsed, err := url.Parse(target); err == nil && parsed.IsAbs() {
+		if parsed.Scheme != "http" {
+			return nil, false
+		}
+		fullURL = parsed.Host + parsed.RequestURI()
+		upstream = &url.URL{Scheme: parsed.Scheme, Host: parsed.Host}
+	} else if len(upstreams) > 0 {
+		index := (atomic.AddUint64(&upstreamCounter, 1) - 1) % uint64(len(upstreams))
+		upstream = upstreams[index].URL
+	}
+	if upstream == nil {
+		return nil, false
+	}
+
+	for _, pattern := range rawPassthroughPatterns {
+		if matchURLPattern(fullURL, pattern) {
+			return upstream, true
+		}
+	}
+	return nil, false
+}
+
+// rawHostLine строка заголовка Host (имя в написании клиента)
+var rawHostLine = regexp.MustCompile(`(?im)^(host[ \t]*:)[^\r\n]*`)
+
+// relayRawConnection передает соединение клиента серверу без изменений, кроме значения Host,
+// пока одна из сторон не закроет соединение
+func relayRawConnection(client net.Conn, head []byte, request string, upstream *url.URL) {
+	atomic.AddInt64(&rawPassthroughConnections, 1)
+	log.Printf("🧱 Raw passthrough: %s → %s", request, upstream.Host)
+
+	transport := httpClient.Transport.(*http.Transport)
+	address := upstream.Host
+	if upstream.Port() == "" {
+		port := "80"
+		if upstream.Scheme == "https" {
+			port = "443"
+		}
+		address = net.JoinHostPort(upstream.Hostname(), port)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	server, err := transport.DialContext(ctx, "tcp", address)
+	if err == nil && upstream.Scheme == "https" {
+		config := transport.TLSClientConfig.Clone()
+		if config.ServerName == "" {
+			config.ServerName = upstream.Hostname()
+		}
+		config.NextProtos = []string{"http/1.1"}
+		tlsConn := tls.Client(server, config)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			server.Close()
+		}
+		server = tlsConn
+	}
+	cancel()
+	if err != nil {
+		atomic.AddInt64(&rawPassthroughErrors, 1)
+		log.Printf("❌ Raw passthrough: ошибка подключения к %s: %v", address, err)
+		fmt.Fprintf(client, "HTTP/1.1 502 Bad Gateway\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+			len("Ошибка выполнения запроса"), "Ошибка выполнения запроса")
+		return
+	}
+	defer server.Close()
+
+	// Остальные байты запроса не трогаем: заголовки, chunked тело и расширения чанков идут как есть
+	head = rawHostLine.ReplaceAll(head, []byte("${1} "+upstream.Host))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		copyRawStream(client, server, "←", &rawPassthroughBytesDown)
+		// Сервер закрыл соединение - прекращаем и передачу от клиента
+		client.SetReadDeadline(time.Now())
+	}()
+	if _, err := server.Write(head); err == nil {
+		logRawChunk("→", head)
+		atomic.AddInt64(&rawPassthroughBytesUp, int64(len(head)))
+		copyRawStream(server, client, "→", &rawPassthroughBytesUp)
+	}
+	// Клиент закончил передачу: сервер может держать keep-alive соединение, поэтому ждем ответ не дольше 30s
+	if closer, ok := server.(interface{ CloseWrite() error }); ok {
+		closer.CloseWrite()
+	}
+	server.SetReadDeadline(time.Now().Add(30 * time.Second))
+	<-done
+	log.Printf("🧱 Raw passthrough: соединение %s → %s закрыто", request, upstream.Host)
+}
+
+// copyRawStream копирует байты из src в dst до EOF или ошибки, считая и логируя их
+func copyRawStream(dst io.Writer, src io.Reader, direction string, counter *int64) {
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buffer)
+		if n > 0 {
+			logRawChunk(direction, buffer[:n])
+			atomic.AddInt64(counter, int64(n))
+			if _, writeErr := dst.Write(buffer[:n]); writeErr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func logRawChunk(direction string, data []byte) {
+	if !rawPassthroughLog {
+		return
+	}
+	if len(data) > rawLogChunkLimit {
+		log.Printf("🧱 %s %d bytes: %q... (+%d bytes)", direction, len(data), data[:rawLogChunkLimit], len(data)-rawLogChunkLimit)
+		return
+	}
+	log.Printf("🧱 %s %d bytes: %q", direction, len(data), data)
+}
+
+// TLSConnectionInfo параметры последнего TLS соединения с хостом
+type TLSConnectionInfo struct {
+	Version         string   `json:"version"`
+	CipherSuite     string   `json:"cipher_suite"`
+	ALPN            string   `json:"alpn"`
+	ServerName      string   `json:"server_name"`
+	Resumed         bool     `json:"resumed"`
+	Certificates    []string `json:"certificates"`
+	Requests        int64    `json:"requests"`
+	HandshakeErrors int64    `json:"handshake_errors"`
+	LastError       string   `json:"last_error,omitempty"`
+	UpdatedAt       string   `json:"updated_at"`
+}
+
+var tlsConnections = make(map[string]*TLSConnectionInfo)
+var tlsConnectionsMutex sync.Mutex
+
+// traceTLSHandshake добавляет к запросу трассировку для логирования ошибок TLS рукопожатия
+func traceTLSHandshake(proxyReq *http.Request) *http.Request {
+	if proxyReq.URL.Scheme != "https" {
+		return proxyReq
+	}
+	host := proxyReq.URL.Host
+	trace := &httptrace.ClientTrace{
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil {
+				recordTLSHandshakeError(host, state, err)
+			}
+		},
+	}
+	return proxyReq.WithContext(httptrace.WithClientTrace(proxyReq.Context(), trace))
+}
+
+// Статистика соединений: клиентские по состояниям http.Server, серверные по адресу подключения.
+// С UPSTREAM_PROXY все серверные соединения идут к прокси и учитываются по его адресу
+type ClientConnectionStats struct {
+	Open     int64 `json:"open"`
+	Active   int64 `json:"active"`
+	Idle     int64 `json:"idle"`
+	Accepted int64 `json:"accepted"`
+	Hijacked int64 `json:"hijacked"`
+}
+
+type UpstreamConnectionStats struct {
+	Open               int64   `json:"open"`
+	Idle               int64   `json:"idle"`
+	Dials              int64   `json:"dials"`
+	DialErrors         int64   `json:"dial_errors"`
+	TLSHandshakeErrors int64   `json:"tls_handshake_errors"`
+	DNSLookups         int64   `json:"dns_lookups"`
+	DNSErrors          int64   `json:"dns_errors"`
+	DNSAvgMs           float64 `json:"dns_avg_ms"`
+	DNSMaxMs           float64 `json:"dns_max_ms"`
+	LastError          string  `json:"last_error,omitempty"`
+	dnsTotal           time.Duration
+}
+
+var clientConnections ClientConnectionStats
+var clientConnStates = make(map[net.Conn]http.ConnState)
+var upstreamConnections = make(map[string]*UpstreamConnectionStats)
+var connectionsMutex sync.Mutex
+
+// trackClientConnState - хук ConnState серверов прокси и арендаторов
+func trackClientConnState(conn net.Conn, state http.ConnState) {
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+
+	switch clientConnStates[conn] {
+	case http.StateActive:
+		clientConnections.Active--
+	case http.StateIdle:
+		clientConnections.Idle--
+	}
+
+	switch state {
+	case http.StateNew:
+		clientConnections.Open++
+		clientConnections.Accepted++
+		clientConnStates[conn] = state
+	case http.StateActive:
+		clientConnections.Active++
+		clientConnStates[conn] = state
+	case http.StateIdle:
+		clientConnections.Idle++
+		clientConnStates[conn] = state
+	case http.StateHijacked, http.StateClosed:
+		if _, ok := clientConnStates[conn]; ok {
+			clientConnections.Open--
+		}
+		if state == http.StateHijacked {
+			clientConnections.Hijacked++
+		}
+		delete(clientConnStates, conn)
+	}
+}
+
+// upstreamConnectionStatsLocked возвращает статистику адреса, создавая ее при первом обращении.
+// Вызывается под connectionsMutex
+func upstreamConnectionStatsLocked(addr string) *UpstreamConnectionStats {
+	stats, ok := upstreamConnections[addr]
+	if !ok {
+		stats = &UpstreamConnectionStats{}
+		upstreamConnections[addr] = stats
+	}
+	return stats
+}
+
+// trackedConn - соединение с сервером, которое отмечает закрытие и простой в пуле транспорта
+type trackedConn struct {
+	net.Conn
+	addr   string
+	idle   bool // под connectionsMutex
+	closed bool // под connectionsMutex
+}
+
+func (c *trackedConn) Close() error {
+	connectionsMutex.Lock()
+	if !c.closed {
+		c.closed = true
+		stats := upstreamConnectionStatsLocked(c.addr)
+		stats.Open--
+		if c.idle {
+			stats.Idle--
+		}
+	}
+	connectionsMutex.Unlock()
+	return c.Conn.Close()
+}
+
+// setIdle отмечает возврат соединения в пул (true) или выдачу его запросу (false)
+func (c *trackedConn) setIdle(idle bool) {
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+	if c.closed || c.idle == idle {
+		return
+	}
+	c.idle = idle
+	stats := upstreamConnectionStatsLocked(c.addr)
+	if idle {
+		stats.Idle++
+	} else {
+		stats.Idle--
+	}
+}
+
+// trackedDial оборачивает функцию подключения транспорта подсчетом соединений и ошибок
+func trackedDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+
+		connectionsMutex.Lock()
+		defer connectionsMutex.Unlock()
+		stats := upstreamConnectionStatsLocked(addr)
+		stats.Dials++
+		if err != nil {
+			// Отмена клиентом - не ошибка подключения
+			if !errors.Is(err, context.Canceled) {
+				stats.DialErrors++
+				stats.LastError = err.Error()
+			}
+			return nil, err
+		}
+		stats.Open++
+		return &trackedConn{Conn: conn, addr: addr}, nil
+	}
+}
+
+// unwrapTrackedConn находит trackedConn под TLS и другими обертками
+func unwrapTrackedConn(conn net.Conn) *trackedConn {
+	for conn != nil {
+		if tracked, ok := conn.(*trackedConn); ok {
+			return tracked
+		}
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		conn = wrapper.NetConn()
+	}
+	return nil
+}
+
+// connectionStatsAddr - адрес, по которому учитываются соединения запроса (как его видит trackedDial)
+func connectionStatsAddr(u *url.URL) string {
+	if proxySettings.Enabled {
+		if proxyURL, err := url.Parse(proxySettings.URL); err == nil {
+			u = proxyURL
+		}
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// traceConnections добавляет к запросу трассировку пула соединений, DNS и TLS рукопожатия
+func traceConnections(proxyReq *http.Request) *http.Request {
+	addr := connectionStatsAddr(proxyReq.URL)
+	var dnsStart time.Time
+	var conn *trackedConn
+
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			dnsStart = time.Now()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			duration := time.Since(dnsStart)
+			connectionsMutex.Lock()
+			defer connectionsMutex.Unlock()
+			stats := upstreamConnectionStatsLocked(addr)
+			stats.DNSLookups++
+			stats.dnsTotal += duration
+			stats.DNSAvgMs = float64(stats.dnsTotal.Microseconds()) / 1000 / float64(stats.DNSLookups)
+			if ms := float64(duration.Microseconds()) / 1000; ms > stats.DNSMaxMs {
+				stats.DNSMaxMs = ms
+			}
+			if info.Err != nil {
+				stats.DNSErrors++
+				stats.LastError = info.Err.Error()
+			}
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err == nil {
+				return
+			}
+			connectionsMutex.Lock()
+			defer connectionsMutex.Unlock()
+			stats := upstreamConnectionStatsLocked(addr)
+			stats.TLSHandshakeErrors++
+			stats.LastError = err.Error()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn = unwrapTrackedConn(info.Conn)
+			if conn != nil {
+				conn.setIdle(false)
+			}
+		},
+		PutIdleConn: func(err error) {
+			if err == nil && conn != nil {
+				conn.setIdle(true)
+			}
+		},
+	}
+	return proxyReq.WithContext(httptrace.WithClientTrace(proxyReq.Context(), trace))
+}
+
+// UpstreamTiming фазы запроса к серверу в миллисекундах. Фаз, которых не было (DNS из кеша,
+// переиспользованное соединение), нет и в результате - они равны нулю
+type UpstreamTiming struct {
+	Host       string  `json:"host"`
+	DNSMs      float64 `json:"dns_ms"`
+	ConnectMs  float64 `json:"connect_ms"`
+	TLSMs      float64 `json:"tls_ms"`
+	TTFBMs     float64 `json:"ttfb_ms"`     // От отправки запроса до первого байта ответа - время сервера
+	TransferMs float64 `json:"transfer_ms"` // От первого байта до конца тела
+	TotalMs    float64 `json:"total_ms"`
+	Reused     bool    `json:"reused"` // Соединение из пула keep-alive
+	Error      string  `json:"error,omitempty"`
+	start      time.Time
+	dnsStart   time.Time
+	connStart  time.Time
+	tlsStart   time.Time
+	wrote      time.Time
+	firstByte  time.Time
+	done       bool
+	mutex      sync.Mutex // Хуки подключения вызываются параллельно при нескольких адресах
+}
+
+// upstreamTimingHolder контейнер, через который фазы передаются в событие трафика
+type upstreamTimingHolder struct {
+	timing *UpstreamTiming
+}
+
+type upstreamTimingKey struct{}
+
+// upstreamTimingPhase накопленные длительности одной фазы для хоста
+type upstreamTimingPhase struct {
+	Count int64   `json:"count"`
+	AvgMs float64 `json:"avg_ms"`
+	MaxMs float64 `json:"max_ms"`
+	sumMs float64
+}
+
+type upstreamTimingHost struct {
+	Requests int64                           `json:"requests"`
+	Reused   int64                           `json:"reused"`
+	Errors   int64                           `json:"errors"`
+	Phases   map[string]*upstreamTimingPhase `json:"phases"`
+}
+
+const maxUpstreamTimingHosts = 200 // Остальные хосты учитываются в "other"
+
+var upstreamTimings = make(map[string]*upstreamTimingHost)
+var upstreamTimingMutex sync.Mutex
+
+// traceUpstreamTiming добавляет к запросу трассировку фаз; итог фиксирует finish после чтения тела
+func traceUpstreamTiming(proxyReq *http.Request) (*http.Request, *UpstreamTiming) {
+	timing := &UpstreamTiming{Host: proxyReq.URL.Host, start: time.Now()}
+	since := func(from time.Time) float64 {
+		return float64(time.Since(from).Microseconds()) / 1000
+	}
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			timing.mutex.Lock()
+			timing.dnsStart = time.Now()
+			timing.mutex.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			timing.mutex.Lock()
+			timing.DNSMs = since(timing.dnsStart)
+			timing.mutex.Unlock()
+		},
+		ConnectStart: func(string, string) {
+			timing.mutex.Lock()
+			if timing.connStart.IsZero() {
+				timing.connStart = time.Now()
+			}
+			timing.mutex.Unlock()
+		},
+		ConnectDone: func(_, _ string, err error) {
+			timing.mutex.Lock()
+			if err == nil {
+				timing.ConnectMs = since(timing.connStart)
+			}
+			timing.mutex.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			timing.mutex.Lock()
+			timing.tlsStart = time.Now()
+			timing.mutex.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			timing.mutex.Lock()
+			timing.TLSMs = since(timing.tlsStart)
+			timing.mutex.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			timing.mutex.Lock()
+			timing.Reused = info.Reused
+			timing.mutex.Unlock()
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			timing.mutex.Lock()
+			timing.wrote = time.Now()
+			timing.mutex.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			timing.mutex.Lock()
+			timing.firstByte = time.Now()
+			timing.mutex.Unlock()
+		},
+	}
+	return proxyReq.WithContext(httptrace.WithClientTrace(proxyReq.Context(), trace)), timing
+}
+
+// finish рассчитывает TTFB и передачу, пишет фазы в лог, статистику хоста и событие трафика
+func (t *UpstreamTiming) finish(r *http.Request, err error) {
+	t.mutex.Lock()
+	if t.done {
+		t.mutex.Unlock()
+		return
+	}
+	t.done = true
+	now := time.Now()
+	if !t.firstByte.IsZero() {
+		if !t.wrote.IsZero() && t.firstByte.After(t.wrote) {
+			t.TTFBMs = float64(t.firstByte.Sub(t.wrote).Microseconds()) / 1000
+		}
+		t.TransferMs = float64(now.Sub(t.firstByte).Microseconds()) / 1000
+	}
+	t.TotalMs = float64(now.Sub(t.start).Microseconds()) / 1000
+	if err != nil {
+		t.Error = err.Error()
+	}
+	timing := &UpstreamTiming{Host: t.Host, DNSMs: t.DNSMs, ConnectMs: t.ConnectMs, TLSMs: t.TLSMs, TTFBMs: t.TTFBMs, TransferMs: t.TransferMs, TotalMs: t.TotalMs, Reused: t.Reused, Error: t.Error}
+	gotFirstByte := !t.firstByte.IsZero()
+	t.mutex.Unlock()
+
+	if holder, ok := r.Context().Value(upstreamTimingKey{}).(*upstreamTimingHolder); ok {
+		holder.timing = timing
+	}
+	recordUpstreamTiming(timing)
+
+	if !logSettings.ShowTiming {
+		return
+	}
+	var phases []string
+	if timing.DNSMs > 0 {
+		phases = append(phases, fmt.Sprintf("DNS %.1fms", timing.DNSMs))
+	}
+	if timing.ConnectMs > 0 {
+		phases = append(phases, fmt.Sprintf("TCP %.1fms", timing.ConnectMs))
+	}
+	if timing.TLSMs > 0 {
+		phases = append(phases, fmt.Sprintf("TLS %.1fms", timing.TLSMs))
+	}
+	if timing.Reused {
+		phases = append(phases, "соединение из пула")
+	}
+	if gotFirstByte {
+		phases = append(phases, fmt.Sprintf("TTFB %.1fms", timing.TTFBMs), fmt.Sprintf("передача %.1fms", timing.TransferMs))
+	}
+	phases = append(phases, fmt.Sprintf("всего %.1fms", timing.TotalMs))
+	if err != nil {
+		phases = append(phases, "ошибка: "+err.Error())
+	}
+	requestLogf(r, "⏱️  Фазы запроса к %s: %s", timing.Host, strings.Join(phases, ", "))
+}
+
+func recordUpstreamTiming(timing *UpstreamTiming) {
+	upstreamTimingMutex.Lock()
+	defer upstreamTimingMutex.Unlock()
+	host := timing.Host
+	if _, ok := upstreamTimings[host]; !ok && len(upstreamTimings) >= maxUpstreamTimingHosts {
+		host = "other"
+	}
+	stats, ok := upstreamTimings[host]
+	if !ok {
+		stats = &upstreamTimingHost{Phases: make(map[string]*upstreamTimingPhase)}
+		upstreamTimings[host] = stats
+	}
+	stats.Requests++
+	if timing.Reused {
+		stats.Reused++
+	}
+	if timing.Error != "" {
+		stats.Errors++
+	}
+	for _, phase := range []struct {
+		name  string
+		value float64
+		seen  bool
+	}{
+		{"dns", timing.DNSMs, timing.DNSMs > 0},
+		{"connect", timing.ConnectMs, timing.ConnectMs > 0},
+		{"tls", timing.TLSMs, timing.TLSMs > 0},
+		{"ttfb", timing.TTFBMs, timing.TTFBMs > 0},
+		{"transfer", timing.TransferMs, timing.TTFBMs > 0},
+		{"total", timing.TotalMs, true},
+	} {
+		if !phase.seen {
+			continue
+		}
+		stat, ok := stats.Phases[phase.name]
+		if !ok {
+			stat = &upstreamTimingPhase{}
+			stats.Phases[phase.name] = stat
+		}
+		stat.Count++
+		stat.sumMs += phase.value
+		stat.AvgMs = math.Round(stat.sumMs/float64(stat.Count)*1000) / 1000
+		if phase.value > stat.MaxMs {
+			stat.MaxMs = phase.value
+		}
+	}
+}
+
+func upstreamTimingStats() map[string]upstreamTimingHost {
+	upstreamTimingMutex.Lock()
+	defer upstreamTimingMutex.Unlock()
+	result := make(map[string]upstreamTimingHost, len(upstreamTimings))
+	for host, stats := range upstreamTimings {
+		copied := upstreamTimingHost{Requests: stats.Requests, Reused: stats.Reused, Errors: stats.Errors, Phases: make(map[string]*upstreamTimingPhase, len(stats.Phases))}
+		for name, phase := range stats.Phases {
+			phaseCopy := *phase
+			copied.Phases[name] = &phaseCopy
+		}
+		result[host] = copied
+	}
+	return result
+}
+
+// DNSCacheEntry адреса хоста, полученные от резолвера
+type DNSCacheEntry struct {
+	Addrs     []string  `json:"addrs"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Hits      int64     `json:"hits"`
+}
+
+type DNSSettings struct {
+	CacheTTL  time.Duration       // 0 - кеш отключен
+	Overrides map[string][]string // Хост -> адреса, резолвер не вызывается
+}
+
+var dnsSettings DNSSettings
+var dnsCache = make(map[string]*DNSCacheEntry)
+var dnsCacheMutex sync.Mutex
+var dnsCacheHits int64    // атомарный
+var dnsCacheMisses int64  // атомарный
+var dnsStaleHits int64    // Ответы из устаревшей записи при ошибке резолвера (атомарный)
+var dnsOverrideHits int64 // атомарный
+var dnsEvicted int64      // Записи, вытесненные из кеша (атомарный)
+
+// Кеш DNS ограничен: запись после истечения TTL нужна только при ошибке резолвера и хранится
+// не дольше dnsStaleWindow, а при переполнении вытесняется запись, истекшая раньше других
+const dnsCacheMaxEntries = 10000
+const dnsStaleWindow = time.Hour
+
+func setupDNSCache() {
+	dnsSettings.Overrides = make(map[string][]string)
+
+	if value := os.Getenv("DNS_CACHE_TTL"); value != "" {
+		if ttl, err := time.ParseDuration(value); err == nil && ttl >= 0 {
+			dnsSettings.CacheTTL = ttl
+		} else {
+			log.Printf("⚠️  Неверный формат DNS_CACHE_TTL: %s, кеш DNS отключен", value)
+		}
+	}
+
+	// DNS_OVERRIDES=api.example.com=10.0.0.5|10.0.0.6,legacy.local=::1
+	if value := os.Getenv("DNS_OVERRIDES"); value != "" {
+		for _, item := range strings.Split(value, ",") {
+			parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				log.Printf("⚠️  Неверный формат DNS_OVERRIDES: %s", item)
+				continue
+			}
+			host := strings.ToLower(strings.TrimSpace(parts[0]))
+			for _, addr := range strings.Split(parts[1], "|") {
+				addr = strings.TrimSpace(addr)
+				if net.ParseIP(addr) == nil {
+					log.Printf("⚠️  DNS_OVERRIDES: '%s' для %s не является IP адресом", addr, host)
+					continue
+				}
+				dnsSettings.Overrides[host] = append(dnsSettings.Overrides[host], addr)
+			}
+		}
+	}
+}
+
+func printDNSSettings() {
+	log.Printf("🧭 DNS:")
+	if dnsSettings.CacheTTL > 0 {
+		log.Printf("   Cache: ✅ (TTL %v)", dnsSettings.CacheTTL)
+	} else {
+		log.Printf("   Cache: ❌")
+	}
+	for host, addrs := range dnsSettings.Overrides {
+		log.Printf("   %s → %s", host, strings.Join(addrs, ", "))
+	}
+	log.Printf("")
+	log.Printf("🔧 Переменные окружения для DNS:")
+	log.Printf("   - DNS_CACHE_TTL=30s - кешировать адреса хостов на 30 секунд")
+	log.Printf("   - DNS_OVERRIDES=api.example.com=10.0.0.5|10.0.0.6 - адреса хостов без обращения к резолверу")
+	log.Printf("   - DELETE /_proxy/dns - очистить кеш DNS (?host= для одного хоста)")
+	log.Printf("")
+}
+
+// resolveHost возвращает адреса хоста: ручные, из кеша или от резолвера.
+// При ошибке резолвера используется устаревшая запись кеша, если она есть
+func resolveHost(ctx context.Context, host string) ([]string, error) {
+	key := strings.ToLower(host)
+	if addrs, ok := dnsSettings.Overrides[key]; ok {
+		atomic.AddInt64(&dnsOverrideHits, 1)
+		return addrs, nil
+	}
+
+	if dnsSettings.CacheTTL > 0 {
+		dnsCacheMutex.Lock()
+		entry, ok := dnsCache[key]
+		if ok && time.Now().Before(entry.ExpiresAt) {
+			entry.Hits++
+			addrs := entry.Addrs
+			dnsCacheMutex.Unlock()
+			atomic.AddInt64(&dnsCacheHits, 1)
+			return addrs, nil
+		}
+		dnsCacheMutex.Unlock()
+		atomic.AddInt64(&dnsCacheMisses, 1)
+	}
+
+	ipAddrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		if dnsSettings.CacheTTL > 0 && !errors.Is(err, context.Canceled) {
+			dnsCacheMutex.Lock()
+			entry, ok := dnsCache[key]
+			if ok && time.Since(entry.ExpiresAt) < dnsStaleWindow {
+				entry.Hits++
+				addrs := entry.Addrs
+				dnsCacheMutex.Unlock()
+				atomic.AddInt64(&dnsStaleHits, 1)
+				if !logMuted(ctx) {
+					log.Printf("🧭 Ошибка DNS для %s (%v), используются адреса из кеша", host, err)
+				}
+				return addrs, nil
+			}
+			dnsCacheMutex.Unlock()
+		}
+		return nil, err
+	}
+
+	addrs := make([]string, 0, len(ipAddrs))
+	for _, ip := range ipAddrs {
+		addrs = append(addrs, ip.String())
+	}
+	if dnsSettings.CacheTTL > 0 {
+		now := time.Now()
+		dnsCacheMutex.Lock()
+		if _, exists := dnsCache[key]; !exists && len(dnsCache) >= dnsCacheMaxEntries {
+			evictDNSCache(now)
+		}
+		dnsCache[key] = &DNSCacheEntry{Addrs: addrs, ExpiresAt: now.Add(dnsSettings.CacheTTL)}
+		dnsCacheMutex.Unlock()
+	}
+	return addrs, nil
+}
+
+// evictDNSCache удаляет записи, истекшие более dnsStaleWindow назад; если места все равно нет -
+// запись, истекающую раньше всех. Вызывается под dnsCacheMutex
+func evictDNSCache(now time.Time) {
+	var oldestKey string
+	var oldest time.Time
+	for key, entry := range dnsCache {
+		if now.Sub(entry.ExpiresAt) > dnsStaleWindow {
+			delete(dnsCache, key)
+			atomic.AddInt64(&dnsEvicted, 1)
+			continue
+		}
+		if oldestKey == "" || entry.ExpiresAt.Before(oldest) {
+			oldestKey, oldest = key, entry.ExpiresAt
+		}
+	}
+	if len(dnsCache) >= dnsCacheMaxEntries && oldestKey != "" {
+		delete(dnsCache, oldestKey)
+		atomic.AddInt64(&dnsEvicted, 1)
+	}
+}
+
+// Политика выбора семейства адресов при подключении к серверу
+const (
+	ipFamilyHappyEyeballs = "happy_eyeballs" // IPv6 и IPv4 параллельно с задержкой (RFC 8305), по умолчанию
+	ipFamilyIPv4          = "ipv4"           // Только IPv4
+	ipFamilyIPv6          = "ipv6"           // Только IPv6
+	ipFamilyPreferIPv4    = "prefer_ipv4"    // Сначала все IPv4, затем IPv6
+	ipFamilyPreferIPv6    = "prefer_ipv6"    // Сначала все IPv6, затем IPv4
+)
+
+// HostIPFamily семейство адресов для хостов по паттерну
+type HostIPFamily struct {
+	Pattern string
+	Family  string
+}
+
+type DialSettings struct {
+	Family        string
+	Hosts         []HostIPFamily
+	FallbackDelay time.Duration
+}
+
+var dialSettings DialSettings
+var ipv4Connections int64 // атомарный
+var ipv6Connections int64 // атомарный
+
+func isIPFamily(value string) bool {
+	switch value {
+	case ipFamilyHappyEyeballs, ipFamilyIPv4, ipFamilyIPv6, ipFamilyPreferIPv4, ipFamilyPreferIPv6:
+		return true
+	}
+	return false
+}
+
+func setupDialSettings() {
+	dialSettings.Family = ipFamilyHappyEyeballs
+	if value := strings.ToLower(os.Getenv("DIAL_IP_FAMILY")); value != "" {
+		if isIPFamily(value) {
+			dialSettings.Family = value
+		} else {
+			log.Printf("⚠️  Неизвестное значение DIAL_IP_FAMILY: %s, используется %s", value, ipFamilyHappyEyeballs)
+		}
+	}
+
+	// DIAL_IP_FAMILY_HOSTS=legacy.internal=ipv4,*.v6.example.com=ipv6
+	for _, item := range strings.Split(os.Getenv("DIAL_IP_FAMILY_HOSTS"), ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || !isIPFamily(strings.ToLower(strings.TrimSpace(parts[1]))) {
+			log.Printf("⚠️  Неверный формат DIAL_IP_FAMILY_HOSTS: %s", item)
+			continue
+		}
+		dialSettings.Hosts = append(dialSettings.Hosts, HostIPFamily{
+			Pattern: strings.ToLower(strings.TrimSpace(parts[0])),
+			Family:  strings.ToLower(strings.TrimSpace(parts[1])),
+		})
+	}
+
+	dialSettings.FallbackDelay = 300 * time.Millisecond
+	if value := os.Getenv("DIAL_FALLBACK_DELAY"); value != "" {
+		if delay, err := time.ParseDuration(value); err == nil && delay > 0 {
+			dialSettings.FallbackDelay = delay
+		} else {
+			log.Printf("⚠️  Неверный формат DIAL_FALLBACK_DELAY: %s, используется 300ms", value)
+		}
+	}
+}
+
+func printDialSettings() {
+	log.Printf("🔌 Подключение к серверу:")
+	log.Printf("   IP family: %s", dialSettings.Family)
+	if dialSettings.Family == ipFamilyHappyEyeballs {
+		log.Printf("   Fallback delay: %v", dialSettings.FallbackDelay)
+	}
+	for _, host := range dialSettings.Hosts {
+		log.Printf("   %s: %s", host.Pattern, host.Family)
+	}
+	log.Printf("")
+	log.Printf("🔧 Переменные окружения для подключения:")
+	log.Printf("   - DIAL_IP_FAMILY=happy_eyeballs|ipv4|ipv6|prefer_ipv4|prefer_ipv6 - семейство адресов")
+	log.Printf("   - DIAL_IP_FAMILY_HOSTS=legacy.internal=ipv4 - семейство для отдельных хостов")
+	log.Printf("   - DIAL_FALLBACK_DELAY=300ms - задержка запасного семейства в режиме happy_eyeballs")
+	log.Printf("")
+}
+
+// NetworkShaping эмуляция плохой сети на уровне TCP соединений с сервером
+type NetworkShaping struct {
+	ConnectLatency   time.Duration // Задержка перед подключением
+	ConnectJitter    time.Duration // Случайная добавка к задержке подключения (0..jitter)
+	StallProbability float64       // Вероятность зависания на каждом сегменте данных
+	StallDuration    time.Duration // Длительность зависания
+	LossRate         float64       // Вероятность потери сегмента: данные приходят после повторной передачи
+	Hosts            []string      // Паттерны хостов (пусто = все)
+}
+
+// shapedSegmentSize размер сегмента, к которому применяются потери и зависания (MSS Ethernet)
+const shapedSegmentSize = 1460
+
+// shapedRetransmitTimeout первая пауза повторной передачи; при потерях подряд удваивается до shapedMaxRetransmit
+const shapedRetransmitTimeout = 200 * time.Millisecond
+const shapedMaxRetransmit = 3200 * time.Millisecond
+
+var networkShaping NetworkShaping
+var shapedConnections int64 // Соединений с эмуляцией сети (атомарный)
+var shapedStalls int64      // Зависаний (атомарный)
+var shapedLosses int64      // Потерянных сегментов (атомарный)
+var shapedDelayMs int64     // Суммарная добавленная задержка, мс (атомарный)
+
+func setupNetworkShaping() {
+	durations := []struct {
+		name   string
+		target *time.Duration
+	}{
+		{"NET_CONNECT_LATENCY", &networkShaping.ConnectLatency},
+		{"NET_CONNECT_JITTER", &networkShaping.ConnectJitter},
+		{"NET_STALL_DURATION", &networkShaping.StallDuration},
+	}
+	networkShaping.StallDuration = 2 * time.Second
+	for _, item := range durations {
+		if value := os.Getenv(item.name); value != "" {
+			if duration, err := time.ParseDuration(value); err == nil && duration >= 0 {
+				*item.target = duration
+			} else {
+				log.Printf("⚠️  Неверный формат %s: %s", item.name, value)
+			}
+		}
+	}
+
+	probabilities := []struct {
+		name   string
+		target *float64
+	}{
+		{"NET_STALL_PROBABILITY", &networkShaping.StallProbability},
+		{"NET_LOSS_RATE", &networkShaping.LossRate},
+	}
+	for _, item := range probabilities {
+		if value := os.Getenv(item.name); value != "" {
+			if probability, err := strconv.ParseFloat(value, 64); err == nil && probability >= 0 && probability <= 1 {
+				*item.target = probability
+			} else {
+				log.Printf("⚠️  Неверное значение %s: %s (ожидается число от 0 до 1)", item.name, value)
+			}
+		}
+	}
+
+	for _, host := range strings.Split(os.Getenv("NET_SHAPING_HOSTS"), ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			networkShaping.Hosts = append(networkShaping.Hosts, host)
+		}
+	}
+}
+
+func (s NetworkShaping) enabled() bool {
+	return s.ConnectLatency > 0 || s.ConnectJitter > 0 || s.StallProbability > 0 || s.LossRate > 0
+}
+
+func (s NetworkShaping) streamShaping() bool {
+	return (s.StallProbability > 0 && s.StallDuration > 0) || s.LossRate > 0
+}
+
+func printNetworkShapingSettings() {
+	log.Printf("📶 Эмуляция сети (TCP):")
+	if networkShaping.enabled() {
+		log.Printf("   Enabled: ✅")
+		log.Printf("   Connect Latency: %v (+0..%v)", networkShaping.ConnectLatency, networkShaping.ConnectJitter)
+		log.Printf("   Stalls: %.1f%% по %v", networkShaping.StallProbability*100, networkShaping.StallDuration)
+		log.Printf("   Loss Rate: %.1f%%", networkShaping.LossRate*100)
+		if len(networkShaping.Hosts) > 0 {
+			log.Printf("   Hosts: %v", networkShaping.Hosts)
+		}
+		if proxySettings.Enabled {
+			log.Printf("   ⚠️  С UPSTREAM_PROXY эмулируется соединение с прокси")
+		}
+	} else {
+		log.Printf("   Enabled: ❌")
+	}
+	log.Printf("")
+	log.Printf("🔧 Переменные окружения для эмуляции сети:")
+	log.Printf("   - NET_CONNECT_LATENCY=300ms - задержка установки соединения с сервером")
+	log.Printf("   - NET_CONNECT_JITTER=200ms - случайная добавка к задержке соединения")
+	log.Printf("   - NET_STALL_PROBABILITY=0.01 - вероятность зависания передачи на каждом сегменте (1460 байт)")
+	log.Printf("   - NET_STALL_DURATION=2s - длительность зависания")
+	log.Printf("   - NET_LOSS_RATE=0.02 - доля потерянных сегментов (задержка повторной передачи от 200ms)")
+	log.Printf("   - NET_SHAPING_HOSTS=api.example.com,*.slow.internal - только для этих хостов")
+	log.Printf("")
+}
+
+func networkShapingStats() map[string]interface{} {
+	return map[string]interface{}{
+		"enabled":           networkShaping.enabled(),
+		"connections":       atomic.LoadInt64(&shapedConnections),
+		"stalls":            atomic.LoadInt64(&shapedStalls),
+		"losses":            atomic.LoadInt64(&shapedLosses),
+		"delay_ms":          atomic.LoadInt64(&shapedDelayMs),
+		"loss_rate":         networkShaping.LossRate,
+		"stall_probability": networkShaping.StallProbability,
+	}
+}
+
+// shapedDial добавляет задержку подключения и оборачивает соединение для зависаний и потерь
+func shapedDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if !networkShaping.enabled() || !isShapedHost(addr) {
+			return dial(ctx, network, addr)
+		}
+		atomic.AddInt64(&shapedConnections, 1)
+
+		latency := networkShaping.ConnectLatency
+		if networkShaping.ConnectJitter > 0 {
+			latency += time.Duration(randomInt63n(int64(networkShaping.ConnectJitter) + 1))
+		}
+		if latency > 0 {
+			timer := time.NewTimer(latency)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			}
+			atomic.AddInt64(&shapedDelayMs, latency.Milliseconds())
+			if !logMuted(ctx) {
+				log.Printf("📶 Задержка подключения к %s: %v", addr, latency)
+			}
+		}
+
+		conn, err := dial(ctx, network, addr)
+		if err != nil || !networkShaping.streamShaping() {
+			return conn, err
+		}
+		return &shapedConn{Conn: conn, addr: addr}, nil
+	}
+}
+
+func isShapedHost(addr string) bool {
+	if len(networkShaping.Hosts) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range networkShaping.Hosts {
+		if matchURLPattern(host, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// shapedConn передает данные сегментами и задерживает некоторые из них:
+// зависание - пауза NET_STALL_DURATION, потеря - пауза повторной передачи, как в TCP
+type shapedConn struct {
+	net.Conn
+	addr        string
+	mutex       sync.Mutex
+	consecutive int // Потерь подряд (для удвоения паузы)
+}
+
+func (c *shapedConn) Read(p []byte) (int, error) {
+	if len(p) > shapedSegmentSize {
+		p = p[:shapedSegmentSize]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.delaySegment("←")
+	}
+	return n, err
+}
+
+func (c *shapedConn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		end := written + shapedSegmentSize
+		if end > len(p) {
+			end = len(p)
+		}
+		c.delaySegment("→")
+		n, err := c.Conn.Write(p[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (c *shapedConn) delaySegment(direction string) {
+	var delay time.Duration
+	c.mutex.Lock()
+	if networkShaping.LossRate > 0 && randomFloat64() < networkShaping.LossRate {
+		delay = shapedRetransmitTimeout << c.consecutive
+		if delay > shapedMaxRetransmit {
+			delay = shapedMaxRetransmit
+		} else {
+			c.consecutive++
+		}
+		atomic.AddInt64(&shapedLosses, 1)
+	} else {
+		c.consecutive = 0
+	}
+	c.mutex.Unlock()
+
+	if networkShaping.StallProbability > 0 && randomFloat64() < networkShaping.StallProbability {
+		delay += networkShaping.StallDuration
+		atomic.AddInt64(&shapedStalls, 1)
+		log.Printf("📶 Зависание соединения %s %s на %v", direction, c.addr, networkShaping.StallDuration)
+	}
+	if delay > 0 {
+		atomic.AddInt64(&shapedDelayMs, delay.Milliseconds())
+		time.Sleep(delay)
+	}
+}
+
+// dialFamilyFor возвращает семейство адресов для хоста: первый подходящий паттерн или общее значение
+func dialFamilyFor(host string) string {
+	host = strings.ToLower(host)
+	for _, entry := range dialSettings.Hosts {
+		if matchURLPattern(host, entry.Pattern) {
+			return entry.Family
+		}
+	}
+	return dialSettings.Family
+}
+
+// orderAddrsByFamily отбрасывает и упорядочивает адреса по семейству.
+// Возвращает основные адреса и запасные (запасные - только для happy_eyeballs)
+func orderAddrsByFamily(addrs []string, family string) (primaries, fallbacks []string) {
+	var ipv4, ipv6 []string
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil && ip.To4() != nil {
+			ipv4 = append(ipv4, addr)
+		} else {
+			ipv6 = append(ipv6, addr)
+		}
+	}
+
+	switch family {
+	case ipFamilyIPv4:
+		return ipv4, nil
+	case ipFamilyIPv6:
+		return ipv6, nil
+	case ipFamilyPreferIPv4:
+		return append(ipv4, ipv6...), nil
+	case ipFamilyPreferIPv6:
+		return append(ipv6, ipv4...), nil
+	}
+	// happy_eyeballs: основное семейство - у первого адреса резолвера
+	if len(addrs) > 0 && len(ipv4) > 0 && addrs[0] == ipv4[0] {
+		return ipv4, ipv6
+	}
+	return ipv6, ipv4
+}
+
+// dialSequential подключается к адресам по очереди до первого успешного
+func dialSequential(ctx context.Context, dialer *net.Dialer, network string, addrs []string, port string) (net.Conn, error) {
+	source, _ := ctx.Value(outboundSourceKey{}).(string)
+	var lastErr error
+	for _, ip := range addrs {
+		dialer, err := outboundDialer(dialer, source, net.ParseIP(ip))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// dialHappyEyeballs подключается к основным адресам, а запасные запускает параллельно
+// через FallbackDelay или сразу после ошибки основных. Побеждает первое соединение
+func dialHappyEyeballs(ctx context.Context, dialer *net.Dialer, network string, primaries, fallbacks []string, port string) (net.Conn, error) {
+	if len(fallbacks) == 0 {
+		return dialSequential(ctx, dialer, network, primaries, port)
+	}
+	if len(primaries) == 0 {
+		return dialSequential(ctx, dialer, network, fallbacks, port)
+	}
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, 2)
+	start := func(addrs []string) {
+		go func() {
+			conn, err := dialSequential(ctx, dialer, network, addrs, port)
+			results <- dialResult{conn, err}
+		}()
+	}
+
+	start(primaries)
+	pending := 1
+	fallbackStarted := false
+	timer := time.NewTimer(dialSettings.FallbackDelay)
+	defer timer.Stop()
+
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				start(fallbacks)
+			}
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				// Проигравшее подключение может успеть установиться - закрываем его
+				if pending > 0 {
+					go func() {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}()
+				}
+				return result.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				start(fallbacks)
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+// networkForFamily сужает сеть подключения для режимов с одним семейством
+func networkForFamily(network, family string) string {
+	if network != "tcp" {
+		return network
+	}
+	switch family {
+	case ipFamilyIPv4:
+		return "tcp4"
+	case ipFamilyIPv6:
+		return "tcp6"
+	}
+	return network
+}
+
+// resolvingDial подключается с учетом семейства адресов, кеша DNS и ручных адресов.
+// Если адреса не нужно упорядочивать самостоятельно, имя разрешает сам dialer
+func resolvingDial(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialResolved(ctx, dialer, network, addr)
+		if err == nil {
+			if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && tcpAddr.IP.To4() != nil {
+				atomic.AddInt64(&ipv4Connections, 1)
+			} else {
+				atomic.AddInt64(&ipv6Connections, 1)
+			}
+		}
+		return conn, err
+	}
+}
+
+func dialResolved(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	family := dialFamilyFor(host)
+	network = networkForFamily(network, family)
+
+	// Исходящий адрес выбирается по семейству адреса сервера, поэтому с ним имя разрешается здесь
+	source, _ := ctx.Value(outboundSourceKey{}).(string)
+	if ip := net.ParseIP(host); ip != nil {
+		dialer, err := outboundDialer(dialer, source, ip)
+		if err != nil {
+			return nil, err
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	ownResolution := source != "" || dnsSettings.CacheTTL > 0 || len(dnsSettings.Overrides) > 0 ||
+		family == ipFamilyPreferIPv4 || family == ipFamilyPreferIPv6
+	if !ownResolution {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	addrs, err := resolveHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	primaries, fallbacks := orderAddrsByFamily(addrs, family)
+	if len(primaries) == 0 && len(fallbacks) == 0 {
+		return nil, fmt.Errorf("нет адресов %s для %s", family, host)
+	}
+	return dialHappyEyeballs(ctx, dialer, network, primaries, fallbacks, port)
+}
+
+// OutboundSource исходящий адрес (IP или имя интерфейса) для запросов по паттерну URL
+type OutboundSource struct {
+	Pattern string
+	Source  string
+}
+
+// outboundSourceKey - ключ контекста запроса к серверу с исходящим адресом маршрута.
+// Транспорт передает значения контекста запроса в DialContext
+type outboundSourceKey struct{}
+
+var outboundSources []OutboundSource
+var outboundClients = make(map[string]*http.Client)
+var outboundClientsMutex sync.Mutex
+var outboundConnections sync.Map // source -> *int64
+
+// setupOutboundSource разбирает OUTBOUND_SOURCE: "tun0", "10.8.0.2" или "/vpn/*=tun0,*=10.0.0.5"
+func setupOutboundSource() {
+	value := os.Getenv("OUTBOUND_SOURCE")
+	if value == "" {
+		return
+	}
+	if !strings.Contains(value, "=") {
+		outboundSources = []OutboundSource{{Pattern: "*", Source: strings.TrimSpace(value)}}
+		return
+	}
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || strings.TrimSpace(parts[1]) == "" {
+			log.Printf("⚠️  Неверный формат OUTBOUND_SOURCE: %s", item)
+			continue
+		}
+		outboundSources = append(outboundSources, OutboundSource{Pattern: strings.TrimSpace(parts[0]), Source: strings.TrimSpace(parts[1])})
+	}
+	for _, source := range outboundSources {
+		if net.ParseIP(source.Source) != nil {
+			continue
+		}
+		if _, err := net.InterfaceByName(source.Source); err != nil {
+			log.Printf("⚠️  OUTBOUND_SOURCE: интерфейс %s не найден (%v), проверка повторится при подключении", source.Source, err)
+		}
+	}
+}
+
+func printOutboundSourceSettings() {
+	log.Printf("🛣️  Исходящий адрес:")
+	if len(outboundSources) > 0 {
+		for _, source := range outboundSources {
+			log.Printf("   %s: %s", source.Pattern, source.Source)
+		}
+	} else {
+		log.Printf("   Enabled: ❌ (выбирает система)")
+	}
+	log.Printf("")
+	log.Printf("🔧 Переменные окружения для исходящего адреса:")
+	log.Printf("   - OUTBOUND_SOURCE=tun0 - все подключения с адреса интерфейса tun0")
+	log.Printf("   - OUTBOUND_SOURCE=/vpn/*=tun0,*=10.0.0.5 - адрес или интерфейс по паттернам URL")
+	log.Printf("")
+}
+
+// resolveOutboundSource возвращает исходящий адрес первого подходящего паттерна OUTBOUND_SOURCE
+func resolveOutboundSource(fullURL string) string {
+	for _, source := range outboundSources {
+		if matchURLPattern(fullURL, source.Pattern) {
+			return source.Source
+		}
+	}
+	return ""
+}
+
+// outboundLocalIP возвращает IP источника того же семейства, что и адрес сервера.
+// Адрес интерфейса ищется при каждом подключении: VPN может получить новый адрес после переподключения
+func outboundLocalIP(source string, remote net.IP) (net.IP, error) {
+	wantIPv4 := remote.To4() != nil
+	if ip := net.ParseIP(source); ip != nil {
+		if (ip.To4() != nil) != wantIPv4 {
+			return nil, fmt.Errorf("исходящий адрес %s и адрес сервера %s разных семейств", source, remote)
+		}
+		return ip, nil
+	}
+
+	iface, err := net.InterfaceByName(source)
+	if err != nil {
+		return nil, fmt.Errorf("интерфейс %s: %w", source, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("адреса интерфейса %s: %w", source, err)
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || (ipNet.IP.To4() != nil) != wantIPv4 || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		return ipNet.IP, nil
+	}
+	family := "IPv6"
+	if wantIPv4 {
+		family = "IPv4"
+	}
+	return nil, fmt.Errorf("на интерфейсе %s нет адреса %s", source, family)
+}
+
+// outboundDialer возвращает копию dialer с исходящим адресом для подключения к remote
+func outboundDialer(dialer *net.Dialer, source string, remote net.IP) (*net.Dialer, error) {
+	if source == "" || remote == nil {
+		return dialer, nil
+	}
+	local, err := outboundLocalIP(source, remote)
+	if err != nil {
+		return nil, err
+	}
+	bound := *dialer
+	bound.LocalAddr = &net.TCPAddr{IP: local}
+	counter, _ := outboundConnections.LoadOrStore(source, new(int64))
+	atomic.AddInt64(counter.(*int64), 1)
+	return &bound, nil
+}
+
+// clientForRequest возвращает клиент для запроса к серверу. Запросы маршрутов KEEPALIVE=off/upstream
+// идут через клиент без пула соединений: Connection: close не мешает взять из пула открытое соединение
+func clientForRequest(proxyReq *http.Request) *http.Client {
+	client := sourceClient(proxyReq)
+	if mode, _ := proxyReq.Context().Value(keepAliveModeKey{}).(string); mode == "off" || mode == "upstream" {
+		return withoutKeepAlive(client)
+	}
+	return client
+}
+
+var noKeepAliveClients sync.Map // *http.Client -> *http.Client с DisableKeepAlives
+
+// withoutKeepAlive возвращает копию клиента, которая открывает новое соединение для каждого запроса
+func withoutKeepAlive(client *http.Client) *http.Client {
+	if cached, ok := noKeepAliveClients.Load(client); ok {
+		return cached.(*http.Client)
+	}
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		return client
+	}
+	transport = transport.Clone()
+	transport.DisableKeepAlives = true
+	cached, _ := noKeepAliveClients.LoadOrStore(client, &http.Client{Transport: transport})
+	return cached.(*http.Client)
+}
+
+// sourceClient возвращает клиент с отдельным пулом соединений для исходящего адреса запроса,
+// иначе соединение, открытое с одного адреса, переиспользовалось бы для маршрута с другим.
+// Upstream прокси берется из маршрута запроса (секция routes)
+func sourceClient(proxyReq *http.Request) *http.Client {
+	route := requestRouteConfig(proxyReq)
+	source, _ := proxyReq.Context().Value(outboundSourceKey{}).(string)
+	if source == "" {
+		return route.Client
+	}
+	key := source
+	if route.Client != httpClient {
+		key += " via " + route.settings.UpstreamProxy
+	}
+	outboundClientsMutex.Lock()
+	defer outboundClientsMutex.Unlock()
+	client, ok := outboundClients[key]
+	if !ok {
+		client = &http.Client{Transport: route.Client.Transport.(*http.Transport).Clone()}
+		outboundClients[key] = client
+	}
+	return client
+}
+
+func outboundSourceStats() map[string]interface{} {
+	routes := make(map[string]string, len(outboundSources))
+	for _, source := range outboundSources {
+		routes[source.Pattern] = source.Source
+	}
+	dials := make(map[string]int64)
+	outboundConnections.Range(func(key, value interface{}) bool {
+		dials[key.(string)] = atomic.LoadInt64(value.(*int64))
+		return true
+	})
+	return map[string]interface{}{
+		"routes": routes,
+		"dials":  dials,
+	}
+}
+
+func dialStats() map[string]interface{} {
+	hosts := make(map[string]string, len(dialSettings.Hosts))
+	for _, host := range dialSettings.Hosts {
+		hosts[host.Pattern] = host.Family
+	}
+	return map[string]interface{}{
+		"ip_family":        dialSettings.Family,
+		"hosts":            hosts,
+		"ipv4_connections": atomic.LoadInt64(&ipv4Connections),
+		"ipv6_connections": atomic.LoadInt64(&ipv6Connections),
+	}
+}
+
+// handleDNSCache показывает (GET) или очищает (DELETE, ?host= для одного хоста) кеш DNS
+func handleDNSCache(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		dnsCacheMutex.Lock()
+		entries := make(map[string]DNSCacheEntry, len(dnsCache))
+		for host, entry := range dnsCache {
+			entries[host] = *entry
+		}
+		dnsCacheMutex.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"entries":   entries,
+			"overrides": dnsSettings.Overrides,
+		})
+	case http.MethodDelete, http.MethodPost:
+		host := strings.ToLower(r.URL.Query().Get("host"))
+		dnsCacheMutex.Lock()
+		removed := 0
+		for key := range dnsCache {
+			if host == "" || key == host {
+				delete(dnsCache, key)
+				removed++
+			}
+		}
+		dnsCacheMutex.Unlock()
+		requestLogf(r, "🧭 Очищен кеш DNS: %d записей", removed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"removed": removed})
+	default:
+		http.Error(w, "Используйте GET или DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+func dnsCacheStats() map[string]interface{} {
+	dnsCacheMutex.Lock()
+	entries := len(dnsCache)
+	dnsCacheMutex.Unlock()
+	return map[string]interface{}{
+		"enabled":       dnsSettings.CacheTTL > 0,
+		"ttl":           dnsSettings.CacheTTL.String(),
+		"entries":       entries,
+		"hits":          atomic.LoadInt64(&dnsCacheHits),
+		"misses":        atomic.LoadInt64(&dnsCacheMisses),
+		"stale_hits":    atomic.LoadInt64(&dnsStaleHits),
+		"override_hits": atomic.LoadInt64(&dnsOverrideHits),
+		"evicted":       atomic.LoadInt64(&dnsEvicted),
+	}
+}
+
+func connectionStats() map[string]interface{} {
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+
+	upstream := make(map[string]UpstreamConnectionStats, len(upstreamConnections))
+	for addr, stats := range upstreamConnections {
+		upstream[addr] = *stats
+	}
+	return map[string]interface{}{
+		"client":   clientConnections,
+		"upstream": upstream,
+	}
+}
+
+// describeTLSCertificate краткое описание сертификата: владелец, издатель и срок действия
+func describeTLSCertificate(cert *x509.Certificate) string {
+	subject := cert.Subject.CommonName
+	if subject == "" && len(cert.DNSNames) > 0 {
+		subject = cert.DNSNames[0]
+	}
+	return fmt.Sprintf("%s (issuer: %s, valid: %s - %s)", subject, cert.Issuer.CommonName,
+		cert.NotBefore.Format("2006-01-02"), cert.NotAfter.Format("2006-01-02"))
+}
+
+// describeTLSError поясняет типичные причины ошибки рукопожатия
+func describeTLSError(err error) string {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidCert x509.CertificateInvalidError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	switch {
+	case errors.Is(err, errCertificatePinMismatch):
+		return "публичный ключ сервера не совпадает с закрепленным (UPSTREAM_TLS_PINS)"
+	case errors.As(err, &unknownAuthority):
+		return "сертификат подписан неизвестным центром сертификации"
+	case errors.As(err, &hostnameErr):
+		return "сертификат не соответствует имени хоста"
+	case errors.As(err, &invalidCert):
+		return "сертификат недействителен (срок действия или ограничения)"
+	case errors.As(err, &recordErr):
+		return "сервер ответил не по TLS (возможно, нужен http://)"
+	case errors.As(err, &alertErr):
+		return "сервер отклонил рукопожатие (версия TLS или набор шифров)"
+	}
+	return ""
+}
+
+func recordTLSHandshakeError(host string, state tls.ConnectionState, err error) {
+	reason := describeTLSError(err)
+	if logSettings.ShowTLSInfo {
+		log.Printf("🔐 Ошибка TLS рукопожатия с %s: %v", host, err)
+		if reason != "" {
+			log.Printf("   Причина: %s", reason)
+		}
+		for i, cert := range state.PeerCertificates {
+			log.Printf("   Сертификат #%d: %s", i, describeTLSCertificate(cert))
+		}
+	}
+
+	tlsConnectionsMutex.Lock()
+	defer tlsConnectionsMutex.Unlock()
+	info, ok := tlsConnections[host]
+	if !ok {
+		info = &TLSConnectionInfo{}
+		tlsConnections[host] = info
+	}
+	info.HandshakeErrors++
+	info.LastError = err.Error()
+	info.UpdatedAt = time.Now().Format(time.RFC3339)
+}
+
+// recordTLSInfo логирует и сохраняет для статистики параметры TLS соединения с сервером
+func recordTLSInfo(host string, state *tls.ConnectionState) {
+	if state == nil {
+		return
+	}
+
+	certificates := make([]string, 0, len(state.PeerCertificates))
+	for _, cert := range state.PeerCertificates {
+		certificates = append(certificates, describeTLSCertificate(cert))
+	}
+	alpn := state.NegotiatedProtocol
+	if alpn == "" {
+		alpn = "http/1.1"
+	}
+
+	if logSettings.ShowTLSInfo {
+		log.Printf("🔐 TLS: %s, %s, ALPN: %s, SNI: %s, resumed: %v",
+			tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite), alpn, state.ServerName, state.DidResume)
+		for i, certificate := range certificates {
+			log.Printf("   Сертификат #%d: %s", i, certificate)
+		}
+	}
+
+	tlsConnectionsMutex.Lock()
+	defer tlsConnectionsMutex.Unlock()
+	info, ok := tlsConnections[host]
+	if !ok {
+		info = &TLSConnectionInfo{}
+		tlsConnections[host] = info
+	}
+	info.Version = tls.VersionName(state.Version)
+	info.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	info.ALPN = alpn
+	info.ServerName = state.ServerName
+	info.Resumed = state.DidResume
+	info.Certificates = certificates
+	info.Requests++
+	info.UpdatedAt = time.Now().Format(time.RFC3339)
+}
+
+func tlsConnectionStats() map[string]TLSConnectionInfo {
+	tlsConnectionsMutex.Lock()
+	defer tlsConnectionsMutex.Unlock()
+	stats := make(map[string]TLSConnectionInfo, len(tlsConnections))
+	for host, info := range tlsConnections {
+		stats[host] = *info
+	}
+	return stats
+}
+
+// TLSSettings параметры TLS для соединений с сервером
+type TLSSettings struct {
+	MinVersion   uint16   // 0 = по умолчанию Go
+	MaxVersion   uint16   // 0 = по умолчанию Go
+	CipherSuites []uint16 // Пусто = по умолчанию Go (для TLS 1.3 не настраивается)
+	CipherNames  []string
+	ServerName   string // Переопределение SNI и имени для проверки сертификата
+	Fingerprint  string // Имя зарегистрированного TLS отпечатка (UPSTREAM_TLS_FINGERPRINT)
+	Pins         []CertificatePin
+}
+
+// CertificatePin допустимые SHA-256 хеши публичных ключей (SPKI) для хоста
+type CertificatePin struct {
+	Host   string   // Имя хоста (поддерживает wildcard *)
+	Hashes []string // Base64 хеши в формате "sha256/..."
+}
+
+var tlsSettings TLSSettings
+
+// tlsVersions поддерживаемые значения UPSTREAM_TLS_MIN_VERSION и UPSTREAM_TLS_MAX_VERSION
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func setupTLSSettings() {
+	tlsSettings.MinVersion = parseTLSVersionSetting("UPSTREAM_TLS_MIN_VERSION")
+	tlsSettings.MaxVersion = parseTLSVersionSetting("UPSTREAM_TLS_MAX_VERSION")
+	if tlsSettings.MinVersion != 0 && tlsSettings.MaxVersion != 0 && tlsSettings.MinVersion > tlsSettings.MaxVersion {
+		log.Printf("⚠️  UPSTREAM_TLS_MIN_VERSION больше UPSTREAM_TLS_MAX_VERSION, ограничения версий TLS не применяются")
+		tlsSettings.MinVersion = 0
+		tlsSettings.MaxVersion = 0
+	}
+
+	if ciphers := os.Getenv("UPSTREAM_TLS_CIPHERS"); ciphers != "" {
+		available := make(map[string]uint16)
+		for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			available[suite.Name] = suite.ID
+		}
+		for _, name := range strings.Split(ciphers, ",") {
+			name = strings.TrimSpace(name)
+			id, ok := available[name]
+			if !ok {
+				log.Printf("⚠️  Неизвестный набор шифров в UPSTREAM_TLS_CIPHERS: %s", name)
+				continue
+			}
+			tlsSettings.CipherSuites = append(tlsSettings.CipherSuites, id)
+			tlsSettings.CipherNames = append(tlsSettings.CipherNames, name)
+		}
+	}
+
+	tlsSettings.ServerName = os.Getenv("UPSTREAM_TLS_SERVER_NAME")
+
+	tlsSettings.Pins = parseCertificatePins(os.Getenv("UPSTREAM_TLS_PINS"))
+	tlsSettings.Fingerprint = os.Getenv("UPSTREAM_TLS_FINGERPRINT")
+}
+
+// parseTLSVersionSetting читает версию TLS ("1.0" - "1.3") из переменной окружения
+func parseTLSVersionSetting(name string) uint16 {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+	version, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(value), "tls")]
+	if !ok {
+		log.Printf("⚠️  Неверное значение %s: %s, используется версия по умолчанию", name, value)
+		return 0
+	}
+	return version
+}
+
+func tlsVersionSettingName(version uint16) string {
+	if version == 0 {
+		return "default"
+	}
+	return tls.VersionName(version)
+}
+
+func printTLSSettings() {
+	log.Printf("🔐 Настройки TLS соединений с сервером:")
+	log.Printf("   Min Version: %s", tlsVersionSettingName(tlsSettings.MinVersion))
+	log.Printf("   Max Version: %s", tlsVersionSettingName(tlsSettings.MaxVersion))
+	if len(tlsSettings.CipherNames) > 0 {
+		log.Printf("   Cipher Suites: %v", tlsSettings.CipherNames)
+	}
+	if tlsSettings.ServerName != "" {
+		log.Printf("   SNI: %s", tlsSettings.ServerName)
+	}
+	for _, pin := range tlsSettings.Pins {
+		log.Printf("   Pin %s: %d ключ(ей)", pin.Host, len(pin.Hashes))
+	}
+	if tlsSettings.Fingerprint != "" {
+		log.Printf("   Fingerprint: %s", tlsSettings.Fingerprint)
+	}
+	log.Printf("")
+	log.Printf("🔧 Переменные окружения для TLS:")
+	log.Printf("   - UPSTREAM_TLS_MIN_VERSION=1.0 - минимальная версия TLS (1.0, 1.1, 1.2, 1.3)")
+	log.Printf("   - UPSTREAM_TLS_MAX_VERSION=1.2 - максимальная версия TLS")
+	log.Printf("   - UPSTREAM_TLS_CIPHERS=TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 - наборы шифров для TLS 1.0-1.2")
+	log.Printf("   - UPSTREAM_TLS_SERVER_NAME=backend.internal - переопределить SNI и имя для проверки сертификата")
+	log.Printf("   - UPSTREAM_TLS_PINS=api.example.com=sha256/AAA...|sha256/BBB... - допустимые публичные ключи хоста")
+	log.Printf("   - UPSTREAM_TLS_FINGERPRINT=chrome - TLS отпечаток клиента из плагина (ProxyTLSFingerprints)")
+	log.Printf("")
+}
+
+var errCertificatePinMismatch = errors.New("certificate pin mismatch")
+
+// parseCertificatePins разбирает список вида "api.example.com=sha256/AAA...|sha256/BBB...,*.cdn.com=sha256/CCC..."
+func parseCertificatePins(value string) []CertificatePin {
+	var pins []CertificatePin
+	if value == "" {
+		return pins
+	}
+
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			log.Printf("⚠️  Неверный формат UPSTREAM_TLS_PINS: %s", item)
+			continue
+		}
+		pin := CertificatePin{Host: strings.ToLower(strings.TrimSpace(parts[0]))}
+		for _, hash := range strings.Split(parts[1], "|") {
+			hash = strings.TrimSpace(hash)
+			decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(hash, "sha256/"))
+			if !strings.HasPrefix(hash, "sha256/") || err != nil || len(decoded) != sha256.Size {
+				log.Printf("⚠️  Неверный хеш ключа для %s: %s (ожидается sha256/<base64>)", pin.Host, hash)
+				continue
+			}
+			pin.Hashes = append(pin.Hashes, hash)
+		}
+		// Хост без корректных хешей не закрепляется, иначе все соединения с ним отклонялись бы
+		if len(pin.Hashes) > 0 {
+			pins = append(pins, pin)
+		}
+	}
+	return pins
+}
+
+// certificatePublicKeyHash хеш публичного ключа сертификата в формате "sha256/<base64>"
+func certificatePublicKeyHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// verifyCertificatePins проверяет, что цепочка сервера содержит закрепленный ключ.
+// Выполняется и при UPSTREAM_PROXY_SKIP_TLS=true
+func verifyCertificatePins(state tls.ConnectionState) error {
+	host := strings.ToLower(state.ServerName)
+	for _, pin := range tlsSettings.Pins {
+		if !matchURLPattern(host, pin.Host) {
+			continue
+		}
+		for _, cert := range state.PeerCertificates {
+			hash := certificatePublicKeyHash(cert)
+			for _, expected := range pin.Hashes {
+				if hash == expected {
+					return nil
+				}
+			}
+		}
+		var received []string
+		for _, cert := range state.PeerCertificates {
+			received = append(received, certificatePublicKeyHash(cert))
+		}
+		return fmt.Errorf("%w for %s: received %v", errCertificatePinMismatch, host, received)
+	}
+	return nil
+}
+
+func pinnedHosts() []string {
+	hosts := make([]string, 0, len(tlsSettings.Pins))
+	for _, pin := range tlsSettings.Pins {
+		hosts = append(hosts, pin.Host)
+	}
+	return hosts
+}
+
+// setupTLSFingerprint подключает к транспорту рукопожатие выбранного TLS отпечатка.
+// Вызывается после loadPlugins, так как отпечатки регистрируются плагинами
+func setupTLSFingerprint() {
+	if tlsSettings.Fingerprint == "" {
+		return
+	}
+	handshake, ok := tlsFingerprints[tlsSettings.Fingerprint]
+	if !ok {
+		log.Printf("⚠️  TLS отпечаток '%s' не зарегистрирован (встроенных профилей нет, подключите плагин), используется стандартный ClientHello Go", tlsSettings.Fingerprint)
+		tlsSettings.Fingerprint = ""
+		return
+	}
+	if proxySettings.Enabled {
+		log.Printf("⚠️  С UPSTREAM_PROXY TLS соединение через CONNECT устанавливается стандартным ClientHello Go")
+	}
+
+	transport := httpClient.Transport.(*http.Transport)
+	dial := transport.DialContext
+	transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		config := transport.TLSClientConfig.Clone()
+		if config.ServerName == "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				host = addr
+			}
+			config.ServerName = host
+		}
+		// Транспорт с собственным DialTLSContext работает только по HTTP/1.1
+		config.NextProtos = []string{"http/1.1"}
+
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		tlsConn, err := handshake(conn, config)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+
+		// Закрепленные ключи проверяются и здесь: плагин может не вызывать VerifyConnection
+		if len(tlsSettings.Pins) > 0 {
+			stateConn, ok := tlsConn.(interface{ ConnectionState() tls.ConnectionState })
+			if !ok {
+				tlsConn.Close()
+				return nil, fmt.Errorf("%w: TLS отпечаток '%s' не предоставляет ConnectionState", errCertificatePinMismatch, tlsSettings.Fingerprint)
+			}
+			if err := verifyCertificatePins(stateConn.ConnectionState()); err != nil {
+				tlsConn.Close()
+				return nil, err
+			}
+		}
+		return tlsConn, nil
+	}
+}
+
+// expectsContinue проверяет, ждет ли клиент 100 Continue перед отправкой тела
+func expectsContinue(r *http.Request) bool {
+	return r.Body != nil && r.ContentLength != 0 && r.ProtoAtLeast(1, 1) &&
+		strings.EqualFold(strings.TrimSpace(r.Header.Get("Expect")), "100-continue")
+}
+
+// capturingReader передает тело запроса серверу и сохраняет прочитанные данные.
+// Транспорт может дописывать тело после получения ответа, поэтому доступ под мьютексом
+type capturingReader struct {
+	reader io.ReadCloser
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (c *capturingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	if n > 0 {
+		c.mutex.Lock()
+		c.buffer.Write(p[:n])
+		c.mutex.Unlock()
+	}
+	return n, err
+}
+
+func (c *capturingReader) Close() error {
+	return c.reader.Close()
+}
+
+// Bytes возвращает копию уже переданной части тела
+func (c *capturingReader) Bytes() []byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]byte(nil), c.buffer.Bytes()...)
+}
+
+// logRequestBody логирует тело входящего запроса
+func logRequestBody(r *http.Request, body []byte) {
+	settings := requestLogSettings(r)
+	if len(body) > 0 && settings.ShowRequestBody {
+		if !logProtobufBody(settings, "📤 Request Body", body, r.Header.Get("Content-Type"), r.Header, r.URL.Path, false) {
+			logBody(settings, "📤 Request Body", body, r.Header.Get("Content-Type"), r.Header)
+		}
+	}
+}
+
+// listenFDEnv переменная окружения с номером дескриптора сокета, переданного при перезапуске
+const listenFDEnv = "PROXY_LISTEN_FD"
+
+var proxyServer *http.Server
+var proxyListener net.Listener
+var shutdownDone = make(chan struct{})
+var restarting int32 // Флаг выполняющегося перезапуска (атомарный)
+
+// watchReloadSignal перезагружает конфигурацию подмен при получении SIGHUP
+func watchReloadSignal(configFile string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		log.Printf("🔄 SIGHUP: перезагрузка конфигурации %s", configFile)
+		if loadConfig(configFile) {
+			log.Printf("Активных правил подмены: %d", countActiveOverrides(nil))
+		} else {
+			log.Printf("⚠️  Конфигурация не изменена, продолжают действовать прежние правила")
+		}
+		for _, tenant := range tenants {
+			loadTenantConfig(tenant)
+		}
+	}
+}
+
+// createListener открывает порт или использует сокет, унаследованный от предыдущего процесса
+func createListener(port string) (net.Listener, error) {
+	if fd := os.Getenv(listenFDEnv); fd != "" {
+		os.Unsetenv(listenFDEnv)
+		number, err := strconv.Atoi(fd)
+		if err != nil {
+			return nil, fmt.Errorf("неверный %s: %s", listenFDEnv, fd)
+		}
+		listener, err := net.FileListener(os.NewFile(uintptr(number), "listener"))
+		if err != nil {
+			return nil, fmt.Errorf("не удалось использовать унаследованный сокет: %w", err)
+		}
+		log.Printf("♻️  Используется сокет предыдущего процесса: %s", listener.Addr())
+		return listener, nil
+	}
+	return net.Listen("tcp", "0.0.0.0:"+port)
+}
+
+var errRestartInProgress = errors.New("перезапуск уже выполняется")
+
+// handleRestart запускает новый экземпляр бинарника с тем же сокетом и плавно завершает текущий.
+// Как и другие изменяющие запросы, принимается только с ADMIN_TOKEN или с localhost (см. handleAdminRequest)
+func handleRestart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Используйте POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pid, err := restartProcess(r)
+	if errors.Is(err, errRestartInProgress) {
+		http.Error(w, "Перезапуск уже выполняется", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Ошибка перезапуска: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"old_pid": os.Getpid(), "new_pid": pid})
+}
+
+// watchRestartSignal перезапускает бинарник по SIGUSR2 - без доступа к HTTP API
+func watchRestartSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	for range signals {
+		log.Printf("♻️  SIGUSR2: перезапуск")
+		if _, err := restartProcess(nil); errors.Is(err, errRestartInProgress) {
+			log.Printf("⚠️  Перезапуск уже выполняется")
+		}
+	}
+}
+
+// restartProcess запускает новый процесс и плавно останавливает текущий; r - запрос API (nil для сигнала)
+func restartProcess(r *http.Request) (int, error) {
+	if !atomic.CompareAndSwapInt32(&restarting, 0, 1) {
+		return 0, errRestartInProgress
+	}
+
+	pid, err := startReplacementProcess()
+	if err != nil {
+		atomic.StoreInt32(&restarting, 0)
+		requestLogf(r, "❌ Ошибка перезапуска: %v", err)
+		return 0, err
+	}
+
+	// Останавливаем прием соединений (запрос API получит ответ); их принимает новый процесс на том же сокете
+	go func() {
+		timeout := shutdownTimeout()
+		requestLogf(r, "⏳ Ожидание завершения текущих запросов (до %v)", timeout)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		// Порты арендаторов освобождаются сразу, новый процесс занимает их повторными попытками
+		for _, server := range tenantServers {
+			go server.Shutdown(ctx)
+		}
+		if err := proxyServer.Shutdown(ctx); err != nil {
+			requestLogf(r, "⚠️  Не все запросы завершились за %v: %v", timeout, err)
+		}
+		// Уже загруженные обмены не должны остаться без индекса
+		if archiveQueue != nil {
+			flushArchiveIndex()
+		}
+		close(shutdownDone)
+	}()
+	return pid, nil
+}
+
+// shutdownTimeout время ожидания текущих запросов при остановке (SHUTDOWN_TIMEOUT, по умолчанию 30s)
+func shutdownTimeout() time.Duration {
+	if value := os.Getenv("SHUTDOWN_TIMEOUT"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil {
+			return parsed
+		}
+	}
+	return 30 * time.Second
+}
+
+// startReplacementProcess запускает бинарник (возможно, уже обновленный) с унаследованным сокетом
+func startReplacementProcess() (int, error) {
+	tcpListener, ok := proxyListener.(*net.TCPListener)
+	if !ok {
+		return 0, fmt.Errorf("сокет %T не поддерживает передачу", proxyListener)
+	}
+	file, err := tcpListener.File()
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	// Новый процесс загрузит кеш с диска - сохраняем актуальное состояние
+	if cacheSettings.Enabled {
+		if err := persistCache(); err != nil {
+			log.Printf("⚠️  Ошибка сохранения кеша: %v", err)
+		}
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// ExtraFiles[0] получает дескриптор 3 в новом процессе
+	cmd.ExtraFiles = []*os.File{file}
+	cmd.Env = append(os.Environ(), listenFDEnv+"=3")
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	log.Printf("♻️  Запущен новый процесс %s (pid %d)", executable, cmd.Process.Pid)
+	return cmd.Process.Pid, nil
+}
+
+// BenchmarkRequest запрос нагрузочного прогона. URL относительный (через прокси к серверу)
+// или абсолютный http:// (для режима HTTP прокси)
+type BenchmarkRequest struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+// BenchmarkConfig параметры нагрузочного прогона (тело POST /_proxy_bench)
+type BenchmarkConfig struct {
+	Requests     []BenchmarkRequest `json:"requests"`      // Запросы, отправляются по кругу
+	RequestsFile string             `json:"requests_file"` // JSON файл со списком запросов в каталоге BENCH_REQUESTS_DIR (альтернатива requests)
+	RPS          float64            `json:"rps"`           // Целевая частота запросов в секунду (по умолчанию 10)
+	Duration     string             `json:"duration"`      // Длительность прогона (по умолчанию 10s)
+	Count        int                `json:"count"`         // Остановиться после N запросов (0 = по длительности)
+	Concurrency  int                `json:"concurrency"`   // Максимум одновременных запросов (по умолчанию 50)
+	Timeout      string             `json:"timeout"`       // Таймаут одного запроса (по умолчанию 30s)
+}
+
+// benchmarkResult результат одного запроса прогона
+type benchmarkResult struct {
+	statusCode int
+	latency    time.Duration
+	err        error
+}
+
+var benchmarkRunning int32 // Флаг выполняющегося прогона (атомарный)
+
+// Пределы параметров прогона: интервал тикера 1s/rps не должен округлиться до нуля,
+// а один запрос к API - занять прокси на неограниченное время
+const (
+	benchMaxRPS         = 10000
+	benchMaxConcurrency = 1000
+	benchMaxDuration    = time.Hour
+)
+
+// handleBenchmark выполняет нагрузочный прогон через прокси и возвращает статистику задержек и ошибок
+func handleBenchmark(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Используйте POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var bench BenchmarkConfig
+	if err := json.NewDecoder(r.Body).Decode(&bench); err != nil {
+		http.Error(w, "Неверный JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if bench.RequestsFile != "" {
+		file, err := benchRequestsPath(bench.RequestsFile)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			http.Error(w, "Не удалось прочитать requests_file: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := json.Unmarshal(data, &bench.Requests); err != nil {
+			http.Error(w, "Ошибка парсинга requests_file: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if len(bench.Requests) == 0 {
+		http.Error(w, "Не заданы запросы (requests или requests_file)", http.StatusBadRequest)
+		return
+	}
+
+	if bench.RPS <= 0 {
+		bench.RPS = 10
+	}
+	if bench.RPS > benchMaxRPS {
+		bench.RPS = benchMaxRPS
+	}
+	if bench.Count < 0 {
+		http.Error(w, "count не может быть отрицательным", http.StatusBadRequest)
+		return
+	}
+	if bench.Concurrency <= 0 {
+		bench.Concurrency = 50
+	}
+	if bench.Concurrency > benchMaxConcurrency {
+		http.Error(w, fmt.Sprintf("concurrency больше %d", benchMaxConcurrency), http.StatusBadRequest)
+		return
+	}
+	duration := 10 * time.Second
+	if bench.Duration != "" {
+		parsed, err := time.ParseDuration(bench.Duration)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Неверный формат duration: "+bench.Duration, http.StatusBadRequest)
+			return
+		}
+		duration = parsed
+	}
+	if duration > benchMaxDuration {
+		http.Error(w, fmt.Sprintf("duration больше %v", benchMaxDuration), http.StatusBadRequest)
+		return
+	}
+	timeout := 30 * time.Second
+	if bench.Timeout != "" {
+		parsed, err := time.ParseDuration(bench.Timeout)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Неверный формат timeout: "+bench.Timeout, http.StatusBadRequest)
+			return
+		}
+		timeout = parsed
+	}
+
+	if !atomic.CompareAndSwapInt32(&benchmarkRunning, 0, 1) {
+		http.Error(w, "Прогон уже выполняется", http.StatusConflict)
+		return
+	}
+	defer atomic.StoreInt32(&benchmarkRunning, 0)
+
+	requestLogf(r, "🏋️  Нагрузочный прогон: %d запрос(ов), %.1f rps, %v", len(bench.Requests), bench.RPS, duration)
+	report := runBenchmark(r.Context(), bench, duration, timeout)
+	requestLogf(r, "🏋️  Прогон завершен: %v запросов, %v ошибок", report["total"], report["errors"])
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// benchRequestsPath путь requests_file внутри каталога BENCH_REQUESTS_DIR; без каталога
+// файлы запросов не читаются - иначе клиент API мог бы прочитать любой файл сервера
+func benchRequestsPath(name string) (string, error) {
+	dir := os.Getenv("BENCH_REQUESTS_DIR")
+	if dir == "" {
+		return "", fmt.Errorf("requests_file требует BENCH_REQUESTS_DIR")
+	}
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("requests_file должен быть относительным путем внутри BENCH_REQUESTS_DIR (%s)", dir)
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// runBenchmark отправляет запросы на собственный порт прокси с заданной частотой,
+// поэтому они проходят через правила подмены, кеш и логирование так же, как запросы клиентов
+func runBenchmark(ctx context.Context, bench BenchmarkConfig, duration, timeout time.Duration) map[string]interface{} {
+	_, port, _ := net.SplitHostPort(proxyListener.Addr().String())
+	localAddr := "127.0.0.1:" + port
+	localProxy := &url.URL{Scheme: "http", Host: localAddr}
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			// Абсолютные URL отправляются как запросы к HTTP прокси
+			Proxy: func(req *http.Request) (*url.URL, error) {
+				if req.URL.Host == localAddr {
+					return nil, nil
+				}
+				return localProxy, nil
+			},
+			MaxIdleConnsPerHost: bench.Concurrency,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	var results []benchmarkResult
+	var resultsMutex sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, bench.Concurrency)
+	dropped := 0
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / bench.RPS))
+	defer ticker.Stop()
+
+	started := time.Now()
+	sent := 0
+loop:
+	for bench.Count == 0 || sent < bench.Count {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-ticker.C:
+		}
+
+		// Если все слоты заняты, запрос пропускается: сервер не успевает за целевой частотой
+		select {
+		case slots <- struct{}{}:
+		default:
+			dropped++
+			continue
+		}
+
+		spec := bench.Requests[sent%len(bench.Requests)]
+		sent++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			result := sendBenchmarkRequest(client, localAddr, spec)
+			resultsMutex.Lock()
+			results = append(results, result)
+			resultsMutex.Unlock()
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(started)
+
+	statuses := make(map[string]int)
+	errorMessages := make(map[string]int)
+	latencies := make([]time.Duration, 0, len(results))
+	errorsCount := 0
+	for _, result := range results {
+		if result.err != nil {
+			errorsCount++
+			errorMessages[result.err.Error()]++
+			continue
+		}
+		statuses[strconv.Itoa(result.statusCode)]++
+		if result.statusCode >= 500 {
+			errorsCount++
+		}
+		latencies = append(latencies, result.latency)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	return map[string]interface{}{
+		"total":          len(results),
+		"errors":         errorsCount,
+		"dropped":        dropped,
+		"target_rps":     bench.RPS,
+		"actual_rps":     math.Round(float64(len(results))/elapsed.Seconds()*100) / 100,
+		"duration":       elapsed.Round(time.Millisecond).String(),
+		"status_codes":   statuses,
+		"error_messages": errorMessages,
+		"latency_ms":     benchmarkLatencyStats(latencies),
+	}
+}
+
+func sendBenchmarkRequest(client *http.Client, localAddr string, spec BenchmarkRequest) benchmarkResult {
+	target := spec.URL
+	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+		target = "http://" + localAddr + "/" + strings.TrimPrefix(target, "/")
+	}
+	method := spec.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	var body io.Reader
+	if spec.Body != "" {
+		body = strings.NewReader(spec.Body)
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return benchmarkResult{err: err}
+	}
+	for name, value := range spec.Headers {
+		req.Header.Set(name, value)
+	}
+
+	started := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return benchmarkResult{err: err}
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return benchmarkResult{statusCode: resp.StatusCode, latency: time.Since(started)}
+}
+
+// benchmarkLatencyStats минимальная, средняя, максимальная задержка и перцентили (latencies отсортированы)
+func benchmarkLatencyStats(latencies []time.Duration) map[string]float64 {
+	if len(latencies) == 0 {
+		return map[string]float64{}
+	}
+	milliseconds := func(d time.Duration) float64 {
+		return math.Round(float64(d)/float64(time.Millisecond)*100) / 100
+	}
+	percentile := func(p float64) float64 {
+		index := int(math.Ceil(p/100*float64(len(latencies)))) - 1
+		if index < 0 {
+			index = 0
+		}
+		return milliseconds(latencies[index])
+	}
+	var total time.Duration
+	for _, latency := range latencies {
+		total += latency
+	}
+	return map[string]float64{
+		"min": milliseconds(latencies[0]),
+		"avg": milliseconds(total / time.Duration(len(latencies))),
+		"p50": percentile(50),
+		"p90": percentile(90),
+		"p99": percentile(99),
+		"max": milliseconds(latencies[len(latencies)-1]),
+	}
+}
+
+// SelfTestCase пример запроса для проверки правил. Поля expect_* необязательны:
+// при расхождении selftest завершается с ненулевым кодом
+type SelfTestCase struct {
+	Method       string            `json:"method"`
+	URL          string            `json:"url"`
+	Headers      map[string]string `json:"headers"`
+	Body         string            `json:"body"`
+	ExpectRule   string            `json:"expect_rule"`   // Ожидаемое правило ("-" = ни одно правило не должно сработать)
+	ExpectStatus int               `json:"expect_status"` // Ожидаемый статус подменного ответа
+}
+
+// harFile минимальная структура HAR для чтения запросов
+type harFile struct {
+	Log struct {
+		Entries []struct {
+			Request struct {
+				Method  string `json:"method"`
+				URL     string `json:"url"`
+				Headers []struct {
+					Name  string `json:"name"`
+					Value string `json:"value"`
+				} `json:"headers"`
+				PostData *struct {
+					MimeType string `json:"mimeType"`
+					Text     string `json:"text"`
+				} `json:"postData"`
+			} `json:"request"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+// loadSelfTestCases читает примеры запросов из JSON массива SelfTestCase, HAR файла
+// или сессии Fiddler/Charles
+func loadSelfTestCases(file string) ([]SelfTestCase, error) {
+	if isCapturedSessionFile(file) {
+		exchanges, err := loadCapturedSession(file)
+		if err != nil {
+			return nil, err
+		}
+		return capturedFixtures(exchanges), nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var har harFile
+	if json.Unmarshal(data, &har) == nil && len(har.Log.Entries) > 0 {
+		cases := make([]SelfTestCase, 0, len(har.Log.Entries))
+		for _, entry := range har.Log.Entries {
+			testCase := SelfTestCase{Method: entry.Request.Method, URL: entry.Request.URL, Headers: make(map[string]string)}
+			for _, header := range entry.Request.Headers {
+				// Псевдозаголовки HTTP/2 (:authority и т.п.) не переносятся
+				if !strings.HasPrefix(header.Name, ":") {
+					testCase.Headers[header.Name] = header.Value
+				}
+			}
+			if entry.Request.PostData != nil {
+				testCase.Body = entry.Request.PostData.Text
+				if entry.Request.PostData.MimeType != "" {
+					testCase.Headers["Content-Type"] = entry.Request.PostData.MimeType
+				}
+			}
+			cases = append(cases, testCase)
+		}
+		return cases, nil
+	}
+
+	var cases []SelfTestCase
+	if err := json.Unmarshal(data, &cases); err != nil {
+		return nil, fmt.Errorf("ожидается JSON массив запросов или HAR: %w", err)
+	}
+	return cases, nil
+}
+
+// CapturedExchange обмен из сессии Fiddler (.saz) или Charles (.chlsj)
+type CapturedExchange struct {
+	Method          string
+	URL             *url.URL
+	RequestHeaders  http.Header
+	RequestBody     []byte
+	Status          int
+	ResponseHeaders http.Header
+	ResponseBody    []byte // Распакованное тело, если сжатие удалось снять (Content-Encoding тогда удаляется)
+}
+
+// ImportedRule правило, созданное из записанного обмена; только заполненные поля,
+// чтобы результат можно было читать и править вручную
+type ImportedRule struct {
+	Name         string            `json:"name"`
+	Method       string            `json:"method"`
+	URLPattern   string            `json:"url_pattern"`
+	MatchType    string            `json:"match_type"`
+	MatchFullURL bool              `json:"match_full_url,omitempty"`
+	StatusCode   int               `json:"status_code"`
+	Headers      map[string]string `json:"headers,omitempty"`
+	BodyText     string            `json:"body_text,omitempty"`
+	BodyFile     string            `json:"body_file,omitempty"`
+	Enabled      bool              `json:"enabled"`
+}
+
+// charlesMessage запрос или ответ в JSON сессии Charles
+type charlesMessage struct {
+	Status int `json:"status"`
+	Header struct {
+		Headers []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"headers"`
+	} `json:"header"`
+	Body *struct {
+		Text    *string `json:"text"`
+		Encoded string  `json:"encoded"` // base64 для бинарных тел
+		Decoded bool    `json:"decoded"` // Charles уже снял Content-Encoding
+	} `json:"body"`
+}
+
+// charlesEntry запись JSON сессии Charles (File → Export Session → JSON Session File)
+type charlesEntry struct {
+	Method     string          `json:"method"`
+	Scheme     string          `json:"scheme"`
+	Host       string          `json:"host"`
+	ActualPort int             `json:"actualPort"`
+	Path       string          `json:"path"`
+	Query      *string         `json:"query"`
+	Tunnel     bool            `json:"tunnel"`
+	Request    charlesMessage  `json:"request"`
+	Response   *charlesMessage `json:"response"`
+}
+
+const importedBodyInlineLimit = 65536 // Текстовые тела больше лимита сохраняются в файлы
+
+func isCapturedSessionFile(file string) bool {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".saz", ".chlsj", ".chls":
+		return true
+	}
+	return false
+}
+
+// loadCapturedSession читает сессию по расширению файла
+func loadCapturedSession(file string) ([]CapturedExchange, error) {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".saz":
+		return loadFiddlerSession(file)
+	case ".chlsj":
+		return loadCharlesSession(file)
+	case ".chls":
+		return nil, fmt.Errorf("бинарный формат Charles не поддерживается - экспортируйте сессию в JSON (File → Export Session → JSON Session File, .chlsj)")
+	}
+	return nil, fmt.Errorf("неизвестный формат сессии %s: ожидается .saz (Fiddler) или .chlsj (Charles)", file)
+}
+
+// loadFiddlerSession читает архив Fiddler: raw/N_c.txt - запрос, raw/N_s.txt - ответ в том виде,
+// в каком они прошли по сети. Туннели CONNECT и сессии без ответа пропускаются
+func loadFiddlerSession(file string) ([]CapturedExchange, error) {
+	archive, err := zip.OpenReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	files := make(map[string]*zip.File)
+	var ids []string
+	for _, entry := range archive.File {
+		name := strings.ReplaceAll(entry.Name, "\\", "/")
+		files[name] = entry
+		if strings.HasPrefix(name, "raw/") && strings.HasSuffix(name, "_c.txt") {
+			ids = append(ids, strings.TrimSuffix(strings.TrimPrefix(name, "raw/"), "_c.txt"))
+		}
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("в архиве нет сессий raw/*_c.txt - это не файл Fiddler .saz")
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		left, _ := strconv.Atoi(ids[i])
+		right, _ := strconv.Atoi(ids[j])
+		return left < right
+	})
+
+	readEntry := func(name string) ([]byte, error) {
+		entry, ok := files[name]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		reader, err := entry.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return io.ReadAll(reader)
+	}
+
+	exchanges := make([]CapturedExchange, 0, len(ids))
+	for _, id := range ids {
+		data, err := readEntry("raw/" + id + "_c.txt")
+		if err != nil {
+			return nil, fmt.Errorf("сессия %s: %w", id, err)
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return nil, fmt.Errorf("сессия %s: неверный запрос: %w", id, err)
+		}
+		if req.Method == http.MethodConnect {
+			continue
+		}
+		requestBody, _ := io.ReadAll(req.Body)
+		requestURL := *req.URL
+		if requestURL.Host == "" {
+			requestURL.Scheme, requestURL.Host = "http", req.Host
+		}
+
+		data, err = readEntry("raw/" + id + "_s.txt")
+		if err != nil || len(data) == 0 {
+			continue
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), req)
+		if err != nil {
+			return nil, fmt.Errorf("сессия %s: неверный ответ: %w", id, err)
+		}
+		// Обрезанное Fiddler тело (ErrUnexpectedEOF) сохраняется как есть
+		responseBody, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		exchanges = append(exchanges, CapturedExchange{
+			Method:          req.Method,
+			URL:             &requestURL,
+			RequestHeaders:  req.Header,
+			RequestBody:     requestBody,
+			Status:          resp.StatusCode,
+			ResponseHeaders: resp.Header,
+			ResponseBody:    decodeCapturedBody(responseBody, resp.Header),
+		})
+	}
+	return exchanges, nil
+}
+
+// loadCharlesSession читает JSON сессию Charles; записи туннелей и без ответа пропускаются
+func loadCharlesSession(file string) ([]CapturedExchange, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var entries []charlesEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("ожидается JSON сессия Charles (.chlsj): %w", err)
+	}
+
+	exchanges := make([]CapturedExchange, 0, len(entries))
+	for i, entry := range entries {
+		if entry.Tunnel || entry.Method == http.MethodConnect || entry.Response == nil || entry.Response.Status == 0 {
+			continue
+		}
+		requestURL := &url.URL{Scheme: entry.Scheme, Host: entry.Host, Path: entry.Path}
+		if requestURL.Scheme == "" {
+			requestURL.Scheme = "http"
+		}
+		if entry.ActualPort != 0 && !(requestURL.Scheme == "http" && entry.ActualPort == 80) && !(requestURL.Scheme == "https" && entry.ActualPort == 443) {
+			requestURL.Host = net.JoinHostPort(entry.Host, strconv.Itoa(entry.ActualPort))
+		}
+		if entry.Query != nil {
+			requestURL.RawQuery = *entry.Query
+		}
+
+		requestHeaders, requestBody, err := entry.Request.decode()
+		if err != nil {
+			return nil, fmt.Errorf("запись %d: %w", i+1, err)
+		}
+		responseHeaders, responseBody, err := entry.Response.decode()
+		if err != nil {
+			return nil, fmt.Errorf("запись %d: %w", i+1, err)
+		}
+		exchanges = append(exchanges, CapturedExchange{
+			Method:          entry.Method,
+			URL:             requestURL,
+			RequestHeaders:  requestHeaders,
+			RequestBody:     requestBody,
+			Status:          entry.Response.Status,
+			ResponseHeaders: responseHeaders,
+			ResponseBody:    responseBody,
+		})
+	}
+	return exchanges, nil
+}
+
+// decode заголовки и тело сообщения Charles; тело, распакованное Charles, теряет Content-Encoding
+func (m *charlesMessage) decode() (http.Header, []byte, error) {
+	headers := make(http.Header)
+	for _, header := range m.Header.Headers {
+		headers.Add(header.Name, header.Value)
+	}
+	if m.Body == nil {
+		return headers, nil, nil
+	}
+	if m.Body.Text != nil {
+		if m.Body.Decoded {
+			headers.Del("Content-Encoding")
+		}
+		return headers, []byte(*m.Body.Text), nil
+	}
+	body, err := base64.StdEncoding.DecodeString(m.Body.Encoded)
+	if err != nil {
+		return nil, nil, fmt.Errorf("неверное тело base64: %w", err)
+	}
+	if m.Body.Decoded {
+		headers.Del("Content-Encoding")
+		return headers, body, nil
+	}
+	return headers, decodeCapturedBody(body, headers), nil
+}
+
+// decodeCapturedBody распаковывает gzip тело и удаляет Content-Encoding; остальные кодировки
+// остаются как есть вместе с заголовком
+func decodeCapturedBody(body []byte, headers http.Header) []byte {
+	if !strings.EqualFold(headers.Get("Content-Encoding"), "gzip") {
+		return body
+	}
+	decoded, err := decompressGzip(body)
+	if err != nil {
+		return body
+	}
+	headers.Del("Content-Encoding")
+	return decoded
+}
+
+// capturedFixtures запросы сессии для selftest
+func capturedFixtures(exchanges []CapturedExchange) []SelfTestCase {
+	cases := make([]SelfTestCase, 0, len(exchanges))
+	for _, exchange := range exchanges {
+		testCase := SelfTestCase{Method: exchange.Method, URL: exchange.URL.String(), Headers: make(map[string]string), Body: string(exchange.RequestBody)}
+		for name, values := range exchange.RequestHeaders {
+			if name != "Content-Length" {
+				testCase.Headers[name] = strings.Join(values, ", ")
+			}
+		}
+		cases = append(cases, testCase)
+	}
+	return cases
+}
+
+// capturedRules правила подмены из обменов сессии: одно правило на метод и URL (с query),
+// повторы пропускаются - побеждает первый ответ. Бинарные и большие тела записываются в bodiesDir
+func capturedRules(exchanges []CapturedExchange, fullURL bool, bodiesDir string) ([]ImportedRule, int, error) {
+	var rules []ImportedRule
+	seen := make(map[string]bool)
+	files := 0
+	for _, exchange := range exchanges {
+		pattern := exchange.URL.RequestURI()
+		if fullURL {
+			pattern = exchange.URL.String()
+		}
+		key := exchange.Method + " " + pattern
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		rule := ImportedRule{
+			Name:         key,
+			Method:       exchange.Method,
+			URLPattern:   pattern,
+			MatchType:    "exact",
+			MatchFullURL: fullURL,
+			StatusCode:   exchange.Status,
+			Headers:      make(map[string]string),
+			Enabled:      true,
+		}
+		for name, values := range exchange.ResponseHeaders {
+			// Длину, дату и параметры соединения прокси выставляет сам
+			switch name {
+			case "Content-Length", "Date", "Connection", "Keep-Alive", "Transfer-Encoding", "Proxy-Connection":
+				continue
+			case "Set-Cookie":
+				rule.Headers[name] = values[0]
+				continue
+			}
+			rule.Headers[name] = strings.Join(values, ", ")
+		}
+
+		body := exchange.ResponseBody
+		if len(body) > 0 && utf8.Valid(body) && bytes.IndexByte(body, 0) < 0 && len(body) <= importedBodyInlineLimit {
+			rule.BodyText = string(body)
+		} else if len(body) > 0 {
+			extension := ".bin"
+			if mediaType, _, err := mime.ParseMediaType(exchange.ResponseHeaders.Get("Content-Type")); err == nil {
+				if extensions, _ := mime.ExtensionsByType(mediaType); len(extensions) > 0 {
+					extension = extensions[0]
+				}
+			}
+			name := strings.Trim(regexp.MustCompile(`[^A-Za-z0-9_-]+`).ReplaceAllString(exchange.URL.Path, "_"), "_")
+			if len(name) > 60 {
+				name = name[:60]
+			}
+			rule.BodyFile = filepath.Join(bodiesDir, fmt.Sprintf("%03d-%s%s", len(rules)+1, name, extension))
+			if err := os.MkdirAll(bodiesDir, 0755); err != nil {
+				return nil, 0, err
+			}
+			if err := os.WriteFile(rule.BodyFile, body, 0644); err != nil {
+				return nil, 0, err
+			}
+			files++
+		}
+		rules = append(rules, rule)
+	}
+	return rules, files, nil
+}
+
+// runSessionImport команда import: сессия Fiddler/Charles → конфигурация правил подмены
+// (или примеры запросов для selftest с --fixtures). Результат - в stdout или файл -o,
+// отчет - в stderr. Аргументы: [--fixtures] [--full-url] [--bodies DIR] [-o FILE] <файл>
+func runSessionImport(args []string) int {
+	fixtures, fullURL := false, false
+	bodiesDir := "responses/imported"
+	var file, output string
+	valid := true
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--fixtures":
+			fixtures = true
+		case "--full-url":
+			fullURL = true
+		case "--bodies", "-o":
+			if i+1 == len(args) {
+				valid = false
+				continue
+			}
+			if args[i] == "-o" {
+				output = args[i+1]
+			} else {
+				bodiesDir = args[i+1]
+			}
+			i++
+		default:
+			file = args[i]
+		}
+	}
+	if file == "" || !valid {
+		fmt.Println("Использование: go run main.go import [--fixtures] [--full-url] [--bodies DIR] [-o FILE] capture.saz|session.chlsj")
+		fmt.Println("  --fixtures - примеры запросов для selftest вместо правил подмены")
+		fmt.Println("  --full-url - правила сравнивают полный URL со схемой и хостом (для сессий с несколькими хостами)")
+		fmt.Println("  --bodies   - директория для бинарных и больших тел ответов (по умолчанию responses/imported)")
+		fmt.Println("  -o         - файл результата (по умолчанию stdout)")
+		return 2
+	}
+
+	exchanges, err := loadCapturedSession(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Ошибка чтения %s: %v\n", file, err)
+		return 2
+	}
+
+	var result interface{}
+	if fixtures {
+		result = capturedFixtures(exchanges)
+		fmt.Fprintf(os.Stderr, "📥 %s: обменов %d → примеров запросов %d\n", file, len(exchanges), len(exchanges))
+	} else {
+		rules, files, err := capturedRules(exchanges, fullURL, bodiesDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ Ошибка записи тел ответов: %v\n", err)
+			return 2
+		}
+		result = map[string]interface{}{"overrides": rules}
+		fmt.Fprintf(os.Stderr, "📥 %s: обменов %d → правил %d (повторов пропущено %d)\n", file, len(exchanges), len(rules), len(exchanges)-len(rules))
+		if files > 0 {
+			fmt.Fprintf(os.Stderr, "📁 Тел ответов в файлах: %d (%s)\n", files, bodiesDir)
+		}
+		hosts := make(map[string]bool)
+		for _, exchange := range exchanges {
+			hosts[exchange.URL.Host] = true
+		}
+		if len(hosts) > 1 && !fullURL {
+			fmt.Fprintf(os.Stderr, "⚠️  В сессии %d хостов, а правила сравнивают только путь - используйте --full-url, если пути пересекаются\n", len(hosts))
+		}
+	}
+
+	data, _ := json.MarshalIndent(result, "", "  ")
+	data = append(data, '\n')
+	if output == "" {
+		os.Stdout.Write(data)
+		return 0
+	}
+	if err := os.WriteFile(output, data, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Ошибка записи %s: %v\n", output, err)
+		return 2
+	}
+	fmt.Fprintf(os.Stderr, "✅ Записано в %s\n", output)
+	return 0
+}
+
+// runSelfTest прогоняет примеры запросов через правила подмены без обращения к серверу
+// и выводит, какие правила сработали, подменные ответы и правила без срабатываний.
+// Аргументы: [--strict] <файл>. Возвращает код завершения процесса
+func runSelfTest(args []string) int {
+	strict := false
+	var file string
+	for _, arg := range args {
+		if arg == "--strict" {
+			strict = true
+		} else {
+			file = arg
+		}
+	}
+	if file == "" {
+		fmt.Println("Использование: go run main.go selftest [--strict] requests.json|traffic.har|capture.saz|session.chlsj")
+		fmt.Println("  --strict - ошибка, если какое-то включенное правило не сработало ни разу")
+		return 2
+	}
+
+	configFile := os.Getenv("OVERRIDE_CONFIG")
+	if configFile == "" {
+		configFile = "overrides.json"
+	}
+	if _, err := os.Stat(configFile); err != nil {
+		fmt.Printf("❌ Конфигурация подмен не найдена: %v\n", err)
+		return 2
+	}
+	cases, err := loadSelfTestCases(file)
+	if err != nil {
+		fmt.Printf("❌ Ошибка чтения %s: %v\n", file, err)
+		return 2
+	}
+
+	// Логи правил не смешиваются с отчетом; предупреждения загрузки выводятся
+	setupLogSettings()
+	loadPlugins()
+	if !loadConfig(configFile) {
+		return 2
+	}
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// Уведомления о срабатывании не отправляются
+	overrides := currentOverrides(nil)
+	for i := range overrides {
+		overrides[i].WebhookURL = ""
+	}
+
+	fmt.Printf("🧪 Проверка правил %s на %d запросах из %s\n\n", configFile, len(cases), file)
+	failures := 0
+	for i, testCase := range cases {
+		if testCase.Method == "" {
+			testCase.Method = http.MethodGet
+		}
+		rule, result := runSelfTestCase(testCase)
+		fmt.Printf("%3d. %s %s\n", i+1, testCase.Method, testCase.URL)
+		fmt.Printf("     Правило: %s\n", rule)
+		fmt.Printf("     Результат: %s\n", result.description)
+
+		if testCase.ExpectRule != "" && testCase.ExpectRule != rule {
+			fmt.Printf("     ❌ Ожидалось правило: %s\n", testCase.ExpectRule)
+			failures++
+		}
+		if testCase.ExpectStatus != 0 && testCase.ExpectStatus != result.statusCode {
+			fmt.Printf("     ❌ Ожидался статус: %d, получен: %d\n", testCase.ExpectStatus, result.statusCode)
+			failures++
+		}
+	}
+
+	var untriggered, disabled []string
+	for i := range overrides {
+		override := &overrides[i]
+		triggered := override.triggerCount()
+		if !override.Enabled {
+			disabled = append(disabled, override.Name)
+		} else if triggered == 0 {
+			untriggered = append(untriggered, override.Name)
+		}
+	}
+
+	fmt.Println()
+	fmt.Printf("📊 Правил: %d, не сработали: %d, отключены: %d\n", len(overrides), len(untriggered), len(disabled))
+	for _, name := range untriggered {
+		fmt.Printf("   ⚪ Не сработало: %s\n", name)
+	}
+	for _, name := range disabled {
+		fmt.Printf("   ⛔ Отключено: %s\n", name)
+	}
+	if strict && len(untriggered) > 0 {
+		failures += len(untriggered)
+	}
+
+	if failures > 0 {
+		fmt.Printf("\n❌ Несоответствий: %d\n", failures)
+		return 1
+	}
+	fmt.Printf("\n✅ Все проверки пройдены\n")
+	return 0
+}
+
+// selfTestResult результат обработки примера запроса
+type selfTestResult struct {
+	statusCode  int // 0 = запрос ушел бы на сервер
+	description string
+}
+
+// runSelfTestCase применяет к примеру запроса ту же логику выбора правила, что и proxyRequest
+func runSelfTestCase(testCase SelfTestCase) (string, selfTestResult) {
+	// Абсолютный URL сохраняется: правила с match_full_url сравнивают и хост
+	target := testCase.URL
+	if parsed, err := url.Parse(target); (err != nil || !parsed.IsAbs()) && !strings.HasPrefix(target, "/") {
+		target = "/" + target
+	}
+
+	r := httptest.NewRequest(testCase.Method, target, strings.NewReader(testCase.Body))
+	for name, value := range testCase.Headers {
+		r.Header.Set(name, value)
+	}
+
+	fullURL := r.URL.Path
+	if r.URL.RawQuery != "" {
+		fullURL += "?" + r.URL.RawQuery
+	}
+	recorder := httptest.NewRecorder()
+	if schemaRule := findSchemaOverride(r.Method, fullURL, r.Header.Get("Content-Type"), r); schemaRule != nil && !validateRequestBody(recorder, r, schemaRule) {
+		return schemaRule.Name, describeSelfTestResponse("запрос отклонен по JSON Schema", recorder)
+	}
+
+	override := findMatchingOverride(r.Method, fullURL, r.Header.Get("Content-Type"), r)
+	if override == nil {
+		return "-", selfTestResult{description: "проксирование на сервер без подмены"}
+	}
+	defer releaseOverride(override)
+
+	if override.RateLimit != nil {
+		writeRateLimitResponse(recorder, override, time.Now().Add(override.retryAfterDuration))
+		return override.Name, describeSelfTestResponse("ограничение частоты", recorder)
+	}
+
+	if override.BodyFile == "" && override.BodyText == "" {
+		var actions []string
+		if len(override.BodyReplacements) > 0 {
+			actions = append(actions, fmt.Sprintf("замены в теле (%d)", len(override.BodyReplacements)))
+		}
+		if override.Fault != nil {
+			actions = append(actions, "повреждение ответа")
+		}
+		if override.HTMLInject != "" {
+			actions = append(actions, "внедрение HTML")
+		}
+		if hasTransforms(override) {
+			actions = append(actions, "обработчики ответа")
+		}
+		if len(actions) == 0 {
+			return override.Name, selfTestResult{description: "проксирование на сервер"}
+		}
+		return override.Name, selfTestResult{description: "проксирование на сервер: " + strings.Join(actions, ", ")}
+	}
+
+	aborted := func() (aborted bool) {
+		// Обрыв соединения (fault.truncate_after) прерывает обработчик через panic
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				if recovered != http.ErrAbortHandler {
+					panic(recovered)
+				}
+				aborted = true
+			}
+		}()
+		handleOverride(recorder, r, override)
+		return false
+	}()
+	if aborted {
+		return override.Name, describeSelfTestResponse("подменный ответ, соединение оборвано", recorder)
+	}
+	return override.Name, describeSelfTestResponse("подменный ответ", recorder)
+}
+
+func describeSelfTestResponse(prefix string, recorder *httptest.ResponseRecorder) selfTestResult {
+	body := recorder.Body.Bytes()
+	description := fmt.Sprintf("%s %d, %d bytes", prefix, recorder.Code, len(body))
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "" {
+		description += ", " + contentType
+	}
+	if len(body) > 0 && isPrintableText(body) {
+		description += "\n     Тело: " + truncateString(strings.ReplaceAll(string(body), "\n", " "), 200)
+	}
+	return selfTestResult{statusCode: recorder.Code, description: description}
+}
+
+// RuleCloseMiss запрос, не прошедший ровно одно условие правила
+type RuleCloseMiss struct {
+	Method   string    `json:"method"`
+	URL      string    `json:"url"`
+	Reason   string    `json:"reason"` // "method", "content_type", "url", "matcher" или "when"
+	Count    int       `json:"count"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// maxCloseMisses сколько разных близких промахов хранится для правила
+const maxCloseMisses = 10
+
+// recordCloseMiss сохраняет близкий промах для отчета о покрытии
+func recordCloseMiss(override *ResponseOverride, method, urlPath, reason string) {
+	override.mutex.Lock()
+	defer override.mutex.Unlock()
+	for i := range override.closeMisses {
+		miss := &override.closeMisses[i]
+		if miss.Method == method && miss.URL == urlPath && miss.Reason == reason {
+			miss.Count++
+			miss.LastSeen = time.Now()
+			return
+		}
+	}
+	if len(override.closeMisses) < maxCloseMisses {
+		override.closeMisses = append(override.closeMisses, RuleCloseMiss{
+			Method: method, URL: urlPath, Reason: reason, Count: 1, LastSeen: time.Now(),
+		})
+	}
+}
+
+// isCloseURL проверяет, похож ли URL на паттерн правила: отличается регистром
+// или путь отличается от паттерна на несколько символов (опечатка, другая версия API)
+func isCloseURL(urlPath string, override *ResponseOverride) bool {
+	if override.MatchType == "regex" || override.MatchType == "glob" || override.MatchFullURL {
+		return false
+	}
+	pattern := override.URLPattern
+	if strings.Contains(strings.ToLower(urlPath), strings.ToLower(pattern)) {
+		return true
+	}
+	if index := strings.Index(urlPath, "?"); index >= 0 {
+		urlPath = urlPath[:index]
+	}
+	// Расстояние считается только для паттернов с тем же первым сегментом пути - иначе каждый
+	// запрос сравнивался бы со всеми правилами
+	if !strings.HasPrefix(pattern, "/") || !strings.EqualFold(firstPathSegment(urlPath), firstPathSegment(pattern)) {
+		return false
+	}
+	threshold := len(pattern) / 5
+	if threshold < 1 {
+		threshold = 1
+	}
+	return editDistance(urlPath, pattern, threshold) <= threshold
+}
+
+// firstPathSegment первый сегмент пути: "/api/users/1" → "api"
+func firstPathSegment(path string) string {
+	segment, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	return segment
+}
+
+// editDistance расстояние Левенштейна; при превышении limit возвращает limit+1
+func editDistance(a, b string, limit int) int {
+	if diff := len(a) - len(b); diff > limit || -diff > limit {
+		return limit + 1
+	}
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		rowMin := current[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(min(previous[j]+1, current[j-1]+1), previous[j-1]+cost)
+			if current[j] < rowMin {
+				rowMin = current[j]
+			}
+		}
+		if rowMin > limit {
+			return limit + 1
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// showCoverage отчет о покрытии правил: какие правила не совпали ни с одним запросом и близкие промахи
+func showCoverage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	overrides := currentOverrides(r)
+	used := make([]map[string]interface{}, 0)
+	unused := make([]map[string]interface{}, 0)
+	for i := range overrides {
+		override := &overrides[i]
+		override.mutex.Lock()
+		closeMisses := append([]RuleCloseMiss(nil), override.closeMisses...)
+		entry := map[string]interface{}{
+			"name":           override.Name,
+			"method":         override.Method,
+			"url_pattern":    override.URLPattern,
+			"is_regex":       override.IsRegex,
+			"match_type":     override.MatchType,
+			"match_full_url": override.MatchFullURL,
+			"enabled":        override.Enabled,
+			"match_count":    atomic.LoadInt64(&override.matchCount),
+			"trigger_count":  override.triggerCount(),
+		}
+		matched := atomic.LoadInt64(&override.matchCount) > 0
+		override.mutex.Unlock()
+
+		if matched {
+			used = append(used, entry)
+			continue
+		}
+		sort.Slice(closeMisses, func(a, b int) bool { return closeMisses[a].Count > closeMisses[b].Count })
+		entry["close_misses"] = closeMisses
+		unused = append(unused, entry)
+	}
+
+	coverage := 0.0
+	if len(overrides) > 0 {
+		coverage = math.Round(float64(len(used))/float64(len(overrides))*1000) / 10
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"total_rules":      len(overrides),
+		"used_rules":       len(used),
+		"unused_rules":     len(unused),
+		"coverage_percent": coverage,
+		"unused":           unused,
+		"used":             used,
+	})
+}
+
+// UnexpectedRequest запрос, которого нет ни в правилах, ни в UNMATCHED_PASSTHROUGH
+type UnexpectedRequest struct {
+	Method string    `json:"method"`
+	URL    string    `json:"url"`
+	Host   string    `json:"host,omitempty"`
+	Count  int       `json:"count"`
+	Last   time.Time `json:"last"`
+}
+
+const maxRecentUnexpected = 100
+
+var unmatchedPolicy = "passthrough"       // passthrough - проксировать на сервер, reject - отвечать 501
+var unmatchedPassthrough []string         // Паттерны URL, которые проксируются и в режиме reject
+var unexpectedRequests int64              // Отклоненные запросы (атомарный)
+var recentUnexpected []*UnexpectedRequest // Уникальные метод+URL (под unexpectedMutex)
+var unexpectedMutex sync.Mutex
+
+func setupUnmatchedPolicy() {
+	if value := os.Getenv("UNMATCHED_POLICY"); value != "" {
+		if value != "passthrough" && value != "reject" {
+			log.Printf("⚠️  Неизвестное значение UNMATCHED_POLICY: %s, используется passthrough", value)
+		} else {
+			unmatchedPolicy = value
+		}
+	}
+	if value := os.Getenv("UNMATCHED_PASSTHROUGH"); value != "" {
+		for _, pattern := range strings.Split(value, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				unmatchedPassthrough = append(unmatchedPassthrough, pattern)
+			}
+		}
+	}
+}
+
+func printUnmatchedPolicySettings() {
+	log.Printf("🚧 Запросы без правил:")
+	if unmatchedPolicy == "reject" {
+		log.Printf("   Policy: reject (501) ✅")
+		if len(unmatchedPassthrough) > 0 {
+			log.Printf("   Passthrough: %v", unmatchedPassthrough)
+		}
+	} else {
+		log.Printf("   Policy: passthrough (проксируются на сервер)")
+	}
+	log.Printf("")
+	log.Printf("🔧 Переменные окружения для запросов без правил:")
+	log.Printf("   - UNMATCHED_POLICY=reject - отвечать 501 на запросы, под которые не подходит ни одно правило")
+	log.Printf("   - UNMATCHED_PASSTHROUGH=/health,/static/* - URL, которые все равно проксируются")
+	log.Printf("")
+}
+
+// rejectUnexpected отвечает 501 на запрос без подходящего правила в режиме UNMATCHED_POLICY=reject.
+// Правило, условия которого выполнены, но которое не сработало (trigger_after, max_triggers), считается ожидаемым
+func rejectUnexpected(w http.ResponseWriter, r *http.Request, fullURL string) bool {
+	if unmatchedPolicy != "reject" || isExcludedURL(fullURL, unmatchedPassthrough) {
+		return false
+	}
+	overrides := currentOverrides(r)
+	for i := range overrides {
+		override := &overrides[i]
+		if override.Enabled && overrideMismatch(override, r.Method, fullURL, r.Header.Get("Content-Type"), r) == "" {
+			return false
+		}
+	}
+
+	atomic.AddInt64(&unexpectedRequests, 1)
+	unexpectedMutex.Lock()
+	var recorded *UnexpectedRequest
+	for _, item := range recentUnexpected {
+		if item.Method == r.Method && item.URL == fullURL && item.Host == r.URL.Host {
+			recorded = item
+			break
+		}
+	}
+	if recorded == nil {
+		recorded = &UnexpectedRequest{Method: r.Method, URL: fullURL, Host: r.URL.Host}
+		if len(recentUnexpected) >= maxRecentUnexpected {
+			recentUnexpected = recentUnexpected[1:]
+		}
+		recentUnexpected = append(recentUnexpected, recorded)
+	}
+	recorded.Count++
+	recorded.Last = time.Now()
+	unexpectedMutex.Unlock()
+
+	requestLogf(r, "🚧 Неожиданный запрос (нет правила): %s %s", r.Method, fullURL)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Proxy-Unexpected", "true")
+	w.WriteHeader(http.StatusNotImplemented)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":  "unexpected request: no override matches and URL is not in UNMATCHED_PASSTHROUGH",
+		"method": r.Method,
+		"url":    fullURL,
+	})
+	return true
+}
+
+func unexpectedStats() map[string]interface{} {
+	unexpectedMutex.Lock()
+	defer unexpectedMutex.Unlock()
+	requests := make([]UnexpectedRequest, 0, len(recentUnexpected))
+	for _, item := range recentUnexpected {
+		requests = append(requests, *item)
+	}
+	return map[string]interface{}{
+		"policy":      unmatchedPolicy,
+		"passthrough": unmatchedPassthrough,
+		"rejected":    atomic.LoadInt64(&unexpectedRequests),
+		"requests":    requests,
+	}
+}
+
+// JournalEntry запрос клиента в журнале
+type JournalEntry struct {
+	Time     time.Time `json:"time"`
+	Method   string    `json:"method"`
+	URL      string    `json:"url"` // Путь с query
+	Host     string    `json:"host,omitempty"`
+	Endpoint string    `json:"endpoint,omitempty"` // Метод и путь с {id} вместо идентификаторов
+	Shape    string    `json:"shape,omitempty"`    // Структура JSON тела запроса: ключи и типы без значений
+	Rule     string    `json:"rule,omitempty"`     // Сработавшее правило
+	Tenant   string    `json:"tenant,omitempty"`
+}
+
+var journalSize = 10000 // Сколько последних запросов хранится (0 - журнал отключен)
+var requestJournal []JournalEntry
+var journalFile *os.File // Файл JOURNAL_FILE: все записи прогона в формате JSON Lines (под journalMutex)
+var journalMutex sync.Mutex
+
+func setupRequestJournal() {
+	if value := os.Getenv("JOURNAL_SIZE"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			log.Printf("⚠️  Неверное значение JOURNAL_SIZE: %s", value)
+		} else {
+			journalSize = size
+		}
+	}
+
+	// {time} - время запуска, чтобы каждый прогон писал свой файл
+	if value := os.Getenv("JOURNAL_FILE"); value != "" {
+		name := strings.ReplaceAll(value, "{time}", startedAt.Format("20060102-150405"))
+		if dir := filepath.Dir(name); dir != "." {
+			os.MkdirAll(dir, 0755)
+		}
+		file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Printf("⚠️  Не удалось открыть JOURNAL_FILE %s: %v", name, err)
+			return
+		}
+		journalFile = file
+	}
+}
+
+func printRequestJournalSettings() {
+	log.Printf("📒 Журнал запросов для /_proxy/verify:")
+	if journalSize > 0 {
+		log.Printf("   Size: %d", journalSize)
+	} else {
+		log.Printf("   Enabled: ❌ (проверяются только счетчики правил)")
+	}
+	if journalFile != nil {
+		log.Printf("   File: %s", journalFile.Name())
+	}
+	log.Printf("")
+	log.Printf("🔧 Переменные окружения для журнала запросов:")
+	log.Printf("   - JOURNAL_SIZE=10000 - сколько последних запросов хранить (0 - отключить)")
+	log.Printf("   - JOURNAL_FILE=runs/journal-{time}.jsonl - сохранять журнал прогона для сравнения (go run main.go compare)")
+	log.Printf("")
+}
+
+// recordJournal добавляет запрос в журнал; самые старые записи вытесняются
+func recordJournal(r *http.Request, fullURL string, override *ResponseOverride) {
+	if journalSize == 0 && journalFile == nil {
+		return
+	}
+	entry := JournalEntry{
+		Time:     time.Now(),
+		Method:   r.Method,
+		URL:      fullURL,
+		Host:     r.URL.Host,
+		Endpoint: endpointKey(r),
+		Tenant:   tenantName(r),
+	}
+	if override != nil {
+		entry.Rule = override.Name
+	}
+	// Структура тела нужна только для сравнения прогонов по JOURNAL_FILE
+	if journalFile != nil && r.Body != nil && r.Body != http.NoBody && strings.Contains(r.Header.Get("Content-Type"), "json") {
+		var body interface{}
+		if json.Unmarshal(peekRequestBody(r), &body) == nil {
+			entry.Shape = jsonShape(body)
+		}
+	}
+
+	journalMutex.Lock()
+	defer journalMutex.Unlock()
+	if journalFile != nil {
+		line, _ := json.Marshal(entry)
+		if _, err := journalFile.Write(append(line, '\n')); err != nil {
+			requestLogf(r, "⚠️  Ошибка записи JOURNAL_FILE: %v", err)
+		}
+	}
+	if journalSize == 0 {
+		return
+	}
+	if len(requestJournal) >= journalSize {
+		requestJournal = requestJournal[len(requestJournal)-journalSize+1:]
+	}
+	requestJournal = append(requestJournal, entry)
+}
+
+// jsonShape структура JSON значения без данных: {"items":[{"id":number}],"name":string}.
+// Элементы массива разной структуры перечисляются через |
+func jsonShape(value interface{}) string {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(typed))
+		for key := range typed {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		parts := make([]string, 0, len(keys))
+		for _, key := range keys {
+			parts = append(parts, strconv.Quote(key)+":"+jsonShape(typed[key]))
+		}
+		return "{" + strings.Join(parts, ",") + "}"
+	case []interface{}:
+		var shapes []string
+		for _, item := range typed {
+			if shape := jsonShape(item); !containsName(shapes, shape) {
+				shapes = append(shapes, shape)
+			}
+		}
+		sort.Strings(shapes)
+		return "[" + strings.Join(shapes, "|") + "]"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	default:
+		return "null"
+	}
+}
+
+// journalEntries записи журнала арендатора запроса, подходящие под метод и wildcard паттерн URL
+func journalEntries(r *http.Request, method, pattern string) []JournalEntry {
+	tenant := tenantName(r)
+	journalMutex.Lock()
+	defer journalMutex.Unlock()
+	var entries []JournalEntry
+	for _, entry := range requestJournal {
+		if entry.Tenant != tenant || (method != "" && method != "*" && !strings.EqualFold(entry.Method, method)) {
+			continue
+		}
+		if pattern != "" && !isExcludedURL(entry.URL, []string{pattern}) && !matchURLPattern(entry.Host+entry.URL, pattern) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// showJournal последние запросы журнала (GET /_proxy/journal?method=POST&url=/api/*)
+func showJournal(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	entries := journalEntries(r, query.Get("method"), query.Get("url"))
+	if entries == nil {
+		entries = []JournalEntry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"size":     journalSize,
+		"requests": entries,
+	})
+}
+
+// JournalEndpointDiff отличия эндпоинта между прогонами
+type JournalEndpointDiff struct {
+	Endpoint      string   `json:"endpoint"`
+	BaseCount     int      `json:"base_count"`
+	Count         int      `json:"count"`
+	AddedShapes   []string `json:"added_shapes,omitempty"`   // Структуры тела, которых не было в базовом прогоне
+	RemovedShapes []string `json:"removed_shapes,omitempty"` // Структуры тела, которые больше не отправляются
+}
+
+// JournalDiff сравнение журналов: базовый прогон (например, предыдущая версия клиента) и новый
+type JournalDiff struct {
+	Added     []JournalEndpointDiff `json:"added"`   // Эндпоинты, которых не было в базовом прогоне
+	Missing   []JournalEndpointDiff `json:"missing"` // Эндпоинты, которые больше не вызываются
+	Changed   []JournalEndpointDiff `json:"changed"` // Изменилось количество вызовов или структура тела
+	Unchanged int                   `json:"unchanged"`
+}
+
+func (d JournalDiff) empty() bool {
+	return len(d.Added) == 0 && len(d.Missing) == 0 && len(d.Changed) == 0
+}
+
+// loadJournalFile читает журнал: JSON Lines из JOURNAL_FILE или ответ /_proxy/journal
+func loadJournalFile(file string) ([]JournalEntry, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var exported struct {
+		Requests []JournalEntry `json:"requests"`
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' && json.Unmarshal(trimmed, &exported) == nil && exported.Requests != nil {
+		return exported.Requests, nil
+	}
+
+	var entries []JournalEntry
+	for number, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var entry JournalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, fmt.Errorf("строка %d: %v", number+1, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// compareJournals группирует запросы по эндпоинтам и сравнивает количество вызовов и структуры тел
+func compareJournals(base, current []JournalEntry) JournalDiff {
+	type endpointCalls struct {
+		count  int
+		shapes []string
+	}
+	group := func(entries []JournalEntry) map[string]*endpointCalls {
+		groups := make(map[string]*endpointCalls)
+		for _, entry := range entries {
+			endpoint := entry.Endpoint
+			if endpoint == "" {
+				endpoint = normalizeEndpoint(entry.Method, entry.Host, strings.SplitN(entry.URL, "?", 2)[0])
+			}
+			calls, ok := groups[endpoint]
+			if !ok {
+				calls = &endpointCalls{}
+				groups[endpoint] = calls
+			}
+			calls.count++
+			if entry.Shape != "" && !containsName(calls.shapes, entry.Shape) {
+				calls.shapes = append(calls.shapes, entry.Shape)
+			}
+		}
+		return groups
+	}
+	difference := func(a, b []string) []string {
+		var result []string
+		for _, item := range a {
+			if !containsName(b, item) {
+				result = append(result, item)
+			}
+		}
+		sort.Strings(result)
+		return result
+	}
+
+	baseGroups, currentGroups := group(base), group(current)
+	diff := JournalDiff{Added: []JournalEndpointDiff{}, Missing: []JournalEndpointDiff{}, Changed: []JournalEndpointDiff{}}
+	for endpoint, calls := range currentGroups {
+		baseCalls, ok := baseGroups[endpoint]
+		if !ok {
+			diff.Added = append(diff.Added, JournalEndpointDiff{Endpoint: endpoint, Count: calls.count, AddedShapes: difference(calls.shapes, nil)})
+			continue
+		}
+		entry := JournalEndpointDiff{
+			Endpoint:      endpoint,
+			BaseCount:     baseCalls.count,
+			Count:         calls.count,
+			AddedShapes:   difference(calls.shapes, baseCalls.shapes),
+			RemovedShapes: difference(baseCalls.shapes, calls.shapes),
+		}
+		if entry.BaseCount != entry.Count || len(entry.AddedShapes) > 0 || len(entry.RemovedShapes) > 0 {
+			diff.Changed = append(diff.Changed, entry)
+		} else {
+			diff.Unchanged++
+		}
+	}
+	for endpoint, calls := range baseGroups {
+		if _, ok := currentGroups[endpoint]; !ok {
+			diff.Missing = append(diff.Missing, JournalEndpointDiff{Endpoint: endpoint, BaseCount: calls.count, RemovedShapes: difference(calls.shapes, nil)})
+		}
+	}
+	for _, list := range [][]JournalEndpointDiff{diff.Added, diff.Missing, diff.Changed} {
+		sort.Slice(list, func(i, j int) bool { return list[i].Endpoint < list[j].Endpoint })
+	}
+	return diff
+}
+
+// handleJournalCompare сравнивает сохраненный прогон с текущим журналом
+// (GET /_proxy/journal/compare?baseline=runs/journal-20240115-091800.jsonl)
+func handleJournalCompare(w http.ResponseWriter, r *http.Request) {
+	if journalFile == nil {
+		http.Error(w, "Сравнение прогонов требует JOURNAL_FILE", http.StatusNotFound)
+		return
+	}
+	baseline := r.URL.Query().Get("baseline")
+	if baseline == "" {
+		http.Error(w, "Укажите файл базового прогона: ?baseline=journal-20260101-120000.jsonl", http.StatusBadRequest)
+		return
+	}
+	path, err := journalBaselinePath(baseline)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	base, err := loadJournalFile(path)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Ошибка чтения %s: %v", baseline, err), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(compareJournals(base, journalEntries(r, "", "")))
+}
+
+// journalBaselinePath ограничивает базовый прогон каталогом JOURNAL_FILE: принимается путь
+// внутри каталога или имя файла относительно него
+func journalBaselinePath(baseline string) (string, error) {
+	dir, err := filepath.Abs(filepath.Dir(journalFile.Name()))
+	if err != nil {
+		return "", err
+	}
+	path, err := filepath.Abs(baseline)
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(dir, path); err == nil && filepath.IsLocal(rel) {
+		return path, nil
+	}
+	if filepath.IsLocal(baseline) {
+		return filepath.Join(dir, baseline), nil
+	}
+	return "", fmt.Errorf("базовый прогон должен быть в каталоге JOURNAL_FILE (%s)", dir)
+}
+
+// runJournalCompare команда compare: различия двух прогонов; код выхода 1, если они есть
+func runJournalCompare(args []string) int {
+	if len(args) != 2 {
+		fmt.Println("Использование: go run main.go compare base.jsonl current.jsonl")
+		fmt.Println("  Файлы - JOURNAL_FILE прогонов или сохраненный ответ /_proxy/journal")
+		return 2
+	}
+	journals := make([][]JournalEntry, 2)
+	for i, file := range args {
+		entries, err := loadJournalFile(file)
+		if err != nil {
+			fmt.Printf("❌ Ошибка чтения %s: %v\n", file, err)
+			return 2
+		}
+		journals[i] = entries
+	}
+
+	diff := compareJournals(journals[0], journals[1])
+	fmt.Printf("🔍 Сравнение прогонов: %s (%d запросов) → %s (%d запросов)\n\n", args[0], len(journals[0]), args[1], len(journals[1]))
+	for _, entry := range diff.Added {
+		fmt.Printf("➕ %s: новый эндпоинт, вызовов %d\n", entry.Endpoint, entry.Count)
+	}
+	for _, entry := range diff.Missing {
+		fmt.Printf("➖ %s: больше не вызывается (было %d)\n", entry.Endpoint, entry.BaseCount)
+	}
+	for _, entry := range diff.Changed {
+		if entry.BaseCount != entry.Count {
+			fmt.Printf("🔢 %s: вызовов %d → %d\n", entry.Endpoint, entry.BaseCount, entry.Count)
+		}
+		for _, shape := range entry.AddedShapes {
+			fmt.Printf("🧩 %s: новая структура тела %s\n", entry.Endpoint, shape)
+		}
+		for _, shape := range entry.RemovedShapes {
+			fmt.Printf("🧩 %s: пропала структура тела %s\n", entry.Endpoint, shape)
+		}
+	}
+	fmt.Printf("\nНовых: %d, пропавших: %d, изменившихся: %d, без изменений: %d\n", len(diff.Added), len(diff.Missing), len(diff.Changed), diff.Unchanged)
+	if diff.empty() {
+		fmt.Println("✅ Поведение клиента не изменилось")
+		return 0
+	}
+	return 1
+}
+
+// VerifyCheck ожидание: правило или запросы с методом и URL встречались заданное число раз.
+// Без count, min и max ожидается хотя бы один запрос
+type VerifyCheck struct {
+	Rule   string `json:"rule,omitempty"`   // Имя правила: считаются совпадения с его условиями (match_count)
+	Method string `json:"method,omitempty"` // Метод запросов журнала (пусто - любой)
+	URL    string `json:"url,omitempty"`    // Wildcard паттерн пути с query или хоста с путем
+	Count  *int   `json:"count,omitempty"`  // Точное количество
+	Min    *int   `json:"min,omitempty"`
+	Max    *int   `json:"max,omitempty"`
+}
+
+// VerifyResult результат проверки ожидания
+type VerifyResult struct {
+	VerifyCheck
+	Actual  int    `json:"actual"`
+	Passed  bool   `json:"passed"`
+	Message string `json:"message,omitempty"`
+}
+
+// handleVerify проверяет, сколько раз клиент вызвал правило или URL (аналог verify в WireMock):
+//
+//	GET  /_proxy/verify?rule=Payment&min=2
+//	GET  /_proxy/verify?method=POST&url=/api/payments*&count=2
+//	POST /_proxy/verify {"checks": [{"rule": "Payment", "count": 2}, {"url": "/api/admin/*", "count": 0}]}
+//
+// Если хотя бы одно ожидание не выполнено, ответ - 417 Expectation Failed
+func handleVerify(w http.ResponseWriter, r *http.Request) {
+	var checks []VerifyCheck
+	switch r.Method {
+	case http.MethodGet:
+		query := r.URL.Query()
+		check := VerifyCheck{Rule: query.Get("rule"), Method: query.Get("method"), URL: query.Get("url")}
+		for name, target := range map[string]**int{"count": &check.Count, "min": &check.Min, "max": &check.Max} {
+			if value := query.Get(name); value != "" {
+				number, err := strconv.Atoi(value)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("Неверное значение %s: %s", name, value), http.StatusBadRequest)
+					return
+				}
+				*target = &number
+			}
+		}
+		checks = []VerifyCheck{check}
+	case http.MethodPost:
+		var request struct {
+			Checks []VerifyCheck `json:"checks"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, fmt.Sprintf("Ошибка парсинга проверок: %v", err), http.StatusBadRequest)
+			return
+		}
+		checks = request.Checks
+	default:
+		http.Error(w, "Используйте GET или POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if len(checks) == 0 {
+		http.Error(w, "Не задано ни одной проверки", http.StatusBadRequest)
+		return
+	}
+
+	passed := true
+	results := make([]VerifyResult, 0, len(checks))
+	for _, check := range checks {
+		result := verifyCheck(r, check)
+		if !result.Passed {
+			passed = false
+			requestLogf(r, "❌ Проверка не пройдена: %s", result.Message)
+		}
+		results = append(results, result)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !passed {
+		w.WriteHeader(http.StatusExpectationFailed)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"passed":  passed,
+		"results": results,
+	})
+}
+
+// verifyCheck считает совпадения правила или запросы журнала и сравнивает с ожиданием
+func verifyCheck(r *http.Request, check VerifyCheck) VerifyResult {
+	result := VerifyResult{VerifyCheck: check}
+	subject := ""
+	switch {
+	case check.Rule != "":
+		subject = fmt.Sprintf("правило '%s'", check.Rule)
+		found := false
+		overrides := currentOverrides(r)
+		for i := range overrides {
+			override := &overrides[i]
+			if override.Name == check.Rule {
+				result.Actual += int(atomic.LoadInt64(&override.matchCount))
+				found = true
+			}
+		}
+		if !found {
+			result.Message = subject + " не найдено"
+			return result
+		}
+	case check.URL != "" || check.Method != "":
+		subject = strings.TrimSpace(check.Method + " " + check.URL)
+		if journalSize == 0 {
+			result.Message = "журнал запросов отключен (JOURNAL_SIZE=0)"
+			return result
+		}
+		result.Actual = len(journalEntries(r, check.Method, check.URL))
+	default:
+		result.Message = "нужно указать rule или url/method"
+		return result
+	}
+
+	switch {
+	case check.Count != nil:
+		result.Passed = result.Actual == *check.Count
+		result.Message = fmt.Sprintf("%s: ожидалось %d, получено %d", subject, *check.Count, result.Actual)
+	case check.Min != nil || check.Max != nil:
+		result.Passed = (check.Min == nil || result.Actual >= *check.Min) && (check.Max == nil || result.Actual <= *check.Max)
+		expected := ""
+		if check.Min != nil {
+			expected += fmt.Sprintf(" не меньше %d", *check.Min)
+		}
+		if check.Max != nil {
+			expected += fmt.Sprintf(" не больше %d", *check.Max)
+		}
+		result.Message = fmt.Sprintf("%s: ожидалось%s, получено %d", subject, expected, result.Actual)
+	default:
+		result.Passed = result.Actual > 0
+		result.Message = fmt.Sprintf("%s: ожидался хотя бы один запрос, получено %d", subject, result.Actual)
+	}
+	return result
+}
+
+// Budget лимиты сценария: сколько раз вызывается эндпоинт, сколько байт передается, какая задержка p95.
+// Без method и url учитываются все запросы
+type Budget struct {
+	Name     string `json:"name"`
+	Method   string `json:"method,omitempty"`    // Метод (пусто или "*" - любой)
+	URL      string `json:"url,omitempty"`       // Wildcard паттерн пути с query или хоста с путем, как в /_proxy/verify
+	MaxCalls *int   `json:"max_calls,omitempty"` // Максимум запросов
+	MaxBytes *int64 `json:"max_bytes,omitempty"` // Максимум байт тел запросов и ответов вместе
+	MaxP95   string `json:"max_p95,omitempty"`   // Максимальная задержка p95, например "300ms"
+	maxP95   time.Duration
+	calls    int64
+	bytes    int64
+	samples  []float64 // Задержки в мс; после budgetSamples - равномерная выборка
+	mutex    sync.Mutex
+}
+
+// BudgetResult состояние бюджета для /_proxy/budget и отчета прогона
+type BudgetResult struct {
+	Name       string   `json:"name"`
+	Method     string   `json:"method,omitempty"`
+	URL        string   `json:"url,omitempty"`
+	Calls      int64    `json:"calls"`
+	MaxCalls   *int     `json:"max_calls,omitempty"`
+	Bytes      int64    `json:"bytes"`
+	MaxBytes   *int64   `json:"max_bytes,omitempty"`
+	P95Ms      float64  `json:"p95_ms"`
+	MaxP95     string   `json:"max_p95,omitempty"`
+	Passed     bool     `json:"passed"`
+	Violations []string `json:"violations,omitempty"`
+}
+
+const budgetSamples = 10000 // Сколько задержек хранится для расчета p95
+
+var runCommand []string // Команда режима run
+
+func (b *Budget) matches(method, host, fullURL string) bool {
+	if b.Method != "" && b.Method != "*" && !strings.EqualFold(b.Method, method) {
+		return false
+	}
+	return b.URL == "" || isExcludedURL(fullURL, []string{b.URL}) || matchURLPattern(host+fullURL, b.URL)
+}
+
+func (b *Budget) record(bytes int64, duration time.Duration) {
+	ms := float64(duration.Microseconds()) / 1000
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.calls++
+	b.bytes += bytes
+	if len(b.samples) < budgetSamples {
+		b.samples = append(b.samples, ms)
+	} else if index := randomInt63n(b.calls); index < budgetSamples {
+		b.samples[index] = ms
+	}
+}
+
+func (b *Budget) result() BudgetResult {
+	b.mutex.Lock()
+	result := BudgetResult{Name: b.Name, Method: b.Method, URL: b.URL, Calls: b.calls, MaxCalls: b.MaxCalls, Bytes: b.bytes, MaxBytes: b.MaxBytes, MaxP95: b.MaxP95}
+	samples := append([]float64(nil), b.samples...)
+	b.mutex.Unlock()
+
+	if len(samples) > 0 {
+		sort.Float64s(samples)
+		result.P95Ms = samples[(len(samples)*95+99)/100-1]
+	}
+	if b.MaxCalls != nil && result.Calls > int64(*b.MaxCalls) {
+		result.Violations = append(result.Violations, fmt.Sprintf("вызовов %d, лимит %d", result.Calls, *b.MaxCalls))
+	}
+	if b.MaxBytes != nil && result.Bytes > *b.MaxBytes {
+		result.Violations = append(result.Violations, fmt.Sprintf("передано %d байт, лимит %d", result.Bytes, *b.MaxBytes))
+	}
+	if b.maxP95 > 0 && result.P95Ms > float64(b.maxP95.Microseconds())/1000 {
+		result.Violations = append(result.Violations, fmt.Sprintf("p95 %.1fms, лимит %v", result.P95Ms, b.maxP95))
+	}
+	result.Passed = len(result.Violations) == 0
+	return result
+}
+
+func resetBudgets(budgets []Budget) {
+	for i := range budgets {
+		budget := &budgets[i]
+		budget.mutex.Lock()
+		budget.calls = 0
+		budget.bytes = 0
+		budget.samples = nil
+		budget.mutex.Unlock()
+	}
+}
+
+// budgetResults состояние бюджетов арендатора запроса или основной конфигурации (r может быть nil)
+func budgetResults(r *http.Request) ([]BudgetResult, bool) {
+	budgets := currentConfig(r).Budgets
+	results := make([]BudgetResult, 0, len(budgets))
+	passed := true
+	for i := range budgets {
+		result := budgets[i].result()
+		passed = passed && result.Passed
+		results = append(results, result)
+	}
+	return results, passed
+}
+
+func budgetStats(r *http.Request) map[string]interface{} {
+	results, passed := budgetResults(r)
+	return map[string]interface{}{
+		"passed":  passed,
+		"budgets": results,
+	}
+}
+
+// countingBody считает прочитанные байты тела запроса
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// budgetHandler учитывает запросы в подходящих бюджетах: вызов, байты тел и полное время ответа
+func budgetHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		budgets := currentConfig(r).Budgets
+		if len(budgets) == 0 || strings.HasPrefix(r.URL.Path, "/_proxy") || r.Method == http.MethodConnect {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		fullURL := r.URL.Path
+		if r.URL.RawQuery != "" {
+			fullURL += "?" + r.URL.RawQuery
+		}
+		method, host := r.Method, r.URL.Host
+		var body *countingBody
+		if r.Body != nil && r.Body != http.NoBody {
+			body = &countingBody{ReadCloser: r.Body}
+			r.Body = body
+		}
+		recorder := &trafficRecorder{ResponseWriter: w}
+		start := time.Now()
+
+		next.ServeHTTP(recorder, r)
+
+		duration := time.Since(start)
+		bytes := recorder.size
+		if body != nil {
+			bytes += body.n
+		}
+		for i := range budgets {
+			if budgets[i].matches(method, host, fullURL) {
+				budgets[i].record(bytes, duration)
+			}
+		}
+	})
+}
+
+// handleBudget состояние бюджетов сценария (GET /_proxy/budget); при нарушении - 417 Expectation Failed
+func handleBudget(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Используйте GET", http.StatusMethodNotAllowed)
+		return
+	}
+	results, passed := budgetResults(r)
+	w.Header().Set("Content-Type", "application/json")
+	if !passed {
+		w.WriteHeader(http.StatusExpectationFailed)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"passed":  passed,
+		"budgets": results,
+	})
+}
+
+// OrderingRule ограничение порядка вызовов: запрос then допустим, только если у того же клиента
+// раньше был успешный запрос first ("POST /login до GET /profile")
+type OrderingRule struct {
+	Name       string          `json:"name"`
+	First      string          `json:"first"`            // "POST */login" - метод необязателен
+	Then       string          `json:"then"`             // "GET */profile*"
+	Scope      string          `json:"scope,omitempty"`  // ip (по умолчанию), header:NAME, cookie:NAME, global
+	Action     string          `json:"action,omitempty"` // record (по умолчанию) - только учесть, reject - ответить ошибкой
+	Status     int             `json:"status,omitempty"` // Статус ответа для reject (по умолчанию 428)
+	seen       map[string]bool // Клиенты, у которых уже был first
+	checked    int64
+	violations int64
+	mutex      sync.Mutex
+}
+
+// OrderingViolation нарушение порядка вызовов для /_proxy/ordering и статистики
+type OrderingViolation struct {
+	Time    time.Time `json:"time"`
+	Rule    string    `json:"rule"`
+	Client  string    `json:"client"`
+	Request string    `json:"request"`
+	Missing string    `json:"missing"` // Запрос, которого не было раньше
+	Action  string    `json:"action"`
+}
+
+const maxOrderingViolations = 50 // Последние нарушения в статистике
+
+var recentOrderingViolations []OrderingViolation
+var orderingMutex sync.Mutex
+
+// scopeKey клиент, для которого отслеживается порядок; пусто - клиента не определить
+func (o *OrderingRule) scopeKey(r *http.Request) string {
+	switch {
+	case o.Scope == "global":
+		return "*"
+	case strings.HasPrefix(o.Scope, "header:"):
+		return r.Header.Get(strings.TrimPrefix(o.Scope, "header:"))
+	case strings.HasPrefix(o.Scope, "cookie:"):
+		if cookie, err := r.Cookie(strings.TrimPrefix(o.Scope, "cookie:")); err == nil {
+			return cookie.Value
+		}
+		return ""
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// check учитывает запрос then: возвращает нарушение, если first у клиента еще не было
+func (o *OrderingRule) check(client, method, fullURL string) *OrderingViolation {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.checked++
+	if o.seen[client] {
+		return nil
+	}
+	o.violations++
+	return &OrderingViolation{
+		Time:    time.Now(),
+		Rule:    o.Name,
+		Client:  client,
+		Request: method + " " + fullURL,
+		Missing: o.First,
+		Action:  o.Action,
+	}
+}
+
+func (o *OrderingRule) markSeen(client string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.seen == nil {
+		o.seen = make(map[string]bool)
+	}
+	o.seen[client] = true
+}
+
+func resetOrdering(rules []OrderingRule) {
+	for i := range rules {
+		rule := &rules[i]
+		rule.mutex.Lock()
+		rule.seen = nil
+		rule.checked = 0
+		rule.violations = 0
+		rule.mutex.Unlock()
+	}
+}
+
+// orderingHandler проверяет порядок вызовов: запрос then без предшествующего first учитывается
+// как нарушение или отклоняется. first засчитывается после ответа без ошибки (статус < 400)
+func orderingHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rules := currentConfig(r).Ordering
+		if len(rules) == 0 || strings.HasPrefix(r.URL.Path, "/_proxy") || r.Method == http.MethodConnect {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		fullURL := r.URL.Path
+		if r.URL.RawQuery != "" {
+			fullURL += "?" + r.URL.RawQuery
+		}
+		method := r.Method
+		for i := range rules {
+			rule := &rules[i]
+			if !matchMethodURLPattern(rule.Then, method, fullURL) {
+				continue
+			}
+			client := rule.scopeKey(r)
+			if client == "" {
+				continue
+			}
+			violation := rule.check(client, method, fullURL)
+			if violation == nil {
+				continue
+			}
+			recordOrderingViolation(*violation)
+			if rule.Action == "reject" {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("X-Proxy-Ordering-Violation", rule.Name)
+				w.WriteHeader(rule.Status)
+				json.NewEncoder(w).Encode(map[string]string{
+					"error":   "ordering",
+					"rule":    rule.Name,
+					"message": "Запросу должен предшествовать " + rule.First,
+				})
+				return
+			}
+		}
+
+		recorder := &trafficRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status >= http.StatusBadRequest {
+			return
+		}
+		for i := range rules {
+			rule := &rules[i]
+			if matchMethodURLPattern(rule.First, method, fullURL) {
+				if client := rule.scopeKey(r); client != "" {
+					rule.markSeen(client)
+				}
+			}
+		}
+	})
+}
+
+func recordOrderingViolation(violation OrderingViolation) {
+	verb := "нарушен"
+	if violation.Action == "reject" {
+		verb = "нарушен, запрос отклонен"
+	}
+	log.Printf("🔢 Порядок '%s' %s: %s (клиент %s) без предшествующего %s", violation.Rule, verb, violation.Request, violation.Client, violation.Missing)
+	orderingMutex.Lock()
+	recentOrderingViolations = append(recentOrderingViolations, violation)
+	if len(recentOrderingViolations) > maxOrderingViolations {
+		recentOrderingViolations = recentOrderingViolations[len(recentOrderingViolations)-maxOrderingViolations:]
+	}
+	orderingMutex.Unlock()
+}
+
+// orderingResults состояние правил порядка арендатора запроса или основной конфигурации (r может быть nil)
+func orderingResults(r *http.Request) (map[string]interface{}, bool) {
+	rules := currentConfig(r).Ordering
+	results := make([]map[string]interface{}, 0, len(rules))
+	passed := true
+	for i := range rules {
+		rule := &rules[i]
+		rule.mutex.Lock()
+		results = append(results, map[string]interface{}{
+			"name":       rule.Name,
+			"first":      rule.First,
+			"then":       rule.Then,
+			"scope":      rule.Scope,
+			"action":     rule.Action,
+			"checked":    rule.checked,
+			"violations": rule.violations,
+		})
+		passed = passed && rule.violations == 0
+		rule.mutex.Unlock()
+	}
+	orderingMutex.Lock()
+	recent := append([]OrderingViolation(nil), recentOrderingViolations...)
+	orderingMutex.Unlock()
+	return map[string]interface{}{
+		"passed":            passed,
+		"rules":             results,
+		"recent_violations": recent,
+	}, passed
+}
+
+func orderingStats(r *http.Request) map[string]interface{} {
+	results, _ := orderingResults(r)
+	return results
+}
+
+// handleOrdering состояние правил порядка вызовов (GET /_proxy/ordering); при нарушении - 417 Expectation Failed
+func handleOrdering(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Используйте GET", http.StatusMethodNotAllowed)
+		return
+	}
+	results, passed := orderingResults(r)
+	w.Header().Set("Content-Type", "application/json")
+	if !passed {
+		w.WriteHeader(http.StatusExpectationFailed)
+	}
+	json.NewEncoder(w).Encode(results)
+}
+
+// runAndVerify выполняет команду режима run и завершает процесс: код команды, если она упала,
+// 1 - если нарушен бюджет или порядок вызовов, 0 - если все в пределах бюджетов
+func runAndVerify(port string) {
+	cmd := exec.Command(runCommand[0], runCommand[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "PROXY_URL=http://127.0.0.1:"+port)
+	log.Printf("▶️  Прогон: %s", strings.Join(runCommand, " "))
+
+	code := 0
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			fmt.Printf("❌ Не удалось запустить команду: %v\n", err)
+			os.Exit(2)
+		}
+		code = exitErr.ExitCode()
+	}
+
+	// Команда завершилась, но ответы на ее последние запросы могут еще обрабатываться
+	finishRun()
+
+	results, passed := budgetResults(nil)
+	fmt.Printf("\n📏 Бюджеты прогона (команда завершилась с кодом %d):\n", code)
+	for _, result := range results {
+		if result.Passed {
+			fmt.Printf("✅ %s: вызовов %d, %d байт, p95 %.1fms\n", result.Name, result.Calls, result.Bytes, result.P95Ms)
+			continue
+		}
+		fmt.Printf("❌ %s: %s\n", result.Name, strings.Join(result.Violations, "; "))
+	}
+	if len(results) == 0 {
+		fmt.Println("   Бюджеты не заданы (секция budgets конфигурации)")
+	}
+
+	ordering, orderingPassed := orderingResults(nil)
+	for _, violation := range ordering["recent_violations"].([]OrderingViolation) {
+		fmt.Printf("❌ Порядок '%s': %s без предшествующего %s\n", violation.Rule, violation.Request, violation.Missing)
+	}
+	if code == 0 && (!passed || !orderingPassed) {
+		code = 1
+	}
+	os.Exit(code)
+}
+
+// finishRun дожидается текущих запросов и дописывает журнал, PCAP, индекс архива и кеш -
+// итоги прогона и файлы должны включать все запросы команды
+func finishRun() {
+	timeout := shutdownTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, server := range tenantServers {
+		go server.Shutdown(ctx)
+	}
+	if err := proxyServer.Shutdown(ctx); err != nil {
+		log.Printf("⚠️  Не все запросы завершились за %v: %v", timeout, err)
+	}
+
+	if journalFile != nil {
+		journalMutex.Lock()
+		journalFile.Sync()
+		journalMutex.Unlock()
+	}
+	if pcapExportQueue != nil {
+		flushPcapExport(ctx)
+	}
+	if archiveQueue != nil {
+		flushArchiveIndex()
+	}
+	if cacheSettings.Enabled {
+		if err := persistCache(); err != nil {
+			log.Printf("⚠️  Ошибка сохранения кеша: %v", err)
+		}
+	}
+}
+
+// Tenant арендатор: независимый набор правил подмены, пространство кеша и статистика.
+// Выбирается по порту, заголовку Host, префиксу пути или клиенту (адрес, заголовок) -
+// так несколько тестировщиков на одном прокси получают изолированное поведение
+type Tenant struct {
+	Name              string                 `json:"name"`
+	Port              string                 `json:"port"`                // Отдельный порт арендатора
+	Host              string                 `json:"host"`                // Значение Host (без порта)
+	PathPrefix        string                 `json:"path_prefix"`         // Префикс пути, удаляется перед проксированием
+	ClientIPs         []string               `json:"client_ips"`          // Адреса и подсети клиентов ("192.168.1.20", "10.0.0.0/24")
+	ClientHeader      string                 `json:"client_header"`       // Заголовок, по которому узнается клиент (X-Tester)
+	ClientHeaderValue string                 `json:"client_header_value"` // Значение заголовка (пусто - любое непустое)
+	OverrideConfig    string                 `json:"override_config"`     // Файл правил арендатора
+	Log               *LogOverride           `json:"log"`                 // Логирование запросов арендатора
+	Throttle          *TenantThrottle        `json:"throttle"`            // Замедление ответов клиентам арендатора
+	config            atomic.Pointer[Config] // Снимок правил арендатора
+	clientNets        []*net.IPNet           // Разобранные ClientIPs
+	requests          int64                  // Количество запросов (атомарный)
+}
+
+// TenantThrottle замедление для клиентов арендатора: задержка перед обработкой и скорость ответа
+type TenantThrottle struct {
+	Latency   string `json:"latency"`   // Задержка перед обработкой запроса, например "500ms"
+	Bandwidth int64  `json:"bandwidth"` // Скорость передачи ответа клиенту, байт/с (0 - без ограничений)
+	latency   time.Duration
+}
+
+type tenantContextKey struct{}
+
+var tenants []*Tenant
+var tenantServers []*http.Server
+
+// loadTenants читает список арендаторов из TENANTS_FILE и их правила
+func loadTenants() {
+	file := os.Getenv("TENANTS_FILE")
+	if file == "" {
+		return
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		log.Printf("⚠️  Не удалось прочитать арендаторов %s: %v", file, err)
+		return
+	}
+	var loaded []*Tenant
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		log.Printf("⚠️  Ошибка парсинга арендаторов %s: %v", file, err)
+		return
+	}
+
+	for _, tenant := range loaded {
+		if tenant.Name == "" || (tenant.Port == "" && tenant.Host == "" && tenant.PathPrefix == "" && len(tenant.ClientIPs) == 0 && tenant.ClientHeader == "") {
+			log.Printf("⚠️  Арендатор без имени или способа выбора (port, host, path_prefix, client_ips, client_header) пропущен")
+			continue
+		}
+		if tenant.PathPrefix != "" {
+			tenant.PathPrefix = "/" + strings.Trim(tenant.PathPrefix, "/")
+		}
+		for _, value := range tenant.ClientIPs {
+			if !strings.Contains(value, "/") {
+				if ip := net.ParseIP(value); ip != nil && ip.To4() != nil {
+					value += "/32"
+				} else {
+					value += "/128"
+				}
+			}
+			_, network, err := net.ParseCIDR(value)
+			if err != nil {
+				log.Printf("⚠️  Арендатор '%s': неверный адрес клиента '%s' пропущен", tenant.Name, value)
+				continue
+			}
+			tenant.clientNets = append(tenant.clientNets, network)
+		}
+		if tenant.Throttle != nil && tenant.Throttle.Latency != "" {
+			latency, err := time.ParseDuration(tenant.Throttle.Latency)
+			if err != nil || latency < 0 {
+				log.Printf("⚠️  Арендатор '%s': неверный формат throttle.latency '%s'", tenant.Name, tenant.Throttle.Latency)
+			} else {
+				tenant.Throttle.latency = latency
+			}
+		}
+		loadTenantConfig(tenant)
+		tenants = append(tenants, tenant)
+	}
+}
+
+// loadTenantConfig загружает правила арендатора; при ошибке сохраняются текущие
+func loadTenantConfig(tenant *Tenant) {
+	if tenant.OverrideConfig == "" {
+		return
+	}
+	loaded, ok := parseConfigFile(tenant.OverrideConfig)
+	if !ok {
+		log.Printf("⚠️  Арендатор '%s': правила не загружены", tenant.Name)
+		return
+	}
+	tenant.config.Store(&loaded)
+	log.Printf("✅ Арендатор '%s': загружена конфигурация из %s", tenant.Name, tenant.OverrideConfig)
+}
+
+// resolveTenant выбирает арендатора по заголовку клиента, адресу клиента, заголовку Host,
+// затем по префиксу пути
+func resolveTenant(r *http.Request) *Tenant {
+	for _, tenant := range tenants {
+		if tenant.ClientHeader == "" {
+			continue
+		}
+		value := strings.TrimSpace(r.Header.Get(tenant.ClientHeader))
+		if value != "" && (tenant.ClientHeaderValue == "" || value == tenant.ClientHeaderValue) {
+			return tenant
+		}
+	}
+	clientHost, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientHost = r.RemoteAddr
+	}
+	if clientIP := net.ParseIP(clientHost); clientIP != nil {
+		for _, tenant := range tenants {
+			for _, network := range tenant.clientNets {
+				if network.Contains(clientIP) {
+					return tenant
+				}
+			}
+		}
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, tenant := range tenants {
+		if tenant.Host != "" && strings.EqualFold(tenant.Host, host) {
+			return tenant
+		}
+	}
+	for _, tenant := range tenants {
+		if tenant.PathPrefix != "" && (r.URL.Path == tenant.PathPrefix || strings.HasPrefix(r.URL.Path, tenant.PathPrefix+"/")) {
+			return tenant
+		}
+	}
+	return nil
+}
+
+// tenantHandler определяет арендатора запроса и сохраняет его в контексте.
+// fixed - арендатор порта (nil для основного порта)
+func tenantHandler(next http.Handler, fixed *Tenant) http.Handler {
+	if len(tenants) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant := fixed
+		if tenant == nil {
+			tenant = resolveTenant(r)
+		}
+		if tenant == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if tenant.PathPrefix != "" && strings.HasPrefix(r.URL.Path, tenant.PathPrefix) {
+			r.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, tenant.PathPrefix), "/")
+			r.URL.RawPath = ""
+		}
+		atomic.AddInt64(&tenant.requests, 1)
+		log.Printf("🏢 Арендатор: %s", tenant.Name)
+		r = r.WithContext(context.WithValue(r.Context(), tenantContextKey{}, tenant))
+
+		// Служебные эндпоинты не замедляются
+		if throttle := tenant.Throttle; throttle != nil && !strings.HasPrefix(r.URL.Path, "/_proxy") {
+			if throttle.latency > 0 {
+				timer := time.NewTimer(throttle.latency)
+				select {
+				case <-timer.C:
+				case <-r.Context().Done():
+					timer.Stop()
+					return
+				}
+			}
+			if throttle.Bandwidth > 0 {
+				w = &throttledWriter{ResponseWriter: w, ctx: r.Context(), bandwidth: throttle.Bandwidth, start: time.Now()}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// throttledWriter ограничивает скорость передачи ответа клиенту: данные уходят порциями
+// по 1/10 секундного объема, после каждой порции - пауза до расчетного времени
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx       context.Context
+	bandwidth int64
+	start     time.Time
+	sent      int64
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	chunk := int(t.bandwidth / 10)
+	if chunk < 512 {
+		chunk = 512
+	}
+	written := 0
+	for written < len(p) {
+		end := written + chunk
+		if end > len(p) {
+			end = len(p)
+		}
+		n, err := t.ResponseWriter.Write(p[written:end])
+		written += n
+		t.sent += int64(n)
+		if err != nil {
+			return written, err
+		}
+		t.Flush()
+		wait := time.Duration(float64(t.sent)/float64(t.bandwidth)*float64(time.Second)) - time.Since(t.start)
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-t.ctx.Done():
+				timer.Stop()
+				return written, t.ctx.Err()
+			}
+		}
+	}
+	return written, nil
+}
+
+// Unwrap - исходный ResponseWriter под ограничением скорости
+func (t *throttledWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// Flush сохраняет поддержку стриминга и SSE
+func (t *throttledWriter) Flush() {
+	if flusher, ok := t.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// startTenantServers запускает отдельные порты арендаторов
+func startTenantServers(handler http.Handler) {
+	for _, tenant := range tenants {
+		if tenant.Port == "" {
+			continue
+		}
+		server := &http.Server{Handler: rawHeaderHandler(logFilterHandler(tenantHandler(handler, tenant))), ConnState: trackClientConnState, ConnContext: rawHeaderConnContext}
+		tenantServers = append(tenantServers, server)
+		go func(tenant *Tenant) {
+			// При перезапуске порт может быть еще занят предыдущим процессом
+			for attempt := 0; ; attempt++ {
+				listener, err := net.Listen("tcp", "0.0.0.0:"+tenant.Port)
+				if err != nil {
+					if attempt < 60 {
+						time.Sleep(time.Second)
+						continue
+					}
+					log.Printf("❌ Арендатор '%s': не удалось открыть порт %s: %v", tenant.Name, tenant.Port, err)
+					return
+				}
+				if err := server.Serve(wrapRawHeaderListener(wrapRawPassthroughListener(listener))); err != nil && err != http.ErrServerClosed {
+					log.Printf("❌ Арендатор '%s': ошибка сервера: %v", tenant.Name, err)
+				}
+				return
+			}
+		}(tenant)
+	}
+}
+
+// tenantFromRequest возвращает арендатора запроса (nil - основная конфигурация)
+func tenantFromRequest(r *http.Request) *Tenant {
+	if r == nil {
+		return nil
+	}
+	tenant, _ := r.Context().Value(tenantContextKey{}).(*Tenant)
+	return tenant
+}
+
+func tenantName(r *http.Request) string {
+	if tenant := tenantFromRequest(r); tenant != nil {
+		return tenant.Name
+	}
+	return ""
+}
+
+func printTenantSettings() {
+	if len(tenants) == 0 {
+		return
+	}
+	log.Printf("🏢 Арендаторы:")
+	for _, tenant := range tenants {
+		var selectors []string
+		if tenant.Port != "" {
+			selectors = append(selectors, "port "+tenant.Port)
+		}
+		if tenant.Host != "" {
+			selectors = append(selectors, "host "+tenant.Host)
+		}
+		if tenant.PathPrefix != "" {
+			selectors = append(selectors, "prefix "+tenant.PathPrefix)
+		}
+		if len(tenant.ClientIPs) > 0 {
+			selectors = append(selectors, "clients "+strings.Join(tenant.ClientIPs, ","))
+		}
+		if tenant.ClientHeader != "" {
+			selectors = append(selectors, "header "+strings.TrimSuffix(tenant.ClientHeader+": "+tenant.ClientHeaderValue, ": "))
+		}
+		if tenant.Throttle != nil {
+			selectors = append(selectors, fmt.Sprintf("throttle +%v, %d B/s", tenant.Throttle.latency, tenant.Throttle.Bandwidth))
+		}
+		log.Printf("   %s: %s, правил: %d", tenant.Name, strings.Join(selectors, ", "), len(configSnapshot(&tenant.config).Overrides))
+	}
+	log.Printf("")
+}
+
+func tenantStats() []map[string]interface{} {
+	stats := make([]map[string]interface{}, 0, len(tenants))
+	for _, tenant := range tenants {
+		rules := len(configSnapshot(&tenant.config).Overrides)
+		stats = append(stats, map[string]interface{}{
+			"name":        tenant.Name,
+			"port":        tenant.Port,
+			"host":        tenant.Host,
+			"path_prefix": tenant.PathPrefix,
+			"client_ips":  tenant.ClientIPs,
+			"header":      tenant.ClientHeader,
+			"throttle":    tenant.Throttle,
+			"rules":       rules,
+			"requests":    atomic.LoadInt64(&tenant.requests),
+		})
+	}
+	return stats
+}
+
+// cacheNamespace определяет пространство кеша запроса: значение CACHE_NAMESPACE_HEADER,
+// затем первый подходящий паттерн CACHE_NAMESPACES, иначе "default".
+// Пространства арендатора получают префикс с его именем
+func cacheNamespace(r *http.Request, fullURL string) string {
+	namespace := ""
+	if cacheSettings.NamespaceHeader != "" {
+		namespace = strings.TrimSpace(r.Header.Get(cacheSettings.NamespaceHeader))
+	}
+	if namespace == "" {
+		for _, pattern := range cacheSettings.NamespacePatterns {
+			if matchURLPattern(fullURL, pattern.Pattern) {
+				namespace = pattern.Namespace
+				break
+			}
+		}
+	}
+	if namespace == "" {
+		namespace = "default"
+	}
+	return tenantCacheNamespace(r, namespace)
+}
+
+// tenantCacheNamespace отделяет пространства кеша арендатора от пространств других арендаторов
+func tenantCacheNamespace(r *http.Request, namespace string) string {
+	if tenant := tenantFromRequest(r); tenant != nil {
+		return tenant.Name + "/" + namespace
+	}
+	return namespace
+}
+
+// ownsCacheNamespace проверяет, что пространство кеша принадлежит арендатору запроса. Пространства
+// основной конфигурации не имеют префикса, поэтому пространства арендаторов исключаются явно
+func ownsCacheNamespace(r *http.Request, namespace string) bool {
+	if tenant := tenantFromRequest(r); tenant != nil {
+		return strings.HasPrefix(namespace, tenant.Name+"/")
+	}
+	for _, tenant := range tenants {
+		if strings.HasPrefix(namespace, tenant.Name+"/") {
+			return false
+		}
+	}
+	return true
+}
+
+func namespacedCacheKey(namespace, key string) string {
+	return namespace + ":" + key
+}
+
+// entryNamespace пространство записи (записи из файлов старых версий - default)
+func entryNamespace(entry *CacheEntry) string {
+	if entry.Namespace == "" {
+		return "default"
+	}
+	return entry.Namespace
+}
+
+// handleCacheFlush удаляет записи одного пространства кеша:
+// ?namespace=имя, без параметра - пространство самого запроса; ?all=true - все пространства (арендатора)
+func handleCacheFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Используйте POST или DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+
+	all := r.URL.Query().Get("all") == "true"
+	namespace := r.URL.Query().Get("namespace")
+	if namespace != "" {
+		namespace = tenantCacheNamespace(r, namespace)
+	} else {
+		namespace = cacheNamespace(r, "")
+	}
+
+	// all=true основной конфигурации не затрагивает пространства арендаторов
+	removed := 0
+	responseCache.Range(func(key, value interface{}) bool {
+		entryNS := entryNamespace(value.(*CacheEntry))
+		if (all && ownsCacheNamespace(r, entryNS)) || (!all && entryNS == namespace) {
+			responseCache.Delete(key)
+			markCacheDirty(key.(string))
+			removed++
+		}
+		return true
+	})
+
+	if all {
+		namespace = "*"
+	}
+	requestLogf(r, "🗑️  Очищено пространство кеша '%s': %d записей", namespace, removed)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"namespace": namespace, "removed": removed})
+}
+
+// CacheEntryInfo запись кеша без тела для /_proxy/cache
+type CacheEntryInfo struct {
+	Key        string    `json:"key"`
+	Namespace  string    `json:"namespace"`
+	URL        string    `json:"url"`
+	Status     int       `json:"status"`
+	Size       int       `json:"size"`
+	CachedAt   time.Time `json:"cached_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	TTLSeconds float64   `json:"ttl_seconds"` // Оставшийся срок (0 - запись истекла)
+}
+
+// CacheExpiryChange изменение срока записи для PATCH /_proxy/cache: задается одно поле
+type CacheExpiryChange struct {
+	TTL       string     `json:"ttl,omitempty"`        // Новый срок от текущего момента ("30s")
+	Extend    string     `json:"extend,omitempty"`     // Продлить текущий срок ("5m", "-10s" - сократить)
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // Точный момент истечения (RFC 3339)
+	Expire    bool       `json:"expire,omitempty"`     // Истечь сейчас
+}
+
+var cacheExpiryChanged int64 // Записи, срок которых изменен через /_proxy/cache (атомарный)
+
+func cacheEntryInfo(key string, entry *CacheEntry) CacheEntryInfo {
+	ttl := time.Until(entry.ExpiresAt).Seconds()
+	if ttl < 0 {
+		ttl = 0
+	}
+	return CacheEntryInfo{
+		Key:        key,
+		Namespace:  entryNamespace(entry),
+		URL:        entry.RequestURL,
+		Status:     entry.StatusCode,
+		Size:       len(entry.Body),
+		CachedAt:   entry.CachedAt,
+		ExpiresAt:  entry.ExpiresAt,
+		TTLSeconds: math.Round(ttl*1000) / 1000,
+	}
+}
+
+// expiresAt вычисляет новый срок записи; ошибка - если поле не задано, их несколько или формат неверный
+func (c CacheExpiryChange) expiresAt(current time.Time) (time.Time, error) {
+	set := 0
+	for _, present := range []bool{c.TTL != "", c.Extend != "", c.ExpiresAt != nil, c.Expire} {
+		if present {
+			set++
+		}
+	}
+	if set != 1 {
+		return time.Time{}, fmt.Errorf("укажите одно из полей: ttl, extend, expires_at, expire")
+	}
+	now := time.Now()
+	switch {
+	case c.Expire:
+		return now, nil
+	case c.ExpiresAt != nil:
+		return *c.ExpiresAt, nil
+	case c.TTL != "":
+		ttl, err := time.ParseDuration(c.TTL)
+		if err != nil || ttl < 0 {
+			return time.Time{}, fmt.Errorf("неверный ttl: %s", c.TTL)
+		}
+		return now.Add(ttl), nil
+	}
+	extend, err := time.ParseDuration(c.Extend)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("неверный extend: %s", c.Extend)
+	}
+	return current.Add(extend), nil
+}
+
+// handleCacheEntries просмотр записей кеша и изменение их срока:
+//
+//	GET   /_proxy/cache?url=*/api/*  - записи (без тел), url - необязательный wildcard паттерн
+//	GET   /_proxy/cache/{key}        - одна запись
+//	PATCH /_proxy/cache/{key}        - изменить срок: {"ttl": "30s"}, {"extend": "5m"}, {"expires_at": "..."}, {"expire": true}
+//	PATCH /_proxy/cache?url=...      - изменить срок всех подходящих записей
+//
+// Арендатор видит и меняет только записи своих пространств
+func handleCacheEntries(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/_proxy/cache"), "/")
+	pattern := r.URL.Query().Get("url")
+	namespace := r.URL.Query().Get("namespace")
+	if namespace != "" {
+		namespace = tenantCacheNamespace(r, namespace)
+	}
+
+	// Записи, к которым относится запрос: по ключу или по паттерну URL, только пространства арендатора запроса
+	var keys []string
+	var entries []*CacheEntry
+	responseCache.Range(func(k, value interface{}) bool {
+		entry := value.(*CacheEntry)
+		entryNS := entryNamespace(entry)
+		if !ownsCacheNamespace(r, entryNS) || (namespace != "" && entryNS != namespace) {
+			return true
+		}
+		if (key != "" && k.(string) == key) || (key == "" && (pattern == "" || matchURLPattern(entry.RequestURL, pattern))) {
+			keys = append(keys, k.(string))
+			entries = append(entries, entry)
+		}
+		return true
+	})
+	if key != "" && len(entries) == 0 {
+		http.Error(w, "Записи "+key+" нет в кеше", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		infos := make([]CacheEntryInfo, 0, len(entries))
+		for i, entry := range entries {
+			infos = append(infos, cacheEntryInfo(keys[i], entry))
+		}
+		sort.Slice(infos, func(i, j int) bool { return infos[i].URL < infos[j].URL })
+		w.Header().Set("Content-Type", "application/json")
+		if key != "" {
+			json.NewEncoder(w).Encode(infos[0])
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"entries": infos})
+	case http.MethodPatch:
+		if key == "" && pattern == "" {
+			http.Error(w, "Укажите ключ (/_proxy/cache/{key}) или паттерн ?url=", http.StatusBadRequest)
+			return
+		}
+		var change CacheExpiryChange
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+			http.Error(w, "Неверный JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := change.expiresAt(time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		infos := make([]CacheEntryInfo, 0, len(entries))
+		for i, entry := range entries {
+			expiresAt, _ := change.expiresAt(entry.ExpiresAt)
+			// Запись заменяется копией: ее могут одновременно отдавать другим клиентам.
+			// Если запись успели обновить или удалить, изменение срока к ней не применяется
+			updated := *entry
+			updated.ExpiresAt = expiresAt
+			if !responseCache.CompareAndSwap(keys[i], entry, &updated) {
+				requestLogf(r, "💾 Запись кеша %s изменилась, срок не изменен", entry.RequestURL)
+				continue
+			}
+			markCacheDirty(keys[i])
+			atomic.AddInt64(&cacheExpiryChanged, 1)
+			requestLogf(r, "💾 Срок записи кеша %s изменен: до %s", updated.RequestURL, expiresAt.Format("15:04:05.000"))
+			infos = append(infos, cacheEntryInfo(keys[i], &updated))
+		}
+		if key != "" && len(infos) == 0 {
+			http.Error(w, "Запись "+key+" изменилась во время запроса, повторите", http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if key != "" {
+			json.NewEncoder(w).Encode(infos[0])
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"entries": infos})
+	default:
+		http.Error(w, "Используйте GET или PATCH", http.StatusMethodNotAllowed)
+	}
+}
+
+func cacheNamespaceStats() map[string]int {
+	counts := make(map[string]int)
+	responseCache.Range(func(key, value interface{}) bool {
+		counts[entryNamespace(value.(*CacheEntry))]++
+		return true
+	})
+	return counts
+}
+
+// requestTagsKey - ключ контекста с тегами запроса; теги становятся известны только
+// при поиске правил, поэтому внешние обработчики получают изменяемый контейнер
+type requestTagsKey struct{}
+
+type requestTagHolder struct {
+	tags []string
+
+	// Результаты matcher плагинов: правила проверяются и для тегов, и при поиске подмены,
+	// а matcher может читать тело или ходить во внешние сервисы
+	mutex    sync.Mutex
+	matchers map[string]bool
+}
+
+// TagStats статистика запросов с тегом
+type TagStats struct {
+	Requests        int64         `json:"requests"`
+	Errors          int64         `json:"errors"` // Ответы 5xx
+	StatusCounts    map[int]int64 `json:"status_counts"`
+	TotalDurationMs float64       `json:"-"`
+	AvgDurationMs   float64       `json:"avg_duration_ms"`
+}
+
+var tagStats = make(map[string]*TagStats)
+var tagStatsMutex sync.Mutex
+
+// collectRequestTags возвращает теги всех включенных правил, условия которых выполнены.
+// Счетчики правил не меняются: тег ставится даже если правило не сработало из-за trigger_after и т.п.
+func collectRequestTags(method, urlPath, contentType string, r *http.Request) []string {
+	overrides := currentOverrides(r)
+	var tags []string
+	for i := range overrides {
+		override := &overrides[i]
+		if !override.Enabled || len(override.Tags) == 0 {
+			continue
+		}
+		if overrideMismatch(override, method, urlPath, contentType, r) != "" {
+			continue
+		}
+		for _, tag := range override.Tags {
+			if tag != "" && !containsName(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+func setRequestTags(r *http.Request, tags []string) {
+	if holder, ok := r.Context().Value(requestTagsKey{}).(*requestTagHolder); ok {
+		holder.tags = tags
+	}
+}
+
+// requestTags возвращает теги запроса (nil, если правила их не назначили)
+func requestTags(r *http.Request) []string {
+	if holder, ok := r.Context().Value(requestTagsKey{}).(*requestTagHolder); ok {
+		return holder.tags
+	}
+	return nil
+}
+
+// requestTagsHandler создает контейнер тегов и после ответа учитывает запрос в статистике тегов
+func requestTagsHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/_proxy") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		holder := &requestTagHolder{}
+		r = r.WithContext(context.WithValue(r.Context(), requestTagsKey{}, holder))
+		recorder := &trafficRecorder{ResponseWriter: w}
+		start := time.Now()
+
+		next.ServeHTTP(recorder, r)
+
+		if len(holder.tags) == 0 {
+			return
+		}
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		duration := float64(time.Since(start).Microseconds()) / 1000
+
+		tagStatsMutex.Lock()
+		defer tagStatsMutex.Unlock()
+		for _, tag := range holder.tags {
+			stats, ok := tagStats[tag]
+			if !ok {
+				stats = &TagStats{StatusCounts: make(map[int]int64)}
+				tagStats[tag] = stats
+			}
+			stats.Requests++
+			stats.StatusCounts[status]++
+			if status >= 500 {
+				stats.Errors++
+			}
+			stats.TotalDurationMs += duration
+		}
+	})
+}
+
+// tagStatsSnapshot копия статистики тегов для /_proxy_stats
+func tagStatsSnapshot() map[string]TagStats {
+	tagStatsMutex.Lock()
+	defer tagStatsMutex.Unlock()
+	snapshot := make(map[string]TagStats, len(tagStats))
+	for tag, stats := range tagStats {
+		copied := *stats
+		copied.StatusCounts = make(map[int]int64, len(stats.StatusCounts))
+		for status, count := range stats.StatusCounts {
+			copied.StatusCounts[status] = count
+		}
+		copied.AvgDurationMs = stats.TotalDurationMs / float64(stats.Requests)
+		snapshot[tag] = copied
+	}
+	return snapshot
+}
+
+// EndpointStats статистика запросов к эндпоинту (метод + нормализованный путь)
+type EndpointStats struct {
+	Requests        int64         `json:"requests"`
+	Errors          int64         `json:"errors"` // Ответы 5xx
+	StatusCounts    map[int]int64 `json:"status_counts"`
+	TotalDurationMs float64       `json:"-"`
+	AvgDurationMs   float64       `json:"avg_duration_ms"`
+	MaxDurationMs   float64       `json:"max_duration_ms"`
+}
+
+var endpointStatsEnabled = true
+var endpointStatsMax = 500 // Сколько разных эндпоинтов учитывать, остальные попадают в overflow
+var endpointStats = make(map[string]*EndpointStats)
+var endpointOverflow int64 // Запросы к эндпоинтам сверх лимита (под endpointStatsMutex)
+var endpointStatsMutex sync.Mutex
+
+// Сегменты пути, которые заменяются шаблонами: /users/42/orders/9f1c... -> /users/{id}/orders/{hash}
+var (
+	endpointNumericSegment = regexp.MustCompile(`^-?[0-9]+$`)
+	endpointUUIDSegment    = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	endpointHashSegment    = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+	endpointTokenSegment   = regexp.MustCompile(`^[A-Za-z0-9_-]{24,}$`)
+)
+
+func setupEndpointStats() {
+	if value := os.Getenv("ENDPOINT_STATS"); value != "" {
+		endpointStatsEnabled = value == "true"
+	}
+	if value := os.Getenv("ENDPOINT_STATS_MAX"); value != "" {
+		if max, err := strconv.Atoi(value); err == nil && max > 0 {
+			endpointStatsMax = max
+		} else {
+			log.Printf("⚠️  Неверное значение ENDPOINT_STATS_MAX: %s", value)
+		}
+	}
+}
+
+func printEndpointStatsSettings() {
+	log.Printf("📈 Статистика по эндпоинтам:")
+	if endpointStatsEnabled {
+		log.Printf("   Enabled: ✅")
+		log.Printf("   Max endpoints: %d", endpointStatsMax)
+		if openAPISettings.Enabled {
+			log.Printf("   Пути группируются по шаблонам OpenAPI спецификации")
+		}
+	} else {
+		log.Printf("   Enabled: ❌")
+	}
+	log.Printf("")
+	log.Printf("🔧 Переменные окружения для статистики по эндпоинтам:")
+	log.Printf("   - ENDPOINT_STATS=false - не вести статистику по эндпоинтам")
+	log.Printf("   - ENDPOINT_STATS_MAX=500 - максимум разных эндпоинтов (остальные в overflow)")
+	log.Printf("")
+}
+
+// endpointKey метод и путь запроса, в котором идентификаторы заменены шаблонами.
+// При загруженной OpenAPI спецификации используется шаблон пути из нее
+func endpointKey(r *http.Request) string {
+	return normalizeEndpoint(r.Method, r.URL.Host, r.URL.Path)
+}
+
+// normalizeEndpoint ключ эндпоинта для метода, хоста (в режиме HTTP proxy) и пути без query
+func normalizeEndpoint(method, host, path string) string {
+	method = strings.ToUpper(method)
+	if path == "" {
+		path = "/"
+	}
+
+	if openAPISettings.Enabled {
+		if operation, _ := findOpenAPIOperation(method, path); operation != "" {
+			template := strings.TrimPrefix(operation, method+" ")
+			return method + " " + host + openAPISettings.BasePath + template
+		}
+	}
+
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		switch {
+		case segment == "":
+		case endpointNumericSegment.MatchString(segment):
+			segments[i] = "{id}"
+		case endpointUUIDSegment.MatchString(segment):
+			segments[i] = "{uuid}"
+		case endpointHashSegment.MatchString(segment):
+			segments[i] = "{hash}"
+		case endpointTokenSegment.MatchString(segment) && strings.ContainsAny(segment, "0123456789"):
+			segments[i] = "{token}"
+		}
+	}
+	// В режиме HTTP proxy запросы идут к разным хостам
+	return method + " " + host + strings.Join(segments, "/")
+}
+
+// endpointStatsHandler учитывает каждый запрос в статистике его эндпоинта независимо от правил подмены
+func endpointStatsHandler(next http.Handler) http.Handler {
+	if !endpointStatsEnabled {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/_proxy") || r.Method == http.MethodConnect {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := endpointKey(r)
+		recorder := &trafficRecorder{ResponseWriter: w}
+		start := time.Now()
+
+		next.ServeHTTP(recorder, r)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		duration := float64(time.Since(start).Microseconds()) / 1000
+
+		endpointStatsMutex.Lock()
+		defer endpointStatsMutex.Unlock()
+		stats, ok := endpointStats[key]
+		if !ok {
+			if len(endpointStats) >= endpointStatsMax {
+				endpointOverflow++
+				return
+			}
+			stats = &EndpointStats{StatusCounts: make(map[int]int64)}
+			endpointStats[key] = stats
+		}
+		stats.Requests++
+		stats.StatusCounts[status]++
+		if status >= 500 {
+			stats.Errors++
+		}
+		stats.TotalDurationMs += duration
+		if duration > stats.MaxDurationMs {
+			stats.MaxDurationMs = duration
+		}
+	})
+}
+
+// endpointStatsSnapshot копия статистики эндпоинтов для /_proxy_stats
+func endpointStatsSnapshot() map[string]interface{} {
+	endpointStatsMutex.Lock()
+	defer endpointStatsMutex.Unlock()
+	endpoints := make(map[string]EndpointStats, len(endpointStats))
+	for key, stats := range endpointStats {
+		copied := *stats
+		copied.StatusCounts = make(map[int]int64, len(stats.StatusCounts))
+		for status, count := range stats.StatusCounts {
+			copied.StatusCounts[status] = count
+		}
+		copied.AvgDurationMs = stats.TotalDurationMs / float64(stats.Requests)
+		endpoints[key] = copied
+	}
+	return map[string]interface{}{
+		"enabled":   endpointStatsEnabled,
+		"max":       endpointStatsMax,
+		"overflow":  endpointOverflow,
+		"endpoints": endpoints,
+	}
+}
+
+// DuplicateRequest повторная отправка одинакового запроса
+type DuplicateRequest struct {
+	Method     string    `json:"method"`
+	URL        string    `json:"url"`
+	Client     string    `json:"client"`
+	Count      int       `json:"count"`       // Сколько раз запрос пришел в пределах окна
+	IntervalMs float64   `json:"interval_ms"` // Время с предыдущей отправки
+	At         time.Time `json:"at"`
+}
+
+// duplicateEntry последняя отправка запроса с данным отпечатком
+type duplicateEntry struct {
+	last  time.Time
+	count int
+}
+
+const maxRecentDuplicates = 50
+
+var duplicateWindow time.Duration // 0 - обнаружение отключено
+var duplicateMethods = []string{"POST", "PUT", "PATCH", "DELETE"}
+var duplicateRequests int64 // Обнаруженные повторы (атомарный)
+var duplicateSeen = make(map[string]*duplicateEntry)
+var recentDuplicates []DuplicateRequest
+var duplicateMutex sync.Mutex
+
+func setupDuplicateDetection() {
+	if value := os.Getenv("DUPLICATE_WINDOW"); value != "" {
+		window, err := time.ParseDuration(value)
+		if err != nil || window < 0 {
+			log.Printf("⚠️  Неверное значение DUPLICATE_WINDOW: %s", value)
+		} else {
+			duplicateWindow = window
+		}
+	}
+	if value := os.Getenv("DUPLICATE_METHODS"); value != "" {
+		duplicateMethods = nil
+		for _, method := range strings.Split(value, ",") {
+			if method = strings.ToUpper(strings.TrimSpace(method)); method != "" {
+				duplicateMethods = append(duplicateMethods, method)
+			}
+		}
+	}
+}
+
+func printDuplicateDetectionSettings() {
+	log.Printf("♻️  Обнаружение повторных запросов:")
+	if duplicateWindow > 0 {
+		log.Printf("   Enabled: ✅")
+		log.Printf("   Window: %v", duplicateWindow)
+		log.Printf("   Methods: %v", duplicateMethods)
+	} else {
+		log.Printf("   Enabled: ❌")
+	}
+	log.Printf("")
+	log.Printf("🔧 Переменные окружения для обнаружения повторов:")
+	log.Printf("   - DUPLICATE_WINDOW=2s - одинаковые запросы клиента в пределах окна считаются повтором")
+	log.Printf("   - DUPLICATE_METHODS=POST,PUT,PATCH,DELETE - проверяемые методы (* - все)")
+	log.Printf("")
+}
+
+// checkDuplicateRequest сравнивает отпечаток запроса (клиент, метод, URL, тело) с отправками
+// в пределах DUPLICATE_WINDOW; повтор отмечается в логе, статистике и заголовке X-Proxy-Duplicate
+func checkDuplicateRequest(w http.ResponseWriter, r *http.Request, fullURL string) {
+	if duplicateWindow == 0 || !(containsName(duplicateMethods, "*") || containsName(duplicateMethods, r.Method)) {
+		return
+	}
+
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	requestURL := fullURL
+	if r.URL.Host != "" {
+		requestURL = r.URL.Host + fullURL
+	}
+	hash := sha256.New()
+	for _, part := range []string{client, r.Method, requestURL} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	hash.Write(peekRequestBody(r))
+	key := hex.EncodeToString(hash.Sum(nil))
+
+	now := time.Now()
+	duplicateMutex.Lock()
+	// Отпечатки с истекшим окном не накапливаются бесконечно
+	if len(duplicateSeen) >= 10000 {
+		for seenKey, seen := range duplicateSeen {
+			if now.Sub(seen.last) > duplicateWindow {
+				delete(duplicateSeen, seenKey)
+			}
+		}
+	}
+	entry, ok := duplicateSeen[key]
+	if !ok || now.Sub(entry.last) > duplicateWindow {
+		duplicateSeen[key] = &duplicateEntry{last: now, count: 1}
+		duplicateMutex.Unlock()
+		return
+	}
+	interval := now.Sub(entry.last)
+	entry.last = now
+	entry.count++
+	duplicate := DuplicateRequest{
+		Method:     r.Method,
+		URL:        requestURL,
+		Client:     client,
+		Count:      entry.count,
+		IntervalMs: float64(interval.Microseconds()) / 1000,
+		At:         now,
+	}
+	recentDuplicates = append(recentDuplicates, duplicate)
+	if len(recentDuplicates) > maxRecentDuplicates {
+		recentDuplicates = recentDuplicates[len(recentDuplicates)-maxRecentDuplicates:]
+	}
+	duplicateMutex.Unlock()
+
+	atomic.AddInt64(&duplicateRequests, 1)
+	w.Header().Set("X-Proxy-Duplicate", strconv.Itoa(duplicate.Count))
+	requestLogf(r, "♻️  Повторный запрос #%d через %v: %s %s (клиент %s)", duplicate.Count, interval.Round(time.Millisecond), r.Method, requestURL, client)
+}
+
+func duplicateStats() map[string]interface{} {
+	duplicateMutex.Lock()
+	defer duplicateMutex.Unlock()
+	recent := make([]DuplicateRequest, len(recentDuplicates))
+	copy(recent, recentDuplicates)
+	return map[string]interface{}{
+		"enabled":    duplicateWindow > 0,
+		"window":     duplicateWindow.String(),
+		"methods":    duplicateMethods,
+		"duplicates": atomic.LoadInt64(&duplicateRequests),
+		"recent":     recent,
+	}
+}
+
+// TrafficEvent сводка обмена запрос/ответ для внешних систем анализа
+type TrafficEvent struct {
+	Time               time.Time       `json:"time"`
+	Method             string          `json:"method"`
+	URL                string          `json:"url"`
+	Host               string          `json:"host"`
+	RemoteAddr         string          `json:"remote_addr"`
+	Tenant             string          `json:"tenant,omitempty"`
+	Status             int             `json:"status"`
+	DurationMs         float64         `json:"duration_ms"`
+	RequestSize        int64           `json:"request_size"`
+	ResponseSize       int64           `json:"response_size"`
+	RequestHeaders     http.Header     `json:"request_headers,omitempty"`
+	ResponseHeaders    http.Header     `json:"response_headers,omitempty"`
+	RequestBody        string          `json:"request_body,omitempty"`
+	RequestBodyBase64  bool            `json:"request_body_base64,omitempty"`
+	ResponseBody       string          `json:"response_body,omitempty"`
+	ResponseBodyBase64 bool            `json:"response_body_base64,omitempty"`
+	BodiesTruncated    bool            `json:"bodies_truncated,omitempty"`
+	Tags               []string        `json:"tags,omitempty"`
+	Timing             *UpstreamTiming `json:"timing,omitempty"` // Фазы запроса к серверу (нет для подменных и кешированных ответов)
+	requestBody        []byte          // Сохраненные тела (не более лимита)
+	responseBody       []byte
+	archived           bool // URL подходит под ARCHIVE_URL_PATTERNS
+}
+
+// trafficRecorder запоминает статус, размер и начало тела ответа клиенту
+type trafficRecorder struct {
+	http.ResponseWriter
+	status    int
+	size      int64
+	limit     int // Сколько байт тела сохранять (0 - не сохранять)
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (t *trafficRecorder) WriteHeader(code int) {
+	if t.status == 0 {
+		t.status = code
+	}
+	t.ResponseWriter.WriteHeader(code)
+}
+
+func (t *trafficRecorder) Write(p []byte) (int, error) {
+	if t.status == 0 {
+		t.status = http.StatusOK
+	}
+	n, err := t.ResponseWriter.Write(p)
+	t.size += int64(n)
+	t.truncated = captureLimited(&t.body, p[:n], t.limit) || t.truncated
+	return n, err
+}
+
+// prepareRaw запоминает ответ, который пишется в перехваченное соединение
+func (t *trafficRecorder) prepareRaw(statusCode int, body []byte) []byte {
+	if t.status == 0 {
+		t.status = statusCode
+	}
+	t.size += int64(len(body))
+	t.truncated = captureLimited(&t.body, body, t.limit) || t.truncated
+	return body
+}
+
+// Unwrap - исходный ResponseWriter записываемого ответа
+func (t *trafficRecorder) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// Flush сохраняет поддержку стриминга и SSE
+func (t *trafficRecorder) Flush() {
+	if flusher, ok := t.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// trafficBodyReader считает переданные байты тела запроса и сохраняет его начало
+type trafficBodyReader struct {
+	reader    io.ReadCloser
+	mutex     sync.Mutex
+	size      int64
+	limit     int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (t *trafficBodyReader) Read(p []byte) (int, error) {
+	n, err := t.reader.Read(p)
+	if n > 0 {
+		t.mutex.Lock()
+		t.size += int64(n)
+		t.truncated = captureLimited(&t.body, p[:n], t.limit) || t.truncated
+		t.mutex.Unlock()
+	}
+	return n, err
+}
+
+func (t *trafficBodyReader) Close() error {
+	return t.reader.Close()
+}
+
+// captureLimited дописывает данные в буфер до лимита; возвращает true, если часть отброшена
+func captureLimited(buffer *bytes.Buffer, data []byte, limit int) bool {
+	if limit <= 0 {
+		return false
+	}
+	room := limit - buffer.Len()
+	if room <= 0 {
+		return len(data) > 0
+	}
+	if len(data) > room {
+		buffer.Write(data[:room])
+		return true
+	}
+	buffer.Write(data)
+	return false
+}
+
+// trafficCaptureEnabled - нужен ли кому-то из получателей поток событий
+func trafficCaptureEnabled() bool {
+	return streamExportQueue != nil || archiveQueue != nil || trafficStoreQueue != nil || pcapExportQueue != nil
+}
+
+// trafficBodyLimit - сколько байт тел сохранять для получателей (наибольший из лимитов);
+// архив учитывается, только если запрос в него попадет
+func trafficBodyLimit(archived bool) int {
+	limit := 0
+	if streamExportQueue != nil && streamExportSettings.Bodies {
+		limit = streamExportSettings.MaxBody
+	}
+	if archived && archiveSettings.MaxBody > limit {
+		limit = archiveSettings.MaxBody
+	}
+	if trafficStoreQueue != nil && trafficStoreSettings.Bodies && trafficStoreSettings.MaxBody > limit {
+		limit = trafficStoreSettings.MaxBody
+	}
+	if pcapExportQueue != nil && pcapExportSettings.MaxBody > limit {
+		limit = pcapExportSettings.MaxBody
+	}
+	return limit
+}
+
+// trafficCaptureHandler формирует TrafficEvent по каждому проксированному запросу
+func trafficCaptureHandler(next http.Handler) http.Handler {
+	if !trafficCaptureEnabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/_proxy") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Запросы, которые не попадут в архив, не буферизуются ради него
+		archived := archiveQueue != nil && archiveMatchesURL(r.URL.String())
+		if !archived && streamExportQueue == nil && trafficStoreQueue == nil && pcapExportQueue == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		limit := trafficBodyLimit(archived)
+		start := time.Now()
+		timingHolder := &upstreamTimingHolder{}
+		r = r.WithContext(context.WithValue(r.Context(), upstreamTimingKey{}, timingHolder))
+		event := &TrafficEvent{
+			Time:       start,
+			Method:     r.Method,
+			URL:        r.URL.String(),
+			Host:       r.Host,
+			RemoteAddr: r.RemoteAddr,
+			Tenant:     tenantName(r),
+			archived:   archived,
+		}
+		if limit > 0 {
+			event.RequestHeaders = cloneHeaders(r.Header)
+		}
+
+		// Пустое тело не оборачиваем, иначе транспорт отправит GET с chunked encoding
+		var bodyReader *trafficBodyReader
+		if r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0 {
+			bodyReader = &trafficBodyReader{reader: r.Body, limit: limit}
+			r.Body = bodyReader
+		}
+		recorder := &trafficRecorder{ResponseWriter: w, limit: limit}
+
+		next.ServeHTTP(recorder, r)
+
+		event.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+		event.Status = recorder.status
+		if event.Status == 0 {
+			event.Status = http.StatusOK
+		}
+		event.ResponseSize = recorder.size
+		event.Tags = requestTags(r)
+		event.Timing = timingHolder.timing
+		if limit > 0 {
+			event.ResponseHeaders = cloneHeaders(w.Header())
+			event.responseBody = recorder.body.Bytes()
+			event.BodiesTruncated = recorder.truncated
+		}
+		if bodyReader != nil {
+			bodyReader.mutex.Lock()
+			event.RequestSize = bodyReader.size
+			event.requestBody = append([]byte(nil), bodyReader.body.Bytes()...)
+			event.BodiesTruncated = event.BodiesTruncated || bodyReader.truncated
+			bodyReader.mutex.Unlock()
+		}
+		dispatchTrafficEvent(event)
+	})
+}
+
+// dispatchTrafficEvent передает событие всем включенным получателям
+func dispatchTrafficEvent(event *TrafficEvent) {
+	if streamExportQueue != nil {
+		exportTrafficEvent(event)
+	}
+	if archiveQueue != nil && event.archived {
+		archiveTrafficEvent(event)
+	}
+	if trafficStoreQueue != nil {
+		storeTrafficEvent(event)
+	}
+	if pcapExportQueue != nil {
+		select {
+		case pcapExportQueue <- event:
+		default:
+			atomic.AddInt64(&pcapDropped, 1)
+		}
+	}
+}
+
+// StreamExportSettings настройки публикации событий трафика в Kafka или NATS
+type StreamExportSettings struct {
+	URL        string // nats://host:4222 или kafka+http://rest-proxy:8082
+	Topic      string // Топик Kafka или subject NATS
+	Bodies     bool   // Добавлять заголовки и тела
+	MaxBody    int    // Максимальный размер сохраняемого тела
+	BufferSize int    // Размер очереди событий
+}
+
+// streamPublisher отправляет пачку событий (JSON) в брокер
+type streamPublisher interface {
+	Publish(events [][]byte) error
+}
+
+var streamExportSettings StreamExportSettings
+var streamExportQueue chan *TrafficEvent
+var streamExportPublished int64 // Отправлено событий (атомарный)
+var streamExportDropped int64   // Отброшено при переполнении очереди (атомарный)
+var streamExportFailed int64    // Не доставлено из-за ошибок брокера (атомарный)
+
+func setupStreamExport() {
+	streamExportSettings = StreamExportSettings{
+		URL:        os.Getenv("STREAM_EXPORT_URL"),
+		Topic:      "proxy.traffic",
+		Bodies:     os.Getenv("STREAM_EXPORT_BODIES") == "true",
+		MaxBody:    65536,
+		BufferSize: 10000,
+	}
+	if streamExportSettings.URL == "" {
+		return
+	}
+	if topic := os.Getenv("STREAM_EXPORT_TOPIC"); topic != "" {
+		streamExportSettings.Topic = topic
+	}
+	if value := os.Getenv("STREAM_EXPORT_MAX_BODY"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			streamExportSettings.MaxBody = parsed
+		}
+	}
+	if value := os.Getenv("STREAM_EXPORT_BUFFER"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			streamExportSettings.BufferSize = parsed
+		}
+	}
+
+	publisher, err := newStreamPublisher(streamExportSettings.URL, streamExportSettings.Topic)
+	if err != nil {
+		log.Printf("⚠️  Экспорт трафика отключен: %v", err)
+		return
+	}
+	streamExportQueue = make(chan *TrafficEvent, streamExportSettings.BufferSize)
+	go streamExportWorker(publisher)
+}
+
+// newStreamPublisher выбирает брокер по схеме URL
+func newStreamPublisher(rawURL, topic string) (streamPublisher, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("неверный STREAM_EXPORT_URL: %w", err)
+	}
+	switch parsed.Scheme {
+	case "nats":
+		publisher := &natsPublisher{address: parsed.Host, subject: topic}
+		if !strings.Contains(publisher.address, ":") {
+			publisher.address += ":4222"
+		}
+		if parsed.User != nil {
+			publisher.user = parsed.User.Username()
+			publisher.password, _ = parsed.User.Password()
+		}
+		return publisher, nil
+	case "kafka+http", "kafka+https":
+		// Kafka через REST Proxy (Confluent REST Proxy, Redpanda HTTP Proxy)
+		endpoint := *parsed
+		endpoint.Scheme = strings.TrimPrefix(parsed.Scheme, "kafka+")
+		endpoint.Path = strings.TrimSuffix(parsed.Path, "/") + "/topics/" + url.PathEscape(topic)
+		return &kafkaRESTPublisher{endpoint: endpoint.String()}, nil
+	}
+	return nil, fmt.Errorf("неподдерживаемая схема %q (используйте nats:// или kafka+http://)", parsed.Scheme)
+}
+
+// exportTrafficEvent ставит событие в очередь без блокировки запроса
+func exportTrafficEvent(event *TrafficEvent) {
+	select {
+	case streamExportQueue <- event:
+	default:
+		atomic.AddInt64(&streamExportDropped, 1)
+	}
+}
+
+// streamExportWorker отправляет события пачками: все, что накопилось в очереди, но не более 100
+func streamExportWorker(publisher streamPublisher) {
+	failing := false
+	batch := make([][]byte, 0, 100)
+	for event := range streamExportQueue {
+		batch = append(batch[:0], encodeStreamEvent(event))
+	drain:
+		for len(batch) < cap(batch) {
+			select {
+			case next := <-streamExportQueue:
+				batch = append(batch, encodeStreamEvent(next))
+			default:
+				break drain
+			}
+		}
+
+		if err := publisher.Publish(batch); err != nil {
+			atomic.AddInt64(&streamExportFailed, int64(len(batch)))
+			if !failing {
+				log.Printf("⚠️  Ошибка экспорта трафика в %s: %v", streamExportDisplayURL(), err)
+				failing = true
+			}
+			continue
+		}
+		if failing {
+			log.Printf("📡 Экспорт трафика в %s восстановлен", streamExportDisplayURL())
+			failing = false
+		}
+		atomic.AddInt64(&streamExportPublished, int64(len(batch)))
+	}
+}
+
+func encodeStreamEvent(event *TrafficEvent) []byte {
+	exported := *event
+	if streamExportSettings.Bodies {
+		// Тела могли быть сохранены с большим лимитом для архива
+		requestBody, requestCut := truncateBody(event.requestBody, streamExportSettings.MaxBody)
+		responseBody, responseCut := truncateBody(event.responseBody, streamExportSettings.MaxBody)
+		exported.BodiesTruncated = event.BodiesTruncated || requestCut || responseCut
+		exported.RequestBody, exported.RequestBodyBase64 = encodeTransformBody(requestBody)
+		if !exported.BodiesTruncated && strings.EqualFold(event.ResponseHeaders.Get("Content-Encoding"), "gzip") {
+			if decompressed, err := decompressGzip(responseBody); err == nil {
+				responseBody = decompressed
+			}
+		}
+		exported.ResponseBody, exported.ResponseBodyBase64 = encodeTransformBody(responseBody)
+	} else {
+		// Заголовки и тела сохранены только для архива
+		exported.RequestHeaders = nil
+		exported.ResponseHeaders = nil
+		exported.BodiesTruncated = false
+	}
+	payload, _ := json.Marshal(exported)
+	return payload
+}
+
+func truncateBody(body []byte, limit int) ([]byte, bool) {
+	if len(body) > limit {
+		return body[:limit], true
+	}
+	return body, false
+}
+
+// natsPublisher публикует события по текстовому протоколу NATS (PUB), переподключаясь при ошибках
+type natsPublisher struct {
+	address  string
+	subject  string
+	user     string
+	password string
+	mutex    sync.Mutex // Защищает conn и writer (PONG пишется из читающей горутины)
+	conn     net.Conn
+	writer   *bufio.Writer
+}
+
+func (n *natsPublisher) Publish(events [][]byte) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.conn == nil {
+		if err := n.connect(); err != nil {
+			return err
+		}
+	}
+	n.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	for _, event := range events {
+		fmt.Fprintf(n.writer, "PUB %s %d\r\n", n.subject, len(event))
+		n.writer.Write(event)
+		n.writer.WriteString("\r\n")
+	}
+	if err := n.writer.Flush(); err != nil {
+		n.conn.Close()
+		n.conn = nil
+		return err
+	}
+	return nil
+}
+
+// connect подключается к серверу: читает INFO, отправляет CONNECT и запускает чтение PING/-ERR
+func (n *natsPublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", n.address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	info, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(info, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("сервер %s не отвечает по протоколу NATS", n.address)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	options := map[string]interface{}{"verbose": false, "pedantic": false, "name": "go-proxy-server", "lang": "go"}
+	if n.user != "" {
+		options["user"] = n.user
+		options["pass"] = n.password
+	}
+	connectLine, _ := json.Marshal(options)
+	writer := bufio.NewWriter(conn)
+	fmt.Fprintf(writer, "CONNECT %s\r\n", connectLine)
+	if err := writer.Flush(); err != nil {
+		conn.Close()
+		return err
+	}
+	n.conn = conn
+	n.writer = writer
+	log.Printf("📡 Подключено к NATS %s", n.address)
+
+	go n.readLoop(conn, reader)
+	return nil
+}
+
+// readLoop отвечает на PING сервера и логирует ошибки протокола
+func (n *natsPublisher) readLoop(conn net.Conn, reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PING":
+			n.mutex.Lock()
+			if n.conn == conn {
+				n.writer.WriteString("PONG\r\n")
+				n.writer.Flush()
+			}
+			n.mutex.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			log.Printf("⚠️  NATS: %s", line)
+		}
+	}
+	n.mutex.Lock()
+	if n.conn == conn {
+		conn.Close()
+		n.conn = nil
+	}
+	n.mutex.Unlock()
+}
+
+// kafkaRESTPublisher отправляет события в топик Kafka через REST Proxy (формат v2)
+type kafkaRESTPublisher struct {
+	endpoint string
+}
+
+var kafkaRESTClient = &http.Client{Timeout: 10 * time.Second}
+
+func (k *kafkaRESTPublisher) Publish(events [][]byte) error {
+	records := make([]map[string]json.RawMessage, 0, len(events))
+	for _, event := range events {
+		records = append(records, map[string]json.RawMessage{"value": event})
+	}
+	payload, err := json.Marshal(map[string]interface{}{"records": records})
+	if err != nil {
+		return err
+	}
+	resp, err := kafkaRESTClient.Post(k.endpoint, "application/vnd.kafka.json.v2+json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("REST Proxy вернул %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// streamExportDisplayURL адрес брокера без пароля для логов и статистики
+func streamExportDisplayURL() string {
+	if parsed, err := url.Parse(streamExportSettings.URL); err == nil {
+		return parsed.Redacted()
+	}
+	return streamExportSettings.URL
+}
+
+func printStreamExportSettings() {
+	if streamExportQueue == nil {
+		return
+	}
+	log.Printf("📡 Экспорт трафика:")
+	log.Printf("   Брокер: %s", streamExportDisplayURL())
+	log.Printf("   Топик: %s", streamExportSettings.Topic)
+	if streamExportSettings.Bodies {
+		log.Printf("   Заголовки и тела: да (до %d байт)", streamExportSettings.MaxBody)
+	} else {
+		log.Printf("   Заголовки и тела: нет (STREAM_EXPORT_BODIES=true)")
+	}
+	log.Printf("   Очередь: %d событий", streamExportSettings.BufferSize)
+	log.Printf("")
+}
+
+func streamExportStats() map[string]interface{} {
+	if streamExportQueue == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"url":       streamExportDisplayURL(),
+		"topic":     streamExportSettings.Topic,
+		"bodies":    streamExportSettings.Bodies,
+		"queued":    len(streamExportQueue),
+		"published": atomic.LoadInt64(&streamExportPublished),
+		"dropped":   atomic.LoadInt64(&streamExportDropped),
+		"failed":    atomic.LoadInt64(&streamExportFailed),
+	}
+}
+
+// ArchiveSettings настройки архивирования тел запросов и ответов в S3-совместимое хранилище
+type ArchiveSettings struct {
+	Endpoint      string   // Схема и хост хранилища (https://s3.eu-central-1.amazonaws.com, http://minio:9000)
+	Bucket        string   // Бакет
+	Prefix        string   // Префикс ключей в бакете
+	Region        string   // Регион для подписи SigV4
+	AccessKey     string   // AWS_ACCESS_KEY_ID
+	SecretKey     string   // AWS_SECRET_ACCESS_KEY
+	SessionToken  string   // AWS_SESSION_TOKEN (временные ключи)
+	URLPatterns   []string // Архивировать только подходящие URL
+	MaxBody       int      // Максимальный размер сохраняемого тела
+	BufferSize    int      // Размер очереди обменов в памяти
+	Workers       int      // Количество параллельных загрузок
+	IndexInterval time.Duration
+}
+
+// ArchiveIndexEntry строка индекса: сводка обмена и ключи объектов с телами
+type ArchiveIndexEntry struct {
+	ID string `json:"id"`
+	TrafficEvent
+	RequestBodyKey  string `json:"request_body_key,omitempty"`
+	ResponseBodyKey string `json:"response_body_key,omitempty"`
+}
+
+var archiveSettings ArchiveSettings
+var archiveQueue chan *TrafficEvent
+var archiveSequence uint64 // Счетчик для идентификаторов обменов (атомарный)
+var archiveIndex []ArchiveIndexEntry
+var archiveIndexMutex sync.Mutex
+var archiveClient = &http.Client{Timeout: 60 * time.Second}
+var archiveStored int64       // Заархивировано обменов (атомарный)
+var archiveDropped int64      // Отброшено при переполнении очереди (атомарный)
+var archiveFailed int64       // Ошибки загрузки (атомарный)
+var archiveFailing int32      // Флаг серии ошибок, чтобы не засорять лог (атомарный)
+var archiveBytes int64        // Загружено байт тел (атомарный)
+var archiveIndexObjects int64 // Записано файлов индекса (атомарный)
+
+// setupArchiveSettings читает ARCHIVE_S3_URL=http(s)://host/bucket/prefix (path-style адресация)
+func setupArchiveSettings() {
+	rawURL := os.Getenv("ARCHIVE_S3_URL")
+	if rawURL == "" {
+		return
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		log.Printf("⚠️  Неверный ARCHIVE_S3_URL: %s (ожидается http(s)://host/bucket/prefix), архивирование отключено", rawURL)
+		return
+	}
+	parts := strings.SplitN(strings.Trim(parsed.Path, "/"), "/", 2)
+	if parts[0] == "" {
+		log.Printf("⚠️  В ARCHIVE_S3_URL не указан бакет, архивирование отключено")
+		return
+	}
+
+	archiveSettings = ArchiveSettings{
+		Endpoint:      parsed.Scheme + "://" + parsed.Host,
+		Bucket:        parts[0],
+		Region:        os.Getenv("ARCHIVE_S3_REGION"),
+		AccessKey:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:     os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:  os.Getenv("AWS_SESSION_TOKEN"),
+		MaxBody:       10 * 1024 * 1024,
+		BufferSize:    1000,
+		Workers:       4,
+		IndexInterval: time.Minute,
+	}
+	if len(parts) == 2 {
+		archiveSettings.Prefix = strings.Trim(parts[1], "/")
+	}
+	if archiveSettings.Region == "" {
+		archiveSettings.Region = "us-east-1"
+	}
+	if archiveSettings.AccessKey == "" || archiveSettings.SecretKey == "" {
+		log.Printf("⚠️  AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY не заданы, запросы к хранилищу не подписываются")
+	}
+	if patterns := os.Getenv("ARCHIVE_URL_PATTERNS"); patterns != "" {
+		for _, pattern := range strings.Split(patterns, ",") {
+			archiveSettings.URLPatterns = append(archiveSettings.URLPatterns, strings.TrimSpace(pattern))
+		}
+	}
+	if value := os.Getenv("ARCHIVE_MAX_BODY"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			archiveSettings.MaxBody = parsed
+		}
+	}
+	if value := os.Getenv("ARCHIVE_BUFFER"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			archiveSettings.BufferSize = parsed
+		}
+	}
+	if value := os.Getenv("ARCHIVE_WORKERS"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			archiveSettings.Workers = parsed
+		}
+	}
+	if value := os.Getenv("ARCHIVE_INDEX_INTERVAL"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			archiveSettings.IndexInterval = parsed
+		}
+	}
+
+	archiveQueue = make(chan *TrafficEvent, archiveSettings.BufferSize)
+	for i := 0; i < archiveSettings.Workers; i++ {
+		go archiveWorker()
+	}
+	go archiveIndexWorker()
+}
+
+// archiveTrafficEvent ставит обмен в очередь на загрузку; тела хранятся только в памяти
+func archiveTrafficEvent(event *TrafficEvent) {
+	select {
+	case archiveQueue <- event:
+	default:
+		atomic.AddInt64(&archiveDropped, 1)
+	}
+}
+
+// archiveMatchesURL - попадает ли запрос в архив по ARCHIVE_URL_PATTERNS (без паттернов - все)
+func archiveMatchesURL(url string) bool {
+	if len(archiveSettings.URLPatterns) == 0 {
+		return true
+	}
+	for _, pattern := range archiveSettings.URLPatterns {
+		if matchURLPattern(url, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveWorker загружает тела обмена и добавляет его в индекс только после успешной загрузки
+func archiveWorker() {
+	for event := range archiveQueue {
+		id := fmt.Sprintf("%s-%d-%06d", event.Time.UTC().Format("150405.000000"), os.Getpid(), atomic.AddUint64(&archiveSequence, 1))
+		dir := archiveKey("bodies", event.Time.UTC().Format("2006-01-02"))
+		entry := ArchiveIndexEntry{ID: id, TrafficEvent: *event}
+
+		var err error
+		if len(event.requestBody) > 0 {
+			entry.RequestBodyKey = dir + "/" + id + ".request"
+			err = archiveBody(entry.RequestBodyKey, event.requestBody, event.RequestHeaders)
+		}
+		if err == nil && len(event.responseBody) > 0 {
+			entry.ResponseBodyKey = dir + "/" + id + ".response"
+			err = archiveBody(entry.ResponseBodyKey, event.responseBody, event.ResponseHeaders)
+		}
+		if err != nil {
+			atomic.AddInt64(&archiveFailed, 1)
+			if atomic.CompareAndSwapInt32(&archiveFailing, 0, 1) {
+				log.Printf("⚠️  Ошибка архивирования в %s: %v", archiveSettings.Endpoint, err)
+			}
+			continue
+		}
+		if atomic.CompareAndSwapInt32(&archiveFailing, 1, 0) {
+			log.Printf("🗄️  Архивирование в %s восстановлено", archiveSettings.Endpoint)
+		}
+
+		atomic.AddInt64(&archiveStored, 1)
+		archiveIndexMutex.Lock()
+		archiveIndex = append(archiveIndex, entry)
+		archiveIndexMutex.Unlock()
+	}
+}
+
+// archiveBody загружает тело с исходными Content-Type и Content-Encoding
+func archiveBody(key string, body []byte, headers http.Header) error {
+	objectHeaders := http.Header{}
+	if contentType := headers.Get("Content-Type"); contentType != "" {
+		objectHeaders.Set("Content-Type", contentType)
+	}
+	if encoding := headers.Get("Content-Encoding"); encoding != "" {
+		objectHeaders.Set("Content-Encoding", encoding)
+	}
+	if err := putArchiveObject(key, body, objectHeaders); err != nil {
+		return err
+	}
+	atomic.AddInt64(&archiveBytes, int64(len(body)))
+	return nil
+}
+
+// archiveIndexWorker периодически выгружает накопленные строки индекса
+func archiveIndexWorker() {
+	ticker := time.NewTicker(archiveSettings.IndexInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		flushArchiveIndex()
+	}
+}
+
+// flushArchiveIndex записывает новый файл индекса (JSON Lines): объекты S3 не дописываются,
+// поэтому каждый интервал - отдельный файл index/ДАТА/ВРЕМЯ-PID.jsonl
+func flushArchiveIndex() {
+	archiveIndexMutex.Lock()
+	entries := archiveIndex
+	archiveIndex = nil
+	archiveIndexMutex.Unlock()
+	if len(entries) == 0 {
+		return
+	}
+
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for _, entry := range entries {
+		encoder.Encode(entry)
+	}
+	now := time.Now().UTC()
+	key := archiveKey("index", now.Format("2006-01-02"), fmt.Sprintf("%s-%d.jsonl", now.Format("150405.000"), os.Getpid()))
+	if err := putArchiveObject(key, buffer.Bytes(), http.Header{"Content-Type": {"application/x-ndjson"}}); err != nil {
+		// Возвращаем строки, чтобы записать их со следующим файлом
+		archiveIndexMutex.Lock()
+		archiveIndex = append(entries, archiveIndex...)
+		archiveIndexMutex.Unlock()
+		log.Printf("⚠️  Ошибка записи индекса архива %s: %v", key, err)
+		return
+	}
+	atomic.AddInt64(&archiveIndexObjects, 1)
+	log.Printf("🗄️  Индекс архива: %s (%d обменов)", key, len(entries))
+}
+
+func archiveKey(parts ...string) string {
+	if archiveSettings.Prefix != "" {
+		parts = append([]string{archiveSettings.Prefix}, parts...)
+	}
+	return strings.Join(parts, "/")
+}
+
+// putArchiveObject выполняет PUT объекта, подписанный AWS Signature V4
+func putArchiveObject(key string, body []byte, headers http.Header) error {
+	objectPath := "/" + awsURIEncode(archiveSettings.Bucket, false) + "/" + awsURIEncode(key, true)
+	req, err := http.NewRequest(http.MethodPut, archiveSettings.Endpoint+objectPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	signS3Request(req, objectPath, body, time.Now().UTC())
+
+	resp, err := archiveClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("хранилище вернуло %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// signS3Request добавляет заголовок Authorization (AWS4-HMAC-SHA256) для сервиса s3
+func signS3Request(req *http.Request, canonicalPath string, body []byte, now time.Time) {
+	payloadHash := sha256Hex(body)
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if archiveSettings.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", archiveSettings.SessionToken)
+	}
+	if archiveSettings.AccessKey == "" || archiveSettings.SecretKey == "" {
+		return
+	}
+
+	// Подписываются host, Content-Type и все заголовки x-amz-*
+	signed := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			signed[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + signed[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{req.Method, canonicalPath, "", canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+	scope := now.Format("20060102") + "/" + archiveSettings.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+archiveSettings.SecretKey), now.Format("20060102"))
+	key = hmacSHA256(key, archiveSettings.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		archiveSettings.AccessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsURIEncode кодирует все, кроме незарезервированных символов RFC 3986 (и "/" для ключей)
+func awsURIEncode(value string, keepSlash bool) string {
+	var builder strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			builder.WriteByte(c)
+		} else {
+			fmt.Fprintf(&builder, "%%%02X", c)
+		}
+	}
+	return builder.String()
+}
+
+func printArchiveSettings() {
+	if archiveQueue == nil {
+		return
+	}
+	log.Printf("🗄️  Архивирование трафика в S3:")
+	log.Printf("   Хранилище: %s/%s/%s", archiveSettings.Endpoint, archiveSettings.Bucket, archiveSettings.Prefix)
+	log.Printf("   Регион: %s", archiveSettings.Region)
+	if len(archiveSettings.URLPatterns) > 0 {
+		log.Printf("   URL Patterns: %v", archiveSettings.URLPatterns)
+	}
+	log.Printf("   Максимальный размер тела: %d байт", archiveSettings.MaxBody)
+	log.Printf("   Очередь: %d обменов, загрузок параллельно: %d", archiveSettings.BufferSize, archiveSettings.Workers)
+	log.Printf("   Индекс: каждые %v", archiveSettings.IndexInterval)
+	log.Printf("")
+}
+
+func archiveStats() map[string]interface{} {
+	if archiveQueue == nil {
+		return nil
+	}
+	archiveIndexMutex.Lock()
+	pending := len(archiveIndex)
+	archiveIndexMutex.Unlock()
+	return map[string]interface{}{
+		"endpoint":       archiveSettings.Endpoint,
+		"bucket":         archiveSettings.Bucket,
+		"prefix":         archiveSettings.Prefix,
+		"queued":         len(archiveQueue),
+		"stored":         atomic.LoadInt64(&archiveStored),
+		"dropped":        atomic.LoadInt64(&archiveDropped),
+		"failed":         atomic.LoadInt64(&archiveFailed),
+		"bytes":          atomic.LoadInt64(&archiveBytes),
+		"index_pending":  pending,
+		"index_files":    atomic.LoadInt64(&archiveIndexObjects),
+		"index_interval": archiveSettings.IndexInterval.String(),
+	}
+}
+
+// TrafficStoreSettings настройки хранения метаданных запросов в SQLite
+type TrafficStoreSettings struct {
+	File       string        // Файл базы данных
+	Driver     string        // Имя драйвера database/sql (sqlite3 - mattn/go-sqlite3, sqlite - modernc.org/sqlite)
+	Bodies     bool          // Сохранять заголовки и тела
+	MaxBody    int           // Максимальный размер сохраняемого тела
+	Retention  time.Duration // Удалять записи старше (0 - хранить все)
+	BufferSize int           // Размер очереди записей
+}
+
+var trafficStoreSettings TrafficStoreSettings
+var trafficDB *sql.DB
+var trafficStoreQueue chan *TrafficEvent
+var trafficStoreWritten int64 // Записано строк (атомарный)
+var trafficStoreDropped int64 // Отброшено при переполнении очереди (атомарный)
+var trafficStoreFailed int64  // Ошибки записи (атомарный)
+
+// trafficStoreSchema - время хранится в UTC в формате SQLite ("2006-01-02 15:04:05.000"),
+// чтобы работали сравнения с datetime('now', '-1 hour')
+const trafficStoreSchema = `
+CREATE TABLE IF NOT EXISTS requests (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	time TEXT NOT NULL,
+	method TEXT NOT NULL,
+	url TEXT NOT NULL,
+	host TEXT NOT NULL,
+	remote_addr TEXT NOT NULL,
+	tenant TEXT NOT NULL,
+	status INTEGER NOT NULL,
+	duration_ms REAL NOT NULL,
+	request_size INTEGER NOT NULL,
+	response_size INTEGER NOT NULL,
+	request_headers TEXT,
+	response_headers TEXT,
+	request_body BLOB,
+	response_body BLOB,
+	bodies_truncated INTEGER NOT NULL DEFAULT 0,
+	tags TEXT
+);
+CREATE INDEX IF NOT EXISTS requests_time ON requests (time);
+CREATE INDEX IF NOT EXISTS requests_host_status ON requests (host, status);
+`
+
+func setupTrafficStore() {
+	trafficStoreSettings = TrafficStoreSettings{
+		File:       os.Getenv("TRAFFIC_DB"),
+		Driver:     os.Getenv("TRAFFIC_DB_DRIVER"),
+		Bodies:     os.Getenv("TRAFFIC_DB_BODIES") == "true",
+		MaxBody:    65536,
+		BufferSize: 10000,
+	}
+	if trafficStoreSettings.File == "" {
+		return
+	}
+	if trafficStoreSettings.Driver == "" {
+		trafficStoreSettings.Driver = "sqlite3"
+	}
+	if value := os.Getenv("TRAFFIC_DB_MAX_BODY"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			trafficStoreSettings.MaxBody = parsed
+		}
+	}
+	if value := os.Getenv("TRAFFIC_DB_RETENTION"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil {
+			trafficStoreSettings.Retention = parsed
+		} else {
+			log.Printf("⚠️  Неверный формат TRAFFIC_DB_RETENTION: %s", value)
+		}
+	}
+	if value := os.Getenv("TRAFFIC_DB_BUFFER"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			trafficStoreSettings.BufferSize = parsed
+		}
+	}
+
+	// Сборка использует только стандартную библиотеку и не содержит драйвера SQLite: без плагина
+	// или файла с импортом драйвера в пакете main хранилище не работает
+	if !containsName(sql.Drivers(), trafficStoreSettings.Driver) {
+		log.Printf("⚠️  TRAFFIC_DB задан, но драйвер database/sql '%s' не зарегистрирован (доступны: %v) - в сборку SQLite не входит, хранилище трафика отключено", trafficStoreSettings.Driver, sql.Drivers())
+		log.Printf("💡 Подключите драйвер SQLite плагином: PROXY_PLUGINS=plugins/sqlite.so")
+		return
+	}
+	db, err := sql.Open(trafficStoreSettings.Driver, trafficStoreSettings.File)
+	if err == nil {
+		_, err = db.Exec(trafficStoreSchema)
+	}
+	if err == nil {
+		err = migrateTrafficStore(db)
+	}
+	if err != nil {
+		log.Printf("⚠️  Ошибка открытия базы трафика %s: %v", trafficStoreSettings.File, err)
+		return
+	}
+	trafficDB = db
+	trafficStoreQueue = make(chan *TrafficEvent, trafficStoreSettings.BufferSize)
+	go trafficStoreWorker()
+	if trafficStoreSettings.Retention > 0 {
+		go trafficStoreCleanupWorker()
+	}
+}
+
+// migrateTrafficStore добавляет столбцы, появившиеся после создания базы: CREATE TABLE IF NOT EXISTS
+// не меняет существующую таблицу
+func migrateTrafficStore(db *sql.DB) error {
+	rows, err := db.Query("PRAGMA table_info(requests)")
+	if err != nil {
+		return err
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		return err
+	}
+	// Строка table_info: cid, name, type, notnull, dflt_value, pk
+	values := make([]interface{}, len(columns))
+	var name string
+	for i := range values {
+		values[i] = new(interface{})
+	}
+	values[1] = &name
+	hasTags := false
+	for rows.Next() {
+		if err := rows.Scan(values...); err != nil {
+			rows.Close()
+			return err
+		}
+		hasTags = hasTags || name == "tags"
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if !hasTags {
+		if _, err := db.Exec("ALTER TABLE requests ADD COLUMN tags TEXT"); err != nil {
+			return err
+		}
+		log.Printf("🗃️  База трафика %s: добавлен столбец tags", trafficStoreSettings.File)
+	}
+	return nil
+}
+
+// storeTrafficEvent ставит событие в очередь записи без блокировки запроса
+func storeTrafficEvent(event *TrafficEvent) {
+	select {
+	case trafficStoreQueue <- event:
+	default:
+		atomic.AddInt64(&trafficStoreDropped, 1)
+	}
+}
+
+// trafficStoreWorker записывает события пачками в одной транзакции (SQLite медленно выполняет
+// отдельные транзакции на каждую строку)
+func trafficStoreWorker() {
+	batch := make([]*TrafficEvent, 0, 100)
+	for event := range trafficStoreQueue {
+		batch = append(batch[:0], event)
+	drain:
+		for len(batch) < cap(batch) {
+			select {
+			case next := <-trafficStoreQueue:
+				batch = append(batch, next)
+			default:
+				break drain
+			}
+		}
+		if err := insertTrafficEvents(batch); err != nil {
+			atomic.AddInt64(&trafficStoreFailed, int64(len(batch)))
+			log.Printf("⚠️  Ошибка записи трафика в %s: %v", trafficStoreSettings.File, err)
+			continue
+		}
+		atomic.AddInt64(&trafficStoreWritten, int64(len(batch)))
+	}
+}
+
+func insertTrafficEvents(events []*TrafficEvent) error {
+	tx, err := trafficDB.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO requests (time, method, url, host, remote_addr, tenant, status, duration_ms,
+		request_size, response_size, request_headers, response_headers, request_body, response_body, bodies_truncated, tags)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, event := range events {
+		var requestHeaders, responseHeaders interface{}
+		var requestBody, responseBody interface{}
+		truncated := 0
+		if trafficStoreSettings.Bodies {
+			if data, err := json.Marshal(event.RequestHeaders); err == nil {
+				requestHeaders = string(data)
+			}
+			if data, err := json.Marshal(event.ResponseHeaders); err == nil {
+				responseHeaders = string(data)
+			}
+			// Тела могли быть сохранены с большим лимитом для других получателей
+			request, requestCut := truncateBody(event.requestBody, trafficStoreSettings.MaxBody)
+			response, responseCut := truncateBody(event.responseBody, trafficStoreSettings.MaxBody)
+			requestBody, responseBody = request, response
+			if event.BodiesTruncated || requestCut || responseCut {
+				truncated = 1
+			}
+		}
+		// Теги хранятся JSON массивом: WHERE tags LIKE '%"checkout"%'
+		var tags interface{}
+		if len(event.Tags) > 0 {
+			if data, err := json.Marshal(event.Tags); err == nil {
+				tags = string(data)
+			}
+		}
+		_, err := stmt.Exec(event.Time.UTC().Format("2006-01-02 15:04:05.000"), event.Method, event.URL, event.Host,
+			event.RemoteAddr, event.Tenant, event.Status, event.DurationMs, event.RequestSize, event.ResponseSize,
+			requestHeaders, responseHeaders, requestBody, responseBody, truncated, tags)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// trafficStoreCleanupWorker удаляет записи старше TRAFFIC_DB_RETENTION
+func trafficStoreCleanupWorker() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		cutoff := time.Now().Add(-trafficStoreSettings.Retention).UTC().Format("2006-01-02 15:04:05.000")
+		result, err := trafficDB.Exec("DELETE FROM requests WHERE time < ?", cutoff)
+		if err != nil {
+			log.Printf("⚠️  Ошибка очистки базы трафика: %v", err)
+			continue
+		}
+		if removed, _ := result.RowsAffected(); removed > 0 {
+			log.Printf("🗃️  Удалено записей трафика старше %v: %d", trafficStoreSettings.Retention, removed)
+		}
+	}
+}
+
+// handleTrafficQuery выполняет SELECT к базе трафика: ?sql=... (GET) или тело запроса (POST).
+// Запросы только на чтение: принимаются SELECT/WITH, соединение переводится в PRAGMA query_only
+func handleTrafficQuery(w http.ResponseWriter, r *http.Request) {
+	if trafficDB == nil {
+		http.Error(w, "Хранилище трафика отключено (TRAFFIC_DB)", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query().Get("sql")
+	if r.Method == http.MethodPost {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 65536))
+		if err != nil {
+			http.Error(w, "Ошибка чтения запроса", http.StatusBadRequest)
+			return
+		}
+		query = string(body)
+	}
+	query = strings.TrimSuffix(strings.TrimSpace(query), ";")
+	lower := strings.ToLower(query)
+	if !strings.HasPrefix(lower, "select") && !strings.HasPrefix(lower, "with") {
+		http.Error(w, "Разрешены только запросы SELECT/WITH", http.StatusBadRequest)
+		return
+	}
+	if strings.Contains(query, ";") {
+		http.Error(w, "Разрешен только один запрос", http.StatusBadRequest)
+		return
+	}
+	limit := 1000
+	if value := r.URL.Query().Get("limit"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			limit = parsed
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	start := time.Now()
+	result, err := runTrafficQuery(ctx, query, limit)
+	if err != nil {
+		http.Error(w, "Ошибка запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	result["duration_ms"] = float64(time.Since(start).Microseconds()) / 1000
+	requestLogf(r, "🗃️  SQL запрос к базе трафика: %s (%d строк)", truncateString(query, 200), len(result["rows"].([][]interface{})))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func runTrafficQuery(ctx context.Context, query string, limit int) (map[string]interface{}, error) {
+	conn, err := trafficDB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "PRAGMA query_only = ON"); err != nil {
+		return nil, err
+	}
+	// Соединение возвращается в пул - снимаем запрет записи после запроса
+	defer conn.ExecContext(context.Background(), "PRAGMA query_only = OFF")
+
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	result := [][]interface{}{}
+	truncated := false
+	for rows.Next() {
+		if len(result) >= limit {
+			truncated = true
+			break
+		}
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		// BLOB и TEXT драйвер может вернуть как []byte - в JSON строкой или base64
+		for i, value := range values {
+			if data, ok := value.([]byte); ok {
+				text, isBase64 := encodeTransformBody(data)
+				if isBase64 {
+					text = "base64:" + text
+				}
+				values[i] = text
+			}
+		}
+		result = append(result, values)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"columns": columns, "rows": result, "truncated": truncated}, nil
+}
+
+func printTrafficStoreSettings() {
+	if trafficDB == nil {
+		return
+	}
+	log.Printf("🗃️  Хранилище трафика (SQLite):")
+	log.Printf("   База: %s (драйвер %s)", trafficStoreSettings.File, trafficStoreSettings.Driver)
+	if trafficStoreSettings.Bodies {
+		log.Printf("   Заголовки и тела: да (до %d байт)", trafficStoreSettings.MaxBody)
+	} else {
+		log.Printf("   Заголовки и тела: нет (TRAFFIC_DB_BODIES=true)")
+	}
+	if trafficStoreSettings.Retention > 0 {
+		log.Printf("   Хранить: %v", trafficStoreSettings.Retention)
+	}
+	log.Printf("   Запросы: /_proxy/traffic/query?sql=SELECT ...")
+	log.Printf("")
+}
+
+func trafficStoreStats() map[string]interface{} {
+	if trafficDB == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"file":      trafficStoreSettings.File,
+		"bodies":    trafficStoreSettings.Bodies,
+		"retention": trafficStoreSettings.Retention.String(),
+		"queued":    len(trafficStoreQueue),
+		"written":   atomic.LoadInt64(&trafficStoreWritten),
+		"dropped":   atomic.LoadInt64(&trafficStoreDropped),
+		"failed":    atomic.LoadInt64(&trafficStoreFailed),
+	}
+}
+
+// PcapExportSettings настройки записи обменов в PCAP файл
+type PcapExportSettings struct {
+	File       string // Файл захвата ({time} - время запуска)
+	MaxBody    int    // Максимальный размер сохраняемого тела
+	BufferSize int    // Размер очереди обменов
+}
+
+// pcapSession синтетическое TCP соединение одного обмена: PCAP хранит пакеты, а прокси видит
+// только HTTP сообщения, поэтому рукопожатие, сегменты и подтверждения формируются заново
+type pcapSession struct {
+	packets    bytes.Buffer
+	client     net.IP
+	server     net.IP
+	clientPort uint16
+	serverPort uint16
+	clientSeq  uint32
+	serverSeq  uint32
+	ipID       uint16
+}
+
+const (
+	pcapLinkTypeRaw = 101 // LINKTYPE_RAW: пакеты начинаются с IPv4 заголовка
+	pcapSnapLen     = 262144
+	pcapSegmentSize = 1460 // Размер TCP сегмента (MSS Ethernet)
+	pcapServerPort  = 80   // Порт сервера, по которому Wireshark включает разбор HTTP
+	tcpFlagFIN      = 0x01
+	tcpFlagSYN      = 0x02
+	tcpFlagPSH      = 0x08
+	tcpFlagACK      = 0x10
+)
+
+var pcapExportSettings PcapExportSettings
+var pcapExportQueue chan *TrafficEvent
+var pcapFile *os.File
+var pcapWritten int64 // Записано обменов (атомарный)
+var pcapDropped int64 // Отброшено при переполнении очереди (атомарный)
+var pcapFailed int64  // Ошибки записи (атомарный)
+var pcapFlushed = make(chan struct{}, 1)
+
+func setupPcapExport() {
+	value := os.Getenv("PCAP_FILE")
+	if value == "" {
+		return
+	}
+	pcapExportSettings = PcapExportSettings{
+		File:       strings.ReplaceAll(value, "{time}", startedAt.Format("20060102-150405")),
+		MaxBody:    1048576,
+		BufferSize: 10000,
+	}
+	if value := os.Getenv("PCAP_MAX_BODY"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			pcapExportSettings.MaxBody = parsed
+		}
+	}
+	if value := os.Getenv("PCAP_BUFFER"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			pcapExportSettings.BufferSize = parsed
+		}
+	}
+
+	if dir := filepath.Dir(pcapExportSettings.File); dir != "." {
+		os.MkdirAll(dir, 0755)
+	}
+	file, err := os.OpenFile(pcapExportSettings.File, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err == nil {
+		// Глобальный заголовок PCAP: версия 2.4, микросекунды, little endian
+		header := make([]byte, 24)
+		binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+		binary.LittleEndian.PutUint16(header[4:], 2)
+		binary.LittleEndian.PutUint16(header[6:], 4)
+		binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+		binary.LittleEndian.PutUint32(header[20:], pcapLinkTypeRaw)
+		_, err = file.Write(header)
+	}
+	if err != nil {
+		log.Printf("⚠️  Не удалось открыть PCAP_FILE %s: %v", pcapExportSettings.File, err)
+		return
+	}
+	pcapFile = file
+	pcapExportQueue = make(chan *TrafficEvent, pcapExportSettings.BufferSize)
+	go pcapExportWorker()
+}
+
+// pcapExportWorker дописывает обмены в файл по одному: файл всегда целый и его можно
+// открыть в Wireshark во время работы прокси или читать через tail -f
+func pcapExportWorker() {
+	var stream uint32
+	for event := range pcapExportQueue {
+		// nil - метка flushPcapExport: все обмены до нее записаны
+		if event == nil {
+			pcapFile.Sync()
+			pcapFlushed <- struct{}{}
+			continue
+		}
+		stream++
+		if _, err := pcapFile.Write(pcapExchange(event, stream)); err != nil {
+			if atomic.AddInt64(&pcapFailed, 1) == 1 {
+				log.Printf("⚠️  Ошибка записи PCAP_FILE %s: %v", pcapExportSettings.File, err)
+			}
+			continue
+		}
+		atomic.AddInt64(&pcapWritten, 1)
+	}
+}
+
+// flushPcapExport дожидается записи обменов, уже стоящих в очереди PCAP
+func flushPcapExport(ctx context.Context) {
+	select {
+	case pcapExportQueue <- nil:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-pcapFlushed:
+	case <-ctx.Done():
+		log.Printf("⚠️  Очередь PCAP_FILE не записана за отведенное время")
+	}
+}
+
+// pcapExchange пакеты одного обмена: рукопожатие, запрос в момент получения, ответ через
+// время обработки и закрытие соединения. Каждый обмен - отдельное соединение с уникальным
+// портом клиента, даже если клиент отправил несколько запросов по keep-alive
+func pcapExchange(event *TrafficEvent, stream uint32) []byte {
+	session := &pcapSession{
+		client:     net.IPv4(127, 0, 0, 1).To4(),
+		server:     net.IPv4(127, 0, 0, 1).To4(),
+		clientPort: uint16(10000 + stream%55000),
+		serverPort: pcapServerPort,
+		clientSeq:  stream * 7919,
+		serverSeq:  stream * 104729,
+	}
+	if host, _, err := net.SplitHostPort(event.RemoteAddr); err == nil {
+		if ip := net.ParseIP(host).To4(); ip != nil {
+			session.client = ip
+		}
+	}
+	host := event.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		session.server = ip
+	}
+
+	start := event.Time
+	end := start.Add(time.Duration(event.DurationMs * float64(time.Millisecond)))
+	session.packet(start, true, tcpFlagSYN, nil)
+	session.packet(start, false, tcpFlagSYN|tcpFlagACK, nil)
+	session.packet(start, true, tcpFlagACK, nil)
+	session.send(start, true, pcapRequestMessage(event))
+	session.packet(start, false, tcpFlagACK, nil)
+	session.send(end, false, pcapResponseMessage(event))
+	session.packet(end, true, tcpFlagACK, nil)
+	session.packet(end, true, tcpFlagFIN|tcpFlagACK, nil)
+	session.packet(end, false, tcpFlagFIN|tcpFlagACK, nil)
+	session.packet(end, true, tcpFlagACK, nil)
+	return session.packets.Bytes()
+}
+
+// send разбивает сообщение на сегменты
+func (s *pcapSession) send(at time.Time, fromClient bool, message []byte) {
+	for len(message) > 0 {
+		size := len(message)
+		if size > pcapSegmentSize {
+			size = pcapSegmentSize
+		}
+		s.packet(at, fromClient, tcpFlagPSH|tcpFlagACK, message[:size])
+		message = message[size:]
+	}
+}
+
+// packet добавляет запись PCAP с IPv4 и TCP заголовками и сдвигает номера последовательности
+func (s *pcapSession) packet(at time.Time, fromClient bool, flags byte, payload []byte) {
+	src, dst := s.client, s.server
+	srcPort, dstPort := s.clientPort, s.serverPort
+	seq, ack := s.clientSeq, s.serverSeq
+	if !fromClient {
+		src, dst = dst, src
+		srcPort, dstPort = dstPort, srcPort
+		seq, ack = ack, seq
+	}
+	if flags&tcpFlagACK == 0 {
+		ack = 0
+	}
+
+	packet := make([]byte, 40+len(payload))
+	ip, tcp := packet[:20], packet[20:]
+	s.ipID++
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(packet)))
+	binary.BigEndian.PutUint16(ip[4:], s.ipID)
+	binary.BigEndian.PutUint16(ip[6:], 0x4000) // Don't Fragment
+	ip[8] = 64
+	ip[9] = 6 // TCP
+	copy(ip[12:16], src)
+	copy(ip[16:20], dst)
+	binary.BigEndian.PutUint16(ip[10:], internetChecksum(ip, 0))
+
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+	// Псевдозаголовок: адреса, протокол и длина TCP сегмента
+	pseudo := uint32(binary.BigEndian.Uint16(src[0:])) + uint32(binary.BigEndian.Uint16(src[2:])) +
+		uint32(binary.BigEndian.Uint16(dst[0:])) + uint32(binary.BigEndian.Uint16(dst[2:])) + 6 + uint32(len(tcp))
+	binary.BigEndian.PutUint16(tcp[16:], internetChecksum(tcp, pseudo))
+
+	record := make([]byte, 16)
+	binary.LittleEndian.PutUint32(record[0:], uint32(at.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(at.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+	s.packets.Write(record)
+	s.packets.Write(packet)
+
+	advance := uint32(len(payload))
+	if flags&(tcpFlagSYN|tcpFlagFIN) != 0 {
+		advance++
+	}
+	if fromClient {
+		s.clientSeq += advance
+	} else {
+		s.serverSeq += advance
+	}
+}
+
+// internetChecksum контрольная сумма IP/TCP (RFC 1071) с начальной суммой псевдозаголовка
+func internetChecksum(data []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
 
-			// Применяем замены к распакованным данным
-			modifiedBody := applyBodyReplacements(decompressedBody, matchedOverride.BodyReplacements)
+// pcapRequestMessage восстанавливает HTTP/1.1 запрос в том виде, в каком его отправил клиент
+func pcapRequestMessage(event *TrafficEvent) []byte {
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "%s %s HTTP/1.1\r\nHost: %s\r\n", event.Method, event.URL, event.Host)
+	body, _ := truncateBody(event.requestBody, pcapExportSettings.MaxBody)
+	withLength := len(body) > 0 || event.RequestHeaders.Get("Content-Length") != ""
+	writePcapHeaders(&message, event.RequestHeaders, body, withLength, int64(len(body)) < event.RequestSize)
+	message.Write(body)
+	return message.Bytes()
+}
 
-			// Если было сжатие - сжимаем обратно
-			if wasCompressed {
-				if compressed, err := compressGzip(modifiedBody); err == nil {
-					log.Printf("🔒 Сжат обратно в gzip: %d -> %d bytes", len(modifiedBody), len(compressed))
-					responseBody = compressed
-				} else {
-					log.Printf("⚠️  Ошибка сжатия gzip: %v, отправляем без сжатия", err)
-					responseBody = modifiedBody
-					// Убираем заголовок Content-Encoding если не можем сжать обратно
-					resp.Header.Del("Content-Encoding")
-				}
-			} else {
-				responseBody = modifiedBody
+// pcapResponseMessage восстанавливает ответ, отправленный клиенту
+func pcapResponseMessage(event *TrafficEvent) []byte {
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "HTTP/1.1 %d %s\r\n", event.Status, http.StatusText(event.Status))
+	body, _ := truncateBody(event.responseBody, pcapExportSettings.MaxBody)
+	// У ответов без тела Content-Length описывает ресурс, а не сообщение - оставляем как есть
+	bodyless := event.Method == http.MethodHead || event.Status == http.StatusNoContent ||
+		event.Status == http.StatusNotModified || event.Status < 200
+	if bodyless {
+		body = nil
+	}
+	writePcapHeaders(&message, event.ResponseHeaders, body, !bodyless, int64(len(body)) < event.ResponseSize && !bodyless)
+	message.Write(body)
+	return message.Bytes()
+}
+
+// writePcapHeaders пишет заголовки в порядке имен; тело передается с Content-Length
+// по фактически сохраненному размеру, чтобы Wireshark собрал сообщение и при обрезке
+func writePcapHeaders(message *bytes.Buffer, headers http.Header, body []byte, withLength, truncated bool) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		if withLength && (strings.EqualFold(name, "Content-Length") || strings.EqualFold(name, "Transfer-Encoding")) {
+			continue
+		}
+		if strings.EqualFold(name, "Host") {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range headers[name] {
+			fmt.Fprintf(message, "%s: %s\r\n", name, value)
+		}
+	}
+	if withLength {
+		fmt.Fprintf(message, "Content-Length: %d\r\n", len(body))
+	}
+	if truncated {
+		message.WriteString("X-Proxy-Body-Truncated: true\r\n")
+	}
+	message.WriteString("\r\n")
+}
+
+func printPcapExportSettings() {
+	if pcapExportQueue == nil {
+		return
+	}
+	log.Printf("🦈 Запись трафика в PCAP:")
+	log.Printf("   Файл: %s", pcapExportSettings.File)
+	log.Printf("   Тела: до %d байт", pcapExportSettings.MaxBody)
+	log.Printf("   Очередь: %d обменов", pcapExportSettings.BufferSize)
+	log.Printf("")
+}
+
+func pcapExportStats() map[string]interface{} {
+	if pcapExportQueue == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"file":    pcapExportSettings.File,
+		"queued":  len(pcapExportQueue),
+		"written": atomic.LoadInt64(&pcapWritten),
+		"dropped": atomic.LoadInt64(&pcapDropped),
+		"failed":  atomic.LoadInt64(&pcapFailed),
+	}
+}
+
+// HeldRequest запрос, остановленный на точке останова и ожидающий решения
+type HeldRequest struct {
+	ID         string      `json:"id"`
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Host       string      `json:"host"`
+	RemoteAddr string      `json:"remote_addr"`
+	Tenant     string      `json:"tenant,omitempty"`
+	Headers    http.Header `json:"headers"`
+	Body       string      `json:"body"`
+	BodyBase64 bool        `json:"body_base64,omitempty"`
+	HeldAt     time.Time   `json:"held_at"`
+	decision   chan BreakpointDecision
+}
+
+// BreakpointDecision решение по остановленному запросу. При release непустые поля заменяют
+// метод, путь с query, заголовки (целиком) и тело; при reject клиент получает status и body
+type BreakpointDecision struct {
+	Action     string      `json:"-"` // "release" или "reject"
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Headers    http.Header `json:"headers"`
+	Body       *string     `json:"body"`
+	BodyBase64 bool        `json:"body_base64"`
+	Status     int         `json:"status"`
+}
+
+var breakpointPatterns []string // "*/api/pay*" или "POST */api/pay*" (защищены breakpointMutex)
+var breakpointTimeout = 5 * time.Minute
+var heldRequests = make(map[string]*HeldRequest)
+var breakpointMutex sync.Mutex
+var breakpointCounter uint64 // Счетчик для идентификаторов (атомарный)
+var breakpointReleased int64 // Отпущено запросов (атомарный)
+var breakpointRejected int64 // Отклонено запросов (атомарный)
+var breakpointTimedOut int64 // Отпущено по таймауту (атомарный)
+
+func setupBreakpoints() {
+	if patterns := os.Getenv("BREAKPOINT_PATTERNS"); patterns != "" {
+		for _, pattern := range strings.Split(patterns, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				breakpointPatterns = append(breakpointPatterns, pattern)
 			}
 		}
 	}
+	if value := os.Getenv("BREAKPOINT_TIMEOUT"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			breakpointTimeout = parsed
+		} else {
+			log.Printf("⚠️  Неверный формат BREAKPOINT_TIMEOUT: %s", value)
+		}
+	}
+}
 
-	// Сохраняем в кеш если включен и URL соответствует паттернам
-	if cacheSettings.Enabled && shouldCacheURL(proxyURL.String()) {
-		cacheKey := generateCacheKey(r.Method, proxyURL.String(), r.Header)
-		cacheResponse(cacheKey, resp.StatusCode, resp.Header, responseBody, proxyURL.String())
-	} else if cacheSettings.Enabled && !shouldCacheURL(proxyURL.String()) {
-		log.Printf("⏭️  URL не соответствует паттернам кеширования: %s", proxyURL.String())
+func printBreakpointSettings() {
+	if len(breakpointPatterns) == 0 {
+		return
 	}
+	log.Printf("⏸️  Точки останова:")
+	for _, pattern := range breakpointPatterns {
+		log.Printf("   %s", pattern)
+	}
+	log.Printf("   Таймаут ожидания: %v (затем запрос отпускается без изменений)", breakpointTimeout)
+	log.Printf("   Управление: /_proxy/breakpoints")
+	log.Printf("")
+}
 
-	// Копируем заголовки ответа
-	copyHeaders(w.Header(), resp.Header)
+// breakpointMatches проверяет запрос по паттернам точек останова (с необязательным методом перед URL)
+func breakpointMatches(method, fullURL string) bool {
+	breakpointMutex.Lock()
+	patterns := breakpointPatterns
+	breakpointMutex.Unlock()
+	for _, pattern := range patterns {
+		if matchMethodURLPattern(pattern, method, fullURL) {
+			return true
+		}
+	}
+	return false
+}
+
+// holdRequest останавливает запрос до решения через API. Возвращает false, если ответ
+// клиенту уже отправлен (запрос отклонен или клиент отключился)
+func holdRequest(w http.ResponseWriter, r *http.Request, fullURL string) bool {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Ошибка чтения тела запроса", http.StatusBadRequest)
+			requestLogf(r, "❌ Ошибка чтения тела запроса: %v", err)
+			return false
+		}
+		r.Body.Close()
+	}
 
-	// Обновляем Content-Length если размер изменился после замен
-	if len(responseBody) > 0 {
-		w.Header().Set("Content-Length", strconv.Itoa(len(responseBody)))
+	held := &HeldRequest{
+		ID:         fmt.Sprintf("bp-%d", atomic.AddUint64(&breakpointCounter, 1)),
+		Method:     r.Method,
+		URL:        fullURL,
+		Host:       r.Host,
+		RemoteAddr: r.RemoteAddr,
+		Tenant:     tenantName(r),
+		Headers:    cloneHeaders(r.Header),
+		HeldAt:     time.Now(),
+		decision:   make(chan BreakpointDecision, 1),
 	}
+	held.Body, held.BodyBase64 = encodeTransformBody(body)
 
-	// Устанавливаем статус код
-	w.WriteHeader(resp.StatusCode)
+	breakpointMutex.Lock()
+	heldRequests[held.ID] = held
+	breakpointMutex.Unlock()
+	defer func() {
+		breakpointMutex.Lock()
+		delete(heldRequests, held.ID)
+		breakpointMutex.Unlock()
+	}()
+	requestLogf(r, "⏸️  Запрос остановлен [%s]: %s %s (release/reject: /_proxy/breakpoints/%s/...)", held.ID, r.Method, fullURL, held.ID)
 
-	// Отправляем тело ответа клиенту
-	_, err = w.Write(responseBody)
-	if err != nil {
-		log.Printf("❌ Ошибка отправки ответа клиенту: %v", err)
+	timer := time.NewTimer(breakpointTimeout)
+	defer timer.Stop()
+
+	var decision BreakpointDecision
+	select {
+	case decision = <-held.decision:
+	case <-timer.C:
+		atomic.AddInt64(&breakpointTimedOut, 1)
+		requestLogf(r, "⏱️  [%s] Решение не принято за %v, запрос отпущен без изменений", held.ID, breakpointTimeout)
+		decision = BreakpointDecision{Action: "release"}
+	case <-r.Context().Done():
+		requestLogf(r, "⚠️  [%s] Клиент отключился во время остановки", held.ID)
+		return false
+	}
+
+	if decision.Action == "reject" {
+		atomic.AddInt64(&breakpointRejected, 1)
+		status := decision.Status
+		if status == 0 {
+			status = http.StatusForbidden
+		}
+		responseBody := []byte("Запрос отклонен на точке останова\n")
+		if decision.Body != nil {
+			if decoded, err := decodeTransformBody(*decision.Body, decision.BodyBase64); err == nil {
+				responseBody = decoded
+			}
+		}
+		for name, values := range decision.Headers {
+			w.Header()[name] = values
+		}
+		writeResponse(w, r, status, responseBody, nil)
+		requestLogf(r, "⛔ [%s] Запрос отклонен: %d", held.ID, status)
+		return false
+	}
+
+	atomic.AddInt64(&breakpointReleased, 1)
+	var edits []string
+	if decision.Method != "" && decision.Method != r.Method {
+		r.Method = strings.ToUpper(decision.Method)
+		edits = append(edits, "метод")
+	}
+	if decision.URL != "" && decision.URL != fullURL {
+		if parsed, err := url.Parse(decision.URL); err == nil {
+			r.URL.Path = parsed.Path
+			r.URL.RawPath = ""
+			r.URL.RawQuery = parsed.RawQuery
+			edits = append(edits, "URL")
+		} else {
+			requestLogf(r, "⚠️  [%s] Неверный URL %q, оставлен исходный", held.ID, decision.URL)
+		}
+	}
+	if decision.Headers != nil {
+		r.Header = decision.Headers
+		edits = append(edits, "заголовки")
+	}
+	if decision.Body != nil {
+		if decoded, err := decodeTransformBody(*decision.Body, decision.BodyBase64); err == nil {
+			body = decoded
+			edits = append(edits, "тело")
+		} else {
+			requestLogf(r, "⚠️  [%s] Неверное тело (base64): %v, оставлено исходное", held.ID, err)
+		}
+	}
+
+	// Тело уже прочитано - передаем его дальше с известной длиной
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Del("Expect")
+	r.Header.Del("Transfer-Encoding")
+	if len(body) > 0 {
+		r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	} else {
+		r.Body = http.NoBody
+		r.Header.Del("Content-Length")
 	}
 
-	log.Printf("✅ Запрос завершен\n")
+	if len(edits) > 0 {
+		requestLogf(r, "▶️  [%s] Запрос отпущен с изменениями: %s", held.ID, strings.Join(edits, ", "))
+	} else {
+		requestLogf(r, "▶️  [%s] Запрос отпущен", held.ID)
+	}
+	return true
 }
 
-// streamingProxyRequest - новый стриминговый режим без буферизации
-func streamingProxyRequest(w http.ResponseWriter, r *http.Request, proxyURL *url.URL, targetURL *url.URL) {
-	// Создаем новый HTTP запрос напрямую с Body из исходного запроса
-	proxyReq, err := http.NewRequest(r.Method, proxyURL.String(), r.Body)
+// handleBreakpoints управляет точками останова:
+//
+//	GET  /_proxy/breakpoints                - паттерны и остановленные запросы
+//	PUT  /_proxy/breakpoints                - {"patterns": [...]} заменить паттерны
+//	GET  /_proxy/breakpoints/{id}           - остановленный запрос
+//	POST /_proxy/breakpoints/{id}/release   - отпустить (тело - BreakpointDecision с изменениями)
+//	POST /_proxy/breakpoints/{id}/reject    - отклонить ({"status": 403, "body": "..."})
+func handleBreakpoints(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/_proxy/breakpoints"), "/"), "/")
+
+	if parts[0] == "" {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(breakpointStats(true))
+		case http.MethodPut, http.MethodPost:
+			var request struct {
+				Patterns []string `json:"patterns"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, "Неверный JSON: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			breakpointMutex.Lock()
+			breakpointPatterns = request.Patterns
+			breakpointMutex.Unlock()
+			requestLogf(r, "⏸️  Точки останова: %v", request.Patterns)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(breakpointStats(false))
+		default:
+			http.Error(w, "Используйте GET или PUT", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	breakpointMutex.Lock()
+	held := heldRequests[parts[0]]
+	breakpointMutex.Unlock()
+	if held == nil {
+		http.Error(w, "Запрос "+parts[0]+" не найден (уже отпущен или клиент отключился)", http.StatusNotFound)
+		return
+	}
+
+	if len(parts) == 1 {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(held)
+		return
+	}
+	if r.Method != http.MethodPost || len(parts) != 2 || (parts[1] != "release" && parts[1] != "reject") {
+		http.Error(w, "Используйте POST /_proxy/breakpoints/{id}/release или /reject", http.StatusBadRequest)
+		return
+	}
+
+	decision := BreakpointDecision{}
+	body, err := io.ReadAll(r.Body)
+	if err == nil && len(bytes.TrimSpace(body)) > 0 {
+		err = json.Unmarshal(body, &decision)
+	}
 	if err != nil {
-		http.Error(w, "Ошибка создания запроса", http.StatusInternalServerError)
-		log.Printf("❌ Ошибка создания запроса: %v", err)
+		http.Error(w, "Неверный JSON: "+err.Error(), http.StatusBadRequest)
 		return
 	}
+	decision.Action = parts[1]
 
-	// Копируем заголовки из оригинального запроса
-	copyHeaders(proxyReq.Header, r.Header)
+	// Решение принимается один раз: повторный вызов не блокируется
+	select {
+	case held.decision <- decision:
+	default:
+		http.Error(w, "Решение по запросу "+held.ID+" уже принято", http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"id": held.ID, "action": decision.Action})
+}
 
-	// Устанавливаем правильный Host заголовок
-	proxyReq.Host = targetURL.Host
+func breakpointStats(withHeld bool) map[string]interface{} {
+	breakpointMutex.Lock()
+	patterns := append([]string{}, breakpointPatterns...)
+	held := make([]*HeldRequest, 0, len(heldRequests))
+	for _, request := range heldRequests {
+		held = append(held, request)
+	}
+	breakpointMutex.Unlock()
+	sort.Slice(held, func(i, j int) bool { return held[i].HeldAt.Before(held[j].HeldAt) })
 
-	// В стриминговом режиме сохраняем исходный ContentLength
-	// Для SSE и chunked encoding это может быть -1
-	proxyReq.ContentLength = r.ContentLength
+	stats := map[string]interface{}{
+		"patterns":  patterns,
+		"timeout":   breakpointTimeout.String(),
+		"held":      len(held),
+		"released":  atomic.LoadInt64(&breakpointReleased),
+		"rejected":  atomic.LoadInt64(&breakpointRejected),
+		"timed_out": atomic.LoadInt64(&breakpointTimedOut),
+	}
+	if withHeld {
+		stats["requests"] = held
+	}
+	return stats
+}
 
-	if r.ContentLength >= 0 {
-		log.Printf("🚀 Стриминг: Content-Length=%d", r.ContentLength)
-	} else {
-		log.Printf("🚀 Стриминг: chunked encoding или unknown length")
+// RequestGate ворота: подходящие запросы копятся и ждут команды release, чтобы уйти на сервер
+// одновременно (намеренное создание гонок на сервере)
+type RequestGate struct {
+	Name      string `json:"name"`
+	Pattern   string `json:"pattern"`              // "*/api/pay*" или "POST */api/pay*"
+	ReleaseAt int    `json:"release_at,omitempty"` // Отпустить всех, когда ждут столько запросов (0 - только по команде)
+	Timeout   string `json:"timeout,omitempty"`    // Максимальное ожидание, затем запрос уходит сам
+	timeout   time.Duration
+	waiting   []*gateWaiter
+	released  int64
+	timedOut  int64
+}
+
+// gateWaiter запрос, ожидающий у ворот
+type gateWaiter struct {
+	Method  string    `json:"method"`
+	URL     string    `json:"url"`
+	Since   time.Time `json:"since"`
+	release chan struct{}
+}
+
+var requestGates []*RequestGate // Защищены gateMutex
+var gateMutex sync.Mutex
+var gateTimeout = time.Minute
+var gateMaxBody int64 = 10 << 20 // Максимальное тело задерживаемого запроса, байт (REQUEST_GATE_MAX_BODY)
+var gateReleased int64           // Отпущено запросов командой или release_at (атомарный)
+var gateTimedOut int64           // Отпущено по таймауту (атомарный)
+
+// setupRequestGates разбирает REQUEST_GATES="pay=POST */api/pay*,stock=*/api/stock*"
+func setupRequestGates() {
+	if value := os.Getenv("REQUEST_GATE_TIMEOUT"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			gateTimeout = parsed
+		} else {
+			log.Printf("⚠️  Неверный формат REQUEST_GATE_TIMEOUT: %s", value)
+		}
+	}
+	if value := os.Getenv("REQUEST_GATE_MAX_BODY"); value != "" {
+		if parsed, err := strconv.ParseInt(value, 10, 64); err == nil && parsed > 0 {
+			gateMaxBody = parsed
+		} else {
+			log.Printf("⚠️  Неверное значение REQUEST_GATE_MAX_BODY: %s", value)
+		}
+	}
+	for _, item := range strings.Split(os.Getenv("REQUEST_GATES"), ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			if parts[0] != "" {
+				log.Printf("⚠️  Неверная запись REQUEST_GATES: %s (ожидается имя=паттерн)", item)
+			}
+			continue
+		}
+		gate := &RequestGate{Name: strings.TrimSpace(parts[0]), Pattern: strings.TrimSpace(parts[1])}
+		if err := gate.compile(); err != nil {
+			log.Printf("⚠️  Ворота '%s': %v", gate.Name, err)
+			continue
+		}
+		requestGates = append(requestGates, gate)
 	}
+}
 
-	// Выполняем запрос через настроенный клиент
-	resp, err := httpClient.Do(proxyReq)
-	if err != nil {
-		http.Error(w, "Ошибка выполнения запроса", http.StatusBadGateway)
-		log.Printf("❌ Ошибка выполнения запроса: %v", err)
+func printRequestGateSettings() {
+	if len(requestGates) == 0 {
 		return
 	}
-	defer resp.Body.Close()
+	log.Printf("🚦 Ворота для гонок запросов:")
+	for _, gate := range requestGates {
+		log.Printf("   %s: %s", gate.Name, gate.Pattern)
+	}
+	log.Printf("   Таймаут ожидания: %v (затем запрос уходит без команды)", gateTimeout)
+	log.Printf("   Максимальное тело: %d bytes (больше - 413)", gateMaxBody)
+	log.Printf("   Управление: /_proxy/gates")
+	log.Printf("")
+}
 
-	// Логируем статус ответа
-	log.Printf("📥 Response Status: %d %s", resp.StatusCode, resp.Status)
+func (g *RequestGate) compile() error {
+	if g.Pattern == "" {
+		return fmt.Errorf("не указан pattern")
+	}
+	if g.ReleaseAt < 0 {
+		return fmt.Errorf("release_at не может быть отрицательным")
+	}
+	g.timeout = gateTimeout
+	if g.Timeout != "" {
+		parsed, err := time.ParseDuration(g.Timeout)
+		if err != nil || parsed <= 0 {
+			return fmt.Errorf("неверный timeout: %s", g.Timeout)
+		}
+		g.timeout = parsed
+	}
+	return nil
+}
 
-	// Логируем заголовки ответа
-	if logSettings.ShowResponseHeaders {
-		logHeaders("📥 Response Headers", resp.Header)
+// matchMethodURLPattern проверяет запрос по паттерну с необязательным методом перед URL ("POST */api/*")
+func matchMethodURLPattern(pattern, method, fullURL string) bool {
+	if parts := strings.SplitN(pattern, " ", 2); len(parts) == 2 {
+		return strings.EqualFold(parts[0], method) && matchURLPattern(fullURL, strings.TrimSpace(parts[1]))
 	}
+	return matchURLPattern(fullURL, pattern)
+}
 
-	// Копируем заголовки ответа ПЕРЕД WriteHeader
-	copyHeaders(w.Header(), resp.Header)
+// releaseWaiters отпускает count первых ожидающих (0 - всех). Без interval каналы закрываются подряд,
+// и запросы уходят на сервер практически одновременно; с interval - по одному. Вызывается под gateMutex
+func (g *RequestGate) releaseWaiters(count int, interval time.Duration) int {
+	if count <= 0 || count > len(g.waiting) {
+		count = len(g.waiting)
+	}
+	batch := g.waiting[:count:count]
+	g.waiting = append([]*gateWaiter(nil), g.waiting[count:]...)
+	g.released += int64(count)
+	atomic.AddInt64(&gateReleased, int64(count))
+	if interval <= 0 {
+		for _, waiter := range batch {
+			close(waiter.release)
+		}
+		return count
+	}
+	go func() {
+		for i, waiter := range batch {
+			if i > 0 {
+				time.Sleep(interval)
+			}
+			close(waiter.release)
+		}
+	}()
+	return count
+}
 
-	// Проверяем, является ли это SSE потоком
-	contentType := resp.Header.Get("Content-Type")
-	isSSE := strings.Contains(strings.ToLower(contentType), "text/event-stream")
+// stageGate задерживает запрос у первых подходящих ворот до команды release, release_at или таймаута.
+// Тело читается заранее, чтобы отпущенные запросы не тратили время на прием тела от клиента
+func stageGate(x *ProxyExchange) bool {
+	gateMutex.Lock()
+	var gate *RequestGate
+	for _, candidate := range requestGates {
+		if matchMethodURLPattern(candidate.Pattern, x.R.Method, x.FullURL) {
+			gate = candidate
+			break
+		}
+	}
+	gateMutex.Unlock()
+	if gate == nil {
+		return true
+	}
 
-	if isSSE {
-		log.Printf("🌊 Обнаружен SSE поток (text/event-stream)")
-		// Для SSE принудительно устанавливаем важные заголовки
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
-		// Убираем Content-Length для SSE потоков
-		w.Header().Del("Content-Length")
+	if x.R.Body != nil && x.R.Body != http.NoBody {
+		// Все ожидающие тела держатся в памяти одновременно - размер ограничен
+		body, err := readBody(http.MaxBytesReader(x.W, x.R.Body, gateMaxBody), x.R.ContentLength)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(x.W, fmt.Sprintf("Тело запроса больше %d bytes (REQUEST_GATE_MAX_BODY)", gateMaxBody), http.StatusRequestEntityTooLarge)
+			requestLogf(x.R, "❌ Ворота '%s': тело запроса больше %d bytes", gate.Name, gateMaxBody)
+			return false
+		}
+		if err != nil {
+			http.Error(x.W, "Ошибка чтения тела запроса", http.StatusBadRequest)
+			requestLogf(x.R, "❌ Ошибка чтения тела запроса: %v", err)
+			return false
+		}
+		x.R.Body.Close()
+		x.R.Body = io.NopCloser(bytes.NewReader(body))
+		x.R.ContentLength = int64(len(body))
+		x.R.Header.Del("Expect")
+		x.R.Header.Del("Transfer-Encoding")
+		x.R.Header.Set("Content-Length", strconv.Itoa(len(body)))
 	}
 
-	// Устанавливаем статус код
-	w.WriteHeader(resp.StatusCode)
+	waiter := &gateWaiter{Method: x.R.Method, URL: x.FullURL, Since: time.Now(), release: make(chan struct{})}
+	gateMutex.Lock()
+	gate.waiting = append(gate.waiting, waiter)
+	waiting := len(gate.waiting)
+	requestLogf(x.R, "🚦 Ворота '%s': запрос ждет (%d): %s %s", gate.Name, waiting, x.R.Method, x.FullURL)
+	if gate.ReleaseAt > 0 && waiting >= gate.ReleaseAt {
+		requestLogf(x.R, "🚦 Ворота '%s': собралось %d запросов, все отпущены одновременно", gate.Name, gate.releaseWaiters(0, 0))
+	}
+	timeout := gate.timeout
+	gateMutex.Unlock()
 
-	// Получаем Flusher для немедленной отправки данных (важно для SSE)
-	flusher, canFlush := w.(http.Flusher)
-	if !canFlush {
-		log.Printf("⚠️  ResponseWriter не поддерживает Flush")
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-waiter.release:
+		return true
+	case <-timer.C:
+	case <-x.R.Context().Done():
+	}
+
+	// Таймаут или отключение клиента: убираем запрос из очереди, если его не отпустили одновременно.
+	// Очередь могла перейти к новым воротам с тем же именем (PUT)
+	gateMutex.Lock()
+	defer gateMutex.Unlock()
+	for _, current := range requestGates {
+		for i, candidate := range current.waiting {
+			if candidate == waiter {
+				current.waiting = append(current.waiting[:i:i], current.waiting[i+1:]...)
+				break
+			}
+		}
+	}
+	select {
+	case <-waiter.release:
+		return true
+	default:
+	}
+	if x.R.Context().Err() != nil {
+		requestLogf(x.R, "⚠️  Ворота '%s': клиент отключился во время ожидания", gate.Name)
+		return false
+	}
+	gate.timedOut++
+	atomic.AddInt64(&gateTimedOut, 1)
+	requestLogf(x.R, "⏱️  Ворота '%s': команды не было %v, запрос отпущен", gate.Name, timeout)
+	return true
+}
+
+// handleRequestGates управляет воротами:
+//
+//	GET    /_proxy/gates                - ворота и ожидающие запросы
+//	PUT    /_proxy/gates/{name}         - создать или заменить ({"pattern": "POST */api/pay*", "release_at": 2})
+//	POST   /_proxy/gates/{name}/release - отпустить ({"count": 0, "interval": "50ms"}; по умолчанию всех сразу)
+//	DELETE /_proxy/gates/{name}         - удалить ворота, ожидающие запросы уходят на сервер
+func handleRequestGates(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/_proxy/gates"), "/"), "/")
+	name := parts[0]
+	w.Header().Set("Content-Type", "application/json")
+
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		json.NewEncoder(w).Encode(requestGateStats(true))
+	case name != "" && len(parts) == 1 && r.Method == http.MethodPut:
+		gate := &RequestGate{}
+		if err := json.NewDecoder(r.Body).Decode(gate); err != nil {
+			http.Error(w, "Неверный JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		gate.Name = name
+		if err := gate.compile(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		gateMutex.Lock()
+		replaced := false
+		for i, existing := range requestGates {
+			if existing.Name == name {
+				// Запросы, ждущие у старых ворот, остаются ждать у новых
+				gate.waiting = existing.waiting
+				requestGates[i] = gate
+				replaced = true
+			}
+		}
+		if !replaced {
+			requestGates = append(requestGates, gate)
+		}
+		gateMutex.Unlock()
+		requestLogf(r, "🚦 Ворота '%s': %s", name, gate.Pattern)
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": name, "pattern": gate.Pattern, "release_at": gate.ReleaseAt, "timeout": gate.timeout.String()})
+	case name != "" && len(parts) == 2 && parts[1] == "release" && r.Method == http.MethodPost:
+		var request struct {
+			Count    int    `json:"count"`
+			Interval string `json:"interval"`
+		}
+		if body, _ := io.ReadAll(r.Body); len(bytes.TrimSpace(body)) > 0 {
+			if err := json.Unmarshal(body, &request); err != nil {
+				http.Error(w, "Неверный JSON: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		var interval time.Duration
+		if request.Interval != "" {
+			parsed, err := time.ParseDuration(request.Interval)
+			if err != nil || parsed < 0 {
+				http.Error(w, "Неверный interval: "+request.Interval, http.StatusBadRequest)
+				return
+			}
+			interval = parsed
+		}
+		gateMutex.Lock()
+		gate := findRequestGate(name)
+		released := 0
+		if gate != nil {
+			released = gate.releaseWaiters(request.Count, interval)
+		}
+		gateMutex.Unlock()
+		if gate == nil {
+			http.Error(w, "Ворота "+name+" не найдены", http.StatusNotFound)
+			return
+		}
+		requestLogf(r, "🚦 Ворота '%s': отпущено %d запросов", name, released)
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": name, "released": released})
+	case name != "" && len(parts) == 1 && r.Method == http.MethodDelete:
+		gateMutex.Lock()
+		gate := findRequestGate(name)
+		released := 0
+		if gate != nil {
+			released = gate.releaseWaiters(0, 0)
+			for i, existing := range requestGates {
+				if existing == gate {
+					requestGates = append(requestGates[:i:i], requestGates[i+1:]...)
+					break
+				}
+			}
+		}
+		gateMutex.Unlock()
+		if gate == nil {
+			http.Error(w, "Ворота "+name+" не найдены", http.StatusNotFound)
+			return
+		}
+		requestLogf(r, "🚦 Ворота '%s' удалены, отпущено %d запросов", name, released)
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": name, "released": released})
+	default:
+		http.Error(w, "Используйте GET /_proxy/gates, PUT или DELETE /_proxy/gates/{name}, POST /_proxy/gates/{name}/release", http.StatusBadRequest)
+	}
+}
+
+// findRequestGate ищет ворота по имени; вызывается под gateMutex
+func findRequestGate(name string) *RequestGate {
+	for _, gate := range requestGates {
+		if gate.Name == name {
+			return gate
+		}
+	}
+	return nil
+}
+
+func requestGateStats(withWaiting bool) map[string]interface{} {
+	gateMutex.Lock()
+	gates := make([]map[string]interface{}, 0, len(requestGates))
+	for _, gate := range requestGates {
+		stat := map[string]interface{}{
+			"name":      gate.Name,
+			"pattern":   gate.Pattern,
+			"timeout":   gate.timeout.String(),
+			"waiting":   len(gate.waiting),
+			"released":  gate.released,
+			"timed_out": gate.timedOut,
+		}
+		if gate.ReleaseAt > 0 {
+			stat["release_at"] = gate.ReleaseAt
+		}
+		if withWaiting {
+			stat["requests"] = append([]*gateWaiter{}, gate.waiting...)
+		}
+		gates = append(gates, stat)
+	}
+	gateMutex.Unlock()
+	return map[string]interface{}{
+		"gates":     gates,
+		"released":  atomic.LoadInt64(&gateReleased),
+		"timed_out": atomic.LoadInt64(&gateTimedOut),
 	}
+}
 
-	// СТРИМИНГ: копируем с поддержкой Flush для SSE
-	if isSSE && canFlush {
-		// Для SSE используем буферизованное копирование с Flush
-		bytesWritten := streamWithFlush(w, resp.Body, flusher)
-		log.Printf("🌊 SSE стриминг завершен: %d bytes передано", bytesWritten)
-	} else {
-		// Обычный стриминг
-		bytesWritten, err := io.Copy(w, resp.Body)
-		if err != nil {
-			log.Printf("❌ Ошибка стриминга ответа: %v", err)
-			return
+var pacHosts []string      // Хосты, запросы к которым идут через прокси (пусто - все)
+var pacProxyAddress string // Адрес прокси для устройств; пусто - из Host запроса PAC файла
+var pacServed int64        // Выдано PAC файлов (атомарный)
+
+func setupPacSettings() {
+	for _, host := range strings.Split(os.Getenv("PAC_HOSTS"), ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			pacHosts = append(pacHosts, host)
 		}
-		log.Printf("🚀 Стриминг завершен: %d bytes передано", bytesWritten)
 	}
+	pacProxyAddress = os.Getenv("PAC_PROXY_ADDRESS")
+}
 
-	log.Printf("✅ Запрос завершен\n")
+func printPacSettings() {
+	log.Printf("🧭 Автоконфигурация прокси (PAC): /_proxy/proxy.pac")
+	if len(pacHosts) > 0 {
+		log.Printf("   Хосты через прокси: %v", pacHosts)
+	} else {
+		log.Printf("   Хосты через прокси: все (HTTP)")
+	}
+	if pacProxyAddress != "" {
+		log.Printf("   Адрес прокси: %s", pacProxyAddress)
+	}
+	log.Printf("")
+	log.Printf("🔧 Переменные окружения для PAC:")
+	log.Printf("   - PAC_HOSTS=api.example.com,*.example.org - хосты, которые направляются через прокси (по умолчанию все)")
+	log.Printf("   - PAC_PROXY_ADDRESS=192.168.1.10:8080 - адрес прокси для устройств (по умолчанию - адрес, по которому запрошен PAC)")
+	log.Printf("")
 }
 
-// streamWithFlush - стриминг с принудительной отправкой для SSE
-func streamWithFlush(w io.Writer, src io.Reader, flusher http.Flusher) int64 {
-	buf := make([]byte, 4096) // Небольшой буфер для частой отправки
-	var written int64
+// handleProxyPAC отдает PAC файл: HTTP запросы к выбранным хостам идут через прокси, остальное напрямую.
+// HTTPS всегда напрямую - прокси отклоняет CONNECT, а через PAC браузер отправил бы его для https://
+func handleProxyPAC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Используйте GET", http.StatusMethodNotAllowed)
+		return
+	}
+	address := pacProxyAddress
+	if address == "" {
+		address = r.Host
+	}
+	proxyHost := address
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		proxyHost = host
+	}
 
-	for {
-		n, err := src.Read(buf)
-		if n > 0 {
-			w.Write(buf[:n])
-			written += int64(n)
-			// Немедленно отправляем данные клиенту (критично для SSE)
-			flusher.Flush()
-		}
-		if err != nil {
-			if err != io.EOF {
-				log.Printf("⚠️  Ошибка чтения SSE потока: %v", err)
-			}
-			break
+	var pac strings.Builder
+	fmt.Fprintf(&pac, "// Автоконфигурация прокси: %s\n", versionString())
+	pac.WriteString("function FindProxyForURL(url, host) {\n")
+	pac.WriteString("  host = host.toLowerCase();\n")
+	pac.WriteString("  if (url.substring(0, 5) !== \"http:\") {\n    return \"DIRECT\";\n  }\n")
+	fmt.Fprintf(&pac, "  if (host === %q) {\n    return \"DIRECT\";\n  }\n", strings.ToLower(proxyHost))
+	if len(pacHosts) > 0 {
+		conditions := make([]string, 0, len(pacHosts))
+		for _, pattern := range pacHosts {
+			conditions = append(conditions, fmt.Sprintf("shExpMatch(host, %q)", pattern))
 		}
+		fmt.Fprintf(&pac, "  if (!(%s)) {\n    return \"DIRECT\";\n  }\n", strings.Join(conditions, " ||\n      "))
 	}
+	fmt.Fprintf(&pac, "  return %q;\n}\n", "PROXY "+address)
 
-	return written
+	atomic.AddInt64(&pacServed, 1)
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "no-cache")
+	io.WriteString(w, pac.String())
 }
 
-// applyBodyReplacements применяет замены к телу ответа
-func applyBodyReplacements(body []byte, replacements []BodyReplacement) []byte {
-	if len(replacements) == 0 {
-		return body
+func pacStats() map[string]interface{} {
+	return map[string]interface{}{
+		"hosts":   pacHosts,
+		"address": pacProxyAddress,
+		"served":  atomic.LoadInt64(&pacServed),
 	}
+}
 
-	result := body
-	replacementsApplied := 0
+// ExpectedChecksum ожидаемый хеш тела ответа для URL (hex или base64); задается хотя бы один алгоритм
+type ExpectedChecksum struct {
+	URL    string `json:"url"` // Wildcard паттерн URL запроса с query
+	MD5    string `json:"md5"`
+	SHA1   string `json:"sha1"`
+	SHA256 string `json:"sha256"`
+	SHA512 string `json:"sha512"`
+}
 
-	for i, replacement := range replacements {
-		if replacement.IsRegex && replacement.compiledRegex != nil {
-			// Regex замена
-			beforeLen := len(result)
-			countBefore := bytes.Count(result, []byte(replacement.Find))
-			result = replacement.compiledRegex.ReplaceAll(result, []byte(replacement.Replace))
-			afterLen := len(result)
+// ChecksumMismatch несовпадение контрольной суммы, сохраняемое для /_proxy_stats
+type ChecksumMismatch struct {
+	Time      time.Time `json:"time"`
+	URL       string    `json:"url"`
+	Source    string    `json:"source"` // Content-MD5, Digest, Content-Digest, Repr-Digest, checksums
+	Algorithm string    `json:"algorithm"`
+	Expected  string    `json:"expected"`
+	Actual    string    `json:"actual"`
+}
 
-			log.Printf("🔄 Замена #%d (regex): '%s' -> '%s'", i+1, replacement.Find, replacement.Replace)
-			log.Printf("   Найдено совпадений: %d, размер: %d -> %d bytes", countBefore, beforeLen, afterLen)
+// checksumCheck одна проверка: ожидаемый хеш и откуда он взят
+type checksumCheck struct {
+	source    string
+	algorithm string
+	expected  []byte
+}
 
-			if beforeLen != afterLen {
-				replacementsApplied++
-			}
-		} else {
-			// Простая текстовая замена (глобальная)
-			searchBytes := []byte(replacement.Find)
-			replaceBytes := []byte(replacement.Replace)
-			beforeLen := len(result)
-			countBefore := bytes.Count(result, searchBytes)
-			result = bytes.ReplaceAll(result, searchBytes, replaceBytes)
-			afterLen := len(result)
+// checksumVerifier считает хеши тела ответа по мере чтения и сверяет их с ожидаемыми
+type checksumVerifier struct {
+	url     string
+	headers http.Header
+	checks  []checksumCheck
+	hashes  map[string]hash.Hash
+}
 
-			log.Printf("🔄 Замена #%d (текст): '%s' -> '%s'", i+1, replacement.Find, replacement.Replace)
-			log.Printf("   Найдено совпадений: %d, размер: %d -> %d bytes", countBefore, beforeLen, afterLen)
+const maxChecksumMismatches = 50 // Последние несовпадения в статистике
 
-			if countBefore > 0 {
-				replacementsApplied++
-			}
-		}
-	}
+var checksumHeaderVerify bool // Сверять тела с Content-MD5/Digest заголовками ответов (CHECKSUM_VERIFY)
+var checksumsVerified int64   // Ответы с проверенной контрольной суммой (атомарный)
+var checksumMismatches int64  // Ответы с несовпавшей контрольной суммой (атомарный)
+var recentChecksumMismatches []ChecksumMismatch
+var checksumMismatchMutex sync.Mutex
 
-	if replacementsApplied > 0 {
-		log.Printf("✨ Всего применено замен: %d из %d", replacementsApplied, len(replacements))
+func setupChecksumVerification() {
+	checksumHeaderVerify = os.Getenv("CHECKSUM_VERIFY") == "true"
+}
+
+func printChecksumSettings() {
+	log.Printf("🧮 Проверка контрольных сумм ответов:")
+	if checksumHeaderVerify {
+		log.Printf("   Headers: ✅ (Content-MD5, Digest, Content-Digest, Repr-Digest)")
 	} else {
-		log.Printf("⚠️  Ни одна замена не была применена (совпадений не найдено)")
+		log.Printf("   Headers: ❌")
 	}
-
-	return result
+	log.Printf("   Expected: %d (секция checksums конфигурации)", len(configSnapshot(&config).Checksums))
+	log.Printf("")
+	log.Printf("🔧 Переменные окружения для контрольных сумм:")
+	log.Printf("   - CHECKSUM_VERIFY=true - сверять тела ответов с Content-MD5/Digest заголовками сервера")
+	log.Printf("")
 }
 
-func handleOverride(w http.ResponseWriter, r *http.Request, override *ResponseOverride) {
-	// Устанавливаем заголовки
-	for key, value := range override.Headers {
-		w.Header().Set(key, value)
+// checksumHash возвращает конструктор хеша по имени алгоритма из заголовков и конфигурации
+func checksumHash(algorithm string) func() hash.Hash {
+	switch strings.ToLower(algorithm) {
+	case "md5":
+		return md5.New
+	case "sha", "sha1", "sha-1":
+		return sha1.New
+	case "sha256", "sha-256":
+		return sha256.New
+	case "sha512", "sha-512":
+		return sha512.New
 	}
+	return nil
+}
 
-	// Получаем тело ответа
-	var responseBody []byte
-	var err error
+// decodeChecksum декодирует ожидаемый хеш: hex, base64 или base64 в двоеточиях (RFC 9530)
+func decodeChecksum(value string, size int) []byte {
+	value = strings.Trim(strings.TrimSpace(value), ":\"")
+	if decoded, err := hex.DecodeString(value); err == nil && len(decoded) == size {
+		return decoded
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(value); err == nil && len(decoded) == size {
+		return decoded
+	}
+	return nil
+}
 
-	if override.BodyFile != "" {
-		// Читаем из файла
-		responseBody, err = os.ReadFile(override.BodyFile)
-		if err != nil {
-			log.Printf("❌ Ошибка чтения файла %s: %v", override.BodyFile, err)
-			http.Error(w, "Ошибка чтения файла подмены", http.StatusInternalServerError)
+// newChecksumVerifier собирает проверки для ответа; nil - проверять нечего. Частичные ответы (206)
+// по заголовкам не проверяются: хеш в них относится ко всему представлению
+func newChecksumVerifier(r *http.Request, resp *http.Response) *checksumVerifier {
+	if r.Method == http.MethodHead || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	fullURL := r.URL.Path
+	if r.URL.RawQuery != "" {
+		fullURL += "?" + r.URL.RawQuery
+	}
+	verifier := &checksumVerifier{url: fullURL, headers: resp.Header, hashes: make(map[string]hash.Hash)}
+	add := func(source, algorithm, value string) {
+		newHash := checksumHash(algorithm)
+		if newHash == nil {
 			return
 		}
-		log.Printf("📂 Загружен ответ из файла: %s (%d bytes)", override.BodyFile, len(responseBody))
-	} else if override.BodyText != "" {
-		// Используем текст
-		responseBody = []byte(override.BodyText)
-		log.Printf("📝 Использован текст ответа (%d bytes)", len(responseBody))
-	}
-
-	// Применяем замены в body если они есть
-	if len(override.BodyReplacements) > 0 && len(responseBody) > 0 {
-		log.Printf("🔄 Применяем замены в body...")
-		responseBody = applyBodyReplacements(responseBody, override.BodyReplacements)
+		name := strings.Replace(strings.ToLower(algorithm), "-", "", 1)
+		if name == "sha" {
+			name = "sha1"
+		}
+		hasher, ok := verifier.hashes[name]
+		if !ok {
+			hasher = newHash()
+		}
+		expected := decodeChecksum(value, hasher.Size())
+		if expected == nil {
+			requestLogf(r, "⚠️  %s: не удалось разобрать %s хеш '%s'", source, algorithm, value)
+			return
+		}
+		verifier.hashes[name] = hasher
+		verifier.checks = append(verifier.checks, checksumCheck{source: source, algorithm: name, expected: expected})
 	}
 
-	// Устанавливаем Content-Length если есть тело
-	if len(responseBody) > 0 {
-		w.Header().Set("Content-Length", strconv.Itoa(len(responseBody)))
+	if checksumHeaderVerify && resp.StatusCode != http.StatusPartialContent {
+		if value := resp.Header.Get("Content-MD5"); value != "" {
+			add("Content-MD5", "md5", value)
+		}
+		for _, name := range []string{"Digest", "Content-Digest", "Repr-Digest"} {
+			for _, item := range strings.Split(strings.Join(resp.Header.Values(name), ","), ",") {
+				if parts := strings.SplitN(strings.TrimSpace(item), "=", 2); len(parts) == 2 {
+					add(name, parts[0], parts[1])
+				}
+			}
+		}
 	}
-
-	// Отправляем статус код
-	w.WriteHeader(override.StatusCode)
-
-	// Отправляем тело
-	if len(responseBody) > 0 {
-		_, err = w.Write(responseBody)
-		if err != nil {
-			log.Printf("❌ Ошибка отправки подменного ответа: %v", err)
+	for _, expected := range currentConfig(r).Checksums {
+		if expected.URL == "" || !matchURLPattern(fullURL, expected.URL) {
+			continue
+		}
+		for _, item := range [][2]string{{"md5", expected.MD5}, {"sha1", expected.SHA1}, {"sha256", expected.SHA256}, {"sha512", expected.SHA512}} {
+			if item[1] != "" {
+				add("checksums", item[0], item[1])
+			}
 		}
+		break
+	}
+	if len(verifier.checks) == 0 {
+		return nil
 	}
+	return verifier
+}
 
-	// Логируем подменный ответ
-	log.Printf("🎭 Отправлен подменный ответ:")
-	log.Printf("   Status: %d", override.StatusCode)
+// Write передает полученные от сервера байты во все нужные хеши
+func (v *checksumVerifier) Write(p []byte) (int, error) {
+	for _, hasher := range v.hashes {
+		hasher.Write(p)
+	}
+	return len(p), nil
+}
 
-	// Логируем заголовки подмены
-	if logSettings.ShowResponseHeaders && len(override.Headers) > 0 {
-		log.Printf("   Override Headers:")
-		headers := make([]string, 0, len(override.Headers))
-		for key, _ := range override.Headers {
-			headers = append(headers, key)
+// verify сверяет хеши после чтения всего тела. Хеш из секции checksums для сжатого ответа может
+// совпасть и с распакованным телом - это проверяется, когда тело есть в памяти (body)
+func (v *checksumVerifier) verify(body []byte) {
+	mismatched := 0
+	for _, check := range v.checks {
+		actual := v.hashes[check.algorithm].Sum(nil)
+		if bytes.Equal(actual, check.expected) {
+			continue
 		}
-		sort.Strings(headers)
-		for _, key := range headers {
-			log.Printf("     %s: %s", key, override.Headers[key])
+		if check.source == "checksums" && body != nil && v.headers.Get("Content-Encoding") != "" {
+			hasher := checksumHash(check.algorithm)()
+			hasher.Write(decompressIfNeeded(body, v.headers))
+			if bytes.Equal(hasher.Sum(nil), check.expected) {
+				continue
+			}
+		}
+		mismatched++
+		mismatch := ChecksumMismatch{
+			Time:      time.Now(),
+			URL:       v.url,
+			Source:    check.source,
+			Algorithm: check.algorithm,
+			Expected:  hex.EncodeToString(check.expected),
+			Actual:    hex.EncodeToString(actual),
+		}
+		log.Printf("❌ Контрольная сумма не совпадает (%s, %s) для %s: ожидалось %s, получено %s",
+			mismatch.Source, mismatch.Algorithm, mismatch.URL, mismatch.Expected, mismatch.Actual)
+		checksumMismatchMutex.Lock()
+		recentChecksumMismatches = append(recentChecksumMismatches, mismatch)
+		if len(recentChecksumMismatches) > maxChecksumMismatches {
+			recentChecksumMismatches = recentChecksumMismatches[len(recentChecksumMismatches)-maxChecksumMismatches:]
 		}
+		checksumMismatchMutex.Unlock()
 	}
+	atomic.AddInt64(&checksumsVerified, 1)
+	if mismatched > 0 {
+		atomic.AddInt64(&checksumMismatches, 1)
+		return
+	}
+	log.Printf("🧮 Контрольная сумма совпала для %s (проверок: %d)", v.url, len(v.checks))
+}
 
-	if len(responseBody) > 0 && logSettings.ShowResponseBody {
-		contentType := override.Headers["Content-Type"]
-		logBody("   Body", responseBody, contentType, nil)
+func checksumStats(r *http.Request) map[string]interface{} {
+	checksumMismatchMutex.Lock()
+	recent := append([]ChecksumMismatch(nil), recentChecksumMismatches...)
+	checksumMismatchMutex.Unlock()
+	return map[string]interface{}{
+		"header_verify":     checksumHeaderVerify,
+		"expected":          len(currentConfig(r).Checksums),
+		"verified":          atomic.LoadInt64(&checksumsVerified),
+		"mismatched":        atomic.LoadInt64(&checksumMismatches),
+		"recent_mismatches": recent,
 	}
+}
 
-	log.Printf("✅ Подмена завершена\n")
+// cacheBackend хранилище записей кеша с записью по ключам: при изменении пишутся только измененные
+// записи, а не весь кеш. Встроенное - журнал (CACHE_BACKEND=log); BoltDB, Badger и другие
+// встраиваемые базы подключаются плагином через ProxyCacheBackends
+type cacheBackend interface {
+	Put(key string, value []byte) error
+	Delete(key string) error
+	Scan(fn func(key string, value []byte) error) error
+	Close() error
 }
 
-// logHeaders логирует HTTP заголовки
-func logHeaders(prefix string, headers http.Header) {
-	if len(headers) == 0 {
-		log.Printf("%s: [None]", prefix)
+// cacheStatsKey служебная запись со статистикой попаданий (ключи записей кеша не начинаются с "!")
+const cacheStatsKey = "!stats"
+
+var cacheBackendName = "snapshot" // CACHE_BACKEND: snapshot (gob+gzip целиком), log или имя из плагина
+var cacheStore cacheBackend       // Открытое хранилище (nil - снимок целиком)
+var cacheBackendFactories = map[string]func(path string) (interface{}, error){
+	"log": func(path string) (interface{}, error) { return openCacheLogStore(path) },
+}
+var cacheDirty = make(map[string]struct{}) // Ключи, измененные после последней записи в хранилище
+var cacheDirtyMutex sync.Mutex
+var cacheStoreWrites int64  // Записанные в хранилище записи (атомарный)
+var cacheStoreDeletes int64 // Удаленные из хранилища записи (атомарный)
+
+// RegisterCacheBackend регистрирует хранилище кеша для CACHE_BACKEND. Функция открывает хранилище
+// по пути CACHE_FILE и возвращает значение с методами Put, Delete, Scan и Close (см. cacheBackend)
+func RegisterCacheBackend(name string, open func(path string) (interface{}, error)) {
+	cacheBackendFactories[strings.ToLower(name)] = open
+}
+
+// markCacheDirty отмечает изменение записи кеша: флаг снимка и ключ для записи в хранилище
+func markCacheDirty(key string) {
+	atomic.StoreInt32(&cacheModified, 1)
+	if cacheStore == nil {
 		return
 	}
+	cacheDirtyMutex.Lock()
+	cacheDirty[key] = struct{}{}
+	cacheDirtyMutex.Unlock()
+}
 
-	// Сортируем заголовки для консистентного вывода
-	keys := make([]string, 0, len(headers))
-	for key := range headers {
-		keys = append(keys, key)
+// fallbackToSnapshot переключает кеш на снимок в cache.gob. Файл другого хранилища снимок
+// перезаписал бы, поэтому с явным CACHE_FILE запуск прерывается
+func fallbackToSnapshot(reason string) {
+	if os.Getenv("CACHE_FILE") != "" {
+		log.Fatalf("❌ %s; снимок перезаписал бы CACHE_FILE=%s", reason, cachePersistFile)
 	}
-	sort.Strings(keys)
+	cacheBackendName = "snapshot"
+	cachePersistFile = "cache.gob"
+	log.Printf("⚠️  %s, используется снимок %s", reason, cachePersistFile)
+	loadCacheFromDisk()
+}
 
-	log.Printf("%s:", prefix)
-	for _, key := range keys {
-		values := headers[key]
-		if len(values) == 1 {
-			log.Printf("  %s: %s", key, values[0])
+// restoreCache восстанавливает кеш из снимка или открывает хранилище CACHE_BACKEND.
+// Если хранилище недоступно (нет плагина, ошибка открытия), используется снимок
+func restoreCache() {
+	if cacheBackendName == "snapshot" {
+		loadCacheFromDisk()
+		return
+	}
+	open := cacheBackendFactories[cacheBackendName]
+	if open == nil {
+		fallbackToSnapshot(fmt.Sprintf("CACHE_BACKEND=%s не зарегистрирован (нужен плагин с ProxyCacheBackends)", cacheBackendName))
+		return
+	}
+	opened, err := open(cachePersistFile)
+	if err == nil {
+		if store, ok := opened.(cacheBackend); ok {
+			cacheStore = store
 		} else {
-			log.Printf("  %s: %v", key, values)
+			err = fmt.Errorf("тип %T не реализует Put, Delete, Scan и Close", opened)
 		}
 	}
-}
-
-// logBody логирует тело запроса/ответа с учетом настроек
-func logBody(prefix string, body []byte, contentType string, headers http.Header) {
-	if len(body) == 0 {
-		log.Printf("%s: [Empty]", prefix)
+	if err != nil {
+		fallbackToSnapshot(fmt.Sprintf("Ошибка открытия хранилища кеша %s (%s): %v", cacheBackendName, cachePersistFile, err))
 		return
 	}
 
-	// Проверяем режим логирования
-	switch logSettings.BodyLogMode {
-	case "none":
-		log.Printf("%s: [Hidden by BODY_LOG_MODE=none]", prefix)
-		return
-	case "full":
-		logBodyFull(prefix, body, contentType, headers)
-		return
-	case "truncate":
-		logBodyTruncated(prefix, body, contentType, headers)
-		return
-	case "json_full":
-		logBodyJSONSmart(prefix, body, contentType, headers)
-		return
-	default:
-		log.Printf("%s: [Unknown BODY_LOG_MODE: %s]", prefix, logSettings.BodyLogMode)
-		return
+	loaded, expired := 0, 0
+	var stale []string
+	now := time.Now()
+	err = cacheStore.Scan(func(key string, value []byte) error {
+		if key == cacheStatsKey {
+			var counters [2]int64
+			if gob.NewDecoder(bytes.NewReader(value)).Decode(&counters) == nil {
+				atomic.StoreInt64(&cacheHits, counters[0])
+				atomic.StoreInt64(&cacheMisses, counters[1])
+			}
+			return nil
+		}
+		var entry CacheEntry
+		if err := gob.NewDecoder(bytes.NewReader(value)).Decode(&entry); err != nil {
+			log.Printf("⚠️  Запись кеша %s не декодируется: %v", key, err)
+			stale = append(stale, key)
+			return nil
+		}
+		if !now.Before(entry.ExpiresAt) {
+			expired++
+			stale = append(stale, key)
+			return nil
+		}
+		responseCache.Store(key, &entry)
+		loaded++
+		return nil
+	})
+	if err != nil {
+		log.Printf("⚠️  Ошибка чтения хранилища кеша: %v", err)
+	}
+	// Устаревшие записи удаляются из хранилища сразу, чтобы оно не росло между запусками
+	for _, key := range stale {
+		cacheStore.Delete(key)
+	}
+	log.Printf("✅ Кеш восстановлен из хранилища %s: %s", cacheBackendName, cachePersistFile)
+	log.Printf("   Загружено записей: %d", loaded)
+	if expired > 0 {
+		log.Printf("   Удалено устаревших: %d", expired)
 	}
+	compactCacheStore()
 }
 
-// logBodyFull показывает body полностью
-func logBodyFull(prefix string, body []byte, contentType string, headers http.Header) {
-	if len(body) > 500*1024 { // 500KB лимит для безопасности
-		log.Printf("%s: [Very large content, %d bytes] - skipping log for safety", prefix, len(body))
-		return
+// persistCache записывает изменения кеша: снимок целиком или измененные записи в хранилище
+func persistCache() error {
+	if cacheStore == nil {
+		return saveCacheToDisk()
 	}
+	return flushCacheChanges()
+}
 
-	decompressedBody := decompressIfNeeded(body, headers)
-
-	if utf8.Valid(decompressedBody) {
-		log.Printf("%s: %s", prefix, string(decompressedBody))
-	} else {
-		log.Printf("%s: [Non-UTF8 data, %d bytes]", prefix, len(decompressedBody))
-		logHexDump(prefix, body)
+// flushCacheChanges записывает в хранилище только измененные ключи: актуальные записи - Put,
+// удаленные и устаревшие - Delete
+func flushCacheChanges() error {
+	cacheDirtyMutex.Lock()
+	dirty := cacheDirty
+	cacheDirty = make(map[string]struct{})
+	cacheDirtyMutex.Unlock()
+	if len(dirty) == 0 {
+		return nil
 	}
-}
 
-// logBodyTruncated показывает body с обрезанием
-func logBodyTruncated(prefix string, body []byte, contentType string, headers http.Header) {
-	decompressedBody := decompressIfNeeded(body, headers)
+	written, deleted := 0, 0
+	now := time.Now()
+	for key := range dirty {
+		value, ok := responseCache.Load(key)
+		if ok && now.Before(value.(*CacheEntry).ExpiresAt) {
+			var buf bytes.Buffer
+			if err := gob.NewEncoder(&buf).Encode(value.(*CacheEntry)); err != nil {
+				return err
+			}
+			if err := cacheStore.Put(key, buf.Bytes()); err != nil {
+				markCacheDirty(key) // Повторим при следующей записи
+				return err
+			}
+			written++
+			continue
+		}
+		if err := cacheStore.Delete(key); err != nil {
+			markCacheDirty(key)
+			return err
+		}
+		deleted++
+	}
 
-	if utf8.Valid(decompressedBody) {
-		text := string(decompressedBody)
-		log.Printf("%s: %s", prefix, truncateString(text, logSettings.MaxLogLength))
-	} else {
-		log.Printf("%s: [Non-UTF8 data, %d bytes]", prefix, len(decompressedBody))
-		logHexDump(prefix, body)
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode([2]int64{atomic.LoadInt64(&cacheHits), atomic.LoadInt64(&cacheMisses)})
+	if err := cacheStore.Put(cacheStatsKey, buf.Bytes()); err != nil {
+		return err
 	}
+	atomic.AddInt64(&cacheStoreWrites, int64(written))
+	atomic.AddInt64(&cacheStoreDeletes, int64(deleted))
+	log.Printf("💾 Кеш записан в хранилище %s: записано %d, удалено %d", cacheBackendName, written, deleted)
+	compactCacheStore()
+	return nil
 }
 
-// logBodyJSONSmart показывает JSON полностью, остальное обрезает
-func logBodyJSONSmart(prefix string, body []byte, contentType string, headers http.Header) {
-	decompressedBody := decompressIfNeeded(body, headers)
-
-	// Проверяем, является ли контент JSON
-	if isJSONContent(contentType, decompressedBody) {
-		// Для JSON форматируем и выводим полностью
-		if formatted := formatJSON(decompressedBody); formatted != "" {
-			log.Printf("%s (JSON formatted):\n%s", prefix, formatted)
-		} else {
-			// Если не удалось отформатировать, выводим как есть
-			log.Printf("%s (JSON): %s", prefix, string(decompressedBody))
+// compactCacheStore сжимает хранилище, если оно это поддерживает и в нем накопились старые версии записей
+func compactCacheStore() {
+	compactor, ok := cacheStore.(interface {
+		NeedsCompaction() bool
+		Compact() error
+	})
+	if !ok || !compactor.NeedsCompaction() {
+		return
+	}
+	if err := compactor.Compact(); err != nil {
+		log.Printf("⚠️  Ошибка сжатия хранилища кеша: %v", err)
+	}
+}
+
+func cacheStoreStats() map[string]interface{} {
+	stats := map[string]interface{}{
+		"backend": cacheBackendName,
+		"file":    cachePersistFile,
+	}
+	if cacheStore != nil {
+		cacheDirtyMutex.Lock()
+		stats["pending"] = len(cacheDirty)
+		cacheDirtyMutex.Unlock()
+		stats["writes"] = atomic.LoadInt64(&cacheStoreWrites)
+		stats["deletes"] = atomic.LoadInt64(&cacheStoreDeletes)
+		if store, ok := cacheStore.(*cacheLogStore); ok {
+			store.mutex.Lock()
+			stats["records"] = store.records
+			stats["live"] = len(store.keys)
+			store.mutex.Unlock()
 		}
-		return
 	}
+	return stats
+}
 
-	// Для не-JSON применяем truncation
-	if utf8.Valid(decompressedBody) {
-		text := string(decompressedBody)
-		log.Printf("%s: %s", prefix, truncateString(text, logSettings.MaxLogLength))
-	} else {
-		log.Printf("%s: [Non-UTF8 data, %d bytes]", prefix, len(decompressedBody))
-		logHexDump(prefix, body)
+// Записи журнала кеша: операция (1 байт), длина ключа и значения (uint32), ключ, значение, CRC32
+const (
+	cacheLogPut    byte = 1
+	cacheLogDelete byte = 2
+)
+
+// cacheLogStore журнал кеша: изменения дописываются в конец файла, при открытии журнал
+// проигрывается, оборванная последняя запись отбрасывается. Когда старых версий записей
+// становится больше, чем актуальных, журнал переписывается
+type cacheLogStore struct {
+	path    string
+	file    *os.File
+	keys    map[string]struct{} // Актуальные ключи
+	records int                 // Записей в файле
+	mutex   sync.Mutex
+}
+
+func openCacheLogStore(path string) (*cacheLogStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
 	}
+	return &cacheLogStore{path: path, file: file, keys: make(map[string]struct{})}, nil
 }
 
-// logHexDump показывает hex дамп для бинарных данных
-func logHexDump(prefix string, body []byte) {
-	sampleSize := min(64, len(body))
-	hexSample := hex.EncodeToString(body[:sampleSize])
-	log.Printf("%s (hex sample): %s", prefix, hexSample)
-	if len(body) > sampleSize {
-		log.Printf("%s (hex): ... +%d more bytes", prefix, len(body)-sampleSize)
+func (s *cacheLogStore) append(op byte, key string, value []byte) error {
+	record := make([]byte, 9, 13+len(key)+len(value))
+	record[0] = op
+	binary.BigEndian.PutUint32(record[1:5], uint32(len(key)))
+	binary.BigEndian.PutUint32(record[5:9], uint32(len(value)))
+	record = append(record, key...)
+	record = append(record, value...)
+	record = binary.BigEndian.AppendUint32(record, crc32.ChecksumIEEE(record))
+	if _, err := s.file.Write(record); err != nil {
+		return err
 	}
+	s.records++
+	return nil
 }
 
-// decompressIfNeeded распаковывает данные если они сжаты
-func decompressIfNeeded(body []byte, headers http.Header) []byte {
-	if headers == nil {
-		return body
+func (s *cacheLogStore) Put(key string, value []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.append(cacheLogPut, key, value); err != nil {
+		return err
 	}
+	s.keys[key] = struct{}{}
+	return nil
+}
 
-	contentEncoding := headers.Get("Content-Encoding")
-	if contentEncoding == "" {
-		return body
+func (s *cacheLogStore) Delete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.keys[key]; !ok {
+		return nil
+	}
+	if err := s.append(cacheLogDelete, key, nil); err != nil {
+		return err
 	}
+	delete(s.keys, key)
+	return nil
+}
 
-	switch strings.ToLower(contentEncoding) {
-	case "gzip":
-		if decompressed, err := decompressGzip(body); err == nil {
-			log.Printf("🔓 Decompressed gzip: %d -> %d bytes", len(body), len(decompressed))
-			return decompressed
+// replay читает журнал с начала и возвращает актуальные значения; оборванный или поврежденный
+// хвост (запись при аварийной остановке) обрезается
+func (s *cacheLogStore) replay() (map[string][]byte, error) {
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(s.file)
+	values := make(map[string][]byte)
+	var offset int64
+	records := 0
+	header := make([]byte, 9)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err != io.EOF {
+				log.Printf("⚠️  Журнал кеша оборван на позиции %d, хвост отброшен", offset)
+			}
+			break
+		}
+		keyLen := binary.BigEndian.Uint32(header[1:5])
+		valueLen := binary.BigEndian.Uint32(header[5:9])
+		payload := make([]byte, int(keyLen)+int(valueLen)+4)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			log.Printf("⚠️  Журнал кеша оборван на позиции %d, хвост отброшен", offset)
+			break
+		}
+		data := payload[:len(payload)-4]
+		checksum := crc32.ChecksumIEEE(header)
+		checksum = crc32.Update(checksum, crc32.IEEETable, data)
+		if checksum != binary.BigEndian.Uint32(payload[len(payload)-4:]) {
+			log.Printf("⚠️  Запись журнала кеша на позиции %d повреждена, хвост отброшен", offset)
+			break
+		}
+		key := string(data[:keyLen])
+		switch header[0] {
+		case cacheLogPut:
+			values[key] = data[keyLen:]
+		case cacheLogDelete:
+			delete(values, key)
 		}
+		offset += int64(len(header) + len(payload))
+		records++
 	}
-
-	return body
+	if err := s.file.Truncate(offset); err != nil {
+		return nil, err
+	}
+	if _, err := s.file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	s.records = records
+	s.keys = make(map[string]struct{}, len(values))
+	for key := range values {
+		s.keys[key] = struct{}{}
+	}
+	return values, nil
 }
 
-// isJSONContent проверяет, является ли контент JSON
-func isJSONContent(contentType string, body []byte) bool {
-	// Проверяем Content-Type
-	if strings.Contains(strings.ToLower(contentType), "application/json") {
-		return true
+func (s *cacheLogStore) Scan(fn func(key string, value []byte) error) error {
+	s.mutex.Lock()
+	values, err := s.replay()
+	s.mutex.Unlock()
+	if err != nil {
+		return err
 	}
-
-	// Проверяем структуру данных
-	if len(body) == 0 {
-		return false
+	for key, value := range values {
+		if err := fn(key, value); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	// Пробуем распарсить как JSON
-	var js interface{}
-	return json.Unmarshal(body, &js) == nil
+// NeedsCompaction - старых версий и удалений в журнале больше, чем актуальных записей
+func (s *cacheLogStore) NeedsCompaction() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.records > 1000 && s.records > 2*len(s.keys)
 }
 
-// formatJSON форматирует JSON для красивого вывода
-func formatJSON(body []byte) string {
-	var js interface{}
-	if err := json.Unmarshal(body, &js); err != nil {
-		return ""
+// Compact переписывает журнал только с актуальными записями во временный файл и заменяет им журнал
+func (s *cacheLogStore) Compact() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	before := s.records
+	values, err := s.replay()
+	if err != nil {
+		return err
 	}
-
-	formatted, err := json.MarshalIndent(js, "", "  ")
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
-		return ""
+		return err
+	}
+	compacted := &cacheLogStore{path: s.path, file: tmp, keys: make(map[string]struct{}, len(values))}
+	for key, value := range values {
+		if err := compacted.append(cacheLogPut, key, value); err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+		compacted.keys[key] = struct{}{}
 	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	s.file.Close()
+	s.file, s.keys, s.records = tmp, compacted.keys, compacted.records
+	log.Printf("🗜️  Журнал кеша сжат: %d -> %d записей", before, s.records)
+	return nil
+}
 
-	return string(formatted)
+func (s *cacheLogStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.file.Close()
 }
 
-// Остальные вспомогательные функции
-func decompressGzip(data []byte) ([]byte, error) {
-	reader, err := gzip.NewReader(bytes.NewReader(data))
-	if err != nil {
-		return nil, err
-	}
-	defer reader.Close()
+// CachePeerSettings обмен записями кеша между экземплярами прокси за балансировщиком
+type CachePeerSettings struct {
+	Peers   []string      // Экземпляры, которым рассылаются новые записи (CACHE_PEERS)
+	Primary string        // Экземпляр, у которого запрашиваются промахи (CACHE_PRIMARY)
+	Token   string        // Общий секрет заголовка X-Proxy-Peer-Token (CACHE_PEER_TOKEN)
+	Timeout time.Duration // Таймаут запросов к соседям (CACHE_PEER_TIMEOUT)
+}
 
-	return io.ReadAll(reader)
+// cachePeerUpdate запись кеша для рассылки соседям
+type cachePeerUpdate struct {
+	key   string
+	entry *CacheEntry
 }
 
-func compressGzip(data []byte) ([]byte, error) {
-	var buf bytes.Buffer
-	writer := gzip.NewWriter(&buf)
+const cachePeerTokenHeader = "X-Proxy-Peer-Token"
 
-	_, err := writer.Write(data)
-	if err != nil {
-		writer.Close()
-		return nil, err
-	}
+// cachePeerMaxEntry максимальный размер записи, принимаемой от соседа
+const cachePeerMaxEntry = 64 << 20
 
-	err = writer.Close()
-	if err != nil {
-		return nil, err
+var cachePeerSettings CachePeerSettings
+var cachePeerClient *http.Client
+var cachePeerQueue chan cachePeerUpdate
+var cachePeerPushed int64     // Записи, отправленные соседям (атомарный)
+var cachePeerPushFailed int64 // Неудачные отправки (атомарный)
+var cachePeerDropped int64    // Записи, не отправленные из-за переполненной очереди (атомарный)
+var cachePeerReceived int64   // Записи, полученные от соседей (атомарный)
+var cachePrimaryHits int64    // Промахи, найденные у основного экземпляра (атомарный)
+var cachePrimaryMisses int64  // Промахи, которых нет и у основного экземпляра (атомарный)
+var cachePrimaryErrors int64  // Ошибки запросов к основному экземпляру (атомарный)
+var cachePeerServed int64     // Записи, отданные соседям по запросу (атомарный)
+
+func setupCachePeers() {
+	for _, peer := range strings.Split(os.Getenv("CACHE_PEERS"), ",") {
+		if peer = strings.TrimRight(strings.TrimSpace(peer), "/"); peer != "" {
+			cachePeerSettings.Peers = append(cachePeerSettings.Peers, peer)
+		}
+	}
+	cachePeerSettings.Primary = strings.TrimRight(strings.TrimSpace(os.Getenv("CACHE_PRIMARY")), "/")
+	cachePeerSettings.Token = os.Getenv("CACHE_PEER_TOKEN")
+	cachePeerSettings.Timeout = 2 * time.Second
+	if value := os.Getenv("CACHE_PEER_TIMEOUT"); value != "" {
+		if timeout, err := time.ParseDuration(value); err == nil && timeout > 0 {
+			cachePeerSettings.Timeout = timeout
+		} else {
+			log.Printf("⚠️  Неверный CACHE_PEER_TIMEOUT: %s, используется 2s", value)
+		}
+	}
+	if len(cachePeerSettings.Peers) == 0 && cachePeerSettings.Primary == "" {
+		return
+	}
+	// Без общего секрета эндпоинт отдавал бы любому клиенту закешированные ответы, в том числе на запросы с авторизацией
+	if cachePeerSettings.Token == "" {
+		log.Printf("⚠️  CACHE_PEER_TOKEN не задан: обмен кешем между экземплярами отключен")
+		cachePeerSettings.Peers = nil
+		cachePeerSettings.Primary = ""
+		return
 	}
 
-	return buf.Bytes(), nil
+	// Соседи - экземпляры прокси в той же сети: без upstream прокси и настроек TLS сервера
+	cachePeerClient = &http.Client{Timeout: cachePeerSettings.Timeout}
+	if len(cachePeerSettings.Peers) > 0 {
+		cachePeerQueue = make(chan cachePeerUpdate, 1000)
+		go cachePeerWorker()
+	}
 }
 
-func min(a, b int) int {
-	if a < b {
-		return a
+func printCachePeerSettings() {
+	log.Printf("🔗 Обмен кешем между экземплярами:")
+	if len(cachePeerSettings.Peers) > 0 || cachePeerSettings.Primary != "" {
+		if len(cachePeerSettings.Peers) > 0 {
+			log.Printf("   Peers: %v", cachePeerSettings.Peers)
+		}
+		if cachePeerSettings.Primary != "" {
+			log.Printf("   Primary: %s", cachePeerSettings.Primary)
+		}
+		log.Printf("   Token: %v", cachePeerSettings.Token != "")
+		log.Printf("   Timeout: %v", cachePeerSettings.Timeout)
+		if !cacheSettings.Enabled {
+			log.Printf("   ⚠️  CACHE_TTL не задан - обмен работает только для маршрутов с кешем")
+		}
+	} else {
+		log.Printf("   Enabled: ❌")
 	}
-	return b
+	log.Printf("")
+	log.Printf("🔧 Переменные окружения для обмена кешем:")
+	log.Printf("   - CACHE_PEERS=http://proxy-2:8080,http://proxy-3:8080 - рассылать новые записи соседям")
+	log.Printf("   - CACHE_PRIMARY=http://proxy-1:8080 - при промахе запрашивать запись у основного экземпляра")
+	log.Printf("   - CACHE_PEER_TOKEN=secret - общий секрет для /_proxy/cache/peer")
+	log.Printf("   - CACHE_PEER_TIMEOUT=2s - таймаут запросов к соседям")
+	log.Printf("")
 }
 
-func truncateString(s string, maxLen int) string {
-	if len(s) <= maxLen {
-		return s
+// replicateCacheEntry ставит новую запись в очередь рассылки; при переполнении запись не отправляется
+func replicateCacheEntry(key string, entry *CacheEntry) {
+	if cachePeerQueue == nil {
+		return
+	}
+	select {
+	case cachePeerQueue <- cachePeerUpdate{key: key, entry: entry}:
+	default:
+		atomic.AddInt64(&cachePeerDropped, 1)
 	}
-	return s[:maxLen] + "... [truncated]"
 }
 
-func copyHeaders(dst, src http.Header) {
-	for name, values := range src {
-		if shouldSkipHeader(name) {
+// cachePeerWorker рассылает записи соседям по одной; сосед, который недоступен, пропускается
+func cachePeerWorker() {
+	for update := range cachePeerQueue {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(update.entry); err != nil {
+			log.Printf("⚠️  Ошибка кодирования записи кеша для соседей: %v", err)
 			continue
 		}
-		for _, value := range values {
-			dst.Add(name, value)
+		for _, peer := range cachePeerSettings.Peers {
+			if err := pushCacheEntry(peer, update.key, buf.Bytes()); err != nil {
+				atomic.AddInt64(&cachePeerPushFailed, 1)
+				log.Printf("⚠️  Запись кеша не отправлена %s: %v", peer, err)
+				continue
+			}
+			atomic.AddInt64(&cachePeerPushed, 1)
 		}
 	}
 }
 
-func shouldSkipHeader(name string) bool {
-	skipHeaders := []string{
-		"Connection",
-		"Proxy-Connection",
-		"Proxy-Authenticate",
-		"Proxy-Authorization",
-		"Te",
-		"Trailer",
-		"Upgrade",
+func pushCacheEntry(peer, key string, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPut, peer+"/_proxy/cache/peer?key="+url.QueryEscape(key), bytes.NewReader(payload))
+	if err != nil {
+		return err
 	}
-
-	// В стриминговом режиме НЕ пропускаем Transfer-Encoding
-	if !logSettings.EnableStreaming {
-		skipHeaders = append(skipHeaders, "Transfer-Encoding")
+	req.Header.Set("Content-Type", "application/x-gob")
+	if cachePeerSettings.Token != "" {
+		req.Header.Set(cachePeerTokenHeader, cachePeerSettings.Token)
 	}
-
-	lowerName := strings.ToLower(name)
-	for _, skipHeader := range skipHeaders {
-		if lowerName == strings.ToLower(skipHeader) {
-			return true
-		}
+	resp, err := cachePeerClient.Do(req)
+	if err != nil {
+		return err
 	}
-	return false
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("статус %d", resp.StatusCode)
+	}
+	return nil
 }
 
-// generateCacheKey генерирует ключ кеша на основе метода, URL и заголовков
-func generateCacheKey(method, url string, headers http.Header) string {
-	h := sha256.New()
-	h.Write([]byte(method))
-	h.Write([]byte(url))
-
-	// Добавляем важные заголовки в ключ кеша
-	if auth := headers.Get("Authorization"); auth != "" {
-		h.Write([]byte("Authorization:"))
-		h.Write([]byte(auth))
+// fetchFromPrimary запрашивает запись, которой нет в локальном кеше, у основного экземпляра
+// и сохраняет ее локально без повторной рассылки
+func fetchFromPrimary(key string) *CacheEntry {
+	if cachePeerSettings.Primary == "" {
+		return nil
 	}
-	if contentType := headers.Get("Content-Type"); contentType != "" {
-		h.Write([]byte("Content-Type:"))
-		h.Write([]byte(contentType))
+	req, err := http.NewRequest(http.MethodGet, cachePeerSettings.Primary+"/_proxy/cache/peer?key="+url.QueryEscape(key), nil)
+	if err != nil {
+		return nil
 	}
-
-	// Добавляем дополнительные заголовки из настроек
-	for _, headerName := range cacheSettings.KeyHeaders {
-		if headerValue := headers.Get(headerName); headerValue != "" {
-			h.Write([]byte(headerName + ":"))
-			h.Write([]byte(headerValue))
-		}
+	if cachePeerSettings.Token != "" {
+		req.Header.Set(cachePeerTokenHeader, cachePeerSettings.Token)
 	}
-
-	return hex.EncodeToString(h.Sum(nil))
+	resp, err := cachePeerClient.Do(req)
+	if err != nil {
+		atomic.AddInt64(&cachePrimaryErrors, 1)
+		log.Printf("⚠️  Основной экземпляр кеша недоступен: %v", err)
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		atomic.AddInt64(&cachePrimaryMisses, 1)
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		atomic.AddInt64(&cachePrimaryErrors, 1)
+		log.Printf("⚠️  Основной экземпляр кеша ответил %d", resp.StatusCode)
+		return nil
+	}
+	var entry CacheEntry
+	if err := gob.NewDecoder(resp.Body).Decode(&entry); err != nil {
+		atomic.AddInt64(&cachePrimaryErrors, 1)
+		log.Printf("⚠️  Ошибка декодирования записи от основного экземпляра: %v", err)
+		return nil
+	}
+	if !time.Now().Before(entry.ExpiresAt) {
+		atomic.AddInt64(&cachePrimaryMisses, 1)
+		return nil
+	}
+	responseCache.Store(key, &entry)
+	markCacheDirty(key)
+	atomic.AddInt64(&cachePrimaryHits, 1)
+	log.Printf("🔗 Запись кеша получена от основного экземпляра %s", cachePeerSettings.Primary)
+	return &entry
 }
 
-// getCachedResponse получает ответ из кеша
-func getCachedResponse(key string) *CacheEntry {
-	if val, ok := responseCache.Load(key); ok {
-		entry := val.(*CacheEntry)
+// handleCachePeer обмен записями с соседями: GET ?key= отдает запись (404 - нет), PUT ?key= сохраняет
+// присланную запись. Полученные записи дальше не рассылаются
+//
+// Эндпоинт доступен, только если задан CACHE_PEER_TOKEN; GET и PUT принимаются только с этим токеном
+func handleCachePeer(w http.ResponseWriter, r *http.Request) {
+	if cachePeerSettings.Token == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !hmac.Equal([]byte(r.Header.Get(cachePeerTokenHeader)), []byte(cachePeerSettings.Token)) {
+		http.Error(w, "Неверный X-Proxy-Peer-Token", http.StatusForbidden)
+		return
+	}
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "Не указан key", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		entry := getCachedResponse(key)
+		if entry == nil {
+			http.Error(w, "Записи нет в кеше", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-gob")
+		if err := gob.NewEncoder(w).Encode(entry); err != nil {
+			requestLogf(r, "⚠️  Ошибка отправки записи кеша соседу: %v", err)
+			return
+		}
+		atomic.AddInt64(&cachePeerServed, 1)
+	case http.MethodPut:
+		var entry CacheEntry
+		if err := gob.NewDecoder(http.MaxBytesReader(w, r.Body, cachePeerMaxEntry)).Decode(&entry); err != nil {
+			http.Error(w, "Ошибка декодирования записи: "+err.Error(), http.StatusBadRequest)
+			return
+		}
 		if time.Now().Before(entry.ExpiresAt) {
-			return entry
+			responseCache.Store(key, &entry)
+			markCacheDirty(key)
+			atomic.AddInt64(&cachePeerReceived, 1)
+			requestLogf(r, "🔗 Запись кеша получена от соседа: %s", entry.RequestURL)
 		}
-		// Удаляем устаревшую запись
-		responseCache.Delete(key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Используйте GET или PUT", http.StatusMethodNotAllowed)
 	}
-	return nil
 }
 
-// cacheResponse сохраняет ответ в кеш
-func cacheResponse(key string, statusCode int, headers http.Header, body []byte, url string) {
-	now := time.Now()
-	entry := &CacheEntry{
-		StatusCode:  statusCode,
-		Headers:     cloneHeaders(headers),
-		Body:        body,
-		CachedAt:    now,
-		ExpiresAt:   now.Add(cacheSettings.TTL),
-		RequestURL:  url,
-		RequestHash: key,
+func cachePeerStats() map[string]interface{} {
+	stats := map[string]interface{}{
+		"peers":          cachePeerSettings.Peers,
+		"primary":        cachePeerSettings.Primary,
+		"pushed":         atomic.LoadInt64(&cachePeerPushed),
+		"failed":         atomic.LoadInt64(&cachePeerPushFailed),
+		"dropped":        atomic.LoadInt64(&cachePeerDropped),
+		"received":       atomic.LoadInt64(&cachePeerReceived),
+		"served":         atomic.LoadInt64(&cachePeerServed),
+		"primary_hits":   atomic.LoadInt64(&cachePrimaryHits),
+		"primary_misses": atomic.LoadInt64(&cachePrimaryMisses),
+		"primary_errors": atomic.LoadInt64(&cachePrimaryErrors),
 	}
-	responseCache.Store(key, entry)
-	atomic.StoreInt32(&cacheModified, 1) // Отмечаем, что кеш изменился
-	log.Printf("💾 Ответ сохранен в кеш (срок действия до %s)", entry.ExpiresAt.Format("15:04:05"))
+	if cachePeerQueue != nil {
+		stats["queued"] = len(cachePeerQueue)
+	}
+	return stats
 }
 
-// serveCachedResponse отправляет кешированный ответ клиенту
-func serveCachedResponse(w http.ResponseWriter, entry *CacheEntry) {
-	log.Printf("📥 Response Status: %d (cached)", entry.StatusCode)
+// HealthCheckSettings активные проверки upstream и смонтированных серверов
+type HealthCheckSettings struct {
+	Path       string            // Путь проверки на каждом сервере (HEALTH_CHECK_PATH)
+	URLs       map[string]string // Свой URL проверки для сервера (HEALTH_CHECK_URLS)
+	Interval   time.Duration     // Период проверок (HEALTH_CHECK_INTERVAL)
+	Timeout    time.Duration     // Таймаут одной проверки (HEALTH_CHECK_TIMEOUT)
+	Status     string            // Ожидаемые статусы: 200, 2xx, 200-399, через запятую (HEALTH_CHECK_STATUS)
+	Fall       int               // Неудачных проверок подряд до исключения (HEALTH_CHECK_FALL)
+	Rise       int               // Успешных проверок подряд до возврата (HEALTH_CHECK_RISE)
+	ReadyzPath string            // Путь готовности прокси (HEALTH_READYZ_PATH)
+}
 
-	// Логируем заголовки с отметкой кеша
-	if logSettings.ShowResponseHeaders {
-		logHeaders("📥 Response Headers (cached)", entry.Headers)
-	}
+// HealthTarget состояние проверок одного сервера
+type HealthTarget struct {
+	Name       string // URL upstream или префикс монтирования
+	URL        string // URL проверки
+	mutex      sync.Mutex
+	healthy    bool
+	fails      int // Неудачных проверок подряд
+	successes  int // Успешных проверок подряд
+	lastStatus int
+	lastError  string
+	lastCheck  time.Time
+	latency    time.Duration
+	checks     int64
+	failures   int64
+}
 
-	// Логируем тело с обрезанием
-	if len(entry.Body) > 0 && logSettings.ShowResponseBody {
-		// Принудительно обрезаем кешированные логи
-		contentType := entry.Headers.Get("Content-Type")
-		logCachedBody("📥 Response Body (cached)", entry.Body, contentType, entry.Headers)
+var healthCheckSettings HealthCheckSettings
+var healthTargets []*HealthTarget
+var healthEjections int64 // Исключения серверов после неудачных проверок (атомарный)
+var healthReroutes int64  // Запросы, перенаправленные с исключенного upstream (атомарный)
+
+func setupHealthChecks() {
+	healthCheckSettings = HealthCheckSettings{
+		Path:       os.Getenv("HEALTH_CHECK_PATH"),
+		URLs:       make(map[string]string),
+		Interval:   10 * time.Second,
+		Timeout:    2 * time.Second,
+		Status:     "2xx",
+		Fall:       2,
+		Rise:       1,
+		ReadyzPath: "/readyz",
+	}
+	for _, item := range strings.Split(os.Getenv("HEALTH_CHECK_URLS"), ",") {
+		// Сервер указывается как в PROXY_TARGET или префиксом из PROXY_MOUNTS: /svc-a=http://localhost:3001/ready
+		if parts := strings.SplitN(strings.TrimSpace(item), "=", 2); len(parts) == 2 {
+			healthCheckSettings.URLs[strings.TrimRight(strings.TrimSpace(parts[0]), "/")] = strings.TrimSpace(parts[1])
+		} else if parts[0] != "" {
+			log.Printf("⚠️  Неверная запись HEALTH_CHECK_URLS: %s (ожидается сервер=URL)", item)
+		}
+	}
+	for name, target := range map[string]*time.Duration{"HEALTH_CHECK_INTERVAL": &healthCheckSettings.Interval, "HEALTH_CHECK_TIMEOUT": &healthCheckSettings.Timeout} {
+		if value := os.Getenv(name); value != "" {
+			if duration, err := time.ParseDuration(value); err == nil && duration > 0 {
+				*target = duration
+			} else {
+				log.Printf("⚠️  Неверный %s: %s, используется %v", name, value, *target)
+			}
+		}
+	}
+	for name, target := range map[string]*int{"HEALTH_CHECK_FALL": &healthCheckSettings.Fall, "HEALTH_CHECK_RISE": &healthCheckSettings.Rise} {
+		if value := os.Getenv(name); value != "" {
+			if n, err := strconv.Atoi(value); err == nil && n > 0 {
+				*target = n
+			} else {
+				log.Printf("⚠️  Неверный %s: %s, используется %d", name, value, *target)
+			}
+		}
+	}
+	if value := os.Getenv("HEALTH_CHECK_STATUS"); value != "" {
+		if healthStatusValid(value) {
+			healthCheckSettings.Status = value
+		} else {
+			log.Printf("⚠️  Неверный HEALTH_CHECK_STATUS: %s, используется 2xx", value)
+		}
 	}
-
-	// Копируем заголовки
-	copyHeaders(w.Header(), entry.Headers)
-
-	// Добавляем заголовок о кешировании
-	w.Header().Set("X-Cache", "HIT")
-	w.Header().Set("X-Cache-Expires", entry.ExpiresAt.Format(time.RFC3339))
-
-	// Устанавливаем статус код
-	w.WriteHeader(entry.StatusCode)
-
-	// Отправляем тело
-	w.Write(entry.Body)
-
-	log.Printf("✅ Запрос завершен (из кеша)\n")
-}
-
-// logCachedBody логирует кешированное тело с обрезанием
-func logCachedBody(prefix string, body []byte, contentType string, headers http.Header) {
-	if len(body) == 0 {
-		log.Printf("%s: [Empty]", prefix)
-		return
+	if value, ok := os.LookupEnv("HEALTH_READYZ_PATH"); ok {
+		healthCheckSettings.ReadyzPath = value
 	}
 
-	decompressedBody := decompressIfNeeded(body, headers)
-
-	// Всегда обрезаем для кешированных ответов
-	maxLen := logSettings.MaxLogLength
-	if maxLen == 0 {
-		maxLen = 2000
+	add := func(name string, base *url.URL) *HealthTarget {
+		checkURL, ok := healthCheckSettings.URLs[name]
+		if !ok {
+			if healthCheckSettings.Path == "" {
+				return nil
+			}
+			checkURL = strings.TrimRight(base.String(), "/") + "/" + strings.TrimLeft(healthCheckSettings.Path, "/")
+		}
+		// До первой проверки сервер считается здоровым
+		target := &HealthTarget{Name: name, URL: checkURL, healthy: true}
+		healthTargets = append(healthTargets, target)
+		return target
 	}
+	for _, upstream := range upstreams {
+		upstream.health = add(strings.TrimRight(upstream.URL.String(), "/"), upstream.URL)
+	}
+	for _, mount := range mounts {
+		mount.health = add(mount.Prefix, mount.Target)
+	}
+	for _, target := range healthTargets {
+		go runHealthChecks(target)
+	}
+}
 
-	if utf8.Valid(decompressedBody) {
-		text := string(decompressedBody)
-		if len(text) > maxLen {
-			log.Printf("%s: %s... [truncated, total: %d bytes]", prefix, text[:maxLen], len(text))
-		} else {
-			log.Printf("%s: %s", prefix, text)
+func printHealthCheckSettings() {
+	log.Printf("🩺 Проверки здоровья серверов:")
+	if len(healthTargets) > 0 {
+		for _, target := range healthTargets {
+			log.Printf("   %s → %s", target.Name, target.URL)
+		}
+		log.Printf("   Interval: %v, Timeout: %v", healthCheckSettings.Interval, healthCheckSettings.Timeout)
+		log.Printf("   Status: %s, Fall: %d, Rise: %d", healthCheckSettings.Status, healthCheckSettings.Fall, healthCheckSettings.Rise)
+		if healthCheckSettings.ReadyzPath != "" {
+			log.Printf("   Readyz: %s", healthCheckSettings.ReadyzPath)
 		}
 	} else {
-		log.Printf("%s: [Non-UTF8 data, %d bytes]", prefix, len(decompressedBody))
-		logHexDump(prefix, body)
+		log.Printf("   Enabled: ❌")
 	}
+	log.Printf("")
+	log.Printf("🔧 Переменные окружения для проверок здоровья:")
+	log.Printf("   - HEALTH_CHECK_PATH=/health - проверять этот путь на каждом upstream и смонтированном сервере")
+	log.Printf("   - HEALTH_CHECK_URLS=http://10.0.0.1:8000=http://10.0.0.1:9000/ready,/svc-a=http://localhost:3001/ping - свой URL проверки")
+	log.Printf("   - HEALTH_CHECK_INTERVAL=10s - период проверок")
+	log.Printf("   - HEALTH_CHECK_TIMEOUT=2s - таймаут одной проверки")
+	log.Printf("   - HEALTH_CHECK_STATUS=2xx - ожидаемые статусы (200, 2xx, 200-399, через запятую)")
+	log.Printf("   - HEALTH_CHECK_FALL=2 - неудачных проверок подряд до исключения сервера")
+	log.Printf("   - HEALTH_CHECK_RISE=1 - успешных проверок подряд до возврата сервера")
+	log.Printf("   - HEALTH_READYZ_PATH=/readyz - путь готовности прокси (пусто - только /_proxy/readyz)")
+	log.Printf("")
 }
 
-// cloneHeaders создает копию заголовков
-func cloneHeaders(headers http.Header) http.Header {
-	clone := make(http.Header)
-	for key, values := range headers {
-		clone[key] = append([]string(nil), values...)
+// healthStatusValid проверяет формат HEALTH_CHECK_STATUS
+func healthStatusValid(spec string) bool {
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		switch {
+		case len(item) == 3 && strings.HasSuffix(item, "xx") && item[0] >= '1' && item[0] <= '5':
+		case strings.Contains(item, "-"):
+			bounds := strings.SplitN(item, "-", 2)
+			low, err1 := strconv.Atoi(bounds[0])
+			high, err2 := strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil || low > high {
+				return false
+			}
+		default:
+			if _, err := strconv.Atoi(item); err != nil {
+				return false
+			}
+		}
 	}
-	return clone
+	return true
 }
 
-// getCacheSize возвращает количество записей в кеше
-func getCacheSize() int {
-	size := 0
-	responseCache.Range(func(key, value interface{}) bool {
-		size++
-		return true
-	})
-	return size
+// healthStatusMatches проверяет статус ответа по HEALTH_CHECK_STATUS
+func healthStatusMatches(status int, spec string) bool {
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		switch {
+		case strings.HasSuffix(item, "xx"):
+			if status/100 == int(item[0]-'0') {
+				return true
+			}
+		case strings.Contains(item, "-"):
+			bounds := strings.SplitN(item, "-", 2)
+			low, _ := strconv.Atoi(bounds[0])
+			high, _ := strconv.Atoi(bounds[1])
+			if status >= low && status <= high {
+				return true
+			}
+		default:
+			if code, _ := strconv.Atoi(item); code == status {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-// matchURLPattern проверяет соответствие URL паттерну с поддержкой wildcard (*)
-func matchURLPattern(urlStr string, pattern string) bool {
-	// Экранируем специальные символы regex кроме *
-	pattern = regexp.QuoteMeta(pattern)
-	// Заменяем \* (экранированную звездочку) на .*
-	pattern = strings.ReplaceAll(pattern, "\\*", ".*")
-	// Добавляем ^ и $ для полного совпадения
-	pattern = "^" + pattern + "$"
+// runHealthChecks проверяет сервер сразу при запуске и затем каждые HEALTH_CHECK_INTERVAL
+func runHealthChecks(target *HealthTarget) {
+	ticker := time.NewTicker(healthCheckSettings.Interval)
+	defer ticker.Stop()
+	for {
+		target.probe()
+		<-ticker.C
+	}
+}
 
-	matched, err := regexp.MatchString(pattern, urlStr)
+// probe выполняет одну проверку. Сервер исключается после HEALTH_CHECK_FALL неудач подряд
+// и возвращается после HEALTH_CHECK_RISE успехов подряд
+func (t *HealthTarget) probe() {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckSettings.Timeout)
+	defer cancel()
+	status := 0
+	errText := ""
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.URL, nil)
+	if err == nil {
+		req.Header.Set("User-Agent", "go-proxy-server health check")
+		var resp *http.Response
+		// Проверки идут через тот же клиент, что и запросы: с настройками TLS и upstream прокси
+		if resp, err = httpClient.Do(req); err == nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+			status = resp.StatusCode
+			if !healthStatusMatches(status, healthCheckSettings.Status) {
+				errText = fmt.Sprintf("статус %d, ожидается %s", status, healthCheckSettings.Status)
+			}
+		}
+	}
 	if err != nil {
-		log.Printf("⚠️  Ошибка проверки паттерна '%s': %v", pattern, err)
-		return false
+		errText = err.Error()
+	}
+	latency := time.Since(start)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.checks++
+	t.lastCheck = start
+	t.lastStatus = status
+	t.lastError = errText
+	t.latency = latency
+	if errText != "" {
+		t.failures++
+		t.fails++
+		t.successes = 0
+		if t.healthy && t.fails >= healthCheckSettings.Fall {
+			t.healthy = false
+			atomic.AddInt64(&healthEjections, 1)
+			log.Printf("🩺 ❌ %s исключен: %s (%d неудачных проверок подряд)", t.Name, errText, t.fails)
+		}
+		return
+	}
+	t.successes++
+	t.fails = 0
+	if !t.healthy && t.successes >= healthCheckSettings.Rise {
+		t.healthy = true
+		log.Printf("🩺 ✅ %s снова доступен (%d успешных проверок подряд)", t.Name, t.successes)
 	}
-	return matched
 }
 
-// shouldCacheURL проверяет, нужно ли кешировать данный URL
-func shouldCacheURL(urlStr string) bool {
-	// Если паттерны не заданы - кешируем все
-	if len(cacheSettings.URLPatterns) == 0 {
+// isHealthy сообщает, проходит ли сервер проверки; сервер без проверок всегда здоров
+func (t *HealthTarget) isHealthy() bool {
+	if t == nil {
 		return true
 	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.healthy
+}
 
-	// Проверяем соответствие хотя бы одному паттерну
-	for _, pattern := range cacheSettings.URLPatterns {
-		if matchURLPattern(urlStr, pattern) {
-			return true
+// nextHealthyUpstream возвращает номер следующего за index здорового upstream (-1 - здоровых нет)
+func nextHealthyUpstream(index int) int {
+	for i := 1; i < len(upstreams); i++ {
+		next := (index + i) % len(upstreams)
+		if upstreams[next].health.isHealthy() {
+			return next
 		}
 	}
-
-	return false
+	return -1
 }
 
-// cachePersistenceWorker периодически сохраняет кеш на диск при изменениях
-func cachePersistenceWorker() {
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
+func (t *HealthTarget) stats() map[string]interface{} {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	stats := map[string]interface{}{
+		"name":     t.Name,
+		"url":      t.URL,
+		"healthy":  t.healthy,
+		"checks":   t.checks,
+		"failures": t.failures,
+	}
+	if !t.lastCheck.IsZero() {
+		stats["last_check"] = t.lastCheck.Format(time.RFC3339)
+		stats["last_status"] = t.lastStatus
+		stats["latency_ms"] = t.latency.Milliseconds()
+	}
+	if t.lastError != "" {
+		stats["last_error"] = t.lastError
+	}
+	return stats
+}
 
-	for range ticker.C {
-		// Проверяем, был ли изменен кеш
-		if atomic.LoadInt32(&cacheModified) == 1 {
-			if err := saveCacheToDisk(); err != nil {
-				log.Printf("⚠️  Ошибка сохранения кеша: %v", err)
-			}
-			atomic.StoreInt32(&cacheModified, 0) // Сбрасываем флаг
+// readiness возвращает готовность прокси: есть здоровый upstream (если PROXY_TARGET задан)
+// и все смонтированные серверы здоровы
+func readiness() (bool, []map[string]interface{}) {
+	ready := len(upstreams) == 0
+	for _, upstream := range upstreams {
+		if upstream.health.isHealthy() {
+			ready = true
+		}
+	}
+	for _, mount := range mounts {
+		if !mount.health.isHealthy() {
+			ready = false
 		}
 	}
+	targets := make([]map[string]interface{}, 0, len(healthTargets))
+	for _, target := range healthTargets {
+		targets = append(targets, target.stats())
+	}
+	return ready, targets
 }
 
-// CacheSnapshot структура для сериализации кеша
-type CacheSnapshot struct {
-	Entries   map[string]*CacheEntry
-	SavedAt   time.Time
-	CacheHits int64
-	CacheMiss int64
+// handleReadyz отвечает 200, когда прокси может обслуживать запросы, иначе 503
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ready, targets := readiness()
+	status := "ready"
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !ready {
+		status = "unavailable"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  status,
+		"targets": targets,
+	})
 }
 
-// saveCacheToDisk сохраняет кеш на диск в формате gob + gzip
-func saveCacheToDisk() error {
-	snapshot := CacheSnapshot{
-		Entries:   make(map[string]*CacheEntry),
-		SavedAt:   time.Now(),
-		CacheHits: atomic.LoadInt64(&cacheHits),
-		CacheMiss: atomic.LoadInt64(&cacheMisses),
+func healthCheckStats() map[string]interface{} {
+	ready, targets := readiness()
+	return map[string]interface{}{
+		"enabled":   len(healthTargets) > 0,
+		"interval":  healthCheckSettings.Interval.String(),
+		"status":    healthCheckSettings.Status,
+		"ready":     ready,
+		"ejections": atomic.LoadInt64(&healthEjections),
+		"reroutes":  atomic.LoadInt64(&healthReroutes),
+		"targets":   targets,
 	}
+}
 
-	// Собираем все записи из sync.Map
-	count := 0
-	responseCache.Range(func(key, value interface{}) bool {
-		keyStr := key.(string)
-		entry := value.(*CacheEntry)
+// MaintenanceSettings режим обслуживания: прокси отвечает на все запросы, кроме служебных,
+// заданным ответом, пока серверы перевыкладываются
+type MaintenanceSettings struct {
+	Enabled     bool      `json:"enabled"`
+	Status      int       `json:"status"`       // Статус ответа (MAINTENANCE_STATUS)
+	Body        string    `json:"body"`         // Тело ответа (MAINTENANCE_BODY)
+	ContentType string    `json:"content_type"` // MAINTENANCE_CONTENT_TYPE
+	RetryAfter  string    `json:"retry_after"`  // Заголовок Retry-After, пусто - не отправляется (MAINTENANCE_RETRY_AFTER)
+	ServeCache  bool      `json:"serve_cache"`  // Отвечать из кеша, если запись есть (MAINTENANCE_SERVE_CACHE)
+	Since       time.Time `json:"since,omitempty"`
+}
 
-		// Сохраняем только актуальные записи
-		if time.Now().Before(entry.ExpiresAt) {
-			snapshot.Entries[keyStr] = entry
-			count++
-		}
-		return true
-	})
+const defaultMaintenanceBody = `{"error":"maintenance","message":"Сервис временно недоступен: идут технические работы"}`
 
-	if count == 0 {
-		// Если нет актуальных записей, удаляем файл
-		if _, err := os.Stat(cachePersistFile); err == nil {
-			os.Remove(cachePersistFile)
-			log.Printf("🗑️  Файл кеша удален (нет актуальных записей)")
+var maintenance atomic.Pointer[MaintenanceSettings]
+var maintenanceRejected int64 // Запросы, получившие ответ режима обслуживания (атомарный)
+var maintenanceCached int64   // Запросы, обслуженные из кеша в режиме обслуживания (атомарный)
+
+func setupMaintenance() {
+	settings := &MaintenanceSettings{
+		Enabled:     os.Getenv("MAINTENANCE_MODE") == "true",
+		Status:      http.StatusServiceUnavailable,
+		Body:        defaultMaintenanceBody,
+		ContentType: "application/json; charset=utf-8",
+		RetryAfter:  os.Getenv("MAINTENANCE_RETRY_AFTER"),
+		ServeCache:  os.Getenv("MAINTENANCE_SERVE_CACHE") == "true",
+	}
+	if value := os.Getenv("MAINTENANCE_STATUS"); value != "" {
+		if status, err := strconv.Atoi(value); err == nil && status >= 200 && status <= 599 {
+			settings.Status = status
+		} else {
+			log.Printf("⚠️  Неверный MAINTENANCE_STATUS: %s, используется 503", value)
 		}
-		return nil
 	}
-
-	// Кодируем в gob
-	var gobBuf bytes.Buffer
-	encoder := gob.NewEncoder(&gobBuf)
-	if err := encoder.Encode(snapshot); err != nil {
-		return err
+	if value := os.Getenv("MAINTENANCE_BODY"); value != "" {
+		settings.Body = value
+		settings.ContentType = "text/plain; charset=utf-8"
 	}
-
-	// Сжимаем с помощью gzip (используем существующую функцию)
-	gzipData, err := compressGzip(gobBuf.Bytes())
-	if err != nil {
-		return err
+	if value := os.Getenv("MAINTENANCE_CONTENT_TYPE"); value != "" {
+		settings.ContentType = value
 	}
-
-	// Сохраняем в файл
-	if err := os.WriteFile(cachePersistFile, gzipData, 0644); err != nil {
-		return err
+	if settings.Enabled {
+		settings.Since = time.Now()
 	}
+	maintenance.Store(settings)
+}
 
-	log.Printf("💾 Кеш сохранен на диск: %d записей (gob: %d bytes, gzip: %d bytes)",
-		count, gobBuf.Len(), len(gzipData))
-	return nil
+func printMaintenanceSettings() {
+	settings := maintenance.Load()
+	log.Printf("🛠️  Режим обслуживания:")
+	if settings.Enabled {
+		log.Printf("   Enabled: ✅ (статус %d)", settings.Status)
+	} else {
+		log.Printf("   Enabled: ❌ (включается через /_proxy/maintenance)")
+	}
+	log.Printf("   Serve cache: %v", settings.ServeCache)
+	if settings.RetryAfter != "" {
+		log.Printf("   Retry-After: %s", settings.RetryAfter)
+	}
+	log.Printf("")
+	log.Printf("🔧 Переменные окружения для режима обслуживания:")
+	log.Printf("   - MAINTENANCE_MODE=true - включить режим обслуживания при запуске")
+	log.Printf("   - MAINTENANCE_STATUS=503 - статус ответа")
+	log.Printf("   - MAINTENANCE_BODY='Идут работы' - тело ответа (по умолчанию JSON)")
+	log.Printf("   - MAINTENANCE_CONTENT_TYPE=text/html - Content-Type ответа")
+	log.Printf("   - MAINTENANCE_RETRY_AFTER=120 - заголовок Retry-After")
+	log.Printf("   - MAINTENANCE_SERVE_CACHE=true - отвечать из кеша, если запись есть")
+	log.Printf("")
 }
 
-// loadCacheFromDisk загружает кеш из файла (gob + gzip)
-func loadCacheFromDisk() {
-	// Проверяем существование файла
-	if _, err := os.Stat(cachePersistFile); os.IsNotExist(err) {
-		log.Printf("📂 Файл кеша не найден: %s", cachePersistFile)
-		return
+// stageMaintenance в режиме обслуживания отвечает заданным ответом; с serve_cache сначала
+// ищется запись в кеше маршрута. Правила, точки останова и сервер не задействуются
+func stageMaintenance(x *ProxyExchange) bool {
+	settings := maintenance.Load()
+	if !settings.Enabled {
+		return true
+	}
+	if settings.ServeCache {
+		if cached := lookupMaintenanceCache(x); cached != nil {
+			atomic.AddInt64(&maintenanceCached, 1)
+			requestLogf(x.R, "🛠️  Режим обслуживания: ответ из кеша (срок действия до %s)", cached.ExpiresAt.Format("15:04:05"))
+			serveCacheHit(x, cached)
+			return false
+		}
+	}
+	atomic.AddInt64(&maintenanceRejected, 1)
+	requestLogf(x.R, "🛠️  Режим обслуживания: %s %s → %d", x.R.Method, x.FullURL, settings.Status)
+	w := x.W
+	w.Header().Set("Content-Type", settings.ContentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Proxy-Maintenance", "true")
+	if settings.RetryAfter != "" {
+		w.Header().Set("Retry-After", settings.RetryAfter)
+	}
+	var body []byte
+	if x.R.Method != http.MethodHead {
+		body = []byte(settings.Body)
 	}
+	writeResponse(w, x.R, settings.Status, body, nil)
+	return false
+}
 
-	// Читаем файл
-	gzipData, err := os.ReadFile(cachePersistFile)
-	if err != nil {
-		log.Printf("⚠️  Ошибка чтения файла кеша: %v", err)
-		return
+// lookupMaintenanceCache ищет запись кеша только на чтение: в режиме обслуживания запрос не уходит
+// к серверу, поэтому промах не считается и не занимает блокировку объединения промахов
+func lookupMaintenanceCache(x *ProxyExchange) *CacheEntry {
+	cache := x.Route.Cache
+	if !cache.Enabled || cache.isExcluded(x.ProxyURL.String()) {
+		return nil
 	}
+	cacheKey := namespacedCacheKey(cacheNamespace(x.R, x.ProxyURL.String()), generateCacheKey(x.R.Method, x.ProxyURL.String(), x.R.Header, cache.KeyHeaders))
+	if cached := getCachedResponse(cacheKey); cached != nil {
+		return cached
+	}
+	return fetchFromPrimary(cacheKey)
+}
 
-	// Распаковываем gzip (используем существующую функцию)
-	gobData, err := decompressGzip(gzipData)
-	if err != nil {
-		log.Printf("⚠️  Ошибка распаковки gzip: %v", err)
+// handleMaintenance: GET - состояние, POST - включить (JSON тело меняет статус, тело ответа,
+// Retry-After и serve_cache), DELETE - выключить
+func handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	current := maintenance.Load()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		settings := *current
+		if body, _ := io.ReadAll(r.Body); len(bytes.TrimSpace(body)) > 0 {
+			if err := json.Unmarshal(body, &settings); err != nil {
+				http.Error(w, "Неверный JSON: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if settings.Status < 200 || settings.Status > 599 {
+				http.Error(w, "status должен быть от 200 до 599", http.StatusBadRequest)
+				return
+			}
+		}
+		settings.Since = current.Since
+		if !current.Enabled {
+			settings.Since = time.Now()
+		}
+		settings.Enabled = true
+		maintenance.Store(&settings)
+		requestLogf(r, "🛠️  Режим обслуживания включен: запросы получают %d", settings.Status)
+	case http.MethodDelete:
+		settings := *current
+		settings.Enabled = false
+		settings.Since = time.Time{}
+		maintenance.Store(&settings)
+		if current.Enabled {
+			requestLogf(r, "🛠️  Режим обслуживания выключен (длился %v)", time.Since(current.Since).Round(time.Second))
+		}
+	default:
+		http.Error(w, "Используйте GET, POST или DELETE", http.StatusMethodNotAllowed)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(maintenanceStats())
+}
 
-	// Декодируем gob
-	var snapshot CacheSnapshot
-	decoder := gob.NewDecoder(bytes.NewReader(gobData))
-	if err := decoder.Decode(&snapshot); err != nil {
-		log.Printf("⚠️  Ошибка декодирования gob: %v", err)
-		return
+func maintenanceStats() map[string]interface{} {
+	settings := maintenance.Load()
+	stats := map[string]interface{}{
+		"enabled":     settings.Enabled,
+		"status":      settings.Status,
+		"serve_cache": settings.ServeCache,
+		"rejected":    atomic.LoadInt64(&maintenanceRejected),
+		"from_cache":  atomic.LoadInt64(&maintenanceCached),
 	}
+	if settings.Enabled {
+		stats["since"] = settings.Since.Format(time.RFC3339)
+	}
+	return stats
+}
 
-	// Загружаем записи
-	loaded := 0
-	expired := 0
-	now := time.Now()
+// cacheFetch запрос к серверу за отсутствующей в кеше записью; done закрывается после сохранения ответа
+type cacheFetch struct {
+	done    chan struct{}
+	waiters int // Запросы, ждущие этого ответа (защищены cacheFetchMutex)
+}
 
-	for key, entry := range snapshot.Entries {
-		// Проверяем актуальность записи
-		if now.Before(entry.ExpiresAt) {
-			responseCache.Store(key, entry)
-			loaded++
-		} else {
-			expired++
-		}
+const maxCacheContentionKeys = 200 // URL в статистике одновременных промахов, остальные - в "other"
+
+var cacheFetches = make(map[string]*cacheFetch) // Защищены cacheFetchMutex
+var cacheContention = make(map[string]int64)    // Одновременные промахи по URL (защищены cacheFetchMutex)
+var cacheFetchMutex sync.Mutex
+var cacheConcurrentMisses int64 // Промахи, пришедшие, пока запись уже запрашивается у сервера (атомарный)
+var cacheCoalesced int64        // Запросы к серверу, сэкономленные ожиданием чужого ответа (атомарный)
+var cacheLockTimeouts int64     // Ожидания, прерванные CACHE_LOCK_TIMEOUT (атомарный)
+
+// coalesceCacheMiss отмечает промах по ключу. Первый промах запрашивает сервер и держит блокировку
+// до конца обработки; следующие с CACHE_COALESCE ждут его ответа не дольше CACHE_LOCK_TIMEOUT.
+// Возвращает false, если ответ клиенту уже отправлен (из кеша после ожидания или клиент отключился)
+func coalesceCacheMiss(x *ProxyExchange, cacheKey string) bool {
+	cacheFetchMutex.Lock()
+	fetch, inFlight := cacheFetches[cacheKey]
+	if !inFlight {
+		fetch = &cacheFetch{done: make(chan struct{})}
+		cacheFetches[cacheKey] = fetch
+		cacheFetchMutex.Unlock()
+		x.Defer(func() {
+			cacheFetchMutex.Lock()
+			delete(cacheFetches, cacheKey)
+			cacheFetchMutex.Unlock()
+			close(fetch.done)
+		})
+		return true
+	}
+	label := x.ProxyURL.String()
+	if _, ok := cacheContention[label]; !ok && len(cacheContention) >= maxCacheContentionKeys {
+		label = "other"
 	}
+	cacheContention[label]++
+	cacheFetchMutex.Unlock()
+	atomic.AddInt64(&cacheConcurrentMisses, 1)
 
-	// Восстанавливаем статистику
-	if loaded > 0 {
-		atomic.StoreInt64(&cacheHits, snapshot.CacheHits)
-		atomic.StoreInt64(&cacheMisses, snapshot.CacheMiss)
+	if !cacheSettings.Coalesce {
+		return true
+	}
+	cacheFetchMutex.Lock()
+	fetch.waiters++
+	cacheFetchMutex.Unlock()
+	defer func() {
+		cacheFetchMutex.Lock()
+		fetch.waiters--
+		cacheFetchMutex.Unlock()
+	}()
+	timer := time.NewTimer(cacheSettings.LockTimeout)
+	defer timer.Stop()
+	select {
+	case <-fetch.done:
+	case <-timer.C:
+		atomic.AddInt64(&cacheLockTimeouts, 1)
+		requestLogf(x.R, "⏱️  Ответ для %s не получен за %v, запрос идет на сервер параллельно", label, cacheSettings.LockTimeout)
+		return true
+	case <-x.R.Context().Done():
+		requestLogf(x.R, "⚠️  Клиент отключился во время ожидания записи кеша")
+		return false
 	}
 
-	log.Printf("✅ Кеш восстановлен из файла: %s", cachePersistFile)
-	log.Printf("   Загружено записей: %d", loaded)
-	if expired > 0 {
-		log.Printf("   Пропущено устаревших: %d", expired)
+	// Ответ мог не попасть в кеш (206, 304, клиент отключился) - тогда запрос идет на сервер
+	cached := getCachedResponse(cacheKey)
+	if cached == nil {
+		return true
+	}
+	atomic.AddInt64(&cacheCoalesced, 1)
+	atomic.AddInt64(&cacheHits, 1)
+	requestLogf(x.R, "💾 Ответ из кеша после ожидания одновременного запроса к серверу")
+	serveCacheHit(x, cached)
+	return false
+}
+
+func cacheCoalescingStats() map[string]interface{} {
+	cacheFetchMutex.Lock()
+	inFlight := len(cacheFetches)
+	waiting := 0
+	for _, fetch := range cacheFetches {
+		waiting += fetch.waiters
+	}
+	contention := make(map[string]int64, len(cacheContention))
+	for label, count := range cacheContention {
+		contention[label] = count
+	}
+	cacheFetchMutex.Unlock()
+	return map[string]interface{}{
+		"enabled":           cacheSettings.Coalesce,
+		"lock_timeout":      cacheSettings.LockTimeout.String(),
+		"in_flight":         inFlight,
+		"waiting":           waiting,
+		"concurrent_misses": atomic.LoadInt64(&cacheConcurrentMisses),
+		"saved_fetches":     atomic.LoadInt64(&cacheCoalesced),
+		"lock_timeouts":     atomic.LoadInt64(&cacheLockTimeouts),
+		"by_url":            contention,
 	}
-	log.Printf("   Сохранен: %s", snapshot.SavedAt.Format("2006-01-02 15:04:05"))
-	log.Printf("   Статистика: hits=%d, misses=%d", snapshot.CacheHits, snapshot.CacheMiss)
-	log.Printf("   Размер файла: gzip=%d bytes, распаковано gob=%d bytes", len(gzipData), len(gobData))
 }
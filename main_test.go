@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// msgpackStr кодирует fixstr MessagePack
+func msgpackStr(s string) []byte {
+	return append([]byte{0xa0 | byte(len(s))}, s...)
+}
+
+// cborStr кодирует короткую текстовую строку CBOR
+func cborStr(s string) []byte {
+	return append([]byte{0x60 | byte(len(s))}, s...)
+}
+
+func TestBinaryReplacementsPreserveTypes(t *testing.T) {
+	msgpackBody := func(text string, half float32) []byte {
+		body := []byte{0x85}
+		body = append(append(body, msgpackStr("s")...), msgpackStr(text)...)
+		body = append(append(body, msgpackStr("f")...), 0xcb)
+		body = binary.BigEndian.AppendUint64(body, math.Float64bits(1.0))
+		body = append(append(body, msgpackStr("h")...), 0xca)
+		body = binary.BigEndian.AppendUint32(body, math.Float32bits(half))
+		body = append(append(body, msgpackStr("b")...), 0xc4, 3, 1, 2, 3)
+		body = append(append(body, msgpackStr("e")...), 0xd4, 5, 7)
+		return body
+	}
+	cborBody := func(text string, half float32) []byte {
+		body := []byte{0xa4}
+		body = append(append(body, cborStr("s")...), cborStr(text)...)
+		body = append(append(body, cborStr("t")...), 0xc1, 0xfb)
+		body = binary.BigEndian.AppendUint64(body, math.Float64bits(1.0))
+		body = append(append(body, cborStr("h")...), 0xfa)
+		body = binary.BigEndian.AppendUint32(body, math.Float32bits(half))
+		body = append(append(body, cborStr("b")...), 0x43, 1, 2, 3)
+		return body
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		find        string
+		replace     string
+		want        []byte
+	}{
+		{"msgpack string", "application/msgpack", msgpackBody("hello", 1.5), "hello", "world", msgpackBody("world", 1.5)},
+		{"msgpack float32", "application/msgpack", msgpackBody("hello", 1.5), `"h":1.5`, `"h":2.5`, msgpackBody("hello", 2.5)},
+		{"msgpack untouched", "application/msgpack", msgpackBody("hello", 1.5), "missing", "x", msgpackBody("hello", 1.5)},
+		{"cbor string", "application/cbor", cborBody("hello", 1.5), "hello", "world", cborBody("world", 1.5)},
+		{"cbor float32", "application/cbor", cborBody("hello", 1.5), `"h":1.5`, `"h":2.5`, cborBody("hello", 2.5)},
+		{"cbor untouched", "application/cbor", cborBody("hello", 1.5), "missing", "x", cborBody("hello", 1.5)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replacements := []BodyReplacement{{Find: tt.find, Replace: tt.replace}}
+			got, ok := applyBinaryJSONReplacements(tt.body, tt.contentType, replacements)
+			if !ok {
+				t.Fatal("replacements were not applied")
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("got % x\nwant % x", got, tt.want)
+			}
+		})
+	}
+}
+
+// parallelOverrideMatches отправляет n параллельных запросов в findMatchingOverride с правилом из rule
+// и возвращает правило вместе с числом срабатываний
+func parallelOverrideMatches(t *testing.T, rule string, n int) (*ResponseOverride, int64) {
+	t.Helper()
+	loaded, ok := parseConfig([]byte(`{"overrides": [` + rule + `]}`))
+	if !ok || len(loaded.Overrides) != 1 {
+		t.Fatalf("failed to parse rule %s", rule)
+	}
+	ctx := context.WithValue(context.Background(), configSnapshotKey{}, &loaded)
+
+	var triggered int64
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodGet, "/counter", nil).WithContext(ctx)
+			if override := findMatchingOverride(r.Method, r.URL.Path, "", r); override != nil {
+				atomic.AddInt64(&triggered, 1)
+				atomic.AddInt64(&override.activeTriggers, -1)
+			}
+		}()
+	}
+	wg.Wait()
+	return &loaded.Overrides[0], triggered
+}
+
+func TestOverrideCountersConcurrent(t *testing.T) {
+	const n = 100
+
+	t.Run("trigger_after", func(t *testing.T) {
+		override, triggered := parallelOverrideMatches(t,
+			`{"name": "after", "enabled": true, "method": "GET", "url_pattern": "/counter", "trigger_after": 10}`, n)
+		if triggered != n-10 {
+			t.Errorf("triggered %d times, want %d", triggered, n-10)
+		}
+		if got := atomic.LoadInt64(&override.matchCount); got != n {
+			t.Errorf("match_count = %d, want %d", got, n)
+		}
+		if got := override.triggerCount(); got != n-10 {
+			t.Errorf("trigger_count = %d, want %d", got, n-10)
+		}
+	})
+
+	t.Run("max_triggers", func(t *testing.T) {
+		override, triggered := parallelOverrideMatches(t,
+			`{"name": "limited", "enabled": true, "method": "GET", "url_pattern": "/counter", "max_triggers": 7}`, n)
+		if triggered != 7 {
+			t.Errorf("triggered %d times, want 7", triggered)
+		}
+		if got := atomic.LoadInt64(&override.matchCount); got != n {
+			t.Errorf("match_count = %d, want %d", got, n)
+		}
+		if got := override.requestCount(); got != n {
+			t.Errorf("request_count = %d, want %d", got, n)
+		}
+	})
+
+	t.Run("reset_after", func(t *testing.T) {
+		// Запрос, опоздавший в уже завершенный цикл, отклоняется, поэтому точное число
+		// срабатываний зависит от планировщика: проверяются границы
+		override, triggered := parallelOverrideMatches(t,
+			`{"name": "cycle", "enabled": true, "method": "GET", "url_pattern": "/counter", "reset_after": 10, "max_triggers": 3}`, n)
+		if triggered < 3 || triggered > 3*n/10 {
+			t.Errorf("triggered %d times, want between 3 and %d", triggered, 3*n/10)
+		}
+		if got := atomic.LoadInt64(&override.matchCount); got != n {
+			t.Errorf("match_count = %d, want %d", got, n)
+		}
+		if got := override.requestCount(); got != 0 {
+			t.Errorf("request_count = %d, want 0 after %d requests", got, n)
+		}
+	})
+}
+
+func TestWriteStatsPrometheus(t *testing.T) {
+	stats := map[string]interface{}{
+		"rules": []interface{}{
+			map[string]interface{}{"name": "dup", "match_count": 1, "trigger_count": 1},
+			map[string]interface{}{"name": "dup", "match_count": 2, "trigger_count": 0},
+		},
+		"status_codes": map[string]interface{}{`a"b\c`: 3},
+	}
+	var out bytes.Buffer
+	writeStatsPrometheus(&out, stats)
+
+	seenSeries := make(map[string]bool)
+	closedFamilies := make(map[string]bool)
+	current := ""
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if family, ok := strings.CutPrefix(line, "# TYPE "); ok {
+			family = strings.Fields(family)[0]
+			if closedFamilies[family] {
+				t.Errorf("family %s is not contiguous", family)
+			}
+			if current != "" {
+				closedFamilies[current] = true
+			}
+			current = family
+			continue
+		}
+		series := line[:strings.LastIndex(line, " ")]
+		if seenSeries[series] {
+			t.Errorf("duplicate series %s", series)
+		}
+		seenSeries[series] = true
+	}
+
+	if !strings.Contains(out.String(), `key="a\"b\\c"`) {
+		t.Errorf("label value is not escaped:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), `item="dup#1"`) {
+		t.Errorf("duplicate rule name is not indexed:\n%s", out.String())
+	}
+}
+
+func TestRewriteQueryKeepsUntouchedPairs(t *testing.T) {
+	rewrites := []QueryRewrite{
+		{Param: "api_key", Action: "set", Value: "secret"},
+		{Param: "debug*", Action: "remove"},
+		{Param: "env", Action: "replace", Value: "stage-$1", compiledFind: regexp.MustCompile("^prod-(.*)$")},
+	}
+	cases := []struct {
+		query string
+		want  string
+	}{
+		// Ничего не меняется - query без перекодирования и сортировки
+		{"z=1&a=%7e&api_key=secret&b", "z=1&a=%7e&api_key=secret&b"},
+		{"z=%2F&debug=1&env=prod-eu&a=1", "z=%2F&env=stage-eu&a=1&api_key=secret"},
+		{"api_key=old&x=1&api_key=dup", "api_key=secret&x=1"},
+	}
+	for _, tc := range cases {
+		if got := rewriteQuery(tc.query, rewrites); got != tc.want {
+			t.Errorf("rewriteQuery(%q) = %q, want %q", tc.query, got, tc.want)
+		}
+	}
+}